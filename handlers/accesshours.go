@@ -0,0 +1,49 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+	"github.com/vouch/vouch-proxy/pkg/responses"
+)
+
+var errOutsideAccessHours = errors.New("outside permitted access hours")
+
+// now is swapped out by tests
+var now = time.Now
+
+// withinAccessHours checks the `vouch.access_hours` rules covering host
+func withinAccessHours(ctx context.Context, host string) bool {
+	return cfg.FromContext(ctx).AccessHoursAllow(host, now())
+}
+
+// hostOfURL the host of the originally requested URL
+func hostOfURL(requestedURL string) string {
+	u, err := url.Parse(requestedURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// sendOutsideAccessHours 403 from /validate, which isn't cached
+// the cookie is left in place since it may be shared with hosts that are open
+func sendOutsideAccessHours(w http.ResponseWriter, r *http.Request) {
+	metrics.ValidateRequest(metrics.ValidateDenied)
+	responses.Error403KeepCookie(w, r, errOutsideAccessHours.Error(), errOutsideAccessHours)
+}
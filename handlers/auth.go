@@ -11,27 +11,76 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"time"
 
+	"github.com/gorilla/sessions"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/capturewriter"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
 	"github.com/vouch/vouch-proxy/pkg/cookie"
 	"github.com/vouch/vouch-proxy/pkg/domains"
 	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+	"github.com/vouch/vouch-proxy/pkg/providerhealth"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
 	"github.com/vouch/vouch-proxy/pkg/responses"
 	"github.com/vouch/vouch-proxy/pkg/structs"
+	"github.com/vouch/vouch-proxy/pkg/timelog"
+	"github.com/vouch/vouch-proxy/pkg/tracing"
 
 	"golang.org/x/oauth2"
 )
 
+// the user declined consent at the IdP
+// https://tools.ietf.org/html/rfc6749#section-4.1.2.1
+const errAccessDenied = "access_denied"
+
+// reasonProviderRateLimited the 503 reason when the provider answers 429 Too Many Requests
+const reasonProviderRateLimited = "provider_rate_limited"
+
 // CallbackHandler /auth
 // - redirects to /auth/{state}/ with the state coming from the query parameter
 func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debug("/auth")
+	cw := &capturewriter.CaptureWriter{ResponseWriter: w}
+	w = cw
+	defer func() {
+		// a login which carries on to /auth/{state}/ is counted there
+		if cw.StatusCode != http.StatusFound {
+			metrics.Callback(cfg.InstanceOf(r.Context()).GenOAuth.Name, callbackResult(cw.StatusCode))
+			trace.SpanFromContext(r.Context()).SetAttributes(tracing.AttrDecision.String(callbackResult(cw.StatusCode)))
+		} else {
+			trace.SpanFromContext(r.Context()).SetAttributes(tracing.AttrDecision.String("redirect_to_auth_state"))
+		}
+	}()
+
+	// a provider with `response_mode=form_post`, such as Sign in with Apple, posts the callback
+	// which is carried on to /auth/{state}/ as the query, less the id_token which is fetched with the code
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			responses.Error400(w, r, fmt.Errorf("/auth: could not parse the posted callback: %w", err))
+			return
+		}
+		r.PostForm.Del("id_token")
+		r.URL.RawQuery = r.PostForm.Encode()
+	}
 
 	// did the IdP return an error?
 	errorIDP := r.URL.Query().Get("error")
-	if errorIDP != "" {
+	if errorIDP == errAccessDenied && r.URL.Query().Get("state") == "" {
+		// without the state we can't find the session and the originally requested URL
+		audit.Log(r, audit.Login, "", audit.Failure, errAccessDenied)
+		responses.AccessDenied(w, r, "")
+		return
+	}
+	if errorIDP != "" && errorIDP != errAccessDenied {
 		errorDescription := r.URL.Query().Get("error_description")
 		responses.Error401HTTP(w, r, fmt.Errorf("/auth Error from IdP: %s - %s", errorIDP, errorDescription))
 		return
@@ -42,32 +91,120 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		responses.Error400(w, r, fmt.Errorf("/auth: could not find state in query %s", r.URL.RawQuery))
 		return
 	}
-	// has to have a trailing / in its path, because the path of the session cookie is set to /auth/{state}/.
+	// the session cookie is sent to /auth/{state}/ as well as /auth/{state} for proxies which strip the trailing slash
 	authStateURL := fmt.Sprintf("/auth/%s/?%s", queryState, r.URL.RawQuery)
 	responses.Redirect302(w, r, authStateURL)
 
 }
 
-// AuthStateHandler /auth/{state}/
+// sessionLoginState the login session of state and what /login kept in it, nil if it can't be used, which has been responded to
+func sessionLoginState(w http.ResponseWriter, r *http.Request, state string) (*sessions.Session, *loginState) {
+	session, err := stateOf(r.Context()).sessstore.Get(r, cfg.FromContext(r.Context()).Session.Name)
+	if err != nil || session.Values["state"] != state {
+		// a misrouted callback rather than a missing or tampered session
+		if err := checkCallbackHost(r, state); err != nil {
+			responses.Error400(w, r, fmt.Errorf("/auth %w", err))
+			return nil, nil
+		}
+	}
+	if isSessionStoreError(err) {
+		responses.Error503(w, r, reasonSessionStore, 0, fmt.Errorf("/auth %w", err))
+		return nil, nil
+	}
+	if err != nil {
+		responses.Error400(w, r, fmt.Errorf("/auth %w: could not find session store %s", err, cfg.FromContext(r.Context()).Session.Name))
+		return nil, nil
+	}
+
+	// is the nonce "state" valid?
+	if session.Values["state"] != state {
+		responses.Error400(w, r, fmt.Errorf("/auth Invalid session state: stored %s, returned %s", session.Values["state"], state))
+		return nil, nil
+	}
+	if err := useSession(r.Context(), session); err != nil {
+		responses.Error400(w, r, fmt.Errorf("/auth %w", err))
+		return nil, nil
+	}
+
+	login := &loginState{Nonce: state}
+	login.RequestedURL, _ = session.Values["requestedURL"].(string)
+	login.Provider, _ = session.Values["provider"].(string)
+	login.RedirectURL, _ = session.Values["redirectURL"].(string)
+	login.CodeChallenge, _ = session.Values["codeChallenge"].(string)
+	login.CodeVerifier, _ = session.Values["codeVerifier"].(string)
+	login.IDTokenNonce, _ = session.Values["nonce"].(string)
+	return session, login
+}
+
+// authStateCookiePath the path of the session cookie set at /login
+// without a trailing slash the cookie still matches `/auth/{state}/` but also `/auth/{state}`, which is what's left
+// when a proxy normalizes away the trailing slash.  Per RFC 6265 section 5.1.4 it doesn't match `/auth/{state}xyz`
+func authStateCookiePath(state string) string {
+	return "/auth/" + state
+}
+
+// AuthStateHandler /auth/{state}/ and /auth/{state}
 // - validate info from oauth provider (Google, GitHub, OIDC, etc)
 // - issue jwt in the form of a cookie
 func AuthStateHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debug("/auth/{state}/")
+	cw := &capturewriter.CaptureWriter{ResponseWriter: w}
+	w = cw
+	oauthProvider := cfg.InstanceOf(r.Context()).GenOAuth
+	defer func() {
+		metrics.Callback(oauthProvider.Name, callbackResult(cw.StatusCode))
+		trace.SpanFromContext(r.Context()).SetAttributes(
+			tracing.AttrProvider.String(oauthProvider.Name),
+			tracing.AttrDecision.String(callbackResult(cw.StatusCode)),
+		)
+	}()
 	// Handle the exchange code to initiate a transport.
 
-	session, err := sessstore.Get(r, cfg.Cfg.Session.Name)
-	if err != nil {
-		responses.Error400(w, r, fmt.Errorf("/auth %w: could not find session store %s", err, cfg.Cfg.Session.Name))
+	queryState := r.URL.Query().Get("state")
+	var session *sessions.Session
+	var login *loginState
+	if cfg.FromContext(r.Context()).StatelessState {
+		var err error
+		login, err = parseLoginState(r.Context(), queryState, stateCookieValue(r))
+		clearStateCookie(w, r, queryState)
+		if err != nil {
+			responses.Error400(w, r, fmt.Errorf("/auth %w", err))
+			return
+		}
+	} else if session, login = sessionLoginState(w, r, queryState); login == nil {
 		return
 	}
 
-	// is the nonce "state" valid?
-	queryState := r.URL.Query().Get("state")
-	if session.Values["state"] != queryState {
-		responses.Error400(w, r, fmt.Errorf("/auth Invalid session state: stored %s, returned %s", session.Values["state"], queryState))
+	// did the user decline consent at the IdP?
+	if r.URL.Query().Get("error") == errAccessDenied {
+		retryURL := ""
+		if login.RequestedURL != "" {
+			retryURL = "/login?url=" + url.QueryEscape(login.RequestedURL)
+		}
+		audit.Log(r, audit.Login, "", audit.Failure, errAccessDenied)
+		responses.AccessDenied(w, r, retryURL)
 		return
 	}
 
+	// the code is exchanged with the provider chosen at /login
+	if login.Provider != "" {
+		if oauthProvider = cfg.OAuthByName(r.Context(), login.Provider); oauthProvider == nil {
+			oauthProvider = cfg.InstanceOf(r.Context()).GenOAuth
+			responses.Error400(w, r, fmt.Errorf("/auth the provider %s chosen at /login is no longer configured", login.Provider))
+			return
+		}
+	}
+	r = r.WithContext(cfg.WithOAuth(r.Context(), oauthProvider))
+
+	// the token exchange must use the same redirect_uri as /login
+	if login.RedirectURL != "" {
+		r = r.WithContext(context.WithValue(r.Context(), cfg.RedirectURLCtxKey, login.RedirectURL))
+	}
+	// and the id_token must carry the nonce sent from there
+	if oauthProvider.NonceCheck() {
+		r = r.WithContext(context.WithValue(r.Context(), cfg.IDTokenNonceCtxKey, login.IDTokenNonce))
+	}
+
 	user := structs.User{}
 	customClaims := structs.CustomClaims{}
 	ptokens := structs.PTokens{}
@@ -75,93 +212,180 @@ func AuthStateHandler(w http.ResponseWriter, r *http.Request) {
 	// is code challenge enabled?
 	authCodeOptions := []oauth2.AuthCodeOption{}
 
-	if cfg.GenOAuth.CodeChallengeMethod != "" {
+	if oauthProvider.CodeChallengeMethod != "" {
 		authCodeOptions = []oauth2.AuthCodeOption{
-			oauth2.SetAuthURLParam("code_challenge", session.Values["codeChallenge"].(string)),
-			oauth2.SetAuthURLParam("code_verifier", session.Values["codeVerifier"].(string)),
+			oauth2.SetAuthURLParam("code_challenge", login.CodeChallenge),
+			oauth2.SetAuthURLParam("code_verifier", login.CodeVerifier),
 		}
 	}
 
 	if err := getUserInfo(r, &user, &customClaims, &ptokens, authCodeOptions...); err != nil {
+		if common.Refused(err) {
+			audit.Log(r, audit.Authz, "", audit.Failure, err.Error())
+			responses.Error403Msg(w, r, err.Error(), fmt.Errorf("/auth %w", err))
+			return
+		}
+		var rl *common.RateLimitError
+		if errors.As(err, &rl) {
+			// pass the provider's backoff on, so that the client waits rather than retrying at once
+			responses.Error503(w, r, reasonProviderRateLimited, rl.RetryAfterSeconds(), fmt.Errorf("/auth %w", err))
+			return
+		}
 		responses.Error400(w, r, fmt.Errorf("/auth Error while retrieving user info after successful login at the OAuth provider: %w", err))
 		return
 	}
+	user.Provider = oauthProvider.Name
+	claimsStart := time.Now()
+	addSIDClaim(r.Context(), &customClaims, ptokens)
+	transformClaims(r.Context(), &user, &customClaims)
+	normalizeGroups(r.Context(), &user, &customClaims)
+	timelog.Since(r, timelog.TimingClaims, claimsStart)
 	log.Debugf("/auth/{state}/ Claims from userinfo: %+v", customClaims)
 
+	// add attributes from the enrichment webhook
+	if err := enrichUser(r.Context(), user, &customClaims); err != nil {
+		audit.Log(r, audit.Login, user.Username, audit.Failure, "enrichment failed: "+err.Error())
+		responses.Error503(w, r, reasonEnrichmentUnavailable, 0, fmt.Errorf("/auth enrichment failed for %s: %w", user.Username, err))
+		return
+	}
+
+	// bound the size of the token for users in a great many groups
+	if err := limitGroups(r.Context(), &user, &customClaims); err != nil {
+		audit.Log(r, audit.Authz, user.Username, audit.Failure, err.Error())
+		responses.Error403(w, r, fmt.Errorf("/auth too many groups for user %w . Please seek support from your administrator", err))
+		return
+	}
+
 	// verify / authz the user
-	if ok, err := verifyUser(user); !ok {
+	requestedURL := login.RequestedURL
+	ok, err := verifyUser(r.Context(), user)
+	auditVerifyUser(r, user, requestedURL, err)
+	if !ok {
 		responses.Error403(w, r, fmt.Errorf("/auth User is not authorized: %w . Please try again or seek support from your administrator", err))
 		return
 	}
 
+	// refused by the operator's rules on their claims
+	if rule := denyRuleFor(r.Context(), customClaims.Claims); rule != nil {
+		err := denyError(user.Username, rule)
+		audit.LogCode(r, audit.Authz, user.Username, audit.Failure, rule.ReasonCode, err.Error())
+		setErrorCode(w, r, rule.ReasonCode)
+		responses.Error403Msg(w, r, denyMessage(rule), fmt.Errorf("/auth %w", err))
+		return
+	}
+
+	// during a lockdown only the incident team may log in
+	if lockedOut(r.Context(), user, customClaims) {
+		audit.Log(r, audit.Login, user.Username, audit.Failure, errLockdown.Error())
+		responses.Error503(w, r, reasonLockdown, 0, fmt.Errorf("/auth %w, %s is not in lockdown.allow_users or lockdown.allow_groups", errLockdown, user.Username))
+		return
+	}
+
+	if requestedURL != "" {
+		if err := checkRequestedURL(r.Context(), requestedURL); err != nil {
+			responses.Error400(w, r, fmt.Errorf("/auth %w", err))
+			return
+		}
+	}
+	if !withinAccessHours(r.Context(), hostOfURL(requestedURL)) {
+		audit.Log(r, audit.Authz, user.Username, audit.Failure, errOutsideAccessHours.Error())
+		responses.Error403Msg(w, r, errOutsideAccessHours.Error(), fmt.Errorf("/auth %s: %w", requestedURL, errOutsideAccessHours))
+		return
+	}
+
 	// SUCCESS!! they are authorized
 
+	// but their account may need to be provisioned first
+	if err := provisionUser(r.Context(), user, customClaims); err != nil {
+		audit.Log(r, audit.Login, user.Username, audit.Failure, "provisioning failed: "+err.Error())
+		responses.Error403Msg(w, r, cfg.FromContext(r.Context()).Provisioning.Message, fmt.Errorf("/auth provisioning failed for %s: %w", user.Username, err))
+		return
+	}
+
 	// issue the jwt
 
-	tokenstring, err := jwtmanager.NewVPJWT(user, customClaims, ptokens)
+	jwtStart := time.Now()
+	tokenstring, err := jwtmanager.NewVPJWT(r.Context(), user, customClaims, ptokens)
+	timelog.Since(r, timelog.TimingJWT, jwtStart)
 	if err != nil {
 		responses.Error500(w, r, fmt.Errorf("/auth Token creation failure: %w . Please seek support from your administrator", err))
 		return
 
 	}
-	cookie.SetCookie(w, r, tokenstring)
 
-	// get the originally requested URL so we can send them on their way
-	requestedURL := session.Values["requestedURL"].(string)
-	if requestedURL != "" {
-		// clear out the session value
+	// clear out the session value before the jwt is issued, so that a failing session store fails the login
+	if session != nil && requestedURL != "" {
 		session.Values["requestedURL"] = ""
 		session.Values[requestedURL] = 0
+		session.Options.Path = authStateCookiePath(queryState)
 		session.Options.MaxAge = -1
-		if err = session.Save(r, w); err != nil {
-			log.Error(err)
+		if err = saveSession(r, w, session); err != nil {
+			responses.Error503(w, r, reasonSessionStore, 0, fmt.Errorf("/auth %w", err))
+			return
 		}
+	}
+	cookie.SetCookie(w, r, tokenstring, customClaims.Claims)
+	issueCSRFToken(w, r, customClaims.Claims)
+	audit.Log(r, audit.Login, user.Username, audit.Success, "")
 
+	// get the originally requested URL so we can send them on their way
+	// by way of /stepup when its host also requires a passkey
+	if requestedURL != "" && cfg.FromContext(r.Context()).StepUpRequired(hostOfURL(requestedURL)) {
+		responses.Redirect302(w, r, stepUpPath+"?url="+url.QueryEscape(requestedURL))
+		return
+	}
+	if requestedURL != "" {
 		responses.Redirect302(w, r, requestedURL)
 		return
 	}
 
 	// otherwise serve an error
-	responses.RenderIndex(w, "/auth "+tokenstring)
+	responses.RenderIndex(w, r, "/auth "+tokenstring)
+}
+
+// callbackResult the result of a login returning from the provider, by the status of the response
+// the user was refused (401, 403) or some other error kept them from logging in
+func callbackResult(status int) string {
+	switch {
+	case status < http.StatusBadRequest:
+		return metrics.CallbackOK
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return metrics.CallbackDenied
+	}
+	return metrics.CallbackError
 }
 
 // verifyUser validates that the domains match for the user
-func verifyUser(u interface{}) (bool, error) {
+func verifyUser(ctx context.Context, u interface{}) (bool, error) {
 
 	user := u.(structs.User)
 
 	switch {
 
 	// AllowAllUsers
-	case cfg.Cfg.AllowAllUsers:
-		log.Debugf("verifyUser: Success! skipping verification, cfg.Cfg.AllowAllUsers is %t", cfg.Cfg.AllowAllUsers)
+	case cfg.FromContext(ctx).AllowAllUsers:
+		log.Debugf("verifyUser: Success! skipping verification, allow_all_users is %t", cfg.FromContext(ctx).AllowAllUsers)
 		return true, nil
 
 	// WhiteList
-	case len(cfg.Cfg.WhiteList) != 0:
-		for _, wl := range cfg.Cfg.WhiteList {
-			if user.Username == wl {
-				log.Debugf("verifyUser: Success! found user.Username in WhiteList: %s", user.Username)
-				return true, nil
-			}
+	case len(cfg.FromContext(ctx).WhiteList) != 0:
+		if inWhiteList(user.Username, cfg.FromContext(ctx).WhiteList, cfg.FromContext(ctx).WhiteListRegexps) {
+			log.Debugf("verifyUser: Success! found user.Username in WhiteList: %s", user.Username)
+			return true, nil
 		}
 		return false, fmt.Errorf("verifyUser: user.Username not found in WhiteList: %s", user.Username)
 
 	// TeamWhiteList
-	case len(cfg.Cfg.TeamWhiteList) != 0:
-		for _, team := range user.TeamMemberships {
-			for _, wl := range cfg.Cfg.TeamWhiteList {
-				if team == wl {
-					log.Debugf("verifyUser: Success! found user.TeamWhiteList in TeamWhiteList: %s for user %s", wl, user.Username)
-					return true, nil
-				}
-			}
+	case len(cfg.FromContext(ctx).TeamWhiteList) != 0:
+		if wl, ok := inTeamWhiteList(ctx, user.TeamMemberships, cfg.FromContext(ctx).TeamWhiteList); ok {
+			log.Debugf("verifyUser: Success! found user.TeamWhiteList in TeamWhiteList: %s for user %s", wl, user.Username)
+			return true, nil
 		}
-		return false, fmt.Errorf("verifyUser: user.TeamMemberships %s not found in TeamWhiteList: %s for user %s", user.TeamMemberships, cfg.Cfg.TeamWhiteList, user.Username)
+		return false, fmt.Errorf("verifyUser: user.TeamMemberships %s not found in TeamWhiteList: %s for user %s", user.TeamMemberships, cfg.FromContext(ctx).TeamWhiteList, user.Username)
 
 	// Domains
-	case len(cfg.Cfg.Domains) != 0:
-		if domains.IsUnderManagement(user.Email) {
+	case len(cfg.FromContext(ctx).Domains) != 0:
+		if domains.IsUnderManagement(ctx, user.Email) {
 			log.Debugf("verifyUser: Success! Email %s found within a %s managed domain", user.Email, cfg.Branding.FullName)
 			return true, nil
 		}
@@ -174,6 +398,29 @@ func verifyUser(u interface{}) (bool, error) {
 	}
 }
 
+// getUserInfo the token exchange and userinfo from the provider of the request (see cfg.OAuth()), whose health is reported at /metrics and /readyz
+// a missing claim is the user's problem rather than the provider's
 func getUserInfo(r *http.Request, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens, opts ...oauth2.AuthCodeOption) error {
-	return provider.GetUserInfo(r, user, customClaims, ptokens, opts...)
+	name := cfg.OAuth(r.Context()).Name
+	ctx, span := tracing.Start(r.Context(), "userinfo")
+	defer span.End()
+	span.SetAttributes(tracing.AttrProvider.String(name))
+	r = r.WithContext(ctx)
+	start := time.Now()
+	err := providerFor(r.Context(), name).GetUserInfo(r, user, customClaims, ptokens, opts...)
+	tracing.SetError(span, err)
+	elapsed := time.Since(start)
+	metrics.ObserveUserInfo(name, elapsed)
+	// the token exchange is timed on its own
+	timelog.Record(r, timelog.TimingUserInfo, elapsed-timelog.Recorded(r, timelog.TimingToken))
+	var rl *common.RateLimitError
+	switch {
+	case err == nil || common.Refused(err):
+		providerhealth.Success(r.Context(), name)
+	case errors.As(err, &rl):
+		// the provider is up, taking this instance out of service wouldn't lessen its load
+	default:
+		providerhealth.Failure(r.Context(), name)
+	}
+	return err
 }
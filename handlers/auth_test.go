@@ -0,0 +1,607 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/timelog"
+)
+
+// loginForState run /login and return the state along with the session cookies set for /auth/{state}/
+func loginForState(t *testing.T, requestedURL string) (string, []*http.Cookie) {
+	req, err := http.NewRequest("GET", "/login?url="+requestedURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(LoginHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusFound {
+		t.Fatalf("LoginHandler() status = %v, want %v", rr.Code, http.StatusFound)
+	}
+	oURL, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oURL.Query().Get("state"), rr.Result().Cookies()
+}
+
+// stubIdP an OpenID Connect provider whose token endpoint issues an access token and whose userinfo endpoint answers with userinfo
+func stubIdP(userinfo string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			_, _ = w.Write([]byte(`{"access_token":"accesstoken","token_type":"Bearer","expires_in":3600}`))
+		case "/userinfo":
+			_, _ = w.Write([]byte(userinfo))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	cfg.OAuthClient.Endpoint.TokenURL = ts.URL + "/token"
+	cfg.GenOAuth.TokenURL = ts.URL + "/token"
+	cfg.GenOAuth.UserInfoURL = ts.URL + "/userinfo"
+	return ts
+}
+
+// authState complete the login at /auth/{state}/ as if the IdP had redirected back with a code
+func authState(t *testing.T, state string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "/auth/"+state+"/?code=authcode&state="+state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(AuthStateHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestCallbackHandlerAccessDenied(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	requestedURL := "http://myapp.example.com/hello"
+	state, cookies := loginForState(t, requestedURL)
+
+	// /auth passes access_denied along to /auth/{state}/ where the session can be found
+	req, err := http.NewRequest("GET", "/auth?error=access_denied&state="+state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(CallbackHandler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	authStateURL := rr.Header().Get("Location")
+	assert.True(t, strings.HasPrefix(authStateURL, "/auth/"+state+"/"))
+
+	req, err = http.NewRequest("GET", authStateURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(AuthStateHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, "access_denied", rr.Header().Get(cfg.Cfg.Headers.Error))
+	body := rr.Body.String()
+	assert.Contains(t, body, "You declined to grant access")
+	assert.Contains(t, body, "/login?url="+url.QueryEscape(requestedURL))
+}
+
+func TestCallbackHandlerAccessDeniedNoState(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	cfg.Cfg.AccessDeniedMessage = "consent was declined"
+
+	req, err := http.NewRequest("GET", "/auth?error=access_denied", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(CallbackHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "consent was declined")
+	assert.NotContains(t, rr.Body.String(), "try again")
+}
+
+func TestCallbackHandlerIdPError(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+
+	req, err := http.NewRequest("GET", "/auth?error=server_error&error_description=oops&state=abc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(CallbackHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "You declined to grant access")
+}
+
+func TestCallbackHandlerFormPost(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+
+	// as Sign in with Apple posts the callback at the first authorization
+	user := `{"name":{"firstName":"Jane","lastName":"Appleseed"}}`
+	form := url.Values{"code": {"abc"}, "state": {"xyz"}, "user": {user}, "id_token": {"eyJ.eyJ.sig"}}
+	req := httptest.NewRequest("POST", "/auth", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(CallbackHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusFound, rr.Code)
+	u, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/auth/xyz/", u.Path)
+	assert.Equal(t, "abc", u.Query().Get("code"))
+	assert.Equal(t, user, u.Query().Get("user"))
+	assert.Empty(t, u.Query().Get("id_token"), "the id_token is fetched with the code")
+}
+
+func TestAuthStateHandlerTrailingSlashStripped(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	requestedURL := "http://myapp.example.com/hello"
+	state, cookies := loginForState(t, requestedURL)
+
+	// let a browser's cookie jar decide which paths the session cookie is sent to
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vouchURL, _ := url.Parse("http://vouch.example.com/login")
+	jar.SetCookies(vouchURL, cookies)
+
+	tests := []struct {
+		name     string
+		path     string
+		wantSent bool
+	}{
+		{"trailing slash", "/auth/" + state + "/", true},
+		{"trailing slash stripped by the proxy", "/auth/" + state, true},
+		{"another state", "/auth/" + state + "x", false},
+		{"callback", "/auth", false},
+		{"validate", "/validate", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse("http://vouch.example.com" + tt.path)
+			sent := false
+			for _, c := range jar.Cookies(u) {
+				if c.Name == cfg.Cfg.Session.Name {
+					sent = true
+				}
+			}
+			assert.Equal(t, tt.wantSent, sent)
+		})
+	}
+
+	// the session is found at the normalized path
+	u, _ := url.Parse("http://vouch.example.com/auth/" + state + "?error=access_denied&state=" + state)
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range jar.Cookies(u) {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(AuthStateHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), "/login?url="+url.QueryEscape(requestedURL))
+}
+
+func TestAuthStateHandlerEmailList(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	defer func() { cfg.GenOAuth.EmailSelect = cfg.EmailFirst }()
+
+	tests := []struct {
+		name       string
+		selectBy   string
+		userinfo   string
+		wantStatus int
+	}{
+		{"first", cfg.EmailFirst, `{"sub":"abc","email":["test@example.com","x@other.com"]}`, http.StatusFound},
+		{"first not in domains", cfg.EmailFirst, `{"sub":"abc","email":["x@other.com","test@example.com"]}`, http.StatusForbidden},
+		{"first verified", cfg.EmailFirstVerified,
+			`{"sub":"abc","email":[{"email":"x@other.com","verified":false},{"email":"test@example.com","verified":true}]}`, http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.GenOAuth.EmailSelect = tt.selectBy
+			idp := stubIdP(tt.userinfo)
+			defer idp.Close()
+
+			requestedURL := "http://app.example.com/hello"
+			state, cookies := loginForState(t, requestedURL)
+			rr := authState(t, state, cookies)
+
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			if tt.wantStatus == http.StatusFound {
+				assert.Equal(t, requestedURL, rr.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestAuthStateHandlerCallbackURL(t *testing.T) {
+	setUp("/config/testing/handler_callback_urls.yml")
+	var redirectURI string
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			redirectURI = r.FormValue("redirect_uri")
+			_, _ = w.Write([]byte(`{"access_token":"accesstoken","token_type":"Bearer","expires_in":3600}`))
+		case "/userinfo":
+			_, _ = w.Write([]byte(`{"sub":"abc","email":"test@example.com"}`))
+		}
+	}))
+	defer idp.Close()
+	cfg.OAuthClient.Endpoint.TokenURL = idp.URL + "/token"
+	cfg.GenOAuth.UserInfoURL = idp.URL + "/userinfo"
+
+	req, _ := http.NewRequest("GET", "/login?url=http://admin.example.com/reports", nil)
+	req.Header.Set("X-Forwarded-Host", "admin.example.com")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(LoginHandler).ServeHTTP(rr, req)
+	oURL, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+
+	// the token exchange uses the redirect_uri chosen at /login, not the first of the callback_urls
+	rr = authState(t, oURL.Query().Get("state"), rr.Result().Cookies())
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "https://admin.example.com/vouch/auth", redirectURI)
+}
+
+func TestAuthStateHandlerClaimsParameter(t *testing.T) {
+	setUp("/config/testing/handler_oidc_claims.yml")
+	var codeVerifier string
+	// an IdP which ignores the claims parameter and gives the claims it always does
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			codeVerifier = r.FormValue("code_verifier")
+			_, _ = w.Write([]byte(`{"access_token":"accesstoken","token_type":"Bearer","expires_in":3600}`))
+		case "/userinfo":
+			_, _ = w.Write([]byte(`{"sub":"abc","email":"test@example.com"}`))
+		}
+	}))
+	defer idp.Close()
+	cfg.OAuthClient.Endpoint.TokenURL = idp.URL + "/token"
+	cfg.GenOAuth.UserInfoURL = idp.URL + "/userinfo"
+
+	req, _ := http.NewRequest("GET", "/login?url=http://app.example.com/hello", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(LoginHandler).ServeHTTP(rr, req)
+	oURL, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id_token":{"groups":null,"email_verified":{"essential":true}},"userinfo":{"groups":null}}`, oURL.Query().Get("claims"))
+	assert.NotEmpty(t, oURL.Query().Get("code_challenge"))
+
+	rr = authState(t, oURL.Query().Get("state"), rr.Result().Cookies())
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "http://app.example.com/hello", rr.Header().Get("Location"))
+	assert.NotEmpty(t, codeVerifier, "PKCE is unaffected")
+}
+
+func TestAuthStateHandlerServerTiming(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	timelog.Configure()
+	idp := stubIdP(`{"sub":"abc","email":"test@example.com"}`)
+	defer idp.Close()
+	handler := http.HandlerFunc(timelog.TimeLog(http.HandlerFunc(AuthStateHandler)))
+
+	login := func() *httptest.ResponseRecorder {
+		state, cookies := loginForState(t, "http://app.example.com/hello")
+		req := httptest.NewRequest("GET", "/auth/"+state+"/?code=authcode&state="+state, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusFound, rr.Code)
+		return rr
+	}
+
+	// it reveals internal timing, so only when asked for
+	assert.Empty(t, login().Header().Get("Server-Timing"))
+
+	cfg.Cfg.ServerTiming.Enabled = true
+	defer func() { cfg.Cfg.ServerTiming.Enabled = false }()
+	var names []string
+	for _, metric := range strings.Split(login().Header().Get("Server-Timing"), ", ") {
+		params := strings.Split(metric, ";")
+		names = append(names, params[0])
+		assert.Regexp(t, `^dur=[0-9]+\.[0-9]$`, params[len(params)-1])
+	}
+	assert.Equal(t, []string{timelog.TimingToken, timelog.TimingUserInfo, timelog.TimingClaims, timelog.TimingJWT, timelog.TimingTotal}, names)
+}
+
+func TestAuthStateHandlerRechecksRequestedURL(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	idp := stubIdP(`{"sub":"abc","email":"test@example.com"}`)
+	defer idp.Close()
+
+	tests := []struct {
+		name         string
+		requestedURL string
+		wantStatus   int
+	}{
+		{"valid", "http://app.example.com/hello", http.StatusFound},
+		{"javascript scheme", "javascript:alert(1)", http.StatusBadRequest},
+		{"data scheme", "data:text/html,<script>alert(1)</script>", http.StatusBadRequest},
+		{"protocol relative", "//app.example.com/hello", http.StatusBadRequest},
+		{"another domain", "http://app.example.org/hello", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, cookies := loginForState(t, "http://app.example.com/hello")
+
+			// a session holding a requestedURL which /login would not have accepted
+			req := httptest.NewRequest("GET", "/auth/"+state+"/", nil)
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+			session, err := std.sessstore.New(req, cfg.Cfg.Session.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			session.Values["requestedURL"] = tt.requestedURL
+			rr := httptest.NewRecorder()
+			if err := std.sessstore.Save(req, rr, session); err != nil {
+				t.Fatal(err)
+			}
+
+			rr = authState(t, state, rr.Result().Cookies())
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			if tt.wantStatus == http.StatusFound {
+				assert.Equal(t, tt.requestedURL, rr.Header().Get("Location"))
+			} else {
+				assert.Empty(t, rr.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestAuthStateHandlerStatelessState(t *testing.T) {
+	setUp("/config/testing/handler_stateless_state.yml")
+	idp := stubIdP(`{"sub":"abc","email":"test@example.com"}`)
+	defer idp.Close()
+
+	requestedURL := "http://app.example.com/hello"
+	state, cookies := loginForState(t, requestedURL)
+	for _, c := range cookies {
+		assert.NotEqual(t, cfg.Cfg.Session.Name, c.Name, "the login session isn't saved")
+	}
+
+	// a state lured into another browser, which hasn't the state cookie, doesn't log it in
+	rr := authState(t, state, nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// the state and its cookie carry the login, even to another instance without the session
+	state, cookies = loginForState(t, requestedURL)
+	rr = authState(t, state, cookies)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, requestedURL, rr.Header().Get("Location"))
+
+	rr = authState(t, state, cookies)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "a state is used once")
+}
+
+func TestAuthStateHandlerUsernameClaim(t *testing.T) {
+	setUp("/config/testing/handler_oidc_username_claim.yml")
+	// a provider which only supplies sub
+	idp := stubIdP(`{"sub":"248289761001"}`)
+	defer idp.Close()
+
+	requestedURL := "http://app.example.com/hello"
+	state, cookies := loginForState(t, requestedURL)
+	rr := authState(t, state, cookies)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, requestedURL, rr.Header().Get("Location"))
+
+	var vpjwt string
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == cfg.Cfg.Cookie.Name {
+			vpjwt = c.Value
+		}
+	}
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), vpjwt)
+	assert.NoError(t, err)
+	assert.Equal(t, "248289761001", claims.Username)
+}
+
+func TestAuthStateHandlerIDTokenNonce(t *testing.T) {
+	tests := []struct {
+		name       string
+		skip       bool
+		nonce      func(sent string) string
+		wantStatus int
+	}{
+		{"nonce sent back", false, func(sent string) string { return sent }, http.StatusFound},
+		{"nonce of another login", false, func(string) string { return "other" }, http.StatusBadRequest},
+		{"no nonce", false, func(string) string { return "" }, http.StatusBadRequest},
+		{"skip_nonce_check", true, func(string) string { return "" }, http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUp("/config/testing/handler_oidc_username_claim.yml")
+			cfg.GenOAuth.SkipNonceCheck = tt.skip
+			// without a jwks_url only the alg of the id_token is checked
+			cfg.GenOAuth.IDTokenSigningAlgs = []string{"HS256"}
+
+			req, err := http.NewRequest("GET", "/login?url=http://app.example.com/hello", nil)
+			assert.NoError(t, err)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(LoginHandler).ServeHTTP(rr, req)
+			oURL, err := url.Parse(rr.Header().Get("Location"))
+			assert.NoError(t, err)
+			sent := oURL.Query().Get("nonce")
+			assert.Equal(t, tt.skip, sent == "", "nonce = %q", sent)
+
+			claims := jwt.MapClaims{"sub": "248289761001", "aud": cfg.GenOAuth.ClientID}
+			if n := tt.nonce(sent); n != "" {
+				claims["nonce"] = n
+			}
+			idToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+			assert.NoError(t, err)
+			idp := stubIdP(`{"sub":"248289761001"}`)
+			defer idp.Close()
+			tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"access_token":"accesstoken","token_type":"Bearer","id_token":"` + idToken + `"}`))
+			}))
+			defer tokens.Close()
+			cfg.OAuthClient.Endpoint.TokenURL = tokens.URL
+
+			state := oURL.Query().Get("state")
+			assert.Equal(t, tt.wantStatus, authState(t, state, rr.Result().Cookies()).Code)
+		})
+	}
+}
+
+func TestAuthStateHandlerLockdown(t *testing.T) {
+	setUp("/config/testing/handler_lockdown.yml")
+
+	tests := []struct {
+		name       string
+		enabled    bool
+		userinfo   string
+		wantStatus int
+	}{
+		{"allowed user", true, `{"sub":"abc","email":"OnCall@example.com"}`, http.StatusFound},
+		{"allowed group", true, `{"sub":"abc","email":"sre@example.com","groups":["staff","incident-response"]}`, http.StatusFound},
+		{"locked out", true, `{"sub":"abc","email":"test@example.com","groups":["staff"]}`, http.StatusServiceUnavailable},
+		{"not locked down", false, `{"sub":"abc","email":"test@example.com","groups":["staff"]}`, http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Cfg.Lockdown.Enabled = tt.enabled
+			idp := stubIdP(tt.userinfo)
+			defer idp.Close()
+
+			requestedURL := "http://app.example.com/hello"
+			state, cookies := loginForState(t, requestedURL)
+			rr := authState(t, state, cookies)
+
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			if tt.wantStatus == http.StatusServiceUnavailable {
+				assert.Equal(t, reasonLockdown, rr.Header().Get(cfg.Cfg.Headers.Error))
+				assert.Empty(t, rr.Header().Values("Set-Cookie"))
+			} else {
+				assert.Equal(t, requestedURL, rr.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestAuthStateHandlerProviderRateLimited(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+	cfg.OAuthClient.Endpoint.TokenURL = ts.URL + "/token"
+	cfg.GenOAuth.TokenURL = ts.URL + "/token"
+
+	state, cookies := loginForState(t, "http://app.example.com/hello")
+	rr := authState(t, state, cookies)
+
+	// the provider's backoff is passed on rather than a login error
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+	assert.Equal(t, reasonProviderRateLimited, rr.Header().Get(cfg.Cfg.Headers.Error))
+}
+
+func TestAuthStateHandlerAccessTokenAudience(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	cfg.GenOAuth.AccessToken.Issuer = "https://idp.example.com/"
+	cfg.GenOAuth.AccessToken.Audiences = []string{"api://vouch"}
+	enc := base64.RawURLEncoding.EncodeToString
+
+	tests := []struct {
+		name     string
+		payload  string
+		wantCode int
+	}{
+		{"matching", `{"iss":"https://idp.example.com/","aud":"api://vouch"}`, http.StatusFound},
+		{"for another resource", `{"iss":"https://idp.example.com/","aud":"https://graph.example.com"}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accessToken := enc([]byte(`{"alg":"RS256"}`)) + "." + enc([]byte(tt.payload)) + ".c2ln"
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if r.URL.Path == "/token" {
+					_, _ = w.Write([]byte(`{"access_token":"` + accessToken + `","token_type":"Bearer","expires_in":3600}`))
+					return
+				}
+				_, _ = w.Write([]byte(`{"sub":"abc","email":"test@example.com"}`))
+			}))
+			defer ts.Close()
+			cfg.OAuthClient.Endpoint.TokenURL = ts.URL + "/token"
+			cfg.GenOAuth.TokenURL = ts.URL + "/token"
+			cfg.GenOAuth.UserInfoURL = ts.URL + "/userinfo"
+
+			state, cookies := loginForState(t, "http://app.example.com/hello")
+			rr := authState(t, state, cookies)
+			assert.Equal(t, tt.wantCode, rr.Code)
+		})
+	}
+}
+
+func TestAuthStateHandlerProfileCookie(t *testing.T) {
+	setUp("/config/testing/handler_profile_cookie.yml")
+	idp := stubIdP(`{"sub":"abc","email":"test@example.com","name":"Test User","picture":"https://example.com/test.png","groups":["admins"]}`)
+	defer idp.Close()
+
+	state, cookies := loginForState(t, "http://app.example.com/hello")
+	rr := authState(t, state, cookies)
+	assert.Equal(t, http.StatusFound, rr.Code)
+
+	var jwtCookie, profile *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		switch c.Name {
+		case cfg.Cfg.Cookie.Name:
+			jwtCookie = c
+		case cfg.Cfg.Cookie.Profile.Name:
+			profile = c
+		}
+	}
+	if jwtCookie == nil || profile == nil {
+		t.Fatalf("want the jwt and profile cookies, got %v", rr.Result().Cookies())
+	}
+	assert.True(t, jwtCookie.HttpOnly)
+	assert.False(t, profile.HttpOnly, "scripts read the profile")
+
+	v, err := url.PathUnescape(profile.Value)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"name":"Test User","picture":"https://example.com/test.png"}`, v)
+}
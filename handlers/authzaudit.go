@@ -0,0 +1,62 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// authzRule the rule by which verifyUser decides, the first of them which is configured
+func authzRule(ctx context.Context) string {
+	switch {
+	case cfg.FromContext(ctx).AllowAllUsers:
+		return audit.RuleAllowAllUsers
+	case len(cfg.FromContext(ctx).WhiteList) != 0:
+		return audit.RuleWhiteList
+	case len(cfg.FromContext(ctx).TeamWhiteList) != 0:
+		return audit.RuleTeamWhiteList
+	case len(cfg.FromContext(ctx).Domains) != 0:
+		return audit.RuleDomains
+	}
+	return audit.RuleNone
+}
+
+// auditVerifyUser record the decision of verifyUser for the user logging in to requestedURL, err is why they were refused
+func auditVerifyUser(r *http.Request, user structs.User, requestedURL string, err error) {
+	d := audit.Decision{User: user.Username, Email: user.Email, Rule: authzRule(r.Context()), URL: requestedURL, Allowed: err == nil}
+	if err != nil {
+		d.Reason = err.Error()
+	}
+	audit.Authorization(r, d)
+}
+
+// auditValidate record the decision of /validate with `audit.validate`, claims is nil if there's no valid jwt
+func auditValidate(r *http.Request, claims *jwtmanager.VouchClaims, rule string, err error) {
+	if !cfg.FromContext(r.Context()).Audit.Validate {
+		return
+	}
+	d := audit.Decision{Rule: rule, URL: forwarded.URL(r), Allowed: err == nil}
+	if claims != nil {
+		d.User = claims.Username
+		d.Email, _ = claims.CustomClaims["email"].(string)
+	}
+	if err != nil {
+		d.Reason = err.Error()
+	}
+	audit.Authorization(r, d)
+}
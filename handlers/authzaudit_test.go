@@ -0,0 +1,128 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// auditEvents the authz events recorded in buf
+func auditEvents(t *testing.T, buf *bytes.Buffer) []audit.Event {
+	var events []audit.Event
+	sc := bufio.NewScanner(buf)
+	for sc.Scan() {
+		e := audit.Event{}
+		assert.NoError(t, json.Unmarshal(sc.Bytes(), &e))
+		if e.Name == audit.Authz {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestAuthStateHandlerAuditsDecision(t *testing.T) {
+	tests := []struct {
+		name       string
+		email      string
+		wantCode   int
+		wantResult string
+	}{
+		{"allowed", "test@example.com", http.StatusFound, audit.Allow},
+		{"denied", "other@example.com", http.StatusForbidden, audit.Deny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUp("/config/testing/handler_audit.yml")
+			buf := &bytes.Buffer{}
+			audit.SetOutput(buf)
+			defer audit.SetOutput(nil)
+			idp := stubIdP(`{"sub":"abc","email":"` + tt.email + `"}`)
+			defer idp.Close()
+
+			state, cookies := loginForState(t, "http://app.example.com/hello")
+			rr := authState(t, state, cookies)
+			assert.Equal(t, tt.wantCode, rr.Code)
+
+			events := auditEvents(t, buf)
+			if !assert.Len(t, events, 1) {
+				return
+			}
+			e := events[0]
+			assert.Equal(t, tt.email, e.User)
+			assert.Equal(t, tt.email, e.Email)
+			assert.Equal(t, audit.RuleWhiteList, e.Rule)
+			assert.Equal(t, tt.wantResult, e.Decision)
+			assert.Equal(t, "http://app.example.com/hello", e.URL)
+			if tt.wantResult == audit.Deny {
+				assert.Equal(t, audit.Failure, e.Outcome)
+				// the reason given by verifyUser
+				assert.Contains(t, e.Reason, "not found in WhiteList")
+			}
+		})
+	}
+}
+
+func TestValidateRequestHandlerAuditsDecision(t *testing.T) {
+	setUp("/config/testing/handler_audit.yml")
+	buf := &bytes.Buffer{}
+	audit.SetOutput(buf)
+	defer audit.SetOutput(nil)
+
+	user := structs.User{Username: "test@example.com", Email: "test@example.com"}
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, structs.CustomClaims{Claims: map[string]interface{}{"email": "test@example.com"}}, structs.PTokens{})
+	assert.NoError(t, err)
+
+	validate := func(vpjwt string) {
+		req := httptest.NewRequest("GET", "/validate", nil)
+		req.Host = "app.example.com"
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Original-URI", "/reports")
+		if vpjwt != "" {
+			req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+		}
+		http.HandlerFunc(ValidateRequestHandler).ServeHTTP(httptest.NewRecorder(), req)
+	}
+	validate(vpjwt)
+	validate("")
+
+	events := auditEvents(t, buf)
+	if !assert.Len(t, events, 2) {
+		return
+	}
+	assert.Equal(t, audit.Allow, events[0].Decision)
+	assert.Equal(t, "test@example.com", events[0].User)
+	assert.Equal(t, "test@example.com", events[0].Email)
+	assert.Equal(t, audit.RuleJWT, events[0].Rule)
+	assert.Equal(t, "https://app.example.com/reports", events[0].URL)
+	assert.Equal(t, "203.0.113.7", events[0].Src)
+
+	assert.Equal(t, audit.Deny, events[1].Decision)
+	assert.Equal(t, errNoJWT.Error(), events[1].Reason)
+
+	// unless it's turned off
+	cfg.Cfg.Audit.Validate = false
+	validate(vpjwt)
+	assert.Empty(t, auditEvents(t, buf))
+}
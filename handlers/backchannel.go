@@ -0,0 +1,178 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#LogoutToken
+const backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+var errLogoutTokenUnverified = errors.New("logout_token can't be verified without oauth.jwks_url")
+
+type logoutToken struct {
+	Aud    interface{}            `json:"aud"`
+	Sid    string                 `json:"sid"`
+	Nonce  string                 `json:"nonce"`
+	Events map[string]interface{} `json:"events"`
+}
+
+// BackChannelLogoutHandler /logout/backchannel
+// the IdP POSTs a `logout_token` when the user's session at the IdP ends
+// every Vouch Proxy session carrying the same `sid` is revoked
+func BackChannelLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	log.Debug("/logout/backchannel")
+	w.Header().Set("Cache-Control", "no-store")
+	if cfg.FromContext(r.Context()).Session.SIDClaim == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	sid, err := sidFromLogoutToken(r.Context(), r.FormValue("logout_token"))
+	if err != nil {
+		log.Errorf("/logout/backchannel %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jwtmanager.RevokeSID(r.Context(), sid)
+	audit.Log(r, audit.Logout, "", audit.Success, "back-channel logout sid "+sid)
+}
+
+// sidFromLogoutToken the sid of a logout_token, verified by the provider which issued it
+func sidFromLogoutToken(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", errors.New("no logout_token")
+	}
+	ctx, err := logoutTokenIssuer(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	return providerSIDFromLogoutToken(ctx, token)
+}
+
+// logoutTokenIssuer ctx with the provider (see cfg.WithOAuth()) whose `oauth.issuer` is the `iss` of the logout_token
+// rather than taking the token from whichever provider's keys verify it, only a provider with a jwks_url is considered
+// a single such provider without an issuer is taken to be the issuer of every logout_token
+func logoutTokenIssuer(ctx context.Context, token string) (context.Context, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return ctx, fmt.Errorf("logout_token: %w", err)
+	}
+	iss, _ := claims["iss"].(string)
+	verifiers := 0
+	for _, c := range cfg.InstanceOf(ctx).OAuthConfigs {
+		if c.JWKSURL == "" {
+			continue
+		}
+		verifiers++
+		if c.Issuer != "" && c.Issuer == iss {
+			return cfg.WithOAuth(ctx, c), nil
+		}
+	}
+	for _, c := range cfg.InstanceOf(ctx).OAuthConfigs {
+		if c.JWKSURL != "" && c.Issuer == "" && verifiers == 1 {
+			return cfg.WithOAuth(ctx, c), nil
+		}
+	}
+	if verifiers == 0 {
+		return ctx, errLogoutTokenUnverified
+	}
+	return ctx, fmt.Errorf("logout_token issued by %q, which isn't the oauth.issuer of any provider", iss)
+}
+
+// providerSIDFromLogoutToken the sid of a logout_token from the provider of ctx, see cfg.OAuth()
+// without `oauth.jwks_url` VerifyIDToken can't check the signature, and anyone could end anyone's sessions
+func providerSIDFromLogoutToken(ctx context.Context, token string) (string, error) {
+	if cfg.OAuth(ctx).JWKSURL == "" {
+		return "", errLogoutTokenUnverified
+	}
+	payload, err := common.VerifyIDToken(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	lt := logoutToken{}
+	if err := json.Unmarshal(payload, &lt); err != nil {
+		return "", err
+	}
+	if _, ok := lt.Events[backChannelLogoutEvent]; !ok {
+		return "", errors.New("logout_token is missing the back-channel logout event")
+	}
+	if lt.Nonce != "" {
+		return "", errors.New("logout_token must not contain a nonce")
+	}
+	if !audienceIncludes(lt.Aud, cfg.OAuth(ctx).ClientID) {
+		return "", errors.New("logout_token was not issued for this client_id")
+	}
+	if lt.Sid == "" {
+		// a logout_token may carry only a `sub`, but then we can't tell which session ended
+		return "", errors.New("logout_token has no sid")
+	}
+	return lt.Sid, nil
+}
+
+// audienceIncludes `aud` may be a string or an array of strings
+func audienceIncludes(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addSIDClaim the IdP's session id is usually found in the id_token rather than at the userinfo endpoint
+// the id_token has already been checked by the provider
+func addSIDClaim(ctx context.Context, customClaims *structs.CustomClaims, ptokens structs.PTokens) {
+	if cfg.FromContext(ctx).Session.SIDClaim == "" || ptokens.PIdToken == "" {
+		return
+	}
+	if _, ok := customClaims.Claims[cfg.FromContext(ctx).Session.SIDClaim]; ok {
+		return
+	}
+	parts := strings.Split(ptokens.PIdToken, ".")
+	if len(parts) != 3 {
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return
+	}
+	idClaims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &idClaims); err != nil {
+		return
+	}
+	if sid, ok := idClaims[cfg.FromContext(ctx).Session.SIDClaim].(string); ok && sid != "" {
+		if customClaims.Claims == nil {
+			customClaims.Claims = map[string]interface{}{}
+		}
+		customClaims.Claims[cfg.FromContext(ctx).Session.SIDClaim] = sid
+	}
+}
@@ -0,0 +1,186 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestBackChannelLogoutRevokesSID(t *testing.T) {
+	setUp("/config/testing/handler_backchannel.yml")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "backchannel1",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	}))
+	defer idp.Close()
+	cfg.GenOAuth.JWKSURL = idp.URL
+
+	logoutToken := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "backchannel1"
+		ss, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return ss
+	}
+	backChannelLogout := func(token string) int {
+		form := url.Values{"logout_token": {token}}
+		req, _ := http.NewRequest("POST", "/logout/backchannel", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(BackChannelLogoutHandler).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// a session at the IdP is linked to each Vouch Proxy JWT
+	user := structs.User{Username: "testuser", Email: "test@example.com"}
+	vouchJWT := func(sid string) string {
+		ptokens := structs.PTokens{PIdToken: logoutToken(jwt.MapClaims{"sid": sid})}
+		customClaims := structs.CustomClaims{}
+		addSIDClaim(context.Background(), &customClaims, ptokens)
+		vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, customClaims, ptokens)
+		assert.NoError(t, err)
+		return vpjwt
+	}
+	jwt1 := vouchJWT("sid-1")
+	jwt2 := vouchJWT("sid-2")
+
+	validate := func(vpjwt string) int {
+		req, _ := http.NewRequest("GET", "http://myapp.example.com/validate", nil)
+		req.Host = "myapp.example.com"
+		req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt, Expires: time.Now().Add(time.Hour)})
+		rr := httptest.NewRecorder()
+		jwtmanager.JWTCacheHandler(http.HandlerFunc(ValidateRequestHandler)).ServeHTTP(rr, req)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusOK, validate(jwt1))
+	assert.Equal(t, http.StatusOK, validate(jwt2))
+
+	event := map[string]interface{}{backChannelLogoutEvent: map[string]interface{}{}}
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   int
+	}{
+		{"no event", jwt.MapClaims{"aud": "vouch-backchannel", "sid": "sid-1"}, http.StatusBadRequest},
+		{"wrong audience", jwt.MapClaims{"aud": "someone-else", "sid": "sid-1", "events": event}, http.StatusBadRequest},
+		{"nonce", jwt.MapClaims{"aud": "vouch-backchannel", "sid": "sid-1", "events": event, "nonce": "n"}, http.StatusBadRequest},
+		{"no sid", jwt.MapClaims{"aud": "vouch-backchannel", "sub": "testuser", "events": event}, http.StatusBadRequest},
+		{"logout", jwt.MapClaims{"aud": []string{"vouch-backchannel"}, "sid": "sid-1", "events": event}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, backChannelLogout(logoutToken(tt.claims)))
+		})
+	}
+
+	// exactly the matching session is gone, even though its response was cached
+	assert.Equal(t, http.StatusUnauthorized, validate(jwt1))
+	assert.Equal(t, http.StatusOK, validate(jwt2))
+
+	// without the IdP's keys the signature can't be checked, so not even a well formed logout_token is taken
+	cfg.GenOAuth.JWKSURL = ""
+	assert.Equal(t, http.StatusBadRequest, backChannelLogout(logoutToken(jwt.MapClaims{"aud": "vouch-backchannel", "sid": "sid-2", "events": event})))
+	assert.Equal(t, http.StatusOK, validate(jwt2))
+}
+
+// the provider whose issuer the logout_token names verifies it, not whichever provider's keys happen to
+func TestBackChannelLogoutIssuer(t *testing.T) {
+	setUp("/config/testing/handler_backchannel.yml")
+	defer func() { cfg.OAuthConfigs = cfg.OAuthConfigs[:1] }()
+
+	idp := func(kid string) (*rsa.PrivateKey, *httptest.Server) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kid": kid,
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}}})
+		}))
+		t.Cleanup(ts.Close)
+		return key, ts
+	}
+	key, ts := idp("idp1")
+	otherKey, otherTS := idp("other1")
+	cfg.GenOAuth.JWKSURL = ts.URL
+	cfg.GenOAuth.Issuer = "https://idp.example.com"
+	other := *cfg.GenOAuth
+	other.Name = "other"
+	other.JWKSURL = otherTS.URL
+	other.Issuer = "https://other.example.com"
+	cfg.OAuthConfigs = append(cfg.OAuthConfigs, &other)
+
+	logoutToken := func(key *rsa.PrivateKey, kid, iss string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":    iss,
+			"aud":    "vouch-backchannel",
+			"sid":    "sid-1",
+			"events": map[string]interface{}{backChannelLogoutEvent: map[string]interface{}{}},
+		})
+		token.Header["kid"] = kid
+		ss, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return ss
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"the provider's own", logoutToken(key, "idp1", "https://idp.example.com"), false},
+		{"the other provider's own", logoutToken(otherKey, "other1", "https://other.example.com"), false},
+		{"signed by the other provider", logoutToken(otherKey, "other1", "https://idp.example.com"), true},
+		{"an unknown issuer", logoutToken(key, "idp1", "https://evil.example.com"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := sidFromLogoutToken(context.Background(), tt.token)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	// a provider without a jwks_url is never asked to verify a logout_token
+	other.JWKSURL = ""
+	_, err := sidFromLogoutToken(context.Background(), logoutToken(otherKey, "other1", "https://other.example.com"))
+	assert.Error(t, err)
+}
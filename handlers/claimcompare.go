@@ -0,0 +1,157 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// claimMatches the claim (a single value or a list) satisfies the operator for the values, see `roles.rules`
+// `==` (or no operator) any element equals any of the values, `!=` no element equals any of them,
+// `>` `>=` `<` `<=` any element compares numerically with the one value
+// a missing claim never matches
+func claimMatches(claim interface{}, operator string, values []string, loose bool) bool {
+	var have []interface{}
+	switch c := claim.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		have = c
+	default:
+		have = []interface{}{c}
+	}
+
+	switch operator {
+	case cfg.OperatorNotEqual:
+		return !claimMatches(have, cfg.OperatorEqual, values, loose)
+	case cfg.OperatorGreater, cfg.OperatorGreaterOrEqual, cfg.OperatorLess, cfg.OperatorLessOrEqual:
+		want, err := strconv.ParseFloat(values[0], 64)
+		if err != nil {
+			return false
+		}
+		for _, h := range have {
+			n, ok := claimNumber(h, loose)
+			if ok && compareNumbers(n, operator, want) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, h := range have {
+		for _, v := range values {
+			if claimEquals(h, v, loose) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimHasAny the claim is either a single value or a list
+func claimHasAny(claim interface{}, values []string) bool {
+	return claimMatches(claim, cfg.OperatorEqual, values, true)
+}
+
+// claimEquals the value from the config, always a string, is read as the JSON type of the claim
+// a number is equal to the same number however it's written (`3`, `3.0`), a boolean to `true` or `false`
+// loose also reads a claim which is a string holding a number or a boolean as that type,
+// ignores the case of `true` and `false`, and takes a value of `1` or `0` (a YAML boolean) for a boolean
+func claimEquals(claim interface{}, value string, loose bool) bool {
+	if n, ok := claimNumber(claim, loose); ok {
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			return n == v
+		}
+	}
+	if b, ok := claimBool(claim, loose); ok {
+		if v, ok := parseBool(value, loose); ok {
+			return b == v
+		}
+		if loose && (value == "1" || value == "0") {
+			return b == (value == "1")
+		}
+	}
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return fmt.Sprint(claim) == value
+}
+
+// claimNumber the claim as a number, JSON numbers arrive as float64
+func claimNumber(claim interface{}, loose bool) (float64, bool) {
+	switch c := claim.(type) {
+	case float64:
+		return c, true
+	case int:
+		return float64(c), true
+	case int64:
+		return float64(c), true
+	case json.Number:
+		n, err := c.Float64()
+		return n, err == nil
+	case string:
+		if !loose {
+			return 0, false
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(c), 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func claimBool(claim interface{}, loose bool) (bool, bool) {
+	switch c := claim.(type) {
+	case bool:
+		return c, true
+	case string:
+		if !loose {
+			return false, false
+		}
+		return parseBool(strings.TrimSpace(c), loose)
+	}
+	return false, false
+}
+
+// parseBool only `true` and `false`, in any case if loose
+func parseBool(s string, loose bool) (bool, bool) {
+	if loose {
+		s = strings.ToLower(s)
+	}
+	switch s {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	}
+	return false, false
+}
+
+func compareNumbers(n float64, operator string, want float64) bool {
+	switch operator {
+	case cfg.OperatorGreater:
+		return n > want
+	case cfg.OperatorGreaterOrEqual:
+		return n >= want
+	case cfg.OperatorLess:
+		return n < want
+	case cfg.OperatorLessOrEqual:
+		return n <= want
+	}
+	return false
+}
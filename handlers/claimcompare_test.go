@@ -0,0 +1,70 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_claimMatches(t *testing.T) {
+	tests := []struct {
+		name       string
+		claim      interface{}
+		operator   string
+		values     []string
+		wantLoose  bool
+		wantStrict bool
+	}{
+		// numbers
+		{"number equals", float64(3), "", []string{"3"}, true, true},
+		{"number equals decimal", float64(3), "==", []string{"3.0"}, true, true},
+		{"number differs", float64(3), "==", []string{"4"}, false, false},
+		{"json.Number", json.Number("3"), ">=", []string{"3"}, true, true},
+		{"number >=", float64(3), ">=", []string{"3"}, true, true},
+		{"number >", float64(3), ">", []string{"3"}, false, false},
+		{"number <", float64(2.5), "<", []string{"3"}, true, true},
+		{"number <=", float64(-1), "<=", []string{"-1"}, true, true},
+		{"string number >=", "3", ">=", []string{"3"}, true, false},
+		{"string number with spaces", " 5 ", ">", []string{"3"}, true, false},
+		{"string number equals decimal", "3.0", "==", []string{"3"}, true, false},
+		{"string number equals itself", "3", "==", []string{"3"}, true, true},
+		{"not a number >=", "three", ">=", []string{"3"}, false, false},
+		{"bool is not a number", true, ">=", []string{"1"}, false, false},
+		{"list any element >=", []interface{}{float64(1), "7"}, ">=", []string{"5"}, true, false},
+		// booleans
+		{"bool equals true", true, "", []string{"true"}, true, true},
+		{"bool differs", false, "", []string{"true"}, false, false},
+		{"bool from yaml", true, "", []string{"1"}, true, false},
+		{"bool case", true, "", []string{"True"}, true, false},
+		{"string bool", "true", "", []string{"true"}, true, true},
+		{"string bool case", "TRUE", "", []string{"true"}, true, false},
+		{"string t is not a bool", "t", "", []string{"true"}, false, false},
+		{"string 1 is not true", "1", "", []string{"true"}, false, false},
+		// strings and lists
+		{"string", "staff", "", []string{"admins", "staff"}, true, true},
+		{"list", []interface{}{"staff", "sre"}, "", []string{"sre"}, true, true},
+		{"not equal", []interface{}{"staff", "sre"}, "!=", []string{"admins"}, true, true},
+		{"not equal any", []interface{}{"staff", "sre"}, "!=", []string{"sre"}, false, false},
+		{"object", map[string]interface{}{"a": "b"}, "", []string{"map[a:b]"}, false, false},
+		{"missing claim", nil, "", []string{"staff"}, false, false},
+		// a rule never matches a user without the claim
+		{"missing claim not equal", nil, "!=", []string{"staff"}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantLoose, claimMatches(tt.claim, tt.operator, tt.values, true), "loose")
+			assert.Equal(t, tt.wantStrict, claimMatches(tt.claim, tt.operator, tt.values, false), "strict")
+		})
+	}
+}
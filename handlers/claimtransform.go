@@ -0,0 +1,191 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// attributeValue one `type=value` of a distinguished name
+type attributeValue struct {
+	typ   string
+	value string
+}
+
+// transformClaims apply each of `claim_transforms`, such as taking the OUs from the user's distinguished name
+// so that they may be forwarded as a claim or authorized by the teamWhitelist
+func transformClaims(ctx context.Context, user *structs.User, customClaims *structs.CustomClaims) {
+	for _, t := range cfg.FromContext(ctx).ClaimTransforms {
+		raw, ok := customClaims.Claims[t.Claim]
+		if !ok {
+			continue
+		}
+		components := splitClaim(t, raw)
+		if t.Target != "" {
+			customClaims.Claims[t.Target] = components
+		}
+		if t.Teams {
+			user.TeamMemberships = appendUnique(user.TeamMemberships, components...)
+		}
+		log.Debugf("claim_transforms %s %s: %v", t.Claim, t.Split, components)
+	}
+}
+
+// splitClaim the components of each of the strings in the claim, without duplicates
+func splitClaim(t cfg.ClaimTransform, raw interface{}) []string {
+	var values []string
+	switch v := raw.(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	components := []string{}
+	for _, v := range values {
+		switch t.Split {
+		case cfg.SplitDN:
+			avs, err := parseDN(v)
+			if err != nil {
+				log.Warnf("claim_transforms %s: %s", t.Claim, err)
+				continue
+			}
+			for _, av := range avs {
+				if t.Attribute == "" || strings.EqualFold(av.typ, t.Attribute) {
+					components = appendUnique(components, av.value)
+				}
+			}
+		case cfg.SplitPath:
+			sep := t.Separator
+			if sep == "" {
+				sep = "/"
+			}
+			for _, c := range strings.Split(v, sep) {
+				if c = strings.TrimSpace(c); c != "" {
+					components = appendUnique(components, c)
+				}
+			}
+		}
+	}
+	return components
+}
+
+func appendUnique(s []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, e := range s {
+			if e == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+var errDNEscape = errors.New("dn ends with an incomplete escape")
+
+// parseDN the attribute values of a distinguished name such as `CN=John,OU=Eng,DC=example,DC=com`, in order
+// https://tools.ietf.org/html/rfc4514 including escapes (`\,` and `\2C`), quoted values and multi-valued RDNs (`+`)
+func parseDN(dn string) ([]attributeValue, error) {
+	var avs []attributeValue
+	var typ string
+	var value []byte
+	inValue, quoted := false, false
+	// the length of value without trailing spaces which weren't escaped
+	kept := 0
+
+	end := func() error {
+		if !inValue {
+			if strings.TrimSpace(typ+string(value)) == "" && len(avs) == 0 {
+				return nil
+			}
+			return fmt.Errorf("dn %q: %q is not type=value", dn, typ+string(value))
+		}
+		avs = append(avs, attributeValue{typ: strings.TrimSpace(typ), value: string(value[:kept])})
+		typ, value, inValue, kept = "", nil, false, 0
+		return nil
+	}
+
+	for i := 0; i < len(dn); i++ {
+		c := dn[i]
+		switch {
+		case c == '\\':
+			if i+1 >= len(dn) {
+				return nil, errDNEscape
+			}
+			if isHex(dn[i+1]) {
+				if i+2 >= len(dn) || !isHex(dn[i+2]) {
+					return nil, errDNEscape
+				}
+				value = append(value, unhex(dn[i+1])<<4|unhex(dn[i+2]))
+				i += 2
+			} else {
+				value = append(value, dn[i+1])
+				i++
+			}
+			kept = len(value)
+		case c == '"' && inValue:
+			quoted = !quoted
+			kept = len(value)
+		case quoted:
+			value = append(value, c)
+			kept = len(value)
+		case c == '=' && !inValue:
+			typ, value, inValue, kept = string(value), nil, true, 0
+		case c == ',' || c == ';' || c == '+':
+			if err := end(); err != nil {
+				return nil, err
+			}
+		case c == ' ' && len(value) == 0:
+			// leading spaces
+		default:
+			value = append(value, c)
+			if c != ' ' {
+				kept = len(value)
+			}
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("dn %q has an unterminated quote", dn)
+	}
+	if err := end(); err != nil {
+		return nil, err
+	}
+	return avs, nil
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
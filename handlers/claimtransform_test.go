@@ -0,0 +1,125 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func Test_parseDN(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	tests := []struct {
+		name    string
+		dn      string
+		want    []attributeValue
+		wantErr bool
+	}{
+		{"simple", "CN=John,OU=Eng,DC=example,DC=com",
+			[]attributeValue{{"CN", "John"}, {"OU", "Eng"}, {"DC", "example"}, {"DC", "com"}}, false},
+		{"multiple OUs", "CN=John Smith,OU=Platform,OU=Eng,DC=example,DC=com",
+			[]attributeValue{{"CN", "John Smith"}, {"OU", "Platform"}, {"OU", "Eng"}, {"DC", "example"}, {"DC", "com"}}, false},
+		{"spaces around separators", "CN = John , OU = Eng",
+			[]attributeValue{{"CN", "John"}, {"OU", "Eng"}}, false},
+		{"escaped comma", `CN=Smith\, John,OU=Eng`,
+			[]attributeValue{{"CN", "Smith, John"}, {"OU", "Eng"}}, false},
+		{"hex escapes", `CN=Smith\2C John,OU=R\C3\A9seau`,
+			[]attributeValue{{"CN", "Smith, John"}, {"OU", "Réseau"}}, false},
+		{"escaped trailing space", `CN=John\ ,OU=Eng`,
+			[]attributeValue{{"CN", "John "}, {"OU", "Eng"}}, false},
+		{"quoted value", `CN="Smith, John",OU=Eng`,
+			[]attributeValue{{"CN", "Smith, John"}, {"OU", "Eng"}}, false},
+		{"multi-valued RDN", "CN=John+UID=jsmith,OU=Eng",
+			[]attributeValue{{"CN", "John"}, {"UID", "jsmith"}, {"OU", "Eng"}}, false},
+		{"semicolon separator", "CN=John;OU=Eng",
+			[]attributeValue{{"CN", "John"}, {"OU", "Eng"}}, false},
+		{"empty", "", nil, false},
+		{"not type=value", "CN=John,Eng", nil, true},
+		{"incomplete escape", `CN=John\`, nil, true},
+		{"incomplete hex escape", `CN=John\2`, nil, true},
+		{"unterminated quote", `CN="John,OU=Eng`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDN(tt.dn)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_splitClaim(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	tests := []struct {
+		name      string
+		transform cfg.ClaimTransform
+		claim     interface{}
+		want      []string
+	}{
+		{"OU of a DN", cfg.ClaimTransform{Split: cfg.SplitDN, Attribute: "OU"},
+			"CN=John,OU=Eng,DC=example,DC=com", []string{"Eng"}},
+		{"attribute is case insensitive", cfg.ClaimTransform{Split: cfg.SplitDN, Attribute: "ou"},
+			"cn=John,ou=Platform,ou=Eng,dc=example,dc=com", []string{"Platform", "Eng"}},
+		{"every value of a DN", cfg.ClaimTransform{Split: cfg.SplitDN},
+			"CN=John,OU=Eng", []string{"John", "Eng"}},
+		{"OUs of a list of DNs without duplicates", cfg.ClaimTransform{Split: cfg.SplitDN, Attribute: "OU"},
+			[]interface{}{"CN=Admins,OU=Groups,OU=Eng,DC=example", "CN=Staff,OU=Groups,DC=example", "not a dn"},
+			[]string{"Groups", "Eng"}},
+		{"path", cfg.ClaimTransform{Split: cfg.SplitPath},
+			"/Eng/Platform/", []string{"Eng", "Platform"}},
+		{"path with separator", cfg.ClaimTransform{Split: cfg.SplitPath, Separator: `\`},
+			`EXAMPLE\Eng`, []string{"EXAMPLE", "Eng"}},
+		{"not a string", cfg.ClaimTransform{Split: cfg.SplitPath}, 42.0, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, splitClaim(tt.transform, tt.claim))
+		})
+	}
+}
+
+func TestVerifyUserByOU(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	cfg.Cfg.Domains = nil
+	cfg.Cfg.TeamWhiteList = []string{"Eng"}
+	cfg.Cfg.ClaimTransforms = []cfg.ClaimTransform{{Claim: "dn", Split: cfg.SplitDN, Attribute: "OU", Target: "ous", Teams: true}}
+
+	tests := []struct {
+		name   string
+		dn     string
+		wantOK bool
+	}{
+		{"in Eng", "CN=John,OU=Eng,DC=example,DC=com", true},
+		{"in Eng under another OU", "CN=John,OU=Platform,OU=Eng,DC=example,DC=com", true},
+		{"in Sales", "CN=Jane,OU=Sales,DC=example,DC=com", false},
+		{"Eng is not an OU", "CN=Eng,OU=Sales,DC=example,DC=com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := structs.User{Username: "john"}
+			customClaims := structs.CustomClaims{Claims: map[string]interface{}{"dn": tt.dn}}
+			transformClaims(context.Background(), &user, &customClaims)
+
+			ok, _ := verifyUser(context.Background(), user)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, user.TeamMemberships, customClaims.Claims["ous"])
+		})
+	}
+}
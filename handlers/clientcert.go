@@ -0,0 +1,101 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// clientCertVerified nginx's $ssl_client_verify for a certificate which it verified, otherwise NONE or FAILED:reason
+const clientCertVerified = "SUCCESS"
+
+var errClientCertNoIdentity = errors.New("the client certificate's subject has neither an email address nor a CN")
+
+// clientCertJWT with `client_cert.enabled` a JWT for the user of the client certificate verified by nginx
+// "" if no certificate was presented, an error if it failed verification or its user isn't authorized
+// the JWT is also set in the cookie, which nginx may pass on to the browser
+func clientCertJWT(w http.ResponseWriter, r *http.Request) (string, error) {
+	verify := r.Header.Get(cfg.FromContext(r.Context()).ClientCert.VerifyHeader)
+	if verify == "" || verify == "NONE" {
+		return "", nil
+	}
+	if verify != clientCertVerified {
+		return "", fmt.Errorf("the client certificate was not verified: %s %s", cfg.FromContext(r.Context()).ClientCert.VerifyHeader, verify)
+	}
+
+	dn := r.Header.Get(cfg.FromContext(r.Context()).ClientCert.DNHeader)
+	user, customClaims, err := clientCertUser(dn)
+	if err != nil {
+		return "", fmt.Errorf("client certificate %q: %w", dn, err)
+	}
+	transformClaims(r.Context(), &user, &customClaims)
+	normalizeGroups(r.Context(), &user, &customClaims)
+
+	_, err = verifyUser(r.Context(), user)
+	auditVerifyUser(r, user, "", err)
+	if err != nil {
+		return "", err
+	}
+
+	jwt, err := jwtmanager.NewVPJWT(r.Context(), user, customClaims, structs.PTokens{})
+	if err != nil {
+		return "", err
+	}
+	cookie.SetCookie(w, r, jwt, customClaims.Claims)
+	audit.Log(r, audit.Login, user.Username, audit.Success, "client certificate")
+	return jwt, nil
+}
+
+// clientCertUser the user named by the subject DN, such as `emailAddress=jane@example.com,CN=Jane Doe,O=Example`
+// by its email address or else its CN, the DN is kept in the `dn` claim for `claim_transforms`
+func clientCertUser(dn string) (structs.User, structs.CustomClaims, error) {
+	avs, err := parseDN(dn)
+	if err != nil {
+		return structs.User{}, structs.CustomClaims{}, err
+	}
+	user := structs.User{}
+	for _, av := range avs {
+		switch strings.ToLower(av.typ) {
+		case "emailaddress", "email", "e", "mail":
+			if user.Email == "" {
+				user.Email = av.value
+			}
+		case "cn":
+			if user.Name == "" {
+				user.Name = av.value
+			}
+		}
+	}
+	user.Username = user.Email
+	if user.Username == "" {
+		user.Username = user.Name
+	}
+	if user.Username == "" {
+		return structs.User{}, structs.CustomClaims{}, errClientCertNoIdentity
+	}
+	claims := map[string]interface{}{"dn": dn}
+	if user.Email != "" {
+		claims["email"] = user.Email
+	}
+	if user.Name != "" {
+		claims["name"] = user.Name
+	}
+	return user, structs.CustomClaims{Claims: claims}, nil
+}
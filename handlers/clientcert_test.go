@@ -0,0 +1,99 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+)
+
+func Test_clientCertUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		dn       string
+		username string
+		email    string
+		wantErr  bool
+	}{
+		{"email and cn", "emailAddress=jane@example.com,CN=Jane Doe,OU=Eng,O=Example", "jane@example.com", "jane@example.com", false},
+		{"cn only", "CN=build-agent-7,OU=CI,O=Example", "build-agent-7", "", false},
+		{"escaped cn", `CN=Doe\, Jane,O=Example`, `Doe, Jane`, "", false},
+		{"neither", "OU=Eng,O=Example", "", "", true},
+		{"not a dn", "jane@example.com", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, customClaims, err := clientCertUser(tt.dn)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.username, user.Username)
+			assert.Equal(t, tt.email, user.Email)
+			assert.Equal(t, tt.dn, customClaims.Claims["dn"])
+		})
+	}
+}
+
+func TestValidateRequestHandlerClientCert(t *testing.T) {
+	setUp("/config/testing/handler_clientcert.yml")
+	handler := jwtmanager.JWTCacheHandler(http.HandlerFunc(ValidateRequestHandler))
+
+	tests := []struct {
+		name       string
+		verify     string
+		dn         string
+		wantCode   int
+		wantUser   string
+		wantCookie bool
+	}{
+		{"no certificate", "", "", http.StatusUnauthorized, "", false},
+		{"nginx saw none", "NONE", "", http.StatusUnauthorized, "", false},
+		{"failed verification", "FAILED:certificate has expired", "emailAddress=jane@example.com,CN=Jane Doe", http.StatusUnauthorized, "", false},
+		{"verified", "SUCCESS", "emailAddress=jane@example.com,CN=Jane Doe,O=Example", http.StatusOK, "jane@example.com", true},
+		{"outside vouch.domains", "SUCCESS", "emailAddress=joe@example.org,CN=Joe", http.StatusUnauthorized, "", false},
+		{"no email to check against vouch.domains", "SUCCESS", "CN=Jane Doe,O=Example", http.StatusUnauthorized, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://myapp.example.com/validate", nil)
+			if tt.verify != "" {
+				req.Header.Set("X-SSL-Client-Verify", tt.verify)
+				req.Header.Set("X-SSL-Client-S-DN", tt.dn)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.wantCode, rr.Code)
+			assert.Equal(t, tt.wantUser, rr.Header().Get(cfg.Cfg.Headers.User))
+			vouchCookie := false
+			for _, c := range rr.Result().Cookies() {
+				vouchCookie = vouchCookie || (c.Name == cfg.Cfg.Cookie.Name && c.Value != "")
+			}
+			assert.Equal(t, tt.wantCookie, vouchCookie)
+		})
+	}
+
+	// the JWT of a user who already logged in is used over the certificate
+	req := httptest.NewRequest("GET", "http://myapp.example.com/validate", nil)
+	req.Header.Set("X-SSL-Client-Verify", "SUCCESS")
+	req.Header.Set("X-SSL-Client-S-DN", "emailAddress=jane@example.com,CN=Jane Doe")
+	req.Header.Set(cfg.Cfg.Headers.JWT, "not.a.jwt")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
@@ -0,0 +1,91 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+const corsAllowMethods = "GET, HEAD, OPTIONS"
+
+// CORSHandler lets the pages of `cors.allowed_origins` call the wrapped handler with fetch, such as /validate for a soft auth check
+// the Origin is only echoed back when it's allowed, and a preflight is answered 204 without reaching the handler
+func CORSHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(cfg.FromContext(r.Context()).CORS.AllowedOrigins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		w.Header().Add("Vary", "Origin")
+		allowed, wildcard := corsOriginAllowed(r.Context(), origin)
+		if !allowed {
+			if preflight {
+				log.Debugf("cors: preflight from %s, which is not in cors.allowed_origins", origin)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if wildcard {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if cfg.FromContext(r.Context()).CORS.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			if h := r.Header.Get("Access-Control-Request-Headers"); h != "" {
+				w.Header().Set("Access-Control-Allow-Headers", h)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// so that the page can read who is logged in, or why not
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join([]string{cfg.FromContext(r.Context()).Headers.User, cfg.FromContext(r.Context()).Headers.Success, cfg.FromContext(r.Context()).Headers.Error}, ", "))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsOriginAllowed origin is listed in `cors.allowed_origins`, or is a subdomain of a `https://*.example.com` entry
+// wildcard is true if it's allowed only by `*`
+func corsOriginAllowed(ctx context.Context, origin string) (allowed bool, wildcard bool) {
+	o, err := url.Parse(origin)
+	if err != nil || o.Host == "" {
+		return false, false
+	}
+	for _, a := range cfg.FromContext(ctx).CORS.AllowedOrigins {
+		if a == "*" {
+			wildcard = true
+			continue
+		}
+		if strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+			return true, false
+		}
+		if u, err := url.Parse(a); err == nil && strings.HasPrefix(u.Host, "*.") && u.Scheme == o.Scheme {
+			if suffix := strings.ToLower(u.Host[1:]); strings.HasSuffix(strings.ToLower(o.Host), suffix) && len(o.Host) > len(suffix) {
+				return true, false
+			}
+		}
+	}
+	return wildcard, wildcard
+}
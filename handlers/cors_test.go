@@ -0,0 +1,119 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func Test_corsOriginAllowed(t *testing.T) {
+	setUp("/config/testing/handler_email.yml")
+	defer func() { cfg.Cfg.CORS.AllowedOrigins = nil }()
+
+	tests := []struct {
+		origin       string
+		allowed      []string
+		wantAllowed  bool
+		wantWildcard bool
+	}{
+		{"https://app.example.com", []string{"https://app.example.com"}, true, false},
+		{"https://APP.example.com", []string{"https://app.example.com/"}, true, false},
+		{"http://app.example.com", []string{"https://app.example.com"}, false, false},
+		{"https://app.example.com:8443", []string{"https://app.example.com"}, false, false},
+		{"https://app.example.com.evil.com", []string{"https://app.example.com"}, false, false},
+		{"https://spa.example.com", []string{"https://*.example.com"}, true, false},
+		{"https://a.b.example.com", []string{"https://*.example.com"}, true, false},
+		{"https://example.com", []string{"https://*.example.com"}, false, false},
+		{"https://evilexample.com", []string{"https://*.example.com"}, false, false},
+		{"null", []string{"https://app.example.com"}, false, false},
+		{"https://anywhere.org", []string{"https://app.example.com", "*"}, true, true},
+		{"https://app.example.com", []string{"*", "https://app.example.com"}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			cfg.Cfg.CORS.AllowedOrigins = tt.allowed
+			allowed, wildcard := corsOriginAllowed(context.Background(), tt.origin)
+			assert.Equal(t, tt.wantAllowed, allowed)
+			assert.Equal(t, tt.wantWildcard, wildcard)
+		})
+	}
+}
+
+func TestCORSHandler(t *testing.T) {
+	setUp("/config/testing/handler_email.yml")
+	handler := CORSHandler(jwtmanager.JWTCacheHandler(http.HandlerFunc(ValidateRequestHandler)))
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), structs.User{Username: "test@example.com", Email: "test@example.com"}, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+
+	request := func(method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://vouch.example.com/validate", nil)
+		req.Host = "myapp.example.com"
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			req.Header.Set("Access-Control-Request-Headers", "authorization")
+		} else {
+			req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt, Expires: time.Now().Add(time.Hour)})
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// off by default
+	rr := request("GET", "https://spa.example.com")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+
+	cfg.Cfg.CORS.AllowedOrigins = []string{"https://spa.example.com", "https://other.example.com"}
+	cfg.Cfg.CORS.AllowCredentials = true
+	defer func() { cfg.Cfg.CORS.AllowedOrigins = nil; cfg.Cfg.CORS.AllowCredentials = false }()
+
+	rr = request("OPTIONS", "https://spa.example.com")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, "https://spa.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rr.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, corsAllowMethods, rr.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "authorization", rr.Header().Get("Access-Control-Allow-Headers"))
+
+	rr = request("OPTIONS", "https://evil.org")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+
+	rr = request("GET", "https://spa.example.com")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "https://spa.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, rr.Header().Get("Access-Control-Expose-Headers"), cfg.Cfg.Headers.User)
+
+	// the response now comes from the cache, with the headers for this request's origin alone
+	rr = request("GET", "https://other.example.com")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []string{"https://other.example.com"}, rr.Header().Values("Access-Control-Allow-Origin"))
+	assert.Equal(t, []string{"true"}, rr.Header().Values("Access-Control-Allow-Credentials"))
+
+	// not reflected blindly
+	rr = request("GET", "https://evil.org")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, rr.Header().Get("Access-Control-Allow-Credentials"))
+}
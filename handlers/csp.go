@@ -0,0 +1,49 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/responses"
+)
+
+// CSPHandler sends `csp.policy` with a nonce of its own for each response, which the templates put on their inline scripts
+// wrap the handlers which render pages with it, such as /login
+func CSPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.FromContext(r.Context()).CSP.Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		nonce, err := generateCSPNonce()
+		if err != nil {
+			responses.Error500(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", strings.ReplaceAll(cfg.FromContext(r.Context()).CSP.Policy, cfg.CSPNonceToken, nonce))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cfg.CSPNonceCtxKey, nonce)))
+	})
+}
+
+// generateCSPNonce 128 bits of crypto/rand, as the CSP spec recommends, base64url so templates needn't escape it
+func generateCSPNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
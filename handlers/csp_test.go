@@ -0,0 +1,70 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+var cspNonceRE = regexp.MustCompile(`'nonce-([A-Za-z0-9_-]+)'`)
+
+func TestCSPHandler(t *testing.T) {
+	setUp("/config/testing/handler_login_options.yml")
+	cfg.Cfg.CSP.Enabled = true
+	defer func() { cfg.Cfg.CSP.Enabled = false }()
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		url      string
+		wantCode int
+	}{
+		{"login options page", LoginHandler, "/login?url=http://myapp.example.com/", http.StatusOK},
+		{"error page", AuthStateHandler, "/auth/nostate/?state=nostate", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nonces := map[string]bool{}
+			for i := 0; i < 2; i++ {
+				rr := httptest.NewRecorder()
+				CSPHandler(tt.handler).ServeHTTP(rr, httptest.NewRequest("GET", tt.url, nil))
+				assert.Equal(t, tt.wantCode, rr.Code)
+
+				policy := rr.Header().Get("Content-Security-Policy")
+				assert.NotContains(t, policy, cfg.CSPNonceToken)
+				assert.NotContains(t, policy, "unsafe-inline")
+				m := cspNonceRE.FindStringSubmatch(policy)
+				if m == nil {
+					t.Fatalf("no nonce in %q", policy)
+				}
+				assert.Contains(t, rr.Body.String(), `nonce="`+m[1]+`"`)
+				nonces[m[1]] = true
+			}
+			assert.Len(t, nonces, 2, "a nonce of its own for each response")
+		})
+	}
+}
+
+func TestCSPHandlerDisabled(t *testing.T) {
+	setUp("/config/testing/handler_login_options.yml")
+	rr := httptest.NewRecorder()
+	CSPHandler(http.HandlerFunc(LoginHandler)).ServeHTTP(rr, httptest.NewRequest("GET", "/login?url=http://myapp.example.com/", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Content-Security-Policy"))
+	assert.NotContains(t, rr.Body.String(), "nonce=")
+}
@@ -0,0 +1,118 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+)
+
+var (
+	errCSRF       = errors.New("the csrf token is missing or does not match")
+	errCSRFMethod = errors.New("csrf requires the proxy to send the method of the request in X-Forwarded-Method or X-Original-Method")
+)
+
+// CSRFHandler with `csrf.enabled` refuses requests which change state unless they carry the token from the csrf cookie
+// it wraps the jwtcache so that a cached response is never returned to a forged request
+func CSRFHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.FromContext(r.Context()).CSRF.Enabled {
+			if err := csrfValid(r); err != nil {
+				sendCSRFDenied(w, r, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfValid the `csrf.header` matches the csrf cookie, or the request needs no token
+// only a jwt sent by the browser in the cookie can be forged cross-site, a jwt in a header or the querystring can't be
+// the subrequest to /validate is a GET whatever the method of the request, so without the forwarded method it is refused
+func csrfValid(r *http.Request) error {
+	if _, err := cookie.Cookie(r); err != nil {
+		return nil
+	}
+	if forwarded.Value(r, "X-Forwarded-Method") == "" && forwarded.Value(r, "X-Original-Method") == "" {
+		return errCSRFMethod
+	}
+	switch forwarded.Method(r) {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return nil
+	}
+	token := cookie.CSRFCookie(r)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(r.Header.Get(cfg.FromContext(r.Context()).CSRF.Header))) != 1 {
+		return errCSRF
+	}
+	return nil
+}
+
+// sendCSRFDenied 403 from /validate
+// the cookie is left in place, the user's own requests remain valid
+func sendCSRFDenied(w http.ResponseWriter, r *http.Request, err error) {
+	metrics.ValidateRequest(metrics.ValidateDenied)
+	if errors.Is(err, errCSRFMethod) {
+		log.Errorf("%s: %s%s", err, forwarded.Host(r), forwarded.URI(r))
+	} else {
+		log.Infof("%s: %s %s%s", err, forwarded.Method(r), forwarded.Host(r), forwarded.URI(r))
+	}
+	w.Header().Set(cfg.FromContext(r.Context()).Headers.Error, err.Error())
+	http.Error(w, err.Error(), http.StatusForbidden)
+}
+
+// issueCSRFToken a new csrf token alongside the jwt at login
+func issueCSRFToken(w http.ResponseWriter, r *http.Request, claims map[string]interface{}) {
+	if !cfg.FromContext(r.Context()).CSRF.Enabled {
+		return
+	}
+	token, err := generateSessionID()
+	if err != nil {
+		log.Errorf("could not generate a csrf token: %s", err)
+		return
+	}
+	cookie.SetCSRFCookie(w, r, token, claims)
+}
+
+// renewCSRFToken the csrf cookie expires with the reissued jwt, the token itself is kept since the app may hold it
+func renewCSRFToken(w http.ResponseWriter, r *http.Request, claims map[string]interface{}) {
+	if !cfg.FromContext(r.Context()).CSRF.Enabled {
+		return
+	}
+	if token := cookie.CSRFCookie(r); token != "" {
+		cookie.SetCSRFCookie(w, r, token, claims)
+		return
+	}
+	issueCSRFToken(w, r, claims)
+}
+
+// ensureCSRFToken issues the csrf cookie at /validate to a session in the jwt cookie without one
+// such as a session issued before `csrf.enabled` was set, unless a reissued jwt already came with one
+func ensureCSRFToken(w http.ResponseWriter, r *http.Request, claims map[string]interface{}) {
+	if !cfg.FromContext(r.Context()).CSRF.Enabled || cookie.CSRFCookie(r) != "" {
+		return
+	}
+	if _, err := cookie.Cookie(r); err != nil {
+		return
+	}
+	for _, c := range w.Header().Values("Set-Cookie") {
+		if strings.HasPrefix(c, cfg.FromContext(r.Context()).CSRF.CookieName+"=") {
+			return
+		}
+	}
+	issueCSRFToken(w, r, claims)
+}
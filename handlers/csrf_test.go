@@ -0,0 +1,178 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestCSRFHandler(t *testing.T) {
+	setUp("/config/testing/handler_csrf.yml")
+	handler := CSRFHandler(jwtmanager.JWTCacheHandler(http.HandlerFunc(ValidateRequestHandler)))
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), structs.User{Username: "testuser", Email: "test@example.com"}, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+
+	const token = "Zm9vYmFyYmF6"
+	tests := []struct {
+		name      string
+		method    string
+		jwtCookie bool
+		header    string
+		wantCode  int
+	}{
+		{"GET without token", "GET", true, "", http.StatusOK},
+		{"POST matching token", "POST", true, token, http.StatusOK},
+		// the jwt was allowed and its response cached, which mustn't be returned
+		{"POST mismatching token", "POST", true, "c29tZXRoaW5nZWxzZQ", http.StatusForbidden},
+		{"POST without token", "POST", true, "", http.StatusForbidden},
+		{"DELETE mismatching token", "delete", true, "c29tZXRoaW5nZWxzZQ", http.StatusForbidden},
+		{"POST jwt in header", "POST", false, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/validate", nil)
+			req.Host = "app.example.com"
+			req.Header.Set("X-Forwarded-Method", tt.method)
+			if tt.jwtCookie {
+				req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+			} else {
+				req.Header.Set(cfg.Cfg.Headers.JWT, vpjwt)
+			}
+			req.AddCookie(&http.Cookie{Name: cfg.Cfg.CSRF.CookieName, Value: token})
+			if tt.header != "" {
+				req.Header.Set(cfg.Cfg.CSRF.Header, tt.header)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantCode, rr.Code)
+			if tt.wantCode == http.StatusForbidden {
+				assert.Equal(t, errCSRF.Error(), rr.Header().Get(cfg.Cfg.Headers.Error))
+				assert.Empty(t, rr.Header().Values("Set-Cookie"))
+			}
+		})
+	}
+}
+
+func TestCSRFHandlerWithoutCookie(t *testing.T) {
+	setUp("/config/testing/handler_csrf.yml")
+	handler := CSRFHandler(http.HandlerFunc(ValidateRequestHandler))
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), structs.User{Username: "testuser", Email: "test@example.com"}, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+
+	// an empty header mustn't match a missing csrf cookie
+	req := httptest.NewRequest("GET", "/validate", nil)
+	req.Host = "app.example.com"
+	req.Header.Set("X-Original-Method", "POST")
+	req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+	req.Header.Set(cfg.Cfg.CSRF.Header, "")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	cfg.Cfg.CSRF.Enabled = false
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestCSRFHandlerWithoutMethod(t *testing.T) {
+	setUp("/config/testing/handler_csrf.yml")
+	handler := CSRFHandler(http.HandlerFunc(ValidateRequestHandler))
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), structs.User{Username: "testuser", Email: "test@example.com"}, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+
+	// the subrequest is a GET whichever method the browser used
+	req := httptest.NewRequest("GET", "/validate", nil)
+	req.Host = "app.example.com"
+	req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, errCSRFMethod.Error(), rr.Header().Get(cfg.Cfg.Headers.Error))
+
+	// a jwt in a header can't be forged
+	req = httptest.NewRequest("GET", "/validate", nil)
+	req.Host = "app.example.com"
+	req.Header.Set(cfg.Cfg.Headers.JWT, vpjwt)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestValidateRequestHandlerIssuesCSRFCookie(t *testing.T) {
+	setUp("/config/testing/handler_csrf.yml")
+	handler := CSRFHandler(http.HandlerFunc(ValidateRequestHandler))
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), structs.User{Username: "testuser", Email: "test@example.com"}, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+
+	// a session issued before csrf was enabled has no csrf cookie
+	req := httptest.NewRequest("GET", "/validate", nil)
+	req.Host = "app.example.com"
+	req.Header.Set("X-Forwarded-Method", "GET")
+	req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var csrf *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == cfg.Cfg.CSRF.CookieName {
+			csrf = c
+		}
+	}
+	if assert.NotNil(t, csrf) {
+		assert.NotEmpty(t, csrf.Value)
+		assert.False(t, csrf.HttpOnly)
+	}
+
+	// nor is it issued again once the browser holds one
+	req.AddCookie(&http.Cookie{Name: cfg.Cfg.CSRF.CookieName, Value: "Zm9vYmFyYmF6"})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Values("Set-Cookie"))
+}
+
+func TestAuthStateHandlerCSRFCookie(t *testing.T) {
+	setUp("/config/testing/handler_csrf.yml")
+	idp := stubIdP(`{"sub":"abc","email":"test@example.com"}`)
+	defer idp.Close()
+
+	state, cookies := loginForState(t, "http://app.example.com/hello")
+	rr := authState(t, state, cookies)
+	assert.Equal(t, http.StatusFound, rr.Code)
+
+	var jwt, csrf *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		switch c.Name {
+		case cfg.Cfg.Cookie.Name:
+			jwt = c
+		case cfg.Cfg.CSRF.CookieName:
+			csrf = c
+		}
+	}
+	if !assert.NotNil(t, jwt) || !assert.NotNil(t, csrf) {
+		return
+	}
+	assert.NotEmpty(t, csrf.Value)
+	assert.False(t, csrf.HttpOnly)
+	assert.Equal(t, jwt.Domain, csrf.Domain)
+	assert.Equal(t, jwt.MaxAge, csrf.MaxAge)
+}
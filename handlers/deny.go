@@ -0,0 +1,56 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+)
+
+var errDenied = errors.New("access denied by deny_rules")
+
+// denyRuleFor the first of the `deny_rules` matching the user's claims, nil if none do
+// claims are compared as by `roles.rules` with loose coercion
+func denyRuleFor(ctx context.Context, customClaims map[string]interface{}) *cfg.DenyRule {
+	for i, rule := range cfg.FromContext(ctx).DenyRules {
+		claim, _ := common.ClaimValue(customClaims, rule.Claim)
+		if claimMatches(claim, rule.Operator, rule.Values, true) {
+			return &cfg.FromContext(ctx).DenyRules[i]
+		}
+	}
+	return nil
+}
+
+// denyMessage shown to the user refused by rule
+func denyMessage(rule *cfg.DenyRule) string {
+	if rule.Message != "" {
+		return rule.Message
+	}
+	return errDenied.Error()
+}
+
+// denyError the error logged for the user refused by rule
+func denyError(username string, rule *cfg.DenyRule) error {
+	return fmt.Errorf("%w: %s matched the rule %s for claim %s", errDenied, username, rule.ReasonCode, rule.Claim)
+}
+
+// setErrorCode pass the reason code of a denial in `headers.error_code`
+func setErrorCode(w http.ResponseWriter, r *http.Request, code string) {
+	if cfg.FromContext(r.Context()).Headers.ErrorCode == "" {
+		return
+	}
+	w.Header().Set(cfg.FromContext(r.Context()).Headers.ErrorCode, code)
+}
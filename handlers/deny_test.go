@@ -0,0 +1,63 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestAuthStateHandlerDenyRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		userinfo string
+		wantCode int
+		wantRule string
+		wantBody string
+	}{
+		{"allowed", `{"sub":"abc","email":"test@example.com","email_verified":true,"employee_type":"staff"}`, http.StatusFound, "", ""},
+		{"unverified", `{"sub":"abc","email":"test@example.com","email_verified":false,"employee_type":"staff"}`, http.StatusForbidden, "email_unverified", "Please verify your email address"},
+		{"unverified as a string", `{"sub":"abc","email":"test@example.com","email_verified":"false","employee_type":"staff"}`, http.StatusForbidden, "email_unverified", ""},
+		{"not workforce", `{"sub":"abc","email":"test@example.com","email_verified":true,"employee_type":"guest"}`, http.StatusForbidden, "not_workforce", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUp("/config/testing/handler_deny_rules.yml")
+			buf := &bytes.Buffer{}
+			audit.SetOutput(buf)
+			defer audit.SetOutput(nil)
+			idp := stubIdP(tt.userinfo)
+			defer idp.Close()
+
+			state, cookies := loginForState(t, "http://app.example.com/hello")
+			rr := authState(t, state, cookies)
+			assert.Equal(t, tt.wantCode, rr.Code)
+			assert.Equal(t, tt.wantRule, rr.Header().Get(cfg.Cfg.Headers.ErrorCode))
+			assert.Contains(t, rr.Body.String(), tt.wantBody)
+
+			// verifyUser allowed the user, then the deny rule refused them
+			events := auditEvents(t, buf)
+			e := events[len(events)-1]
+			assert.Equal(t, tt.wantRule, e.Code)
+			if tt.wantRule != "" {
+				assert.Len(t, events, 2)
+				assert.Equal(t, audit.Failure, e.Outcome)
+				assert.Equal(t, "test@example.com", e.User)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// OAuth 2.0 Device Authorization Grant
+// https://tools.ietf.org/html/rfc8628
+
+const (
+	deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	errAuthorizationPending = "authorization_pending"
+	errSlowDown             = "slow_down"
+	errExpiredToken         = "expired_token"
+	errInvalidRequest       = "invalid_request"
+
+	// https://tools.ietf.org/html/rfc8628#section-3.5
+	deviceDefaultInterval = 5
+	deviceSlowDownBy      = 5
+)
+
+// pending device codes, by device_code
+var deviceCodes = cache.New(10*time.Minute, time.Minute)
+
+type deviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error       string `json:"error"`
+}
+
+// devicePoll the IdP is polled no more often than interval
+type devicePoll struct {
+	mu       sync.Mutex
+	interval int
+	next     time.Time
+}
+
+// DeviceCodeHandler /device/code
+// starts the device flow at the IdP and returns the user_code and verification_uri for the user
+func DeviceCodeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Debug("/device/code")
+	if cfg.InstanceOf(r.Context()).GenOAuth.DeviceAuthURL == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	form := url.Values{}
+	form.Set("client_id", cfg.InstanceOf(r.Context()).GenOAuth.ClientID)
+	form.Set("scope", strings.Join(cfg.InstanceOf(r.Context()).GenOAuth.Scopes, " "))
+	if cfg.InstanceOf(r.Context()).GenOAuth.ClientSecret != "" {
+		form.Set("client_secret", cfg.InstanceOf(r.Context()).GenOAuth.ClientSecret)
+	}
+	resp, err := common.HTTPClient(r.Context()).PostForm(cfg.InstanceOf(r.Context()).GenOAuth.DeviceAuthURL, form)
+	if err != nil {
+		log.Error(err)
+		deviceError(w, http.StatusBadGateway, "server_error", 0)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Errorf("/device/code %s returned %s: %s", cfg.InstanceOf(r.Context()).GenOAuth.DeviceAuthURL, resp.Status, body)
+		deviceError(w, http.StatusBadGateway, "server_error", 0)
+		return
+	}
+
+	dar := deviceAuthResponse{}
+	if err := json.Unmarshal(body, &dar); err != nil || dar.DeviceCode == "" {
+		log.Errorf("/device/code could not parse response from %s: %s", cfg.InstanceOf(r.Context()).GenOAuth.DeviceAuthURL, body)
+		deviceError(w, http.StatusBadGateway, "server_error", 0)
+		return
+	}
+	if dar.Interval <= 0 {
+		dar.Interval = deviceDefaultInterval
+	}
+	deviceCodes.Set(dar.DeviceCode, &devicePoll{interval: dar.Interval}, time.Duration(dar.ExpiresIn)*time.Second)
+
+	writeJSON(w, http.StatusOK, dar)
+}
+
+// DeviceTokenHandler /device/token
+// poll with the `device_code` returned by /device/code until the user has approved the login
+// responds `authorization_pending` or `slow_down` (as does the IdP) and finally with the Vouch Proxy JWT
+func DeviceTokenHandler(w http.ResponseWriter, r *http.Request) {
+	log.Debug("/device/token")
+	if cfg.InstanceOf(r.Context()).GenOAuth.DeviceAuthURL == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	deviceCode := r.FormValue("device_code")
+	if deviceCode == "" {
+		deviceError(w, http.StatusBadRequest, errInvalidRequest, 0)
+		return
+	}
+	v, ok := deviceCodes.Get(deviceCode)
+	if !ok {
+		deviceError(w, http.StatusBadRequest, errExpiredToken, 0)
+		return
+	}
+	poll := v.(*devicePoll)
+
+	// don't let the client get us throttled at the IdP
+	poll.mu.Lock()
+	if time.Now().Before(poll.next) {
+		poll.interval += deviceSlowDownBy
+		poll.next = time.Now().Add(time.Duration(poll.interval) * time.Second)
+		interval := poll.interval
+		poll.mu.Unlock()
+		deviceError(w, http.StatusBadRequest, errSlowDown, interval)
+		return
+	}
+	poll.next = time.Now().Add(time.Duration(poll.interval) * time.Second)
+	poll.mu.Unlock()
+
+	dtr, err := pollDeviceToken(r.Context(), deviceCode)
+	if err != nil {
+		log.Error(err)
+		deviceError(w, http.StatusBadGateway, "server_error", 0)
+		return
+	}
+
+	switch dtr.Error {
+	case "":
+	case errAuthorizationPending:
+		deviceError(w, http.StatusBadRequest, errAuthorizationPending, poll.interval)
+		return
+	case errSlowDown:
+		poll.mu.Lock()
+		poll.interval += deviceSlowDownBy
+		poll.next = time.Now().Add(time.Duration(poll.interval) * time.Second)
+		interval := poll.interval
+		poll.mu.Unlock()
+		deviceError(w, http.StatusBadRequest, errSlowDown, interval)
+		return
+	default:
+		// access_denied, expired_token and anything else ends the flow
+		deviceCodes.Delete(deviceCode)
+		log.Infof("/device/token device flow ended by the IdP: %s", dtr.Error)
+		deviceError(w, http.StatusBadRequest, dtr.Error, 0)
+		return
+	}
+	deviceCodes.Delete(deviceCode)
+
+	user := structs.User{}
+	customClaims := structs.CustomClaims{}
+	ptokens := structs.PTokens{PAccessToken: dtr.AccessToken, PIdToken: dtr.IDToken}
+	if ptokens.PIdToken != "" {
+		if _, err := common.VerifyIDToken(r.Context(), ptokens.PIdToken); err != nil {
+			log.Errorf("/device/token %s", err)
+			deviceError(w, http.StatusUnauthorized, "invalid_token", 0)
+			return
+		}
+	}
+	if err := userInfoWithToken(r.Context(), ptokens.PAccessToken, &user, &customClaims); err != nil {
+		if common.Refused(err) {
+			audit.Log(r, audit.Authz, "", audit.Failure, err.Error())
+			log.Errorf("/device/token %s", err)
+			deviceError(w, http.StatusForbidden, errAccessDenied, 0)
+			return
+		}
+		log.Errorf("/device/token error while retrieving user info: %s", err)
+		deviceError(w, http.StatusBadGateway, "server_error", 0)
+		return
+	}
+
+	addSIDClaim(r.Context(), &customClaims, ptokens)
+	transformClaims(r.Context(), &user, &customClaims)
+	normalizeGroups(r.Context(), &user, &customClaims)
+	if err := enrichUser(r.Context(), user, &customClaims); err != nil {
+		log.Errorf("/device/token enrichment failed for %s: %s", user.Username, err)
+		deviceError(w, http.StatusBadGateway, "server_error", 0)
+		return
+	}
+	if err := limitGroups(r.Context(), &user, &customClaims); err != nil {
+		log.Errorf("/device/token %s", err)
+		deviceError(w, http.StatusForbidden, errAccessDenied, 0)
+		return
+	}
+	authorized, err := verifyUser(r.Context(), user)
+	auditVerifyUser(r, user, "", err)
+	if !authorized {
+		log.Errorf("/device/token user is not authorized: %s", err)
+		deviceError(w, http.StatusForbidden, errAccessDenied, 0)
+		return
+	}
+	if rule := denyRuleFor(r.Context(), customClaims.Claims); rule != nil {
+		err := denyError(user.Username, rule)
+		audit.LogCode(r, audit.Authz, user.Username, audit.Failure, rule.ReasonCode, err.Error())
+		log.Errorf("/device/token %s", err)
+		setErrorCode(w, r, rule.ReasonCode)
+		deviceError(w, http.StatusForbidden, errAccessDenied, 0)
+		return
+	}
+	if err := provisionUser(r.Context(), user, customClaims); err != nil {
+		log.Errorf("/device/token provisioning failed for %s: %s", user.Username, err)
+		deviceError(w, http.StatusForbidden, errAccessDenied, 0)
+		return
+	}
+
+	user.Provider = cfg.InstanceOf(r.Context()).GenOAuth.Name
+	tokenstring, err := jwtmanager.NewVPJWT(r.Context(), user, customClaims, ptokens)
+	if err != nil {
+		log.Errorf("/device/token token creation failure: %s", err)
+		deviceError(w, http.StatusInternalServerError, "server_error", 0)
+		return
+	}
+	cookie.SetCookie(w, r, tokenstring, customClaims.Claims)
+	audit.Log(r, audit.Login, user.Username, audit.Success, "device authorization")
+	log.Infof("/device/token issued token for %s", user.Username)
+
+	// the client sends this back as `Authorization: Bearer ${access_token}`
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": tokenstring,
+		"token_type":   "Bearer",
+		"expires_in":   cfg.FromContext(r.Context()).JWT.MaxAge * 60,
+	})
+}
+
+func pollDeviceToken(ctx context.Context, deviceCode string) (*deviceTokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", deviceGrantType)
+	form.Set("device_code", deviceCode)
+	form.Set("client_id", cfg.InstanceOf(ctx).GenOAuth.ClientID)
+	if cfg.InstanceOf(ctx).GenOAuth.ClientSecret != "" {
+		form.Set("client_secret", cfg.InstanceOf(ctx).GenOAuth.ClientSecret)
+	}
+	resp, err := common.HTTPClient(ctx).PostForm(cfg.InstanceOf(ctx).GenOAuth.TokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	dtr := &deviceTokenResponse{}
+	if err := json.Unmarshal(body, dtr); err != nil {
+		return nil, fmt.Errorf("could not parse response from %s (%s): %w", cfg.InstanceOf(ctx).GenOAuth.TokenURL, resp.Status, err)
+	}
+	if dtr.Error == "" && dtr.AccessToken == "" {
+		return nil, fmt.Errorf("no access_token in response from %s (%s)", cfg.InstanceOf(ctx).GenOAuth.TokenURL, resp.Status)
+	}
+	return dtr, nil
+}
+
+// userInfoWithToken fetch the user from the OpenID Connect userinfo endpoint of the provider of ctx with an access token
+// used by the device flow and to refresh group memberships, which are only offered for providers with a userinfo endpoint
+func userInfoWithToken(ctx context.Context, accessToken string, user *structs.User, customClaims *structs.CustomClaims) error {
+	userInfoURL := cfg.OAuth(ctx).UserInfoURL
+	req, err := http.NewRequest("GET", userInfoURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := common.RateLimitedHTTPClient(ctx).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", userInfoURL, resp.Status)
+	}
+	data = common.NormalizeEmail(ctx, data)
+	if err := common.MapClaims(ctx, data, customClaims); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, user); err != nil {
+		return err
+	}
+	user.PrepareUserData()
+	return nil
+}
+
+func deviceError(w http.ResponseWriter, status int, code string, interval int) {
+	body := map[string]interface{}{"error": code}
+	if interval > 0 {
+		body["interval"] = interval
+	}
+	writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(err)
+	}
+}
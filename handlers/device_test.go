@@ -0,0 +1,118 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+)
+
+func postDevice(handler http.HandlerFunc, form url.Values) (*httptest.ResponseRecorder, map[string]interface{}) {
+	req, _ := http.NewRequest("POST", "/device", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	body := map[string]interface{}{}
+	_ = json.Unmarshal(rr.Body.Bytes(), &body)
+	return rr, body
+}
+
+func TestDeviceFlow(t *testing.T) {
+	setUp("/config/testing/handler_device.yml")
+
+	tokenResponses := []string{
+		`{"error":"authorization_pending"}`,
+		`{"error":"slow_down"}`,
+		`{"access_token":"idp-access-token","token_type":"Bearer"}`,
+	}
+	tokenRequests := 0
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/device":
+			assert.Equal(t, "vouch-cli", r.FormValue("client_id"))
+			_, _ = w.Write([]byte(`{"device_code":"dc1","user_code":"ABCD-EFGH","verification_uri":"https://idp.example.com/activate","expires_in":600,"interval":5}`))
+		case "/token":
+			assert.Equal(t, deviceGrantType, r.FormValue("grant_type"))
+			assert.Equal(t, "dc1", r.FormValue("device_code"))
+			if tokenResponses[tokenRequests] != tokenResponses[len(tokenResponses)-1] {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			_, _ = w.Write([]byte(tokenResponses[tokenRequests]))
+			tokenRequests++
+		case "/userinfo":
+			assert.Equal(t, "Bearer idp-access-token", r.Header.Get("Authorization"))
+			_, _ = w.Write([]byte(`{"email":"test@example.com","name":"Test Name"}`))
+		}
+	}))
+	defer idp.Close()
+	cfg.GenOAuth.DeviceAuthURL = idp.URL + "/device"
+	cfg.GenOAuth.TokenURL = idp.URL + "/token"
+	cfg.GenOAuth.UserInfoURL = idp.URL + "/userinfo"
+
+	// pretend the client waited `interval` seconds
+	waited := func() {
+		v, _ := deviceCodes.Get("dc1")
+		v.(*devicePoll).next = time.Time{}
+	}
+
+	rr, body := postDevice(DeviceCodeHandler, url.Values{})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "ABCD-EFGH", body["user_code"])
+	assert.Equal(t, "dc1", body["device_code"])
+
+	poll := url.Values{"device_code": {"dc1"}}
+
+	rr, body = postDevice(DeviceTokenHandler, poll)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, errAuthorizationPending, body["error"])
+
+	// polling too fast is answered without bothering the IdP
+	rr, body = postDevice(DeviceTokenHandler, poll)
+	assert.Equal(t, errSlowDown, body["error"])
+	assert.Equal(t, float64(10), body["interval"])
+	assert.Equal(t, 1, tokenRequests)
+
+	// the IdP asks us to slow down too
+	waited()
+	rr, body = postDevice(DeviceTokenHandler, poll)
+	assert.Equal(t, errSlowDown, body["error"])
+	assert.Equal(t, float64(15), body["interval"])
+
+	waited()
+	rr, body = postDevice(DeviceTokenHandler, poll)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "Bearer", body["token_type"])
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), body["access_token"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, "test@example.com", claims.Username)
+
+	// the device_code is spent
+	rr, body = postDevice(DeviceTokenHandler, poll)
+	assert.Equal(t, errExpiredToken, body["error"])
+}
+
+func TestDeviceFlowNotConfigured(t *testing.T) {
+	setUp("/config/testing/handler_email.yml")
+	rr, _ := postDevice(DeviceCodeHandler, url.Values{})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
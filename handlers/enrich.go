@@ -0,0 +1,89 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// reasonEnrichmentUnavailable the 503 reason when the enrichment webhook fails closed
+const reasonEnrichmentUnavailable = "enrichment_unavailable"
+
+// enrichUser POST the user to the `enrichment.url` webhook and merge the json object it answers with into the claims
+// claims from the IdP are never overwritten
+// if the webhook fails the error is returned, unless `enrichment.fail_open` is set in which case the user carries on without
+func enrichUser(ctx context.Context, user structs.User, customClaims *structs.CustomClaims) error {
+	if cfg.FromContext(ctx).Enrichment.URL == "" {
+		return nil
+	}
+
+	attrs, err := fetchEnrichment(ctx, user, *customClaims)
+	if err != nil {
+		if cfg.FromContext(ctx).Enrichment.FailOpen {
+			log.Warnf("enrichment failed for %s, continuing without it: %s", user.Username, err)
+			return nil
+		}
+		return err
+	}
+	mergeClaims(customClaims, attrs)
+	log.Debugf("user %s enriched by %s: %+v", user.Username, cfg.FromContext(ctx).Enrichment.URL, attrs)
+	return nil
+}
+
+func fetchEnrichment(ctx context.Context, user structs.User, customClaims structs.CustomClaims) (map[string]interface{}, error) {
+	body, err := json.Marshal(provisionRequest{
+		Username: user.Username,
+		Name:     user.Name,
+		Email:    user.Email,
+		Claims:   customClaims.Claims,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: time.Duration(cfg.FromContext(ctx).Enrichment.Timeout) * time.Second}
+	resp, err := client.Post(cfg.FromContext(ctx).Enrichment.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("enrichment webhook %s returned %s", cfg.FromContext(ctx).Enrichment.URL, resp.Status)
+	}
+	attrs := make(map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&attrs); err != nil {
+		return nil, fmt.Errorf("enrichment webhook %s did not answer with a json object: %w", cfg.FromContext(ctx).Enrichment.URL, err)
+	}
+	return attrs, nil
+}
+
+// mergeClaims adds attrs to the claims, keeping any claim of the same name that's already there
+func mergeClaims(customClaims *structs.CustomClaims, attrs map[string]interface{}) {
+	if customClaims.Claims == nil {
+		customClaims.Claims = make(map[string]interface{})
+	}
+	for k, v := range attrs {
+		if _, ok := customClaims.Claims[k]; ok {
+			log.Debugf("enrichment attribute %s ignored, the claim is already set", k)
+			continue
+		}
+		customClaims.Claims[k] = v
+	}
+}
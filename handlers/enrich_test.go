@@ -0,0 +1,130 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func Test_mergeClaims(t *testing.T) {
+	setUp("/config/testing/handler_email.yml")
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		attrs  map[string]interface{}
+		want   map[string]interface{}
+	}{
+		{"no claims from the IdP", nil, map[string]interface{}{"cost_center": "1234"}, map[string]interface{}{"cost_center": "1234"}},
+		{"added", map[string]interface{}{"sub": "abc"}, map[string]interface{}{"manager": "boss@example.com"}, map[string]interface{}{"sub": "abc", "manager": "boss@example.com"}},
+		{"IdP claim kept", map[string]interface{}{"email": "test@example.com"}, map[string]interface{}{"email": "other@example.com"}, map[string]interface{}{"email": "test@example.com"}},
+		{"nothing to add", map[string]interface{}{"sub": "abc"}, map[string]interface{}{}, map[string]interface{}{"sub": "abc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			customClaims := structs.CustomClaims{Claims: tt.claims}
+			mergeClaims(&customClaims, tt.attrs)
+			assert.Equal(t, tt.want, customClaims.Claims)
+		})
+	}
+}
+
+func Test_enrichUser(t *testing.T) {
+	setUp("/config/testing/handler_email.yml")
+	user := structs.User{Username: "testuser", Email: "test@example.com", Name: "Test Name"}
+
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		failOpen bool
+		wantErr  bool
+		wantCC   interface{}
+	}{
+		{"enriched", http.StatusOK, `{"cost_center":"1234"}`, false, false, "1234"},
+		{"error fail closed", http.StatusInternalServerError, ``, false, true, nil},
+		{"error fail open", http.StatusInternalServerError, ``, true, false, nil},
+		{"not json fail closed", http.StatusOK, `cost_center=1234`, false, true, nil},
+		{"not json fail open", http.StatusOK, `cost_center=1234`, true, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer ts.Close()
+			cfg.Cfg.Enrichment.URL = ts.URL
+			cfg.Cfg.Enrichment.Timeout = 1
+			cfg.Cfg.Enrichment.FailOpen = tt.failOpen
+			defer func() { cfg.Cfg.Enrichment.URL = "" }()
+
+			customClaims := structs.CustomClaims{Claims: map[string]interface{}{"sub": "abc"}}
+			err := enrichUser(context.Background(), user, &customClaims)
+			assert.Equal(t, tt.wantErr, err != nil, "enrichUser() err = %v", err)
+			assert.Equal(t, tt.wantCC, customClaims.Claims["cost_center"])
+			assert.Equal(t, "abc", customClaims.Claims["sub"])
+		})
+	}
+}
+
+func Test_enrichUserIssuedToken(t *testing.T) {
+	setUp("/config/testing/handler_email.yml")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"cost_center":"1234","manager":"boss@example.com"}`))
+	}))
+	defer ts.Close()
+	cfg.Cfg.Enrichment.URL = ts.URL
+	cfg.Cfg.Enrichment.Timeout = 1
+	defer func() { cfg.Cfg.Enrichment.URL = "" }()
+
+	user := structs.User{Username: "testuser", Email: "test@example.com", Name: "Test Name"}
+	customClaims := structs.CustomClaims{}
+	assert.NoError(t, enrichUser(context.Background(), user, &customClaims))
+
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, customClaims, structs.PTokens{})
+	assert.NoError(t, err)
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), vpjwt)
+	assert.NoError(t, err)
+	assert.Equal(t, "1234", claims.CustomClaims["cost_center"])
+	assert.Equal(t, "boss@example.com", claims.CustomClaims["manager"])
+}
+
+func TestAuthStateHandlerEnrichmentUnavailable(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	idp := stubIdP(`{"sub":"abc","email":"test@example.com"}`)
+	defer idp.Close()
+
+	enrichment := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer enrichment.Close()
+	cfg.Cfg.Enrichment.URL = enrichment.URL
+	cfg.Cfg.Enrichment.Timeout = 1
+	defer func() { cfg.Cfg.Enrichment.URL = "" }()
+
+	state, cookies := loginForState(t, "http://app.example.com/hello")
+	rr := authState(t, state, cookies)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+	assert.Equal(t, reasonEnrichmentUnavailable, rr.Header().Get(cfg.Cfg.Headers.Error))
+	assert.Contains(t, rr.Body.String(), `"reason":"enrichment_unavailable"`)
+}
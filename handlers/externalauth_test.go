@@ -0,0 +1,104 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestValidateRequestHandlerExternalAuth(t *testing.T) {
+	setUp("/config/testing/handler_external_auth.yml")
+	handler := jwtmanager.JWTCacheHandler(http.HandlerFunc(ValidateRequestHandler))
+	groupsHeader := cfg.Cfg.Headers.ClaimsCleaned["groups"]
+	nameHeader := cfg.Cfg.Headers.ClaimsCleaned["family_name"]
+
+	newJWT := func(username string, teams ...string) string {
+		user := structs.User{Username: username, Email: username + "@example.com", TeamMemberships: teams}
+		customClaims := structs.CustomClaims{Claims: map[string]interface{}{"groups": []interface{}{"staff"}, "family_name": "Smith"}}
+		vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, customClaims, structs.PTokens{})
+		assert.NoError(t, err)
+		return vpjwt
+	}
+	admin := newJWT("bob", "admins")
+	operator := newJWT("carol", "ops")
+
+	tests := []struct {
+		name        string
+		jwt         string
+		id          string
+		host        string
+		wantCode    int
+		wantHeaders []string
+	}{
+		{"validate", operator, "", "app.example.com", http.StatusOK, []string{groupsHeader, nameHeader}},
+		{"validate, policy for the host", operator, "", "admin.example.com", http.StatusForbidden, nil},
+		{"the id's team", operator, "ops", "admin.example.com", http.StatusOK, []string{groupsHeader}},
+		{"not the id's team", admin, "ops", "app.example.com", http.StatusForbidden, nil},
+		{"ids are lowercased", operator, "OPS", "app.example.com", http.StatusOK, []string{groupsHeader}},
+		{"no policy of its own", operator, "narrow", "admin.example.com", http.StatusForbidden, nil},
+		{"no policy of its own, the host's policy", admin, "narrow", "admin.example.com", http.StatusOK, []string{nameHeader}},
+		{"unknown id", operator, "unknown", "app.example.com", http.StatusOK, []string{groupsHeader, nameHeader}},
+		// the responses cached for carol at the ops id aren't served here
+		{"unknown id, policy for the host", operator, "unknown", "admin.example.com", http.StatusForbidden, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// again from the jwtcache, which caches the response per id
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest("GET", "/_external-auth-"+tt.id, nil)
+				if tt.id != "" {
+					req = mux.SetURLVars(req, map[string]string{"id": tt.id})
+				}
+				req.Host = tt.host
+				req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: tt.jwt})
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				assert.Equal(t, tt.wantCode, rr.Code)
+				if tt.wantCode == http.StatusForbidden {
+					assert.Equal(t, errPolicyDenied.Error(), rr.Header().Get(cfg.Cfg.Headers.Error))
+					continue
+				}
+				for _, h := range []string{groupsHeader, nameHeader} {
+					assert.Equal(t, contains(tt.wantHeaders, h), rr.Header().Get(h) != "", h)
+				}
+			}
+		})
+	}
+}
+
+func TestNewVPJWTTeamsForExternalAuth(t *testing.T) {
+	setUp("/config/testing/handler_external_auth.yml")
+	cfg.Cfg.Policies = nil
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), structs.User{Username: "carol", TeamMemberships: []string{"ops"}}, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), vpjwt)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ops"}, claims.Teams)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
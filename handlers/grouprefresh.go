@@ -0,0 +1,103 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// groupRefreshes the groups last fetched for each user, which bounds the calls to the userinfo endpoint
+// to one per user for each `groups.refresh_interval` however many sessions or requests they have
+var groupRefreshes = cache.New(cache.NoExpiration, 10*time.Minute)
+
+// refreshedGroups the groups claim as found at the userinfo endpoint, found is false if the claim was absent
+// and the team memberships derived from the userinfo as at login, see fetchGroups
+type refreshedGroups struct {
+	groups interface{}
+	found  bool
+	teams  []string
+}
+
+// refreshGroups once the JWT is older than `groups.refresh_interval` fetch the user's groups again
+// and reissue the cookie with them, so that a user removed from a group loses access before the JWT expires
+// if the groups can't be fetched (the access token may have expired) the user keeps the groups they have
+func refreshGroups(w http.ResponseWriter, r *http.Request, claims *jwtmanager.VouchClaims) {
+	interval := time.Duration(cfg.FromContext(r.Context()).Groups.RefreshInterval) * time.Minute
+	if interval == 0 || claims.PAccessToken == "" || time.Since(time.Unix(claims.IssuedAt, 0)) < interval {
+		return
+	}
+
+	var rg refreshedGroups
+	if v, found := groupRefreshes.Get(claims.Username); found {
+		rg = v.(refreshedGroups)
+	} else {
+		current, found := claims.CustomClaims[cfg.FromContext(r.Context()).Groups.Claim]
+		rg = refreshedGroups{current, found, claims.Teams}
+		if fetched, err := fetchGroups(r.Context(), claims); err != nil {
+			log.Warnf("could not refresh groups for %s, keeping the groups they have: %s", claims.Username, err)
+		} else {
+			rg = fetched
+		}
+		groupRefreshes.Set(claims.Username, rg, interval)
+	}
+
+	if claims.CustomClaims == nil {
+		claims.CustomClaims = make(map[string]interface{})
+	}
+	if rg.found {
+		claims.CustomClaims[cfg.FromContext(r.Context()).Groups.Claim] = rg.groups
+	} else {
+		delete(claims.CustomClaims, cfg.FromContext(r.Context()).Groups.Claim)
+	}
+	// as kept by jwtmanager.NewVPJWT for the teamWhitelist of `vouch.policies`
+	if cfg.FromContext(r.Context()).PoliciesUseTeams() {
+		claims.Teams = rg.teams
+	}
+
+	claims.IssuedAt = time.Now().Unix()
+	tokenstring, err := jwtmanager.ReissueVPJWT(r.Context(), *claims)
+	if err != nil {
+		log.Errorf("could not reissue the JWT for %s with refreshed groups: %s", claims.Username, err)
+		return
+	}
+	cookie.SetCookie(w, r, tokenstring, claims.CustomClaims)
+	renewCSRFToken(w, r, claims.CustomClaims)
+	log.Debugf("groups refreshed for %s", claims.Username)
+}
+
+// fetchGroups the groups and team memberships from the userinfo, derived by the claim_transforms, group_normalization
+// and groups.max as they are at login
+func fetchGroups(ctx context.Context, claims *jwtmanager.VouchClaims) (refreshedGroups, error) {
+	user := structs.User{}
+	customClaims := structs.CustomClaims{}
+	// the userinfo endpoint of the provider the user logged in with
+	ctx = cfg.WithOAuth(cfg.WithInstanceOf(context.Background(), ctx), cfg.OAuthFor(ctx, claims.Provider))
+	if err := userInfoWithToken(ctx, claims.PAccessToken, &user, &customClaims); err != nil {
+		return refreshedGroups{}, err
+	}
+	user.Username = claims.Username
+	transformClaims(ctx, &user, &customClaims)
+	normalizeGroups(ctx, &user, &customClaims)
+	if err := limitGroups(ctx, &user, &customClaims); err != nil {
+		return refreshedGroups{}, err
+	}
+	groups, found := customClaims.Claims[cfg.FromContext(ctx).Groups.Claim]
+	return refreshedGroups{groups, found, user.TeamMemberships}, nil
+}
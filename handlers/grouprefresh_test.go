@@ -0,0 +1,158 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// groupRefreshJWT a JWT for testuser issued `age` ago
+func groupRefreshJWT(t *testing.T, groups []interface{}, age time.Duration) string {
+	user := structs.User{Username: "testuser", Email: "test@example.com"}
+	customClaims := structs.CustomClaims{Claims: map[string]interface{}{"groups": groups}}
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, customClaims, structs.PTokens{PAccessToken: "accesstoken"})
+	assert.NoError(t, err)
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), vpjwt)
+	assert.NoError(t, err)
+	claims.IssuedAt = time.Now().Add(-age).Unix()
+	vpjwt, err = jwtmanager.ReissueVPJWT(context.Background(), *claims)
+	assert.NoError(t, err)
+	return vpjwt
+}
+
+func validateWithJWT(t *testing.T, vpjwt string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "/validate", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "app.example.com"
+	req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(ValidateRequestHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestValidateRequestHandlerGroupRefresh(t *testing.T) {
+	setUp("/config/testing/handler_group_refresh.yml")
+	groupRefreshes.Flush()
+
+	calls := 0
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "Bearer accesstoken", r.Header.Get("Authorization"))
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"sub":"abc","email":"test@example.com","groups":["staff"]}`))
+	}))
+	defer ts.Close()
+	cfg.GenOAuth.UserInfoURL = ts.URL
+	groupsHeader := cfg.Cfg.Headers.ClaimHeader + "Groups"
+
+	// a recently issued JWT is left alone
+	rr := validateWithJWT(t, groupRefreshJWT(t, []interface{}{"staff", "platform-admins"}, time.Minute))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"staff","platform-admins"`, rr.Header().Get(groupsHeader))
+	assert.Empty(t, rr.Header().Get("Set-Cookie"))
+	assert.Equal(t, 0, calls)
+
+	// the user has since been removed from platform-admins
+	rr = validateWithJWT(t, groupRefreshJWT(t, []interface{}{"staff", "platform-admins"}, 10*time.Minute))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"staff"`, rr.Header().Get(groupsHeader))
+	assert.Equal(t, 1, calls)
+
+	// the reissued cookie carries the refreshed groups
+	resp := http.Response{Header: rr.Header()}
+	var reissued string
+	for _, c := range resp.Cookies() {
+		if c.Name == cfg.Cfg.Cookie.Name {
+			reissued = c.Value
+		}
+	}
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), reissued)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"staff"}, claims.CustomClaims["groups"])
+
+	// another stale session for the same user within the interval doesn't call the IdP again
+	rr = validateWithJWT(t, groupRefreshJWT(t, []interface{}{"staff", "platform-admins"}, 10*time.Minute))
+	assert.Equal(t, `"staff"`, rr.Header().Get(groupsHeader))
+	assert.Equal(t, 1, calls)
+}
+
+func TestValidateRequestHandlerGroupRefreshFails(t *testing.T) {
+	setUp("/config/testing/handler_group_refresh.yml")
+	groupRefreshes.Flush()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+	cfg.GenOAuth.UserInfoURL = ts.URL
+
+	rr := validateWithJWT(t, groupRefreshJWT(t, []interface{}{"staff"}, 10*time.Minute))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"staff"`, rr.Header().Get(cfg.Cfg.Headers.ClaimHeader+"Groups"))
+}
+
+// without a header for the groups claim it's still kept in the jwt, and the team memberships derived from it are
+// refreshed with it, so that a user removed from a group loses a host of `vouch.policies` as well
+func TestValidateRequestHandlerGroupRefreshTeams(t *testing.T) {
+	setUp("/config/testing/handler_group_refresh_teams.yml")
+	groupRefreshes.Flush()
+
+	userinfo := `{"sub":"abc","email":"test@example.com","groups":["staff","platform-admins"]}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(userinfo))
+	}))
+	defer ts.Close()
+	cfg.GenOAuth.UserInfoURL = ts.URL
+
+	// as at login
+	customClaims := structs.CustomClaims{}
+	assert.NoError(t, common.MapClaims(context.Background(), []byte(userinfo), &customClaims))
+	assert.Contains(t, customClaims.Claims, "groups", "kept for the refresh")
+	user := structs.User{Username: "testuser", Email: "test@example.com"}
+	normalizeGroups(context.Background(), &user, &customClaims)
+	assert.Equal(t, []string{"staff", "platform-admins"}, user.TeamMemberships)
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, customClaims, structs.PTokens{PAccessToken: "accesstoken"})
+	assert.NoError(t, err)
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), vpjwt)
+	assert.NoError(t, err)
+	claims.IssuedAt = time.Now().Add(-10 * time.Minute).Unix()
+	vpjwt, err = jwtmanager.ReissueVPJWT(context.Background(), *claims)
+	assert.NoError(t, err)
+
+	// the user has since been removed from platform-admins
+	userinfo = `{"sub":"abc","email":"test@example.com","groups":["staff"]}`
+	req := httptest.NewRequest("GET", "/validate", nil)
+	req.Host = "admin.example.com"
+	req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(ValidateRequestHandler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	reissued, err := jwtmanager.ClaimsFromJWT(context.Background(), reissuedJWT(rr))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"staff"}, reissued.Teams)
+		assert.Equal(t, []interface{}{"staff"}, reissued.CustomClaims["groups"])
+	}
+}
@@ -0,0 +1,144 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// normalizeGroups rewrite the user's team memberships and the groups claim into their canonical form per `group_normalization`
+// with `group_normalization.teams` the groups of the claim are also added to the team memberships
+func normalizeGroups(ctx context.Context, user *structs.User, customClaims *structs.CustomClaims) {
+	if len(cfg.FromContext(ctx).GroupNormalization.Rules) == 0 && !cfg.FromContext(ctx).GroupNormalization.Teams {
+		return
+	}
+	var teams []string
+	for _, t := range user.TeamMemberships {
+		teams = appendUnique(teams, cfg.NormalizeGroup(ctx, t))
+	}
+
+	var native []string
+	switch v := customClaims.Claims[cfg.FromContext(ctx).Groups.Claim].(type) {
+	case string:
+		native = []string{v}
+	case []string:
+		native = v
+	case []interface{}:
+		for _, g := range v {
+			native = append(native, fmt.Sprint(g))
+		}
+	}
+	if native != nil {
+		groups := []string{}
+		for _, g := range native {
+			groups = appendUnique(groups, cfg.NormalizeGroup(ctx, g))
+		}
+		customClaims.Claims[cfg.FromContext(ctx).Groups.Claim] = groups
+		if cfg.FromContext(ctx).GroupNormalization.Teams {
+			teams = appendUnique(teams, groups...)
+		}
+	}
+	user.TeamMemberships = teams
+	log.Debugf("group_normalization for %s teams %v groups %v", user.Username, teams, customClaims.Claims[cfg.FromContext(ctx).Groups.Claim])
+}
+
+// limitGroups bound the user's team memberships and the groups claim to `groups.max`
+// per `groups.strategy`
+func limitGroups(ctx context.Context, user *structs.User, customClaims *structs.CustomClaims) error {
+	if cfg.FromContext(ctx).Groups.Max <= 0 {
+		return nil
+	}
+
+	teams, err := boundGroups(ctx, user.TeamMemberships)
+	if err != nil {
+		return fmt.Errorf("%s team memberships: %w", user.Username, err)
+	}
+	user.TeamMemberships = teams
+
+	if customClaims.Claims == nil {
+		return nil
+	}
+	raw, ok := customClaims.Claims[cfg.FromContext(ctx).Groups.Claim]
+	if !ok {
+		return nil
+	}
+	var groups []string
+	switch v := raw.(type) {
+	case []string:
+		groups = v
+	case []interface{}:
+		groups = make([]string, 0, len(v))
+		for _, g := range v {
+			groups = append(groups, fmt.Sprint(g))
+		}
+	default:
+		return nil
+	}
+	groups, err = boundGroups(ctx, groups)
+	if err != nil {
+		return fmt.Errorf("%s claim %s: %w", user.Username, cfg.FromContext(ctx).Groups.Claim, err)
+	}
+	customClaims.Claims[cfg.FromContext(ctx).Groups.Claim] = groups
+	return nil
+}
+
+func boundGroups(ctx context.Context, groups []string) ([]string, error) {
+	max := cfg.FromContext(ctx).Groups.Max
+	if len(groups) <= max {
+		return groups, nil
+	}
+	log.Infof("user is in %d groups, more than groups.max %d, applying groups.strategy %s", len(groups), max, cfg.FromContext(ctx).Groups.Strategy)
+
+	switch cfg.FromContext(ctx).Groups.Strategy {
+	case cfg.GroupsError:
+		return nil, fmt.Errorf("%d groups exceeds groups.max %d", len(groups), max)
+	case cfg.GroupsTruncate:
+		return groups[:max], nil
+	}
+
+	// GroupsPreferWhitelist
+	whitelisted := make(map[string]bool, len(cfg.FromContext(ctx).TeamWhiteList))
+	for _, wl := range cfg.FromContext(ctx).TeamWhiteList {
+		whitelisted[teamKey(ctx, cfg.NormalizeGroup(ctx, wl))] = true
+	}
+	kept := make([]string, 0, max)
+	for _, g := range groups {
+		if len(kept) == max {
+			break
+		}
+		if whitelisted[teamKey(ctx, g)] {
+			kept = append(kept, g)
+		}
+	}
+	// fill in the rest, keeping their order
+	for _, g := range groups {
+		if len(kept) == max {
+			break
+		}
+		if !whitelisted[teamKey(ctx, g)] {
+			kept = append(kept, g)
+		}
+	}
+	return kept, nil
+}
+
+// teamKey the team as compared with the teamWhitelist, lowercased with `case_insensitive_teams`
+func teamKey(ctx context.Context, team string) string {
+	if cfg.FromContext(ctx).CaseInsensitiveTeams {
+		return strings.ToLower(team)
+	}
+	return team
+}
@@ -0,0 +1,166 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func manyGroups(n int) []interface{} {
+	groups := make([]interface{}, n)
+	for i := range groups {
+		groups[i] = fmt.Sprintf("group-%d", i)
+	}
+	return groups
+}
+
+func Test_limitGroups(t *testing.T) {
+	setUp("/config/testing/handler_groups.yml")
+
+	tests := []struct {
+		name      string
+		strategy  string
+		groups    []interface{}
+		wantLen   int
+		wantFirst []string
+		wantErr   bool
+	}{
+		{"under the limit", cfg.GroupsPreferWhitelist, manyGroups(10), 10, []string{"group-0"}, false},
+		{"whitelist", cfg.GroupsPreferWhitelist, manyGroups(5000), 50, []string{"group-4321", "group-4999", "group-0"}, false},
+		{"truncate", cfg.GroupsTruncate, manyGroups(5000), 50, []string{"group-0", "group-1"}, false},
+		{"error", cfg.GroupsError, manyGroups(5000), 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Cfg.Groups.Strategy = tt.strategy
+			user := &structs.User{Username: "testuser", Email: "test@example.com"}
+			customClaims := &structs.CustomClaims{Claims: map[string]interface{}{"groups": tt.groups}}
+
+			err := limitGroups(context.Background(), user, customClaims)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			got := customClaims.Claims["groups"].([]string)
+			assert.Len(t, got, tt.wantLen)
+			assert.Equal(t, tt.wantFirst, got[:len(tt.wantFirst)])
+		})
+	}
+}
+
+func Test_limitGroupsCaseInsensitiveTeams(t *testing.T) {
+	setUp("/config/testing/handler_groups.yml")
+	cfg.Cfg.CaseInsensitiveTeams = true
+	groups := manyGroups(5000)
+	groups[4321] = "GROUP-4321"
+	user := &structs.User{Username: "testuser", Email: "test@example.com"}
+	customClaims := &structs.CustomClaims{Claims: map[string]interface{}{"groups": groups}}
+
+	// the whitelisted group is kept whatever its case
+	assert.NoError(t, limitGroups(context.Background(), user, customClaims))
+	assert.Equal(t, "GROUP-4321", customClaims.Claims["groups"].([]string)[0])
+}
+
+func Test_limitGroupsBoundsToken(t *testing.T) {
+	setUp("/config/testing/handler_groups.yml")
+	user := &structs.User{Username: "testuser", Email: "test@example.com"}
+	customClaims := &structs.CustomClaims{Claims: map[string]interface{}{"groups": manyGroups(5000)}}
+	for _, g := range manyGroups(5000) {
+		user.TeamMemberships = append(user.TeamMemberships, g.(string))
+	}
+
+	assert.NoError(t, limitGroups(context.Background(), user, customClaims))
+	assert.Len(t, user.TeamMemberships, 50)
+	assert.Contains(t, user.TeamMemberships, "group-4321")
+
+	// the user is still authorized by the whitelisted group
+	ok, err := verifyUser(context.Background(), *user)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), *user, *customClaims, structs.PTokens{})
+	assert.NoError(t, err)
+	assert.Less(t, len(vpjwt), 4096)
+}
+
+func TestAuthStateHandlerGroupNormalization(t *testing.T) {
+	setUp("/config/testing/handler_group_normalization.yml")
+
+	tests := []struct {
+		name       string
+		userinfo   string
+		wantStatus int
+		wantGroups []string
+	}{
+		{"canonical group", `{"sub":"abc","email":"test@example.com","groups":["/Platform/SRE","/staff"]}`, http.StatusFound, []string{"platform/sre", "staff"}},
+		{"other groups", `{"sub":"abc","email":"test@example.com","groups":["/staff"]}`, http.StatusForbidden, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := stubIdP(tt.userinfo)
+			defer idp.Close()
+
+			state, cookies := loginForState(t, "http://app.example.com/hello")
+			rr := authState(t, state, cookies)
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			if tt.wantStatus != http.StatusFound {
+				return
+			}
+
+			var jwt string
+			for _, c := range rr.Result().Cookies() {
+				if c.Name == cfg.Cfg.Cookie.Name {
+					jwt = c.Value
+				}
+			}
+			claims, err := jwtmanager.ClaimsFromJWT(context.Background(), jwt)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantGroups, toStrings(claims.CustomClaims["groups"]))
+		})
+	}
+}
+
+func Test_normalizeGroups(t *testing.T) {
+	setUp("/config/testing/handler_group_normalization.yml")
+
+	// GitHub team memberships are normalized, and the teamWhitelist may hold either form
+	cfg.GenOAuth.Provider = cfg.Providers.GitHub
+	cfg.Cfg.GroupNormalization.Rules = append(cfg.Cfg.GroupNormalization.Rules, cfg.GroupRule{Provider: cfg.Providers.GitHub, Match: `^myorg/(.+)$`, Replace: "$1"})
+	cfg.Cfg.TeamWhiteList = []string{"myorg/platform/sre"}
+	assert.NoError(t, cfg.ValidateConfiguration())
+
+	user := structs.User{Username: "testuser", TeamMemberships: []string{"myorg/Platform/SRE", "myorg/staff"}}
+	customClaims := structs.CustomClaims{Claims: map[string]interface{}{}}
+	normalizeGroups(context.Background(), &user, &customClaims)
+	assert.Equal(t, []string{"platform/sre", "staff"}, user.TeamMemberships)
+	assert.NotContains(t, customClaims.Claims, "groups")
+
+	ok, err := verifyUser(context.Background(), user)
+	assert.True(t, ok, err)
+}
+
+func toStrings(v interface{}) []string {
+	var s []string
+	for _, e := range v.([]interface{}) {
+		s = append(s, e.(string))
+	}
+	return s
+}
@@ -11,19 +11,28 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package handlers
 
 import (
+	"container/list"
+	"context"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 
+	"github.com/vouch/vouch-proxy/handlers/saml"
+	"github.com/vouch/vouch-proxy/pkg/capturewriter"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
-	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/geoip"
+	"github.com/vouch/vouch-proxy/pkg/providerhealth"
 	"github.com/vouch/vouch-proxy/pkg/providers/adfs"
 	"github.com/vouch/vouch-proxy/pkg/providers/alibaba"
+	"github.com/vouch/vouch-proxy/pkg/providers/apple"
 	"github.com/vouch/vouch-proxy/pkg/providers/azure"
 	"github.com/vouch/vouch-proxy/pkg/providers/common"
 	"github.com/vouch/vouch-proxy/pkg/providers/github"
+	"github.com/vouch/vouch-proxy/pkg/providers/gitlab"
 	"github.com/vouch/vouch-proxy/pkg/providers/google"
 	"github.com/vouch/vouch-proxy/pkg/providers/homeassistant"
 	"github.com/vouch/vouch-proxy/pkg/providers/indieauth"
@@ -39,35 +48,115 @@ type Provider interface {
 	GetUserInfo(r *http.Request, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens, opts ...oauth2.AuthCodeOption) error
 }
 
-const (
-	base64Bytes = 32
+var (
+	log     *zap.SugaredLogger
+	fastlog *zap.Logger
 )
 
-var (
-	sessstore *sessions.CookieStore
-	log       *zap.SugaredLogger
-	fastlog   *zap.Logger
+// state what the package derives from the configuration of a cfg.Instance
+// the caches keyed by a jwt or by the state of a login are shared by every cfg.Instance
+type state struct {
+	sessstore sessions.Store
 	provider  Provider
-)
+	// providers by the name of each of cfg.OAuthConfigs, see providerFor()
+	providers map[string]Provider
+
+	// sessionPinger the Redis of `session.backend`, checked by /healthcheck with `healthcheck.deep_check`, nil for the cookie backend
+	sessionPinger interface{ Ping() error }
+	// sessionKV the Redis of `session.backend`, which `lockout.shared` also keeps its failures in, nil for the cookie backend
+	sessionKV kvStore
+
+	// usedSessions the ids of the login sessions which have already returned to /auth/{state}/
+	// held for as long as a login session lives, sharded per `session.store_shards`
+	usedSessions *shardedCache
+	// authFailures the failed logins of the clients of /auth, see `vouch.lockout`
+	authFailures *failureTracker
+	// loginLimiter the buckets of the clients of /login and /auth, see `vouch.rate_limit`
+	loginLimiter *rateLimiter
+	passkeys     *passkeyStore
+
+	// deepCheckResults the results of the checks of `healthcheck.deep_check`, run at deepCheckAt, guarded by deepCheckMu
+	deepCheckMu      sync.Mutex
+	deepCheckAt      time.Time
+	deepCheckResults map[string]healthCheck
+}
+
+type stateKey struct{}
+
+// std the state of the package configuration, for a request without a cfg.Instance
+var std = &state{
+	usedSessions: newShardedCache(1, 5*time.Minute, 10*time.Minute),
+	authFailures: &failureTracker{clients: make(map[string]*list.Element), recent: list.New()},
+	loginLimiter: newRateLimiter(),
+	passkeys:     &passkeyStore{},
+}
+
+// stateOf the state of the cfg.Instance of ctx, otherwise std
+func stateOf(ctx context.Context) *state {
+	if s, ok := cfg.State(ctx, stateKey{}).(*state); ok {
+		return s
+	}
+	return std
+}
 
 // Configure see main.go configure()
 func Configure() {
 	log = cfg.Logging.Logger
 	fastlog = cfg.Logging.FastLogger
-	// http://www.gorillatoolkit.org/pkg/sessions
-	sessstore = sessions.NewCookieStore([]byte(cfg.Cfg.Session.Key))
-	sessstore.Options.HttpOnly = cfg.Cfg.Cookie.HTTPOnly
-	sessstore.Options.Secure = cfg.Cfg.Cookie.Secure
-	sessstore.Options.SameSite = cookie.SameSite()
-	sessstore.Options.MaxAge = 300 // give the user five minutes to log in at the IdP
-
-	provider = getProvider()
-	provider.Configure()
+	// before the providers, which build their clients with common.HTTPClient()
 	common.Configure()
+	std = newState()
+	for _, p := range std.providers {
+		p.Configure()
+	}
+	capturewriter.Configure()
+	providerhealth.Configure()
+	geoip.Configure()
+}
+
+// ConfigureInstance the session store, providers and the rest of the state of inst, see cfg.NewInstance()
+// the packages the handlers use are configured for inst by pkg/vouch beforehand
+func ConfigureInstance(inst *cfg.Instance) {
+	log = cfg.Logging.Logger
+	fastlog = cfg.Logging.FastLogger
+	s := newState()
+	inst.SetState(stateKey{}, s)
+	for _, p := range s.providers {
+		if ip, ok := p.(interface{ ConfigureInstance(*cfg.Instance) }); ok {
+			ip.ConfigureInstance(inst)
+			continue
+		}
+		p.Configure()
+	}
+}
+
+func newState() *state {
+	s := &state{passkeys: &passkeyStore{}}
+	// http://www.gorillatoolkit.org/pkg/sessions
+	s.sessstore = s.newSessionStore()
+	s.usedSessions = newShardedCache(cfg.Cfg.Session.StoreShards, 5*time.Minute, 10*time.Minute)
+	s.authFailures = s.newFailureTracker()
+	s.loginLimiter = newRateLimiter()
+
+	s.providers = make(map[string]Provider, len(cfg.OAuthConfigs))
+	for _, c := range cfg.OAuthConfigs {
+		s.providers[c.Name] = s.getProvider(c.Provider)
+	}
+	s.provider = s.providers[cfg.GenOAuth.Name]
+	return s
+}
+
+// providerFor the Provider of the oauth provider name, of the cfg.Instance of ctx
+func providerFor(ctx context.Context, name string) Provider {
+	s := stateOf(ctx)
+	if p, ok := s.providers[name]; ok {
+		return p
+	}
+	return s.provider
 }
 
-func getProvider() Provider {
-	switch cfg.GenOAuth.Provider {
+func (s *state) getProvider(name string) Provider {
+	switch name {
 	case cfg.Providers.IndieAuth:
 		return indieauth.Provider{}
 	case cfg.Providers.ADFS:
@@ -82,12 +171,18 @@ func getProvider() Provider {
 		return google.Provider{}
 	case cfg.Providers.GitHub:
 		return github.Provider{PrepareTokensAndClient: common.PrepareTokensAndClient}
+	case cfg.Providers.GitLab:
+		return gitlab.Provider{PrepareTokensAndClient: common.PrepareTokensAndClient}
 	case cfg.Providers.Nextcloud:
 		return nextcloud.Provider{}
 	case cfg.Providers.OIDC:
 		return openid.Provider{}
 	case cfg.Providers.Alibaba:
 		return alibaba.Provider{}
+	case cfg.Providers.Apple:
+		return apple.Provider{}
+	case cfg.Providers.SAML:
+		return saml.Provider{KV: s.sessionKV}
 	default:
 		// shouldn't ever reach this since cfg checks for a properly configure `oauth.provider`
 		log.Fatal("oauth.provider appears to be misconfigured, please check your config")
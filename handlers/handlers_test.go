@@ -11,6 +11,7 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
@@ -47,17 +48,42 @@ func setUp(configFile string) {
 func TestVerifyUserPositiveUserInWhiteList(t *testing.T) {
 	setUp("/config/testing/handler_whitelist.yml")
 	user := &structs.User{Username: "test@example.com", Email: "test@example.com", Name: "Test Name"}
-	ok, err := verifyUser(*user)
+	ok, err := verifyUser(context.Background(), *user)
 	assert.True(t, ok)
 	assert.Nil(t, err)
 }
 
+func TestVerifyUserWhiteListRegex(t *testing.T) {
+	setUp("/config/testing/handler_whitelist_regex.yml")
+	tests := []struct {
+		username string
+		want     bool
+	}{
+		{"test@example.com", true},
+		{"ext-bob@partner.com", true},
+		{"ext-@partner.com", false},
+		{"bob@partner.com", false},
+		// the pattern must match the whole username
+		{"ext-bob@partner.com.evil.com", false},
+		{"xext-bob@partner.com", false},
+		// an entry is a pattern only by its prefix, never a literal username
+		{`regex:ext-[a-z]+@partner\.com`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			ok, err := verifyUser(context.Background(), structs.User{Username: tt.username, Email: tt.username})
+			assert.Equal(t, tt.want, ok)
+			assert.Equal(t, tt.want, err == nil)
+		})
+	}
+}
+
 func TestVerifyUserPositiveAllowAllUsers(t *testing.T) {
 	setUp("/config/testing/handler_allowallusers.yml")
 
 	user := &structs.User{Username: "testuser", Email: "test@example.com", Name: "Test Name"}
 
-	ok, err := verifyUser(*user)
+	ok, err := verifyUser(context.Background(), *user)
 	assert.True(t, ok)
 	assert.Nil(t, err)
 }
@@ -65,7 +91,7 @@ func TestVerifyUserPositiveAllowAllUsers(t *testing.T) {
 func TestVerifyUserPositiveByEmail(t *testing.T) {
 	setUp("/config/testing/handler_email.yml")
 	user := &structs.User{Username: "testuser", Email: "test@example.com", Name: "Test Name"}
-	ok, err := verifyUser(*user)
+	ok, err := verifyUser(context.Background(), *user)
 	assert.True(t, ok)
 	assert.Nil(t, err)
 }
@@ -77,7 +103,7 @@ func TestVerifyUserPositiveByTeam(t *testing.T) {
 	user := &structs.User{Username: "testuser", Email: "test@example.com", Name: "Test Name"}
 	user.TeamMemberships = append(user.TeamMemberships, "org1/team3")
 	user.TeamMemberships = append(user.TeamMemberships, "org1/team1")
-	ok, err := verifyUser(*user)
+	ok, err := verifyUser(context.Background(), *user)
 	assert.True(t, ok)
 	assert.Nil(t, err)
 }
@@ -87,17 +113,44 @@ func TestVerifyUserNegativeByTeam(t *testing.T) {
 	user := &structs.User{Username: "testuser", Email: "test@example.com", Name: "Test Name"}
 	// cfg.Cfg.TeamWhiteList = append(cfg.Cfg.TeamWhiteList, "org1/team1")
 
-	ok, err := verifyUser(*user)
+	ok, err := verifyUser(context.Background(), *user)
 	assert.False(t, ok)
 	assert.NotNil(t, err)
 }
 
+func TestVerifyUserCaseInsensitiveTeams(t *testing.T) {
+	tests := []struct {
+		name            string
+		team            string
+		caseInsensitive bool
+		want            bool
+	}{
+		{"exact", "org1/team1", false, true},
+		{"org case by default", "ORG1/team1", false, false},
+		{"team case by default", "org1/Team1", false, false},
+		{"exact case insensitive", "org1/team1", true, true},
+		{"org case", "ORG1/team1", true, true},
+		{"team case", "org1/TEAM1", true, true},
+		{"mixed case", "Org1/tEaM1", true, true},
+		{"other team", "Org1/Team3", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUp("/config/testing/handler_teams.yml")
+			cfg.Cfg.CaseInsensitiveTeams = tt.caseInsensitive
+			user := structs.User{Username: "testuser", Email: "test@example.com", TeamMemberships: []string{tt.team}}
+			ok, err := verifyUser(context.Background(), user)
+			assert.Equal(t, tt.want, ok, "%v", err)
+		})
+	}
+}
+
 func TestVerifyUserPositiveNoDomainsConfigured(t *testing.T) {
 	setUp("/config/testing/handler_nodomains.yml")
 
 	user := &structs.User{Username: "testuser", Email: "test@example.com", Name: "Test Name"}
 	cfg.Cfg.Domains = make([]string, 0)
-	ok, err := verifyUser(*user)
+	ok, err := verifyUser(context.Background(), *user)
 
 	assert.True(t, ok)
 	assert.Nil(t, err)
@@ -106,7 +159,7 @@ func TestVerifyUserPositiveNoDomainsConfigured(t *testing.T) {
 func TestVerifyUserNegative(t *testing.T) {
 	setUp("/config/testing/test_config.yml")
 	user := &structs.User{Username: "testuser", Email: "test@example.com", Name: "Test Name"}
-	ok, err := verifyUser(*user)
+	ok, err := verifyUser(context.Background(), *user)
 
 	assert.False(t, ok)
 	assert.NotNil(t, err)
@@ -141,11 +194,10 @@ func init() {
 	// log.SetLevel(log.DebugLevel)
 
 	lc = jwtmanager.VouchClaims{
-		Username:       u1.Username,
-		CustomClaims:   customClaims.Claims,
-		PAccessToken:   t1.PAccessToken,
-		PIdToken:       t1.PIdToken,
-		StandardClaims: jwtmanager.StandardClaims,
+		Username:     u1.Username,
+		CustomClaims: customClaims.Claims,
+		PAccessToken: t1.PAccessToken,
+		PIdToken:     t1.PIdToken,
 	}
 	json.Unmarshal([]byte(claimjson), &customClaims.Claims)
 }
@@ -163,9 +215,9 @@ func TestParsedIdPTokens(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			setUp(tt.configFile)
-			uts, err := jwtmanager.NewVPJWT(u1, customClaims, t1)
+			uts, err := jwtmanager.NewVPJWT(context.Background(), u1, customClaims, t1)
 			assert.NoError(t, err)
-			utsParsed, _ := jwtmanager.ParseTokenString(uts)
+			utsParsed, _ := jwtmanager.ParseTokenString(context.Background(), uts)
 			utsPtokens, _ := jwtmanager.PTokenClaims(utsParsed)
 
 			if tt.wantIDPTokens {
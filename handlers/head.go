@@ -0,0 +1,35 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"net/http"
+)
+
+// headWriter drops the body of the response to a HEAD request
+type headWriter struct {
+	http.ResponseWriter
+}
+
+func (w headWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// HeadHandler answer a HEAD request just as the GET would be answered, with the same status and headers but no body
+// for the idempotent endpoints (/validate, /healthcheck...) which monitoring and some proxies check with HEAD
+func HeadHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w = headWriter{w}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
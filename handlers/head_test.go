@@ -0,0 +1,76 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestHeadHealthcheck(t *testing.T) {
+	setUp("/config/testing/handler_email.yml")
+	handler := HeadHandler(http.HandlerFunc(HealthcheckHandler))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("HEAD", "/healthcheck", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.Empty(t, rr.Body.String())
+
+	// GET is unchanged
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/healthcheck", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"ok": true`)
+}
+
+func TestHeadValidate(t *testing.T) {
+	setUp("/config/testing/handler_email.yml")
+	user := structs.User{Username: "testuser", Email: "test@example.com", Name: "Test Name"}
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+	handler := HeadHandler(jwtmanager.JWTCacheHandler(http.HandlerFunc(ValidateRequestHandler)))
+
+	tests := []struct {
+		name       string
+		jwt        string
+		wantStatus int
+		wantUser   string
+	}{
+		{"authorized", vpjwt, http.StatusOK, "testuser"},
+		{"authorized from the cache", vpjwt, http.StatusOK, "testuser"},
+		{"no jwt", "", http.StatusUnauthorized, ""},
+		{"bad jwt", "garbage", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("HEAD", "/validate", nil)
+			req.Host = "myapp.example.com"
+			if tt.jwt != "" {
+				req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: tt.jwt})
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatus, rr.Code)
+			assert.Equal(t, tt.wantUser, rr.Header().Get(cfg.Cfg.Headers.User))
+			assert.Empty(t, rr.Body.String())
+		})
+	}
+}
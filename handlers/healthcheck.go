@@ -11,15 +11,151 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+	"github.com/vouch/vouch-proxy/pkg/providerhealth"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
 )
 
+// deepCheckTTL the result of the checks of `healthcheck.deep_check` is reused for this long
+// so that however often the load balancers probe, the IdP and the session backend are reached once in a while
+const deepCheckTTL = 5 * time.Second
+
+// healthCheck the result of one of the checks of `healthcheck.deep_check`
+type healthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// probeTimeout a probe of the IdP gives up well before a load balancer's probe would
+const probeTimeout = 3 * time.Second
+
 // HealthcheckHandler /healthcheck
 // just returns 200 '{ "ok": true }'
+// with `healthcheck.deep_check` the IdP and the session backend must also be reachable, otherwise 503
+// '{"ok":false,"checks":{"idp":{"ok":false,"error":"..."},"session_store":{"ok":true}}}'
 func HealthcheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	if _, err := fmt.Fprintf(w, "{ \"ok\": true }"); err != nil {
+	if !cfg.FromContext(r.Context()).Healthcheck.DeepCheck {
+		if _, err := fmt.Fprintf(w, "{ \"ok\": true }"); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+
+	ok, checks := deepChecks(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(struct {
+		OK     bool                   `json:"ok"`
+		Checks map[string]healthCheck `json:"checks"`
+	}{ok, checks}); err != nil {
+		log.Error(err)
+	}
+}
+
+// deepChecks the results of the checks, run again once they're deepCheckTTL old
+// requests arriving while the checks run wait for them rather than each running their own
+func deepChecks(ctx context.Context) (bool, map[string]healthCheck) {
+	s := stateOf(ctx)
+	s.deepCheckMu.Lock()
+	defer s.deepCheckMu.Unlock()
+	if s.deepCheckResults == nil || now().Sub(s.deepCheckAt) >= deepCheckTTL {
+		s.deepCheckResults = runDeepChecks(ctx)
+		s.deepCheckAt = now()
+	}
+	ok := true
+	for _, c := range s.deepCheckResults {
+		ok = ok && c.OK
+	}
+	return ok, s.deepCheckResults
+}
+
+func runDeepChecks(ctx context.Context) map[string]healthCheck {
+	checks := map[string]healthCheck{"idp": toHealthCheck("idp", probeIdP(ctx))}
+	if stateOf(ctx).sessionPinger != nil {
+		checks["session_store"] = toHealthCheck("session_store", stateOf(ctx).sessionPinger.Ping())
+	}
+	return checks
+}
+
+// toHealthCheck the detail of a failure is logged, the response only says what failed
+func toHealthCheck(name string, err error) healthCheck {
+	if err == nil {
+		return healthCheck{OK: true}
+	}
+	log.Warnf("/healthcheck %s: %s", name, err)
+	return healthCheck{Error: "unreachable"}
+}
+
+// probeIdP each provider's auth_url (or the IdP's metadata with saml) answers, any response short of a 5xx will do
+func probeIdP(ctx context.Context) error {
+	for _, c := range cfg.InstanceOf(ctx).OAuthConfigs {
+		u := c.AuthURL
+		if c.Provider == cfg.Providers.SAML {
+			u = cfg.FromContext(ctx).SAML.IdPMetadataURL
+		}
+		if err := probe(ctx, u); err != nil {
+			return fmt.Errorf("%s: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// probe a HEAD of u, through the client of the requests to the IdP
+func probe(ctx context.Context, u string) error {
+	if u == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(cfg.WithInstanceOf(context.Background(), ctx), probeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := common.HTTPClient(ctx).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%s answered %s", u, resp.Status)
+	}
+	return nil
+}
+
+// ReadyzHandler /readyz
+// 200 if every provider is healthy, otherwise 503, along with the health of each provider
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready := providerhealth.Ready(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(struct {
+		Ready     bool                             `json:"ready"`
+		Providers map[string]providerhealth.Status `json:"providers"`
+	}{ready, providerhealth.Statuses(r.Context())}); err != nil {
+		log.Error(err)
+	}
+}
+
+// MetricsHandler /metrics
+// the health of each provider and the counts of requests, logins and callbacks for Prometheus
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := providerhealth.WriteMetrics(r.Context(), w); err != nil {
+		log.Error(err)
+		return
+	}
+	if err := metrics.WriteMetrics(w); err != nil {
 		log.Error(err)
 	}
 }
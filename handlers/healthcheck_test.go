@@ -0,0 +1,195 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/providerhealth"
+)
+
+func TestReadyzAndMetricsReflectProviderHealth(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	cfg.Cfg.Readiness.FailureThreshold = 2
+	providerhealth.Success(context.Background(), cfg.GenOAuth.Provider)
+	defer providerhealth.Success(context.Background(), cfg.GenOAuth.Provider)
+
+	readyz := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(ReadyzHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+		return rr
+	}
+	metrics := func() string {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(MetricsHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		return rr.Body.String()
+	}
+
+	rr := readyz()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"ready":true`)
+	assert.Contains(t, metrics(), `vouch_provider_up{provider="oidc"} 1`)
+
+	// the IdP's token endpoint is down
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer idp.Close()
+	cfg.OAuthClient.Endpoint.TokenURL = idp.URL + "/token"
+
+	for i := 0; i < cfg.Cfg.Readiness.FailureThreshold; i++ {
+		state, cookies := loginForState(t, "http://app.example.com/hello")
+		assert.Equal(t, http.StatusBadRequest, authState(t, state, cookies).Code)
+	}
+
+	rr = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"ready":false`)
+	assert.Contains(t, rr.Body.String(), `"oidc":{"healthy":false,"consecutive_failures":2`)
+	m := metrics()
+	assert.Contains(t, m, `vouch_provider_up{provider="oidc"} 0`)
+	assert.Contains(t, m, `vouch_provider_consecutive_failures{provider="oidc"} 2`)
+}
+
+// metricValue the value of the sample on the line beginning with series, 0 if there isn't one
+func metricValue(t *testing.T, series string) float64 {
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(MetricsHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			v, err := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			assert.NoError(t, err)
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetricsCountLoginsAndValidation(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	idp := stubIdP(`{"sub":"abc","email":"test@example.com"}`)
+	defer idp.Close()
+
+	validate := func(result string) float64 {
+		return metricValue(t, `vouch_validate_requests_total{result="`+result+`"}`)
+	}
+	callbacks := func(result string) float64 {
+		return metricValue(t, `vouch_callback_total{provider="oidc",result="`+result+`"}`)
+	}
+	logins, ok, denied, nocookie := metricValue(t, "vouch_login_total"), validate("ok"), validate("denied"), validate("nocookie")
+	callbacksOK, callbacksError := callbacks("ok"), callbacks("error")
+	userInfo := metricValue(t, `vouch_userinfo_duration_seconds_count{provider="oidc"}`)
+
+	state, cookies := loginForState(t, "http://app.example.com/hello")
+	rr := authState(t, state, cookies)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, logins+1, metricValue(t, "vouch_login_total"))
+	assert.Equal(t, callbacksOK+1, callbacks("ok"))
+	assert.Equal(t, userInfo+1, metricValue(t, `vouch_userinfo_duration_seconds_count{provider="oidc"}`))
+
+	// the state was used up
+	assert.Equal(t, http.StatusBadRequest, authState(t, state, cookies).Code)
+	assert.Equal(t, callbacksError+1, callbacks("error"))
+
+	req := httptest.NewRequest("GET", "http://app.example.com/validate", nil)
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	http.HandlerFunc(ValidateRequestHandler).ServeHTTP(httptest.NewRecorder(), req)
+	http.HandlerFunc(ValidateRequestHandler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://app.example.com/validate", nil))
+	req = httptest.NewRequest("GET", "http://app.example.com/validate", nil)
+	req.Header.Set("Authorization", "Bearer not.a.jwt")
+	http.HandlerFunc(ValidateRequestHandler).ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, ok+1, validate("ok"))
+	assert.Equal(t, nocookie+1, validate("nocookie"))
+	assert.Equal(t, denied+1, validate("denied"))
+}
+
+type fakePinger struct{ err error }
+
+func (f *fakePinger) Ping() error { return f.err }
+
+func TestHealthcheckDeepCheck(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	defer func() { now = time.Now; std.sessionPinger = nil; std.deepCheckResults = nil }()
+
+	healthcheck := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(HealthcheckHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/healthcheck", nil))
+		return rr
+	}
+
+	// by default nothing is checked
+	rr := healthcheck()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{ "ok": true }`, rr.Body.String())
+
+	idpStatus, probes := http.StatusOK, 0
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		w.WriteHeader(idpStatus)
+	}))
+	defer idp.Close()
+	cfg.GenOAuth.AuthURL = idp.URL + "/auth"
+	pinger := &fakePinger{}
+	std.sessionPinger = pinger
+	cfg.Cfg.Healthcheck.DeepCheck = true
+	defer func() { cfg.Cfg.Healthcheck.DeepCheck = false }()
+	t0 := time.Now()
+	now = func() time.Time { return t0 }
+	std.deepCheckResults = nil
+
+	rr = healthcheck()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"ok":true,"checks":{"idp":{"ok":true},"session_store":{"ok":true}}}`, rr.Body.String())
+
+	// within deepCheckTTL the results are reused
+	idpStatus = http.StatusServiceUnavailable
+	pinger.err = errors.New("dial tcp 10.0.0.1:6379: connection refused")
+	now = func() time.Time { return t0.Add(deepCheckTTL - time.Second) }
+	assert.Equal(t, http.StatusOK, healthcheck().Code)
+	assert.Equal(t, 1, probes)
+
+	now = func() time.Time { return t0.Add(deepCheckTTL) }
+	rr = healthcheck()
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.JSONEq(t, `{"ok":false,"checks":{"idp":{"ok":false,"error":"unreachable"},"session_store":{"ok":false,"error":"unreachable"}}}`, rr.Body.String())
+	assert.NotContains(t, rr.Body.String(), "10.0.0.1", "the detail is logged, not served")
+	assert.Equal(t, 2, probes)
+
+	// a 4xx is an answer, the IdP is up
+	idpStatus = http.StatusMethodNotAllowed
+	pinger.err = nil
+	now = func() time.Time { return t0.Add(2 * deepCheckTTL) }
+	assert.Equal(t, http.StatusOK, healthcheck().Code)
+
+	// each provider is probed
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	other := *cfg.GenOAuth
+	other.Name = "other"
+	other.AuthURL = down.URL + "/auth"
+	cfg.OAuthConfigs = append(cfg.OAuthConfigs, &other)
+	defer func() { cfg.OAuthConfigs = cfg.OAuthConfigs[:1] }()
+	now = func() time.Time { return t0.Add(3 * deepCheckTTL) }
+	assert.Equal(t, http.StatusServiceUnavailable, healthcheck().Code)
+}
@@ -0,0 +1,78 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+)
+
+var errIdle = errors.New("the session was idle for longer than jwt.idle_timeout")
+
+// idleReissues the JWT reissued with a fresh last_seen in place of each JWT, which bounds the reissues to one per
+// session per touchInterval() and gives the requests in flight with the old JWT the same new one
+var idleReissues = cache.New(cache.NoExpiration, 10*time.Minute)
+
+// idleTimeout `jwt.idle_timeout`, 0 when sessions don't time out
+func idleTimeout(ctx context.Context) time.Duration {
+	return time.Duration(cfg.FromContext(ctx).JWT.IdleTimeout) * time.Minute
+}
+
+// touchInterval how stale last_seen gets before it's updated, so that not every request sets the cookie
+func touchInterval(ctx context.Context) time.Duration {
+	return idleTimeout(ctx) / 10
+}
+
+// lastSeen when the session was last used, a JWT issued before `jwt.idle_timeout` was configured was last seen when issued
+func lastSeen(claims *jwtmanager.VouchClaims) time.Time {
+	if claims.LastSeen == 0 {
+		return time.Unix(claims.IssuedAt, 0)
+	}
+	return time.Unix(claims.LastSeen, 0)
+}
+
+// sessionIdle the session hasn't been used at /validate for `jwt.idle_timeout`
+func sessionIdle(ctx context.Context, claims *jwtmanager.VouchClaims) bool {
+	return idleTimeout(ctx) > 0 && time.Since(lastSeen(claims)) > idleTimeout(ctx)
+}
+
+// touchSession reissue the cookie with last_seen set to now, keeping the JWT's expiry, so that an active user stays
+// logged in until `jwt.maxAge` while an idle one is logged out after `jwt.idle_timeout`
+func touchSession(w http.ResponseWriter, r *http.Request, claims *jwtmanager.VouchClaims, jwt string) {
+	if idleTimeout(r.Context()) == 0 || time.Since(lastSeen(claims)) < touchInterval(r.Context()) {
+		return
+	}
+
+	var tokenstring string
+	if v, found := idleReissues.Get(jwt); found {
+		tokenstring = v.(string)
+	} else {
+		reissued := *claims
+		reissued.LastSeen = time.Now().Unix()
+		var err error
+		if tokenstring, err = jwtmanager.ReissueVPJWT(r.Context(), reissued); err != nil {
+			log.Errorf("could not reissue the JWT for %s with a new last_seen: %s", claims.Username, err)
+			return
+		}
+		idleReissues.Set(jwt, tokenstring, touchInterval(r.Context()))
+		log.Debugf("session of %s seen, now idles out in %d minutes", claims.Username, cfg.FromContext(r.Context()).JWT.IdleTimeout)
+	}
+	cookie.SetCookie(w, r, tokenstring, claims.CustomClaims)
+	renewCSRFToken(w, r, claims.CustomClaims)
+}
@@ -0,0 +1,115 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// idleJWT a JWT for testuser last seen `ago`
+func idleJWT(t *testing.T, ago time.Duration) string {
+	user := structs.User{Username: "testuser", Email: "test@example.com"}
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), vpjwt)
+	assert.NoError(t, err)
+	claims.LastSeen = time.Now().Add(-ago).Unix()
+	vpjwt, err = jwtmanager.ReissueVPJWT(context.Background(), *claims)
+	assert.NoError(t, err)
+	return vpjwt
+}
+
+func TestValidateRequestHandlerIdleTimeout(t *testing.T) {
+	setUp("/config/testing/handler_idle_timeout.yml")
+	idleReissues.Flush()
+
+	tests := []struct {
+		name     string
+		ago      time.Duration
+		wantCode int
+		reissued bool
+	}{
+		{"just seen", 30 * time.Second, http.StatusOK, false},
+		{"seen a while ago", 10 * time.Minute, http.StatusOK, true},
+		{"about to idle out", 29 * time.Minute, http.StatusOK, true},
+		{"idle", 31 * time.Minute, http.StatusUnauthorized, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := idleJWT(t, tt.ago)
+			oldClaims, err := jwtmanager.ClaimsFromJWT(context.Background(), old)
+			assert.NoError(t, err)
+
+			rr := validateWithJWT(t, old)
+			assert.Equal(t, tt.wantCode, rr.Code)
+			reissued := reissuedJWT(rr)
+			assert.Equal(t, tt.reissued, reissued != "")
+			if !tt.reissued {
+				return
+			}
+			claims, err := jwtmanager.ClaimsFromJWT(context.Background(), reissued)
+			assert.NoError(t, err)
+			assert.InDelta(t, time.Now().Unix(), claims.LastSeen, 5)
+			// the session still ends at the JWT's expiry
+			assert.Equal(t, oldClaims.ExpiresAt, claims.ExpiresAt)
+
+			// requests in flight with the old JWT get the same new one, the new one isn't reissued again yet
+			assert.Equal(t, reissued, reissuedJWT(validateWithJWT(t, old)))
+			rr = validateWithJWT(t, reissued)
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Empty(t, reissuedJWT(rr))
+		})
+	}
+}
+
+func TestSessionIdleWithoutLastSeen(t *testing.T) {
+	setUp("/config/testing/handler_idle_timeout.yml")
+	idleReissues.Flush()
+	// a JWT issued before jwt.idle_timeout was configured was last seen when issued
+	cfg.Cfg.JWT.IdleTimeout = 0
+	vpjwt := rollingJWT(t, time.Hour)
+	cfg.Cfg.JWT.IdleTimeout = 30
+
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), vpjwt)
+	assert.NoError(t, err)
+	assert.Zero(t, claims.LastSeen)
+	assert.False(t, sessionIdle(context.Background(), claims))
+	claims.IssuedAt = time.Now().Add(-time.Hour).Unix()
+	assert.True(t, sessionIdle(context.Background(), claims))
+}
+
+func TestValidateRequestHandlerIdleTimeoutDisabled(t *testing.T) {
+	setUp("/config/testing/handler_idle_timeout.yml")
+	idleReissues.Flush()
+	cfg.Cfg.JWT.IdleTimeout = 0
+
+	rr := validateWithJWT(t, idleJWT(t, time.Hour))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, reissuedJWT(rr))
+}
+
+// a response served from the jwtcache doesn't touch the session, so it isn't cached for longer than last_seen goes stale
+func TestJWTCacheIdleTimeout(t *testing.T) {
+	setUp("/config/testing/handler_idle_timeout.yml")
+	jwtmanager.Cache(context.Background()).SetDefault("idle", http.Header{})
+	item, ok := jwtmanager.Cache(context.Background()).Items()["idle"]
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(touchInterval(context.Background())), time.Unix(0, item.Expiration), time.Second)
+}
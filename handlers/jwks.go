@@ -0,0 +1,33 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+)
+
+// JWKSHandler /.well-known/jwks.json
+// the public key which verifies the jwt and `headers.assertion` with an RS* or ES* `jwt.signing_method`, otherwise 404
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	jwks, ok := jwtmanager.JWKS(r.Context())
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if err := json.NewEncoder(w).Encode(jwks); err != nil {
+		log.Error(err)
+	}
+}
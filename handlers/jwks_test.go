@@ -0,0 +1,61 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+)
+
+func TestJWKSHandler(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	jwks := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(JWKSHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+		return rr
+	}
+	assert.Equal(t, http.StatusNotFound, jwks().Code, "the secret of HS256 is never published")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	pubDER, err := x509.MarshalPKIXPublicKey(key.Public())
+	assert.NoError(t, err)
+	pubFile := filepath.Join(t.TempDir(), "jwt.pub")
+	assert.NoError(t, ioutil.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0600))
+	cfg.Cfg.JWT.SigningMethod, cfg.Cfg.JWT.PublicKeyFile = "ES256", pubFile
+	jwtmanager.Configure()
+	defer setUp("/config/testing/handler_oidc.yml")
+
+	rr := jwks()
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var set jwtmanager.JWKSet
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &set))
+	if assert.Len(t, set.Keys, 1) {
+		assert.Equal(t, "EC", set.Keys[0].Kty)
+		assert.Equal(t, "P-256", set.Keys[0].Crv)
+		assert.Equal(t, "ES256", set.Keys[0].Alg)
+	}
+}
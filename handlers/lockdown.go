@@ -0,0 +1,56 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// reasonLockdown the 503 reason when new logins are refused by `lockdown`
+const reasonLockdown = "lockdown"
+
+var errLockdown = errors.New("new logins are suspended")
+
+// lockedOut with `lockdown.enabled` only the `lockdown.allow_users` (by username or email)
+// and the members of `lockdown.allow_groups` (by team membership or the `groups.claim`) may log in
+// users who already hold a JWT are not affected
+func lockedOut(ctx context.Context, user structs.User, customClaims structs.CustomClaims) bool {
+	if !cfg.FromContext(ctx).Lockdown.Enabled {
+		return false
+	}
+	for _, u := range cfg.FromContext(ctx).Lockdown.AllowUsers {
+		if u == user.Username || (user.Email != "" && strings.EqualFold(u, user.Email)) {
+			log.Infof("lockdown: %s is in lockdown.allow_users", user.Username)
+			return false
+		}
+	}
+	if len(cfg.FromContext(ctx).Lockdown.AllowGroups) == 0 {
+		return true
+	}
+	for _, team := range user.TeamMemberships {
+		for _, g := range cfg.FromContext(ctx).Lockdown.AllowGroups {
+			if team == g {
+				log.Infof("lockdown: %s is a member of %s in lockdown.allow_groups", user.Username, g)
+				return false
+			}
+		}
+	}
+	if claimHasAny(customClaims.Claims[cfg.FromContext(ctx).Groups.Claim], cfg.FromContext(ctx).Lockdown.AllowGroups) {
+		log.Infof("lockdown: %s is a member of lockdown.allow_groups", user.Username)
+		return false
+	}
+	return true
+}
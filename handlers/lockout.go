@@ -0,0 +1,195 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/capturewriter"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
+	"github.com/vouch/vouch-proxy/pkg/redis"
+	"github.com/vouch/vouch-proxy/pkg/responses"
+)
+
+const (
+	// lockoutKeyPrefix follows `session.redis.key_prefix` in the key of the failures of each client with `lockout.shared`
+	lockoutKeyPrefix = "lockout:"
+	// lockedKeySuffix of the key which exists while the client is locked out
+	lockedKeySuffix = ":locked"
+)
+
+var errLockedOut = errors.New("too many failed logins")
+
+// LockoutHandler answers 429 to a client which has failed `lockout.threshold` logins within `lockout.window`
+// until `lockout.duration` has passed, wrap /auth and /auth/{state}/ with it
+// a login fails when the IdP answers with an error, the state is invalid or the user isn't permitted,
+// a provider or session store which is unavailable (5xx) is not the client's failure
+func LockoutHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.FromContext(r.Context()).Lockout.Threshold <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := forwarded.ClientIP(r)
+		if wait := stateOf(r.Context()).authFailures.lockedFor(client); wait > 0 {
+			responses.Error429(w, r, int(math.Ceil(wait.Seconds())), fmt.Errorf("%s %w from %s", r.URL.Path, errLockedOut, client))
+			return
+		}
+		cw := &capturewriter.CaptureWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		if status := cw.GetStatusCode(); status >= http.StatusBadRequest && status < http.StatusInternalServerError && status != http.StatusTooManyRequests {
+			if stateOf(r.Context()).authFailures.fail(r.Context(), client) {
+				log.Warnf("lockout: %s failed %d logins within %d seconds, refusing it for %d seconds",
+					client, cfg.FromContext(r.Context()).Lockout.Threshold, cfg.FromContext(r.Context()).Lockout.Window, cfg.FromContext(r.Context()).Lockout.Duration)
+			}
+		}
+	})
+}
+
+// failureTracker the failures of each client, bounded to the `lockout.max_clients` most recently seen
+// with `lockout.shared` they're counted in the Redis of `session.backend` so that every instance locks out the client
+type failureTracker struct {
+	// mu guards the failures kept in memory, Redis counts those it keeps atomically
+	mu      sync.Mutex
+	clients map[string]*list.Element
+	// recent the failures, the most recently seen at the front
+	recent *list.List
+	kv     kvStore
+	prefix string
+}
+
+type failures struct {
+	client string
+	// Count the failures since Since, the first of them within the window
+	Count       int
+	Since       time.Time
+	LockedUntil time.Time
+}
+
+func (s *state) newFailureTracker() *failureTracker {
+	t := &failureTracker{clients: make(map[string]*list.Element), recent: list.New()}
+	if cfg.Cfg.Lockout.Shared {
+		t.kv = s.sessionKV
+		t.prefix = cfg.Cfg.Session.Redis.KeyPrefix + lockoutKeyPrefix
+	}
+	return t
+}
+
+// lockedFor how long until the client may try again, 0 if it isn't locked out
+// a failing Redis falls back to the failures this instance has seen
+func (t *failureTracker) lockedFor(client string) time.Duration {
+	if t.kv != nil {
+		wait, err := t.kv.PTTL(t.prefix + client + lockedKeySuffix)
+		switch {
+		case errors.Is(err, redis.ErrNil):
+			return 0
+		case err == nil:
+			return wait
+		}
+		log.Warnf("lockout: could not get the lockout of %s from session.backend redis: %s", client, err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.get(client)
+	if wait := f.LockedUntil.Sub(now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// fail count a failure of the client, true if it's now locked out
+func (t *failureTracker) fail(ctx context.Context, client string) bool {
+	window := time.Duration(cfg.FromContext(ctx).Lockout.Window) * time.Second
+	duration := time.Duration(cfg.FromContext(ctx).Lockout.Duration) * time.Second
+	if t.kv != nil {
+		locked, err := t.failShared(ctx, client, window, duration)
+		if err == nil {
+			return locked
+		}
+		log.Warnf("lockout: could not count the failures of %s in session.backend redis: %s", client, err)
+	}
+
+	n := now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.get(client)
+	if n.Sub(f.Since) > window {
+		f.Count, f.Since = 0, n
+	}
+	f.Count++
+	locked := f.Count >= cfg.FromContext(ctx).Lockout.Threshold
+	if locked {
+		f.Count, f.LockedUntil = 0, n.Add(duration)
+	}
+	t.put(ctx, f)
+	return locked
+}
+
+// failShared INCR the client's failures, which expire a window after the first of them,
+// and once they reach the threshold set a key which locks the client out until it expires
+func (t *failureTracker) failShared(ctx context.Context, client string, window, duration time.Duration) (bool, error) {
+	key := t.prefix + client
+	count, err := t.kv.Incr(key)
+	if err != nil {
+		return false, err
+	}
+	// INCR keeps the expiry of a key which exists, so only the first failure sets it
+	if count == 1 {
+		if err := t.kv.PExpire(key, window); err != nil {
+			return false, err
+		}
+	}
+	if count < int64(cfg.FromContext(ctx).Lockout.Threshold) {
+		return false, nil
+	}
+	if err := t.kv.Set(key+lockedKeySuffix, []byte("1"), duration); err != nil {
+		return false, err
+	}
+	// the failures start again from 0 once the lockout has passed
+	if err := t.kv.Del(key); err != nil {
+		log.Warnf("lockout: could not reset the failures of %s in session.backend redis: %s", client, err)
+	}
+	return true, nil
+}
+
+// get the failures of the client kept in memory, t.mu must be held
+func (t *failureTracker) get(client string) *failures {
+	if e, ok := t.clients[client]; ok {
+		t.recent.MoveToFront(e)
+		return e.Value.(*failures)
+	}
+	return &failures{client: client}
+}
+
+// put the failures of the client in memory, t.mu must be held
+func (t *failureTracker) put(ctx context.Context, f *failures) {
+	if e, ok := t.clients[f.client]; ok {
+		e.Value = f
+		t.recent.MoveToFront(e)
+		return
+	}
+	t.clients[f.client] = t.recent.PushFront(f)
+	// a flood of spoofed addresses forgets the clients seen longest ago rather than growing without bound
+	for t.recent.Len() > cfg.FromContext(ctx).Lockout.MaxClients {
+		oldest := t.recent.Back()
+		t.recent.Remove(oldest)
+		delete(t.clients, oldest.Value.(*failures).client)
+	}
+}
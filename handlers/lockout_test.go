@@ -0,0 +1,138 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// useLockout a fresh tracker with the clock stopped at t
+func useLockout(t *testing.T, threshold, window, duration, maxClients int) *time.Time {
+	clock := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	cfg.Cfg.Lockout.Threshold = threshold
+	cfg.Cfg.Lockout.Window = window
+	cfg.Cfg.Lockout.Duration = duration
+	cfg.Cfg.Lockout.MaxClients = maxClients
+	std.authFailures = std.newFailureTracker()
+	t.Cleanup(func() {
+		now = time.Now
+		cfg.Cfg.Lockout.Threshold = 0
+		cfg.Cfg.Lockout.Shared = false
+	})
+	return &clock
+}
+
+// lockoutCallback /auth with the IdP's error, or without one the callback carries on to /auth/{state}/
+func lockoutCallback(client string, idpError string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/auth?state=abc&code=authcode&error="+idpError, nil)
+	req.Header.Set("X-Forwarded-For", client)
+	rr := httptest.NewRecorder()
+	LockoutHandler(http.HandlerFunc(CallbackHandler)).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestLockoutHandler(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	clock := useLockout(t, 3, 60, 300, 100)
+
+	assert.Equal(t, http.StatusUnauthorized, lockoutCallback("192.0.2.1", "server_error").Code)
+	assert.Equal(t, http.StatusUnauthorized, lockoutCallback("192.0.2.1", "server_error").Code)
+	// a callback which carries on isn't a failure
+	assert.Equal(t, http.StatusFound, lockoutCallback("192.0.2.1", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, lockoutCallback("192.0.2.1", "server_error").Code)
+
+	rr := lockoutCallback("192.0.2.1", "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "300", rr.Header().Get("Retry-After"))
+	assert.Contains(t, rr.Header().Get(cfg.Cfg.Headers.Error), errLockedOut.Error())
+
+	// each client has failures of its own
+	assert.Equal(t, http.StatusFound, lockoutCallback("192.0.2.2", "").Code)
+
+	*clock = clock.Add(300 * time.Second)
+	assert.Equal(t, http.StatusFound, lockoutCallback("192.0.2.1", "").Code)
+}
+
+func TestLockoutHandlerWindow(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	clock := useLockout(t, 2, 60, 300, 100)
+
+	assert.Equal(t, http.StatusUnauthorized, lockoutCallback("192.0.2.1", "server_error").Code)
+	// the first failure is forgotten once the window has passed
+	*clock = clock.Add(61 * time.Second)
+	assert.Equal(t, http.StatusUnauthorized, lockoutCallback("192.0.2.1", "server_error").Code)
+	assert.Equal(t, http.StatusFound, lockoutCallback("192.0.2.1", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, lockoutCallback("192.0.2.1", "server_error").Code)
+	assert.Equal(t, http.StatusTooManyRequests, lockoutCallback("192.0.2.1", "").Code)
+}
+
+func TestLockoutHandlerOff(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	useLockout(t, 0, 60, 300, 100)
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusUnauthorized, lockoutCallback("192.0.2.1", "server_error").Code)
+	}
+}
+
+func TestFailureTrackerMaxClients(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	useLockout(t, 1, 60, 300, 2)
+
+	assert.True(t, std.authFailures.fail(context.Background(), "192.0.2.1"))
+	assert.True(t, std.authFailures.fail(context.Background(), "192.0.2.2"))
+	assert.True(t, std.authFailures.fail(context.Background(), "192.0.2.3"))
+	assert.Equal(t, 2, std.authFailures.recent.Len())
+	// the client seen longest ago is forgotten
+	assert.Zero(t, std.authFailures.lockedFor("192.0.2.1"))
+	assert.Equal(t, 300*time.Second, std.authFailures.lockedFor("192.0.2.3"))
+}
+
+func TestFailureTrackerShared(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	kv := newFakeKV()
+	std.sessionKV = kv
+	defer func() { std.sessionKV = nil }()
+	cfg.Cfg.Lockout.Shared = true
+	useLockout(t, 2, 60, 300, 100)
+
+	assert.False(t, std.authFailures.fail(context.Background(), "192.0.2.1"))
+	// another instance sees the failures kept in Redis
+	other := std.newFailureTracker()
+	assert.True(t, other.fail(context.Background(), "192.0.2.1"))
+	assert.Equal(t, 300*time.Second, std.authFailures.lockedFor("192.0.2.1"))
+	assert.Zero(t, std.authFailures.recent.Len(), "nothing is kept in memory")
+	key := cfg.Cfg.Session.Redis.KeyPrefix + lockoutKeyPrefix + "192.0.2.1"
+	assert.Equal(t, 300*time.Second, kv.ttls[key+lockedKeySuffix])
+	// the count starts again once the lockout has passed
+	assert.NotContains(t, kv.data, key)
+	assert.Equal(t, 1, kv.calls["PEXPIRE"], "only the first failure sets the window")
+
+	assert.False(t, std.authFailures.fail(context.Background(), "192.0.2.3"))
+	assert.Equal(t, 60*time.Second, kv.ttls[cfg.Cfg.Session.Redis.KeyPrefix+lockoutKeyPrefix+"192.0.2.3"])
+
+	// a failing Redis falls back to the failures this instance has seen
+	kv.failing["INCR"] = errors.New("connection refused")
+	kv.failing["PTTL"] = errors.New("connection refused")
+	assert.False(t, std.authFailures.fail(context.Background(), "192.0.2.2"))
+	assert.True(t, std.authFailures.fail(context.Background(), "192.0.2.2"))
+	assert.Equal(t, 300*time.Second, std.authFailures.lockedFor("192.0.2.2"))
+}
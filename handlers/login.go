@@ -11,6 +11,9 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package handlers
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/http"
@@ -20,11 +23,15 @@ import (
 
 	"github.com/gorilla/sessions"
 	cv "github.com/nirasan/go-oauth-pkce-code-verifier"
-	"github.com/theckman/go-securerandom"
+	"github.com/vouch/vouch-proxy/handlers/saml"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
 	"github.com/vouch/vouch-proxy/pkg/cookie"
 	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
 	"github.com/vouch/vouch-proxy/pkg/responses"
+	"github.com/vouch/vouch-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 )
 
@@ -40,22 +47,23 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	// no matter how you ended up here, make sure the cookie gets cleared out
 	cookie.ClearCookie(w, r)
 
-	session, err := sessstore.Get(r, cfg.Cfg.Session.Name)
+	session, err := loginSession(r)
 	if err != nil {
-		log.Infof("couldn't find existing encrypted secure cookie with name %s: %s (probably fine)", cfg.Cfg.Session.Name, err)
+		responses.Error500(w, r, fmt.Errorf("/login could not create a session: %w", err))
+		return
 	}
 
-	state, err := generateStateNonce()
+	state, err := generateStateNonce(r.Context())
 	if err != nil {
 		log.Error(err)
 	}
 
 	// set the state variable in the session
 	session.Values["state"] = state
+	rememberLoginHost(r, state)
 
 	// set the path for the session cookie to only send the correct cookie to /auth/{state}/
-	// must have a trailing slash. Otherwise, it is send to all endpoints that _start_ with the cookie path.
-	session.Options.Path = fmt.Sprintf("/auth/%s/", state)
+	session.Options.Path = authStateCookiePath(state)
 
 	log.Debugf("session state set to %s", session.Values["state"])
 
@@ -69,6 +77,24 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// with more than one login option the user may need to choose one
+	oauthProvider := cfg.InstanceOf(r.Context()).GenOAuth
+	if len(cfg.FromContext(r.Context()).LoginOptions) > 0 {
+		option := selectLoginOption(r, requestedURL)
+		if option == nil {
+			trace.SpanFromContext(r.Context()).SetAttributes(tracing.AttrDecision.String("login_options"))
+			responses.RenderLoginOptions(w, r, requestedURL, r.URL.Query().Get("domain_hint"))
+			return
+		}
+		log.Debugf("/login option %s selected", option.Name)
+		session.Values["loginOption"] = option.Name
+		oauthProvider = cfg.OAuthFor(r.Context(), option.Provider)
+	}
+	// the provider logged in with is the one which the code is exchanged with at /auth/{state}/
+	session.Values["provider"] = oauthProvider.Name
+	r = r.WithContext(cfg.WithOAuth(r.Context(), oauthProvider))
+	trace.SpanFromContext(r.Context()).SetAttributes(tracing.AttrProvider.String(oauthProvider.Name))
+
 	// set session variable for eventual 302 redirecton to original request
 	session.Values["requestedURL"] = requestedURL
 	log.Debugf("session requestedURL set to %s", session.Values["requestedURL"])
@@ -84,14 +110,59 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	session.Values[requestedURL] = failcount
 
 	// Add code challenge if enabled
-	if cfg.GenOAuth.CodeChallengeMethod != "" {
+	if oauthProvider.CodeChallengeMethod != "" {
 		log.Debugf("Adding code challenge")
-		appendCodeChallenge(*session)
+		appendCodeChallenge(*session, oauthProvider.CodeChallengeMethod)
 	}
 
-	log.Debugf("saving session with failcount %d", failcount)
-	if err = session.Save(r, w); err != nil {
-		log.Error(err)
+	// the id_token returned to /auth/{state}/ must carry the nonce, so that it can't be replayed from another login
+	var idTokenNonce string
+	if oauthProvider.NonceCheck() {
+		if idTokenNonce, err = generateStateNonce(r.Context()); err != nil {
+			responses.Error500(w, r, fmt.Errorf("/login could not generate a nonce: %w", err))
+			return
+		}
+		session.Values["nonce"] = idTokenNonce
+	}
+
+	// with `stateless_state` the state carries what /auth/{state}/ needs in place of the session, which isn't saved
+	if cfg.FromContext(r.Context()).StatelessState {
+		nonce := state
+		if state, err = signLoginState(r.Context(), loginState{
+			Nonce:        state,
+			RequestedURL: requestedURL,
+			Provider:     oauthProvider.Name,
+			RedirectURL:  oauthClientForHost(r.Context(), loginHost(r, *session)).RedirectURL,
+			IDTokenNonce: idTokenNonce,
+		}); err != nil {
+			responses.Error500(w, r, fmt.Errorf("/login could not sign the state: %w", err))
+			return
+		}
+		session.Values["state"] = state
+		setStateCookie(w, r, state, nonce)
+	}
+
+	var oURL string
+	if oauthProvider.Provider == cfg.Providers.SAML {
+		// the IdP posts its response to vouch.saml.acs_url, which carries on to /auth/{state}/
+		if oURL, err = saml.AuthnRequestURL(r.Context(), state); err != nil {
+			responses.Error503(w, r, saml.ReasonIdPMetadata, 0, fmt.Errorf("/login %w", err))
+			return
+		}
+	} else {
+		// the callback_url chosen for the host is saved in the session for the token exchange
+		oURL = oauthLoginURL(r, *session)
+	}
+
+	if !cfg.FromContext(r.Context()).StatelessState {
+		log.Debugf("saving session with failcount %d", failcount)
+		if err = saveSession(r, w, session); err != nil {
+			if isSessionStoreError(err) {
+				responses.Error503(w, r, reasonSessionStore, 0, fmt.Errorf("/login %w", err))
+				return
+			}
+			log.Error(err)
+		}
 	}
 
 	if failcount > failCountLimit {
@@ -102,7 +173,8 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 	// SUCCESS
 	// bounce to oauth provider for login
-	var oURL = oauthLoginURL(r, *session)
+	metrics.Login()
+	trace.SpanFromContext(r.Context()).SetAttributes(tracing.AttrDecision.String("redirect_to_provider"))
 	log.Debugf("redirecting to oauthURL %s", oURL)
 	responses.Redirect302(w, r, oURL)
 }
@@ -112,6 +184,7 @@ var (
 	errInvalidURL = errors.New("requested destination URL appears to be invalid")
 	errURLNotHTTP = errors.New("requested destination URL is not a valid URL (does not begin with 'http://' or 'https://')")
 	errDangerQS   = errors.New("requested destination URL has a dangerous query string")
+	errURLTooLong = errors.New("requested destination URL is too long")
 	badStrings    = []string{"http://", "https://", "data:", "ftp://", "ftps://", "//", "javascript:"}
 	reAmpSemi     = regexp.MustCompile("[&;]")
 )
@@ -126,6 +199,7 @@ var (
 // * All login params starting with vouch- or x-vouch- (case insensitively) are treated as true login params
 // * The "error" login param (case sensitively) is treated as true login param
 // * The "rd" login param (case sensitively) added by nginx ingress is treated as true login param https://github.com/vouch/vouch-proxy/issues/289
+// * The "provider" and "domain_hint" login params (case sensitively) used to select a login option are treated as true login params
 // * All other login params are treated as non-login params
 // * All non-login params between the url param and the first true login param are folded into the url param
 // * All remaining non-login params are considered stray non-login params
@@ -148,7 +222,8 @@ func normalizeLoginURLParam(loginURL *url.URL) (*url.URL, []string, error) {
 		isVouchParam := strings.HasPrefix(lcParamKey, cfg.Branding.LCName) ||
 			strings.HasPrefix(lcParamKey, "x-"+cfg.Branding.LCName) ||
 			paramKey == "error" || // Used by VouchProxy login
-			paramKey == "rd" // Passed to VouchProxy by nginx-ingress and then ignored (see #289)
+			paramKey == "rd" || // Passed to VouchProxy by nginx-ingress and then ignored (see #289)
+			paramKey == "provider" || paramKey == "domain_hint" // login option selection
 
 		if urlParam == nil {
 			// Still looking for url param
@@ -206,10 +281,34 @@ func getValidRequestedURL(r *http.Request) (string, error) {
 		return "", errNoURL
 	}
 
+	return validRequestedURL(r.Context(), u)
+}
+
+// checkRequestedURL the requestedURL held in the session is still valid, before it is used as the redirect after login
+func checkRequestedURL(ctx context.Context, requestedURL string) error {
+	u, err := url.Parse(requestedURL)
+	if err != nil {
+		return fmt.Errorf("%w %s", errInvalidURL, err)
+	}
+	_, err = validRequestedURL(ctx, u)
+	return err
+}
+
+// validRequestedURL the requested URL must be a not too long http(s) URL, without another URL in its query string,
+// within one of the domains Vouch Proxy manages
+func validRequestedURL(ctx context.Context, u *url.URL) (string, error) {
+	if l := len(u.String()); l > cfg.FromContext(ctx).RequestedURLMaxLength {
+		return "", fmt.Errorf("%w: %d characters long, the most allowed is %d (%s.requested_url_max_length)", errURLTooLong, l, cfg.FromContext(ctx).RequestedURLMaxLength, cfg.Branding.LCName)
+	}
+
 	if u.Scheme != "http" && u.Scheme != "https" {
 		return "", errURLNotHTTP
 	}
 
+	if u.Host == "" || u.Opaque != "" {
+		return "", fmt.Errorf("%w: no host", errInvalidURL)
+	}
+
 	for _, v := range u.Query() {
 		// log.Debugf("validateRequestedURL %s:%s", k, v)
 		for _, vval := range v {
@@ -222,19 +321,19 @@ func getValidRequestedURL(r *http.Request) (string, error) {
 	}
 
 	hostname := u.Hostname()
-	if cfg.GenOAuth.Provider != cfg.Providers.IndieAuth {
-		d := domains.Matches(hostname)
+	if cfg.InstanceOf(ctx).GenOAuth.Provider != cfg.Providers.IndieAuth {
+		d := domains.Matches(ctx, hostname)
 		if d == "" {
-			inCookieDomain := (hostname == cfg.Cfg.Cookie.Domain || strings.HasSuffix(hostname, "."+cfg.Cfg.Cookie.Domain))
-			if cfg.Cfg.Cookie.Domain == "" || !inCookieDomain {
+			inCookieDomain := (hostname == cfg.FromContext(ctx).Cookie.Domain || strings.HasSuffix(hostname, "."+cfg.FromContext(ctx).Cookie.Domain))
+			if cfg.FromContext(ctx).Cookie.Domain == "" || !inCookieDomain {
 				return "", fmt.Errorf("%w: not within a %s managed domain", errInvalidURL, cfg.Branding.FullName)
 			}
 		}
 	}
 
 	// if the requested URL is http then the cookie cannot be seen if cfg.Cfg.Cookie.Secure is set
-	if u.Scheme == "http" && cfg.Cfg.Cookie.Secure {
-		return "", fmt.Errorf("%w: mismatch between requested destination URL and '%s.cookie.secure: %v' (the cookie is only visible to 'https' but the requested site is 'http')", errInvalidURL, cfg.Branding.LCName, cfg.Cfg.Cookie.Secure)
+	if u.Scheme == "http" && cfg.FromContext(ctx).Cookie.Secure {
+		return "", fmt.Errorf("%w: mismatch between requested destination URL and '%s.cookie.secure: %v' (the cookie is only visible to 'https' but the requested site is 'http')", errInvalidURL, cfg.Branding.LCName, cfg.FromContext(ctx).Cookie.Secure)
 	}
 
 	return u.String(), nil
@@ -245,55 +344,179 @@ func oauthLoginURL(r *http.Request, session sessions.Session) string {
 	// See relevant RFC: http://tools.ietf.org/html/rfc6749#section-10.12
 	var state string = session.Values["state"].(string)
 	opts := []oauth2.AuthCodeOption{}
-	if cfg.GenOAuth.Provider == cfg.Providers.IndieAuth {
-		return cfg.OAuthClient.AuthCodeURL(state, oauth2.SetAuthURLParam("response_type", "id"))
+	provider := cfg.OAuth(r.Context())
+	if provider.Provider == cfg.Providers.IndieAuth {
+		return provider.Client().AuthCodeURL(state, oauth2.SetAuthURLParam("response_type", "id"))
+	}
+
+	// the callback_url and scopes may depend on the host
+	oauthClient := oauthClientForHost(r.Context(), loginHost(r, session))
+	session.Values["redirectURL"] = oauthClient.RedirectURL
+	// append code challenge and code challenge method query parameters if enabled
+
+	if provider.CodeChallengeMethod != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("code_challenge_method", provider.CodeChallengeMethod))
+		opts = append(opts, oauth2.SetAuthURLParam("code_challenge", session.Values["codeChallenge"].(string)))
+	}
+	if o := provider.AuthCodeOption(); o != nil {
+		opts = append(opts, o)
+	}
+	if nonce, ok := session.Values["nonce"].(string); ok && nonce != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", nonce))
+	}
+	if provider.ClaimsParam != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("claims", provider.ClaimsParam))
+	}
+	if provider.Provider == cfg.Providers.ADFS {
+		opts = append(opts, oauth2.SetAuthURLParam("resource", provider.ADFSResource(oauthClient.RedirectURL)))
+	}
+	if name, ok := session.Values["loginOption"].(string); ok {
+		if option := loginOptionByName(r.Context(), name); option != nil {
+			for k, v := range option.Params {
+				opts = append(opts, oauth2.SetAuthURLParam(k, v))
+			}
+		}
+	}
+	return oauthClient.AuthCodeURL(state, opts...)
+}
+
+// oauthClientForHost a copy of the OAuthClient of the provider of ctx with the callback_url and scopes configured for host
+// `oauth.host_overrides` take precedence over `oauth.callback_urls`
+func oauthClientForHost(ctx context.Context, host string) *oauth2.Config {
+	provider := cfg.OAuth(ctx)
+	c := *provider.Client()
+	hostname := strings.Split(host, ":")[0]
+	for _, o := range provider.HostOverrides {
+		if hostInDomain(hostname, o.Host) {
+			log.Debugf("/login oauth.host_overrides matched %s", o.Host)
+			if o.RedirectURL != "" {
+				c.RedirectURL = o.RedirectURL
+			}
+			if len(o.Scopes) > 0 {
+				c.Scopes = o.Scopes
+			}
+			return &c
+		}
+	}
+
+	if v := callbackURLForHost(ctx, hostname); v != "" {
+		log.Debugf("/login callback_url set to %s", v)
+		c.RedirectURL = v
+		return &c
 	}
 
-	// cfg.OAuthClient.RedirectURL is set in cfg
 	// this checks the multiple redirect case for multiple matching domains
-	if len(cfg.GenOAuth.RedirectURLs) > 0 {
-		found := false
-		domain := domains.Matches(r.Host)
+	if len(provider.RedirectURLs) > 0 {
+		domain := domains.Matches(ctx, host)
 		log.Debugf("/login looking for callback_url matching %s", domain)
-		for _, v := range cfg.GenOAuth.RedirectURLs {
+		for _, v := range provider.RedirectURLs {
 			if strings.Contains(v, domain) {
-				found = true
 				log.Debugf("/login callback_url set to %s", v)
-				cfg.OAuthClient.RedirectURL = v
-				break
+				c.RedirectURL = v
+				return &c
 			}
 		}
-		if !found {
-			log.Infof("/login no callback_url matched %s (is the `Host` header being passed to Vouch Proxy?)", domain)
+		log.Infof("/login no callback_url matched %s (is the `Host` header being passed to Vouch Proxy?)", domain)
+	}
+	return &c
+}
+
+// loginHost the host whose callback_url is used, see forwarded.Host() (or the Host of the request to /login)
+// or else the host of the requested URL if only it has a callback_url of its own
+func loginHost(r *http.Request, session sessions.Session) string {
+	host := forwarded.Host(r)
+	if callbackURLForHost(r.Context(), strings.Split(host, ":")[0]) != "" {
+		return host
+	}
+	if requestedURL, ok := session.Values["requestedURL"].(string); ok {
+		if u, err := url.Parse(requestedURL); err == nil && callbackURLForHost(r.Context(), u.Hostname()) != "" {
+			return u.Host
 		}
 	}
-	// append code challenge and code challenge method query parameters if enabled
+	return host
+}
 
-	if cfg.GenOAuth.CodeChallengeMethod != "" {
-		opts = append(opts, oauth2.SetAuthURLParam("code_challenge_method", cfg.GenOAuth.CodeChallengeMethod))
-		opts = append(opts, oauth2.SetAuthURLParam("code_challenge", session.Values["codeChallenge"].(string)))
+// callbackURLForHost the entry of the `oauth.callback_urls` of the provider of ctx on the same host, "" if there isn't one
+func callbackURLForHost(ctx context.Context, hostname string) string {
+	for _, v := range cfg.OAuth(ctx).RedirectURLs {
+		if u, err := url.Parse(v); err == nil && strings.EqualFold(u.Hostname(), hostname) {
+			return v
+		}
 	}
-	if cfg.OAuthopts != nil {
-		opts = append(opts, cfg.OAuthopts)
+	return ""
+}
+
+// selectLoginOption choose from cfg.Cfg.LoginOptions, in order of precedence...
+// * the option named by `?provider=`
+// * the option whose Domains include the domain of `?domain_hint=` (which may be an email address)
+// * the option whose Hosts include the host of the requested URL
+// * the only option
+// returns nil if the user needs to choose
+func selectLoginOption(r *http.Request, requestedURL string) *cfg.LoginOption {
+	if name := r.URL.Query().Get("provider"); name != "" {
+		if option := loginOptionByName(r.Context(), name); option != nil {
+			return option
+		}
+		log.Infof("/login no login option named %s", name)
 	}
-	return cfg.OAuthClient.AuthCodeURL(state, opts...)
+
+	if hint := r.URL.Query().Get("domain_hint"); hint != "" {
+		hint = strings.ToLower(hint[strings.LastIndex(hint, "@")+1:])
+		for i, o := range cfg.FromContext(r.Context()).LoginOptions {
+			for _, d := range o.Domains {
+				if hostInDomain(hint, d) {
+					return &cfg.FromContext(r.Context()).LoginOptions[i]
+				}
+			}
+		}
+		log.Infof("/login no login option found for domain_hint %s", hint)
+	}
+
+	if u, err := url.Parse(requestedURL); err == nil {
+		for i, o := range cfg.FromContext(r.Context()).LoginOptions {
+			for _, h := range o.Hosts {
+				if hostInDomain(u.Hostname(), h) {
+					return &cfg.FromContext(r.Context()).LoginOptions[i]
+				}
+			}
+		}
+	}
+
+	if len(cfg.FromContext(r.Context()).LoginOptions) == 1 {
+		return &cfg.FromContext(r.Context()).LoginOptions[0]
+	}
+	return nil
 }
 
-var regExJustAlphaNum, _ = regexp.Compile("[^a-zA-Z0-9]+")
+func loginOptionByName(ctx context.Context, name string) *cfg.LoginOption {
+	for i, o := range cfg.FromContext(ctx).LoginOptions {
+		if o.Name == name {
+			return &cfg.FromContext(ctx).LoginOptions[i]
+		}
+	}
+	return nil
+}
 
-func generateStateNonce() (string, error) {
-	state, err := securerandom.URLBase64InBytes(base64Bytes)
-	if err != nil {
+// hostInDomain is host the domain or a subdomain of it
+func hostInDomain(host, domain string) bool {
+	host = strings.ToLower(host)
+	domain = strings.ToLower(domain)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// generateStateNonce `session.state_bytes` from crypto/rand, encoded as unpadded url safe base64
+func generateStateNonce(ctx context.Context) (string, error) {
+	b := make([]byte, cfg.FromContext(ctx).Session.StateBytes)
+	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
-	state = regExJustAlphaNum.ReplaceAllString(state, "")
-	return state, nil
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func appendCodeChallenge(session sessions.Session) {
+func appendCodeChallenge(session sessions.Session, method string) {
 	var codeChallenge string
 	var CodeVerifier, _ = cv.CreateCodeVerifier()
-	switch strings.ToUpper(cfg.GenOAuth.CodeChallengeMethod) {
+	switch strings.ToUpper(method) {
 	case "S256":
 		codeChallenge = CodeVerifier.CodeChallengeS256()
 		break
@@ -303,7 +526,7 @@ func appendCodeChallenge(session sessions.Session) {
 		log.Fatal("plain code challenge method is not supported")
 		return
 	default:
-		log.Fatal("Code challenge method %s is invalid", cfg.GenOAuth.CodeChallengeMethod)
+		log.Fatal("Code challenge method %s is invalid", method)
 		return
 	}
 	session.Values["codeChallenge"] = codeChallenge
@@ -11,9 +11,15 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package handlers
 
 import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -112,6 +118,14 @@ func Test_getValidRequestedURL(t *testing.T) {
 		{"multiple query param", "http://example.com/?strange=but-true&also-strange=but-false", "http://example.com/?strange=but-true&also-strange=but-false", false},
 		{"multiple query params, one of them bad", "http://example.com/?strange=but-true&also-strange=but-false&strange-but-bad=https://badandstrange.com", "", true},
 		{"multiple query params, one of them bad (escaped)", "http://example.com/?strange=but-true&also-strange=but-false&strange-but-bad=https%3a%2f%2fbadandstrange.com", "", true},
+		{"javascript scheme", "javascript:alert(document.domain)//example.com/", "", true},
+		{"javascript scheme mixed case", "JaVaScRiPt:alert(1)", "", true},
+		{"javascript scheme escaped", "javascript%3Aalert(1)", "", true},
+		{"data scheme", "data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==", "", true},
+		{"protocol relative", "//example.com/dest", "", true},
+		{"protocol relative escaped", "%2F%2Fexample.com%2Fdest", "", true},
+		{"no host", "http:example.com/dest", "", true},
+		{"too long", "http://example.com/" + strings.Repeat("a", 2048), "", true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -207,3 +221,228 @@ func TestLoginErrTooManyRedirects(t *testing.T) {
 		})
 	}
 }
+
+func Test_selectLoginOption(t *testing.T) {
+	setUp("/config/testing/handler_login_options.yml")
+	tests := []struct {
+		name         string
+		query        string
+		requestedURL string
+		want         string
+	}{
+		{"by provider", "provider=partners", "http://myapp.example.com/", "partners"},
+		{"unknown provider", "provider=nobody", "http://myapp.example.com/", ""},
+		{"by domain_hint email", "domain_hint=someone@partner.org", "http://myapp.example.com/", "partners"},
+		{"by domain_hint subdomain", "domain_hint=eu.partner.org", "http://myapp.example.com/", "partners"},
+		{"by domain_hint case insensitive", "domain_hint=Someone@Example.COM", "http://myapp.example.com/", "staff"},
+		{"unknown domain_hint", "domain_hint=someone@elsewhere.org", "http://myapp.example.com/", ""},
+		{"by host", "", "http://intranet.example.com/path", "staff"},
+		{"provider before host", "provider=partners", "http://intranet.example.com/path", "partners"},
+		{"must choose", "", "http://myapp.example.com/", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/login?"+tt.query, nil)
+			got := selectLoginOption(r, tt.requestedURL)
+			if tt.want == "" {
+				assert.Nil(t, got)
+				return
+			}
+			if assert.NotNil(t, got) {
+				assert.Equal(t, tt.want, got.Name)
+			}
+		})
+	}
+}
+
+func TestLoginHandlerLoginOptions(t *testing.T) {
+	setUp("/config/testing/handler_login_options.yml")
+	handler := http.HandlerFunc(LoginHandler)
+
+	// without a selection the user is asked to choose, lightest first
+	req, _ := http.NewRequest("GET", "/login?url=http://myapp.example.com/", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	body := rr.Body.String()
+	assert.Contains(t, body, "provider=staff")
+	assert.Contains(t, body, "provider=partners")
+	assert.Less(t, strings.Index(body, "provider=staff"), strings.Index(body, "provider=partners"))
+
+	// once selected the option's params are passed to the IdP
+	req, _ = http.NewRequest("GET", "/login?url=http://myapp.example.com/&domain_hint=someone@partner.org", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	redirectURL, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "partners", redirectURL.Query().Get("kc_idp_hint"))
+}
+
+func Test_oauthClientForHost(t *testing.T) {
+	setUp("/config/testing/handler_login_host_overrides.yml")
+	tests := []struct {
+		name            string
+		host            string
+		wantRedirectURL string
+		wantScopes      []string
+	}{
+		{"default", "vouch.example.com", "http://vouch.example.com/auth", []string{"openid", "email"}},
+		{"override", "vouch.example.org", "http://vouch.example.org/auth", []string{"openid", "email", "groups"}},
+		{"override with port", "vouch.example.org:9090", "http://vouch.example.org/auth", []string{"openid", "email", "groups"}},
+		{"override scopes only", "scopes.example.com", "http://vouch.example.com/auth", []string{"openid"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := oauthClientForHost(context.Background(), tt.host)
+			assert.Equal(t, tt.wantRedirectURL, got.RedirectURL)
+			assert.Equal(t, tt.wantScopes, got.Scopes)
+		})
+	}
+	// the shared client is left alone
+	assert.Equal(t, "http://vouch.example.com/auth", cfg.OAuthClient.RedirectURL)
+}
+
+func TestLoginHandlerHostOverrides(t *testing.T) {
+	setUp("/config/testing/handler_login_host_overrides.yml")
+	handler := http.HandlerFunc(LoginHandler)
+
+	req, _ := http.NewRequest("GET", "http://vouch.example.org/login?url=http://myapp.example.org/", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+
+	redirectURL, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "http://vouch.example.org/auth", redirectURL.Query().Get("redirect_uri"))
+	assert.Equal(t, "openid email groups", redirectURL.Query().Get("scope"))
+}
+
+func TestLoginHandlerCallbackURLs(t *testing.T) {
+	setUp("/config/testing/handler_callback_urls.yml")
+	handler := http.HandlerFunc(LoginHandler)
+
+	tests := []struct {
+		name          string
+		host          string
+		forwardedHost string
+		requestedURL  string
+		want          string
+	}{
+		{"by X-Forwarded-Host", "vouch:9090", "admin.example.com", "http://app.example.com/", "https://admin.example.com/vouch/auth"},
+		{"by Host", "admin.example.com:443", "", "http://app.example.com/", "https://admin.example.com/vouch/auth"},
+		{"case insensitive", "vouch:9090", "ADMIN.example.com", "http://app.example.com/", "https://admin.example.com/vouch/auth"},
+		{"by requested url", "vouch:9090", "", "http://admin.example.com/reports", "https://admin.example.com/vouch/auth"},
+		{"X-Forwarded-Host before requested url", "vouch:9090", "app.example.com", "http://admin.example.com/reports", "https://app.example.com/vouch/auth"},
+		{"first when none match", "vouch:9090", "", "http://other.example.com/", "https://app.example.com/vouch/auth"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/login?url="+tt.requestedURL, nil)
+			req.Host = tt.host
+			if tt.forwardedHost != "" {
+				req.Header.Set("X-Forwarded-Host", tt.forwardedHost)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusFound, rr.Code)
+
+			redirectURL, err := url.Parse(rr.Header().Get("Location"))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, redirectURL.Query().Get("redirect_uri"))
+		})
+	}
+}
+
+func TestLoginHandlerSAML(t *testing.T) {
+	metadata, err := ioutil.ReadFile(filepath.Join(os.Getenv("VOUCH_ROOT"), "config/testing/saml_idp_metadata.xml"))
+	assert.NoError(t, err)
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(metadata)
+	}))
+	defer idp.Close()
+	os.Setenv("VOUCH_SAML_IDP_METADATA_URL", idp.URL)
+	defer os.Unsetenv("VOUCH_SAML_IDP_METADATA_URL")
+	setUp("/config/testing/handler_saml.yml")
+	assert.Equal(t, cfg.Providers.SAML, cfg.GenOAuth.Provider)
+
+	req, _ := http.NewRequest("GET", "https://vouch.example.com/login?url=https://app.example.com/", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(LoginHandler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+
+	// the state of the session is the RelayState of the authentication request
+	redirectURL, err := url.Parse(rr.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "idp.example.com", redirectURL.Host)
+	assert.Equal(t, "/sso/redirect", redirectURL.Path)
+	assert.NotEmpty(t, redirectURL.Query().Get("SAMLRequest"))
+	state := redirectURL.Query().Get("RelayState")
+	assert.NotEmpty(t, state)
+	found := false
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == cfg.Cfg.Session.Name {
+			found = true
+			assert.Equal(t, "/auth/"+state, c.Path)
+		}
+	}
+	assert.True(t, found, "the session cookie is set")
+}
+
+func Test_generateStateNonce(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	defer func(n int) { cfg.Cfg.Session.StateBytes = n }(cfg.Cfg.Session.StateBytes)
+
+	for _, n := range []int{16, 32, 64} {
+		cfg.Cfg.Session.StateBytes = n
+		seen := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			state, err := generateStateNonce(context.Background())
+			assert.NoError(t, err)
+			assert.Len(t, state, base64.RawURLEncoding.EncodedLen(n))
+			assert.Equal(t, state, url.PathEscape(state), "state must be url safe")
+			assert.False(t, seen[state], "state %s was generated twice", state)
+			seen[state] = true
+		}
+	}
+}
+
+func TestLoginHandlerMultipleProviders(t *testing.T) {
+	setUp("/config/testing/handler_multiple_providers.yml")
+	defer cfg.InitForTestPurposes()
+	handler := http.HandlerFunc(LoginHandler)
+
+	// each provider is offered
+	req, _ := http.NewRequest("GET", "/login?url=http://myapp.example.com/", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "provider=staff")
+	assert.Contains(t, rr.Body.String(), "provider=github")
+
+	// and the one chosen is sent to
+	tests := []struct {
+		provider string
+		wantHost string
+	}{
+		{"staff", "staff.example.com"},
+		{"github", "github.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/login?url=http://myapp.example.com/&provider="+tt.provider, nil)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusFound, rr.Code)
+			redirectURL, err := url.Parse(rr.Header().Get("Location"))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantHost, redirectURL.Host)
+			assert.Equal(t, cfg.OAuthByName(context.Background(), tt.provider).ClientID, redirectURL.Query().Get("client_id"))
+
+			// the provider is remembered for /auth
+			session, err := std.sessstore.Get(req, cfg.Cfg.Session.Name)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.provider, session.Values["provider"])
+		})
+	}
+}
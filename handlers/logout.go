@@ -11,64 +11,79 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
 
+	"github.com/vouch/vouch-proxy/pkg/audit"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
 	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/domains"
 	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
 	"github.com/vouch/vouch-proxy/pkg/responses"
 )
 
 var errUnauthRedirURL = fmt.Errorf("/logout The requested url is not present in `%s.post_logout_redirect_uris`", cfg.Branding.LCName)
+var errRedirURLNotInDomains = fmt.Errorf("/logout The requested url is not within `%s.domains`", cfg.Branding.LCName)
 
 // LogoutHandler /logout
 // Destroys Vouch session
 // If oauth.end_session_endpoint present in conf, also redirects to destroy session at oauth provider
 // If "url" param present in request, also redirects to that (after destroying one or both sessions)
+// otherwise to `vouch.post_logout_redirect_uri` if it's set
+// with "user" param an admin revokes that user's sessions instead, see revokeUser
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debug("/logout")
+	if user := r.URL.Query().Get("user"); user != "" {
+		revokeUser(w, r, user)
+		return
+	}
 
 	jwt := jwtmanager.FindJWT(r)
-	claims, err := jwtmanager.ClaimsFromJWT(jwt)
+	claims, err := jwtmanager.ClaimsFromJWT(r.Context(), jwt)
 	if err != nil {
 		log.Error(err)
 	}
 
 	var token = ""
+	var username = ""
 	if claims != nil {
 		token = claims.PIdToken
+		username = claims.Username
 	}
 
 	cookie.ClearCookie(w, r)
+	audit.Log(r, audit.Logout, username, audit.Success, "")
 	log.Debug("/logout deleting session")
-	session, err := sessstore.Get(r, cfg.Cfg.Session.Name)
+	session, err := stateOf(r.Context()).sessstore.Get(r, cfg.FromContext(r.Context()).Session.Name)
 	session.Options.MaxAge = -1
 	if err != nil {
 		log.Error(err)
 	}
-	if err = session.Save(r, w); err != nil {
+	// the user is logged out by the cleared cookie, the login session expires by itself
+	if err = saveSession(r, w, session); err != nil {
 		log.Error(err)
 	}
 
-	providerLogoutURL := cfg.GenOAuth.LogoutURL
+	// the end_session_endpoint of the provider the user logged in with
+	providerLogoutURL := cfg.InstanceOf(r.Context()).GenOAuth.LogoutURL
+	if claims != nil {
+		providerLogoutURL = cfg.OAuthFor(r.Context(), claims.Provider).LogoutURL
+	}
 	redirectURL := r.URL.Query().Get("url")
 
 	// Make sure that redirectURL, if given, is allowed by config
 	if redirectURL != "" {
-		redirectValid := false
-		for _, allowed := range cfg.Cfg.LogoutRedirectURLs {
-			if allowed == redirectURL {
-				log.Debugf("/logout found ")
-				redirectValid = true
-				break
-			}
-		}
-		if !redirectValid {
-			responses.Error400(w, r, fmt.Errorf("%w: %s", errUnauthRedirURL, redirectURL))
+		if err := checkLogoutRedirect(r.Context(), redirectURL); err != nil {
+			responses.Error400(w, r, fmt.Errorf("%w: %s", err, redirectURL))
 			return
 		}
+	} else if claims != nil {
+		redirectURL = logoutRedirectFor(r.Context(), claims.CustomClaims)
+	} else {
+		redirectURL = cfg.FromContext(r.Context()).PostLogoutRedirectURI
 	}
 
 	// If provider logout URL is configured, redirect to it (and pass redirectURL along)
@@ -94,6 +109,36 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	if redirectURL != "" {
 		responses.Redirect302(w, r, redirectURL)
 	} else {
-		responses.RenderIndex(w, "/logout you have been logged out")
+		responses.RenderIndex(w, r, "/logout you have been logged out")
+	}
+}
+
+// logoutRedirectFor the url of the first of `post_logout_redirect_rules` matching the claims, or `post_logout_redirect_uri`
+func logoutRedirectFor(ctx context.Context, customClaims map[string]interface{}) string {
+	for _, rule := range cfg.FromContext(ctx).PostLogoutRedirectRules {
+		claim, _ := common.ClaimValue(customClaims, rule.Claim)
+		if claimMatches(claim, rule.Operator, rule.Values, true) {
+			return rule.URL
+		}
+	}
+	return cfg.FromContext(ctx).PostLogoutRedirectURI
+}
+
+// checkLogoutRedirect the url must be listed in `post_logout_redirect_uris`
+// or, when that isn't set, be an http(s) url of a host within `vouch.domains`
+func checkLogoutRedirect(ctx context.Context, redirectURL string) error {
+	if len(cfg.FromContext(ctx).LogoutRedirectURLs) != 0 {
+		for _, allowed := range cfg.FromContext(ctx).LogoutRedirectURLs {
+			if allowed == redirectURL {
+				log.Debugf("/logout found %s in %s.post_logout_redirect_uris", redirectURL, cfg.Branding.LCName)
+				return nil
+			}
+		}
+		return errUnauthRedirURL
+	}
+	u, err := url.Parse(redirectURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || domains.Matches(ctx, u.Hostname()) == "" {
+		return errRedirURLNotInDomains
 	}
+	return nil
 }
@@ -11,11 +11,18 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package handlers
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+	"github.com/vouch/vouch-proxy/pkg/structs"
 )
 
 func TestLogoutHandler(t *testing.T) {
@@ -94,3 +101,90 @@ func TestProviderLogoutHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestLogoutHandlerSingleLogout(t *testing.T) {
+	setUp("/config/testing/handler_logout_single_logout.yml")
+	handler := http.HandlerFunc(LogoutHandler)
+
+	user := structs.User{Username: "test@example.com", Email: "test@example.com"}
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, structs.CustomClaims{}, structs.PTokens{PIdToken: "the.id.token"})
+	assert.NoError(t, err)
+
+	logout := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/logout"+query, nil)
+		req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		wantcode int
+		want     string
+	}{
+		{"the default", "", http.StatusFound, cfg.Cfg.PostLogoutRedirectURI},
+		{"within domains", "?url=https://other.example.com/bye", http.StatusFound, "https://other.example.com/bye"},
+		{"outside domains", "?url=https://evil.com/", http.StatusBadRequest, ""},
+		{"lookalike domain", "?url=https://notexample.com/", http.StatusBadRequest, ""},
+		{"scheme relative", "?url=//evil.com/", http.StatusBadRequest, ""},
+		{"not http", "?url=javascript://example.com/%250aalert(1)", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := logout(tt.query)
+			assert.Equal(t, tt.wantcode, rr.Code)
+			if tt.wantcode != http.StatusFound {
+				return
+			}
+			location, err := url.Parse(rr.Header().Get("Location"))
+			assert.NoError(t, err)
+			assert.Equal(t, cfg.GenOAuth.LogoutURL, location.Scheme+"://"+location.Host+location.Path)
+			assert.Equal(t, "the.id.token", location.Query().Get("id_token_hint"))
+			assert.Equal(t, tt.want, location.Query().Get("post_logout_redirect_uri"))
+		})
+	}
+
+	t.Run("without RP-initiated logout", func(t *testing.T) {
+		cfg.GenOAuth.LogoutURL = ""
+		rr := logout("")
+		assert.Equal(t, http.StatusFound, rr.Code)
+		assert.Equal(t, cfg.Cfg.PostLogoutRedirectURI, rr.Header().Get("Location"))
+	})
+}
+
+func TestLogoutHandlerRedirectRules(t *testing.T) {
+	setUp("/config/testing/handler_logout_redirect_rules.yml")
+	handler := http.HandlerFunc(LogoutHandler)
+
+	tests := []struct {
+		name     string
+		userinfo string
+		query    string
+		want     string
+	}{
+		{"partner", `{"sub":"abc","user_type":"partner","groups":["employees"]}`, "", "https://partners.example.com/"},
+		{"employee", `{"sub":"abc","user_type":"staff","groups":["sales","employees"]}`, "", "https://intranet.example.com/goodbye"},
+		{"no match falls back", `{"sub":"abc","user_type":"staff"}`, "", "http://myapp.example.com/loggedout"},
+		{"url given", `{"sub":"abc","user_type":"partner"}`, "?url=https://other.example.com/bye", "https://other.example.com/bye"},
+		{"not logged in", "", "", "http://myapp.example.com/loggedout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/logout"+tt.query, nil)
+			if tt.userinfo != "" {
+				// as unmarshaled from the IdP's userinfo by MapClaims
+				customClaims := structs.CustomClaims{}
+				assert.NoError(t, common.MapClaims(context.Background(), []byte(tt.userinfo), &customClaims))
+				vpjwt, err := jwtmanager.NewVPJWT(context.Background(), structs.User{Username: "test@example.com"}, customClaims, structs.PTokens{})
+				assert.NoError(t, err)
+				req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusFound, rr.Code)
+			assert.Equal(t, tt.want, rr.Header().Get("Location"))
+		})
+	}
+}
@@ -0,0 +1,77 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
+	"github.com/vouch/vouch-proxy/pkg/geoip"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+)
+
+var errNetworkDenied = errors.New("access from your network or location is not permitted")
+
+// the GeoIP lookups are swapped out by tests
+var (
+	lookupCountry = geoip.Country
+	lookupASN     = geoip.ASN
+)
+
+// NetworkRulesHandler refuses clients denied by `vouch.network_rules` before /validate
+// it wraps the jwtcache so that a response cached for a client which was allowed is never returned to one which isn't
+func NetworkRulesHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rule := deniedNetwork(r); rule != nil {
+			sendNetworkDenied(w, r, rule)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deniedNetwork the `vouch.network_rules` rule covering the requested host which denies the client, nil if none do
+func deniedNetwork(r *http.Request) *cfg.NetworkRule {
+	if len(cfg.FromContext(r.Context()).NetworkRules) == 0 {
+		return nil
+	}
+	return cfg.FromContext(r.Context()).NetworkRulesDeny(forwarded.Host(r), func() cfg.ClientNetwork {
+		return clientNetwork(r)
+	})
+}
+
+// clientNetwork the country and ASN of the client's address, as trusted per `vouch.forwarded`
+func clientNetwork(r *http.Request) cfg.ClientNetwork {
+	c := cfg.ClientNetwork{IP: net.ParseIP(forwarded.ClientIP(r))}
+	if c.IP == nil {
+		return c
+	}
+	c.Country, c.HasCountry = lookupCountry(r.Context(), c.IP)
+	c.ASN, c.HasASN = lookupASN(r.Context(), c.IP)
+	return c
+}
+
+// sendNetworkDenied 403 from /validate
+// the cookie is left in place since the user may be allowed elsewhere
+func sendNetworkDenied(w http.ResponseWriter, r *http.Request, rule *cfg.NetworkRule) {
+	metrics.ValidateRequest(metrics.ValidateDenied)
+	msg := errNetworkDenied.Error()
+	if rule.Message != "" {
+		msg = rule.Message
+	}
+	c := clientNetwork(r)
+	log.Infof("%s: client %s (country %q, ASN %d) requesting %s", errNetworkDenied, c.IP, c.Country, c.ASN, forwarded.Host(r))
+	w.Header().Set(cfg.FromContext(r.Context()).Headers.Error, msg)
+	http.Error(w, msg, http.StatusForbidden)
+}
@@ -0,0 +1,81 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/geoip"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestNetworkRulesHandler(t *testing.T) {
+	setUp("/config/testing/handler_network_rules.yml")
+	countries := map[string]string{"192.0.2.1": "DE", "198.51.100.1": "RU"}
+	lookupCountry = func(_ context.Context, ip net.IP) (string, bool) { return countries[ip.String()], true }
+	defer func() { lookupCountry = geoip.Country }()
+
+	handler := NetworkRulesHandler(jwtmanager.JWTCacheHandler(http.HandlerFunc(ValidateRequestHandler)))
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), structs.User{Username: "testuser", Email: "test@example.com"}, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		host     string
+		clientIP string
+		wantCode int
+		wantErr  string
+	}{
+		{"allowed country", "app.example.com", "192.0.2.1", http.StatusOK, ""},
+		// the same jwt was allowed and its response cached, which mustn't be returned
+		{"denied country", "app.example.com", "198.51.100.1", http.StatusForbidden, "access from your country is not permitted"},
+		{"host without rules", "vouch.github.io", "198.51.100.1", http.StatusOK, ""},
+		{"allowed cidr", "admin.example.com", "10.1.2.3", http.StatusOK, ""},
+		{"outside allowed cidrs", "admin.example.com", "192.0.2.1", http.StatusForbidden, errNetworkDenied.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/validate", nil)
+			req.Host = tt.host
+			req.Header.Set("X-Forwarded-For", tt.clientIP)
+			req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantCode, rr.Code)
+			assert.Equal(t, tt.wantErr, rr.Header().Get(cfg.Cfg.Headers.Error))
+		})
+	}
+}
+
+func TestNetworkRulesHandlerWithoutGeoIP(t *testing.T) {
+	// geoip.country_db isn't configured, which ValidateConfiguration() refuses, so the rules by country deny every request
+	setUp("/config/testing/handler_network_rules.yml")
+	handler := NetworkRulesHandler(http.HandlerFunc(ValidateRequestHandler))
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), structs.User{Username: "testuser", Email: "test@example.com"}, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/validate", nil)
+	req.Host = "app.example.com"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
@@ -0,0 +1,90 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+	"github.com/vouch/vouch-proxy/pkg/responses"
+)
+
+var errPolicyDenied = errors.New("not permitted by the policy for this host")
+
+// checkPolicy the entry of `vouch.external_auth` for the id of an `/_external-auth-{id}` request, if it sets who may pass,
+// or else the first of `vouch.policies` covering the requested host must allow the user, any user passes if none do
+// the user has already passed the global whiteList, teamWhitelist, domains or allowAllUsers at login
+func checkPolicy(r *http.Request, claims *jwtmanager.VouchClaims) error {
+	if id, ea := cfg.FromContext(r.Context()).ExternalAuthFor(r); ea != nil && ea.HasPolicy() {
+		if policyAllows(r.Context(), &ea.Policy, claims) {
+			return nil
+		}
+		return fmt.Errorf("%w: %s is not allowed at /_external-auth-%s by %s.external_auth.%s", errPolicyDenied, claims.Username, id, cfg.Branding.LCName, id)
+	}
+	host := forwarded.Host(r)
+	i, p := cfg.FromContext(r.Context()).PolicyFor(host)
+	if p == nil || policyAllows(r.Context(), p, claims) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not allowed at %s by %s.policies[%d]", errPolicyDenied, claims.Username, host, cfg.Branding.LCName, i)
+}
+
+// policyAllows is true if p allows all users, or the user is in its whiteList or a member of one of its teamWhitelist
+func policyAllows(ctx context.Context, p *cfg.Policy, claims *jwtmanager.VouchClaims) bool {
+	if p.AllowAllUsers || inWhiteList(claims.Username, p.WhiteList, p.WhiteListRegexps) {
+		return true
+	}
+	_, ok := inTeamWhiteList(ctx, claims.Teams, p.TeamWhiteList)
+	return ok
+}
+
+// sendPolicyDenied 403 from /validate
+// the cookie is left in place since the user may be allowed at other hosts
+func sendPolicyDenied(w http.ResponseWriter, r *http.Request, err error) {
+	metrics.ValidateRequest(metrics.ValidateDenied)
+	responses.Error403KeepCookie(w, r, errPolicyDenied.Error(), err)
+}
+
+// inWhiteList is true if username is listed in whiteList or matches one of its compiled `regex:` entries
+func inWhiteList(username string, whiteList []string, regexps []*regexp.Regexp) bool {
+	for _, wl := range whiteList {
+		if !strings.HasPrefix(wl, cfg.WhiteListRegexPrefix) && username == wl {
+			return true
+		}
+	}
+	for _, re := range regexps {
+		if re.MatchString(username) {
+			return true
+		}
+	}
+	return false
+}
+
+// inTeamWhiteList the entry of teamWhiteList which one of the teams is, and whether there is one
+// the teamWhitelist may list either the provider's name for a group or its canonical form
+func inTeamWhiteList(ctx context.Context, teams []string, teamWhiteList []string) (string, bool) {
+	for _, team := range teams {
+		for _, wl := range teamWhiteList {
+			if teamKey(ctx, team) == teamKey(ctx, cfg.NormalizeGroup(ctx, wl)) {
+				return wl, true
+			}
+		}
+	}
+	return "", false
+}
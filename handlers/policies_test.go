@@ -0,0 +1,128 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestValidateRequestHandlerPolicies(t *testing.T) {
+	setUp("/config/testing/handler_policies.yml")
+	handler := jwtmanager.JWTCacheHandler(http.HandlerFunc(ValidateRequestHandler))
+
+	newJWT := func(username string, teams ...string) string {
+		user := structs.User{Username: username, Email: username + "@example.com", TeamMemberships: teams}
+		vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, structs.CustomClaims{}, structs.PTokens{})
+		assert.NoError(t, err)
+		return vpjwt
+	}
+	admin := newJWT("bob", "admins")
+	alice := newJWT("alice", "staff")
+	auditor := newJWT("auditor-carol")
+
+	tests := []struct {
+		name          string
+		jwt           string
+		host          string
+		forwardedHost string
+		wantCode      int
+	}{
+		{"team member", admin, "admin.example.com", "", http.StatusOK},
+		{"not a team member", alice, "admin.example.com", "", http.StatusForbidden},
+		{"subdomain", alice, "eu.admin.example.com", "", http.StatusForbidden},
+		{"with a port", alice, "admin.example.com:8443", "", http.StatusForbidden},
+		{"team member with a port", admin, "admin.example.com:8443", "", http.StatusOK},
+		{"forwarded host", alice, "vouch.example.com", "admin.example.com", http.StatusForbidden},
+		{"forwarded host with a port", alice, "vouch.example.com", "ADMIN.example.com:443", http.StatusForbidden},
+		{"forwarded host allowed", alice, "admin.example.com", "wiki.example.com", http.StatusOK},
+		{"whitelist", alice, "reports.example.com", "", http.StatusOK},
+		{"whitelist regex", auditor, "reports.example.com:8080", "", http.StatusOK},
+		{"not in whitelist", admin, "reports.example.com", "", http.StatusForbidden},
+		{"allowAllUsers", auditor, "wiki.example.com", "", http.StatusOK},
+		{"no policy, global config", auditor, "app.example.com", "", http.StatusOK},
+		// the responses cached for alice at other hosts aren't served here
+		{"not a team member, allowed elsewhere", alice, "admin.example.com", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// again from the jwtcache, which caches the response per policy
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest("GET", "/validate", nil)
+				req.Host = tt.host
+				if tt.forwardedHost != "" {
+					req.Header.Set("X-Forwarded-Host", tt.forwardedHost)
+				}
+				req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: tt.jwt})
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				assert.Equal(t, tt.wantCode, rr.Code)
+				if tt.wantCode == http.StatusForbidden {
+					assert.Equal(t, errPolicyDenied.Error(), rr.Header().Get(cfg.Cfg.Headers.Error))
+					assert.Empty(t, rr.Result().Cookies(), "the cookie is kept for other hosts")
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRequestHandlerPoliciesBearer(t *testing.T) {
+	setUp("/config/testing/handler_policies.yml")
+	handler := jwtmanager.JWTCacheHandler(http.HandlerFunc(ValidateRequestHandler))
+
+	tests := []struct {
+		name     string
+		user     structs.User
+		wantCode int
+	}{
+		{"team member", structs.User{Username: "bob", Email: "bob@example.com", TeamMemberships: []string{"admins"}}, http.StatusOK},
+		{"not a team member", structs.User{Username: "alice", Email: "alice@example.com", TeamMemberships: []string{"staff"}}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vpjwt, err := jwtmanager.NewVPJWT(context.Background(), tt.user, structs.CustomClaims{}, structs.PTokens{})
+			assert.NoError(t, err)
+			req := httptest.NewRequest("GET", "/validate", nil)
+			req.Host = "admin.example.com"
+			req.Header.Set("Authorization", "Bearer "+vpjwt)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.wantCode, rr.Code)
+		})
+	}
+}
+
+func TestNewVPJWTTeamsForPolicies(t *testing.T) {
+	user := structs.User{Username: "bob", TeamMemberships: []string{"admins"}}
+
+	setUp("/config/testing/handler_policies.yml")
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), vpjwt)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admins"}, claims.Teams)
+
+	// only kept when a policy needs them
+	setUp("/config/testing/handler_oidc.yml")
+	vpjwt, err = jwtmanager.NewVPJWT(context.Background(), user, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+	claims, err = jwtmanager.ClaimsFromJWT(context.Background(), vpjwt)
+	assert.NoError(t, err)
+	assert.Empty(t, claims.Teams)
+}
@@ -0,0 +1,65 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+type provisionRequest struct {
+	Username string                 `json:"username"`
+	Name     string                 `json:"name"`
+	Email    string                 `json:"email"`
+	Claims   map[string]interface{} `json:"claims,omitempty"`
+}
+
+// provisionUser POST the user to the `provisioning.url` webhook and wait for it to answer
+// any response other than 2xx within `provisioning.timeout` is an error
+func provisionUser(ctx context.Context, user structs.User, customClaims structs.CustomClaims) error {
+	if cfg.FromContext(ctx).Provisioning.URL == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(provisionRequest{
+		Username: user.Username,
+		Name:     user.Name,
+		Email:    user.Email,
+		Claims:   customClaims.Claims,
+	})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: time.Duration(cfg.FromContext(ctx).Provisioning.Timeout) * time.Second}
+	resp, err := client.Post(cfg.FromContext(ctx).Provisioning.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drain the body so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("provisioning webhook %s returned %s", cfg.FromContext(ctx).Provisioning.URL, resp.Status)
+	}
+	log.Debugf("user %s provisioned by %s", user.Username, cfg.FromContext(ctx).Provisioning.URL)
+	return nil
+}
@@ -0,0 +1,66 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func Test_provisionUser(t *testing.T) {
+	setUp("/config/testing/handler_email.yml")
+	user := structs.User{Username: "testuser", Email: "test@example.com", Name: "Test Name"}
+
+	tests := []struct {
+		name    string
+		status  int
+		delay   time.Duration
+		wantErr bool
+	}{
+		{"created", http.StatusCreated, 0, false},
+		{"ok", http.StatusOK, 0, false},
+		{"conflict", http.StatusConflict, 0, true},
+		{"server error", http.StatusInternalServerError, 0, true},
+		{"timeout", http.StatusOK, 1200 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got provisionRequest
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewDecoder(r.Body).Decode(&got)
+				time.Sleep(tt.delay)
+				w.WriteHeader(tt.status)
+			}))
+			defer ts.Close()
+			cfg.Cfg.Provisioning.URL = ts.URL
+			cfg.Cfg.Provisioning.Timeout = 1
+			defer func() { cfg.Cfg.Provisioning.URL = "" }()
+
+			err := provisionUser(context.Background(), user, structs.CustomClaims{})
+			assert.Equal(t, tt.wantErr, err != nil, "provisionUser() err = %v", err)
+			assert.Equal(t, user.Username, got.Username)
+		})
+	}
+}
+
+func Test_provisionUserNotConfigured(t *testing.T) {
+	setUp("/config/testing/handler_email.yml")
+	assert.NoError(t, provisionUser(context.Background(), structs.User{Username: "testuser"}, structs.CustomClaims{}))
+}
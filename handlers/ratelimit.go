@@ -0,0 +1,93 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
+	"github.com/vouch/vouch-proxy/pkg/responses"
+)
+
+var errRateLimited = errors.New("too many requests")
+
+// RateLimitHandler answers 429 to a client which has exceeded `vouch.rate_limit`, wrap /login and /auth with it
+func RateLimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.FromContext(r.Context()).RateLimit.RequestsPerMinute <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := forwarded.ClientIP(r)
+		if wait := stateOf(r.Context()).loginLimiter.take(r.Context(), client); wait > 0 {
+			responses.Error429(w, r, int(math.Ceil(wait.Seconds())), fmt.Errorf("%s %w from %s", r.URL.Path, errRateLimited, client))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimiter a token bucket for each client, bounded to the `rate_limit.max_clients` most recently seen
+type rateLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*list.Element
+	// recent the buckets, the most recently seen at the front
+	recent *list.List
+}
+
+type bucket struct {
+	client string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{clients: make(map[string]*list.Element), recent: list.New()}
+}
+
+// take a token from the client's bucket, returning how long until one is available if it's empty
+func (l *rateLimiter) take(ctx context.Context, client string) time.Duration {
+	perSecond := float64(cfg.FromContext(ctx).RateLimit.RequestsPerMinute) / 60
+	burst := float64(cfg.FromContext(ctx).RateLimit.Burst)
+	t := now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var b *bucket
+	if e, ok := l.clients[client]; ok {
+		l.recent.MoveToFront(e)
+		b = e.Value.(*bucket)
+		b.tokens = math.Min(burst, b.tokens+t.Sub(b.last).Seconds()*perSecond)
+	} else {
+		b = &bucket{client: client, tokens: burst}
+		l.clients[client] = l.recent.PushFront(b)
+		// a flood of spoofed addresses forgets the clients seen longest ago rather than growing without bound
+		for l.recent.Len() > cfg.FromContext(ctx).RateLimit.MaxClients {
+			oldest := l.recent.Back()
+			l.recent.Remove(oldest)
+			delete(l.clients, oldest.Value.(*bucket).client)
+		}
+	}
+	b.last = t
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
@@ -0,0 +1,95 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// useRateLimit a fresh limiter with the clock stopped at t
+func useRateLimit(t *testing.T, perMinute, burst, maxClients int) *time.Time {
+	clock := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	std.loginLimiter = newRateLimiter()
+	cfg.Cfg.RateLimit.RequestsPerMinute = perMinute
+	cfg.Cfg.RateLimit.Burst = burst
+	cfg.Cfg.RateLimit.MaxClients = maxClients
+	t.Cleanup(func() {
+		now = time.Now
+		cfg.Cfg.RateLimit.RequestsPerMinute = 0
+	})
+	return &clock
+}
+
+func rateLimitedLogin(client string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/login?url=http://myapp.example.com/hello", nil)
+	req.Header.Set("X-Forwarded-For", client)
+	rr := httptest.NewRecorder()
+	RateLimitHandler(http.HandlerFunc(LoginHandler)).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	clock := useRateLimit(t, 6, 2, 100)
+
+	assert.Equal(t, http.StatusFound, rateLimitedLogin("192.0.2.1").Code)
+	assert.Equal(t, http.StatusFound, rateLimitedLogin("192.0.2.1").Code)
+	rr := rateLimitedLogin("192.0.2.1")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	// one request every ten seconds
+	assert.Equal(t, "10", rr.Header().Get("Retry-After"))
+	assert.Contains(t, rr.Header().Get(cfg.Cfg.Headers.Error), errRateLimited.Error())
+
+	// each client has a bucket of its own
+	assert.Equal(t, http.StatusFound, rateLimitedLogin("192.0.2.2").Code)
+
+	*clock = clock.Add(5 * time.Second)
+	rr = rateLimitedLogin("192.0.2.1")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "5", rr.Header().Get("Retry-After"))
+
+	*clock = clock.Add(5 * time.Second)
+	assert.Equal(t, http.StatusFound, rateLimitedLogin("192.0.2.1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, rateLimitedLogin("192.0.2.1").Code)
+}
+
+func TestRateLimitHandlerDisabled(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	useRateLimit(t, 0, 1, 100)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusFound, rateLimitedLogin("192.0.2.1").Code)
+	}
+}
+
+func TestRateLimiterMaxClients(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	useRateLimit(t, 6, 1, 2)
+
+	assert.Zero(t, std.loginLimiter.take(context.Background(), "192.0.2.1"))
+	assert.Zero(t, std.loginLimiter.take(context.Background(), "192.0.2.2"))
+	assert.NotZero(t, std.loginLimiter.take(context.Background(), "192.0.2.1"))
+	// 192.0.2.2 was seen longest ago and is forgotten
+	assert.Zero(t, std.loginLimiter.take(context.Background(), "192.0.2.3"))
+	assert.Len(t, std.loginLimiter.clients, 2)
+	assert.Equal(t, 2, std.loginLimiter.recent.Len())
+	assert.NotContains(t, std.loginLimiter.clients, "192.0.2.2")
+	assert.NotZero(t, std.loginLimiter.take(context.Background(), "192.0.2.1"))
+	assert.Zero(t, std.loginLimiter.take(context.Background(), "192.0.2.2"))
+}
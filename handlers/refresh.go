@@ -0,0 +1,113 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+)
+
+var (
+	// sessionRefreshes the session refreshed in place of each JWT within `oauth.refresh_window` of expiry, nil if the
+	// refresh failed, so that the refresh token (which the provider may accept only once) is used once per JWT
+	sessionRefreshes = cache.New(cache.NoExpiration, 10*time.Minute)
+	// refreshLocks the requests in flight with the same JWT wait for the one refreshing it
+	refreshLocks sync.Map
+)
+
+// refreshedSession the reissued JWT and its claims
+type refreshedSession struct {
+	token  string
+	claims jwtmanager.VouchClaims
+}
+
+// refreshSession once the JWT is within `oauth.refresh_window` of expiry use the provider's refresh token to reissue it
+// expiring with the provider's new access token, if the refresh fails the user logs in again once the JWT expires
+func refreshSession(w http.ResponseWriter, r *http.Request, claims *jwtmanager.VouchClaims, jwt string) {
+	provider := cfg.OAuthFor(r.Context(), claims.Provider)
+	window := refreshWindow(provider.RefreshWindow, claims)
+	if !provider.UseRefreshTokens || claims.PRefreshToken == "" || time.Until(time.Unix(claims.ExpiresAt, 0)) > window {
+		return
+	}
+
+	l, _ := refreshLocks.LoadOrStore(jwt, &sync.Mutex{})
+	mu := l.(*sync.Mutex)
+	mu.Lock()
+	defer func() {
+		refreshLocks.Delete(jwt)
+		mu.Unlock()
+	}()
+
+	var rs *refreshedSession
+	if v, found := sessionRefreshes.Get(jwt); found {
+		rs = v.(*refreshedSession)
+	} else {
+		rs = reissueRefreshed(cfg.WithOAuth(r.Context(), provider), claims)
+		// the old JWT can't be used past its expiry, so neither can its entry
+		sessionRefreshes.Set(jwt, rs, window)
+	}
+	if rs == nil {
+		return
+	}
+	*claims = rs.claims
+	cookie.SetCookie(w, r, rs.token, claims.CustomClaims)
+	renewCSRFToken(w, r, claims.CustomClaims)
+}
+
+// refreshWindow `oauth.refresh_window`, or half the lifetime of a jwt which expires with an access token that lives
+// no longer than the window, else the jwt would be refreshed at every request from the moment it's issued
+func refreshWindow(minutes int, claims *jwtmanager.VouchClaims) time.Duration {
+	window := time.Duration(minutes) * time.Minute
+	if lifetime := time.Duration(claims.ExpiresAt-claims.IssuedAt) * time.Second; lifetime > 0 && window >= lifetime {
+		return lifetime / 2
+	}
+	return window
+}
+
+func reissueRefreshed(ctx context.Context, claims *jwtmanager.VouchClaims) *refreshedSession {
+	ptokens, err := common.RefreshTokens(ctx, claims.PRefreshToken)
+	if err != nil {
+		log.Warnf("could not refresh the session of %s, they'll log in again once it expires: %s", claims.Username, err)
+		return nil
+	}
+	if ptokens.PRefreshToken == "" {
+		ptokens.PRefreshToken = claims.PRefreshToken
+	}
+
+	refreshed := *claims
+	// the access and id tokens are kept only if they were at login, see NewVPJWT
+	if refreshed.PAccessToken != "" {
+		refreshed.PAccessToken = ptokens.PAccessToken
+	}
+	if refreshed.PIdToken != "" && ptokens.PIdToken != "" {
+		refreshed.PIdToken = ptokens.PIdToken
+	}
+	refreshed.PRefreshToken = ptokens.PRefreshToken
+	refreshed.IssuedAt = time.Now().Unix()
+	refreshed.ExpiresAt = jwtmanager.ExpiresAt(ctx, *ptokens)
+
+	tokenstring, err := jwtmanager.ReissueVPJWT(ctx, refreshed)
+	if err != nil {
+		log.Errorf("could not reissue the JWT for %s with refreshed tokens: %s", claims.Username, err)
+		return nil
+	}
+	log.Debugf("session of %s refreshed, now expires at %s", claims.Username, time.Unix(refreshed.ExpiresAt, 0))
+	return &refreshedSession{token: tokenstring, claims: refreshed}
+}
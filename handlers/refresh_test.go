@@ -0,0 +1,165 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// stubTokenEndpoint grants new tokens for the refresh token "good", rotating it, and refuses any other
+func stubTokenEndpoint(calls *int32) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "good" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"newaccesstoken","refresh_token":"rotated","token_type":"Bearer","expires_in":1800}`))
+	}))
+	cfg.OAuthClient.Endpoint.TokenURL = ts.URL
+	return ts
+}
+
+// refreshTokenJWT a JWT for testuser carrying refreshToken which expires in `ttl`, issued with an access token
+// which lived 30 minutes
+func refreshTokenJWT(t *testing.T, refreshToken string, ttl time.Duration) string {
+	user := structs.User{Username: "testuser", Email: "test@example.com"}
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, structs.CustomClaims{}, structs.PTokens{PAccessToken: "oldaccesstoken", PRefreshToken: refreshToken})
+	assert.NoError(t, err)
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), vpjwt)
+	assert.NoError(t, err)
+	claims.ExpiresAt = time.Now().Add(ttl).Unix()
+	claims.IssuedAt = time.Now().Add(ttl - 30*time.Minute).Unix()
+	vpjwt, err = jwtmanager.ReissueVPJWT(context.Background(), *claims)
+	assert.NoError(t, err)
+	return vpjwt
+}
+
+func TestValidateRequestHandlerRefreshTokens(t *testing.T) {
+	setUp("/config/testing/handler_refresh_tokens.yml")
+	var calls int32
+	ts := stubTokenEndpoint(&calls)
+	defer ts.Close()
+
+	tests := []struct {
+		name         string
+		refreshToken string
+		ttl          time.Duration
+		wantCode     int
+		wantCalls    int32
+		refreshed    bool
+	}{
+		{"outside the window", "good", 30 * time.Minute, http.StatusOK, 0, false},
+		{"within the window", "good", 2 * time.Minute, http.StatusOK, 1, true},
+		// the user logs in again once the JWT expires
+		{"refresh refused", "revoked", 2 * time.Minute, http.StatusOK, 1, false},
+		{"expired", "good", -time.Minute, http.StatusUnauthorized, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessionRefreshes.Flush()
+			atomic.StoreInt32(&calls, 0)
+
+			rr := validateWithJWT(t, refreshTokenJWT(t, tt.refreshToken, tt.ttl))
+			assert.Equal(t, tt.wantCode, rr.Code)
+			assert.Equal(t, tt.wantCalls, atomic.LoadInt32(&calls))
+			reissued := reissuedJWT(rr)
+			assert.Equal(t, tt.refreshed, reissued != "")
+			if !tt.refreshed {
+				return
+			}
+			assert.Equal(t, "newaccesstoken", rr.Header().Get(cfg.Cfg.Headers.AccessToken))
+			claims, err := jwtmanager.ClaimsFromJWT(context.Background(), reissued)
+			assert.NoError(t, err)
+			assert.Equal(t, "testuser", claims.Username)
+			assert.Equal(t, "rotated", claims.PRefreshToken)
+			// the JWT expires with the new access token, sooner than jwt.maxAge
+			assert.InDelta(t, time.Now().Add(30*time.Minute).Unix(), claims.ExpiresAt, 5)
+		})
+	}
+}
+
+func TestValidateRequestHandlerRefreshTokensOnce(t *testing.T) {
+	setUp("/config/testing/handler_refresh_tokens.yml")
+	sessionRefreshes.Flush()
+	var calls int32
+	ts := stubTokenEndpoint(&calls)
+	defer ts.Close()
+
+	// the requests in flight with the same JWT use the refresh token once and get the same cookie
+	old := refreshTokenJWT(t, "good", 2*time.Minute)
+	reissued := make([]string, 5)
+	var wg sync.WaitGroup
+	for i := range reissued {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reissued[i] = reissuedJWT(validateWithJWT(t, old))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	for _, r := range reissued {
+		assert.NotEmpty(t, r)
+		assert.Equal(t, reissued[0], r)
+	}
+}
+
+func TestValidateRequestHandlerRefreshTokensDisabled(t *testing.T) {
+	setUp("/config/testing/handler_refresh_tokens.yml")
+	sessionRefreshes.Flush()
+	var calls int32
+	ts := stubTokenEndpoint(&calls)
+	defer ts.Close()
+	cfg.GenOAuth.UseRefreshTokens = false
+
+	rr := validateWithJWT(t, refreshTokenJWT(t, "good", 2*time.Minute))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, reissuedJWT(rr))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestValidateRequestHandlerRefreshWindowClamped(t *testing.T) {
+	setUp("/config/testing/handler_refresh_tokens.yml")
+	sessionRefreshes.Flush()
+	var calls int32
+	ts := stubTokenEndpoint(&calls)
+	defer ts.Close()
+
+	// the access token lives 4 minutes, within the 5 minute refresh_window from the moment it's issued
+	user := structs.User{Username: "testuser", Email: "test@example.com"}
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, structs.CustomClaims{}, structs.PTokens{PRefreshToken: "good", PExpiry: time.Now().Add(4 * time.Minute)})
+	assert.NoError(t, err)
+	rr := validateWithJWT(t, vpjwt)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, reissuedJWT(rr))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), vpjwt)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, refreshWindow(cfg.GenOAuth.RefreshWindow, claims))
+	claims.ExpiresAt = claims.IssuedAt + 30*60
+	assert.Equal(t, 5*time.Minute, refreshWindow(cfg.GenOAuth.RefreshWindow, claims))
+}
@@ -0,0 +1,99 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/responses"
+)
+
+const reasonRevocationStore = "revocation_store_unavailable"
+
+var (
+	errNotAdmin     = errors.New("revoking a user's sessions requires membership of one of revocation_store.admin_teams")
+	errRevokeOrigin = errors.New("revoking a user's sessions with the jwt cookie requires the csrf token or a request from the same origin")
+)
+
+// revokeUser /logout?user=<email>
+// an admin, a member of one of `revocation_store.admin_teams`, POSTs to revoke every session of the user issued until now
+// /validate refuses them at every instance sharing the `revocation_store`
+func revokeUser(w http.ResponseWriter, r *http.Request, username string) {
+	w.Header().Set("Cache-Control", "no-store")
+	if !jwtmanager.UserRevocationSupported(r.Context()) {
+		log.Warnf("/logout?user=%s %s", username, jwtmanager.ErrRevocationUnsupported)
+		http.Error(w, jwtmanager.ErrRevocationUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+	// a GET could be forged by a link followed by the admin
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "revoking a user's sessions requires a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	// nor can a POST from another site be trusted, the browser sends the cookie whatever `cookie.sameSite`
+	if !revokeNotForged(r) {
+		audit.Log(r, audit.Logout, "", audit.Failure, "cross-site request to revoke the sessions of "+username)
+		responses.Error403KeepCookie(w, r, errRevokeOrigin.Error(), fmt.Errorf("/logout?user=%s %w", username, errRevokeOrigin))
+		return
+	}
+
+	claims, err := jwtmanager.ClaimsFromJWT(r.Context(), jwtmanager.FindJWT(r))
+	if err != nil || claims.Username == "" || jwtmanager.IsRevoked(r.Context(), claims) || jwtmanager.IsUserRevoked(r.Context(), claims) {
+		responses.Error401HTTP(w, r, fmt.Errorf("/logout?user=%s requires the jwt of an admin: %v", username, err))
+		return
+	}
+	if _, ok := inTeamWhiteList(r.Context(), claims.Teams, cfg.FromContext(r.Context()).RevocationStore.AdminTeams); !ok {
+		audit.Log(r, audit.Logout, claims.Username, audit.Failure, "not allowed to revoke the sessions of "+username)
+		responses.Error403KeepCookie(w, r, errNotAdmin.Error(), fmt.Errorf("/logout?user=%s %s: %w", username, claims.Username, errNotAdmin))
+		return
+	}
+
+	at, err := jwtmanager.RevokeUser(r.Context(), username)
+	if err != nil {
+		audit.Log(r, audit.Logout, claims.Username, audit.Failure, "revoking the sessions of "+username)
+		responses.Error503(w, r, reasonRevocationStore, 0, fmt.Errorf("/logout?user=%s %w", username, err))
+		return
+	}
+	audit.Log(r, audit.Logout, claims.Username, audit.Success, "revoked the sessions of "+username)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		User      string `json:"user"`
+		RevokedAt int64  `json:"revoked_at"`
+	}{username, at.Unix()}); err != nil {
+		log.Error(err)
+	}
+}
+
+// revokeNotForged the admin's jwt was sent in a header, which can't be forged cross-site,
+// or with the cookie the request carries the `csrf.header` or an `Origin` of Vouch Proxy itself
+func revokeNotForged(r *http.Request) bool {
+	if _, err := cookie.Cookie(r); err != nil {
+		return true
+	}
+	if cfg.FromContext(r.Context()).CSRF.Enabled {
+		if token := cookie.CSRFCookie(r); token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(r.Header.Get(cfg.FromContext(r.Context()).CSRF.Header))) == 1 {
+			return true
+		}
+	}
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && origin.Host != "" && strings.EqualFold(origin.Host, r.Host)
+}
@@ -0,0 +1,107 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestRevokeUser(t *testing.T) {
+	setUp("/config/testing/handler_revocation.yml")
+	kv := newFakeKV()
+	jwtmanager.SetRevocationStore(kv)
+
+	vouchJWT := func(username string, teams ...string) string {
+		vpjwt, err := jwtmanager.NewVPJWT(context.Background(), structs.User{Username: username, Email: username, TeamMemberships: teams}, structs.CustomClaims{}, structs.PTokens{})
+		assert.NoError(t, err)
+		return vpjwt
+	}
+	admin := vouchJWT("admin@example.com", "vouch-admins")
+	other := vouchJWT("other@example.com", "engineering")
+	fired := vouchJWT("fired@example.com")
+	colleague := vouchJWT("colleague@example.com")
+
+	validate := func(vpjwt string) int {
+		req := httptest.NewRequest("GET", "http://myapp.example.com/validate", nil)
+		req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt, Expires: time.Now().Add(time.Hour)})
+		rr := httptest.NewRecorder()
+		jwtmanager.JWTCacheHandler(http.HandlerFunc(ValidateRequestHandler)).ServeHTTP(rr, req)
+		return rr.Code
+	}
+	revokeFrom := func(origin, method, vpjwt string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://vouch.example.com/logout?user=fired@example.com", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if vpjwt != "" {
+			req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(LogoutHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	revoke := func(method, vpjwt string) *httptest.ResponseRecorder {
+		return revokeFrom("https://vouch.example.com", method, vpjwt)
+	}
+
+	// the response for the fired user's jwt is cached
+	assert.Equal(t, http.StatusOK, validate(fired))
+	assert.Equal(t, http.StatusOK, validate(colleague))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, revoke("GET", admin).Code)
+	assert.Equal(t, http.StatusUnauthorized, revoke("POST", "").Code)
+	assert.Equal(t, http.StatusForbidden, revoke("POST", other).Code)
+	// a form on another site, or no Origin at all
+	assert.Equal(t, http.StatusForbidden, revokeFrom("https://evil.example.net", "POST", admin).Code)
+	assert.Equal(t, http.StatusForbidden, revokeFrom("", "POST", admin).Code)
+	assert.Empty(t, kv.data)
+
+	kv.failing["SET"] = errors.New("connection refused")
+	assert.Equal(t, http.StatusServiceUnavailable, revoke("POST", admin).Code)
+	delete(kv.failing, "SET")
+
+	rr := revoke("POST", admin)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"user":"fired@example.com"`)
+	assert.Contains(t, kv.data, "vouch:revoked:fired@example.com")
+	assert.Equal(t, time.Duration(cfg.Cfg.JWT.MaxAge)*time.Minute, kv.ttls["vouch:revoked:fired@example.com"])
+
+	// a jwt in a header needs no Origin, a script on another site can't send it
+	req := httptest.NewRequest("POST", "http://vouch.example.com/logout?user=fired@example.com", nil)
+	req.Header.Set(cfg.Cfg.Headers.JWT, admin)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(LogoutHandler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, validate(fired))
+	assert.Equal(t, http.StatusOK, validate(colleague))
+	assert.Equal(t, http.StatusOK, validate(admin))
+}
+
+func TestRevokeUserNotSupported(t *testing.T) {
+	setUp("/config/testing/handler_logout_url.yml")
+	req := httptest.NewRequest("POST", "http://vouch.example.com/logout?user=fired@example.com", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(LogoutHandler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotImplemented, rr.Code)
+	assert.Contains(t, rr.Body.String(), "not supported")
+}
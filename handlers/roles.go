@@ -0,0 +1,41 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+)
+
+// generateRoleHeader pass the role derived from the user's claims by `roles.rules` to the `headers.role` header
+func generateRoleHeader(w http.ResponseWriter, r *http.Request, claims *jwtmanager.VouchClaims) {
+	if len(cfg.FromContext(r.Context()).Roles.Rules) == 0 && cfg.FromContext(r.Context()).Roles.Default == "" {
+		return
+	}
+	if role := roleFor(r.Context(), claims.CustomClaims); role != "" {
+		w.Header().Add(cfg.FromContext(r.Context()).Headers.Role, role)
+	}
+}
+
+// roleFor the Role of the first rule matching the claims, or `roles.default`
+func roleFor(ctx context.Context, customClaims map[string]interface{}) string {
+	for _, rule := range cfg.FromContext(ctx).Roles.Rules {
+		claim, _ := common.ClaimValue(customClaims, rule.Claim)
+		if claimMatches(claim, rule.Operator, rule.Values, cfg.FromContext(ctx).Roles.Coercion != cfg.CoercionStrict) {
+			return rule.Role
+		}
+	}
+	return cfg.FromContext(ctx).Roles.Default
+}
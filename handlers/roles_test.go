@@ -0,0 +1,98 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func Test_roleFor(t *testing.T) {
+	setUp("/config/testing/handler_roles.yml")
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   string
+	}{
+		{"admin", map[string]interface{}{"groups": []interface{}{"staff", "platform-admins"}}, "admin"},
+		{"first match wins", map[string]interface{}{"groups": []interface{}{"sre", "platform-admins"}, "department": "compliance"}, "admin"},
+		{"second rule", map[string]interface{}{"groups": []interface{}{"sre"}, "department": "compliance"}, "operator"},
+		{"single valued claim", map[string]interface{}{"groups": []interface{}{"staff"}, "department": "compliance"}, "auditor"},
+		{"default", map[string]interface{}{"groups": []interface{}{"staff"}}, "user"},
+		{"clearance number", map[string]interface{}{"clearance": float64(3)}, "cleared"},
+		{"clearance string", map[string]interface{}{"clearance": "4"}, "cleared"},
+		{"clearance too low", map[string]interface{}{"clearance": float64(2)}, "user"},
+		{"no claims", nil, "user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, roleFor(context.Background(), tt.claims))
+		})
+	}
+}
+
+func Test_roleForStrictCoercion(t *testing.T) {
+	setUp("/config/testing/handler_roles.yml")
+	cfg.Cfg.Roles.Coercion = cfg.CoercionStrict
+	defer func() { cfg.Cfg.Roles.Coercion = cfg.CoercionLoose }()
+
+	assert.Equal(t, "cleared", roleFor(context.Background(), map[string]interface{}{"clearance": float64(3)}))
+	// a string is only compared as a string
+	assert.Equal(t, "user", roleFor(context.Background(), map[string]interface{}{"clearance": "4"}))
+}
+
+func TestValidateRequestHandlerRoleHeader(t *testing.T) {
+	setUp("/config/testing/handler_roles.yml")
+
+	tests := []struct {
+		name    string
+		groups  []interface{}
+		noRoles bool
+		want    string
+	}{
+		{"admin", []interface{}{"platform-admins"}, false, "admin"},
+		{"default", []interface{}{"staff"}, false, "user"},
+		{"roles not configured", []interface{}{"platform-admins"}, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUp("/config/testing/handler_roles.yml")
+			if tt.noRoles {
+				cfg.Cfg.Roles.Rules = nil
+				cfg.Cfg.Roles.Default = ""
+			}
+			customClaims := structs.CustomClaims{Claims: map[string]interface{}{"groups": tt.groups}}
+			user := &structs.User{Username: "testuser", Email: "test@example.com", Name: "Test Name"}
+			vpjwt, err := jwtmanager.NewVPJWT(context.Background(), *user, customClaims, structs.PTokens{})
+			assert.NoError(t, err)
+
+			req, err := http.NewRequest("GET", "/validate", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(ValidateRequestHandler).ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, tt.want, rr.Header().Get("X-Vouch-Role"))
+		})
+	}
+}
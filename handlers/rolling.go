@@ -0,0 +1,54 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+)
+
+// rollingReissues the JWT reissued in place of each JWT within `jwt.rolling.window` of expiry, which bounds
+// the reissues to one per session per window and gives the requests in flight with the old JWT the same new one
+var rollingReissues = cache.New(cache.NoExpiration, 10*time.Minute)
+
+// rollSession once the JWT is within `jwt.rolling.window` of expiry reissue the cookie expiring `jwt.maxAge` from now
+// so that a user who keeps using the site stays logged in while an idle one is logged out when the JWT expires
+func rollSession(w http.ResponseWriter, r *http.Request, claims *jwtmanager.VouchClaims, jwt string) {
+	window := time.Duration(cfg.FromContext(r.Context()).JWT.Rolling.Window) * time.Minute
+	if !cfg.FromContext(r.Context()).JWT.Rolling.Enabled || time.Until(time.Unix(claims.ExpiresAt, 0)) > window {
+		return
+	}
+
+	var tokenstring string
+	if v, found := rollingReissues.Get(jwt); found {
+		tokenstring = v.(string)
+	} else {
+		reissued := *claims
+		reissued.IssuedAt = time.Now().Unix()
+		reissued.ExpiresAt = time.Now().Add(time.Duration(cfg.FromContext(r.Context()).JWT.MaxAge) * time.Minute).Unix()
+		var err error
+		if tokenstring, err = jwtmanager.ReissueVPJWT(r.Context(), reissued); err != nil {
+			log.Errorf("could not reissue the JWT for %s with a rolling expiry: %s", claims.Username, err)
+			return
+		}
+		// the old JWT can't be used past its expiry, so neither can its entry
+		rollingReissues.Set(jwt, tokenstring, window)
+		log.Debugf("session of %s rolled over, now expires in %d minutes", claims.Username, cfg.FromContext(r.Context()).JWT.MaxAge)
+	}
+	cookie.SetCookie(w, r, tokenstring, claims.CustomClaims)
+	renewCSRFToken(w, r, claims.CustomClaims)
+}
@@ -0,0 +1,109 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// rollingJWT a JWT for testuser which expires in `ttl`
+func rollingJWT(t *testing.T, ttl time.Duration) string {
+	user := structs.User{Username: "testuser", Email: "test@example.com"}
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), vpjwt)
+	assert.NoError(t, err)
+	claims.ExpiresAt = time.Now().Add(ttl).Unix()
+	vpjwt, err = jwtmanager.ReissueVPJWT(context.Background(), *claims)
+	assert.NoError(t, err)
+	return vpjwt
+}
+
+// reissuedJWT the value of the jwt cookie set by the response, "" if there's none or it's deleted
+func reissuedJWT(rr http.ResponseWriter) string {
+	resp := http.Response{Header: rr.Header()}
+	for _, c := range resp.Cookies() {
+		if c.Name == cfg.Cfg.Cookie.Name && c.MaxAge >= 0 {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func TestValidateRequestHandlerRolling(t *testing.T) {
+	setUp("/config/testing/handler_rolling.yml")
+	rollingReissues.Flush()
+
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		wantCode int
+		reissued bool
+	}{
+		{"recently issued", 50 * time.Minute, http.StatusOK, false},
+		{"just outside the window", 16 * time.Minute, http.StatusOK, false},
+		{"active user within the window", 10 * time.Minute, http.StatusOK, true},
+		{"about to expire", 30 * time.Second, http.StatusOK, true},
+		{"idle user, expired", -time.Minute, http.StatusUnauthorized, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := validateWithJWT(t, rollingJWT(t, tt.ttl))
+			assert.Equal(t, tt.wantCode, rr.Code)
+			reissued := reissuedJWT(rr)
+			assert.Equal(t, tt.reissued, reissued != "")
+			if !tt.reissued {
+				return
+			}
+			claims, err := jwtmanager.ClaimsFromJWT(context.Background(), reissued)
+			assert.NoError(t, err)
+			assert.InDelta(t, time.Now().Add(60*time.Minute).Unix(), claims.ExpiresAt, 5)
+			assert.Equal(t, "testuser", claims.Username)
+
+			// the reissued JWT is outside the window until it nears expiry again
+			rr = validateWithJWT(t, reissued)
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Empty(t, reissuedJWT(rr))
+		})
+	}
+}
+
+func TestValidateRequestHandlerRollingOncePerWindow(t *testing.T) {
+	setUp("/config/testing/handler_rolling.yml")
+	rollingReissues.Flush()
+
+	old := rollingJWT(t, 10*time.Minute)
+	first := reissuedJWT(validateWithJWT(t, old))
+	assert.NotEmpty(t, first)
+
+	// another request in flight with the old JWT a second later gets the same cookie
+	time.Sleep(time.Second)
+	assert.Equal(t, first, reissuedJWT(validateWithJWT(t, old)))
+}
+
+func TestValidateRequestHandlerRollingDisabled(t *testing.T) {
+	setUp("/config/testing/handler_rolling.yml")
+	rollingReissues.Flush()
+	cfg.Cfg.JWT.Rolling.Enabled = false
+
+	rr := validateWithJWT(t, rollingJWT(t, 10*time.Minute))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, reissuedJWT(rr))
+}
@@ -0,0 +1,177 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package saml
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+)
+
+const (
+	nsMetadata       = "urn:oasis:names:tc:SAML:2.0:metadata"
+	bindingRedirect  = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	bindingPost      = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	maxMetadataSize  = 1 << 20
+	metadataMaxAge   = 24 * time.Hour
+	protocolSupport  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	metadataMimeType = "application/samlmetadata+xml"
+)
+
+// idp what's known of the IdP from its metadata
+type idp struct {
+	entityID string
+	// ssoURL where the authentication request is sent, with the HTTP-Redirect binding
+	ssoURL string
+	// certs the IdP signs its responses with one of these
+	certs []*x509.Certificate
+}
+
+type entityDescriptor struct {
+	XMLName           xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID          string   `xml:"entityID,attr"`
+	IDPSSODescriptors []struct {
+		KeyDescriptors []struct {
+			Use          string   `xml:"use,attr"`
+			Certificates []string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
+		SingleSignOnServices []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleSignOnService"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
+}
+
+// loadIdP the IdP's metadata from `vouch.saml.idp_metadata_url`, fetched again once it's a day old
+// while it can't be fetched again the metadata fetched before is used
+func (s *state) loadIdP(ctx context.Context) (*idp, error) {
+	s.idpMu.Lock()
+	defer s.idpMu.Unlock()
+	if s.idpCached != nil && now().Before(s.idpFetched.Add(metadataMaxAge)) {
+		return s.idpCached, nil
+	}
+	m, err := fetchIdP(ctx, cfg.FromContext(ctx).SAML.IdPMetadataURL)
+	if err != nil {
+		if s.idpCached != nil {
+			log.Warnf("saml: using the IdP metadata fetched at %s, %s", s.idpFetched, err)
+			return s.idpCached, nil
+		}
+		return nil, err
+	}
+	s.idpCached, s.idpFetched = m, now()
+	log.Debugf("saml: IdP %s with %d signing certificates, single sign-on at %s", m.entityID, len(m.certs), m.ssoURL)
+	return m, nil
+}
+
+func fetchIdP(ctx context.Context, metadataURL string) (*idp, error) {
+	resp, err := common.HTTPClient(ctx).Get(metadataURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching the IdP metadata: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching the IdP metadata from %s: %s", metadataURL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMetadataSize))
+	if err != nil {
+		return nil, fmt.Errorf("fetching the IdP metadata: %w", err)
+	}
+	return parseIdPMetadata(body)
+}
+
+// parseIdPMetadata the EntityDescriptor of the IdP
+func parseIdPMetadata(body []byte) (*idp, error) {
+	var ed entityDescriptor
+	if err := xml.Unmarshal(body, &ed); err != nil {
+		return nil, fmt.Errorf("IdP metadata: %w", err)
+	}
+	if len(ed.IDPSSODescriptors) != 1 {
+		return nil, errors.New("IdP metadata must have exactly one IDPSSODescriptor")
+	}
+	m := &idp{entityID: ed.EntityID}
+	d := ed.IDPSSODescriptors[0]
+	for _, k := range d.KeyDescriptors {
+		if k.Use != "" && k.Use != "signing" {
+			continue
+		}
+		for _, c := range k.Certificates {
+			der, err := decodeBase64(c)
+			if err != nil {
+				return nil, fmt.Errorf("IdP metadata: certificate %w", err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("IdP metadata: %w", err)
+			}
+			m.certs = append(m.certs, cert)
+		}
+	}
+	for _, s := range d.SingleSignOnServices {
+		if s.Binding == bindingRedirect {
+			m.ssoURL = s.Location
+			break
+		}
+	}
+	switch {
+	case m.entityID == "":
+		return nil, errors.New("IdP metadata has no entityID")
+	case len(m.certs) == 0:
+		return nil, errors.New("IdP metadata has no signing certificate")
+	case m.ssoURL == "":
+		return nil, errors.New("IdP metadata has no SingleSignOnService with the HTTP-Redirect binding")
+	}
+	return m, nil
+}
+
+// MetadataHandler /saml/metadata, the service provider metadata of Vouch Proxy for the IdP
+func MetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg.InstanceOf(r.Context()).GenOAuth.Provider != cfg.Providers.SAML {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", metadataMimeType)
+	_, _ = io.WriteString(w, spMetadata(r.Context()))
+}
+
+// spMetadata the EntityDescriptor of Vouch Proxy, whose signing certificate is published when `vouch.saml.cert` is set
+func spMetadata(ctx context.Context) string {
+	c, spCert := cfg.FromContext(ctx), stateOf(ctx).spCert
+	var b strings.Builder
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		`<md:EntityDescriptor xmlns:md="%s" entityID="%s">`+
+		`<md:SPSSODescriptor AuthnRequestsSigned="%t" WantAssertionsSigned="true" protocolSupportEnumeration="%s">`,
+		nsMetadata, escape(c.SAML.EntityID), spCert != nil, protocolSupport)
+	if spCert != nil {
+		fmt.Fprintf(&b, `<md:KeyDescriptor use="signing"><ds:KeyInfo xmlns:ds="%s"><ds:X509Data><ds:X509Certificate>%s</ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>`,
+			nsDSig, base64.StdEncoding.EncodeToString(spCert.Raw))
+	}
+	fmt.Fprintf(&b, `<md:AssertionConsumerService Binding="%s" Location="%s" index="0" isDefault="true"/>`+
+		`</md:SPSSODescriptor></md:EntityDescriptor>`+"\n",
+		bindingPost, escape(c.SAML.ACSURL))
+	return b.String()
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
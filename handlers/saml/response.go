@@ -0,0 +1,248 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package saml
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+const (
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+
+	statusSuccess      = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	confirmationBearer = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	nameIDEmail        = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+
+	// allowedClockSkew between the clocks of the IdP and Vouch Proxy
+	allowedClockSkew = 90 * time.Second
+)
+
+var (
+	errInvalidResponse = errors.New("SAML response is not valid")
+	errStatus          = errors.New("the IdP refused the authentication")
+)
+
+// assertion of the IdP about the user, kept in session.backend redis from /saml/acs until /auth/{state}/
+type assertion struct {
+	ID           string `json:"id"`
+	NameID       string `json:"name_id"`
+	NameIDFormat string `json:"name_id_format"`
+	// Attributes by name, in the order of the assertion
+	Attributes     map[string][]string `json:"attributes"`
+	AttributeNames []string            `json:"attribute_names"`
+	// NotOnOrAfter the assertion may no longer be used
+	NotOnOrAfter time.Time `json:"not_on_or_after"`
+}
+
+// parseResponse the assertion of the SAMLResponse posted to the ACS, which must answer the authentication request for state
+// the assertion must be signed by the IdP, on its own or as part of the response
+// the user is taken only from the assertion whose signature (or whose response's signature) was verified
+func parseResponse(c *cfg.Config, samlResponse, state string, m *idp) (*assertion, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(samlResponse), ""))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidResponse, err)
+	}
+	resp, err := parseXML(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidResponse, err)
+	}
+	if !is(resp, nsProtocol, "Response") {
+		return nil, fmt.Errorf("%w: not a Response", errInvalidResponse)
+	}
+	if err := checkResponse(c, resp, state, m); err != nil {
+		return nil, err
+	}
+
+	// the assertion is taken from the response whose signature was verified
+	responseSigned := false
+	switch verified, err := verifySignature(resp, m.certs); {
+	case err == nil:
+		resp, responseSigned = verified, true
+	case !errors.Is(err, errNotSigned):
+		return nil, fmt.Errorf("%w: response %s", errInvalidResponse, err)
+	}
+	if len(all(resp, nsAssertion, "EncryptedAssertion")) > 0 {
+		return nil, fmt.Errorf("%w: encrypted assertions are not supported", errInvalidResponse)
+	}
+	a := child(resp, nsAssertion, "Assertion")
+	if a == nil {
+		return nil, fmt.Errorf("%w: the response must have exactly one Assertion", errInvalidResponse)
+	}
+	switch verified, err := verifySignature(a, m.certs); {
+	case err == nil:
+		a = verified
+	case errors.Is(err, errNotSigned) && responseSigned:
+	case errors.Is(err, errNotSigned):
+		return nil, fmt.Errorf("%w: neither the response nor the assertion is signed", errInvalidResponse)
+	default:
+		return nil, fmt.Errorf("%w: assertion %s", errInvalidResponse, err)
+	}
+	return checkAssertion(c, a, state, m)
+}
+
+// checkResponse the status, issuer, destination and request of the response
+func checkResponse(c *cfg.Config, resp *etree.Element, state string, m *idp) error {
+	status := child(resp, nsProtocol, "Status")
+	code := child(status, nsProtocol, "StatusCode")
+	if code == nil {
+		return fmt.Errorf("%w: no StatusCode", errInvalidResponse)
+	}
+	if attr(code, "Value") != statusSuccess {
+		codes := []string{attr(code, "Value")}
+		if sub := child(code, nsProtocol, "StatusCode"); sub != nil {
+			codes = append(codes, attr(sub, "Value"))
+		}
+		if msg := text(child(status, nsProtocol, "StatusMessage")); msg != "" {
+			codes = append(codes, msg)
+		}
+		return fmt.Errorf("%w: %s", errStatus, strings.Join(codes, " "))
+	}
+	if issuer := child(resp, nsAssertion, "Issuer"); issuer != nil && text(issuer) != m.entityID {
+		return fmt.Errorf("%w: issued by %s rather than %s", errInvalidResponse, text(issuer), m.entityID)
+	}
+	if d := attr(resp, "Destination"); d != "" && d != c.SAML.ACSURL {
+		return fmt.Errorf("%w: destination %s is not vouch.saml.acs_url", errInvalidResponse, d)
+	}
+	if irt := attr(resp, "InResponseTo"); irt != "" && irt != requestID(state) {
+		return fmt.Errorf("%w: in response to %s rather than the authentication request of the RelayState", errInvalidResponse, irt)
+	}
+	return nil
+}
+
+// checkAssertion the issuer, subject and conditions of the assertion, and its attributes
+// only a bearer assertion for Vouch Proxy's authentication request of state, within its validity, is accepted
+func checkAssertion(c *cfg.Config, a *etree.Element, state string, m *idp) (*assertion, error) {
+	if issuer := text(child(a, nsAssertion, "Issuer")); issuer != m.entityID {
+		return nil, fmt.Errorf("%w: assertion issued by %s rather than %s", errInvalidResponse, issuer, m.entityID)
+	}
+	t := now()
+	result := &assertion{ID: attr(a, "ID"), Attributes: make(map[string][]string)}
+	if result.ID == "" {
+		return nil, fmt.Errorf("%w: the assertion has no ID", errInvalidResponse)
+	}
+
+	subject := child(a, nsAssertion, "Subject")
+	nameID := child(subject, nsAssertion, "NameID")
+	result.NameID = text(nameID)
+	if result.NameID == "" {
+		return nil, fmt.Errorf("%w: the assertion has no NameID", errInvalidResponse)
+	}
+	result.NameIDFormat = attr(nameID, "Format")
+
+	confirmed := false
+	var unconfirmed error
+	for _, sc := range all(subject, nsAssertion, "SubjectConfirmation") {
+		if attr(sc, "Method") != confirmationBearer {
+			continue
+		}
+		if err := checkConfirmation(c, child(sc, nsAssertion, "SubjectConfirmationData"), state, t); err != nil {
+			unconfirmed = err
+			continue
+		}
+		confirmed = true
+		break
+	}
+	if !confirmed {
+		if unconfirmed == nil {
+			unconfirmed = errors.New("no bearer SubjectConfirmation")
+		}
+		return nil, fmt.Errorf("%w: %s", errInvalidResponse, unconfirmed)
+	}
+
+	conditions := child(a, nsAssertion, "Conditions")
+	if conditions == nil {
+		return nil, fmt.Errorf("%w: the assertion has no Conditions", errInvalidResponse)
+	}
+	notBefore, err := parseTime(attr(conditions, "NotBefore"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: NotBefore %s", errInvalidResponse, err)
+	}
+	if !notBefore.IsZero() && t.Add(allowedClockSkew).Before(notBefore) {
+		return nil, fmt.Errorf("%w: the assertion is not valid before %s", errInvalidResponse, notBefore)
+	}
+	result.NotOnOrAfter, err = parseTime(attr(conditions, "NotOnOrAfter"))
+	if err != nil || result.NotOnOrAfter.IsZero() {
+		return nil, fmt.Errorf("%w: the assertion has no NotOnOrAfter", errInvalidResponse)
+	}
+	if !t.Add(-allowedClockSkew).Before(result.NotOnOrAfter) {
+		return nil, fmt.Errorf("%w: the assertion expired at %s", errInvalidResponse, result.NotOnOrAfter)
+	}
+	// each of the audience restrictions must name Vouch Proxy
+	restrictions := all(conditions, nsAssertion, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return nil, fmt.Errorf("%w: the assertion has no AudienceRestriction", errInvalidResponse)
+	}
+	for _, ar := range restrictions {
+		found := false
+		for _, aud := range all(ar, nsAssertion, "Audience") {
+			if text(aud) == c.SAML.EntityID {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: the assertion is not for the audience %s", errInvalidResponse, c.SAML.EntityID)
+		}
+	}
+
+	for _, as := range all(a, nsAssertion, "AttributeStatement") {
+		for _, attribute := range all(as, nsAssertion, "Attribute") {
+			name := attr(attribute, "Name")
+			if name == "" {
+				continue
+			}
+			if _, ok := result.Attributes[name]; !ok {
+				result.AttributeNames = append(result.AttributeNames, name)
+			}
+			for _, v := range all(attribute, nsAssertion, "AttributeValue") {
+				result.Attributes[name] = append(result.Attributes[name], text(v))
+			}
+		}
+	}
+	return result, nil
+}
+
+// checkConfirmation the bearer may use the assertion at the ACS, for the authentication request of state, until NotOnOrAfter
+func checkConfirmation(c *cfg.Config, data *etree.Element, state string, t time.Time) error {
+	if data == nil {
+		return errors.New("the bearer SubjectConfirmation has no SubjectConfirmationData")
+	}
+	if r := attr(data, "Recipient"); r != c.SAML.ACSURL {
+		return fmt.Errorf("the recipient %s is not vouch.saml.acs_url", r)
+	}
+	if irt := attr(data, "InResponseTo"); irt != requestID(state) {
+		return fmt.Errorf("the assertion is in response to %q rather than the authentication request of the RelayState", irt)
+	}
+	notOnOrAfter, err := parseTime(attr(data, "NotOnOrAfter"))
+	if err != nil || notOnOrAfter.IsZero() {
+		return errors.New("the bearer SubjectConfirmationData has no NotOnOrAfter")
+	}
+	if !t.Add(-allowedClockSkew).Before(notOnOrAfter) {
+		return fmt.Errorf("the bearer confirmation expired at %s", notOnOrAfter)
+	}
+	return nil
+}
+
+// parseTime an xs:dateTime, the zero time if s is empty
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
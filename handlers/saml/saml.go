@@ -0,0 +1,379 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package saml Vouch Proxy as the service provider of a SAML 2.0 IdP, see `vouch.saml` in the config
+// /login sends the user to the IdP with an authentication request for the login's state, the IdP posts its response to /saml/acs
+// the verified assertion is kept in session.backend redis for /auth/{state}/, on whichever instance,
+// which checks the session and issues the jwt as it does for an OAuth provider
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+	"github.com/vouch/vouch-proxy/pkg/redis"
+	"github.com/vouch/vouch-proxy/pkg/responses"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// Provider the assertions posted to the ACS take the place of the token exchange and userinfo of an OAuth provider
+type Provider struct {
+	// KV the Redis of `session.backend`, in which the assertions are kept between the ACS and /auth/{state}/
+	KV KV
+}
+
+// KV the commands of Redis in which the assertions and the ids of those used are kept
+type KV interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Del(key string) error
+	Incr(key string) (int64, error)
+	PExpire(key string, ttl time.Duration) error
+}
+
+// ReasonIdPMetadata the 503 reason while the IdP's metadata can't be fetched
+const ReasonIdPMetadata = "idp_metadata_unavailable"
+
+// reasonSessionStore the 503 reason when session.backend redis fails, as for the login sessions
+const reasonSessionStore = "session_store_unavailable"
+
+const (
+	// pendingTTL the time from the IdP's post to the ACS until the assertion is used at /auth/{state}/
+	pendingTTL      = 5 * time.Minute
+	maxResponseSize = 1 << 20
+	// pendingKeyPrefix and seenKeyPrefix follow `session.redis.key_prefix` in the keys of the assertion of each login
+	// and of the id of each assertion used
+	pendingKeyPrefix = "saml:assertion:"
+	seenKeyPrefix    = "saml:seen:"
+)
+
+const authnRequest = `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"` +
+	` ID="%s" Version="2.0" IssueInstant="%s" Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s">` +
+	`<saml:Issuer>%s</saml:Issuer><samlp:NameIDPolicy AllowCreate="true"/></samlp:AuthnRequest>`
+
+var (
+	log *zap.SugaredLogger
+
+	errNoAssertion = errors.New("no SAML assertion for the state, it may have been used already or the IdP's response took too long")
+	errNoKV        = errors.New("SAML assertions are kept in session.backend redis, which is not configured")
+
+	// the state of /login, base64url encoded
+	reState = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+	// now is swapped out by tests
+	now = time.Now
+)
+
+// state of the service provider of a cfg.Instance
+type state struct {
+	spKey  *rsa.PrivateKey
+	spCert *x509.Certificate
+
+	// kv see Provider.KV
+	kv KV
+
+	idpMu      sync.Mutex
+	idpCached  *idp
+	idpFetched time.Time
+}
+
+type stateKey struct{}
+
+// std the state of the package configuration, for a request without a cfg.Instance
+var std = &state{}
+
+// stateOf the state of the cfg.Instance of ctx, otherwise std
+func stateOf(ctx context.Context) *state {
+	if s, ok := cfg.State(ctx, stateKey{}).(*state); ok {
+		return s
+	}
+	return std
+}
+
+// Configure see main.go configure()
+func (p Provider) Configure() {
+	log = cfg.Logging.Logger
+	std = p.newState()
+	std.loadIdPAtStart(context.Background())
+}
+
+// ConfigureInstance the service provider of inst, see cfg.NewInstance()
+func (p Provider) ConfigureInstance(inst *cfg.Instance) {
+	log = cfg.Logging.Logger
+	s := p.newState()
+	inst.SetState(stateKey{}, s)
+	s.loadIdPAtStart(cfg.WithInstance(context.Background(), inst))
+}
+
+func (p Provider) newState() *state {
+	s := &state{kv: p.KV}
+	if cfg.Cfg.SAML.Cert != "" {
+		var err error
+		if s.spKey, s.spCert, err = cfg.Cfg.SAMLKeyPair(); err != nil {
+			log.Error(err)
+		}
+	}
+	return s
+}
+
+func (s *state) loadIdPAtStart(ctx context.Context) {
+	if _, err := s.loadIdP(ctx); err != nil {
+		log.Errorf("saml: %s, it will be fetched again at /login", err)
+	}
+}
+
+// requestID the ID of the authentication request for the state of the login, which the IdP's response must be in response to
+func requestID(state string) string {
+	return "_" + state
+}
+
+// AuthnRequestURL the IdP's single sign-on url with the authentication request for the state of the login
+// using the HTTP-Redirect binding, signed with `vouch.saml.key` if it's set
+func AuthnRequestURL(ctx context.Context, state string) (string, error) {
+	c, s := cfg.FromContext(ctx), stateOf(ctx)
+	m, err := s.loadIdP(ctx)
+	if err != nil {
+		return "", err
+	}
+	req := fmt.Sprintf(authnRequest, requestID(state), now().UTC().Format(time.RFC3339), escape(m.ssoURL),
+		escape(c.SAML.ACSURL), bindingPost, escape(c.SAML.EntityID))
+	var b bytes.Buffer
+	fw, err := flate.NewWriter(&b, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fw.Write([]byte(req)); err != nil {
+		return "", err
+	}
+	if err := fw.Close(); err != nil {
+		return "", err
+	}
+
+	// the signature is over the query as sent, in this order
+	// https://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf section 3.4.4.1
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(b.Bytes())) + "&RelayState=" + url.QueryEscape(state)
+	if s.spKey != nil {
+		query += "&SigAlg=" + url.QueryEscape(algRSASHA256)
+		hashed := sha256.Sum256([]byte(query))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, s.spKey, crypto.SHA256, hashed[:])
+		if err != nil {
+			return "", err
+		}
+		query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(sig))
+	}
+	sep := "?"
+	if strings.Contains(m.ssoURL, "?") {
+		sep = "&"
+	}
+	return m.ssoURL + sep + query, nil
+}
+
+// ACSHandler /saml/acs, the assertion consumer service to which the IdP posts its response
+// - verifies the response and keeps its assertion for the login of the RelayState, the state set at /login
+// - redirects to /auth/{state}/, where the session cookie is sent to check the state, as for an OAuth provider
+func ACSHandler(w http.ResponseWriter, r *http.Request) {
+	c, s := cfg.FromContext(r.Context()), stateOf(r.Context())
+	genOAuth := cfg.InstanceOf(r.Context()).GenOAuth
+	if genOAuth.Provider != cfg.Providers.SAML {
+		http.NotFound(w, r)
+		return
+	}
+	log.Debug("/saml/acs")
+	r.Body = http.MaxBytesReader(w, r.Body, maxResponseSize)
+	if err := r.ParseForm(); err != nil {
+		metrics.Callback(genOAuth.Provider, metrics.CallbackError)
+		responses.Error400(w, r, fmt.Errorf("/saml/acs could not parse the posted response: %w", err))
+		return
+	}
+	state := r.PostForm.Get("RelayState")
+	if !reState.MatchString(state) {
+		metrics.Callback(genOAuth.Provider, metrics.CallbackError)
+		responses.Error400(w, r, errors.New("/saml/acs the RelayState is not the state of a login, IdP initiated logins are not supported"))
+		return
+	}
+	m, err := s.loadIdP(r.Context())
+	if err != nil {
+		metrics.Callback(genOAuth.Provider, metrics.CallbackError)
+		responses.Error503(w, r, ReasonIdPMetadata, 0, fmt.Errorf("/saml/acs %w", err))
+		return
+	}
+
+	a, err := parseResponse(c, r.PostForm.Get("SAMLResponse"), state, m)
+	if err == nil {
+		err = s.markSeen(c, a)
+	}
+	if err != nil && !errors.Is(err, errInvalidResponse) && !errors.Is(err, errStatus) {
+		metrics.Callback(genOAuth.Provider, metrics.CallbackError)
+		responses.Error503(w, r, reasonSessionStore, 0, fmt.Errorf("/saml/acs %w", err))
+		return
+	}
+	if err != nil {
+		audit.Log(r, audit.Login, "", audit.Failure, err.Error())
+		if errors.Is(err, errStatus) {
+			metrics.Callback(genOAuth.Provider, metrics.CallbackDenied)
+			responses.Error401HTTP(w, r, fmt.Errorf("/saml/acs Error from IdP: %w", err))
+			return
+		}
+		metrics.Callback(genOAuth.Provider, metrics.CallbackError)
+		responses.Error400(w, r, fmt.Errorf("/saml/acs %w", err))
+		return
+	}
+	if err := s.keepAssertion(c, state, a); err != nil {
+		metrics.Callback(genOAuth.Provider, metrics.CallbackError)
+		responses.Error503(w, r, reasonSessionStore, 0, fmt.Errorf("/saml/acs %w", err))
+		return
+	}
+	log.Debugf("/saml/acs assertion %s for %s", a.ID, a.NameID)
+	responses.Redirect302(w, r, fmt.Sprintf("/auth/%s/?state=%s", state, state))
+}
+
+// markSeen the id of the assertion, which is refused if it's been posted before, on any instance
+// the id is kept until the assertion has expired, the INCR of its key succeeds for one request alone
+func (s *state) markSeen(c *cfg.Config, a *assertion) error {
+	if s.kv == nil {
+		return errNoKV
+	}
+	key := c.Session.Redis.KeyPrefix + seenKeyPrefix + a.ID
+	n, err := s.kv.Incr(key)
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return fmt.Errorf("%w: assertion %s has been used already", errInvalidResponse, a.ID)
+	}
+	ttl := a.NotOnOrAfter.Sub(now()) + allowedClockSkew
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return s.kv.PExpire(key, ttl)
+}
+
+// keepAssertion for the login of state, until it's taken at /auth/{state}/
+func (s *state) keepAssertion(c *cfg.Config, state string, a *assertion) error {
+	if s.kv == nil {
+		return errNoKV
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return s.kv.Set(c.Session.Redis.KeyPrefix+pendingKeyPrefix+state, b, pendingTTL)
+}
+
+// takeAssertion the assertion posted to the ACS for the login of state, which is then forgotten
+// the INCR of its key succeeds for one request alone
+func (s *state) takeAssertion(c *cfg.Config, state string) (*assertion, error) {
+	if s.kv == nil {
+		return nil, errNoKV
+	}
+	key := c.Session.Redis.KeyPrefix + pendingKeyPrefix + state
+	b, err := s.kv.Get(key)
+	if errors.Is(err, redis.ErrNil) {
+		return nil, errNoAssertion
+	}
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.kv.Incr(key + ":taken")
+	if err != nil {
+		return nil, err
+	}
+	if n != 1 {
+		return nil, errNoAssertion
+	}
+	if err := s.kv.PExpire(key+":taken", pendingTTL); err != nil {
+		log.Warnf("saml: could not expire the assertion taken for %s: %s", state, err)
+	}
+	if err := s.kv.Del(key); err != nil {
+		log.Warnf("saml: could not delete the assertion taken for %s: %s", state, err)
+	}
+	a := &assertion{}
+	if err := json.Unmarshal(b, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// GetUserInfo the user of the assertion posted to the ACS for the state of /auth/{state}/
+// the NameID is the username, the email and groups are from the attributes named by `vouch.saml.attributes`
+// every attribute is a claim, which may be passed in `headers.claims`
+func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens, opts ...oauth2.AuthCodeOption) error {
+	c := cfg.FromContext(r.Context())
+	a, err := stateOf(r.Context()).takeAssertion(c, r.URL.Query().Get("state"))
+	if err != nil {
+		return err
+	}
+	claims := make(map[string]interface{}, len(a.AttributeNames)+2)
+	for _, name := range a.AttributeNames {
+		values := a.Attributes[name]
+		if len(values) == 1 {
+			claims[name] = values[0]
+			continue
+		}
+		claims[name] = list(values)
+	}
+
+	user.Username = a.NameID
+	if emails := a.Attributes[c.SAML.Attributes.Email]; len(emails) > 0 {
+		user.Email = emails[0]
+	} else if a.NameIDFormat == nameIDEmail {
+		user.Email = a.NameID
+	}
+	if user.Email != "" {
+		claims["email"] = user.Email
+	}
+	if groups, ok := a.Attributes[c.SAML.Attributes.Groups]; ok {
+		user.TeamMemberships = groups
+		claims[c.Groups.Claim] = list(groups)
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	log.Debugf("getUserInfoFromSAML claims: %s", string(data))
+	if err := common.MapClaims(r.Context(), data, customClaims); err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Debugf("User Obj: %+v", user)
+	return nil
+}
+
+func list(values []string) []interface{} {
+	l := make([]interface{}, len(values))
+	for i, v := range values {
+		l[i] = v
+	}
+	return l
+}
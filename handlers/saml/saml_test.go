@@ -0,0 +1,521 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/redis"
+	"github.com/vouch/vouch-proxy/pkg/responses"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// testResponse is signed by a testIdP where the placeholders are
+const testResponse = `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_response1" InResponseTo="_teststate" Version="2.0" IssueInstant="2024-01-01T00:00:00Z" Destination="https://vouch.example.com/saml/acs">
+  <saml:Issuer>https://idp.example.com/metadata</saml:Issuer><!--response signature-->
+  <samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+  <saml:Assertion Version="2.0" IssueInstant="2024-01-01T00:00:00Z" ID="_assertion1">
+    <saml:Issuer>https://idp.example.com/metadata</saml:Issuer><!--assertion signature-->
+    <saml:Subject>
+      <saml:NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent">u123</saml:NameID>
+      <saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+        <saml:SubjectConfirmationData Recipient="https://vouch.example.com/saml/acs" NotOnOrAfter="2024-01-01T00:05:00Z" InResponseTo="_teststate"/>
+      </saml:SubjectConfirmation>
+    </saml:Subject>
+    <saml:Conditions NotBefore="2023-12-31T23:59:00Z" NotOnOrAfter="2024-01-01T00:05:00Z">
+      <saml:AudienceRestriction><saml:Audience>https://vouch.example.com/saml/metadata</saml:Audience></saml:AudienceRestriction>
+    </saml:Conditions>
+    <saml:AttributeStatement>
+      <saml:Attribute Name="email"><saml:AttributeValue>joe@example.com</saml:AttributeValue></saml:Attribute>
+      <saml:Attribute Name="groups"><saml:AttributeValue>staff</saml:AttributeValue></saml:Attribute>
+    </saml:AttributeStatement>
+  </saml:Assertion>
+</samlp:Response>`
+
+var (
+	testNow         = time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC)
+	testKey         *rsa.PrivateKey
+	otherKey        *rsa.PrivateKey
+	responseSig     = "<!--response signature-->"
+	assertionSig    = "<!--assertion signature-->"
+	metadataFixture = "config/testing/saml_idp_metadata.xml"
+)
+
+// testIdP signs SAML responses as the IdP would
+type testIdP struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	if testKey == nil {
+		var err error
+		testKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+		otherKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+	}
+	return newTestIdPWithKey(t, testKey)
+}
+
+func newTestIdPWithKey(t *testing.T, key *rsa.PrivateKey) *testIdP {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testIdP{key: key, cert: cert}
+}
+
+func (p *testIdP) metadata() string {
+	return fmt.Sprintf(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com/metadata">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor><ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:X509Data><ds:X509Certificate>%s</ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso/redirect?tenant=1"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`, base64.StdEncoding.EncodeToString(p.cert.Raw))
+}
+
+// sign the element id of doc, putting the signature in place of placeholder
+func (p *testIdP) sign(t *testing.T, doc, placeholder, id string) string {
+	root, err := parseXML([]byte(doc))
+	assert.NoError(t, err)
+	e := findID(root, id)
+	assert.NotNil(t, e, id)
+	ns, err := etreeutils.NSBuildParentContext(e)
+	assert.NoError(t, err)
+	detached, err := etreeutils.NSDetatch(ns, e)
+	assert.NoError(t, err)
+
+	ctx, err := dsig.NewSigningContext(p.key, [][]byte{p.cert.Raw})
+	assert.NoError(t, err)
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	sig, err := ctx.ConstructSignature(detached, true)
+	assert.NoError(t, err)
+	sigDoc := etree.NewDocument()
+	sigDoc.SetRoot(sig)
+	signature, err := sigDoc.WriteToString()
+	assert.NoError(t, err)
+	return strings.Replace(doc, placeholder, signature, 1)
+}
+
+func findID(e *etree.Element, id string) *etree.Element {
+	if attr(e, "ID") == id {
+		return e
+	}
+	for _, c := range e.ChildElements() {
+		if found := findID(c, id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// fakeKV stands in for Redis
+type fakeKV struct {
+	mu   sync.Mutex
+	data map[string][]byte
+	// failing the error every command fails with
+	failing error
+}
+
+func newFakeKV() *fakeKV {
+	return &fakeKV{data: make(map[string][]byte)}
+}
+
+func (f *fakeKV) Get(key string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing != nil {
+		return nil, f.failing
+	}
+	v, ok := f.data[key]
+	if !ok {
+		return nil, redis.ErrNil
+	}
+	return v, nil
+}
+
+func (f *fakeKV) Set(key string, value []byte, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing != nil {
+		return f.failing
+	}
+	f.data[key] = value
+	return nil
+}
+
+func (f *fakeKV) Del(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing != nil {
+		return f.failing
+	}
+	delete(f.data, key)
+	return nil
+}
+
+func (f *fakeKV) Incr(key string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing != nil {
+		return 0, f.failing
+	}
+	n, _ := strconv.ParseInt(string(f.data[key]), 10, 64)
+	n++
+	f.data[key] = []byte(strconv.FormatInt(n, 10))
+	return n, nil
+}
+
+func (f *fakeKV) PExpire(key string, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing != nil {
+		return f.failing
+	}
+	if _, ok := f.data[key]; !ok {
+		return redis.ErrNil
+	}
+	return nil
+}
+
+func fixtureCerts(t *testing.T) []*x509.Certificate {
+	b, err := ioutil.ReadFile(filepath.Join(os.Getenv("VOUCH_ROOT"), metadataFixture))
+	assert.NoError(t, err)
+	m, err := parseIdPMetadata(b)
+	assert.NoError(t, err)
+	return m.certs
+}
+
+// setUp configures config/testing/handler_saml.yml with the metadata served by the test server
+// the assertions are kept in the fakeKV returned
+func setUp(t *testing.T, metadata string) *fakeKV {
+	assert.NoError(t, os.Setenv("VOUCH_CONFIG", filepath.Join(os.Getenv("VOUCH_ROOT"), "config/testing/handler_saml.yml")))
+	cfg.InitForTestPurposes()
+	domains.Configure()
+	cookie.Configure()
+	responses.Configure()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(metadata))
+	}))
+	t.Cleanup(srv.Close)
+	cfg.Cfg.SAML.IdPMetadataURL = srv.URL
+	now = func() time.Time { return testNow }
+	t.Cleanup(func() { now = time.Now })
+	kv := newFakeKV()
+	Provider{KV: kv}.Configure()
+	return kv
+}
+
+func TestConfigure(t *testing.T) {
+	setUp(t, newTestIdP(t).metadata())
+	assert.Equal(t, cfg.Providers.SAML, cfg.GenOAuth.Provider)
+	assert.Equal(t, "https://vouch.example.com/saml/metadata", cfg.Cfg.SAML.EntityID)
+	m, err := std.loadIdP(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "https://idp.example.com/metadata", m.entityID)
+	assert.Equal(t, "https://idp.example.com/sso/redirect?tenant=1", m.ssoURL)
+	assert.Len(t, m.certs, 1)
+}
+
+func Test_parseResponseFixture(t *testing.T) {
+	b, err := ioutil.ReadFile(filepath.Join(os.Getenv("VOUCH_ROOT"), metadataFixture))
+	assert.NoError(t, err)
+	setUp(t, string(b))
+	m, err := std.loadIdP(context.Background())
+	assert.NoError(t, err)
+
+	b, err = ioutil.ReadFile(filepath.Join(os.Getenv("VOUCH_ROOT"), "config/testing/saml_response.xml"))
+	assert.NoError(t, err)
+	a, err := parseResponse(cfg.Cfg, base64.StdEncoding.EncodeToString(b), "teststate", m)
+	assert.NoError(t, err)
+	assert.Equal(t, "_assertion1", a.ID)
+	assert.Equal(t, "jane@example.com", a.NameID)
+	assert.Equal(t, nameIDEmail, a.NameIDFormat)
+	assert.Equal(t, []string{"email", "groups", "displayName"}, a.AttributeNames)
+	assert.Equal(t, []string{"staff", "R&D"}, a.Attributes["groups"])
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 5, 0, 0, time.UTC), a.NotOnOrAfter)
+}
+
+func Test_parseResponse(t *testing.T) {
+	p := newTestIdP(t)
+	setUp(t, p.metadata())
+	m, err := std.loadIdP(context.Background())
+	assert.NoError(t, err)
+	other := newTestIdPWithKey(t, otherKey)
+
+	signAssertion := func(doc string) string { return p.sign(t, doc, assertionSig, "_assertion1") }
+	signResponse := func(doc string) string { return p.sign(t, doc, responseSig, "_response1") }
+	replace := func(old, new string) func(string) string {
+		return func(doc string) string { return strings.Replace(doc, old, new, 1) }
+	}
+	same := func(doc string) string { return doc }
+
+	tests := []struct {
+		name    string
+		edit    func(string) string
+		sign    func(string) string
+		after   func(string) string
+		state   string
+		at      time.Time
+		wantErr error
+	}{
+		{"the assertion is signed", same, signAssertion, same, "", time.Time{}, nil},
+		{"the response is signed", same, signResponse, same, "", time.Time{}, nil},
+		{"both are signed", same, func(doc string) string { return signResponse(signAssertion(doc)) }, same, "", time.Time{}, nil},
+		{"within the allowed clock skew", same, signAssertion, same, "", time.Date(2024, 1, 1, 0, 6, 0, 0, time.UTC), nil},
+		{"neither is signed", same, same, same, "", time.Time{}, errInvalidResponse},
+		{"signed by another key", same, func(doc string) string { return other.sign(t, doc, assertionSig, "_assertion1") }, same, "", time.Time{}, errInvalidResponse},
+		{"tampered with after it was signed", same, signAssertion, replace(">u123<", ">admin<"), "", time.Time{}, errInvalidResponse},
+		{"another unsigned assertion is wrapped in", same, signAssertion,
+			replace("</samlp:Response>", `<saml:Assertion ID="_evil"><saml:Issuer>https://idp.example.com/metadata</saml:Issuer></saml:Assertion></samlp:Response>`), "", time.Time{}, errInvalidResponse},
+		{"the signed assertion is wrapped in an unsigned one", same, signAssertion,
+			func(doc string) string {
+				start := strings.Index(doc, "<saml:Assertion ")
+				end := strings.Index(doc, "</saml:Assertion>") + len("</saml:Assertion>")
+				evil := strings.Replace(doc[start:end], ">u123<", ">admin<", 1)
+				evil = strings.Replace(evil, `ID="_assertion1"`, `ID="_evil"`, 1)
+				evil = strings.Replace(evil, "</saml:Assertion>", doc[start:end]+"</saml:Assertion>", 1)
+				return doc[:start] + evil + doc[end:]
+			}, "", time.Time{}, errInvalidResponse},
+		{"for another login", same, signAssertion, same, "otherstate", time.Time{}, errInvalidResponse},
+		{"the assertion is for another login", replace(`InResponseTo="_teststate"/>`, `InResponseTo="_otherstate"/>`), signAssertion, same, "", time.Time{}, errInvalidResponse},
+		{"for another audience", replace("https://vouch.example.com/saml/metadata", "https://other.example.com/saml/metadata"), signAssertion, same, "", time.Time{}, errInvalidResponse},
+		{"no audience restriction", replace("<saml:AudienceRestriction><saml:Audience>https://vouch.example.com/saml/metadata</saml:Audience></saml:AudienceRestriction>", ""), signAssertion, same, "", time.Time{}, errInvalidResponse},
+		{"for another recipient", replace(`Recipient="https://vouch.example.com/saml/acs"`, `Recipient="https://other.example.com/saml/acs"`), signAssertion, same, "", time.Time{}, errInvalidResponse},
+		{"for another destination", replace(`Destination="https://vouch.example.com/saml/acs"`, `Destination="https://other.example.com/saml/acs"`), signAssertion, same, "", time.Time{}, errInvalidResponse},
+		{"issued by another IdP", replace("<saml:Issuer>https://idp.example.com/metadata</saml:Issuer><!--assertion", "<saml:Issuer>https://other.example.com</saml:Issuer><!--assertion"), signAssertion, same, "", time.Time{}, errInvalidResponse},
+		{"not a bearer assertion", replace(":cm:bearer", ":cm:holder-of-key"), signAssertion, same, "", time.Time{}, errInvalidResponse},
+		{"expired", same, signAssertion, same, "", time.Date(2024, 1, 1, 0, 7, 0, 0, time.UTC), errInvalidResponse},
+		{"not yet valid", same, signAssertion, same, "", time.Date(2023, 12, 31, 23, 57, 0, 0, time.UTC), errInvalidResponse},
+		{"the IdP refused", replace("status:Success", "status:Responder"), same, same, "", time.Time{}, errStatus},
+		{"an encrypted assertion", replace("</samlp:Response>", `<saml:EncryptedAssertion/></samlp:Response>`), signResponse, same, "", time.Time{}, errInvalidResponse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = func() time.Time { return testNow }
+			if !tt.at.IsZero() {
+				now = func() time.Time { return tt.at }
+			}
+			state := "teststate"
+			if tt.state != "" {
+				state = tt.state
+			}
+			doc := tt.after(tt.sign(tt.edit(testResponse)))
+			a, err := parseResponse(cfg.Cfg, base64.StdEncoding.EncodeToString([]byte(doc)), state, m)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), "%v", err)
+				assert.Nil(t, a)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "u123", a.NameID)
+		})
+	}
+}
+
+func postACS(doc, state string) *httptest.ResponseRecorder {
+	form := url.Values{"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte(doc))}, "RelayState": {state}}
+	req := httptest.NewRequest(http.MethodPost, "/saml/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	ACSHandler(rr, req)
+	return rr
+}
+
+func TestACSHandler(t *testing.T) {
+	p := newTestIdP(t)
+	setUp(t, p.metadata())
+	doc := p.sign(t, testResponse, assertionSig, "_assertion1")
+
+	rr := postACS(doc, "teststate")
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "/auth/teststate/?state=teststate", rr.Header().Get("Location"))
+
+	// the assertion may only be used once
+	rr = postACS(doc, "teststate")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = postACS(doc, "not/a/state")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = postACS(strings.Replace(testResponse, "status:Success", "status:Responder", 1), "teststate")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	cfg.GenOAuth.Provider = cfg.Providers.OIDC
+	rr = postACS(doc, "teststate")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestGetUserInfo(t *testing.T) {
+	p := newTestIdP(t)
+	setUp(t, p.metadata())
+	assert.Equal(t, http.StatusFound, postACS(p.sign(t, testResponse, assertionSig, "_assertion1"), "teststate").Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/teststate/?state=teststate", nil)
+	user := &structs.User{}
+	customClaims := &structs.CustomClaims{}
+	assert.NoError(t, Provider{}.GetUserInfo(req, user, customClaims, &structs.PTokens{}))
+	assert.Equal(t, "u123", user.Username)
+	assert.Equal(t, "joe@example.com", user.Email)
+	assert.Equal(t, []string{"staff"}, user.TeamMemberships)
+	assert.Equal(t, "joe@example.com", customClaims.Claims["email"])
+	assert.Equal(t, []interface{}{"staff"}, customClaims.Claims["groups"])
+
+	// the assertion is taken
+	assert.True(t, errors.Is(Provider{}.GetUserInfo(req, &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{}), errNoAssertion))
+}
+
+func TestAuthnRequestURL(t *testing.T) {
+	setUp(t, newTestIdP(t).metadata())
+	u, err := AuthnRequestURL(context.Background(), "teststate")
+	assert.NoError(t, err)
+	parsed, err := url.Parse(u)
+	assert.NoError(t, err)
+	assert.Equal(t, "idp.example.com", parsed.Host)
+	assert.Equal(t, "/sso/redirect", parsed.Path)
+	q := parsed.Query()
+	assert.Equal(t, "1", q.Get("tenant"))
+	assert.Equal(t, "teststate", q.Get("RelayState"))
+	assert.Empty(t, q.Get("Signature"))
+
+	deflated, err := base64.StdEncoding.DecodeString(q.Get("SAMLRequest"))
+	assert.NoError(t, err)
+	inflated, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	assert.NoError(t, err)
+	req, err := parseXML(inflated)
+	assert.NoError(t, err)
+	assert.True(t, is(req, nsProtocol, "AuthnRequest"))
+	assert.Equal(t, "_teststate", attr(req, "ID"))
+	assert.Equal(t, "https://vouch.example.com/saml/acs", attr(req, "AssertionConsumerServiceURL"))
+	assert.Equal(t, "https://idp.example.com/sso/redirect?tenant=1", attr(req, "Destination"))
+	assert.Equal(t, "2024-01-01T00:01:00Z", attr(req, "IssueInstant"))
+	assert.Equal(t, "https://vouch.example.com/saml/metadata", text(child(req, nsAssertion, "Issuer")))
+
+	// signed with saml.key
+	sp := newTestIdPWithKey(t, otherKey)
+	dir := t.TempDir()
+	cfg.Cfg.SAML.Cert = filepath.Join(dir, "sp.crt")
+	cfg.Cfg.SAML.Key = filepath.Join(dir, "sp.key")
+	assert.NoError(t, ioutil.WriteFile(cfg.Cfg.SAML.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: sp.cert.Raw}), 0600))
+	assert.NoError(t, ioutil.WriteFile(cfg.Cfg.SAML.Key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(otherKey)}), 0600))
+	Provider{}.Configure()
+
+	u, err = AuthnRequestURL(context.Background(), "teststate")
+	assert.NoError(t, err)
+	query := u[strings.Index(u, "SAMLRequest="):]
+	signed := query[:strings.Index(query, "&Signature=")]
+	parsed, err = url.Parse(u)
+	assert.NoError(t, err)
+	assert.Equal(t, algRSASHA256, parsed.Query().Get("SigAlg"))
+	sig, err := base64.StdEncoding.DecodeString(parsed.Query().Get("Signature"))
+	assert.NoError(t, err)
+	hashed := sha256.Sum256([]byte(signed))
+	assert.NoError(t, rsa.VerifyPKCS1v15(&otherKey.PublicKey, crypto.SHA256, hashed[:], sig))
+}
+
+func TestMetadataHandler(t *testing.T) {
+	setUp(t, newTestIdP(t).metadata())
+	rr := httptest.NewRecorder()
+	MetadataHandler(rr, httptest.NewRequest(http.MethodGet, "/saml/metadata", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, metadataMimeType, rr.Header().Get("Content-Type"))
+
+	md, err := parseXML(rr.Body.Bytes())
+	assert.NoError(t, err)
+	assert.True(t, is(md, nsMetadata, "EntityDescriptor"))
+	assert.Equal(t, "https://vouch.example.com/saml/metadata", attr(md, "entityID"))
+	sp := child(md, nsMetadata, "SPSSODescriptor")
+	assert.Equal(t, "false", attr(sp, "AuthnRequestsSigned"))
+	assert.Nil(t, child(sp, nsMetadata, "KeyDescriptor"))
+	assert.Equal(t, "https://vouch.example.com/saml/acs", attr(child(sp, nsMetadata, "AssertionConsumerService"), "Location"))
+
+	cfg.GenOAuth.Provider = cfg.Providers.OIDC
+	rr = httptest.NewRecorder()
+	MetadataHandler(rr, httptest.NewRequest(http.MethodGet, "/saml/metadata", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func Test_loadIdP(t *testing.T) {
+	setUp(t, newTestIdP(t).metadata())
+	m, err := std.loadIdP(context.Background())
+	assert.NoError(t, err)
+
+	// the metadata fetched before is used while it can't be fetched again
+	cfg.Cfg.SAML.IdPMetadataURL = "http://127.0.0.1:1/metadata"
+	now = func() time.Time { return testNow.Add(metadataMaxAge + time.Minute) }
+	stale, err := std.loadIdP(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, m, stale)
+
+	std.idpMu.Lock()
+	std.idpCached = nil
+	std.idpMu.Unlock()
+	_, err = std.loadIdP(context.Background())
+	assert.Error(t, err)
+}
+
+func Test_parseIdPMetadata(t *testing.T) {
+	md := newTestIdP(t).metadata()
+	tests := []struct {
+		name     string
+		metadata string
+	}{
+		{"no entityID", strings.Replace(md, `entityID="https://idp.example.com/metadata"`, "", 1)},
+		{"no HTTP-Redirect binding", strings.Replace(md, "bindings:HTTP-Redirect", "bindings:HTTP-POST", 1)},
+		{"no signing certificate", strings.Replace(md, "<md:KeyDescriptor>", `<md:KeyDescriptor use="encryption">`, 1)},
+		{"not an IdP", strings.Replace(md, "IDPSSODescriptor", "SPSSODescriptor", 2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseIdPMetadata([]byte(tt.metadata))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,253 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package saml
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+// the enveloped signatures of SAML, verified by goxmldsig
+// https://www.w3.org/TR/xmldsig-core1/
+const (
+	nsDSig = "http://www.w3.org/2000/09/xmldsig#"
+	nsXML  = "http://www.w3.org/XML/1998/namespace"
+
+	algRSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+)
+
+var (
+	// the SHA-1 signature and digest methods, which goxmldsig accepts, are refused
+	weakAlgorithms = map[string]bool{
+		"http://www.w3.org/2000/09/xmldsig#rsa-sha1":           true,
+		"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha1":    true,
+		"http://www.w3.org/2000/09/xmldsig#sha1":               true,
+		"http://www.w3.org/2000/09/xmldsig#dsa-sha1":           true,
+		"http://www.w3.org/2000/09/xmldsig#hmac-sha1":          true,
+		"http://www.w3.org/2001/04/xmldsig-more#hmac-sha1":     true,
+		"http://www.w3.org/2001/04/xmldsig-more#rsa-md5":       true,
+		"http://www.w3.org/2001/04/xmldsig-more#md5":           true,
+		"http://www.w3.org/2001/04/xmldsig-more#rsa-ripemd160": true,
+	}
+
+	errNotSigned = errors.New("not signed")
+	errSignature = errors.New("signature is not valid")
+)
+
+// parseXML the root element of the document, which mustn't have a DTD
+func parseXML(b []byte) (*etree.Element, error) {
+	// the tags must match, attributes mayn't repeat and there may be no DTD, which etree doesn't check
+	d := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			seen := make(map[xml.Name]bool, len(t.Attr))
+			for _, a := range t.Attr {
+				if seen[a.Name] {
+					return nil, fmt.Errorf("attribute %s is repeated", a.Name.Local)
+				}
+				seen[a.Name] = true
+			}
+		case xml.ProcInst:
+			if t.Target != "xml" {
+				return nil, fmt.Errorf("processing instruction %s is not supported", t.Target)
+			}
+		case xml.Directive:
+			return nil, errors.New("DTDs are not allowed")
+		}
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(b); err != nil {
+		return nil, err
+	}
+	switch roots := doc.ChildElements(); len(roots) {
+	case 0:
+		return nil, io.ErrUnexpectedEOF
+	case 1:
+		return roots[0], checkElement(roots[0])
+	default:
+		return nil, errors.New("more than one root element")
+	}
+}
+
+// checkElement e and its descendants declare their prefixes
+func checkElement(e *etree.Element) error {
+	if _, ok := lookupNamespace(e, e.Space); !ok {
+		return fmt.Errorf("prefix %s is not declared", e.Space)
+	}
+	for _, a := range e.Attr {
+		if _, ok := lookupNamespace(e, a.Space); !ok && a.Space != "xmlns" {
+			return fmt.Errorf("prefix %s is not declared", a.Space)
+		}
+	}
+	for _, c := range e.ChildElements() {
+		if err := checkElement(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupNamespace the namespace bound to prefix in the scope of e, "" is the default namespace
+func lookupNamespace(e *etree.Element, prefix string) (string, bool) {
+	for n := e; n != nil; n = n.Parent() {
+		for _, a := range n.Attr {
+			if (prefix == "" && a.Space == "" && a.Key == "xmlns") ||
+				(prefix != "" && a.Space == "xmlns" && a.Key == prefix) {
+				return a.Value, true
+			}
+		}
+	}
+	switch prefix {
+	case "xml":
+		return nsXML, true
+	case "":
+		return "", true
+	}
+	return "", false
+}
+
+// is the element local in the namespace space
+func is(e *etree.Element, space, local string) bool {
+	ns, ok := lookupNamespace(e, e.Space)
+	return ok && ns == space && e.Tag == local
+}
+
+// attr the value of the unqualified attribute local of e, "" if it's not set
+func attr(e *etree.Element, local string) string {
+	if e == nil {
+		return ""
+	}
+	for _, a := range e.Attr {
+		if a.Space == "" && a.Key == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// all the child elements of e local in the namespace space
+func all(e *etree.Element, space, local string) []*etree.Element {
+	if e == nil {
+		return nil
+	}
+	var found []*etree.Element
+	for _, c := range e.ChildElements() {
+		if is(c, space, local) {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+// child the only child element of e local in the namespace space, nil if there isn't exactly one
+func child(e *etree.Element, space, local string) *etree.Element {
+	if found := all(e, space, local); len(found) == 1 {
+		return found[0]
+	}
+	return nil
+}
+
+// text the character data of e, surrounding whitespace trimmed
+// all of it rather than etree's Text(), which stops at a comment or child element
+func text(e *etree.Element) string {
+	if e == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, c := range e.Child {
+		if cd, ok := c.(*etree.CharData); ok {
+			b.WriteString(cd.Data)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// verifySignature the element signed by the enveloped signature of e, its ds:Signature child, by one of certs
+// the data of a SAML message is only taken from the element returned, which is the canonical form of e whose digest was verified
+func verifySignature(e *etree.Element, certs []*x509.Certificate) (*etree.Element, error) {
+	sigs := all(e, nsDSig, "Signature")
+	switch len(sigs) {
+	case 0:
+		return nil, errNotSigned
+	case 1:
+	default:
+		return nil, errors.New("more than one signature")
+	}
+	signedInfo := child(sigs[0], nsDSig, "SignedInfo")
+	if signedInfo == nil {
+		return nil, errors.New("signature has no SignedInfo")
+	}
+	ref := child(signedInfo, nsDSig, "Reference")
+	if ref == nil {
+		return nil, errors.New("signature must have exactly one Reference")
+	}
+	// goxmldsig also accepts an empty URI, for the whole document
+	id := attr(e, "ID")
+	if id == "" || attr(ref, "URI") != "#"+id {
+		return nil, fmt.Errorf("signature references %s rather than the signed element", attr(ref, "URI"))
+	}
+	for _, method := range []*etree.Element{child(signedInfo, nsDSig, "SignatureMethod"), child(ref, nsDSig, "DigestMethod")} {
+		if alg := attr(method, "Algorithm"); weakAlgorithms[alg] {
+			return nil, fmt.Errorf("%s is not supported", alg)
+		}
+	}
+
+	// the namespaces declared by e's ancestors are declared on the copy which is verified
+	ns, err := etreeutils.NSBuildParentContext(e)
+	if err != nil {
+		return nil, err
+	}
+	detached, err := etreeutils.NSDetatch(ns, e)
+	if err != nil {
+		return nil, err
+	}
+	// the SignatureValue, which isn't itself signed, is often broken over lines, which goxmldsig doesn't decode
+	if v := child(child(detached, nsDSig, "Signature"), nsDSig, "SignatureValue"); v != nil {
+		v.SetText(strings.Join(strings.Fields(text(v)), ""))
+	}
+	// goxmldsig trusts a lone certificate when the signature has no KeyInfo, so each of the IdP's is tried alone
+	for _, cert := range certs {
+		ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{cert}})
+		var verified *etree.Element
+		if verified, err = ctx.Validate(detached); err == nil {
+			return verified, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errSignature, err)
+}
+
+// decodeBase64 of an XML element, which may be broken over lines
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	if s == "" {
+		return nil, errors.New("is empty")
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
@@ -0,0 +1,85 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package saml
+
+import (
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseXML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"a DTD", `<!DOCTYPE r [<!ENTITY e "x">]><r>&e;</r>`},
+		{"a processing instruction", `<r><?pi data?></r>`},
+		{"duplicate attributes", `<r a="1" a="2"/>`},
+		{"mismatched tags", `<r><a></b></r>`},
+		{"an undeclared prefix", `<x:r/>`},
+		{"more than one root", `<r/><r/>`},
+		{"empty", ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseXML([]byte(tt.in))
+			assert.Error(t, err)
+		})
+	}
+}
+
+// config/testing/saml_response.xml was signed with openssl, its assertion with the PrefixList "xs"
+func Test_verifySignature(t *testing.T) {
+	certs := fixtureCerts(t)
+	b, err := ioutil.ReadFile(filepath.Join(os.Getenv("VOUCH_ROOT"), "config/testing/saml_response.xml"))
+	assert.NoError(t, err)
+
+	resp, err := parseXML(b)
+	assert.NoError(t, err)
+	a := child(resp, nsAssertion, "Assertion")
+	verified, err := verifySignature(a, certs)
+	assert.NoError(t, err)
+	assert.Nil(t, child(verified, nsDSig, "Signature"), "the enveloped signature is removed")
+	assert.Equal(t, "jane@example.com", text(child(child(verified, nsAssertion, "Subject"), nsAssertion, "NameID")))
+	_, err = verifySignature(resp, certs)
+	assert.True(t, errors.Is(err, errNotSigned), "the response isn't signed")
+	_, err = verifySignature(a, []*x509.Certificate{newTestIdP(t).cert})
+	assert.True(t, errors.Is(err, errSignature), "signed by another key")
+
+	tampered, err := parseXML([]byte(strings.Replace(string(b), ">jane@example.com</saml:NameID>", ">joe@example.com</saml:NameID>", 1)))
+	assert.NoError(t, err)
+	_, err = verifySignature(child(tampered, nsAssertion, "Assertion"), certs)
+	assert.True(t, errors.Is(err, errSignature), "the digest doesn't match")
+
+	// a comment isn't signed, the text on either side of it is all of the NameID
+	commented, err := parseXML([]byte(strings.Replace(string(b), ">jane@example.com</saml:NameID>", ">jane@example.com<!---->.evil.example</saml:NameID>", 1)))
+	assert.NoError(t, err)
+	_, err = verifySignature(child(commented, nsAssertion, "Assertion"), certs)
+	assert.True(t, errors.Is(err, errSignature), "the NameID is jane@example.com.evil.example")
+
+	// the signature must be of the element which holds it
+	moved, err := parseXML([]byte(strings.Replace(string(b), `ID="_assertion1"`, `ID="_assertion2"`, 1)))
+	assert.NoError(t, err)
+	_, err = verifySignature(child(moved, nsAssertion, "Assertion"), certs)
+	assert.Error(t, err)
+
+	sha1, err := parseXML([]byte(strings.Replace(string(b), algRSASHA256, "http://www.w3.org/2000/09/xmldsig#rsa-sha1", 1)))
+	assert.NoError(t, err)
+	_, err = verifySignature(child(sha1, nsAssertion, "Assertion"), certs)
+	assert.Error(t, err)
+}
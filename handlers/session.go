@@ -0,0 +1,167 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
+)
+
+// sessionIDKey the session's id is kept in its values since the cookie store doesn't keep session.ID
+const sessionIDKey = "id"
+
+var (
+	errSessionUsed  = errors.New("the login session has already been used")
+	errSessionNoID  = errors.New("the login session has no id")
+	errCallbackHost = errors.New("the callback from the IdP arrived at another host than the login began at")
+
+	// loginHosts the host at which each login began, by its state, to explain a callback which arrives at another host
+	loginHosts = newHostsByState(maxLoginHosts)
+)
+
+// loginSession the session which carries the OAuth state through the login
+// with `session.rotate` it is regenerated with a new id and without any of the values it had, so that a session cookie
+// planted in the browser by someone else can't be used to fix the login, only the failure count for each requested URL is kept
+func loginSession(r *http.Request) (*sessions.Session, error) {
+	session, err := stateOf(r.Context()).sessstore.Get(r, cfg.FromContext(r.Context()).Session.Name)
+	if err != nil {
+		log.Infof("couldn't find existing encrypted secure cookie with name %s: %s (probably fine)", cfg.FromContext(r.Context()).Session.Name, err)
+	}
+	if !cfg.FromContext(r.Context()).Session.Rotate {
+		return session, nil
+	}
+
+	id, err := generateSessionID()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range session.Values {
+		if _, failcount := v.(int); !failcount {
+			delete(session.Values, k)
+		}
+	}
+	session.IsNew = true
+	session.ID = id
+	session.Values[sessionIDKey] = id
+	return session, nil
+}
+
+// maxLoginHosts how many logins' hosts are remembered, a flood of /login forgets the oldest rather than growing without bound
+const maxLoginHosts = 10000
+
+// hostsByState the host of each of the most recent logins, the most recent at the front of recent
+type hostsByState struct {
+	mu     sync.Mutex
+	max    int
+	states map[string]*list.Element
+	recent *list.List
+}
+
+type hostOfState struct {
+	state   string
+	host    string
+	expires time.Time
+}
+
+func newHostsByState(max int) *hostsByState {
+	return &hostsByState{max: max, states: make(map[string]*list.Element), recent: list.New()}
+}
+
+// set remember host for state for as long as the login session lives
+func (h *hostsByState) set(state, host string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e, ok := h.states[state]; ok {
+		h.recent.Remove(e)
+	}
+	h.states[state] = h.recent.PushFront(&hostOfState{state: state, host: host, expires: now().Add(loginSessionMaxAge * time.Second)})
+	for h.recent.Len() > h.max {
+		h.remove(h.recent.Back())
+	}
+}
+
+// get the host at which the login for state began, if it's still remembered
+func (h *hostsByState) get(state string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.states[state]
+	if !ok {
+		return "", false
+	}
+	lh := e.Value.(*hostOfState)
+	if now().After(lh.expires) {
+		h.remove(e)
+		return "", false
+	}
+	return lh.host, true
+}
+
+func (h *hostsByState) remove(e *list.Element) {
+	h.recent.Remove(e)
+	delete(h.states, e.Value.(*hostOfState).state)
+}
+
+// rememberLoginHost the host at which the login for state began, see checkCallbackHost
+func rememberLoginHost(r *http.Request, state string) {
+	loginHosts.set(state, forwarded.Host(r))
+}
+
+// checkCallbackHost when the login session can't be found, the login for state having begun at another host explains why
+// the session cookie is only sent back to the host which set it, so a proxy which routes the callback elsewhere loses it
+func checkCallbackHost(r *http.Request, state string) error {
+	loginHost, found := loginHosts.get(state)
+	if !found {
+		return nil
+	}
+	host := forwarded.Host(r)
+	if strings.EqualFold(loginHost, host) {
+		return nil
+	}
+	return fmt.Errorf("%w: the login began at %s but the callback arrived at %s, where the session cookie isn't sent. "+
+		"Check that oauth.callback_url is on %s and that the proxy passes on its Host (or X-Forwarded-Host)", errCallbackHost, loginHost, host, loginHost)
+}
+
+// useSession with `session.rotate` each login session may return to /auth/{state}/ only once
+func useSession(ctx context.Context, session *sessions.Session) error {
+	if !cfg.FromContext(ctx).Session.Rotate {
+		return nil
+	}
+	id, _ := session.Values[sessionIDKey].(string)
+	if id == "" {
+		return errSessionNoID
+	}
+	if err := stateOf(ctx).usedSessions.Add(id, true, loginSessionMaxAge*time.Second); err != nil {
+		return errSessionUsed
+	}
+	session.ID = id
+	return nil
+}
+
+func generateSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
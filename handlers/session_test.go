@@ -0,0 +1,161 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// sessionFromCookies decode the login session set by a response
+func sessionFromCookies(t *testing.T, cookies []*http.Cookie) *sessions.Session {
+	req := httptest.NewRequest("GET", "/auth/", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	session, err := std.sessstore.New(req, cfg.Cfg.Session.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestLoginHandlerRotatesSession(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	requestedURL := "http://myapp.example.com/hello"
+
+	// a session planted in the victim's browser
+	planted := sessions.NewSession(std.sessstore, cfg.Cfg.Session.Name)
+	planted.Options = &sessions.Options{Path: "/", MaxAge: 300}
+	planted.Values[sessionIDKey] = "planted"
+	planted.Values["state"] = "plantedstate"
+	planted.Values[requestedURL] = 2
+	rr := httptest.NewRecorder()
+	if err := std.sessstore.Save(httptest.NewRequest("GET", "/", nil), rr, planted); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/login?url="+requestedURL, nil)
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(LoginHandler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+
+	first := sessionFromCookies(t, rr.Result().Cookies())
+	firstID, _ := first.Values[sessionIDKey].(string)
+	assert.NotEmpty(t, firstID)
+	assert.NotEqual(t, "planted", firstID)
+	assert.NotEqual(t, "plantedstate", first.Values["state"])
+	// the failure count is carried over
+	assert.Equal(t, 3, first.Values[requestedURL])
+
+	_, cookies := loginForState(t, requestedURL)
+	second := sessionFromCookies(t, cookies)
+	assert.NotEqual(t, firstID, second.Values[sessionIDKey])
+}
+
+func TestLoginHandlerWithoutRotation(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+	cfg.Cfg.Session.Rotate = false
+	defer func() { cfg.Cfg.Session.Rotate = true }()
+
+	_, cookies := loginForState(t, "http://myapp.example.com/hello")
+	assert.Nil(t, sessionFromCookies(t, cookies).Values[sessionIDKey])
+}
+
+func TestAuthStateHandlerSessionUsedOnce(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	idp := stubIdP(`{"sub":"abc","email":"test@example.com"}`)
+	defer idp.Close()
+
+	requestedURL := "http://app.example.com/hello"
+	state, cookies := loginForState(t, requestedURL)
+
+	rr := authState(t, state, cookies)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, requestedURL, rr.Header().Get("Location"))
+
+	// replaying the session cookie is refused
+	rr = authState(t, state, cookies)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestAuthStateHandlerCallbackHost(t *testing.T) {
+	setUp("/config/testing/handler_login_url.yml")
+
+	req := httptest.NewRequest("GET", "/login?url=http://myapp.example.com/hello", nil)
+	req.Host = "vouch-a.example.com"
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(LoginHandler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	state := sessionFromCookies(t, rr.Result().Cookies()).Values["state"].(string)
+
+	tests := []struct {
+		name     string
+		host     string
+		wantHost bool
+	}{
+		// the session cookie was set for vouch-a and isn't sent to vouch-b
+		{"another host", "vouch-b.example.com", true},
+		{"the same host", "vouch-a.example.com", false},
+		{"the same host in another case", "VOUCH-A.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/auth/"+state+"/?code=authcode&state="+state, nil)
+			req.Host = tt.host
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(AuthStateHandler).ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+			msg := rr.Header().Get(cfg.Cfg.Headers.Error)
+			if tt.wantHost {
+				assert.Contains(t, msg, errCallbackHost.Error())
+				assert.Contains(t, msg, "vouch-a.example.com")
+				assert.Contains(t, msg, "vouch-b.example.com")
+			} else {
+				assert.NotContains(t, msg, errCallbackHost.Error())
+			}
+		})
+	}
+}
+
+func TestHostsByState(t *testing.T) {
+	t0 := time.Now()
+	now = func() time.Time { return t0 }
+	defer func() { now = time.Now }()
+
+	h := newHostsByState(2)
+	h.set("state1", "vouch-a.example.com")
+	h.set("state2", "vouch-a.example.com")
+	h.set("state3", "vouch-b.example.com")
+	// bounded, the oldest login is forgotten
+	_, found := h.get("state1")
+	assert.False(t, found)
+	host, found := h.get("state3")
+	assert.True(t, found)
+	assert.Equal(t, "vouch-b.example.com", host)
+
+	// and forgotten once its login session has expired
+	now = func() time.Time { return t0.Add((loginSessionMaxAge + 1) * time.Second) }
+	_, found = h.get("state3")
+	assert.False(t, found)
+	assert.Equal(t, 1, h.recent.Len())
+}
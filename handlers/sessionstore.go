@@ -0,0 +1,196 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/redis"
+)
+
+// loginSessionMaxAge give the user five minutes to log in at the IdP
+const loginSessionMaxAge = 300
+
+// redisSessionIDKey the value of the session cookie of the redis store, which carries only the session's id
+const redisSessionIDKey = "rid"
+
+// reasonSessionStore the 503 reason when the login session can't be loaded or saved
+const reasonSessionStore = "session_store_unavailable"
+
+var errSessionExpired = errors.New("the login session has expired")
+
+// sessionStoreError the store of the login sessions failed, rather than the session being missing or invalid
+type sessionStoreError struct {
+	err error
+}
+
+func (e *sessionStoreError) Error() string { return "session.backend redis: " + e.err.Error() }
+
+func (e *sessionStoreError) Unwrap() error { return e.err }
+
+// isSessionStoreError see sessionStoreError
+func isSessionStoreError(err error) bool {
+	var serr *sessionStoreError
+	return errors.As(err, &serr)
+}
+
+// saveSession save the login session, trying again `session.save_retries` times if the store fails
+func saveSession(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	var err error
+	for i := 0; i <= cfg.FromContext(r.Context()).Session.SaveRetries; i++ {
+		if err = session.Save(r, w); err == nil || !isSessionStoreError(err) {
+			return err
+		}
+		log.Warnf("saving the login session failed (attempt %d of %d): %s", i+1, cfg.FromContext(r.Context()).Session.SaveRetries+1, err)
+	}
+	return fmt.Errorf("could not save the login session: %w", err)
+}
+
+// newSessionStore the store of the login sessions per `session.backend`
+func (s *state) newSessionStore() sessions.Store {
+	cookies := sessions.NewCookieStore([]byte(cfg.Cfg.Session.Key))
+	cookies.Options.HttpOnly = cfg.Cfg.Cookie.HTTPOnly
+	cookies.Options.Secure = cfg.Cfg.Cookie.Secure
+	cookies.Options.SameSite = cookie.SameSite(context.Background())
+	cookies.Options.MaxAge = loginSessionMaxAge
+	s.sessionPinger = nil
+	s.sessionKV = nil
+	if cfg.Cfg.Session.Backend != cfg.SessionBackendRedis {
+		return cookies
+	}
+
+	opts := redis.Options{
+		Addr:     cfg.Cfg.Session.Redis.Addr,
+		Password: cfg.Cfg.Session.Redis.Password,
+		DB:       cfg.Cfg.Session.Redis.DB,
+		Timeout:  time.Duration(cfg.Cfg.Session.Timeout) * time.Second,
+	}
+	if cfg.Cfg.Session.Redis.TLS {
+		opts.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	client := redis.NewClient(opts)
+	s.sessionPinger = client
+	s.sessionKV = client
+	if err := client.Ping(); err != nil {
+		// the login sessions can't be kept until it's reachable, but /validate doesn't need it
+		log.Errorf("session.backend redis at %s: %s", opts.Addr, err)
+	}
+	return newRedisStore(client, cookies, cfg.Cfg.Session.Redis.KeyPrefix)
+}
+
+// kvStore the commands of Redis used by redisStore and the failureTracker
+type kvStore interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Del(key string) error
+	Incr(key string) (int64, error)
+	PExpire(key string, ttl time.Duration) error
+	PTTL(key string) (time.Duration, error)
+}
+
+// redisStore keeps each login session in Redis under its state nonce, so that any instance can complete the login
+// the session cookie carries only the session's id, encoded with `session.key` by the cookie store
+type redisStore struct {
+	kv      kvStore
+	cookies *sessions.CookieStore
+	prefix  string
+	Options *sessions.Options
+}
+
+func newRedisStore(kv kvStore, cookies *sessions.CookieStore, prefix string) *redisStore {
+	return &redisStore{kv: kv, cookies: cookies, prefix: prefix, Options: cookies.Options}
+}
+
+// Get the session from the registry of the request, loading it at the first Get
+func (s *redisStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New the session named by the cookie, or a new one if there's no cookie
+// a session which has expired from Redis is new, along with errSessionExpired
+func (s *redisStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := s.cookies.New(r, name)
+	if err != nil {
+		return session, err
+	}
+	id, _ := c.Values[redisSessionIDKey].(string)
+	if id == "" {
+		return session, nil
+	}
+	b, err := s.kv.Get(s.prefix + id)
+	if errors.Is(err, redis.ErrNil) {
+		return session, errSessionExpired
+	}
+	if err != nil {
+		return session, &sessionStoreError{err}
+	}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+// Save the session to Redis for the lifetime of the login and set its cookie, or delete both with a negative MaxAge
+func (s *redisStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	// a login session is keyed by its state nonce, which is unique to the login
+	id, _ := session.Values["state"].(string)
+	if id == "" {
+		id = session.ID
+	}
+
+	if session.Options.MaxAge < 0 {
+		if id != "" {
+			if err := s.kv.Del(s.prefix + id); err != nil {
+				return &sessionStoreError{err}
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if id == "" {
+		var err error
+		if id, err = generateSessionID(); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return err
+	}
+	if err := s.kv.Set(s.prefix+id, buf.Bytes(), loginSessionMaxAge*time.Second); err != nil {
+		return &sessionStoreError{err}
+	}
+	session.ID = id
+
+	c := sessions.NewSession(s.cookies, session.Name())
+	c.Values[redisSessionIDKey] = id
+	c.Options = session.Options
+	return s.cookies.Save(r, w, c)
+}
@@ -0,0 +1,234 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/redis"
+)
+
+// fakeKV stands in for Redis
+type fakeKV struct {
+	mu   sync.Mutex
+	data map[string][]byte
+	ttls map[string]time.Duration
+	// failing the error each command (GET, SET, DEL, INCR, PEXPIRE or PTTL) fails with, and calls how often each was tried
+	failing map[string]error
+	calls   map[string]int
+}
+
+func newFakeKV() *fakeKV {
+	return &fakeKV{data: make(map[string][]byte), ttls: make(map[string]time.Duration), failing: make(map[string]error), calls: make(map[string]int)}
+}
+
+func (f *fakeKV) fail(cmd string) error {
+	f.calls[cmd]++
+	return f.failing[cmd]
+}
+
+func (f *fakeKV) Get(key string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail("GET"); err != nil {
+		return nil, err
+	}
+	v, ok := f.data[key]
+	if !ok {
+		return nil, redis.ErrNil
+	}
+	return v, nil
+}
+
+func (f *fakeKV) Set(key string, value []byte, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail("SET"); err != nil {
+		return err
+	}
+	f.data[key] = value
+	f.ttls[key] = ttl
+	return nil
+}
+
+func (f *fakeKV) Del(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail("DEL"); err != nil {
+		return err
+	}
+	delete(f.data, key)
+	delete(f.ttls, key)
+	return nil
+}
+
+func (f *fakeKV) Incr(key string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail("INCR"); err != nil {
+		return 0, err
+	}
+	n, _ := strconv.ParseInt(string(f.data[key]), 10, 64)
+	n++
+	f.data[key] = []byte(strconv.FormatInt(n, 10))
+	return n, nil
+}
+
+func (f *fakeKV) PExpire(key string, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail("PEXPIRE"); err != nil {
+		return err
+	}
+	if _, ok := f.data[key]; !ok {
+		return redis.ErrNil
+	}
+	f.ttls[key] = ttl
+	return nil
+}
+
+func (f *fakeKV) PTTL(key string) (time.Duration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.fail("PTTL"); err != nil {
+		return 0, err
+	}
+	if _, ok := f.data[key]; !ok {
+		return 0, redis.ErrNil
+	}
+	return f.ttls[key], nil
+}
+
+// useRedisStore each call is a Vouch Proxy instance of its own, sharing kv
+func useRedisStore(kv *fakeKV) {
+	cookies := sessions.NewCookieStore([]byte(cfg.Cfg.Session.Key))
+	cookies.Options.MaxAge = loginSessionMaxAge
+	std.sessstore = newRedisStore(kv, cookies, "vouch:session:")
+}
+
+func TestRedisSessionStoreLogin(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	idp := stubIdP(`{"sub":"abc","email":"test@example.com"}`)
+	defer idp.Close()
+	defer func() { std.sessstore = std.newSessionStore() }()
+
+	kv := newFakeKV()
+	useRedisStore(kv)
+	requestedURL := "http://app.example.com/hello"
+	state, cookies := loginForState(t, requestedURL)
+
+	key := "vouch:session:" + state
+	assert.Contains(t, kv.data, key)
+	assert.Equal(t, loginSessionMaxAge*time.Second, kv.ttls[key])
+	for _, c := range cookies {
+		assert.NotContains(t, c.Value, "app.example.com")
+	}
+
+	// the login completes at another instance
+	useRedisStore(kv)
+	rr := authState(t, state, cookies)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, requestedURL, rr.Header().Get("Location"))
+	assert.NotContains(t, kv.data, key, "the session is deleted once used")
+}
+
+func TestRedisSessionStoreExpired(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	defer func() { std.sessstore = std.newSessionStore() }()
+
+	kv := newFakeKV()
+	useRedisStore(kv)
+	state, cookies := loginForState(t, "http://app.example.com/hello")
+	assert.NoError(t, kv.Del("vouch:session:"+state))
+
+	rr := authState(t, state, cookies)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	req := httptest.NewRequest("GET", "/auth/"+state+"/", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	session, err := std.sessstore.New(req, cfg.Cfg.Session.Name)
+	assert.Equal(t, errSessionExpired, err)
+	assert.True(t, session.IsNew)
+}
+
+func TestRedisSessionStoreFailing(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	idp := stubIdP(`{"sub":"abc","email":"test@example.com"}`)
+	defer idp.Close()
+	defer func() { std.sessstore = std.newSessionStore() }()
+	errDown := errors.New("dial tcp 10.0.0.1:6379: i/o timeout")
+
+	tests := []struct {
+		name      string
+		failing   string
+		wantCalls int
+	}{
+		// the login session can't be loaded at the callback
+		{"get", "GET", 1},
+		// nor deleted once the login is complete, which is tried again per session.save_retries
+		{"del", "DEL", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := newFakeKV()
+			useRedisStore(kv)
+			state, cookies := loginForState(t, "http://app.example.com/hello")
+
+			kv.failing[tt.failing] = errDown
+			rr := authState(t, state, cookies)
+			assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+			assert.Equal(t, reasonSessionStore, rr.Header().Get(cfg.Cfg.Headers.Error))
+			assert.Equal(t, tt.wantCalls, kv.calls[tt.failing])
+			for _, c := range rr.Result().Cookies() {
+				assert.NotEqual(t, cfg.Cfg.Cookie.Name, c.Name, "no jwt is issued")
+			}
+		})
+	}
+
+	// nor saved at /login
+	kv := newFakeKV()
+	useRedisStore(kv)
+	kv.failing["SET"] = errDown
+	req := httptest.NewRequest("GET", "/login?url=http://app.example.com/hello", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(LoginHandler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, reasonSessionStore, rr.Header().Get(cfg.Cfg.Headers.Error))
+	assert.Equal(t, 2, kv.calls["SET"])
+
+	kv.failing["SET"] = nil
+	state, _ := loginForState(t, "http://app.example.com/hello")
+	assert.NotEmpty(t, state, "the login succeeds once the store is back")
+}
+
+func TestNewSessionStore(t *testing.T) {
+	setUp("/config/testing/handler_oidc.yml")
+	_, ok := std.newSessionStore().(*sessions.CookieStore)
+	assert.True(t, ok, "the cookie store by default")
+
+	cfg.Cfg.Session.Backend = cfg.SessionBackendRedis
+	cfg.Cfg.Session.Redis.Addr = "127.0.0.1:1"
+	defer func() { cfg.Cfg.Session.Backend = cfg.SessionBackendCookie }()
+	_, ok = std.newSessionStore().(*redisStore)
+	assert.True(t, ok)
+}
@@ -0,0 +1,64 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"hash/fnv"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// shardedCache spreads its keys over several caches, each with its own lock, so that
+// concurrent logins don't all wait on one mutex, see `session.store_shards`
+type shardedCache struct {
+	shards []*cache.Cache
+}
+
+func newShardedCache(shards int, defaultExpiration, cleanupInterval time.Duration) *shardedCache {
+	if shards < 1 {
+		shards = 1
+	}
+	c := &shardedCache{shards: make([]*cache.Cache, shards)}
+	for i := range c.shards {
+		c.shards[i] = cache.New(defaultExpiration, cleanupInterval)
+	}
+	return c
+}
+
+// shard the cache holding key
+func (c *shardedCache) shard(key string) *cache.Cache {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+// Add key only if it isn't already held, see cache.Add
+func (c *shardedCache) Add(key string, x interface{}, d time.Duration) error {
+	return c.shard(key).Add(key, x, d)
+}
+
+// Get see cache.Get
+func (c *shardedCache) Get(key string) (interface{}, bool) {
+	return c.shard(key).Get(key)
+}
+
+// ItemCount across all of the shards
+func (c *shardedCache) ItemCount() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.ItemCount()
+	}
+	return n
+}
@@ -0,0 +1,79 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardedCache(t *testing.T) {
+	for _, shards := range []int{0, 1, 16} {
+		t.Run(fmt.Sprint(shards), func(t *testing.T) {
+			c := newShardedCache(shards, time.Minute, time.Minute)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 1000; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					assert.NoError(t, c.Add(fmt.Sprintf("session-%d", i), true, time.Minute))
+				}(i)
+			}
+			wg.Wait()
+			assert.Equal(t, 1000, c.ItemCount())
+
+			// each key is added only once, whichever shard holds it
+			assert.Error(t, c.Add("session-42", true, time.Minute))
+			_, found := c.Get("session-42")
+			assert.True(t, found)
+			_, found = c.Get("session-1000")
+			assert.False(t, found)
+		})
+	}
+}
+
+func TestShardedCacheSpreadsKeys(t *testing.T) {
+	c := newShardedCache(16, time.Minute, time.Minute)
+	for i := 0; i < 1600; i++ {
+		_ = c.Add(fmt.Sprintf("session-%d", i), true, time.Minute)
+	}
+	for i, s := range c.shards {
+		assert.NotZero(t, s.ItemCount(), "shard %d", i)
+	}
+}
+
+// BenchmarkShardedCacheAdd login sessions being used concurrently, as at /auth/{state}/
+// compare the shards on a machine with several cores with
+// go test ./handlers -run XXX -bench ShardedCache -cpu 1,4,16
+func BenchmarkShardedCacheAdd(b *testing.B) {
+	for _, shards := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			c := newShardedCache(shards, time.Minute, time.Minute)
+			var goroutines int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				prefix := strconv.FormatInt(atomic.AddInt64(&goroutines, 1), 10) + "-"
+				for i := 0; pb.Next(); i++ {
+					if err := c.Add(prefix+strconv.Itoa(i), true, time.Minute); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,156 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+)
+
+// stateKeyInfo binds the key signing the state to its use, see jwtmanager.DeriveKey()
+const stateKeyInfo = "vouch-proxy stateless state HMAC-SHA256"
+
+var (
+	errStateInvalid = errors.New("the state is not one issued by /login")
+	errStateExpired = errors.New("the login took too long, the state has expired")
+	errStateUsed    = errors.New("the state has already been used")
+	errStateBrowser = errors.New("the state was issued by /login to another browser")
+)
+
+// loginState what /login passes on to /auth/{state}/, kept in the session or with `vouch.stateless_state` signed into the state itself
+type loginState struct {
+	Nonce        string `json:"n"`
+	RequestedURL string `json:"u,omitempty"`
+	// Provider the name of the provider chosen at /login
+	Provider string `json:"p,omitempty"`
+	// RedirectURL the callback_url the code was issued for, which the token exchange must use
+	RedirectURL string `json:"r,omitempty"`
+	// IDTokenNonce the nonce sent with the authorization request, see oauthConfig.NonceCheck()
+	IDTokenNonce string `json:"i,omitempty"`
+	Expires      int64  `json:"e"`
+	// the PKCE pair is only ever kept in the session, the state is seen by the IdP and the browser
+	CodeChallenge string `json:"-"`
+	CodeVerifier  string `json:"-"`
+}
+
+// signLoginState the state carrying ls, which expires along with a login session
+func signLoginState(ctx context.Context, ls loginState) (string, error) {
+	ls.Expires = time.Now().Add(loginSessionMaxAge * time.Second).Unix()
+	payload, err := json.Marshal(ls)
+	if err != nil {
+		return "", err
+	}
+	p := base64.RawURLEncoding.EncodeToString(payload)
+	return p + "." + base64.RawURLEncoding.EncodeToString(stateMAC(ctx, p)), nil
+}
+
+// stateCookieName the cookie binding a stateless state to the browser it was issued to, see setStateCookie
+func stateCookieName(ctx context.Context) string {
+	return cfg.FromContext(ctx).Session.Name + "_state"
+}
+
+// setStateCookie with nothing saved in the session, a state lured into another browser would log that browser in
+// as whoever completes the login at the IdP, so /login leaves a hash of the state's nonce with the browser
+// it's only sent to /auth/{state}/ and lives as long as the state does
+func setStateCookie(w http.ResponseWriter, r *http.Request, state string, nonce string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookieName(r.Context()),
+		Value:    stateBinding(nonce),
+		Path:     authStateCookiePath(state),
+		MaxAge:   loginSessionMaxAge,
+		HttpOnly: cfg.FromContext(r.Context()).Cookie.HTTPOnly,
+		Secure:   cfg.FromContext(r.Context()).Cookie.Secure,
+		SameSite: cookie.SameSite(r.Context()),
+	})
+}
+
+// clearStateCookie the state has been used, see setStateCookie
+func clearStateCookie(w http.ResponseWriter, r *http.Request, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookieName(r.Context()),
+		Path:     authStateCookiePath(state),
+		MaxAge:   -1,
+		HttpOnly: cfg.FromContext(r.Context()).Cookie.HTTPOnly,
+		Secure:   cfg.FromContext(r.Context()).Cookie.Secure,
+		SameSite: cookie.SameSite(r.Context()),
+	})
+}
+
+// stateCookieValue the binding sent back to /auth/{state}/ by the browser, if any
+func stateCookieValue(r *http.Request) string {
+	c, err := r.Cookie(stateCookieName(r.Context()))
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+func stateBinding(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// parseLoginState the loginState of a state signed by signLoginState, binding the value of the browser's state cookie
+// each state is accepted once, only from the browser it was issued to, and only if its requested url is one /login would have accepted
+func parseLoginState(ctx context.Context, state string, binding string) (*loginState, error) {
+	parts := strings.Split(state, ".")
+	if len(parts) != 2 {
+		return nil, errStateInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, stateMAC(ctx, parts[0])) {
+		return nil, errStateInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errStateInvalid
+	}
+	ls := &loginState{}
+	if err := json.Unmarshal(payload, ls); err != nil || ls.Nonce == "" {
+		return nil, errStateInvalid
+	}
+	if time.Now().Unix() > ls.Expires {
+		return nil, errStateExpired
+	}
+	// which also binds the id_token nonce the state carries to the browser
+	if subtle.ConstantTimeCompare([]byte(binding), []byte(stateBinding(ls.Nonce))) != 1 {
+		return nil, errStateBrowser
+	}
+	// the key signs nothing but states, but guard against an open redirect should it ever be compromised
+	if ls.RequestedURL != "" {
+		if err := checkRequestedURL(ctx, ls.RequestedURL); err != nil {
+			return nil, fmt.Errorf("%w: %s", errStateInvalid, err)
+		}
+	}
+	if err := stateOf(ctx).usedSessions.Add(ls.Nonce, true, loginSessionMaxAge*time.Second); err != nil {
+		return nil, errStateUsed
+	}
+	return ls, nil
+}
+
+func stateMAC(ctx context.Context, payload string) []byte {
+	mac := hmac.New(sha256.New, jwtmanager.DeriveKey(ctx, stateKeyInfo))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
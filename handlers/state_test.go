@@ -0,0 +1,82 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLoginState(t *testing.T) {
+	setUp("/config/testing/handler_stateless_state.yml")
+
+	sign := func(ls loginState) string {
+		state, err := signLoginState(context.Background(), ls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+	// resign a state with a payload of its own, as though the key were known
+	forge := func(ls loginState) string {
+		payload, _ := json.Marshal(ls)
+		p := base64.RawURLEncoding.EncodeToString(payload)
+		return p + "." + base64.RawURLEncoding.EncodeToString(stateMAC(context.Background(), p))
+	}
+
+	valid := sign(loginState{Nonce: "valid", RequestedURL: "http://app.example.com/hello", Provider: "oidc"})
+	parts := strings.Split(sign(loginState{Nonce: "tampered", RequestedURL: "http://app.example.com/hello"}), ".")
+	evil, _ := json.Marshal(loginState{Nonce: "tampered", RequestedURL: "http://evil.example.org/", Expires: time.Now().Add(time.Minute).Unix()})
+	tampered := base64.RawURLEncoding.EncodeToString(evil) + "." + parts[1]
+
+	tests := []struct {
+		name    string
+		state   string
+		nonce   string
+		wantErr error
+	}{
+		// the state cookie is left by /login with the browser the state was issued to
+		{"another browser", valid, "other", errStateBrowser},
+		{"no state cookie", valid, "", errStateBrowser},
+		{"valid", valid, "valid", nil},
+		{"used", valid, "valid", errStateUsed},
+		{"tampered", tampered, "tampered", errStateInvalid},
+		{"not signed", "abcdef", "", errStateInvalid},
+		{"bad mac", parts[0] + ".AAAA", "tampered", errStateInvalid},
+		{"expired", forge(loginState{Nonce: "expired", Expires: time.Now().Add(-time.Second).Unix()}), "expired", errStateExpired},
+		{"another domain", forge(loginState{Nonce: "open", RequestedURL: "http://evil.example.org/", Expires: time.Now().Add(time.Minute).Unix()}), "open", errStateInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			binding := ""
+			if tt.nonce != "" {
+				binding = stateBinding(tt.nonce)
+			}
+			ls, err := parseLoginState(context.Background(), tt.state, binding)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), "parseLoginState() error = %v, want %v", err, tt.wantErr)
+				assert.Nil(t, ls)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "valid", ls.Nonce)
+			assert.Equal(t, "http://app.example.com/hello", ls.RequestedURL)
+			assert.Equal(t, "oidc", ls.Provider)
+		})
+	}
+}
@@ -0,0 +1,437 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/redis"
+	"github.com/vouch/vouch-proxy/pkg/responses"
+)
+
+const (
+	// stepUpPath where the user confirms with a passkey before reaching a host of `vouch.step_up_hosts`
+	stepUpPath = "/stepup"
+	// stepUpEnrolPath where an admin of `vouch.step_up_admin_teams` gets the link with which a user enrols a passkey
+	stepUpEnrolPath = "/stepup/enrol"
+	// stepUpEnrolTTL how long the link may be used, once
+	stepUpEnrolTTL = 24 * time.Hour
+
+	// passkeysKeyPrefix and stepUpEnrolKeyPrefix follow `session.redis.key_prefix` in the keys of each user's
+	// passkeys and of each enrolment link
+	passkeysKeyPrefix    = "passkeys:"
+	stepUpEnrolKeyPrefix = "stepup:enrol:"
+)
+
+var (
+	errStepUpRequired = errors.New("the host requires the user to confirm with a passkey at " + stepUpPath)
+	errStepUpSession  = errors.New("the step-up session has expired, please try again")
+	errNoPasskey      = errors.New("the passkey is not one registered for the user")
+	errNotEnrolled    = errors.New("no passkey is enrolled for the user, ask an admin for a link to enrol one")
+	errStepUpEnrol    = errors.New("the link to enrol a passkey is unknown, used, expired or for another user")
+	errNotStepUpAdmin = errors.New("enrolling a user's passkey requires membership of one of step_up_admin_teams")
+	errStepUpBackend  = errors.New("passkeys are kept in session.backend redis, which is not configured")
+)
+
+// StepUpHandler /stepup
+// GET renders the page which asks the browser for a passkey, POST verifies it and reissues the jwt marked as stepped up
+// a passkey is only registered with the link an admin got for the user at /stepup/enrol, a user without one is refused
+func StepUpHandler(w http.ResponseWriter, r *http.Request) {
+	jwt := jwtmanager.FindJWT(r)
+	claims, err := jwtmanager.ClaimsFromJWT(r.Context(), jwt)
+	if err == nil {
+		err = checkClaims(r.Context(), claims)
+	}
+	if jwt == "" || err != nil {
+		// log in first, /auth/{state}/ sends the user back here
+		responses.Redirect302(w, r, "/login?url="+url.QueryEscape(r.URL.Query().Get("url")))
+		return
+	}
+	if r.Method == http.MethodPost {
+		verifyStepUp(w, r, claims)
+		return
+	}
+
+	token := r.URL.Query().Get("enrol")
+	requestedURL, err := getValidRequestedURL(r)
+	// the link to enrol a passkey goes to /stepup alone
+	if err != nil && !(token != "" && errors.Is(err, errNoURL)) {
+		responses.Error400(w, r, fmt.Errorf("%s %w", stepUpPath, err))
+		return
+	}
+	creds, err := stateOf(r.Context()).passkeys.credentials(r.Context(), claims.Username)
+	if err != nil {
+		responses.Error503(w, r, reasonSessionStore, 0, fmt.Errorf("%s %w", stepUpPath, err))
+		return
+	}
+	var enrolment string
+	if token != "" {
+		enrolment = stepUpEnrolHash(token)
+		if err := stateOf(r.Context()).passkeys.checkEnrolment(r.Context(), enrolment, claims.Username); err != nil {
+			audit.Log(r, audit.Login, claims.Username, audit.Failure, "step-up: "+err.Error())
+			responses.Error403KeepCookie(w, r, errStepUpEnrol.Error(), fmt.Errorf("%s %s: %w", stepUpPath, claims.Username, err))
+			return
+		}
+	} else if len(creds) == 0 {
+		responses.Error403KeepCookie(w, r, errNotEnrolled.Error(), fmt.Errorf("%s %s: %w", stepUpPath, claims.Username, errNotEnrolled))
+		return
+	}
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		responses.Error500(w, r, fmt.Errorf("%s %w", stepUpPath, err))
+		return
+	}
+	options := responses.StepUpOptions{
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		RPID:      stepUpRPID(r),
+		UserID:    stepUpUserID(claims.Username),
+		Username:  claims.Username,
+		Register:  enrolment != "",
+	}
+	for _, c := range creds {
+		options.CredentialIDs = append(options.CredentialIDs, c.ID)
+	}
+
+	// the challenge is kept in a session of its own, as the state is for /auth/{state}/
+	session, err := stateOf(r.Context()).sessstore.Get(r, cfg.FromContext(r.Context()).Session.Name)
+	if err != nil {
+		log.Infof("couldn't find existing encrypted secure cookie with name %s: %s (probably fine)", cfg.FromContext(r.Context()).Session.Name, err)
+	}
+	session.Values["stepUpChallenge"] = options.Challenge
+	session.Values["stepUpUser"] = claims.Username
+	session.Values["stepUpEnrolment"] = enrolment
+	session.Values["requestedURL"] = requestedURL
+	session.Options.Path = stepUpPath
+	session.Options.MaxAge = loginSessionMaxAge
+	if err := saveSession(r, w, session); err != nil {
+		responses.Error503(w, r, reasonSessionStore, 0, fmt.Errorf("%s %w", stepUpPath, err))
+		return
+	}
+	responses.RenderStepUp(w, r, options)
+}
+
+// verifyStepUp the passkey the browser answered the challenge of the step-up session with
+func verifyStepUp(w http.ResponseWriter, r *http.Request, claims *jwtmanager.VouchClaims) {
+	session, err := stateOf(r.Context()).sessstore.Get(r, cfg.FromContext(r.Context()).Session.Name)
+	challenge, _ := session.Values["stepUpChallenge"].(string)
+	if err != nil || challenge == "" || session.Values["stepUpUser"] != claims.Username {
+		responses.Error400(w, r, fmt.Errorf("%s %w", stepUpPath, errStepUpSession))
+		return
+	}
+	enrolment, _ := session.Values["stepUpEnrolment"].(string)
+	requestedURL, _ := session.Values["requestedURL"].(string)
+	// each challenge is answered once, the cookie of a session kept in the cookie itself could be sent again
+	session.Options.Path = stepUpPath
+	session.Options.MaxAge = -1
+	if err := saveSession(r, w, session); err != nil {
+		responses.Error503(w, r, reasonSessionStore, 0, fmt.Errorf("%s %w", stepUpPath, err))
+		return
+	}
+	if err := stateOf(r.Context()).usedSessions.Add(challenge, true, loginSessionMaxAge*time.Second); err != nil {
+		responses.Error400(w, r, fmt.Errorf("%s %w", stepUpPath, errStepUpSession))
+		return
+	}
+
+	if err := checkPasskey(r, claims.Username, challenge, enrolment); err != nil {
+		audit.Log(r, audit.Login, claims.Username, audit.Failure, "step-up: "+err.Error())
+		responses.Error403KeepCookie(w, r, errWebAuthn.Error(), fmt.Errorf("%s %s: %w", stepUpPath, claims.Username, err))
+		return
+	}
+
+	claims.StepUp = time.Now().Unix()
+	tokenstring, err := jwtmanager.ReissueVPJWT(r.Context(), *claims)
+	if err != nil {
+		responses.Error500(w, r, fmt.Errorf("%s Token creation failure: %w", stepUpPath, err))
+		return
+	}
+	cookie.SetCookie(w, r, tokenstring, claims.CustomClaims)
+	audit.Log(r, audit.Login, claims.Username, audit.Success, "step-up")
+	if requestedURL != "" {
+		responses.Redirect302(w, r, requestedURL)
+		return
+	}
+	responses.RenderIndex(w, r, stepUpPath+" confirmed "+claims.Username)
+}
+
+// checkPasskey the assertion (or with the enrolment the new passkey) posted to /stepup for challenge
+func checkPasskey(r *http.Request, username string, challenge string, enrolment string) error {
+	id, err := base64.RawURLEncoding.DecodeString(r.PostFormValue("id"))
+	if err != nil {
+		return fmt.Errorf("%w: %s", errWebAuthn, err)
+	}
+	clientData, err := base64.RawURLEncoding.DecodeString(r.PostFormValue("client_data"))
+	if err != nil {
+		return fmt.Errorf("%w: %s", errWebAuthn, err)
+	}
+	authData, err := base64.RawURLEncoding.DecodeString(r.PostFormValue("authenticator_data"))
+	if err != nil {
+		return fmt.Errorf("%w: %s", errWebAuthn, err)
+	}
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return err
+	}
+	if err := ad.check(stepUpRPID(r)); err != nil {
+		return err
+	}
+	origin := forwarded.Scheme(r) + "://" + forwarded.Host(r)
+	credID := base64.RawURLEncoding.EncodeToString(id)
+
+	if enrolment != "" {
+		if err := checkClientData(clientData, webauthnCreate, challenge, origin); err != nil {
+			return err
+		}
+		publicKey, err := base64.RawURLEncoding.DecodeString(r.PostFormValue("public_key"))
+		if err != nil {
+			return fmt.Errorf("%w: %s", errWebAuthn, err)
+		}
+		if err := checkRegistration(ad, id, publicKey); err != nil {
+			return err
+		}
+		// the link is used once, even if two browsers were given it
+		if err := stateOf(r.Context()).passkeys.useEnrolment(r.Context(), enrolment, username); err != nil {
+			return err
+		}
+		return stateOf(r.Context()).passkeys.update(r.Context(), username, func(creds []webauthnCredential) ([]webauthnCredential, error) {
+			for _, c := range creds {
+				if c.ID == credID {
+					return nil, fmt.Errorf("%w: the passkey is already registered", errWebAuthn)
+				}
+			}
+			return append(creds, webauthnCredential{ID: credID, PublicKey: publicKey, SignCount: ad.signCount}), nil
+		})
+	}
+
+	if err := checkClientData(clientData, webauthnGet, challenge, origin); err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(r.PostFormValue("signature"))
+	if err != nil {
+		return fmt.Errorf("%w: %s", errWebAuthn, err)
+	}
+	return stateOf(r.Context()).passkeys.update(r.Context(), username, func(creds []webauthnCredential) ([]webauthnCredential, error) {
+		for i := range creds {
+			if creds[i].ID != credID {
+				continue
+			}
+			if err := verifyAssertion(creds[i].PublicKey, authData, clientData, sig); err != nil {
+				return nil, err
+			}
+			if err := checkSignCount(creds[i].SignCount, ad.signCount); err != nil {
+				return nil, err
+			}
+			creds[i].SignCount = ad.signCount
+			return creds, nil
+		}
+		return nil, errNoPasskey
+	})
+}
+
+// stepUpRPID the WebAuthn relying party, `cookie.domain` if it's set so that a passkey serves each host of the domain
+// otherwise the host at which Vouch Proxy is reached
+func stepUpRPID(r *http.Request) string {
+	if cfg.FromContext(r.Context()).Cookie.Domain != "" {
+		return strings.TrimPrefix(cfg.FromContext(r.Context()).Cookie.Domain, ".")
+	}
+	return strings.Split(forwarded.Host(r), ":")[0]
+}
+
+// stepUpUserID the WebAuthn user handle, which should not reveal who the user is
+func stepUpUserID(username string) string {
+	h := sha256.Sum256([]byte(username))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// StepUpEnrolHandler /stepup/enrol?user=<username>
+// an admin, a member of one of `vouch.step_up_admin_teams`, POSTs to get the link with which the user enrols a passkey
+// the link is given to the user out of band, and can be used once within stepUpEnrolTTL by that user once logged in
+func StepUpEnrolHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	username := r.URL.Query().Get("user")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "enrolling a user's passkey requires a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if username == "" {
+		responses.Error400(w, r, fmt.Errorf("%s requires ?user=", stepUpEnrolPath))
+		return
+	}
+	if !revokeNotForged(r) {
+		responses.Error403KeepCookie(w, r, errRevokeOrigin.Error(), fmt.Errorf("%s?user=%s %w", stepUpEnrolPath, username, errRevokeOrigin))
+		return
+	}
+	claims, err := jwtmanager.ClaimsFromJWT(r.Context(), jwtmanager.FindJWT(r))
+	if err == nil {
+		err = checkClaims(r.Context(), claims)
+	}
+	if err != nil || claims.Username == "" {
+		responses.Error401HTTP(w, r, fmt.Errorf("%s?user=%s requires the jwt of an admin: %v", stepUpEnrolPath, username, err))
+		return
+	}
+	if _, ok := inTeamWhiteList(r.Context(), claims.Teams, cfg.FromContext(r.Context()).StepUpAdminTeams); !ok {
+		audit.Log(r, audit.Login, claims.Username, audit.Failure, "not allowed to enrol a passkey for "+username)
+		responses.Error403KeepCookie(w, r, errNotStepUpAdmin.Error(), fmt.Errorf("%s?user=%s %s: %w", stepUpEnrolPath, username, claims.Username, errNotStepUpAdmin))
+		return
+	}
+
+	token, err := stateOf(r.Context()).passkeys.enrol(r.Context(), username)
+	if err != nil {
+		responses.Error503(w, r, reasonSessionStore, 0, fmt.Errorf("%s?user=%s %w", stepUpEnrolPath, username, err))
+		return
+	}
+	audit.Log(r, audit.Login, claims.Username, audit.Success, "issued a link to enrol a passkey for "+username)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		User      string `json:"user"`
+		URL       string `json:"url"`
+		ExpiresAt int64  `json:"expires_at"`
+	}{username, forwarded.Scheme(r) + "://" + forwarded.Host(r) + stepUpPath + "?enrol=" + token, time.Now().Add(stepUpEnrolTTL).Unix()}); err != nil {
+		log.Error(err)
+	}
+}
+
+// stepUpEnrolHash the enrolment link's token as it's kept, so that reading Redis doesn't give away usable links
+func stepUpEnrolHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// passkeyStore the passkeys registered by each user, kept as json in the Redis of `session.backend`
+// so that every instance of Vouch Proxy asks for the same passkeys
+type passkeyStore struct {
+	// mu orders the updates of this instance, between instances the last update of a user's passkeys wins
+	mu sync.Mutex
+}
+
+func (s *passkeyStore) kv(ctx context.Context) (kvStore, error) {
+	if stateOf(ctx).sessionKV == nil {
+		return nil, errStepUpBackend
+	}
+	return stateOf(ctx).sessionKV, nil
+}
+
+func (s *passkeyStore) key(ctx context.Context, username string) string {
+	return cfg.FromContext(ctx).Session.Redis.KeyPrefix + passkeysKeyPrefix + username
+}
+
+func (s *passkeyStore) credentials(ctx context.Context, username string) ([]webauthnCredential, error) {
+	kv, err := s.kv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b, err := kv.Get(s.key(ctx, username))
+	if errors.Is(err, redis.ErrNil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var creds []webauthnCredential
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return nil, fmt.Errorf("the passkeys of %s: %w", username, err)
+	}
+	return creds, nil
+}
+
+// update replace the user's passkeys with those returned by fn, they're left as they are if fn returns an error
+func (s *passkeyStore) update(ctx context.Context, username string, fn func([]webauthnCredential) ([]webauthnCredential, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kv, err := s.kv(ctx)
+	if err != nil {
+		return err
+	}
+	creds, err := s.credentials(ctx, username)
+	if err != nil {
+		return err
+	}
+	if creds, err = fn(creds); err != nil {
+		return err
+	}
+	b, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	return kv.Set(s.key(ctx, username), b, 0)
+}
+
+// enrol a token for the link with which the user registers a passkey
+func (s *passkeyStore) enrol(ctx context.Context, username string) (string, error) {
+	kv, err := s.kv(ctx)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if err := kv.Set(cfg.FromContext(ctx).Session.Redis.KeyPrefix+stepUpEnrolKeyPrefix+stepUpEnrolHash(token), []byte(username), stepUpEnrolTTL); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// checkEnrolment the enrolment, by the hash of its token, is for the user and hasn't been used
+func (s *passkeyStore) checkEnrolment(ctx context.Context, enrolment string, username string) error {
+	kv, err := s.kv(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := kv.Get(cfg.FromContext(ctx).Session.Redis.KeyPrefix + stepUpEnrolKeyPrefix + enrolment)
+	if errors.Is(err, redis.ErrNil) || (err == nil && string(b) != username) {
+		return errStepUpEnrol
+	}
+	return err
+}
+
+// useEnrolment check the enrolment and claim it, the INCR of its key succeeds for one request alone
+func (s *passkeyStore) useEnrolment(ctx context.Context, enrolment string, username string) error {
+	if err := s.checkEnrolment(ctx, enrolment, username); err != nil {
+		return err
+	}
+	kv, err := s.kv(ctx)
+	if err != nil {
+		return err
+	}
+	key := cfg.FromContext(ctx).Session.Redis.KeyPrefix + stepUpEnrolKeyPrefix + enrolment
+	n, err := kv.Incr(key + ":used")
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return errStepUpEnrol
+	}
+	if err := kv.PExpire(key+":used", stepUpEnrolTTL); err != nil {
+		log.Warnf("step-up: could not expire the used enrolment of %s: %s", username, err)
+	}
+	if err := kv.Del(key); err != nil {
+		log.Warnf("step-up: could not remove the used enrolment of %s: %s", username, err)
+	}
+	return nil
+}
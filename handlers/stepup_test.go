@@ -0,0 +1,338 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+const (
+	stepUpRequestedURL = "http://admin.example.com/settings"
+	stepUpOrigin       = "http://vouch.example.com"
+)
+
+func setUpStepUp(t *testing.T) string {
+	setUp("/config/testing/handler_stepup.yml")
+	std.sessionKV = newFakeKV()
+	t.Cleanup(func() { std.sessionKV = nil })
+	user := structs.User{Username: "testuser", Email: "test@example.com"}
+	vpjwt, err := jwtmanager.NewVPJWT(context.Background(), user, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+	return vpjwt
+}
+
+func stepUpRequest(t *testing.T, method string, vpjwt string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	return stepUpRequestEnrol(t, method, vpjwt, "", form, cookies)
+}
+
+// stepUpRequestEnrol with the token of the link to enrol a passkey, if not ""
+func stepUpRequestEnrol(t *testing.T, method string, vpjwt string, enrol string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	// the url is the last parameter, see normalizeLoginURLParam
+	target := stepUpPath + "?url=" + url.QueryEscape(stepUpRequestedURL)
+	if enrol != "" {
+		target = stepUpPath + "?enrol=" + url.QueryEscape(enrol) + "&url=" + url.QueryEscape(stepUpRequestedURL)
+	}
+	req, err := http.NewRequest(method, target, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "vouch.example.com"
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if vpjwt != "" {
+		req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(StepUpHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+var stepUpChallengeRe = regexp.MustCompile(`"challenge":"([^"]+)"`)
+
+// stepUpChallenge GET /stepup, the challenge on the page and the cookies of its session
+func stepUpChallenge(t *testing.T, vpjwt string) (string, []*http.Cookie) {
+	return stepUpEnrolChallenge(t, vpjwt, "")
+}
+
+// stepUpEnrolChallenge GET /stepup with the link to enrol a passkey
+func stepUpEnrolChallenge(t *testing.T, vpjwt string, enrol string) (string, []*http.Cookie) {
+	rr := stepUpRequestEnrol(t, http.MethodGet, vpjwt, enrol, nil, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("StepUpHandler() status = %v, want %v", rr.Code, http.StatusOK)
+	}
+	m := stepUpChallengeRe.FindStringSubmatch(rr.Body.String())
+	if m == nil {
+		t.Fatalf("no challenge in %s", rr.Body.String())
+	}
+	return m[1], rr.Result().Cookies()
+}
+
+// enrolPasskey register a's passkey for testuser with a link from an admin
+func enrolPasskey(t *testing.T, vpjwt string, a *testAuthenticator) {
+	token, err := std.passkeys.enrol(context.Background(), "testuser")
+	assert.NoError(t, err)
+	challenge, cookies := stepUpEnrolChallenge(t, vpjwt, token)
+	assert.Equal(t, http.StatusFound, stepUpRequest(t, http.MethodPost, vpjwt, a.register(challenge, stepUpOrigin), cookies).Code)
+}
+
+// register the form the browser posts for a new passkey
+func (a *testAuthenticator) register(challenge string, origin string) url.Values {
+	authData := a.authData("vouch.example.com", flagUserPresent, true)
+	return url.Values{
+		"id":                 {base64.RawURLEncoding.EncodeToString(a.id)},
+		"client_data":        {base64.RawURLEncoding.EncodeToString(clientDataJSON(a.t, webauthnCreate, challenge, origin))},
+		"authenticator_data": {base64.RawURLEncoding.EncodeToString(authData)},
+		"public_key":         {base64.RawURLEncoding.EncodeToString(a.publicKey())},
+	}
+}
+
+// assert the form the browser posts when asked for the passkey
+func (a *testAuthenticator) assert(challenge string, origin string) url.Values {
+	a.signCount++
+	authData := a.authData("vouch.example.com", flagUserPresent, false)
+	clientData := clientDataJSON(a.t, webauthnGet, challenge, origin)
+	return url.Values{
+		"id":                 {base64.RawURLEncoding.EncodeToString(a.id)},
+		"client_data":        {base64.RawURLEncoding.EncodeToString(clientData)},
+		"authenticator_data": {base64.RawURLEncoding.EncodeToString(authData)},
+		"signature":          {base64.RawURLEncoding.EncodeToString(a.sign(authData, clientData))},
+	}
+}
+
+func validateStepUpHost(t *testing.T, vpjwt string, host string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "/validate", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(ValidateRequestHandler).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestValidateRequestHandlerStepUp(t *testing.T) {
+	vpjwt := setUpStepUp(t)
+
+	assert.Equal(t, http.StatusOK, validateStepUpHost(t, vpjwt, "app.example.com").Code)
+	assert.Equal(t, http.StatusUnauthorized, validateStepUpHost(t, vpjwt, "admin.example.com").Code)
+	assert.Equal(t, http.StatusUnauthorized, validateStepUpHost(t, vpjwt, "db.admin.example.com").Code)
+
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), vpjwt)
+	assert.NoError(t, err)
+	claims.StepUp = time.Now().Unix()
+	steppedUp, err := jwtmanager.ReissueVPJWT(context.Background(), *claims)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, validateStepUpHost(t, steppedUp, "admin.example.com").Code)
+}
+
+func TestStepUpHandler(t *testing.T) {
+	vpjwt := setUpStepUp(t)
+	a := newTestAuthenticator(t)
+
+	// the user registers a passkey with the link from an admin
+	token, err := std.passkeys.enrol(context.Background(), "testuser")
+	assert.NoError(t, err)
+	challenge, cookies := stepUpEnrolChallenge(t, vpjwt, token)
+	rr := stepUpRequest(t, http.MethodPost, vpjwt, a.register(challenge, stepUpOrigin), cookies)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, stepUpRequestedURL, rr.Header().Get("Location"))
+	steppedUp := reissuedJWT(rr)
+	assert.Equal(t, http.StatusOK, validateStepUpHost(t, steppedUp, "admin.example.com").Code)
+
+	// kept in redis, for every instance
+	creds, err := std.passkeys.credentials(context.Background(), "testuser")
+	assert.NoError(t, err)
+	assert.Len(t, creds, 1)
+	assert.Contains(t, std.sessionKV.(*fakeKV).data, cfg.Cfg.Session.Redis.KeyPrefix+passkeysKeyPrefix+"testuser")
+
+	// and is asked for it afterwards
+	challenge, cookies = stepUpChallenge(t, vpjwt)
+	rr = stepUpRequest(t, http.MethodPost, vpjwt, a.assert(challenge, stepUpOrigin), cookies)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	claims, err := jwtmanager.ClaimsFromJWT(context.Background(), reissuedJWT(rr))
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Now().Unix(), claims.StepUp, 5)
+	assert.Equal(t, "testuser", claims.Username)
+
+	// each challenge is answered once
+	rr = stepUpRequest(t, http.MethodPost, vpjwt, a.assert(challenge, stepUpOrigin), cookies)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// a second link adds a second passkey
+	other := newTestAuthenticator(t)
+	other.id = []byte("credential-2")
+	enrolPasskey(t, vpjwt, other)
+	creds, err = std.passkeys.credentials(context.Background(), "testuser")
+	assert.NoError(t, err)
+	assert.Len(t, creds, 2)
+}
+
+func TestStepUpHandlerNotEnrolled(t *testing.T) {
+	vpjwt := setUpStepUp(t)
+	a := newTestAuthenticator(t)
+
+	// no passkey is registered at the user's first visit
+	rr := stepUpRequest(t, http.MethodGet, vpjwt, nil, nil)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, errNotEnrolled.Error(), rr.Header().Get(cfg.Cfg.Headers.Error))
+
+	theirs, err := std.passkeys.enrol(context.Background(), "someoneelse")
+	assert.NoError(t, err)
+	for name, token := range map[string]string{"unknown link": "bm90IGEgbGluaw", "another user's link": theirs} {
+		rr = stepUpRequestEnrol(t, http.MethodGet, vpjwt, token, nil, nil)
+		assert.Equal(t, http.StatusForbidden, rr.Code, name)
+		assert.Equal(t, errStepUpEnrol.Error(), rr.Header().Get(cfg.Cfg.Headers.Error), name)
+	}
+
+	// a link is used once, even by two pages opened with it
+	token, err := std.passkeys.enrol(context.Background(), "testuser")
+	assert.NoError(t, err)
+	challenge, cookies := stepUpEnrolChallenge(t, vpjwt, token)
+	challenge2, cookies2 := stepUpEnrolChallenge(t, vpjwt, token)
+	assert.Equal(t, http.StatusFound, stepUpRequest(t, http.MethodPost, vpjwt, a.register(challenge, stepUpOrigin), cookies).Code)
+	rr = stepUpRequest(t, http.MethodPost, vpjwt, newTestAuthenticator(t).register(challenge2, stepUpOrigin), cookies2)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, http.StatusForbidden, stepUpRequestEnrol(t, http.MethodGet, vpjwt, token, nil, nil).Code)
+	creds, err := std.passkeys.credentials(context.Background(), "testuser")
+	assert.NoError(t, err)
+	assert.Len(t, creds, 1)
+
+	// without redis there are no passkeys to ask for
+	std.sessionKV = nil
+	assert.Equal(t, http.StatusServiceUnavailable, stepUpRequest(t, http.MethodGet, vpjwt, nil, nil).Code)
+}
+
+func TestStepUpEnrolHandler(t *testing.T) {
+	setUpStepUp(t)
+	vouchJWT := func(username string, teams ...string) string {
+		vpjwt, err := jwtmanager.NewVPJWT(context.Background(), structs.User{Username: username, Email: username, TeamMemberships: teams}, structs.CustomClaims{}, structs.PTokens{})
+		assert.NoError(t, err)
+		return vpjwt
+	}
+	enrol := func(method string, origin string, vpjwt string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://vouch.example.com"+stepUpEnrolPath+"?user=testuser", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if vpjwt != "" {
+			req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(StepUpEnrolHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	admin := vouchJWT("admin@example.com", "vouch-admins")
+
+	assert.Equal(t, http.StatusMethodNotAllowed, enrol("GET", stepUpOrigin, admin).Code)
+	assert.Equal(t, http.StatusUnauthorized, enrol("POST", stepUpOrigin, "").Code)
+	assert.Equal(t, http.StatusForbidden, enrol("POST", stepUpOrigin, vouchJWT("testuser")).Code, "a user can't enrol their own passkey")
+	assert.Equal(t, http.StatusForbidden, enrol("POST", "https://evil.example.net", admin).Code)
+
+	rr := enrol("POST", stepUpOrigin, admin)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var link struct {
+		User string `json:"user"`
+		URL  string `json:"url"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &link))
+	assert.Equal(t, "testuser", link.User)
+	u, err := url.Parse(link.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, stepUpOrigin+stepUpPath, u.Scheme+"://"+u.Host+u.Path)
+	assert.NoError(t, std.passkeys.checkEnrolment(context.Background(), stepUpEnrolHash(u.Query().Get("enrol")), "testuser"))
+	// only the hash of the link is kept
+	for k := range std.sessionKV.(*fakeKV).data {
+		assert.NotContains(t, k, u.Query().Get("enrol"))
+	}
+}
+
+func TestStepUpHandlerRejected(t *testing.T) {
+	vpjwt := setUpStepUp(t)
+	a := newTestAuthenticator(t)
+	enrolPasskey(t, vpjwt, a)
+	challenge, cookies := stepUpChallenge(t, vpjwt)
+	assert.Equal(t, http.StatusFound, stepUpRequest(t, http.MethodPost, vpjwt, a.assert(challenge, stepUpOrigin), cookies).Code)
+
+	other := newTestAuthenticator(t)
+	tests := []struct {
+		name string
+		form func(challenge string) url.Values
+	}{
+		{"another passkey", func(c string) url.Values { return other.assert(c, stepUpOrigin) }},
+		{"another origin", func(c string) url.Values { return a.assert(c, "https://evil.example.net") }},
+		{"another challenge", func(c string) url.Values { return a.assert("bm90IHRoZSBjaGFsbGVuZ2U", stepUpOrigin) }},
+		{"a second passkey can't be registered without a link", func(c string) url.Values { return other.register(c, stepUpOrigin) }},
+		{"bad signature", func(c string) url.Values {
+			form := a.assert(c, stepUpOrigin)
+			form.Set("signature", base64.RawURLEncoding.EncodeToString([]byte("not a signature")))
+			return form
+		}},
+		{"replayed sign count", func(c string) url.Values {
+			// the count of the assertion already accepted
+			a.signCount = 0
+			return a.assert(c, stepUpOrigin)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			challenge, cookies := stepUpChallenge(t, vpjwt)
+			rr := stepUpRequest(t, http.MethodPost, vpjwt, tt.form(challenge), cookies)
+			assert.Equal(t, http.StatusForbidden, rr.Code)
+			assert.Empty(t, reissuedJWT(rr))
+		})
+	}
+}
+
+func TestStepUpHandlerNotLoggedIn(t *testing.T) {
+	setUpStepUp(t)
+	rr := stepUpRequest(t, http.MethodGet, "", nil, nil)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "/login?url="+url.QueryEscape(stepUpRequestedURL), rr.Header().Get("Location"))
+
+	// without the session of the page the post is refused
+	rr = stepUpRequest(t, http.MethodPost, setUpStepUp(t), newTestAuthenticator(t).register("challenge", stepUpOrigin), nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestAuthStateHandlerStepUp(t *testing.T) {
+	setUpStepUp(t)
+	ts := stubIdP(`{"sub":"abc","email":"test@example.com","name":"Test"}`)
+	defer ts.Close()
+
+	state, cookies := loginForState(t, stepUpRequestedURL)
+	rr := authState(t, state, cookies)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, stepUpPath+"?url="+url.QueryEscape(stepUpRequestedURL), rr.Header().Get("Location"))
+
+	state, cookies = loginForState(t, "http://app.example.com/")
+	rr = authState(t, state, cookies)
+	assert.Equal(t, "http://app.example.com/", rr.Header().Get("Location"))
+}
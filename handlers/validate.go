@@ -11,22 +11,36 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
-	"reflect"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
 
 	"go.uber.org/zap"
 
+	"github.com/vouch/vouch-proxy/pkg/audit"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
 	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
 	"github.com/vouch/vouch-proxy/pkg/responses"
+	"github.com/vouch/vouch-proxy/pkg/structs"
 )
 
 var (
-	errNoJWT  = errors.New("no jwt found in request")
-	errNoUser = errors.New("no User found in jwt")
+	errNoJWT   = errors.New("no jwt found in request")
+	errNoUser  = errors.New("no User found in jwt")
+	errRevoked = errors.New("the session was ended at the IdP")
+	// errUserRevoked see revokeUser
+	errUserRevoked = errors.New("the user's sessions were revoked")
 )
 
 // ValidateRequestHandler /validate
@@ -34,50 +48,97 @@ func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 	fastlog.Debug("/validate")
 
 	jwt := jwtmanager.FindJWT(r)
+	if jwt == "" && cfg.FromContext(r.Context()).ClientCert.Enabled {
+		var err error
+		if jwt, err = clientCertJWT(w, r); err != nil {
+			send401or200PublicAccess(w, r, nil, err)
+			return
+		}
+	}
 	if jwt == "" {
-		send401or200PublicAccess(w, r, errNoJWT)
+		send401or200PublicAccess(w, r, nil, errNoJWT)
 		return
 	}
 
-	claims, err := jwtmanager.ClaimsFromJWT(jwt)
+	claims, err := jwtmanager.ClaimsFromJWT(r.Context(), jwt)
 	if err != nil {
-		send401or200PublicAccess(w, r, err)
+		send401or200PublicAccess(w, r, nil, err)
 		return
 	}
 
-	if claims.Username == "" {
-		send401or200PublicAccess(w, r, errNoUser)
+	if err := checkClaims(r.Context(), claims); err != nil {
+		send401or200PublicAccess(w, r, claims, err)
 		return
 	}
 
-	if !cfg.Cfg.AllowAllUsers {
-		if !claims.SiteInAudience(r.Host) {
-			send401or200PublicAccess(w, r,
+	if !cfg.FromContext(r.Context()).AllowAllUsers {
+		if !claims.SiteInAudience(r.Context(), r.Host) {
+			send401or200PublicAccess(w, r, claims,
 				fmt.Errorf("http header 'Host: %s' not authorized for configured `vouch.domains` (is Host being sent properly?)", r.Host))
 			return
 		}
 	}
 
-	generateCustomClaimsHeaders(w, claims)
-	w.Header().Add(cfg.Cfg.Headers.User, claims.Username)
-	w.Header().Add(cfg.Cfg.Headers.Success, "true")
+	// the request is authorized by the refreshed groups, not only the next one
+	refreshGroups(w, r, claims)
+
+	if !withinAccessHours(r.Context(), forwarded.Host(r)) {
+		auditValidate(r, claims, audit.RuleAccessHours, errOutsideAccessHours)
+		sendOutsideAccessHours(w, r)
+		return
+	}
+
+	if err := checkPolicy(r, claims); err != nil {
+		auditValidate(r, claims, audit.RulePolicy, err)
+		sendPolicyDenied(w, r, err)
+		return
+	}
 
-	if cfg.Cfg.Headers.AccessToken != "" && claims.PAccessToken != "" {
-		w.Header().Add(cfg.Cfg.Headers.AccessToken, claims.PAccessToken)
+	if cfg.FromContext(r.Context()).StepUpRequired(forwarded.Host(r)) && claims.StepUp == 0 {
+		send401or200PublicAccess(w, r, claims, errStepUpRequired)
+		return
 	}
-	if cfg.Cfg.Headers.IDToken != "" && claims.PIdToken != "" {
-		w.Header().Add(cfg.Cfg.Headers.IDToken, claims.PIdToken)
+
+	jwtmanager.TrackSID(r.Context(), claims, jwt)
+	refreshSession(w, r, claims, jwt)
+	rollSession(w, r, claims, jwt)
+	touchSession(w, r, claims, jwt)
+	ensureCSRFToken(w, r, claims.CustomClaims)
+	auditValidate(r, claims, audit.RuleJWT, nil)
+
+	// the backend already holds the headers for this session
+	if cfg.FromContext(r.Context()).ConditionalValidate.Enabled {
+		fingerprint := jwtmanager.SessionFingerprint(r.Context(), claims)
+		if jwtmanager.SessionUnchanged(r, fingerprint) {
+			metrics.ValidateRequest(metrics.ValidateOK)
+			jwtmanager.SendSessionUnchanged(w, r, claims.Username, fingerprint)
+			return
+		}
+		jwtmanager.SetSessionFingerprintHeader(w, r, fingerprint)
 	}
+
+	generateCustomClaimsHeaders(w, r, claims)
+	generateClaimHeaders(w, r, claims)
+	generateUIDHeader(w, r, claims)
+	generateRoleHeader(w, r, claims)
+	generateLogoutURLHeader(w, r)
+	jwtmanager.SetAssertionHeader(w, r, jwt, claims)
+	w.Header().Add(cfg.FromContext(r.Context()).Headers.User, claims.Username)
+	w.Header().Add(cfg.FromContext(r.Context()).Headers.Success, "true")
+
+	jwtmanager.SetAccessTokenHeader(w, r, claims)
+	jwtmanager.SetIDTokenHeader(w, r, claims)
 	// fastlog.Debugf("response headers %+v", w.Header())
 	// fastlog.Debug("response header",
 	// 	zap.String(cfg.Cfg.Headers.User, w.Header().Get(cfg.Cfg.Headers.User)))
 	fastlog.Debug("response header",
-		zap.Any("all headers", w.Header()))
+		zap.Any("all headers", redactTokenHeaders(r.Context(), w.Header())))
 
 	// good to go!!
+	metrics.ValidateRequest(metrics.ValidateOK)
 
-	if cfg.Cfg.Testing {
-		responses.RenderIndex(w, "user authorized "+claims.Username)
+	if cfg.FromContext(r.Context()).Testing {
+		responses.RenderIndex(w, r, "user authorized "+claims.Username)
 	} else {
 		responses.OK200(w, r)
 	}
@@ -87,48 +148,245 @@ func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func generateCustomClaimsHeaders(w http.ResponseWriter, claims *jwtmanager.VouchClaims) {
-	if len(cfg.Cfg.Headers.ClaimsCleaned) > 0 {
+// checkClaims the session of the claims of a valid JWT hasn't ended
+func checkClaims(ctx context.Context, claims *jwtmanager.VouchClaims) error {
+	switch {
+	case claims.Username == "":
+		return errNoUser
+	case jwtmanager.IsRevoked(ctx, claims):
+		return errRevoked
+	case jwtmanager.IsUserRevoked(ctx, claims):
+		return errUserRevoked
+	case sessionIdle(ctx, claims):
+		return errIdle
+	}
+	return nil
+}
+
+// UserFromJWT the user of a JWT which /validate would accept on any of `vouch.domains`, for an application embedding Vouch Proxy
+func UserFromJWT(ctx context.Context, jwt string) (*structs.User, error) {
+	claims, err := jwtmanager.ClaimsFromJWT(ctx, jwt)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkClaims(ctx, claims); err != nil {
+		return nil, err
+	}
+	user := &structs.User{Username: claims.Username, Provider: claims.Provider, TeamMemberships: claims.Teams}
+	user.Email, _ = claims.CustomClaims["email"].(string)
+	user.Name, _ = claims.CustomClaims["name"].(string)
+	return user, nil
+}
+
+// VerifyUser the user is one of those permitted by `vouch.allowAllUsers`, `vouch.whiteList`, `vouch.teamWhitelist`
+// or `vouch.domains`, as checked at login
+func VerifyUser(ctx context.Context, user structs.User) error {
+	_, err := verifyUser(ctx, user)
+	return err
+}
+
+// generateCustomClaimsHeaders pass each of `headers.claims`, or only those of the `vouch.external_auth` entry of an `/_external-auth-{id}` request
+func generateCustomClaimsHeaders(w http.ResponseWriter, r *http.Request, claims *jwtmanager.VouchClaims) {
+	if len(cfg.FromContext(r.Context()).Headers.ClaimsCleaned) > 0 {
 		log.Debug("Found claims in config, finding specific keys...")
-		// Run through all the claims found
-		for k, v := range claims.CustomClaims {
-			// Run through the claims we are looking for
-			for claim, header := range cfg.Cfg.Headers.ClaimsCleaned {
-				// Check for matching claim
-				if claim == k {
-					log.Debugf("Found matching claim key: %s", k)
-					if val, ok := v.([]interface{}); ok {
-						strs := make([]string, len(val))
-						for i, v := range val {
-							strs[i] = fmt.Sprintf("\"%s\"", v)
-						}
-						log.Debugf("Adding header for claim %s - %s: %s", k, header, val)
-						w.Header().Add(header, strings.Join(strs, ","))
+		_, ea := cfg.FromContext(r.Context()).ExternalAuthFor(r)
+		// Run through the claims we are looking for, which may be a dotted path into an object such as `address.country`
+		for claim, header := range cfg.FromContext(r.Context()).Headers.ClaimsCleaned {
+			if ea != nil && !ea.PassesClaim(claim) {
+				continue
+			}
+			v, ok := common.ClaimValue(claims.CustomClaims, claim)
+			if !ok {
+				continue
+			}
+			log.Debugf("Found matching claim key: %s", claim)
+			switch val := v.(type) {
+			case []interface{}:
+				if claim == cfg.FromContext(r.Context()).Groups.Claim && cfg.FromContext(r.Context()).Groups.HeaderStyle != cfg.GroupsHeaderQuoted {
+					addGroupsHeader(w, r, header, val)
+					continue
+				}
+				strs := make([]string, len(val))
+				for i, v := range val {
+					if obj, ok := v.(map[string]interface{}); ok {
+						strs[i] = objectClaimJSON(claim, obj)
 					} else {
-						// convert to string
-						val := fmt.Sprint(v)
-						if reflect.TypeOf(val).Kind() == reflect.String {
-							// if val, ok := v.(string); ok {
-							w.Header().Add(header, val)
-							log.Debugf("Adding header for claim %s - %s: %s", k, header, val)
-						} else {
-							log.Errorf("Couldn't parse header type for %s %+v.  Please submit an issue.", k, v)
-						}
+						strs[i] = fmt.Sprintf("\"%s\"", v)
 					}
 				}
+				log.Debugf("Adding header for claim %s - %s: %s", claim, header, val)
+				w.Header().Add(header, strings.Join(strs, ","))
+			case map[string]interface{}:
+				if cfg.FromContext(r.Context()).Headers.ObjectClaims == cfg.ObjectClaimsOmit {
+					log.Debugf("Omitting header for object claim %s, see headers.object_claims", claim)
+					continue
+				}
+				w.Header().Add(header, objectClaimJSON(claim, val))
+				log.Debugf("Adding header for claim %s - %s: %s", claim, header, val)
+			default:
+				// convert to string
+				w.Header().Add(header, fmt.Sprint(v))
+				log.Debugf("Adding header for claim %s - %s: %v", claim, header, v)
 			}
 		}
 	}
 
 }
 
-func send401or200PublicAccess(w http.ResponseWriter, r *http.Request, e error) {
-	if cfg.Cfg.PublicAccess {
-		log.Debugf("error: %s, but public access is '%v', returning OK200", e, cfg.Cfg.PublicAccess)
-		w.Header().Add(cfg.Cfg.Headers.User, "")
+// generateClaimHeaders pass each header of `headers.claim_headers` the claim at its path
+// an array is joined by `headers.claim_headers_separator`, a missing or empty claim omits the header
+func generateClaimHeaders(w http.ResponseWriter, r *http.Request, claims *jwtmanager.VouchClaims) {
+	for header, path := range cfg.FromContext(r.Context()).Headers.ClaimHeaders {
+		v, ok := common.ClaimValue(claims.CustomClaims, path)
+		if !ok {
+			log.Debugf("claim %s not found for user %s, omitting header %s", path, claims.Username, header)
+			continue
+		}
+		var val string
+		switch vv := v.(type) {
+		case []interface{}:
+			strs := make([]string, 0, len(vv))
+			for _, e := range vv {
+				if s := claimHeaderValue(path, e); s != "" {
+					strs = append(strs, s)
+				}
+			}
+			val = strings.Join(strs, cfg.FromContext(r.Context()).Headers.ClaimHeadersSeparator)
+		default:
+			val = claimHeaderValue(path, v)
+		}
+		if val == "" {
+			continue
+		}
+		w.Header().Set(header, val)
+		log.Debugf("Adding header for claim %s - %s: %s", path, header, val)
+	}
+}
+
+// claimHeaderValue a value of a claim as text, an object as JSON
+func claimHeaderValue(claim string, v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case map[string]interface{}:
+		return objectClaimJSON(claim, val)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// addGroupsHeader pass the groups claim per `groups.header_style`, either joined by `groups.header_delimiter` or one header for each
+func addGroupsHeader(w http.ResponseWriter, r *http.Request, header string, groups []interface{}) {
+	strs := make([]string, len(groups))
+	for i, g := range groups {
+		strs[i] = fmt.Sprint(g)
+	}
+	if cfg.FromContext(r.Context()).Groups.HeaderStyle == cfg.GroupsHeaderRepeated {
+		for _, g := range strs {
+			w.Header().Add(header, g)
+		}
+		return
+	}
+	w.Header().Add(header, strings.Join(strs, cfg.FromContext(r.Context()).Groups.HeaderDelimiter))
+}
+
+// objectClaimJSON a claim whose value is an object is passed as JSON
+func objectClaimJSON(claim string, obj map[string]interface{}) string {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		log.Errorf("Couldn't encode claim %s %+v as JSON: %s", claim, obj, err)
+		return ""
+	}
+	return string(b)
+}
+
+// generateUIDHeader pass the numeric user id found in the claim `headers.uidclaim` to the `headers.uid` header
+func generateUIDHeader(w http.ResponseWriter, r *http.Request, claims *jwtmanager.VouchClaims) {
+	if cfg.FromContext(r.Context()).Headers.UIDClaim == "" {
+		return
+	}
+	v, ok := claims.CustomClaims[cfg.FromContext(r.Context()).Headers.UIDClaim]
+	if !ok {
+		log.Debugf("uid claim %s not found for user %s", cfg.FromContext(r.Context()).Headers.UIDClaim, claims.Username)
+		return
+	}
+	uid, err := claimToInt(v)
+	if err != nil {
+		log.Warnf("uid claim %s for user %s is not numeric, omitting header %s: %s", cfg.FromContext(r.Context()).Headers.UIDClaim, claims.Username, cfg.FromContext(r.Context()).Headers.UID, err)
+		return
+	}
+	w.Header().Add(cfg.FromContext(r.Context()).Headers.UID, strconv.FormatInt(uid, 10))
+}
+
+// claimToInt json numbers arrive as float64, some IdPs send ids as strings
+func claimToInt(v interface{}) (int64, error) {
+	switch val := v.(type) {
+	case float64:
+		if val != math.Trunc(val) || math.Abs(val) > 1<<53 {
+			return 0, fmt.Errorf("%v is not an integer", val)
+		}
+		return int64(val), nil
+	case json.Number:
+		return val.Int64()
+	case string:
+		return strconv.ParseInt(val, 10, 64)
+	default:
+		return 0, fmt.Errorf("unexpected type %T", v)
+	}
+}
+
+// generateLogoutURLHeader pass the url of /logout to the `headers.logout_url` header so that the application needn't know it
+// the user is returned to the requested host after logout, only if it is within `vouch.domains`
+// /logout is found alongside the callback_url for the host
+func generateLogoutURLHeader(w http.ResponseWriter, r *http.Request) {
+	if cfg.FromContext(r.Context()).Headers.LogoutURL == "" {
+		return
+	}
+	host := forwarded.Host(r)
+	if domains.Matches(r.Context(), host) == "" {
+		log.Debugf("host %s is not within %s.domains, omitting header %s", host, cfg.Branding.LCName, cfg.FromContext(r.Context()).Headers.LogoutURL)
+		return
+	}
+	logoutURL, err := url.Parse(oauthClientForHost(r.Context(), host).RedirectURL)
+	if err != nil || logoutURL.Host == "" {
+		log.Warnf("couldn't find /logout from the callback_url for host %s, omitting header %s: %v", host, cfg.FromContext(r.Context()).Headers.LogoutURL, err)
+		return
+	}
+
+	returnURL := url.URL{Scheme: forwarded.Scheme(r), Host: host, Path: "/"}
+
+	logoutURL.Path = path.Join(path.Dir(logoutURL.Path), "logout")
+	logoutURL.RawQuery = url.Values{"url": {returnURL.String()}}.Encode()
+	logoutURL.Fragment = ""
+	w.Header().Add(cfg.FromContext(r.Context()).Headers.LogoutURL, logoutURL.String())
+}
+
+func send401or200PublicAccess(w http.ResponseWriter, r *http.Request, claims *jwtmanager.VouchClaims, e error) {
+	auditValidate(r, claims, audit.RuleJWT, e)
+	if errors.Is(e, errNoJWT) {
+		metrics.ValidateRequest(metrics.ValidateNoCookie)
+	} else {
+		metrics.ValidateRequest(metrics.ValidateDenied)
+	}
+	if cfg.FromContext(r.Context()).PublicAccess {
+		log.Debugf("error: %s, but public access is '%v', returning OK200", e, cfg.FromContext(r.Context()).PublicAccess)
+		w.Header().Add(cfg.FromContext(r.Context()).Headers.User, "")
 		responses.OK200(w, r)
 		return
 	}
 
 	responses.Error401(w, r, e)
 }
+
+// redactTokenHeaders a copy of the response headers for the debug log, without the provider's tokens
+func redactTokenHeaders(ctx context.Context, h http.Header) http.Header {
+	h = h.Clone()
+	for _, header := range []string{cfg.FromContext(ctx).Headers.AccessToken, cfg.FromContext(ctx).Headers.IDToken} {
+		if header != "" && h.Get(header) != "" {
+			h.Set(header, "[redacted]")
+		}
+	}
+	return h
+}
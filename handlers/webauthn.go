@@ -0,0 +1,229 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// the WebAuthn ceremonies of /stepup, see https://www.w3.org/TR/webauthn-2/
+// the browser gives the public key of a new passkey as SubjectPublicKeyInfo (getPublicKey()), which is kept
+// once it's the same key as the COSE key of the authenticator data, no attestation is asked for
+
+const (
+	webauthnCreate = "webauthn.create"
+	webauthnGet    = "webauthn.get"
+
+	// flags of the authenticator data
+	flagUserPresent      = 0x01
+	flagAttestedCredData = 0x40
+
+	// the COSE key types, and the labels of their parameters, of the ES256, EdDSA and RS256 keys asked for
+	// https://www.rfc-editor.org/rfc/rfc8152#section-13
+	coseKty      = 1
+	coseKtyOKP   = 1
+	coseKtyEC2   = 2
+	coseKtyRSA   = 3
+	coseCrv      = -1
+	coseX        = -2
+	coseY        = -3
+	coseN        = -1
+	coseE        = -2
+	coseP256     = 1
+	coseEd25519  = 6
+	coseKeyBytes = 32
+)
+
+var errWebAuthn = errors.New("the passkey could not be verified")
+
+// webauthnCredential a passkey registered at /stepup
+type webauthnCredential struct {
+	// ID the credential id, unpadded url safe base64
+	ID string `json:"id"`
+	// PublicKey DER encoded SubjectPublicKeyInfo
+	PublicKey []byte `json:"public_key"`
+	SignCount uint32 `json:"sign_count"`
+}
+
+// authenticatorData https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	// credentialID of a passkey being registered
+	credentialID []byte
+	// credentialKey the public key of a passkey being registered
+	credentialKey crypto.PublicKey
+}
+
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", errWebAuthn)
+	}
+	ad := &authenticatorData{rpIDHash: b[:32], flags: b[32], signCount: binary.BigEndian.Uint32(b[33:37])}
+	if ad.flags&flagAttestedCredData != 0 {
+		// aaguid, then the length of the credential id and the id itself
+		rest := b[37:]
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", errWebAuthn)
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		if len(rest) < 18+n {
+			return nil, fmt.Errorf("%w: credential id too short", errWebAuthn)
+		}
+		ad.credentialID = rest[18 : 18+n]
+		// the COSE key follows, and then any extensions
+		var key map[int]interface{}
+		if err := cbor.NewDecoder(bytes.NewReader(rest[18+n:])).Decode(&key); err != nil {
+			return nil, fmt.Errorf("%w: credential public key: %s", errWebAuthn, err)
+		}
+		var err error
+		if ad.credentialKey, err = coseKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return ad, nil
+}
+
+// coseKey the public key of a COSE_Key, one of the ES256, EdDSA and RS256 keys asked for at registration
+func coseKey(key map[int]interface{}) (crypto.PublicKey, error) {
+	param := func(label int) []byte {
+		b, _ := key[label].([]byte)
+		return b
+	}
+	curve := func() uint64 {
+		crv, _ := key[coseCrv].(uint64)
+		return crv
+	}
+	kty, _ := key[coseKty].(uint64)
+	switch {
+	case kty == coseKtyEC2 && curve() == coseP256 && len(param(coseX)) == coseKeyBytes && len(param(coseY)) == coseKeyBytes:
+		k := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(param(coseX)), Y: new(big.Int).SetBytes(param(coseY))}
+		if !k.Curve.IsOnCurve(k.X, k.Y) {
+			return nil, fmt.Errorf("%w: credential public key is not on P-256", errWebAuthn)
+		}
+		return k, nil
+	case kty == coseKtyOKP && curve() == coseEd25519 && len(param(coseX)) == ed25519.PublicKeySize:
+		return ed25519.PublicKey(param(coseX)), nil
+	case kty == coseKtyRSA && len(param(coseN)) > 0 && len(param(coseE)) > 0 && len(param(coseE)) <= 4:
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(param(coseN)), E: int(new(big.Int).SetBytes(param(coseE)).Int64())}, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported credential public key of kty %v", errWebAuthn, key[coseKty])
+}
+
+// check the passkey is one for rpID and the user was present
+func (ad *authenticatorData) check(rpID string) error {
+	want := sha256.Sum256([]byte(rpID))
+	if subtle.ConstantTimeCompare(ad.rpIDHash, want[:]) != 1 {
+		return fmt.Errorf("%w: not a passkey for %s", errWebAuthn, rpID)
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return fmt.Errorf("%w: the user was not present", errWebAuthn)
+	}
+	return nil
+}
+
+// checkClientData the client data of a ceremony of type typ, for challenge, at origin
+func checkClientData(clientDataJSON []byte, typ string, challenge string, origin string) error {
+	var cd struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return fmt.Errorf("%w: %s", errWebAuthn, err)
+	}
+	switch {
+	case cd.Type != typ:
+		return fmt.Errorf("%w: client data of type %q", errWebAuthn, cd.Type)
+	case subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(challenge)) != 1:
+		return fmt.Errorf("%w: the challenge doesn't match", errWebAuthn)
+	case cd.Origin != origin || cd.CrossOrigin:
+		return fmt.Errorf("%w: from origin %s rather than %s", errWebAuthn, cd.Origin, origin)
+	}
+	return nil
+}
+
+// parsePasskeyPublicKey the public key of a passkey, one of the ES256, EdDSA and RS256 keys asked for at registration
+func parsePasskeyPublicKey(spki []byte) (crypto.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errWebAuthn, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey, *rsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported key type %T", errWebAuthn, key)
+}
+
+// verifyAssertion the signature of an assertion, over the authenticator data and the hash of the client data
+func verifyAssertion(spki []byte, authData []byte, clientDataJSON []byte, sig []byte) error {
+	key, err := parsePasskeyPublicKey(spki)
+	if err != nil {
+		return err
+	}
+	cdHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), cdHash[:]...)
+	digest := sha256.Sum256(signed)
+	ok := false
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(k, digest[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(k, signed, sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	}
+	if !ok {
+		return fmt.Errorf("%w: bad signature", errWebAuthn)
+	}
+	return nil
+}
+
+// checkSignCount a passkey which counts its signatures must count up, otherwise it may have been cloned
+func checkSignCount(stored uint32, got uint32) error {
+	if (stored != 0 || got != 0) && got <= stored {
+		return fmt.Errorf("%w: signature count %d not above %d", errWebAuthn, got, stored)
+	}
+	return nil
+}
+
+// checkRegistration the passkey being registered, its id and its public key, is the one the authenticator data is for
+func checkRegistration(ad *authenticatorData, credentialID []byte, spki []byte) error {
+	if ad.flags&flagAttestedCredData == 0 || !bytes.Equal(ad.credentialID, credentialID) {
+		return fmt.Errorf("%w: the credential id doesn't match", errWebAuthn)
+	}
+	key, err := parsePasskeyPublicKey(spki)
+	if err != nil {
+		return err
+	}
+	if k, ok := key.(interface{ Equal(crypto.PublicKey) bool }); !ok || !k.Equal(ad.credentialKey) {
+		return fmt.Errorf("%w: the public key isn't the passkey's", errWebAuthn)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// testAuthenticator a software passkey
+type testAuthenticator struct {
+	t         *testing.T
+	key       *ecdsa.PrivateKey
+	id        []byte
+	signCount uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return &testAuthenticator{t: t, key: key, id: []byte("credential-1")}
+}
+
+func (a *testAuthenticator) publicKey() []byte {
+	spki, err := x509.MarshalPKIXPublicKey(&a.key.PublicKey)
+	assert.NoError(a.t, err)
+	return spki
+}
+
+// coseKey the passkey's public key as a COSE_Key
+func (a *testAuthenticator) coseKey() []byte {
+	x, y := make([]byte, coseKeyBytes), make([]byte, coseKeyBytes)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	b, err := cbor.Marshal(map[int]interface{}{coseKty: coseKtyEC2, 3: -7, coseCrv: coseP256, coseX: x, coseY: y})
+	assert.NoError(a.t, err)
+	return b
+}
+
+// authData the authenticator data for rpID, with the attested credential data when registering
+func (a *testAuthenticator) authData(rpID string, flags byte, register bool) []byte {
+	h := sha256.Sum256([]byte(rpID))
+	b := append(h[:], flags)
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], a.signCount)
+	if register {
+		b[32] |= flagAttestedCredData
+		b = append(b, make([]byte, 16)...)
+		b = append(b, byte(len(a.id)>>8), byte(len(a.id)))
+		b = append(b, a.id...)
+		b = append(b, a.coseKey()...)
+	}
+	return b
+}
+
+func clientDataJSON(t *testing.T, typ, challenge, origin string) []byte {
+	b, err := json.Marshal(map[string]interface{}{"type": typ, "challenge": challenge, "origin": origin})
+	assert.NoError(t, err)
+	return b
+}
+
+func (a *testAuthenticator) sign(authData, clientData []byte) []byte {
+	h := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), h[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	assert.NoError(a.t, err)
+	return sig
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	a := newTestAuthenticator(t)
+	other := newTestAuthenticator(t)
+	authData := a.authData("example.com", flagUserPresent, false)
+	clientData := clientDataJSON(t, webauthnGet, "challenge", "https://vouch.example.com")
+	sig := a.sign(authData, clientData)
+
+	assert.NoError(t, verifyAssertion(a.publicKey(), authData, clientData, sig))
+	assert.True(t, errors.Is(verifyAssertion(other.publicKey(), authData, clientData, sig), errWebAuthn), "another passkey's key")
+	tampered := clientDataJSON(t, webauthnGet, "other", "https://vouch.example.com")
+	assert.True(t, errors.Is(verifyAssertion(a.publicKey(), authData, tampered, sig), errWebAuthn), "signed other client data")
+	assert.True(t, errors.Is(verifyAssertion([]byte("not a key"), authData, clientData, sig), errWebAuthn))
+}
+
+func TestCheckClientData(t *testing.T) {
+	origin := "https://vouch.example.com"
+	tests := []struct {
+		name       string
+		clientData []byte
+		wantErr    bool
+	}{
+		{"valid", clientDataJSON(t, webauthnGet, "c", origin), false},
+		{"registration", clientDataJSON(t, webauthnCreate, "c", origin), true},
+		{"other challenge", clientDataJSON(t, webauthnGet, "d", origin), true},
+		{"other origin", clientDataJSON(t, webauthnGet, "c", "https://evil.example.net"), true},
+		{"cross origin", []byte(`{"type":"webauthn.get","challenge":"c","origin":"https://vouch.example.com","crossOrigin":true}`), true},
+		{"not json", []byte("{"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkClientData(tt.clientData, webauthnGet, "c", origin)
+			assert.Equal(t, tt.wantErr, err != nil, "err = %v", err)
+		})
+	}
+}
+
+func TestParseAuthenticatorData(t *testing.T) {
+	a := newTestAuthenticator(t)
+	a.signCount = 7
+	ad, err := parseAuthenticatorData(a.authData("example.com", flagUserPresent, true))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(7), ad.signCount)
+	assert.Equal(t, a.id, ad.credentialID)
+	assert.NoError(t, ad.check("example.com"))
+	assert.Error(t, ad.check("example.net"), "a passkey of another relying party")
+	assert.NoError(t, checkRegistration(ad, a.id, a.publicKey()))
+	assert.Error(t, checkRegistration(ad, []byte("other"), a.publicKey()))
+	// the key given alongside the credential id must be the one the authenticator attests
+	other := newTestAuthenticator(t)
+	err = checkRegistration(ad, a.id, other.publicKey())
+	assert.True(t, errors.Is(err, errWebAuthn), "err = %v", err)
+
+	ad, err = parseAuthenticatorData(a.authData("example.com", 0, false))
+	assert.NoError(t, err)
+	assert.Error(t, ad.check("example.com"), "the user wasn't present")
+
+	_, err = parseAuthenticatorData([]byte("short"))
+	assert.Error(t, err)
+	truncated := a.authData("example.com", flagUserPresent, true)
+	_, err = parseAuthenticatorData(truncated[:len(truncated)-1])
+	assert.Error(t, err)
+}
+
+func TestCheckSignCount(t *testing.T) {
+	assert.NoError(t, checkSignCount(0, 0), "a passkey which doesn't count")
+	assert.NoError(t, checkSignCount(4, 5))
+	assert.Error(t, checkSignCount(5, 5), "a cloned passkey")
+	assert.Error(t, checkSignCount(5, 0))
+}
+
+func Test_coseKey(t *testing.T) {
+	a := newTestAuthenticator(t)
+	var key map[int]interface{}
+	assert.NoError(t, cbor.Unmarshal(a.coseKey(), &key))
+	got, err := coseKey(key)
+	assert.NoError(t, err)
+	assert.True(t, a.key.PublicKey.Equal(got))
+
+	key[coseY] = make([]byte, coseKeyBytes)
+	_, err = coseKey(key)
+	assert.Error(t, err, "a point not on the curve")
+	key[coseKty] = uint64(4)
+	_, err = coseKey(key)
+	assert.Error(t, err, "a symmetric key")
+}
@@ -23,14 +23,16 @@ https://github.com/vouch/vouch-proxy#submitting-a-pull-request-for-a-new-feature
 */
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	// "net/http/pprof"
@@ -39,32 +41,34 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/vouch/vouch-proxy/handlers"
+	"github.com/vouch/vouch-proxy/pkg/audit"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
-	"github.com/vouch/vouch-proxy/pkg/cookie"
-	"github.com/vouch/vouch-proxy/pkg/domains"
 	"github.com/vouch/vouch-proxy/pkg/healthcheck"
-	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
-	"github.com/vouch/vouch-proxy/pkg/responses"
+	"github.com/vouch/vouch-proxy/pkg/proxyproto"
+	"github.com/vouch/vouch-proxy/pkg/selftest"
 	"github.com/vouch/vouch-proxy/pkg/timelog"
+	"github.com/vouch/vouch-proxy/pkg/tracing"
+	"github.com/vouch/vouch-proxy/pkg/vouch"
 )
 
 // version and semver get overwritten by build with
 // go build -i -v -ldflags="-X main.version=$(git describe --always --long) -X main.semver=v$(git semver get)"
 var (
-	version   = "undefined"
-	builddt   = "undefined"
-	host      = "undefined"
-	semver    = "undefined"
-	branch    = "undefined"
-	uname     = "undefined"
-	staticDir = "/static/"
-	logger    *zap.SugaredLogger
-	fastlog   *zap.Logger
-	help      = flag.Bool("help", false, "show usage")
-	scheme    = map[bool]string{
+	version = "undefined"
+	builddt = "undefined"
+	host    = "undefined"
+	semver  = "undefined"
+	branch  = "undefined"
+	uname   = "undefined"
+	logger  *zap.SugaredLogger
+	fastlog *zap.Logger
+	help    = flag.Bool("help", false, "show usage")
+	scheme  = map[bool]string{
 		false: "http",
 		true:  "https",
 	}
+	// proxyHeaderTimeout is how long a connection has to send its PROXY protocol header
+	proxyHeaderTimeout = 5 * time.Second
 	// doProfile = flag.Bool("profile", false, "run profiler at /debug/pprof")
 )
 
@@ -101,16 +105,38 @@ func configure() {
 	logger = cfg.Logging.Logger
 	fastlog = cfg.Logging.FastLogger
 
+	isConfigTest, offline := cfg.ConfigTest()
 	if err := cfg.ValidateConfiguration(); err != nil {
+		if isConfigTest {
+			configTestFailed(err)
+		}
 		logger.Fatal(err)
 	}
 
-	domains.Configure()
-	jwtmanager.Configure()
-	cookie.Configure()
-	responses.Configure()
-	handlers.Configure()
-	timelog.Configure()
+	audit.Version = semver
+	vouch.Configure()
+
+	if isConfigTest {
+		if problems := selftest.CheckConfig(context.Background(), offline); len(problems) > 0 {
+			configTestFailed(problems...)
+		}
+		logger.Info("config test passed")
+		os.Exit(0)
+	}
+
+	if cfg.Cfg.SelfTest.Enabled {
+		if err := selftest.Run(context.Background()); err != nil {
+			logger.Fatal(err)
+		}
+	}
+}
+
+// configTestFailed `-test` reports each problem and exits non-zero, without binding the listener
+func configTestFailed(problems ...error) {
+	for _, p := range problems {
+		logger.Errorf("config test failed: %s", p)
+	}
+	os.Exit(1)
 }
 
 func main() {
@@ -131,37 +157,12 @@ func main() {
 		"tls", tls,
 		"oauth.provider", cfg.GenOAuth.Provider)
 
-	muxR := mux.NewRouter()
+	muxR := vouch.Router()
 
-	authH := http.HandlerFunc(handlers.ValidateRequestHandler)
-	muxR.HandleFunc("/validate", timelog.TimeLog(jwtmanager.JWTCacheHandler(authH)))
-	muxR.HandleFunc("/_external-auth-{id}", timelog.TimeLog(jwtmanager.JWTCacheHandler(authH)))
-
-	loginH := http.HandlerFunc(handlers.LoginHandler)
-	muxR.HandleFunc("/login", timelog.TimeLog(loginH))
-
-	logoutH := http.HandlerFunc(handlers.LogoutHandler)
-	muxR.HandleFunc("/logout", timelog.TimeLog(logoutH))
-
-	authStateH := http.HandlerFunc(handlers.AuthStateHandler)
-	muxR.HandleFunc("/auth/{state}/", timelog.TimeLog(authStateH))
-
-	callH := http.HandlerFunc(handlers.CallbackHandler)
-	muxR.HandleFunc("/auth", timelog.TimeLog(callH))
-
-	healthH := http.HandlerFunc(handlers.HealthcheckHandler)
-	muxR.HandleFunc("/healthcheck", timelog.TimeLog(healthH))
-
-	// setup static
-	sPath, err := filepath.Abs(cfg.RootDir + staticDir)
-	if fastlog.Core().Enabled(zap.DebugLevel) {
-		if err != nil {
-			logger.Errorf("couldn't find static assets at %s", sPath)
-		}
-		logger.Debugf("serving static files from %s", sPath)
+	// see metrics in the config, kept off the public listener if metrics.listen is set
+	if cfg.Cfg.Metrics.Enabled && cfg.Cfg.Metrics.Listen != "" {
+		go serveMetrics(cfg.Cfg.Metrics.Listen, http.HandlerFunc(handlers.MetricsHandler))
 	}
-	// https://golangcode.com/serve-static-assets-using-the-mux-router/
-	muxR.PathPrefix(staticDir).Handler(http.StripPrefix(staticDir, http.FileServer(http.Dir(sPath))))
 
 	//
 	// if *doProfile {
@@ -177,13 +178,72 @@ func main() {
 		ErrorLog:     log.New(&fwdToZapWriter{fastlog}, "", 0),
 	}
 
-	if tls {
-		srv.TLSConfig = cfg.TLSConfig(cfg.Cfg.TLS.Profile)
-		logger.Fatal(srv.ListenAndServeTLS(cfg.Cfg.TLS.Cert, cfg.Cfg.TLS.Key))
-	} else {
-		logger.Fatal(srv.ListenAndServe())
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		logger.Fatal(err)
 	}
+	if cfg.Cfg.ProxyProtocol {
+		logger.Info("expecting a PROXY protocol header on every connection")
+		lis = &proxyproto.Listener{Listener: lis, HeaderTimeout: proxyHeaderTimeout}
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		if tls {
+			srv.TLSConfig = cfg.TLSConfig(cfg.Cfg.TLS.Profile)
+			served <- srv.ServeTLS(lis, cfg.Cfg.TLS.Cert, cfg.Cfg.TLS.Key)
+		} else {
+			served <- srv.Serve(lis)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-served:
+		logger.Error(err)
+		flushLogs()
+		os.Exit(1)
+	case sig := <-stop:
+		shutdown(srv, sig)
+	}
+}
+
+// shutdown stop accepting connections and wait up to `vouch.shutdown_timeout` for the requests in flight,
+// so that a rolling deploy doesn't break the logins on their way back from the IdP
+func shutdown(srv *http.Server, sig os.Signal) {
+	timeout := time.Duration(cfg.Cfg.ShutdownTimeout) * time.Second
+	logger.Infof("received %s, waiting up to %s for requests in flight before shutting down", sig, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warnf("requests still in flight after %s were dropped: %s", timeout, err)
+	}
+	logger.Info(cfg.Branding.FullName + " stopped")
+	flushLogs()
+}
 
+// flushLogs send the spans still queued and write out whatever the loggers hold
+func flushLogs() {
+	tracing.Flush()
+	// syncing stdout fails on some platforms, there's nothing to be done about it on the way out
+	_ = fastlog.Sync()
+	_ = logger.Sync()
+}
+
+// serveMetrics /metrics alone on its own listener, such as localhost
+func serveMetrics(listen string, metricsH http.Handler) {
+	metricsR := mux.NewRouter()
+	metricsR.HandleFunc("/metrics", timelog.TimeLog(handlers.HeadHandler(metricsH)))
+	srv := &http.Server{
+		Handler:      metricsR,
+		Addr:         listen,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+		ErrorLog:     log.New(&fwdToZapWriter{fastlog}, "", 0),
+	}
+	logger.Infof("serving /metrics on http://%s/metrics", listen)
+	logger.Fatal(srv.ListenAndServe())
 }
 
 func checkTCPPortAvailable(listen string) {
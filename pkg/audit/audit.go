@@ -0,0 +1,326 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package audit records login, authorization and logout events for a SIEM
+// as json, CEF (ArcSight Common Event Format) or LEEF (QRadar Log Event Extended Format)
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
+)
+
+// event names
+const (
+	Login  = "login"
+	Authz  = "authz"
+	Logout = "logout"
+
+	Success = "success"
+	Failure = "failure"
+
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// the rules by which an authz decision is made
+const (
+	RuleAllowAllUsers = "AllowAllUsers"
+	RuleWhiteList     = "WhiteList"
+	RuleTeamWhiteList = "TeamWhiteList"
+	RuleDomains       = "Domains"
+	// RuleNone nothing is configured, any user who logs in at the IdP is allowed
+	RuleNone = "None"
+	// RuleJWT /validate, the request carries a valid JWT for the host
+	RuleJWT = "JWT"
+	// RuleAccessHours /validate, the host is outside its permitted hours
+	RuleAccessHours = "AccessHours"
+	// RulePolicy /validate, the user isn't allowed by the `policies` entry covering the host
+	RulePolicy = "Policy"
+)
+
+// Event an audit record
+type Event struct {
+	Time    time.Time `json:"time"`
+	Name    string    `json:"event"`
+	User    string    `json:"user,omitempty"`
+	Src     string    `json:"src,omitempty"`
+	Host    string    `json:"host,omitempty"`
+	Outcome string    `json:"outcome"`
+	Reason  string    `json:"reason,omitempty"`
+	// Code the operator's reason code for a denial, such as that of the `deny_rules` entry which refused the user
+	Code string `json:"reason_code,omitempty"`
+	// the details of an authz decision, see Authorization()
+	Email    string `json:"email,omitempty"`
+	Rule     string `json:"rule,omitempty"`
+	Decision string `json:"decision,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// Decision an authorization decision, the Reason of a denial is the error which refused the user
+type Decision struct {
+	User    string
+	Email   string
+	Rule    string
+	URL     string
+	Allowed bool
+	Reason  string
+}
+
+var (
+	log *zap.SugaredLogger
+	// Version the version of Vouch Proxy reported in CEF and LEEF headers, set by main
+	Version = "undefined"
+
+	// std where the events are written for a request without a cfg.Instance
+	std = &sink{}
+)
+
+// sink where the events of a cfg.Instance are written, out is swapped by Configure and SetOutput while requests are served
+type sink struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+type sinkKey struct{}
+
+// sinkOf the sink of the cfg.Instance of ctx, otherwise std
+func sinkOf(ctx context.Context) *sink {
+	if s, ok := cfg.State(ctx, sinkKey{}).(*sink); ok {
+		return s
+	}
+	return std
+}
+
+// Configure see main.go configure()
+func Configure() {
+	log = cfg.Logging.Logger
+	SetOutput(output())
+}
+
+// ConfigureInstance where the events of inst are written, see cfg.NewInstance()
+func ConfigureInstance(inst *cfg.Instance) {
+	log = cfg.Logging.Logger
+	inst.SetState(sinkKey{}, &sink{out: output()})
+}
+
+// output the writer of `audit.file`, nil unless `audit.enabled`
+func output() io.Writer {
+	if !cfg.Cfg.Audit.Enabled {
+		return nil
+	}
+	var w io.Writer
+	switch cfg.Cfg.Audit.File {
+	case "", "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(cfg.Cfg.Audit.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("audit: could not open %s: %s", cfg.Cfg.Audit.File, err)
+		}
+		w = f
+	}
+	log.Infof("audit: %s events written to %s", cfg.Cfg.Audit.Format, cfg.Cfg.Audit.File)
+	return w
+}
+
+// SetOutput send audit events of a request without a cfg.Instance to w, mostly for testing
+func SetOutput(w io.Writer) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.out = w
+}
+
+// enabled whether the events of the request r are written anywhere
+func enabled(r *http.Request) bool {
+	s := sinkOf(r.Context())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out != nil
+}
+
+// Log record an event for the request r
+func Log(r *http.Request, name, user, outcome, reason string) {
+	LogCode(r, name, user, outcome, "", reason)
+}
+
+// LogCode record an event for the request r along with a reason code, by which denials can be aggregated
+func LogCode(r *http.Request, name, user, outcome, code, reason string) {
+	if !enabled(r) {
+		return
+	}
+	write(r, Event{
+		Time:    time.Now().UTC(),
+		Name:    name,
+		User:    user,
+		Src:     srcIP(r),
+		Host:    r.Host,
+		Outcome: outcome,
+		Reason:  reason,
+		Code:    code,
+	})
+}
+
+// Authorization record the authz decision d for the request r
+func Authorization(r *http.Request, d Decision) {
+	if !enabled(r) {
+		return
+	}
+	e := Event{
+		Time:     time.Now().UTC(),
+		Name:     Authz,
+		User:     d.User,
+		Src:      srcIP(r),
+		Host:     r.Host,
+		Outcome:  Success,
+		Decision: Allow,
+		Reason:   d.Reason,
+		Email:    d.Email,
+		Rule:     d.Rule,
+		URL:      d.URL,
+	}
+	if !d.Allowed {
+		e.Outcome = Failure
+		e.Decision = Deny
+	}
+	write(r, e)
+}
+
+func write(r *http.Request, e Event) {
+	line := Format(e, cfg.FromContext(r.Context()).Audit.Format)
+	s := sinkOf(r.Context())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.out == nil {
+		return
+	}
+	if _, err := fmt.Fprintln(s.out, line); err != nil {
+		log.Errorf("audit: %s", err)
+	}
+}
+
+// Format render e as a single line of json, cef or leef
+func Format(e Event, format string) string {
+	switch format {
+	case cfg.AuditCEF:
+		return formatCEF(e)
+	case cfg.AuditLEEF:
+		return formatLEEF(e)
+	default:
+		b, _ := json.Marshal(e)
+		return string(b)
+	}
+}
+
+// CEF:Version|Device Vendor|Device Product|Device Version|Device Event Class ID|Name|Severity|Extension
+func formatCEF(e Event) string {
+	header := []string{
+		"CEF:0",
+		cefHeader(cfg.Branding.CcName),
+		cefHeader(cfg.Branding.FullName),
+		cefHeader(Version),
+		cefHeader(e.Name),
+		cefHeader(e.Name + " " + e.Outcome),
+		severity(e),
+	}
+	ext := []string{
+		"rt=" + cefValue(fmt.Sprint(e.Time.UnixNano()/int64(time.Millisecond))),
+		"suser=" + cefValue(e.User),
+		"src=" + cefValue(e.Src),
+		"dhost=" + cefValue(e.Host),
+		"outcome=" + cefValue(e.Outcome),
+		"reason=" + cefValue(e.Reason),
+	}
+	if e.Code != "" {
+		ext = append(ext, "cs1Label=reasonCode", "cs1="+cefValue(e.Code))
+	}
+	if e.Rule != "" {
+		ext = append(ext, "cs2Label=rule", "cs2="+cefValue(e.Rule), "act="+cefValue(e.Decision))
+	}
+	if e.Email != "" {
+		ext = append(ext, "cs3Label=email", "cs3="+cefValue(e.Email))
+	}
+	if e.URL != "" {
+		ext = append(ext, "request="+cefValue(e.URL))
+	}
+	return strings.Join(header, "|") + "|" + strings.Join(ext, " ")
+}
+
+// LEEF:Version|Vendor|Product|Version|EventID|Extension (tab delimited)
+func formatLEEF(e Event) string {
+	header := []string{
+		"LEEF:1.0",
+		leefHeader(cfg.Branding.CcName),
+		leefHeader(cfg.Branding.FullName),
+		leefHeader(Version),
+		leefHeader(e.Name),
+	}
+	ext := []string{
+		"devTime=" + leefValue(e.Time.Format("Jan 02 2006 15:04:05.000 MST")),
+		"devTimeFormat=MMM dd yyyy HH:mm:ss.SSS z",
+		"usrName=" + leefValue(e.User),
+		"src=" + leefValue(e.Src),
+		"dstHost=" + leefValue(e.Host),
+		"sev=" + severity(e),
+		"outcome=" + leefValue(e.Outcome),
+		"reason=" + leefValue(e.Reason),
+	}
+	if e.Code != "" {
+		ext = append(ext, "reasonCode="+leefValue(e.Code))
+	}
+	if e.Rule != "" {
+		ext = append(ext, "rule="+leefValue(e.Rule), "decision="+leefValue(e.Decision))
+	}
+	if e.Email != "" {
+		ext = append(ext, "email="+leefValue(e.Email))
+	}
+	if e.URL != "" {
+		ext = append(ext, "url="+leefValue(e.URL))
+	}
+	return strings.Join(header, "|") + "|" + strings.Join(ext, "\t")
+}
+
+func severity(e Event) string {
+	if e.Outcome == Failure {
+		return "5"
+	}
+	return "3"
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefValueEscaper  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	leefHeaderEscape = strings.NewReplacer(`|`, `\|`, "\n", " ", "\r", " ")
+	leefValueEscape  = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+)
+
+func cefHeader(s string) string  { return cefHeaderEscaper.Replace(s) }
+func cefValue(s string) string   { return cefValueEscaper.Replace(s) }
+func leefHeader(s string) string { return leefHeaderEscape.Replace(s) }
+func leefValue(s string) string  { return leefValueEscape.Replace(s) }
+
+// srcIP the address of the client, see forwarded.ClientIP
+func srcIP(r *http.Request) string {
+	return forwarded.ClientIP(r)
+}
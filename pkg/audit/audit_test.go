@@ -0,0 +1,168 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func setUp(format string) *bytes.Buffer {
+	cfg.InitForTestPurposes()
+	Configure()
+	cfg.Cfg.Audit.Format = format
+	buf := &bytes.Buffer{}
+	SetOutput(buf)
+	return buf
+}
+
+func request() *http.Request {
+	r, _ := http.NewRequest("GET", "http://vouch.example.com/auth/state/", nil)
+	r.RemoteAddr = "192.0.2.10:54321"
+	return r
+}
+
+// CEF:0|vendor|product|version|signature|name|severity|key=value key=value...
+var cefLine = regexp.MustCompile(`^CEF:0\|([^|\\]|\\.)*\|([^|\\]|\\.)*\|([^|\\]|\\.)*\|([^|\\]|\\.)*\|([^|\\]|\\.)*\|(10|[0-9])\|(\w+=([^=\\]|\\.)*)( \w+=([^=\\]|\\.)*)*$`)
+
+func TestLogCEF(t *testing.T) {
+	buf := setUp(cfg.AuditCEF)
+	Version = "v1.2|3"
+
+	Log(request(), Authz, "test@example.com", Failure, `not in teamWhitelist a=b \ c`)
+
+	line := strings.TrimSuffix(buf.String(), "\n")
+	assert.Regexp(t, cefLine, line)
+	assert.True(t, strings.HasPrefix(line, `CEF:0|Vouch|Vouch Proxy|v1.2\|3|authz|authz failure|5|`), line)
+	assert.Contains(t, line, "suser=test@example.com ")
+	assert.Contains(t, line, "src=192.0.2.10 ")
+	assert.Contains(t, line, "dhost=vouch.example.com ")
+	assert.Contains(t, line, "outcome=failure ")
+	assert.Contains(t, line, `reason=not in teamWhitelist a\=b \\ c`)
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+}
+
+func TestLogLEEF(t *testing.T) {
+	buf := setUp(cfg.AuditLEEF)
+	Version = "v1.2"
+
+	Log(request(), Login, "test@example.com", Success, "")
+
+	line := strings.TrimSuffix(buf.String(), "\n")
+	assert.True(t, strings.HasPrefix(line, "LEEF:1.0|Vouch|Vouch Proxy|v1.2|login|devTime="), line)
+	fields := strings.Split(strings.SplitN(line, "|", 6)[5], "\t")
+	assert.Contains(t, fields, "usrName=test@example.com")
+	assert.Contains(t, fields, "src=192.0.2.10")
+	assert.Contains(t, fields, "outcome=success")
+}
+
+func TestLogJSON(t *testing.T) {
+	buf := setUp(cfg.AuditJSON)
+
+	Log(request(), Logout, "test@example.com", Success, "")
+
+	e := Event{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &e))
+	assert.Equal(t, Logout, e.Name)
+	assert.Equal(t, "test@example.com", e.User)
+	assert.Equal(t, "192.0.2.10", e.Src)
+	assert.WithinDuration(t, time.Now(), e.Time, time.Minute)
+}
+
+func TestLogCode(t *testing.T) {
+	buf := setUp(cfg.AuditJSON)
+	LogCode(request(), Authz, "test@example.com", Failure, "email_unverified", "denied")
+	e := Event{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &e))
+	assert.Equal(t, "email_unverified", e.Code)
+	assert.Contains(t, buf.String(), `"reason_code":"email_unverified"`)
+
+	buf = setUp(cfg.AuditCEF)
+	LogCode(request(), Authz, "test@example.com", Failure, "email_unverified", "denied")
+	line := strings.TrimSuffix(buf.String(), "\n")
+	assert.Regexp(t, cefLine, line)
+	assert.True(t, strings.HasSuffix(line, " cs1Label=reasonCode cs1=email_unverified"), line)
+
+	buf = setUp(cfg.AuditLEEF)
+	LogCode(request(), Authz, "test@example.com", Failure, "email_unverified", "denied")
+	assert.Contains(t, strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\t"), "reasonCode=email_unverified")
+
+	// without a code there's nothing to aggregate by
+	buf = setUp(cfg.AuditCEF)
+	Log(request(), Authz, "test@example.com", Failure, "denied")
+	assert.NotContains(t, buf.String(), "cs1")
+}
+
+func TestAuthorization(t *testing.T) {
+	buf := setUp(cfg.AuditJSON)
+	d := Decision{User: "test", Email: "test@example.com", Rule: RuleTeamWhiteList, URL: "https://app.example.com/", Reason: "not in teamWhitelist"}
+	Authorization(request(), d)
+	e := Event{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &e))
+	assert.Equal(t, Authz, e.Name)
+	assert.Equal(t, Failure, e.Outcome)
+	assert.Equal(t, Deny, e.Decision)
+	assert.Equal(t, RuleTeamWhiteList, e.Rule)
+	assert.Equal(t, "test@example.com", e.Email)
+	assert.Equal(t, "https://app.example.com/", e.URL)
+	assert.Equal(t, "not in teamWhitelist", e.Reason)
+
+	buf = setUp(cfg.AuditCEF)
+	d.Allowed = true
+	d.Reason = ""
+	Authorization(request(), d)
+	line := strings.TrimSuffix(buf.String(), "\n")
+	assert.Regexp(t, cefLine, line)
+	assert.Contains(t, line, "outcome=success ")
+	assert.Contains(t, line, "cs2Label=rule cs2=TeamWhiteList act=allow ")
+	assert.Contains(t, line, "cs3Label=email cs3=test@example.com ")
+	assert.Contains(t, line, "request=https://app.example.com/")
+
+	buf = setUp(cfg.AuditLEEF)
+	Authorization(request(), d)
+	fields := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\t")
+	assert.Contains(t, fields, "rule=TeamWhiteList")
+	assert.Contains(t, fields, "decision=allow")
+	assert.Contains(t, fields, "email=test@example.com")
+}
+
+func TestLogDisabled(t *testing.T) {
+	setUp(cfg.AuditJSON)
+	SetOutput(nil)
+	// nothing to write to, nothing happens
+	Log(request(), Logout, "test@example.com", Success, "")
+}
+
+func TestLogWhileSetOutput(t *testing.T) {
+	buf := setUp(cfg.AuditJSON)
+	// under `go test -race`, Log must not read the writer which SetOutput is replacing
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			SetOutput(buf)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		Log(request(), Logout, "test@example.com", Success, "")
+	}
+	<-done
+	assert.Equal(t, 100, strings.Count(buf.String(), "\n"))
+}
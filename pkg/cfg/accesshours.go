@@ -0,0 +1,146 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AccessHours restricts access to Hosts (or their subdomains) to a daily window
+// a window whose End is before its Start crosses midnight, and belongs to the day on which it starts
+type AccessHours struct {
+	Hosts    []string `mapstructure:"hosts"`
+	Timezone string   `mapstructure:"timezone"`
+	// Days three letter day names (`mon`, `tue`...) on which the window opens, defaults to every day
+	Days  []string `mapstructure:"days"`
+	Start string   `mapstructure:"start"` // 15:04
+	End   string   `mapstructure:"end"`   // 15:04
+
+	location *time.Location
+	days     map[time.Weekday]bool
+	start    int // minutes after midnight
+	end      int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// configureAccessHours parses the timezone, days and times of each `vouch.access_hours` rule
+func configureAccessHours() error {
+	for i := range Cfg.AccessHours {
+		a := &Cfg.AccessHours[i]
+		if len(a.Hosts) == 0 {
+			return fmt.Errorf("configuration error: %s.access_hours[%d].hosts is not set", Branding.LCName, i)
+		}
+		loc, err := time.LoadLocation(a.Timezone)
+		if err != nil {
+			return fmt.Errorf("configuration error: %s.access_hours[%d].timezone: %w", Branding.LCName, i, err)
+		}
+		a.location = loc
+
+		a.days = make(map[time.Weekday]bool)
+		for _, d := range a.Days {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return fmt.Errorf("configuration error: %s.access_hours[%d].days: unknown day %q", Branding.LCName, i, d)
+			}
+			a.days[wd] = true
+		}
+		if len(a.days) == 0 {
+			for _, wd := range weekdays {
+				a.days[wd] = true
+			}
+		}
+
+		if a.start, err = minutesAfterMidnight(a.Start); err != nil {
+			return fmt.Errorf("configuration error: %s.access_hours[%d].start: %w", Branding.LCName, i, err)
+		}
+		if a.end, err = minutesAfterMidnight(a.End); err != nil {
+			return fmt.Errorf("configuration error: %s.access_hours[%d].end: %w", Branding.LCName, i, err)
+		}
+		if a.start == a.end {
+			return fmt.Errorf("configuration error: %s.access_hours[%d] start and end are both %s", Branding.LCName, i, a.Start)
+		}
+	}
+	return nil
+}
+
+func minutesAfterMidnight(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not in the form 15:04", hhmm)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Matches is true if host is one of the Hosts or a subdomain of one
+func (a *AccessHours) Matches(host string) bool {
+	return matchesHost(a.Hosts, host)
+}
+
+// IDTokenHostAllowed is true if the `headers.idtoken` header may be sent to host, see `headers.idtoken_hosts`
+func (c *Config) IDTokenHostAllowed(host string) bool {
+	return len(c.Headers.IDTokenHosts) == 0 || matchesHost(c.Headers.IDTokenHosts, host)
+}
+
+// StepUpRequired is true if host is one of `vouch.step_up_hosts` or a subdomain of one
+func (c *Config) StepUpRequired(host string) bool {
+	return matchesHost(c.StepUpHosts, host)
+}
+
+// matchesHost is true if host, without any port, is one of hosts or a subdomain of one
+func matchesHost(hosts []string, host string) bool {
+	host = strings.ToLower(strings.Split(host, ":")[0])
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows is true if t falls within the window, from Start up to but not including End
+func (a *AccessHours) Allows(t time.Time) bool {
+	t = t.In(a.location)
+	m := t.Hour()*60 + t.Minute()
+	if a.start < a.end {
+		return a.days[t.Weekday()] && m >= a.start && m < a.end
+	}
+	// the window crosses midnight
+	if m >= a.start {
+		return a.days[t.Weekday()]
+	}
+	if m < a.end {
+		return a.days[t.AddDate(0, 0, -1).Weekday()]
+	}
+	return false
+}
+
+// AccessHoursAllow is false if host is covered by an `access_hours` rule whose window is closed at t
+// every rule matching the host must allow access
+func (c *Config) AccessHoursAllow(host string, t time.Time) bool {
+	for i := range c.AccessHours {
+		if c.AccessHours[i].Matches(host) && !c.AccessHours[i].Allows(t) {
+			return false
+		}
+	}
+	return true
+}
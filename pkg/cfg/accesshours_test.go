@@ -0,0 +1,90 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessHoursAllows(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 2021-03-01 is a Monday
+	at := func(day, hour, min int) time.Time { return time.Date(2021, 3, day, hour, min, 0, 0, ny) }
+
+	tests := []struct {
+		name   string
+		window AccessHours
+		t      time.Time
+		want   bool
+	}{
+		{"business hours noon", AccessHours{Start: "09:00", End: "17:00"}, at(1, 12, 0), true},
+		{"business hours 3am", AccessHours{Start: "09:00", End: "17:00"}, at(1, 3, 0), false},
+		{"business hours opens at start", AccessHours{Start: "09:00", End: "17:00"}, at(1, 9, 0), true},
+		{"business hours one minute before start", AccessHours{Start: "09:00", End: "17:00"}, at(1, 8, 59), false},
+		{"business hours last minute", AccessHours{Start: "09:00", End: "17:00"}, at(1, 16, 59), true},
+		{"business hours closed at end", AccessHours{Start: "09:00", End: "17:00"}, at(1, 17, 0), false},
+		{"weekdays only on saturday", AccessHours{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "09:00", End: "17:00"}, at(6, 12, 0), false},
+		{"other timezone", AccessHours{Start: "09:00", End: "17:00"}, time.Date(2021, 3, 1, 17, 0, 0, 0, time.UTC), true},
+		{"overnight before midnight", AccessHours{Start: "22:00", End: "06:00"}, at(1, 23, 30), true},
+		{"overnight after midnight", AccessHours{Start: "22:00", End: "06:00"}, at(2, 5, 59), true},
+		{"overnight closed at end", AccessHours{Start: "22:00", End: "06:00"}, at(2, 6, 0), false},
+		{"overnight closed midday", AccessHours{Start: "22:00", End: "06:00"}, at(1, 12, 0), false},
+		{"overnight at midnight", AccessHours{Start: "22:00", End: "06:00"}, at(2, 0, 0), true},
+		// the window opening friday night runs into saturday, but none opens saturday night
+		{"overnight friday into saturday", AccessHours{Days: []string{"fri"}, Start: "22:00", End: "06:00"}, at(6, 2, 0), true},
+		{"overnight saturday into sunday", AccessHours{Days: []string{"fri"}, Start: "22:00", End: "06:00"}, at(7, 2, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.window.Hosts = []string{"example.com"}
+			tt.window.Timezone = "America/New_York"
+			Cfg = &Config{AccessHours: []AccessHours{tt.window}}
+			assert.NoError(t, configureAccessHours())
+			assert.Equal(t, tt.want, Cfg.AccessHours[0].Allows(tt.t))
+		})
+	}
+}
+
+func TestAccessHoursAllow(t *testing.T) {
+	Cfg = &Config{AccessHours: []AccessHours{{Hosts: []string{"example.com"}, Timezone: "UTC", Start: "09:00", End: "17:00"}}}
+	assert.NoError(t, configureAccessHours())
+
+	night := time.Date(2021, 3, 1, 3, 0, 0, 0, time.UTC)
+	assert.False(t, Cfg.AccessHoursAllow("example.com", night))
+	assert.False(t, Cfg.AccessHoursAllow("app.example.com:8443", night))
+	assert.True(t, Cfg.AccessHoursAllow("notexample.com", night))
+	assert.True(t, Cfg.AccessHoursAllow("example.com", night.Add(9*time.Hour)))
+}
+
+func TestConfigureAccessHoursErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		window AccessHours
+	}{
+		{"no hosts", AccessHours{Timezone: "UTC", Start: "09:00", End: "17:00"}},
+		{"unknown timezone", AccessHours{Hosts: []string{"example.com"}, Timezone: "Mars/Olympus_Mons", Start: "09:00", End: "17:00"}},
+		{"unknown day", AccessHours{Hosts: []string{"example.com"}, Days: []string{"someday"}, Start: "09:00", End: "17:00"}},
+		{"bad start", AccessHours{Hosts: []string{"example.com"}, Start: "9am", End: "17:00"}},
+		{"empty window", AccessHours{Hosts: []string{"example.com"}, Start: "09:00", End: "09:00"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Cfg = &Config{AccessHours: []AccessHours{tt.window}}
+			assert.Error(t, configureAccessHours())
+		})
+	}
+}
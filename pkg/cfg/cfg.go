@@ -11,15 +11,25 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package cfg
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/dgrijalva/jwt-go"
@@ -29,6 +39,7 @@ import (
 	securerandom "github.com/theckman/go-securerandom"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/http/httpguts"
 )
 
 // Config vouch jwt cookie configuration
@@ -46,7 +57,24 @@ type Config struct {
 	TeamWhiteList []string `mapstructure:"teamWhitelist"`
 	AllowAllUsers bool     `mapstructure:"allowAllUsers"`
 	PublicAccess  bool     `mapstructure:"publicAccess"`
-	TLS           struct {
+	Groups        struct {
+		Claim    string `mapstructure:"claim"`
+		Max      int    `mapstructure:"max"`
+		Strategy string `mapstructure:"strategy"`
+		// RefreshInterval in minutes between fetching the user's groups again from the userinfo endpoint, 0 never
+		RefreshInterval int `mapstructure:"refresh_interval" envconfig:"refresh_interval"`
+		// HeaderStyle how the groups claim is passed in its header, see GroupsHeaderQuoted
+		HeaderStyle string `mapstructure:"header_style" envconfig:"header_style"`
+		// HeaderDelimiter between the groups with the joined HeaderStyle
+		HeaderDelimiter string `mapstructure:"header_delimiter" envconfig:"header_delimiter"`
+	}
+	// WhiteListRegexps the compiled `regex:` entries of the WhiteList, see configureWhiteList()
+	WhiteListRegexps []*regexp.Regexp `mapstructure:"-" envconfig:"-"`
+	// EmailRegex overrides DefaultEmailRegex, such as to accept the addresses of service accounts
+	EmailRegex string `mapstructure:"email_regex" envconfig:"email_regex"`
+	// EmailRegexp the compiled EmailRegex, see configureEmailRegex()
+	EmailRegexp *regexp.Regexp `mapstructure:"-" envconfig:"-"`
+	TLS         struct {
 		Cert    string `mapstructure:"cert"`
 		Key     string `mapstructure:"key"`
 		Profile string `mapstructure:"profile"`
@@ -59,14 +87,41 @@ type Config struct {
 		PrivateKeyFile string `mapstructure:"private_key_file"`
 		PublicKeyFile  string `mapstructure:"public_key_file"`
 		Compress       bool   `mapstructure:"compress"`
+		// Encrypt the signed jwt as a JWE, with a key derived from the Secret, so the browser can't read the user's claims
+		Encrypt bool `mapstructure:"encrypt"`
+		// Rolling reissue the cookie at /validate once the jwt is within Window minutes of expiry
+		Rolling struct {
+			Enabled bool `mapstructure:"enabled"`
+			Window  int  `mapstructure:"window"`
+		} `mapstructure:"rolling"`
+		// IdleTimeout minutes without a request at /validate after which the session ends, well before the jwt expires
+		IdleTimeout int `mapstructure:"idle_timeout" envconfig:"idle_timeout"`
+		// AudienceKeys the `headers.assertion` for each Audience is signed with a key of its own rather than the jwt's
+		AudienceKeys []AudienceKey `mapstructure:"audience_keys" envconfig:"-"`
 	}
 	Cookie struct {
-		Name     string `mapstructure:"name"`
+		Name string `mapstructure:"name"`
+		// Domain of the cookie, CookieDomainAuto for the longest of `vouch.domains` the request is for, CookieDomainOff for none
 		Domain   string `mapstructure:"domain"`
 		Secure   bool   `mapstructure:"secure"`
 		HTTPOnly bool   `mapstructure:"httpOnly"`
 		MaxAge   int    `mapstructure:"maxage"`
 		SameSite string `mapstructure:"sameSite"`
+		// MaxChunkSize the size in bytes of each cookie, attributes and all, a larger jwt is split into several cookies
+		MaxChunkSize int `mapstructure:"max_chunk_size" envconfig:"max_chunk_size"`
+		// Compress gzip the jwt before it's split into cookies
+		Compress bool `mapstructure:"compress"`
+
+		// TenantClaim the claim naming the user's tenant, whose cookie is scoped to the tenant's domain in TenantDomains
+		TenantClaim   string            `mapstructure:"tenant_claim" envconfig:"tenant_claim"`
+		TenantDomains map[string]string `mapstructure:"tenant_domains" envconfig:"tenant_domains"`
+		// Profile a second cookie, readable by scripts, holding only the allowlisted Claims of the user as JSON
+		Profile struct {
+			Enabled bool     `mapstructure:"enabled"`
+			Name    string   `mapstructure:"name"`
+			Claims  []string `mapstructure:"claims"`
+		} `mapstructure:"profile" envconfig:"profile"`
+		HostOnly bool // set by `cookie.domain: off`, the cookie is sent back only to the host which set it
 	}
 
 	Headers struct {
@@ -80,19 +135,350 @@ type Config struct {
 		Claims        []string          `mapstructure:"claims"`
 		AccessToken   string            `mapstructure:"accesstoken"`
 		IDToken       string            `mapstructure:"idtoken"`
+		UID           string            `mapstructure:"uid"`
+		UIDClaim      string            `mapstructure:"uidclaim"`
+		Assertion     string            `mapstructure:"assertion"`
+		Role          string            `mapstructure:"role"`
 		ClaimsCleaned map[string]string // the rawClaim is mapped to the actual claims header
-	}
+		// Prefix begins the name of each header in place of X-Vouch-, such as X-Auth- where another auth proxy uses X-Vouch-
+		Prefix string `mapstructure:"prefix"`
+
+		// ObjectClaims how a claim whose value is a JSON object is passed in its header
+		ObjectClaims string `mapstructure:"object_claims" envconfig:"object_claims"`
+		// LogoutURL the header carrying the url of /logout which returns the user to the requested host
+		LogoutURL string `mapstructure:"logout_url" envconfig:"logout_url"`
+		// IDTokenHosts the only hosts (or their subdomains) sent the IDToken header, every host if empty
+		IDTokenHosts []string `mapstructure:"idtoken_hosts" envconfig:"idtoken_hosts"`
+		// ErrorCode the header carrying the reason code of the `deny_rules` entry which refused the user, not sent if empty
+		ErrorCode string `mapstructure:"error_code" envconfig:"error_code"`
+		// ClaimHeaders each header is passed the claim at its path, such as `realm_access.roles[0]`
+		ClaimHeaders map[string]string `mapstructure:"claim_headers" envconfig:"claim_headers"`
+		// ClaimHeadersSeparator joins the values of a claim of ClaimHeaders which is an array
+		ClaimHeadersSeparator string `mapstructure:"claim_headers_separator" envconfig:"claim_headers_separator"`
+		// AccessTokenEncrypt a base64 encoded 256 bit key shared with the upstream, see AccessTokenKey
+		// the AccessToken header is then a compact JWE of the access token rather than the token itself
+		AccessTokenEncrypt string `mapstructure:"accesstoken_encrypt" envconfig:"accesstoken_encrypt"`
+		// AcceptBearer the jwt may be sent as `Authorization: Bearer` by a client which doesn't keep the cookie
+		AcceptBearer bool `mapstructure:"accept_bearer" envconfig:"accept_bearer"`
+	}
+	// StatelessState the OAuth state is a short lived token signed with a key derived from the jwt.secret, which carries
+	// the requested url to /auth/{state}/ in place of the login session
+	StatelessState bool `mapstructure:"stateless_state" envconfig:"stateless_state"`
+
 	Session struct {
-		Name string `mapstructure:"name"`
-		Key  string `mapstructure:"key"`
-	}
+		Name     string `mapstructure:"name"`
+		Key      string `mapstructure:"key"`
+		SIDClaim string `mapstructure:"sid_claim"`
+		// StateBytes of randomness in the OAuth state nonce
+		StateBytes int `mapstructure:"state_bytes" envconfig:"state_bytes"`
+		// Rotate mint a new session at each /login which may be used only once
+		Rotate bool `mapstructure:"rotate"`
+		// StoreShards the in-memory store of used login sessions is split into, each with its own lock
+		StoreShards int `mapstructure:"store_shards" envconfig:"store_shards"`
+		// Backend where the login sessions are kept, see SessionBackendCookie
+		Backend string `mapstructure:"backend"`
+		// Timeout seconds for each command to a network backed store
+		Timeout int `mapstructure:"timeout"`
+		// SaveRetries times a failed save of a login session is tried again
+		SaveRetries int `mapstructure:"save_retries" envconfig:"save_retries"`
+		// Redis the server holding the login sessions with the redis Backend
+		Redis struct {
+			Addr     string `mapstructure:"addr"`
+			Password string `mapstructure:"password"`
+			DB       int    `mapstructure:"db"`
+			TLS      bool   `mapstructure:"tls"`
+			// KeyPrefix of the key of each session, followed by its state nonce
+			KeyPrefix string `mapstructure:"key_prefix" envconfig:"key_prefix"`
+		} `mapstructure:"redis"`
+	}
+	// RevocationStore the shared store of the users whose sessions were revoked by an admin at /logout?user=
+	RevocationStore struct {
+		// Backend RevocationStoreRedis, or empty for none
+		Backend string `mapstructure:"backend"`
+		// AdminTeams the user must be a member of one of these to revoke another's sessions
+		AdminTeams []string `mapstructure:"admin_teams" envconfig:"admin_teams"`
+		Redis      struct {
+			Addr     string `mapstructure:"addr"`
+			Password string `mapstructure:"password"`
+			DB       int    `mapstructure:"db"`
+			TLS      bool   `mapstructure:"tls"`
+			// KeyPrefix of the key of each revocation, followed by the username
+			KeyPrefix string `mapstructure:"key_prefix" envconfig:"key_prefix"`
+		} `mapstructure:"redis"`
+	} `mapstructure:"revocation_store" envconfig:"revocation_store"`
+	// ClientCert log in at /validate a user presenting a client certificate verified by nginx, without the OAuth round trip
+	ClientCert struct {
+		Enabled bool `mapstructure:"enabled"`
+		// TrustHeaders acknowledges that nginx sets both headers, replacing any sent by the client, required with Enabled
+		TrustHeaders bool `mapstructure:"trust_headers" envconfig:"trust_headers"`
+		// DNHeader holds the subject DN of the certificate, nginx's $ssl_client_s_dn
+		DNHeader string `mapstructure:"dn_header" envconfig:"dn_header"`
+		// VerifyHeader holds the result of the verification, nginx's $ssl_client_verify, which must be SUCCESS
+		VerifyHeader string `mapstructure:"verify_header" envconfig:"verify_header"`
+	} `mapstructure:"client_cert" envconfig:"client_cert"`
 	TestURL            string   `mapstructure:"test_url"`
 	TestURLs           []string `mapstructure:"test_urls"`
 	Testing            bool     `mapstructure:"testing"`
 	LogoutRedirectURLs []string `mapstructure:"post_logout_redirect_uris" envconfig:"post_logout_redirect_uris"`
+	// PostLogoutRedirectURI where /logout sends the user when no `?url=` is given, through the provider's end_session_endpoint if it's set
+	PostLogoutRedirectURI string `mapstructure:"post_logout_redirect_uri" envconfig:"post_logout_redirect_uri"`
+	// PostLogoutRedirectRules choose the PostLogoutRedirectURI of the user by their claims, the first matching rule wins
+	PostLogoutRedirectRules []LogoutRedirectRule `mapstructure:"post_logout_redirect_rules" envconfig:"-"`
+	// RequiredClaims must be found in the claims from the IdP or the login is refused
+	RequiredClaims []string `mapstructure:"required_claims" envconfig:"required_claims"`
+	// RetryAfter seconds sent in the `Retry-After` header of a 503 unless the feature shedding load knows better
+	RetryAfter int `mapstructure:"retry_after" envconfig:"retry_after"`
+	// RequestedURLMaxLength the longest URL that may be requested at /login for the redirect after login
+	RequestedURLMaxLength int `mapstructure:"requested_url_max_length" envconfig:"requested_url_max_length"`
+	// Templates override the built-in index.tmpl and login_options.tmpl with those found in Dir
+	Templates struct {
+		Dir string `mapstructure:"dir"`
+	} `mapstructure:"templates"`
+	// AccessDeniedMessage is shown when the user declines consent at the IdP (`error=access_denied`)
+	AccessDeniedMessage string `mapstructure:"access_denied_message" envconfig:"access_denied_message"`
+	// Forwarded which of the values to use when a chain of proxies has each appended to an X-Forwarded-* header
+	// and whether the X-Forwarded-* headers or the RFC 7239 `Forwarded` header is read first, see ForwardedHeaderX
+	Forwarded struct {
+		Select      string `mapstructure:"select"`
+		TrustedHops int    `mapstructure:"trusted_hops" envconfig:"trusted_hops"`
+		Header      string `mapstructure:"header"`
+	}
+	// ProxyProtocol every connection must begin with a PROXY protocol header from an L4 load balancer
+	ProxyProtocol bool `mapstructure:"proxy_protocol" envconfig:"proxy_protocol"`
+	// ShutdownTimeout seconds to wait on SIGTERM or SIGINT for the requests in flight to finish
+	ShutdownTimeout int `mapstructure:"shutdown_timeout" envconfig:"shutdown_timeout"`
+	// Audit login, authz and logout events for a SIEM
+	Audit struct {
+		Enabled bool   `mapstructure:"enabled"`
+		File    string `mapstructure:"file"`
+		Format  string `mapstructure:"format"`
+		// Validate also record the decision of each /validate which isn't answered from the jwtcache
+		Validate bool `mapstructure:"validate"`
+	}
+	// Provisioning webhook which must succeed before the JWT is issued
+	Provisioning struct {
+		URL     string `mapstructure:"url"`
+		Timeout int    `mapstructure:"timeout"` // in seconds
+		Message string `mapstructure:"message"`
+	}
+	// Enrichment webhook which adds attributes from an internal directory to the claims
+	Enrichment struct {
+		URL      string `mapstructure:"url"`
+		Timeout  int    `mapstructure:"timeout"` // in seconds
+		FailOpen bool   `mapstructure:"fail_open" envconfig:"fail_open"`
+	}
+	// OAuthClient the client making requests to the IdP, see OAuthClientTLSConfig()
+	OAuthClient struct {
+		Timeout int `mapstructure:"timeout"` // in seconds
+		// CABundle a PEM file of CAs trusted along with the system's, for a self-hosted IdP with a private CA
+		CABundle           string `mapstructure:"ca_bundle" envconfig:"ca_bundle"`
+		InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify" envconfig:"insecure_skip_verify"`
+	} `mapstructure:"oauth_client" envconfig:"oauth_client"`
+	// GroupNormalization rewrites the provider's group names into a canonical form per its Rules
+	// with Teams the canonical groups of the `groups.claim` are also added to the user's team memberships
+	GroupNormalization struct {
+		Teams bool        `mapstructure:"teams"`
+		Rules []GroupRule `mapstructure:"rules" envconfig:"-"`
+	} `mapstructure:"group_normalization"`
+	// Lockdown refuses new logins with a 503, such as during maintenance or an incident
+	// except for the AllowUsers and the members of AllowGroups, so that the incident team isn't locked out
+	Lockdown struct {
+		Enabled     bool     `mapstructure:"enabled"`
+		AllowUsers  []string `mapstructure:"allow_users" envconfig:"allow_users"`
+		AllowGroups []string `mapstructure:"allow_groups" envconfig:"allow_groups"`
+	}
+	// CSRF issues a token in a cookie which scripts may read, alongside the JWT
+	// /validate then requires requests which change state to send it back in the Header (the double submit pattern)
+	CSRF struct {
+		Enabled    bool   `mapstructure:"enabled"`
+		CookieName string `mapstructure:"cookie_name" envconfig:"cookie_name"`
+		Header     string `mapstructure:"header"`
+	}
+	// Roles derive a single role for the user from their claims, passed to applications in the `headers.role` header
+	Roles struct {
+		Default string     `mapstructure:"default"`
+		Rules   []RoleRule `mapstructure:"rules" envconfig:"-"`
+		// Coercion whether a claim which is a string holding a number or a boolean is compared as one
+		Coercion string `mapstructure:"coercion"`
+	}
+	// DenyRules refuse the login of a user by their claims, the first matching rule's reason code is audited
+	DenyRules []DenyRule `mapstructure:"deny_rules" envconfig:"-"`
+	// SelfTest at startup check the JWT can be signed and verified and the provider can be reached
+	// OnFailure whether a failure stops startup or is logged and reported at /readyz
+	SelfTest struct {
+		Enabled   bool   `mapstructure:"enabled"`
+		OnFailure string `mapstructure:"on_failure" envconfig:"on_failure"`
+	} `mapstructure:"self_test" envconfig:"self_test"`
+	// ConditionalValidate /validate passes the session's fingerprint in Header, a backend which sends it back in RequestHeader
+	// is answered with only the user, success and fingerprint headers for as long as the session is unchanged
+	ConditionalValidate struct {
+		Enabled       bool   `mapstructure:"enabled"`
+		Header        string `mapstructure:"header"`
+		RequestHeader string `mapstructure:"request_header" envconfig:"request_header"`
+	} `mapstructure:"conditional_validate" envconfig:"conditional_validate"`
+	// ServerTiming add a Server-Timing header breaking down where the time of the request went, such as the token exchange at /auth
+	ServerTiming struct {
+		Enabled bool `mapstructure:"enabled"`
+	} `mapstructure:"server_timing" envconfig:"server_timing"`
+	// Metrics /metrics for Prometheus, on Listen (such as 127.0.0.1:9091) rather than the public listener if it's set
+	Metrics struct {
+		Enabled bool   `mapstructure:"enabled"`
+		Listen  string `mapstructure:"listen"`
+	}
+	// Tracing OpenTelemetry spans of /login, /auth and the requests to the provider, sent to the OTLP/HTTP collector at Endpoint
+	Tracing struct {
+		Enabled     bool    `mapstructure:"enabled"`
+		Endpoint    string  `mapstructure:"endpoint"`
+		ServiceName string  `mapstructure:"service_name" envconfig:"service_name"`
+		SampleRate  float64 `mapstructure:"sample_rate" envconfig:"sample_rate"`
+	} `mapstructure:"tracing"`
+	// Readiness /readyz answers 503 while a provider has failed FailureThreshold token exchanges in a row
+	// the last of them within FailureWindow seconds
+	Readiness struct {
+		FailureThreshold int `mapstructure:"failure_threshold" envconfig:"failure_threshold"`
+		FailureWindow    int `mapstructure:"failure_window" envconfig:"failure_window"`
+	}
+	// Healthcheck /healthcheck answers 200 without checking anything unless DeepCheck
+	// then it also checks that the provider's auth_url and the session backend can be reached, see handlers.HealthcheckHandler
+	Healthcheck struct {
+		DeepCheck bool `mapstructure:"deep_check" envconfig:"deep_check"`
+	}
+	// LoginOptions are presented on a selection page at /login, sorted by Weight
+	LoginOptions []LoginOption `mapstructure:"login_options"`
+	// ClaimTransforms split a claim holding a distinguished name or a path into its components
+	ClaimTransforms []ClaimTransform `mapstructure:"claim_transforms" envconfig:"-"`
+	// AccessHours limit some hosts to permitted hours, such as business hours
+	AccessHours []AccessHours `mapstructure:"access_hours" envconfig:"-"`
+	// NetworkRules limit some hosts to clients from permitted networks, countries or autonomous systems
+	NetworkRules []NetworkRule `mapstructure:"network_rules" envconfig:"-"`
+	// Policies who may reach some hosts, the first policy covering the requested host applies
+	Policies []Policy `mapstructure:"policies" envconfig:"-"`
+	// StepUpHosts the hosts (or their subdomains) which also require the user to confirm with a passkey at /stepup
+	StepUpHosts []string `mapstructure:"step_up_hosts" envconfig:"step_up_hosts"`
+	// StepUpAdminTeams the teams whose members get the links with which users enrol a passkey, at /stepup/enrol
+	StepUpAdminTeams []string `mapstructure:"step_up_admin_teams" envconfig:"step_up_admin_teams"`
+	// SAML a SAML 2.0 IdP in place of the OAuth provider, see SAML
+	SAML SAML `mapstructure:"saml" envconfig:"saml"`
+	// ExternalAuth per id overrides for `/_external-auth-{id}`
+	ExternalAuth map[string]ExternalAuth `mapstructure:"external_auth" envconfig:"-"`
+	// GeoIP MaxMind DB files used by network_rules to find the country and ASN of the client
+	GeoIP struct {
+		CountryDB string `mapstructure:"country_db" envconfig:"country_db"`
+		ASNDB     string `mapstructure:"asn_db" envconfig:"asn_db"`
+	} `mapstructure:"geoip"`
+	// TokenClaims are added to every JWT issued by Vouch Proxy
+	TokenClaims []TokenClaim `mapstructure:"token_claims" envconfig:"-"`
+	// CaseInsensitiveTeams compare the user's team memberships with the TeamWhiteList without regard to case
+	CaseInsensitiveTeams bool `mapstructure:"case_insensitive_teams" envconfig:"case_insensitive_teams"`
+	// RateLimit the requests of each client address to /login and /auth, a token bucket of Burst refilled at RequestsPerMinute
+	// the buckets of at most MaxClients addresses are kept, the least recently seen are dropped first
+	RateLimit struct {
+		RequestsPerMinute int `mapstructure:"requests_per_minute" envconfig:"requests_per_minute"`
+		Burst             int `mapstructure:"burst"`
+		MaxClients        int `mapstructure:"max_clients" envconfig:"max_clients"`
+	} `mapstructure:"rate_limit" envconfig:"rate_limit"`
+	// Lockout answers 429 for Duration seconds to a client address which failed Threshold logins at /auth within Window seconds
+	// the failures of at most MaxClients addresses are kept, in the Redis of `session.backend` if Shared
+	Lockout struct {
+		Threshold  int  `mapstructure:"threshold"`
+		Window     int  `mapstructure:"window"`
+		Duration   int  `mapstructure:"duration"`
+		MaxClients int  `mapstructure:"max_clients" envconfig:"max_clients"`
+		Shared     bool `mapstructure:"shared"`
+	} `mapstructure:"lockout"`
+	// CSP send the Content-Security-Policy Policy with the pages of Vouch Proxy, a nonce for each response replaces {nonce}
+	CSP struct {
+		Enabled bool   `mapstructure:"enabled"`
+		Policy  string `mapstructure:"policy"`
+	} `mapstructure:"csp"`
+	// CORS lets the pages of AllowedOrigins call /validate and /auth with fetch, none are allowed by default
+	CORS struct {
+		// AllowedOrigins such as `https://app.example.com`, `https://*.example.com` for its subdomains, or `*` for any without credentials
+		AllowedOrigins   []string `mapstructure:"allowed_origins" envconfig:"allowed_origins"`
+		AllowCredentials bool     `mapstructure:"allow_credentials" envconfig:"allow_credentials"`
+	} `mapstructure:"cors"`
+}
+
+// RoleRule the user is given Role if the Claim (a string or a list) holds any of the Values
+// or, with an Operator such as `>=`, compares with the one value
+// rules are evaluated in order and the first match wins
+type RoleRule struct {
+	Role     string   `mapstructure:"role"`
+	Claim    string   `mapstructure:"claim"`
+	Operator string   `mapstructure:"operator"`
+	Values   []string `mapstructure:"values"`
+}
+
+// DenyRule the login of a user whose Claim matches, as for a RoleRule, is refused with Message
+// ReasonCode is the operator's stable name for the rule, recorded by the audit log and sent in `headers.error_code`
+type DenyRule struct {
+	Claim      string   `mapstructure:"claim"`
+	Operator   string   `mapstructure:"operator"`
+	Values     []string `mapstructure:"values"`
+	ReasonCode string   `mapstructure:"reason_code"`
+	Message    string   `mapstructure:"message"`
+}
+
+// LogoutRedirectRule a user whose Claim matches, as for a RoleRule, is sent to URL after /logout
+type LogoutRedirectRule struct {
+	Claim    string   `mapstructure:"claim"`
+	Operator string   `mapstructure:"operator"`
+	Values   []string `mapstructure:"values"`
+	URL      string   `mapstructure:"url"`
+}
+
+// AudienceKey sign the assertions for Audience, a requested host, with this key
+// the public key of an RS* or ES* key is derived from the PrivateKeyFile
+type AudienceKey struct {
+	Audience       string `mapstructure:"audience"`
+	SigningMethod  string `mapstructure:"signing_method"`
+	Secret         string `mapstructure:"secret"`
+	PrivateKeyFile string `mapstructure:"private_key_file"`
+}
+
+// SigningKey the secret of an HS* SigningMethod, or the private key
+func (k AudienceKey) SigningKey() (interface{}, error) {
+	if strings.HasPrefix(k.SigningMethod, "HS") {
+		return []byte(k.Secret), nil
+	}
+	return privateKey(k.SigningMethod, k.PrivateKeyFile)
+}
+
+// reasonCodeRE a reason code is safe to send in a header and to aggregate by
+var reasonCodeRE = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ClaimTransform split the Claim (a string or a list) per Split into its components
+// which are set as the Target claim and, with Teams, added to the user's team memberships checked against the teamWhitelist
+type ClaimTransform struct {
+	Claim string `mapstructure:"claim"`
+	Split string `mapstructure:"split"`
+	// Attribute with `split: dn` only the values of this attribute are kept, such as OU
+	Attribute string `mapstructure:"attribute"`
+	// Separator with `split: path`, defaults to /
+	Separator string `mapstructure:"separator"`
+	Target    string `mapstructure:"target"`
+	Teams     bool   `mapstructure:"teams"`
 }
 
-type branding struct {
+// LoginOption a choice offered to the user at /login
+// the selected option's Params are added to the request sent to the IdP
+// which is how brokering IdPs (Keycloak `kc_idp_hint`, Azure `domain_hint`, Auth0 `connection`) route to an upstream IdP
+type LoginOption struct {
+	Name   string `mapstructure:"name"`
+	Label  string `mapstructure:"label"`
+	Icon   string `mapstructure:"icon"`
+	Weight int    `mapstructure:"weight"`
+	// Domains email domains used for home realm discovery via `/login?domain_hint=user@domain`
+	Domains []string `mapstructure:"domains"`
+	// Hosts requested hosts (or their parent domains) which select this option without asking
+	Hosts  []string          `mapstructure:"hosts"`
+	Params map[string]string `mapstructure:"params"`
+	// Provider the name of the `oauth` provider the option logs in with, defaults to the first
+	Provider string `mapstructure:"provider"`
+}
+
+// Brand the names of Vouch Proxy, see Branding
+type Brand struct {
 	LCName   string // lower case vouch
 	UCName   string // UPPER CASE VOUCH
 	CcName   string // camelCase Vouch
@@ -102,7 +488,7 @@ type branding struct {
 
 var (
 	// Branding that's our name
-	Branding = branding{"vouch", "VOUCH", "Vouch", "Vouch Proxy", "https://github.com/vouch/vouch-proxy"}
+	Branding = Brand{"vouch", "VOUCH", "Vouch", "Vouch Proxy", "https://github.com/vouch/vouch-proxy"}
 
 	// RootDir is where Vouch Proxy looks for ./config/config.yml, ./data, ./static and ./templates
 	RootDir string
@@ -115,8 +501,10 @@ var (
 		port:          flag.Int("port", -1, "port"),
 		configFile:    flag.String("config", "", "specify alternate config.yml file as command line arg"),
 		// https://github.com/uber-go/zap/blob/master/flag.go
-		logLevel: zap.LevelFlag("loglevel", cmdLineLoggingDefault, "set log level to one of: panic, error, warn, info, debug"),
-		logTest:  flag.Bool("logtest", false, "print a series of log messages and exit (used for testing)"),
+		logLevel:            zap.LevelFlag("loglevel", cmdLineLoggingDefault, "set log level to one of: panic, error, warn, info, debug"),
+		logTest:             flag.Bool("logtest", false, "print a series of log messages and exit (used for testing)"),
+		IsConfigTest:        flag.Bool("test", false, "validate the configuration, report each problem and exit (non-zero if there are any), also VOUCH_TEST=1"),
+		IsConfigTestOffline: flag.Bool("testoffline", false, "with -test, skip the checks which reach the provider, also VOUCH_TEST_OFFLINE=1"),
 	}
 
 	// Cfg the main exported config variable
@@ -135,16 +523,116 @@ type cmdLineFlags struct {
 	configFile    *string
 	logLevel      *zapcore.Level
 	logTest       *bool
+	// IsConfigTest IsConfigTestOffline see ConfigTest()
+	IsConfigTest        *bool
+	IsConfigTestOffline *bool
 }
 
 const (
 	// for a Base64 string we need 44 characters to get 32bytes (6 bits per char)
 	minBase64Length = 44
+	// minJWEKeyLength the shortest jwt.secret from which the key of `jwt.encrypt` is derived, 256 bits
+	minJWEKeyLength = 32
 	base64Bytes     = 32
+	// accessTokenKeyLength the key of `headers.accesstoken_encrypt`, 256 bits
+	accessTokenKeyLength = 32
+	// the state nonce must carry at least 128 bits, and stay short enough for a url and a cookie path
+	minStateBytes = 16
+	maxStateBytes = 128
+	// each cookie of a split jwt must still hold its name and attributes, and browsers refuse cookies over 4096 bytes
+	minCookieChunkSize = 512
+	maxCookieChunkSize = 4096
+	// CookieDomainAuto and CookieDomainOff the values of `cookie.domain` which aren't a domain
+	CookieDomainAuto = "auto"
+	CookieDomainOff  = "off"
+	// a shard per core is plenty
+	maxStoreShards = 1024
+	// seconds the user may be kept waiting for a provider which is rate limiting, see oauth.rate_limit
+	defaultRateLimitMaxWait = 5
+	// defaultRefreshWindow minutes, see oauth.refresh_window
+	defaultRefreshWindow = 5
+	// Azure AD's claim naming the tenant, see oauth.allowed_tenants
+	defaultTenantClaim = "tid"
+
+	// SessionBackendCookie the login session is kept in its cookie, encrypted with session.key
+	SessionBackendCookie = "cookie"
+	// SessionBackendRedis the login session is kept in Redis, its cookie carries only its id, so that it's shared by every instance
+	SessionBackendRedis = "redis"
+	// RevocationStoreRedis the revocations of `revocation_store` are kept in Redis, shared by every instance
+	RevocationStoreRedis = "redis"
+
+	// GroupsTruncate keep the first groups.max groups
+	GroupsTruncate = "truncate"
+	// GroupsPreferWhitelist keep the groups found in the teamWhitelist, then fill up to groups.max
+	GroupsPreferWhitelist = "whitelist"
+	// GroupsError refuse the login of users in more than groups.max groups
+	GroupsError = "error"
+
+	// GroupsHeaderQuoted each group quoted and joined by commas `"a","b"`, as for any list claim
+	GroupsHeaderQuoted = "quoted"
+	// GroupsHeaderJoined the groups joined by groups.header_delimiter `a;b`
+	GroupsHeaderJoined = "joined"
+	// GroupsHeaderRepeated the header repeated for each group
+	GroupsHeaderRepeated = "repeated"
+
+	// ForwardedFirst ForwardedLast the value chosen of a forwarded header holding several, see forwarded.select
+	ForwardedFirst = "first"
+	ForwardedLast  = "last"
+
+	// ForwardedHeaderX ForwardedHeaderRFC7239 the headers read first for the host, scheme and client address, see forwarded.header
+	// the other are read when the proxy didn't set those
+	ForwardedHeaderX       = "x-forwarded"
+	ForwardedHeaderRFC7239 = "forwarded"
+
+	// OperatorEqual and the others compare a claim with the values of a `roles.rules` rule
+	OperatorEqual          = "=="
+	OperatorNotEqual       = "!="
+	OperatorGreater        = ">"
+	OperatorGreaterOrEqual = ">="
+	OperatorLess           = "<"
+	OperatorLessOrEqual    = "<="
+
+	// CoercionLoose CoercionStrict whether a claim which is a string holding a number or a boolean is compared as one, see roles.coercion
+	CoercionLoose  = "loose"
+	CoercionStrict = "strict"
+
+	// SelfTestFatal SelfTestWarn what a failed startup self-test does, see self_test.on_failure
+	SelfTestFatal = "fatal"
+	SelfTestWarn  = "warn"
+
+	// EmailFirst EmailFirstVerified the address chosen when the email claim is a list, see oauth.email_select
+	EmailFirst         = "first"
+	EmailFirstVerified = "first_verified"
+
+	// ObjectClaimsJSON ObjectClaimsOmit how an object claim is passed, see headers.object_claims
+	ObjectClaimsJSON = "json"
+	ObjectClaimsOmit = "omit"
+
+	// SplitDN SplitPath how a claim is split, see claim_transforms
+	SplitDN   = "dn"
+	SplitPath = "path"
+
+	// AuditJSON AuditCEF AuditLEEF formats of audit.format
+	AuditJSON = "json"
+	AuditCEF  = "cef"
+	AuditLEEF = "leef"
 
 	// ErrCtxKey set or check the http request context to see if it has errored
 	// see `responses.Error401` and `jwtmanager.JWTCacheHandler` for example
 	ErrCtxKey ctxKey = 0
+	// RedirectURLCtxKey the callback_url chosen at /login, which must also be used for the token exchange at /auth
+	RedirectURLCtxKey ctxKey = 1
+	// CSPNonceCtxKey the nonce of the `csp.policy` sent with the response, for the templates to put on their inline scripts
+	CSPNonceCtxKey ctxKey = 2
+	// OAuthCtxKey the provider chosen at /login, see OAuth()
+	OAuthCtxKey ctxKey = 3
+	// IDTokenNonceCtxKey the nonce sent at /login, which the id_token returned to /auth must carry
+	IDTokenNonceCtxKey ctxKey = 4
+	// InstanceCtxKey the Instance serving the request, see WithInstance()
+	InstanceCtxKey ctxKey = 5
+
+	// CSPNonceToken replaced in `csp.policy` with the nonce of each response
+	CSPNonceToken = "{nonce}"
 )
 
 // use a typed ctxKey to avoid context key collision
@@ -200,6 +688,43 @@ func Configure() {
 	logConfigIfDebug()
 }
 
+// Defaults the Config of .defaults.yml, a starting point for ConfigureWith()
+func Defaults() Config {
+	setRootDir()
+	viper.SetConfigName(".defaults")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(RootDir)
+	if err := viper.ReadInConfig(); err != nil {
+		log.Error(err)
+	}
+	c := Config{}
+	if err := viper.UnmarshalKey(Branding.LCName, &c); err != nil {
+		log.Error(err)
+	}
+	return c
+}
+
+// ConfigureWith configure from c and the oauth providers, the first of them the default, in place of the config file
+// and the environment, for an application embedding Vouch Proxy (see pkg/vouch)
+// the configuration is package state, configuring again replaces it
+func ConfigureWith(c Config, oauth ...*OAuthConfig) error {
+	if len(oauth) == 0 {
+		return fmt.Errorf("configuration error: at least one oauth provider is required")
+	}
+	setRootDir()
+	Cfg = &c
+	fixConfigOptions()
+	Logging.configure()
+	if err := configureOAuthConfigs(oauth); err != nil {
+		return err
+	}
+	setProviderDefaults()
+	if err := cleanClaimsHeaders(); err != nil {
+		return err
+	}
+	return ValidateConfiguration()
+}
+
 // using envconfig
 // https://github.com/kelseyhightower/envconfig
 func configureFromEnv() bool {
@@ -229,6 +754,77 @@ func configureFromEnv() bool {
 	return false
 }
 
+// checkTracing `tracing.endpoint` is the url of a collector and `tracing.sample_rate` a fraction
+func checkTracing() error {
+	if !Cfg.Tracing.Enabled {
+		return nil
+	}
+	if u, err := url.Parse(Cfg.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("configuration error: %s.tracing.endpoint must be the http(s) url of an OTLP collector, such as http://otel-collector:4318 (currently: '%s')", Branding.LCName, Cfg.Tracing.Endpoint)
+	}
+	if Cfg.Tracing.SampleRate < 0 || Cfg.Tracing.SampleRate > 1 {
+		return fmt.Errorf("configuration error: %s.tracing.sample_rate must be between 0 and 1 (currently: %v)", Branding.LCName, Cfg.Tracing.SampleRate)
+	}
+	return nil
+}
+
+// checkJWTEncrypt `jwt.encrypt` derives the JWE key from the jwt.secret, with RS* and ES* signing methods there is none
+func checkJWTEncrypt() error {
+	if !Cfg.JWT.Encrypt {
+		return nil
+	}
+	if !strings.HasPrefix(Cfg.JWT.SigningMethod, "HS") {
+		return fmt.Errorf("configuration error: %s.jwt.encrypt requires an HS* jwt.signing_method (currently: %s)", Branding.LCName, Cfg.JWT.SigningMethod)
+	}
+	if len(Cfg.JWT.Secret) < minJWEKeyLength {
+		return fmt.Errorf("configuration error: %s.jwt.encrypt requires a jwt.secret of at least %d characters (currently: %d)", Branding.LCName, minJWEKeyLength, len(Cfg.JWT.Secret))
+	}
+	return nil
+}
+
+// checkBackChannelIssuers with `session.sid_claim` a logout_token is verified only by the provider whose `oauth.issuer` it names,
+// when more than one provider could verify it each must say which issuer it is
+func checkBackChannelIssuers() error {
+	if Cfg.Session.SIDClaim == "" {
+		return nil
+	}
+	verifiers := 0
+	for _, c := range OAuthConfigs {
+		if c.JWKSURL != "" {
+			verifiers++
+		}
+	}
+	if verifiers < 2 {
+		return nil
+	}
+	for _, c := range OAuthConfigs {
+		if c.JWKSURL != "" && c.Issuer == "" {
+			return fmt.Errorf("configuration error: %s.session.sid_claim with more than one provider requires oauth.issuer of the provider %s", Branding.LCName, c.Name)
+		}
+	}
+	return nil
+}
+
+// checkStatelessState `stateless_state` signs the state with a key derived from the jwt.secret
+// and has nowhere to keep a PKCE code_verifier or the SAML request
+func checkStatelessState() error {
+	if !Cfg.StatelessState {
+		return nil
+	}
+	if !strings.HasPrefix(Cfg.JWT.SigningMethod, "HS") {
+		return fmt.Errorf("configuration error: %s.stateless_state requires an HS* jwt.signing_method (currently: %s)", Branding.LCName, Cfg.JWT.SigningMethod)
+	}
+	for _, c := range OAuthConfigs {
+		if c.CodeChallengeMethod != "" {
+			return fmt.Errorf("configuration error: %s.stateless_state cannot be combined with oauth.code_challenge_method", Branding.LCName)
+		}
+		if c.Provider == Providers.SAML {
+			return fmt.Errorf("configuration error: %s.stateless_state cannot be combined with the %s provider", Branding.LCName, Providers.SAML)
+		}
+	}
+	return nil
+}
+
 // ValidateConfiguration confirm the Configuration is valid
 func ValidateConfiguration() error {
 	if Cfg.Testing {
@@ -239,6 +835,42 @@ func ValidateConfiguration() error {
 	return basicTest()
 }
 
+// CheckJWTSecretLength an error if the HS* `jwt.secret` is too short, which only warns at startup
+func CheckJWTSecretLength() error {
+	if strings.HasPrefix(Cfg.JWT.SigningMethod, "HS") && len(Cfg.JWT.Secret) < minBase64Length {
+		return fmt.Errorf("Your secret is too short! (%d characters long). Please consider deleting %s to automatically generate a secret of %d characters",
+			len(Cfg.JWT.Secret),
+			Branding.LCName+".jwt.secret",
+			minBase64Length)
+	}
+	return nil
+}
+
+// AccessTokenKey the key of `headers.accesstoken_encrypt`, with which the access token is encrypted as A256GCM
+// the key is base64 (standard or url, padded or not) encoded, such as from `openssl rand -base64 32`
+func (c *Config) AccessTokenKey() ([]byte, error) {
+	k := strings.TrimRight(strings.TrimSpace(c.Headers.AccessTokenEncrypt), "=")
+	key, err := base64.RawStdEncoding.DecodeString(k)
+	if err != nil {
+		key, err = base64.RawURLEncoding.DecodeString(k)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s.headers.accesstoken_encrypt is not base64 encoded", Branding.LCName)
+	}
+	if len(key) != accessTokenKeyLength {
+		return nil, fmt.Errorf("%s.headers.accesstoken_encrypt must be a key of %d bytes (currently: %d)", Branding.LCName, accessTokenKeyLength, len(key))
+	}
+	return key, nil
+}
+
+// ConfigTest whether the configuration is only validated, with `-test` or VOUCH_TEST=1
+// and whether the checks which reach the provider are skipped, with `-testoffline` or VOUCH_TEST_OFFLINE=1
+func ConfigTest() (test bool, offline bool) {
+	test = *CmdLine.IsConfigTest || os.Getenv(Branding.UCName+"_TEST") == "1"
+	offline = *CmdLine.IsConfigTestOffline || os.Getenv(Branding.UCName+"_TEST_OFFLINE") == "1"
+	return test, offline
+}
+
 func setRootDir() {
 	// set RootDir from VOUCH_ROOT env var, or to the executable's directory
 	if os.Getenv(Branding.UCName+"_ROOT") != "" {
@@ -304,6 +936,16 @@ func logConfigIfDebug() {
 	if len(Cfg.JWT.Secret) != 0 {
 		maskedCfg.JWT.Secret = "XXXXXXXX"
 	}
+	if len(Cfg.Session.Redis.Password) != 0 {
+		maskedCfg.Session.Redis.Password = "XXXXXXXX"
+	}
+	maskedCfg.JWT.AudienceKeys = make([]AudienceKey, len(Cfg.JWT.AudienceKeys))
+	for i, k := range Cfg.JWT.AudienceKeys {
+		if len(k.Secret) != 0 {
+			k.Secret = "XXXXXXXX"
+		}
+		maskedCfg.JWT.AudienceKeys[i] = k
+	}
 	log.Debugf("Cfg %+v", maskedCfg)
 
 	maskedGenOAuth := *GenOAuth
@@ -313,6 +955,14 @@ func logConfigIfDebug() {
 }
 
 func fixConfigOptions() {
+	switch strings.ToLower(Cfg.Cookie.Domain) {
+	case CookieDomainAuto:
+		Cfg.Cookie.Domain = ""
+	case CookieDomainOff:
+		Cfg.Cookie.Domain = ""
+		Cfg.Cookie.HostOnly = true
+	}
+
 	if Cfg.Cookie.MaxAge > Cfg.JWT.MaxAge {
 		log.Warnf("setting `%s.cookie.maxage` to `%s.jwt.maxage` value of %d minutes (curently set to %d minutes)", Branding.LCName, Branding.LCName, Cfg.JWT.MaxAge, Cfg.Cookie.MaxAge)
 		Cfg.Cookie.MaxAge = Cfg.JWT.MaxAge
@@ -322,6 +972,7 @@ func fixConfigOptions() {
 	if !viper.IsSet(Branding.LCName + ".headers.redirect") {
 		Cfg.Headers.Redirect = "X-" + Branding.CcName + "-Requested-URI"
 	}
+	applyHeadersPrefix()
 
 	// jwt defaults
 	if strings.HasPrefix(Cfg.JWT.SigningMethod, "HS") && len(Cfg.JWT.Secret) == 0 {
@@ -336,6 +987,12 @@ func fixConfigOptions() {
 		Cfg.JWT.PublicKeyFile = path.Join(RootDir, Cfg.JWT.PublicKeyFile)
 	}
 
+	for i, k := range Cfg.JWT.AudienceKeys {
+		if len(k.PrivateKeyFile) > 0 && !path.IsAbs(k.PrivateKeyFile) {
+			Cfg.JWT.AudienceKeys[i].PrivateKeyFile = path.Join(RootDir, k.PrivateKeyFile)
+		}
+	}
+
 	if len(Cfg.Session.Key) == 0 {
 		log.Warn("generating random session.key")
 		rstr, err := securerandom.Base64OfBytes(base64Bytes)
@@ -349,11 +1006,85 @@ func fixConfigOptions() {
 		Cfg.TestURLs = append(Cfg.TestURLs, Cfg.TestURL)
 	}
 
+	// lighter options float to the top of the login page, ties keep the order of the config file
+	sort.SliceStable(Cfg.LoginOptions, func(i, j int) bool {
+		return Cfg.LoginOptions[i].Weight < Cfg.LoginOptions[j].Weight
+	})
+
+	if err := configureWhiteList(); err != nil {
+		log.Error(err)
+	}
+	if err := configureEmailRegex(); err != nil {
+		log.Error(err)
+	}
+	if err := configureAccessHours(); err != nil {
+		log.Error(err)
+	}
+	if err := configureNetworkRules(); err != nil {
+		log.Error(err)
+	}
+	if err := configurePolicies(); err != nil {
+		log.Error(err)
+	}
+	if err := configureExternalAuth(); err != nil {
+		log.Error(err)
+	}
+	if err := configureGroupNormalization(); err != nil {
+		log.Error(err)
+	}
+	if err := configureTokenClaims(); err != nil {
+		log.Error(err)
+	}
+
 }
 
 // use viper and mapstructure check to see if
 // https://pkg.go.dev/github.com/spf13/viper@v1.6.3?tab=doc#Unmarshal
 // https://pkg.go.dev/github.com/mitchellh/mapstructure?tab=doc#DecoderConfig
+// headerNames the names of the headers which /validate sends and reads, each of which `headers.prefix` may begin
+func headerNames() []*string {
+	return []*string{&Cfg.Headers.JWT, &Cfg.Headers.User, &Cfg.Headers.Redirect, &Cfg.Headers.Success, &Cfg.Headers.Error,
+		&Cfg.Headers.ClaimHeader, &Cfg.Headers.AccessToken, &Cfg.Headers.IDToken, &Cfg.Headers.UID, &Cfg.Headers.Assertion,
+		&Cfg.Headers.Role, &Cfg.Headers.LogoutURL, &Cfg.Headers.ErrorCode, &Cfg.ConditionalValidate.Header}
+}
+
+// applyHeadersPrefix `headers.prefix` in place of the X-Vouch- which begins the name of a header, a name of another form is kept
+func applyHeadersPrefix() {
+	if Cfg.Headers.Prefix == "" {
+		return
+	}
+	defaultPrefix := "X-" + Branding.CcName + "-"
+	for _, h := range headerNames() {
+		if strings.HasPrefix(strings.ToLower(*h), strings.ToLower(defaultPrefix)) {
+			*h = Cfg.Headers.Prefix + (*h)[len(defaultPrefix):]
+		}
+	}
+}
+
+// checkHeaderAndCookieNames the names of headers and cookies must be tokens, otherwise they're refused or dropped
+// https://tools.ietf.org/html/rfc7230#section-3.2
+func checkHeaderAndCookieNames() error {
+	headers := []string{Cfg.Headers.Prefix, Cfg.CSRF.Header, Cfg.ConditionalValidate.RequestHeader, Cfg.ClientCert.DNHeader, Cfg.ClientCert.VerifyHeader}
+	for _, h := range headerNames() {
+		headers = append(headers, *h)
+	}
+	for _, h := range headers {
+		if h != "" && !httpguts.ValidHeaderFieldName(h) {
+			return fmt.Errorf("configuration error: %q is not a valid header name", h)
+		}
+	}
+	if Cfg.Cookie.Name == "" {
+		return fmt.Errorf("configuration error: %s.cookie.name must be set", Branding.LCName)
+	}
+	for _, c := range []string{Cfg.Cookie.Name, Cfg.CSRF.CookieName, Cfg.Cookie.Profile.Name, Cfg.Session.Name} {
+		// a cookie name is a token just as a header name is
+		if c != "" && !httpguts.ValidHeaderFieldName(c) {
+			return fmt.Errorf("configuration error: %q is not a valid cookie name", c)
+		}
+	}
+	return nil
+}
+
 func checkConfigFileWellFormed() error {
 	opt := func(dc *mapstructure.DecoderConfig) {
 		dc.ErrorUnused = true
@@ -361,7 +1092,7 @@ func checkConfigFileWellFormed() error {
 
 	type quick struct {
 		Vouch Config
-		OAuth oauthConfig
+		OAuth []oauthConfig
 	}
 	q := &quick{}
 
@@ -388,7 +1119,7 @@ func basicTest() error {
 	if GenOAuth.Provider == "" {
 		return errors.New("configuration error: required configuration option 'oauth.provider' is not set")
 	}
-	if GenOAuth.ClientID == "" {
+	if GenOAuth.ClientID == "" && GenOAuth.Provider != Providers.SAML {
 		return errors.New("configuration error: required configuration option 'oauth.client_id' is not set")
 	}
 
@@ -419,11 +1150,8 @@ func basicTest() error {
 			return fmt.Errorf("%s.jwt.private_key_file should not be set when using signing method %s", Branding.LCName, Cfg.JWT.SigningMethod)
 		}
 
-		if len(Cfg.JWT.Secret) < minBase64Length {
-			log.Errorf("Your secret is too short! (%d characters long). Please consider deleting %s to automatically generate a secret of %d characters",
-				len(Cfg.JWT.Secret),
-				Branding.LCName+".jwt.secret",
-				minBase64Length)
+		if err := CheckJWTSecretLength(); err != nil {
+			log.Error(err)
 		}
 	}
 
@@ -448,6 +1176,217 @@ func basicTest() error {
 			Branding.LCName+".session.key",
 			minBase64Length)
 	}
+	if err := configureWhiteList(); err != nil {
+		return err
+	}
+	if err := configureEmailRegex(); err != nil {
+		return err
+	}
+	if err := configureAccessHours(); err != nil {
+		return err
+	}
+	if err := configureNetworkRules(); err != nil {
+		return err
+	}
+	if err := configurePolicies(); err != nil {
+		return err
+	}
+	if err := configureExternalAuth(); err != nil {
+		return err
+	}
+	if err := configureGroupNormalization(); err != nil {
+		return err
+	}
+	if err := configureTokenClaims(); err != nil {
+		return err
+	}
+	if Cfg.RetryAfter <= 0 {
+		return fmt.Errorf("configuration error: %s.retry_after must be greater than 0 (currently: %d)", Branding.LCName, Cfg.RetryAfter)
+	}
+	if Cfg.RateLimit.RequestsPerMinute < 0 {
+		return fmt.Errorf("configuration error: %s.rate_limit.requests_per_minute must not be negative (currently: %d)", Branding.LCName, Cfg.RateLimit.RequestsPerMinute)
+	}
+	if Cfg.RateLimit.RequestsPerMinute > 0 && (Cfg.RateLimit.Burst < 1 || Cfg.RateLimit.MaxClients < 1) {
+		return fmt.Errorf("configuration error: %s.rate_limit requires a burst and max_clients of at least 1", Branding.LCName)
+	}
+	if Cfg.Lockout.Threshold < 0 {
+		return fmt.Errorf("configuration error: %s.lockout.threshold must not be negative (currently: %d)", Branding.LCName, Cfg.Lockout.Threshold)
+	}
+	if Cfg.Lockout.Threshold > 0 && (Cfg.Lockout.Window < 1 || Cfg.Lockout.Duration < 1 || Cfg.Lockout.MaxClients < 1) {
+		return fmt.Errorf("configuration error: %s.lockout requires a window, duration and max_clients of at least 1", Branding.LCName)
+	}
+	if Cfg.Lockout.Shared && Cfg.Session.Backend != SessionBackendRedis {
+		return fmt.Errorf("configuration error: %s.lockout.shared requires session.backend %s", Branding.LCName, SessionBackendRedis)
+	}
+	if len(Cfg.StepUpHosts) > 0 && Cfg.Session.Backend != SessionBackendRedis {
+		return fmt.Errorf("configuration error: %s.step_up_hosts requires session.backend %s, in which passkeys are kept", Branding.LCName, SessionBackendRedis)
+	}
+	if len(Cfg.StepUpHosts) > 0 && len(Cfg.StepUpAdminTeams) == 0 {
+		return fmt.Errorf("configuration error: %s.step_up_hosts requires step_up_admin_teams, whose members enrol the users' passkeys", Branding.LCName)
+	}
+	if err := checkHeaderAndCookieNames(); err != nil {
+		return err
+	}
+	if Cfg.ShutdownTimeout < 1 {
+		return fmt.Errorf("configuration error: %s.shutdown_timeout must be at least 1 second (currently: %d)", Branding.LCName, Cfg.ShutdownTimeout)
+	}
+	if Cfg.OAuthClient.Timeout < 1 {
+		return fmt.Errorf("configuration error: %s.oauth_client.timeout must be at least 1 second (currently: %d)", Branding.LCName, Cfg.OAuthClient.Timeout)
+	}
+	if _, err := Cfg.OAuthClientTLSConfig(); err != nil {
+		return fmt.Errorf("configuration error: %s.oauth_client.ca_bundle %w", Branding.LCName, err)
+	}
+	if Cfg.Templates.Dir != "" {
+		if fi, err := os.Stat(Cfg.Templates.Dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("configuration error: %s.templates.dir %s is not a directory", Branding.LCName, Cfg.Templates.Dir)
+		}
+	}
+	if Cfg.CSP.Enabled && Cfg.CSP.Policy == "" {
+		return fmt.Errorf("configuration error: %s.csp requires a policy", Branding.LCName)
+	}
+	if Cfg.RequestedURLMaxLength <= 0 {
+		return fmt.Errorf("configuration error: %s.requested_url_max_length must be greater than 0 (currently: %d)", Branding.LCName, Cfg.RequestedURLMaxLength)
+	}
+	if Cfg.Readiness.FailureThreshold < 1 {
+		return fmt.Errorf("configuration error: %s.readiness.failure_threshold must be at least 1 (currently: %d)", Branding.LCName, Cfg.Readiness.FailureThreshold)
+	}
+	if Cfg.Readiness.FailureWindow < 1 {
+		return fmt.Errorf("configuration error: %s.readiness.failure_window must be at least 1 (currently: %d)", Branding.LCName, Cfg.Readiness.FailureWindow)
+	}
+	if err := checkPostLogoutRedirectURI(); err != nil {
+		return err
+	}
+	if Cfg.ConditionalValidate.Enabled && (Cfg.ConditionalValidate.Header == "" || Cfg.ConditionalValidate.RequestHeader == "") {
+		return fmt.Errorf("configuration error: %s.conditional_validate requires header and request_header", Branding.LCName)
+	}
+	if Cfg.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(Cfg.Metrics.Listen); err != nil {
+			return fmt.Errorf("configuration error: %s.metrics.listen %s must be an address such as 127.0.0.1:9091: %w", Branding.LCName, Cfg.Metrics.Listen, err)
+		}
+	}
+	if err := checkTracing(); err != nil {
+		return err
+	}
+	if Cfg.SelfTest.OnFailure != SelfTestFatal && Cfg.SelfTest.OnFailure != SelfTestWarn {
+		return fmt.Errorf("configuration error: %s.self_test.on_failure must be either '%s' or '%s'", Branding.LCName, SelfTestFatal, SelfTestWarn)
+	}
+	if Cfg.Groups.RefreshInterval < 0 {
+		return fmt.Errorf("configuration error: %s.groups.refresh_interval cannot be lower than 0 (currently: %d)", Branding.LCName, Cfg.Groups.RefreshInterval)
+	}
+	if Cfg.Groups.RefreshInterval > 0 && GenOAuth.UserInfoURL == "" {
+		return fmt.Errorf("configuration error: %s.groups.refresh_interval requires oauth.user_info_url", Branding.LCName)
+	}
+	if err := checkJWTEncrypt(); err != nil {
+		return err
+	}
+	if Cfg.JWT.Rolling.Enabled && (Cfg.JWT.Rolling.Window < 1 || Cfg.JWT.Rolling.Window >= Cfg.JWT.MaxAge) {
+		return fmt.Errorf("configuration error: %s.jwt.rolling.window must be at least 1 and less than jwt.maxAge %d (currently: %d)", Branding.LCName, Cfg.JWT.MaxAge, Cfg.JWT.Rolling.Window)
+	}
+	if Cfg.JWT.IdleTimeout < 0 || (Cfg.JWT.IdleTimeout > 0 && Cfg.JWT.IdleTimeout >= Cfg.JWT.MaxAge) {
+		return fmt.Errorf("configuration error: %s.jwt.idle_timeout must be less than jwt.maxAge %d (currently: %d)", Branding.LCName, Cfg.JWT.MaxAge, Cfg.JWT.IdleTimeout)
+	}
+	if Cfg.JWT.IdleTimeout > 0 && Cfg.JWT.Rolling.Enabled {
+		// rolling moves the expiry, the idle timeout is within a fixed one
+		return fmt.Errorf("configuration error: %s.jwt.idle_timeout cannot be combined with jwt.rolling", Branding.LCName)
+	}
+	if err := checkStatelessState(); err != nil {
+		return err
+	}
+	if err := checkBackChannelIssuers(); err != nil {
+		return err
+	}
+	if err := checkAudienceKeys(); err != nil {
+		return err
+	}
+	for i, rule := range Cfg.Roles.Rules {
+		if rule.Role == "" || rule.Claim == "" || len(rule.Values) == 0 {
+			return fmt.Errorf("configuration error: %s.roles.rules[%d] requires a role, a claim and values", Branding.LCName, i)
+		}
+		if err := checkRuleOperator(fmt.Sprintf("roles.rules[%d]", i), rule.Operator, rule.Values); err != nil {
+			return err
+		}
+	}
+	for i, rule := range Cfg.DenyRules {
+		if rule.Claim == "" || len(rule.Values) == 0 || rule.ReasonCode == "" {
+			return fmt.Errorf("configuration error: %s.deny_rules[%d] requires a claim, values and a reason_code", Branding.LCName, i)
+		}
+		if !reasonCodeRE.MatchString(rule.ReasonCode) {
+			return fmt.Errorf("configuration error: %s.deny_rules[%d].reason_code %q may only hold letters, digits, '_', '-' and '.'", Branding.LCName, i, rule.ReasonCode)
+		}
+		if err := checkRuleOperator(fmt.Sprintf("deny_rules[%d]", i), rule.Operator, rule.Values); err != nil {
+			return err
+		}
+	}
+	if Cfg.Roles.Coercion != CoercionLoose && Cfg.Roles.Coercion != CoercionStrict {
+		return fmt.Errorf("configuration error: %s.roles.coercion must be either '%s' or '%s'", Branding.LCName, CoercionLoose, CoercionStrict)
+	}
+	for i, t := range Cfg.ClaimTransforms {
+		if t.Claim == "" || (t.Target == "" && !t.Teams) {
+			return fmt.Errorf("configuration error: %s.claim_transforms[%d] requires a claim and either a target or teams", Branding.LCName, i)
+		}
+		if t.Split != SplitDN && t.Split != SplitPath {
+			return fmt.Errorf("configuration error: %s.claim_transforms[%d].split must be one of %s or %s", Branding.LCName, i, SplitDN, SplitPath)
+		}
+	}
+	if Cfg.Session.StoreShards < 1 || Cfg.Session.StoreShards > maxStoreShards {
+		return fmt.Errorf("configuration error: %s.session.store_shards must be between 1 and %d (currently: %d)", Branding.LCName, maxStoreShards, Cfg.Session.StoreShards)
+	}
+	switch Cfg.Session.Backend {
+	case SessionBackendCookie:
+	case SessionBackendRedis:
+		if _, _, err := net.SplitHostPort(Cfg.Session.Redis.Addr); err != nil {
+			return fmt.Errorf("configuration error: %s.session.redis.addr %s must be an address such as redis:6379: %w", Branding.LCName, Cfg.Session.Redis.Addr, err)
+		}
+		if Cfg.Session.Redis.DB < 0 {
+			return fmt.Errorf("configuration error: %s.session.redis.db cannot be negative", Branding.LCName)
+		}
+	default:
+		return fmt.Errorf("configuration error: %s.session.backend must be either '%s' or '%s' (currently: %s)", Branding.LCName, SessionBackendCookie, SessionBackendRedis, Cfg.Session.Backend)
+	}
+	for i, o := range Cfg.CORS.AllowedOrigins {
+		if o == "*" {
+			if Cfg.CORS.AllowCredentials {
+				return fmt.Errorf("configuration error: %s.cors.allowed_origins[%d] '*' cannot be combined with allow_credentials, list the origins", Branding.LCName, i)
+			}
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return fmt.Errorf("configuration error: %s.cors.allowed_origins[%d] %s must be an origin such as https://app.example.com", Branding.LCName, i, o)
+		}
+	}
+	if Cfg.ClientCert.Enabled {
+		if !Cfg.ClientCert.TrustHeaders {
+			return fmt.Errorf("configuration error: %s.client_cert.enabled requires %s.client_cert.trust_headers: true, confirming that nginx sets %s and %s in place of any sent by the client", Branding.LCName, Branding.LCName, Cfg.ClientCert.DNHeader, Cfg.ClientCert.VerifyHeader)
+		}
+		if Cfg.ClientCert.DNHeader == "" || Cfg.ClientCert.VerifyHeader == "" {
+			return fmt.Errorf("configuration error: %s.client_cert requires both dn_header and verify_header", Branding.LCName)
+		}
+	}
+	switch Cfg.RevocationStore.Backend {
+	case "":
+	case RevocationStoreRedis:
+		if _, _, err := net.SplitHostPort(Cfg.RevocationStore.Redis.Addr); err != nil {
+			return fmt.Errorf("configuration error: %s.revocation_store.redis.addr %s must be an address such as redis:6379: %w", Branding.LCName, Cfg.RevocationStore.Redis.Addr, err)
+		}
+		if Cfg.RevocationStore.Redis.DB < 0 {
+			return fmt.Errorf("configuration error: %s.revocation_store.redis.db cannot be negative", Branding.LCName)
+		}
+	default:
+		return fmt.Errorf("configuration error: %s.revocation_store.backend must be either empty or '%s' (currently: %s)", Branding.LCName, RevocationStoreRedis, Cfg.RevocationStore.Backend)
+	}
+	if len(Cfg.RevocationStore.AdminTeams) > 0 && Cfg.RevocationStore.Backend == "" {
+		return fmt.Errorf("configuration error: %s.revocation_store.admin_teams requires %s.revocation_store.backend", Branding.LCName, Branding.LCName)
+	}
+	if Cfg.Session.Timeout < 1 {
+		return fmt.Errorf("configuration error: %s.session.timeout must be at least 1 second (currently: %d)", Branding.LCName, Cfg.Session.Timeout)
+	}
+	if Cfg.Session.SaveRetries < 0 {
+		return fmt.Errorf("configuration error: %s.session.save_retries cannot be negative (currently: %d)", Branding.LCName, Cfg.Session.SaveRetries)
+	}
+	if Cfg.Session.StateBytes < minStateBytes || Cfg.Session.StateBytes > maxStateBytes {
+		return fmt.Errorf("configuration error: %s.session.state_bytes must be between %d and %d (currently: %d)", Branding.LCName, minStateBytes, maxStateBytes, Cfg.Session.StateBytes)
+	}
 	if Cfg.Cookie.MaxAge < 0 {
 		return fmt.Errorf("configuration error: cookie maxAge cannot be lower than 0 (currently: %d)", Cfg.Cookie.MaxAge)
 	}
@@ -457,6 +1396,110 @@ func basicTest() error {
 	if Cfg.Cookie.MaxAge > Cfg.JWT.MaxAge {
 		return fmt.Errorf("configuration error: Cookie maxAge (%d) cannot be larger than the JWT maxAge (%d)", Cfg.Cookie.MaxAge, Cfg.JWT.MaxAge)
 	}
+	if Cfg.Cookie.MaxChunkSize < minCookieChunkSize || Cfg.Cookie.MaxChunkSize > maxCookieChunkSize {
+		return fmt.Errorf("configuration error: %s.cookie.max_chunk_size must be between %d and %d (currently: %d)", Branding.LCName, minCookieChunkSize, maxCookieChunkSize, Cfg.Cookie.MaxChunkSize)
+	}
+	if (Cfg.Cookie.TenantClaim == "") != (len(Cfg.Cookie.TenantDomains) == 0) {
+		return fmt.Errorf("configuration error: %s.cookie.tenant_claim and %s.cookie.tenant_domains must be set together", Branding.LCName, Branding.LCName)
+	}
+	for tenant, domain := range Cfg.Cookie.TenantDomains {
+		if !allowedCookieDomain(domain) {
+			return fmt.Errorf("configuration error: %s.cookie.tenant_domains %s: %s is not within %s.domains or %s.cookie.domain", Branding.LCName, tenant, domain, Branding.LCName, Branding.LCName)
+		}
+	}
+
+	switch Cfg.Audit.Format {
+	case AuditJSON, AuditCEF, AuditLEEF:
+	default:
+		return fmt.Errorf("configuration error: %s.audit.format must be one of %s, %s or %s", Branding.LCName, AuditJSON, AuditCEF, AuditLEEF)
+	}
+
+	switch Cfg.Headers.ObjectClaims {
+	case ObjectClaimsJSON, ObjectClaimsOmit:
+	default:
+		return fmt.Errorf("configuration error: %s.headers.object_claims must be one of %s or %s", Branding.LCName, ObjectClaimsJSON, ObjectClaimsOmit)
+	}
+	for header, claim := range Cfg.Headers.ClaimHeaders {
+		if !httpguts.ValidHeaderFieldName(header) || claim == "" {
+			return fmt.Errorf("configuration error: %s.headers.claim_headers %s: %q must be a header name and the path of a claim", Branding.LCName, header, claim)
+		}
+	}
+	if Cfg.Headers.AccessTokenEncrypt != "" {
+		if Cfg.Headers.AccessToken == "" {
+			return fmt.Errorf("configuration error: %s.headers.accesstoken_encrypt requires %s.headers.accesstoken, the header it encrypts", Branding.LCName, Branding.LCName)
+		}
+		if _, err := Cfg.AccessTokenKey(); err != nil {
+			return fmt.Errorf("configuration error: %w", err)
+		}
+	}
+	if Cfg.Headers.LogoutURL != "" && len(Cfg.Domains) == 0 {
+		return fmt.Errorf("configuration error: %s.headers.logout_url requires %s.domains, the hosts which may be returned to after logout", Branding.LCName, Branding.LCName)
+	}
+
+	if Cfg.CSRF.Enabled {
+		if Cfg.CSRF.CookieName == "" || Cfg.CSRF.Header == "" {
+			return fmt.Errorf("configuration error: %s.csrf requires cookie_name and header", Branding.LCName)
+		}
+		// the jwt cookie is found (and cleared) by its name as a prefix
+		if strings.HasPrefix(Cfg.CSRF.CookieName, Cfg.Cookie.Name) {
+			return fmt.Errorf("configuration error: %s.csrf.cookie_name %s must not begin with %s.cookie.name %s", Branding.LCName, Cfg.CSRF.CookieName, Branding.LCName, Cfg.Cookie.Name)
+		}
+	}
+
+	if Cfg.Cookie.Profile.Enabled {
+		if Cfg.Cookie.Profile.Name == "" || len(Cfg.Cookie.Profile.Claims) == 0 {
+			return fmt.Errorf("configuration error: %s.cookie.profile requires name and claims", Branding.LCName)
+		}
+		if strings.HasPrefix(Cfg.Cookie.Profile.Name, Cfg.Cookie.Name) {
+			return fmt.Errorf("configuration error: %s.cookie.profile.name %s must not begin with %s.cookie.name %s", Branding.LCName, Cfg.Cookie.Profile.Name, Branding.LCName, Cfg.Cookie.Name)
+		}
+		if Cfg.CSRF.Enabled && Cfg.Cookie.Profile.Name == Cfg.CSRF.CookieName {
+			return fmt.Errorf("configuration error: %s.cookie.profile.name %s is also %s.csrf.cookie_name", Branding.LCName, Cfg.Cookie.Profile.Name, Branding.LCName)
+		}
+	}
+
+	switch Cfg.Forwarded.Select {
+	case ForwardedFirst, ForwardedLast:
+	default:
+		return fmt.Errorf("configuration error: %s.forwarded.select must be one of %s or %s", Branding.LCName, ForwardedFirst, ForwardedLast)
+	}
+	switch Cfg.Forwarded.Header {
+	case ForwardedHeaderX, ForwardedHeaderRFC7239:
+	default:
+		return fmt.Errorf("configuration error: %s.forwarded.header must be one of %s or %s", Branding.LCName, ForwardedHeaderX, ForwardedHeaderRFC7239)
+	}
+	if Cfg.Forwarded.TrustedHops < 1 {
+		return fmt.Errorf("configuration error: %s.forwarded.trusted_hops must be at least 1 (currently: %d)", Branding.LCName, Cfg.Forwarded.TrustedHops)
+	}
+
+	switch Cfg.Groups.Strategy {
+	case GroupsTruncate, GroupsPreferWhitelist, GroupsError:
+	default:
+		return fmt.Errorf("configuration error: %s.groups.strategy must be one of %s, %s or %s", Branding.LCName, GroupsTruncate, GroupsPreferWhitelist, GroupsError)
+	}
+	switch Cfg.Groups.HeaderStyle {
+	case GroupsHeaderQuoted, GroupsHeaderRepeated:
+	case GroupsHeaderJoined:
+		if Cfg.Groups.HeaderDelimiter == "" {
+			return fmt.Errorf("configuration error: %s.groups.header_style %s requires a header_delimiter", Branding.LCName, GroupsHeaderJoined)
+		}
+	default:
+		return fmt.Errorf("configuration error: %s.groups.header_style must be one of %s, %s or %s", Branding.LCName, GroupsHeaderQuoted, GroupsHeaderJoined, GroupsHeaderRepeated)
+	}
+
+	loginOptionNames := make(map[string]bool)
+	for _, o := range Cfg.LoginOptions {
+		if o.Name == "" {
+			return fmt.Errorf("configuration error: every %s.login_options entry requires a name", Branding.LCName)
+		}
+		if loginOptionNames[o.Name] {
+			return fmt.Errorf("configuration error: %s.login_options name %s is used more than once", Branding.LCName, o.Name)
+		}
+		loginOptionNames[o.Name] = true
+		if InstanceOf(context.Background()).OAuthByName(o.Provider) == nil {
+			return fmt.Errorf("configuration error: %s.login_options %s names the provider %s, which is not one of the oauth providers", Branding.LCName, o.Name, o.Provider)
+		}
+	}
 
 	// check tls config
 	if Cfg.TLS.Key != "" && Cfg.TLS.Cert == "" {
@@ -469,6 +1512,20 @@ func basicTest() error {
 	return nil
 }
 
+// allowedCookieDomain the domain is one of `vouch.domains` or `vouch.cookie.domain`, or a subdomain of one
+func allowedCookieDomain(domain string) bool {
+	allowed := Cfg.Domains
+	if Cfg.Cookie.Domain != "" {
+		allowed = append([]string{Cfg.Cookie.Domain}, allowed...)
+	}
+	for _, a := range allowed {
+		if domain == a || strings.HasSuffix(domain, "."+a) {
+			return true
+		}
+	}
+	return false
+}
+
 // setDefaults set default options for most items from `.defaults.yml` in the root dir
 func setDefaults() {
 
@@ -538,10 +1595,110 @@ func cleanClaimsHeaders() error {
 		}
 		cleanedHeaders[claim] = header
 	}
+	// the token_claims are passed on as headers as well
+	for _, t := range Cfg.TokenClaims {
+		if _, ok := cleanedHeaders[t.Claim]; ok || t.Claim == "" {
+			continue
+		}
+		header, err := claimToHeader(t.Claim)
+		if err != nil {
+			return err
+		}
+		cleanedHeaders[t.Claim] = header
+	}
 	Cfg.Headers.ClaimsCleaned = cleanedHeaders
 	return nil
 }
 
+// checkPostLogoutRedirectURI the default destination after /logout must be an absolute url
+// and one of `post_logout_redirect_uris` when they're listed, as a `?url=` would have to be
+// checkRuleOperator the operator of the rule at key, such as roles.rules[0], and the values it compares with
+func checkRuleOperator(key, operator string, values []string) error {
+	switch operator {
+	case "", OperatorEqual, OperatorNotEqual:
+	case OperatorGreater, OperatorGreaterOrEqual, OperatorLess, OperatorLessOrEqual:
+		if len(values) != 1 {
+			return fmt.Errorf("configuration error: %s.%s operator %s requires a single value", Branding.LCName, key, operator)
+		}
+		if _, err := strconv.ParseFloat(values[0], 64); err != nil {
+			return fmt.Errorf("configuration error: %s.%s operator %s requires a number, not %q", Branding.LCName, key, operator, values[0])
+		}
+	default:
+		return fmt.Errorf("configuration error: %s.%s.operator %s must be one of ==, !=, >, >=, < or <=", Branding.LCName, key, operator)
+	}
+	return nil
+}
+
+// checkAudienceKeys each of `jwt.audience_keys` names a distinct audience and has a usable key
+func checkAudienceKeys() error {
+	seen := make(map[string]bool, len(Cfg.JWT.AudienceKeys))
+	for i, k := range Cfg.JWT.AudienceKeys {
+		name := fmt.Sprintf("%s.jwt.audience_keys[%d]", Branding.LCName, i)
+		aud := strings.ToLower(k.Audience)
+		switch {
+		case aud == "":
+			return fmt.Errorf("configuration error: %s requires an audience", name)
+		case seen[aud]:
+			return fmt.Errorf("configuration error: %s audience %s is listed more than once", name, k.Audience)
+		case !strings.HasPrefix(k.SigningMethod, "HS") && !strings.HasPrefix(k.SigningMethod, "RS") && !strings.HasPrefix(k.SigningMethod, "ES"),
+			jwt.GetSigningMethod(k.SigningMethod) == nil:
+			return fmt.Errorf("configuration error: %s.signing_method %q not allowed", name, k.SigningMethod)
+		case strings.HasPrefix(k.SigningMethod, "HS") && (k.PrivateKeyFile != "" || len(k.Secret) < minBase64Length):
+			return fmt.Errorf("configuration error: %s with signing method %s requires a secret of at least %d characters and no private_key_file", name, k.SigningMethod, minBase64Length)
+		case !strings.HasPrefix(k.SigningMethod, "HS") && (k.Secret != "" || k.PrivateKeyFile == ""):
+			return fmt.Errorf("configuration error: %s with signing method %s requires a private_key_file and no secret", name, k.SigningMethod)
+		}
+		if _, err := k.SigningKey(); err != nil {
+			return fmt.Errorf("configuration error: %s: %w", name, err)
+		}
+		seen[aud] = true
+	}
+	return nil
+}
+
+func checkPostLogoutRedirectURI() error {
+	if Cfg.PostLogoutRedirectURI != "" {
+		if err := checkLogoutRedirectURL("post_logout_redirect_uri", Cfg.PostLogoutRedirectURI); err != nil {
+			return err
+		}
+	}
+	for i, rule := range Cfg.PostLogoutRedirectRules {
+		name := fmt.Sprintf("post_logout_redirect_rules[%d]", i)
+		if rule.Claim == "" || len(rule.Values) == 0 || rule.URL == "" {
+			return fmt.Errorf("configuration error: %s.%s requires a claim, values and a url", Branding.LCName, name)
+		}
+		if err := checkRuleOperator(name, rule.Operator, rule.Values); err != nil {
+			return err
+		}
+		if err := checkLogoutRedirectURL(name+".url", rule.URL); err != nil {
+			return err
+		}
+		// unlike a `?url=` these aren't checked at /logout, so they must be on a host Vouch Proxy manages
+		u, _ := url.Parse(rule.URL)
+		if !allowedCookieDomain(u.Hostname()) {
+			return fmt.Errorf("configuration error: %s.%s.url %s must be within %s.domains or %s.cookie.domain", Branding.LCName, name, rule.URL, Branding.LCName, Branding.LCName)
+		}
+	}
+	return nil
+}
+
+// checkLogoutRedirectURL the url must be absolute and one of `post_logout_redirect_uris` when they're listed
+func checkLogoutRedirectURL(name, redirectURL string) error {
+	u, err := url.Parse(redirectURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("configuration error: %s.%s %s must be an absolute http or https url", Branding.LCName, name, redirectURL)
+	}
+	if len(Cfg.LogoutRedirectURLs) == 0 {
+		return nil
+	}
+	for _, allowed := range Cfg.LogoutRedirectURLs {
+		if allowed == redirectURL {
+			return nil
+		}
+	}
+	return fmt.Errorf("configuration error: %s.%s %s must be one of %s.post_logout_redirect_uris", Branding.LCName, name, redirectURL, Branding.LCName)
+}
+
 // InitForTestPurposes is called by most *_testing.go files in Vouch Proxy
 func InitForTestPurposes() {
 	InitForTestPurposesWithProvider("")
@@ -550,6 +1707,8 @@ func InitForTestPurposes() {
 // InitForTestPurposesWithProvider just for testing
 func InitForTestPurposesWithProvider(provider string) {
 	Cfg = &Config{} // clear it out since we're called multiple times from subsequent tests
+	GenOAuth = &oauthConfig{}
+	OAuthConfigs = []*oauthConfig{GenOAuth}
 	Logging.setLogLevel(zapcore.InfoLevel)
 	setRootDir()
 	// _, b, _, _ := runtime.Caller(0)
@@ -582,14 +1741,14 @@ func InitForTestPurposesWithProvider(provider string) {
 
 }
 
-func DecryptionKey() (interface{}, error) {
-	if strings.HasPrefix(Cfg.JWT.SigningMethod, "HS") {
-		return []byte(Cfg.JWT.Secret), nil
+func (c *Config) DecryptionKey() (interface{}, error) {
+	if strings.HasPrefix(c.JWT.SigningMethod, "HS") {
+		return []byte(c.JWT.Secret), nil
 	}
 
-	f, err := os.Open(Cfg.JWT.PublicKeyFile)
+	f, err := os.Open(c.JWT.PublicKeyFile)
 	if err != nil {
-		return nil, fmt.Errorf("error opening Key %s: %s", Cfg.JWT.PublicKeyFile, err)
+		return nil, fmt.Errorf("error opening Key %s: %s", c.JWT.PublicKeyFile, err)
 	}
 
 	keyBytes, err := ioutil.ReadAll(f)
@@ -599,13 +1758,13 @@ func DecryptionKey() (interface{}, error) {
 
 	var key interface{}
 	switch {
-	case strings.HasPrefix(Cfg.JWT.SigningMethod, "RS"):
+	case strings.HasPrefix(c.JWT.SigningMethod, "RS"):
 		key, err = jwt.ParseRSAPublicKeyFromPEM(keyBytes)
-	case strings.HasPrefix(Cfg.JWT.SigningMethod, "ES"):
+	case strings.HasPrefix(c.JWT.SigningMethod, "ES"):
 		key, err = jwt.ParseECPublicKeyFromPEM(keyBytes)
 	default:
 		// signingMethod should already have been validated, this should not happen
-		return nil, fmt.Errorf("unexpected signing method %s", Cfg.JWT.SigningMethod)
+		return nil, fmt.Errorf("unexpected signing method %s", c.JWT.SigningMethod)
 	}
 
 	if err != nil {
@@ -615,14 +1774,36 @@ func DecryptionKey() (interface{}, error) {
 	return key, nil
 }
 
-func SigningKey() (interface{}, error) {
-	if strings.HasPrefix(Cfg.JWT.SigningMethod, "HS") {
-		return []byte(Cfg.JWT.Secret), nil
+func (c *Config) SigningKey() (interface{}, error) {
+	if strings.HasPrefix(c.JWT.SigningMethod, "HS") {
+		return []byte(c.JWT.Secret), nil
 	}
+	return privateKey(c.JWT.SigningMethod, c.JWT.PrivateKeyFile)
+}
+
+// parseECPrivateKey an ECDSA private key in SEC 1 or, such as the .p8 files of Apple, PKCS #8 form
+func parseECPrivateKey(keyBytes []byte) (*ecdsa.PrivateKey, error) {
+	key, err := jwt.ParseECPrivateKeyFromPEM(keyBytes)
+	if err == nil || errors.Is(err, jwt.ErrKeyMustBePEMEncoded) {
+		return key, err
+	}
+	block, _ := pem.Decode(keyBytes)
+	pkcs8, perr := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if perr != nil {
+		return nil, err
+	}
+	ecKey, ok := pkcs8.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, jwt.ErrNotECPrivateKey
+	}
+	return ecKey, nil
+}
 
-	f, err := os.Open(Cfg.JWT.PrivateKeyFile)
+// privateKey the RSA or ECDSA private key for signingMethod from the PEM file
+func privateKey(signingMethod, file string) (interface{}, error) {
+	f, err := os.Open(file)
 	if err != nil {
-		return nil, fmt.Errorf("error opening RSA Key %s: %s", Cfg.JWT.PrivateKeyFile, err)
+		return nil, fmt.Errorf("error opening RSA Key %s: %s", file, err)
 	}
 
 	keyBytes, err := ioutil.ReadAll(f)
@@ -632,13 +1813,13 @@ func SigningKey() (interface{}, error) {
 
 	var key interface{}
 	switch {
-	case strings.HasPrefix(Cfg.JWT.SigningMethod, "RS"):
+	case strings.HasPrefix(signingMethod, "RS"):
 		key, err = jwt.ParseRSAPrivateKeyFromPEM(keyBytes)
-	case strings.HasPrefix(Cfg.JWT.SigningMethod, "ES"):
-		key, err = jwt.ParseECPrivateKeyFromPEM(keyBytes)
+	case strings.HasPrefix(signingMethod, "ES"):
+		key, err = parseECPrivateKey(keyBytes)
 	default:
 		// We should have validated this before
-		return nil, fmt.Errorf("unexpected signing method %s", Cfg.JWT.SigningMethod)
+		return nil, fmt.Errorf("unexpected signing method %s", signingMethod)
 	}
 
 	if err != nil {
@@ -11,12 +11,24 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package cfg
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -79,6 +91,508 @@ func TestConfigWithTLS(t *testing.T) {
 		})
 	}
 }
+func TestConfigCookieMaxChunkSize(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxChunkSize int
+		wantErr      bool
+	}{
+		{"default", 4000, false},
+		{"minimum", minCookieChunkSize, false},
+		{"maximum", maxCookieChunkSize, false},
+		{"too small", minCookieChunkSize - 1, true},
+		{"too large", maxCookieChunkSize + 1, true},
+		{"unset", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(cleanupEnv)
+			InitForTestPurposes()
+			Cfg.Cookie.MaxChunkSize = tt.maxChunkSize
+			err := ValidateConfiguration()
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigStateBytes(t *testing.T) {
+	tests := []struct {
+		name       string
+		stateBytes int
+		wantErr    bool
+	}{
+		{"default", 32, false},
+		{"minimum", minStateBytes, false},
+		{"maximum", maxStateBytes, false},
+		{"too short", minStateBytes - 1, true},
+		{"too long", maxStateBytes + 1, true},
+		{"unset", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(cleanupEnv)
+			InitForTestPurposes()
+			Cfg.Session.StateBytes = tt.stateBytes
+			err := ValidateConfiguration()
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigLogoutURLRequiresDomains(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	Cfg.Headers.LogoutURL = "X-Vouch-Logout-URL"
+	assert.NoError(t, ValidateConfiguration())
+
+	Cfg.Domains = nil
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigRoleOperators(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	tests := []struct {
+		name     string
+		operator string
+		values   []string
+		coercion string
+		wantErr  bool
+	}{
+		{"any of", "", []string{"a", "b"}, CoercionLoose, false},
+		{"not equal", "!=", []string{"a", "b"}, CoercionLoose, false},
+		{"numeric", ">=", []string{"3"}, CoercionStrict, false},
+		{"numeric needs a number", ">=", []string{"three"}, CoercionLoose, true},
+		{"numeric needs one value", "<", []string{"3", "4"}, CoercionLoose, true},
+		{"unknown operator", "~=", []string{"a"}, CoercionLoose, true},
+		{"unknown coercion", "", []string{"a"}, "sloppy", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitForTestPurposes()
+			Cfg.Roles.Rules = []RoleRule{{Role: "r", Claim: "c", Operator: tt.operator, Values: tt.values}}
+			Cfg.Roles.Coercion = tt.coercion
+			err := ValidateConfiguration()
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+		})
+	}
+}
+
+func TestConfigGroupsHeaderStyle(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	tests := []struct {
+		style     string
+		delimiter string
+		wantErr   bool
+	}{
+		{GroupsHeaderQuoted, ",", false},
+		{GroupsHeaderJoined, ";", false},
+		{GroupsHeaderJoined, "", true},
+		{GroupsHeaderRepeated, "", false},
+		{"json", ",", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.style+" "+tt.delimiter, func(t *testing.T) {
+			InitForTestPurposes()
+			Cfg.Groups.HeaderStyle = tt.style
+			Cfg.Groups.HeaderDelimiter = tt.delimiter
+			err := ValidateConfiguration()
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+		})
+	}
+}
+
+func TestConfigConditionalValidate(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.False(t, Cfg.ConditionalValidate.Enabled)
+	assert.Equal(t, "X-Vouch-Session", Cfg.ConditionalValidate.Header)
+	assert.Equal(t, "If-Vouch-Session", Cfg.ConditionalValidate.RequestHeader)
+
+	Cfg.ConditionalValidate.Enabled = true
+	assert.NoError(t, ValidateConfiguration())
+	Cfg.ConditionalValidate.RequestHeader = ""
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigOAuthClaims(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.Empty(t, GenOAuth.ClaimsParam)
+
+	GenOAuth.Claims = map[string]interface{}{
+		"userinfo": map[string]interface{}{"groups": nil, "email_verified": map[string]interface{}{"essential": true}},
+	}
+	assert.NoError(t, ValidateConfiguration())
+	param, err := oauthClaimsParam()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"userinfo":{"groups":null,"email_verified":{"essential":true}}}`, param)
+
+	// the parameter only has members for the id_token and userinfo
+	GenOAuth.Claims = map[string]interface{}{"groups": nil}
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigDenyRules(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	tests := []struct {
+		name    string
+		rule    DenyRule
+		wantErr bool
+	}{
+		{"valid", DenyRule{Claim: "email_verified", Values: []string{"false"}, ReasonCode: "email_unverified"}, false},
+		{"operator", DenyRule{Claim: "age", Operator: "<", Values: []string{"18"}, ReasonCode: "minor"}, false},
+		{"no reason code", DenyRule{Claim: "email_verified", Values: []string{"false"}}, true},
+		{"reason code with spaces", DenyRule{Claim: "email_verified", Values: []string{"false"}, ReasonCode: "not verified"}, true},
+		{"no values", DenyRule{Claim: "email_verified", ReasonCode: "email_unverified"}, true},
+		{"not a number", DenyRule{Claim: "age", Operator: "<", Values: []string{"young"}, ReasonCode: "minor"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitForTestPurposes()
+			Cfg.DenyRules = []DenyRule{tt.rule}
+			err := ValidateConfiguration()
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+		})
+	}
+}
+
+func TestConfigJWTRolling(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.False(t, Cfg.JWT.Rolling.Enabled)
+	assert.Equal(t, 15, Cfg.JWT.Rolling.Window)
+
+	Cfg.JWT.Rolling.Enabled = true
+	assert.NoError(t, ValidateConfiguration())
+	Cfg.JWT.Rolling.Window = 0
+	assert.Error(t, ValidateConfiguration())
+	// a window as long as the JWT would reissue it at every request
+	Cfg.JWT.Rolling.Window = Cfg.JWT.MaxAge
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigJWTIdleTimeout(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.Equal(t, 0, Cfg.JWT.IdleTimeout)
+
+	Cfg.JWT.IdleTimeout = 30
+	assert.NoError(t, ValidateConfiguration())
+	Cfg.JWT.IdleTimeout = -1
+	assert.Error(t, ValidateConfiguration())
+	Cfg.JWT.IdleTimeout = Cfg.JWT.MaxAge
+	assert.Error(t, ValidateConfiguration())
+	Cfg.JWT.IdleTimeout = 30
+	Cfg.JWT.Rolling.Enabled = true
+	assert.Error(t, ValidateConfiguration(), "rolling moves the expiry")
+}
+
+func TestConfigStatelessState(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.False(t, Cfg.StatelessState)
+
+	Cfg.StatelessState = true
+	GenOAuth.CodeChallengeMethod = ""
+	assert.NoError(t, ValidateConfiguration())
+	GenOAuth.CodeChallengeMethod = "S256"
+	assert.Error(t, ValidateConfiguration(), "the code_verifier is kept in the session")
+	GenOAuth.CodeChallengeMethod = ""
+	Cfg.JWT.SigningMethod = "RS256"
+	assert.Error(t, checkStatelessState(), "the key is derived from the jwt.secret")
+}
+
+func TestConfigWhiteListRegex(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	Cfg.WhiteList = []string{"test@example.com", `regex:ext-.+@partner\.com`, "regex:(?i)^admin-"}
+	assert.NoError(t, ValidateConfiguration())
+	assert.Len(t, Cfg.WhiteListRegexps, 2)
+
+	// an invalid pattern fails rather than being skipped
+	Cfg.WhiteList = []string{"regex:ext-(.+@partner.com"}
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigPostLogoutRedirectURI(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	tests := []struct {
+		uri     string
+		listed  []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"https://myapp.example.com/", nil, false},
+		{"https://myapp.example.com/", []string{"https://myapp.example.com/"}, false},
+		{"https://myapp.example.com/", []string{"https://other.example.com/"}, true},
+		{"/loggedout", nil, true},
+		{"javascript:alert(1)", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			InitForTestPurposes()
+			Cfg.PostLogoutRedirectURI = tt.uri
+			Cfg.LogoutRedirectURLs = tt.listed
+			err := ValidateConfiguration()
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+		})
+	}
+}
+
+func TestConfigSessionBackend(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	tests := []struct {
+		backend string
+		addr    string
+		wantErr bool
+	}{
+		{SessionBackendCookie, "", false},
+		{SessionBackendRedis, "redis:6379", false},
+		{SessionBackendRedis, "", true},
+		{SessionBackendRedis, "redis", true},
+		{"memcached", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backend+" "+tt.addr, func(t *testing.T) {
+			InitForTestPurposes()
+			assert.Equal(t, "vouch:session:", Cfg.Session.Redis.KeyPrefix)
+			Cfg.Session.Backend = tt.backend
+			Cfg.Session.Redis.Addr = tt.addr
+			err := ValidateConfiguration()
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+		})
+	}
+}
+
+func TestConfigCORS(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	tests := []struct {
+		name        string
+		origins     []string
+		credentials bool
+		wantErr     bool
+	}{
+		{"off", nil, false, false},
+		{"origins", []string{"https://app.example.com", "http://localhost:3000", "https://*.example.com"}, true, false},
+		{"any without credentials", []string{"*"}, false, false},
+		{"any with credentials", []string{"*"}, true, true},
+		{"a url rather than an origin", []string{"https://app.example.com/page"}, false, true},
+		{"no scheme", []string{"app.example.com"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitForTestPurposes()
+			Cfg.CORS.AllowedOrigins = tt.origins
+			Cfg.CORS.AllowCredentials = tt.credentials
+			err := ValidateConfiguration()
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+		})
+	}
+}
+
+func TestConfigEmailRegex(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.True(t, Cfg.IsEmail("jane@example.com"))
+	assert.False(t, Cfg.IsEmail("EXAMPLE\\jane"))
+	assert.False(t, Cfg.IsEmail("svc_build@ci"+strings.Repeat("-", 70)+".example.com"))
+
+	Cfg.EmailRegex = `^[^@\s]+@[^@\s]+$`
+	assert.NoError(t, ValidateConfiguration())
+	assert.True(t, Cfg.IsEmail("svc_build@ci"+strings.Repeat("-", 70)+".example.com"))
+	assert.False(t, Cfg.IsEmail("EXAMPLE\\jane"))
+
+	Cfg.EmailRegex = `^[`
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigClientCert(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.False(t, Cfg.ClientCert.Enabled)
+	assert.Equal(t, "X-SSL-Client-S-DN", Cfg.ClientCert.DNHeader)
+	assert.Equal(t, "X-SSL-Client-Verify", Cfg.ClientCert.VerifyHeader)
+
+	Cfg.ClientCert.Enabled = true
+	assert.Error(t, ValidateConfiguration(), "the headers must be trusted")
+	Cfg.ClientCert.TrustHeaders = true
+	assert.NoError(t, ValidateConfiguration())
+	Cfg.ClientCert.DNHeader = ""
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigRevocationStore(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	tests := []struct {
+		name       string
+		backend    string
+		addr       string
+		adminTeams []string
+		wantErr    bool
+	}{
+		{"none", "", "", nil, false},
+		{"redis", RevocationStoreRedis, "redis:6379", []string{"admins"}, false},
+		{"no addr", RevocationStoreRedis, "", nil, true},
+		{"admin_teams without a backend", "", "", []string{"admins"}, true},
+		{"memcached", "memcached", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitForTestPurposes()
+			assert.Equal(t, "vouch:revoked:", Cfg.RevocationStore.Redis.KeyPrefix)
+			Cfg.RevocationStore.Backend = tt.backend
+			Cfg.RevocationStore.Redis.Addr = tt.addr
+			Cfg.RevocationStore.AdminTeams = tt.adminTeams
+			err := ValidateConfiguration()
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+			// the admin's teams are kept in the jwt
+			assert.Equal(t, len(tt.adminTeams) > 0, Cfg.PoliciesUseTeams())
+		})
+	}
+}
+
+func TestConfigMetrics(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.True(t, Cfg.Metrics.Enabled)
+	assert.Empty(t, Cfg.Metrics.Listen)
+
+	Cfg.Metrics.Listen = "127.0.0.1:9091"
+	assert.NoError(t, ValidateConfiguration())
+	Cfg.Metrics.Listen = "9091"
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigTracing(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	tests := []struct {
+		name       string
+		endpoint   string
+		sampleRate float64
+		wantErr    bool
+	}{
+		{"collector", "http://otel-collector:4318", 1, false},
+		{"with a path", "https://collector.example.com/v1/traces", 0.25, false},
+		{"no endpoint", "", 1, true},
+		{"not a url", "otel-collector:4318", 1, true},
+		{"sample rate too high", "http://otel-collector:4318", 1.5, true},
+		{"negative sample rate", "http://otel-collector:4318", -0.1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitForTestPurposes()
+			assert.False(t, Cfg.Tracing.Enabled)
+			assert.Equal(t, "vouch-proxy", Cfg.Tracing.ServiceName)
+			assert.Equal(t, 1.0, Cfg.Tracing.SampleRate)
+			Cfg.Tracing.Enabled = true
+			Cfg.Tracing.Endpoint = tt.endpoint
+			Cfg.Tracing.SampleRate = tt.sampleRate
+			err := ValidateConfiguration()
+			assert.Equal(t, tt.wantErr, err != nil, "%v", err)
+		})
+	}
+}
+
+func TestConfigSelfTest(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.False(t, Cfg.SelfTest.Enabled)
+	assert.Equal(t, SelfTestFatal, Cfg.SelfTest.OnFailure)
+
+	os.Setenv("VOUCH_SELF_TEST_ON_FAILURE", SelfTestWarn)
+	InitForTestPurposes()
+	assert.Equal(t, SelfTestWarn, Cfg.SelfTest.OnFailure)
+	assert.NoError(t, ValidateConfiguration())
+
+	Cfg.SelfTest.OnFailure = "ignore"
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigCSRF(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	Cfg.CSRF.Enabled = true
+	assert.NoError(t, ValidateConfiguration())
+
+	// it would be taken for a part of the jwt cookie
+	Cfg.CSRF.CookieName = Cfg.Cookie.Name + "_csrf"
+	assert.Error(t, ValidateConfiguration())
+
+	Cfg.CSRF.CookieName = "VouchCSRF"
+	Cfg.CSRF.Header = ""
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigTokenClaims(t *testing.T) {
+	tests := []struct {
+		name        string
+		tokenClaims []TokenClaim
+		wantErr     bool
+		wantHeaders []string
+	}{
+		{"unset", nil, false, nil},
+		{"static and template", []TokenClaim{{Claim: "env", Value: "prod"}, {Claim: "principal", Value: "{{.Email}}"}}, false, []string{"env", "principal"}},
+		{"no claim", []TokenClaim{{Value: "prod"}}, true, nil},
+		{"bad template", []TokenClaim{{Claim: "principal", Value: "{{.Email"}}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(cleanupEnv)
+			InitForTestPurposes()
+			Cfg.TokenClaims = tt.tokenClaims
+			err := ValidateConfiguration()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				assert.NoError(t, cleanClaimsHeaders())
+				for _, claim := range tt.wantHeaders {
+					assert.Contains(t, Cfg.Headers.ClaimsCleaned, claim)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigTenantDomains(t *testing.T) {
+	tests := []struct {
+		name          string
+		tenantClaim   string
+		tenantDomains map[string]string
+		cookieDomain  string
+		wantErr       bool
+	}{
+		{"unset", "", nil, "", false},
+		{"within domains", "tenant", map[string]string{"a": "a.vouch.github.io", "b": "b.vouch.github.io"}, "", false},
+		{"the domain itself", "tenant", map[string]string{"a": "vouch.github.io"}, "", false},
+		{"within cookie.domain", "tenant", map[string]string{"a": "a.example.com"}, "example.com", false},
+		{"outside domains", "tenant", map[string]string{"a": "a.vouch.github.io", "b": "b.example.com"}, "", true},
+		{"suffix is not a subdomain", "tenant", map[string]string{"a": "evilvouch.github.io"}, "", true},
+		{"claim without domains", "tenant", nil, "", true},
+		{"domains without claim", "", map[string]string{"a": "a.vouch.github.io"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(cleanupEnv)
+			InitForTestPurposes()
+			Cfg.Cookie.TenantClaim = tt.tenantClaim
+			Cfg.Cookie.TenantDomains = tt.tenantDomains
+			Cfg.Cookie.Domain = tt.cookieDomain
+			err := ValidateConfiguration()
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func TestSetGitHubDefaults(t *testing.T) {
 	InitForTestPurposesWithProvider("github")
 	assert.Equal(t, []string{"read:user"}, GenOAuth.Scopes)
@@ -276,3 +790,588 @@ func cleanupEnv() {
 	Cfg = &Config{}
 	GenOAuth = &oauthConfig{}
 }
+
+func TestConfigCookieProfile(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.Equal(t, "VouchProfile", Cfg.Cookie.Profile.Name)
+	Cfg.Cookie.Profile.Enabled = true
+	assert.Error(t, ValidateConfiguration(), "the claims must be listed")
+
+	Cfg.Cookie.Profile.Claims = []string{"name", "picture"}
+	assert.NoError(t, ValidateConfiguration())
+
+	// it would be taken for a part of the jwt cookie
+	Cfg.Cookie.Profile.Name = Cfg.Cookie.Name + "_profile"
+	assert.Error(t, ValidateConfiguration())
+
+	Cfg.CSRF.Enabled = true
+	Cfg.Cookie.Profile.Name = Cfg.CSRF.CookieName
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigRateLimit(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.Equal(t, 0, Cfg.RateLimit.RequestsPerMinute, "off by default")
+	assert.NoError(t, ValidateConfiguration())
+
+	Cfg.RateLimit.RequestsPerMinute = 30
+	assert.NoError(t, ValidateConfiguration())
+	Cfg.RateLimit.Burst = 0
+	assert.Error(t, ValidateConfiguration())
+
+	Cfg.RateLimit.Burst = 10
+	Cfg.RateLimit.RequestsPerMinute = -1
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigLockout(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.Equal(t, 0, Cfg.Lockout.Threshold, "off by default")
+	assert.Equal(t, 300, Cfg.Lockout.Window)
+	assert.Equal(t, 900, Cfg.Lockout.Duration)
+
+	Cfg.Lockout.Threshold = 10
+	assert.NoError(t, ValidateConfiguration())
+	Cfg.Lockout.Duration = 0
+	assert.Error(t, ValidateConfiguration())
+
+	Cfg.Lockout.Duration = 900
+	Cfg.Lockout.Threshold = -1
+	assert.Error(t, ValidateConfiguration())
+
+	Cfg.Lockout.Threshold = 10
+	Cfg.Lockout.Shared = true
+	assert.Error(t, ValidateConfiguration(), "requires session.backend redis")
+}
+
+func TestConfigTemplatesDir(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.Empty(t, Cfg.Templates.Dir)
+
+	Cfg.Templates.Dir = t.TempDir()
+	assert.NoError(t, ValidateConfiguration())
+	Cfg.Templates.Dir = filepath.Join(Cfg.Templates.Dir, "missing")
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigForwardedHeader(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.Equal(t, ForwardedHeaderX, Cfg.Forwarded.Header)
+
+	Cfg.Forwarded.Header = ForwardedHeaderRFC7239
+	assert.NoError(t, ValidateConfiguration())
+	Cfg.Forwarded.Header = "x-forwarded-for"
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigCSP(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.False(t, Cfg.CSP.Enabled)
+	assert.Contains(t, Cfg.CSP.Policy, "'nonce-"+CSPNonceToken+"'")
+
+	Cfg.CSP.Enabled = true
+	assert.NoError(t, ValidateConfiguration())
+	Cfg.CSP.Policy = ""
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigJWTEncrypt(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.False(t, Cfg.JWT.Encrypt)
+
+	Cfg.JWT.Encrypt = true
+	Cfg.JWT.Secret = "too-short"
+	assert.Error(t, ValidateConfiguration())
+	Cfg.JWT.Secret = "a-jwt-secret-of-at-least-32-characters"
+	assert.NoError(t, ValidateConfiguration())
+
+	Cfg.JWT.SigningMethod = "RS256"
+	assert.Error(t, checkJWTEncrypt(), "there is no secret to derive the key from")
+}
+
+func TestConfigClaimHeaders(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.Equal(t, ",", Cfg.Headers.ClaimHeadersSeparator)
+
+	Cfg.Headers.ClaimHeaders = map[string]string{"X-App-Role": "realm_access.roles[0]"}
+	assert.NoError(t, ValidateConfiguration())
+	Cfg.Headers.ClaimHeaders = map[string]string{"X App Role": "realm_access.roles[0]"}
+	assert.Error(t, ValidateConfiguration())
+	Cfg.Headers.ClaimHeaders = map[string]string{"X-App-Role": ""}
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigSessionTimeout(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.Equal(t, 5, Cfg.Session.Timeout)
+	assert.Equal(t, 1, Cfg.Session.SaveRetries)
+
+	Cfg.Session.Timeout = 0
+	assert.Error(t, ValidateConfiguration())
+	Cfg.Session.Timeout = 5
+	Cfg.Session.SaveRetries = -1
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigPostLogoutRedirectRules(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+
+	rule := LogoutRedirectRule{Claim: "user_type", Values: []string{"partner"}, URL: "https://partners." + Cfg.Domains[0] + "/"}
+	Cfg.PostLogoutRedirectRules = []LogoutRedirectRule{rule}
+	assert.NoError(t, ValidateConfiguration())
+
+	tests := []struct {
+		name string
+		rule LogoutRedirectRule
+	}{
+		{"no url", LogoutRedirectRule{Claim: "user_type", Values: []string{"partner"}}},
+		{"no values", LogoutRedirectRule{Claim: "user_type", URL: rule.URL}},
+		{"relative url", LogoutRedirectRule{Claim: "user_type", Values: []string{"partner"}, URL: "/bye"}},
+		{"outside domains", LogoutRedirectRule{Claim: "user_type", Values: []string{"partner"}, URL: "https://evil.com/"}},
+		{"bad operator", LogoutRedirectRule{Claim: "level", Operator: "~", Values: []string{"3"}, URL: rule.URL}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Cfg.PostLogoutRedirectRules = []LogoutRedirectRule{rule, tt.rule}
+			assert.Error(t, ValidateConfiguration())
+		})
+	}
+
+	// when they're listed the url must be one of the post_logout_redirect_uris
+	Cfg.PostLogoutRedirectRules = []LogoutRedirectRule{rule}
+	Cfg.LogoutRedirectURLs = []string{"https://other." + Cfg.Domains[0] + "/"}
+	assert.Error(t, ValidateConfiguration())
+	Cfg.LogoutRedirectURLs = append(Cfg.LogoutRedirectURLs, rule.URL)
+	assert.NoError(t, ValidateConfiguration())
+}
+
+func TestConfigIDTokenSigningAlgs(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.Subset(t, GenOAuth.IDTokenSigningAlgs, []string{"RS256", "PS256", "ES256", "ES384"})
+	assert.NotContains(t, GenOAuth.IDTokenSigningAlgs, "none")
+
+	GenOAuth.ClientSecret = ""
+	assert.NotContains(t, defaultIDTokenSigningAlgs(), "HS256", "an HMAC needs the client_secret as its key")
+	GenOAuth.ClientSecret = "secret"
+	assert.Contains(t, defaultIDTokenSigningAlgs(), "HS256")
+
+	// nor may one be listed for a client without a client_secret, such as a public PKCE client
+	GenOAuth.IDTokenSigningAlgs = []string{"RS256", "HS256"}
+	assert.NoError(t, ValidateConfiguration())
+	GenOAuth.ClientSecret = ""
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigUseRefreshTokens(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.Equal(t, 5, GenOAuth.RefreshWindow)
+
+	GenOAuth.UseRefreshTokens = true
+	defer func() { GenOAuth.UseRefreshTokens = false }()
+	assert.Error(t, ValidateConfiguration(), "the refresh token must not be readable in the cookie")
+	Cfg.JWT.Encrypt = true
+	Cfg.JWT.Secret = "testingsecrettestingsecrettestingsecret"
+	assert.NoError(t, ValidateConfiguration())
+
+	GenOAuth.RefreshWindow = Cfg.JWT.MaxAge
+	assert.Error(t, ValidateConfiguration())
+	GenOAuth.RefreshWindow = 0
+	assert.Error(t, ValidateConfiguration())
+	GenOAuth.RefreshWindow = 5
+	Cfg.JWT.Rolling.Enabled = true
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigApple(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposesWithProvider("apple")
+	defer InitForTestPurposes()
+	assert.Equal(t, "https://appleid.apple.com/auth/token", GenOAuth.TokenURL)
+	assert.Equal(t, "https://appleid.apple.com/auth/keys", GenOAuth.JWKSURL)
+	assert.Equal(t, []string{"name", "email"}, GenOAuth.Scopes)
+	GenOAuth.ClientSecret = ""
+	assert.Error(t, ValidateConfiguration(), "the key is required")
+
+	// the .p8 file downloaded from Apple is PKCS #8
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	p8 := filepath.Join(t.TempDir(), "AuthKey_KEY123.p8")
+	assert.NoError(t, ioutil.WriteFile(p8, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	GenOAuth.Apple.TeamID = "TEAM123"
+	GenOAuth.Apple.KeyID = "KEY123"
+	GenOAuth.Apple.PrivateKeyFile = p8
+	assert.NoError(t, ValidateConfiguration())
+	signingKey, err := GenOAuth.AppleSigningKey()
+	assert.NoError(t, err)
+	assert.Equal(t, key, signingKey)
+
+	GenOAuth.UseRefreshTokens = true
+	assert.Error(t, ValidateConfiguration())
+	GenOAuth.UseRefreshTokens = false
+	GenOAuth.Apple.PrivateKeyFile = filepath.Join(t.TempDir(), "missing.p8")
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigAccessTokenEncrypt(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	setUp("/config/testing/handler_accesstoken.yml")
+	assert.NoError(t, ValidateConfiguration())
+	key, err := Cfg.AccessTokenKey()
+	assert.NoError(t, err)
+	assert.Len(t, key, 32)
+
+	Cfg.Headers.AccessTokenEncrypt = "not base64!"
+	assert.Error(t, ValidateConfiguration())
+	Cfg.Headers.AccessTokenEncrypt = "c2hvcnQ="
+	assert.Error(t, ValidateConfiguration(), "the key must be 256 bits")
+	Cfg.Headers.AccessTokenEncrypt = "1etvapkjqhkOPpx39B0fPjdYvYt6MZZIFemwPpRUxMU"
+	assert.NoError(t, ValidateConfiguration())
+	Cfg.Headers.AccessToken = ""
+	assert.Error(t, ValidateConfiguration(), "there is no header to encrypt")
+}
+
+func TestConfigSAML(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	setUp("/config/testing/handler_saml.yml")
+	assert.Equal(t, Providers.SAML, GenOAuth.Provider)
+	assert.Equal(t, "https://vouch.example.com/saml/metadata", Cfg.SAML.EntityID)
+	assert.Equal(t, "email", Cfg.SAML.Attributes.Email)
+	assert.Equal(t, "groups", Cfg.SAML.Attributes.Groups)
+	assert.Error(t, ValidateConfiguration(), "the assertions are kept in session.backend redis")
+	Cfg.Session.Backend = SessionBackendRedis
+	Cfg.Session.Redis.Addr = "redis:6379"
+	assert.NoError(t, ValidateConfiguration())
+
+	Cfg.SAML.ACSURL = "https://vouch.example.org/saml/acs"
+	assert.Error(t, ValidateConfiguration(), "the acs_url must be within vouch.domains")
+	Cfg.SAML.ACSURL = "/saml/acs"
+	assert.Error(t, ValidateConfiguration(), "the acs_url must be absolute")
+	Cfg.SAML.ACSURL = "https://vouch.example.com/saml/acs"
+
+	// the key pair which signs the authentication requests
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	Cfg.SAML.Cert = filepath.Join(dir, "sp.crt")
+	assert.NoError(t, ioutil.WriteFile(Cfg.SAML.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Error(t, ValidateConfiguration(), "cert and key must be set together")
+	Cfg.SAML.Key = filepath.Join(dir, "sp.key")
+	assert.NoError(t, ioutil.WriteFile(Cfg.SAML.Key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	assert.NoError(t, ValidateConfiguration())
+	signingKey, cert, err := Cfg.SAMLKeyPair()
+	assert.NoError(t, err)
+	assert.Equal(t, key, signingKey)
+	assert.Equal(t, der, cert.Raw)
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(Cfg.SAML.Key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(other)}), 0600))
+	assert.Error(t, ValidateConfiguration(), "the cert is not for the key")
+
+	Cfg.SAML.Cert, Cfg.SAML.Key = "", ""
+	GenOAuth.UseRefreshTokens = true
+	assert.Error(t, ValidateConfiguration())
+	GenOAuth.UseRefreshTokens = false
+	GenOAuth.Provider = Providers.Google
+	assert.Error(t, ValidateConfiguration(), "saml is used in place of an oauth provider")
+}
+
+func TestConfigAudienceKeys(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	secret := strings.Repeat("s", minBase64Length)
+	keyFile := filepath.Join(t.TempDir(), "missing.key")
+
+	Cfg.JWT.AudienceKeys = []AudienceKey{{Audience: "svc-a.example.com", SigningMethod: "HS256", Secret: secret}}
+	assert.NoError(t, ValidateConfiguration())
+
+	tests := []struct {
+		name string
+		key  AudienceKey
+	}{
+		{"no audience", AudienceKey{SigningMethod: "HS256", Secret: secret}},
+		{"listed twice", AudienceKey{Audience: "SVC-A.example.com", SigningMethod: "HS256", Secret: secret}},
+		{"signing method", AudienceKey{Audience: "svc-b.example.com", SigningMethod: "PS256", PrivateKeyFile: keyFile}},
+		{"short secret", AudienceKey{Audience: "svc-b.example.com", SigningMethod: "HS256", Secret: "short"}},
+		{"no private_key_file", AudienceKey{Audience: "svc-b.example.com", SigningMethod: "RS256"}},
+		{"secret with RS256", AudienceKey{Audience: "svc-b.example.com", SigningMethod: "RS256", Secret: secret, PrivateKeyFile: keyFile}},
+		{"missing private_key_file", AudienceKey{Audience: "svc-b.example.com", SigningMethod: "RS256", PrivateKeyFile: keyFile}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Cfg.JWT.AudienceKeys = []AudienceKey{Cfg.JWT.AudienceKeys[0], tt.key}
+			assert.Error(t, ValidateConfiguration())
+		})
+	}
+	Cfg.JWT.AudienceKeys = nil
+}
+
+func TestConfigPolicies(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	Cfg.Policies = []Policy{
+		{Hosts: []string{"admin.example.com"}, TeamWhiteList: []string{"admins"}},
+		{Hosts: []string{"reports.example.com"}, WhiteList: []string{"alice", "regex:^auditor-.+$"}},
+		{Hosts: []string{"example.com"}, AllowAllUsers: true},
+	}
+	defer func() { Cfg.Policies = nil }()
+	assert.NoError(t, ValidateConfiguration())
+	assert.Len(t, Cfg.Policies[1].WhiteListRegexps, 1)
+	assert.True(t, Cfg.PoliciesUseTeams())
+
+	tests := []struct {
+		host string
+		want int
+	}{
+		{"admin.example.com", 0},
+		{"ADMIN.example.com:8443", 0},
+		{"eu.admin.example.com", 0},
+		{"reports.example.com:80", 1},
+		// the first policy covering the host applies
+		{"wiki.example.com", 2},
+		{"example.org", -1},
+		{"notadmin.example.org", -1},
+	}
+	for _, tt := range tests {
+		i, p := Cfg.PolicyFor(tt.host)
+		assert.Equal(t, tt.want, i, tt.host)
+		assert.Equal(t, tt.want == -1, p == nil, tt.host)
+	}
+
+	bad := []Policy{
+		{TeamWhiteList: []string{"admins"}},
+		{Hosts: []string{"admin.example.com"}},
+		{Hosts: []string{"admin.example.com"}, AllowAllUsers: true, WhiteList: []string{"alice"}},
+		{Hosts: []string{"admin.example.com"}, WhiteList: []string{"regex:("}},
+	}
+	for _, p := range bad {
+		Cfg.Policies = []Policy{p}
+		assert.Error(t, ValidateConfiguration(), "%+v", p)
+	}
+}
+
+func TestConfigExternalAuth(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	Cfg.Headers.Claims = []string{"groups", "family_name"}
+	Cfg.ExternalAuth = map[string]ExternalAuth{
+		"ops":    {Policy: Policy{WhiteList: []string{"regex:^ops-.+$"}}, Claims: []string{"groups"}},
+		"narrow": {Claims: []string{"family_name"}},
+	}
+	defer func() { Cfg.ExternalAuth = nil }()
+	assert.NoError(t, ValidateConfiguration())
+	assert.Len(t, Cfg.ExternalAuth["ops"].WhiteListRegexps, 1)
+	assert.False(t, Cfg.PoliciesUseTeams())
+
+	tests := []struct {
+		id         string
+		want       string
+		wantPolicy bool
+	}{
+		{"ops", "ops", true},
+		{"OPS", "ops", true},
+		{"narrow", "narrow", false},
+		{"unknown", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/_external-auth-"+tt.id, nil), map[string]string{"id": tt.id})
+		id, ea := Cfg.ExternalAuthFor(r)
+		assert.Equal(t, tt.want, id, tt.id)
+		assert.Equal(t, tt.want == "", ea == nil, tt.id)
+		if ea != nil {
+			assert.Equal(t, tt.wantPolicy, ea.HasPolicy(), tt.id)
+		}
+	}
+	_, ea := Cfg.ExternalAuthFor(httptest.NewRequest("GET", "/validate", nil))
+	assert.Nil(t, ea)
+
+	bad := []ExternalAuth{
+		{Policy: Policy{Hosts: []string{"admin.example.com"}, AllowAllUsers: true}},
+		{Policy: Policy{AllowAllUsers: true, TeamWhiteList: []string{"ops"}}},
+		{Policy: Policy{WhiteList: []string{"regex:("}}},
+		{Claims: []string{"email"}},
+	}
+	for _, ea := range bad {
+		Cfg.ExternalAuth = map[string]ExternalAuth{"bad": ea}
+		assert.Error(t, ValidateConfiguration(), "%+v", ea)
+	}
+}
+
+func TestConfigMultipleProviders(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	setUp("/config/testing/handler_multiple_providers.yml")
+	defer InitForTestPurposes()
+	assert.Len(t, OAuthConfigs, 2)
+	assert.Equal(t, "staff", GenOAuth.Name)
+	assert.Equal(t, "https://staff.example.com/token", GenOAuth.TokenURL)
+
+	gh := OAuthByName(context.Background(), "github")
+	assert.NotNil(t, gh)
+	assert.Equal(t, "https://github.com/login/oauth/access_token", gh.TokenURL)
+	assert.Equal(t, "https://github.com/login/oauth/access_token", gh.Client().Endpoint.TokenURL)
+	assert.Equal(t, "https://staff.example.com/token", GenOAuth.Client().Endpoint.TokenURL)
+	assert.Nil(t, OAuthByName(context.Background(), "missing"))
+	assert.Equal(t, GenOAuth, OAuthFor(context.Background(), "missing"))
+	assert.Equal(t, gh, OAuth(WithOAuth(context.Background(), gh)))
+	assert.Equal(t, GenOAuth, OAuth(context.Background()))
+
+	// each provider is offered at /login
+	assert.Equal(t, []LoginOption{
+		{Name: "staff", Label: "Staff", Provider: "staff"},
+		{Name: "github", Label: "GitHub", Provider: "github"},
+	}, Cfg.LoginOptions)
+	assert.NoError(t, ValidateConfiguration())
+
+	Cfg.LoginOptions[1].Provider = "gitlab"
+	assert.Error(t, ValidateConfiguration())
+	Cfg.LoginOptions[1].Provider = "github"
+	gh.Name = "staff"
+	assert.Error(t, ValidateConfiguration(), "provider names must be unique")
+}
+
+func TestConfigOAuthClient(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.Equal(t, 10, Cfg.OAuthClient.Timeout)
+	c, err := Cfg.OAuthClientTLSConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, c, "the default transport is used")
+
+	Cfg.OAuthClient.Timeout = 0
+	assert.Error(t, ValidateConfiguration())
+	Cfg.OAuthClient.Timeout = 10
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(bundle, []byte("not a certificate"), 0600))
+	Cfg.OAuthClient.CABundle = bundle
+	assert.Error(t, ValidateConfiguration())
+	Cfg.OAuthClient.CABundle = bundle + ".missing"
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigStepUp(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	Cfg.StepUpHosts = []string{"admin.example.com"}
+	Cfg.StepUpAdminTeams = []string{"vouch-admins"}
+	assert.Error(t, ValidateConfiguration(), "the passkeys must be shared by every instance")
+	Cfg.Session.Backend = SessionBackendRedis
+	Cfg.Session.Redis.Addr = "redis:6379"
+	assert.NoError(t, ValidateConfiguration())
+	Cfg.StepUpAdminTeams = nil
+	assert.Error(t, ValidateConfiguration(), "no one could enrol a passkey")
+
+	assert.True(t, Cfg.StepUpRequired("admin.example.com"))
+	assert.True(t, Cfg.StepUpRequired("db.admin.example.com"))
+	assert.False(t, Cfg.StepUpRequired("app.example.com"))
+}
+
+func TestConfigCookieDomain(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	tests := []struct {
+		domain       string
+		wantDomain   string
+		wantHostOnly bool
+	}{
+		{"", "", false},
+		{"auto", "", false},
+		{"off", "", true},
+		{"OFF", "", true},
+		{"example.com", "example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			InitForTestPurposes()
+			Cfg.Cookie.Domain = tt.domain
+			fixConfigOptions()
+			assert.Equal(t, tt.wantDomain, Cfg.Cookie.Domain)
+			assert.Equal(t, tt.wantHostOnly, Cfg.Cookie.HostOnly)
+		})
+	}
+}
+
+func TestConfigShutdownTimeout(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	assert.Equal(t, 15, Cfg.ShutdownTimeout)
+	Cfg.ShutdownTimeout = 0
+	assert.Error(t, ValidateConfiguration())
+}
+
+func TestConfigHeadersPrefix(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	Cfg.Headers.Prefix = "X-Auth-"
+	Cfg.Headers.Role = "X-Team-Role"
+	applyHeadersPrefix()
+	assert.Equal(t, "X-Auth-User", Cfg.Headers.User)
+	assert.Equal(t, "X-Auth-Success", Cfg.Headers.Success)
+	assert.Equal(t, "X-Auth-Token", Cfg.Headers.JWT)
+	assert.Equal(t, "X-Auth-IdP-Claims-", Cfg.Headers.ClaimHeader)
+	assert.Equal(t, "X-Team-Role", Cfg.Headers.Role, "a name of another form is kept")
+	assert.NoError(t, cleanClaimsHeaders())
+	assert.NoError(t, ValidateConfiguration())
+}
+
+func TestConfigHeaderAndCookieNames(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	tests := []struct {
+		name    string
+		set     func()
+		wantErr bool
+	}{
+		{"defaults", func() {}, false},
+		{"header name with a space", func() { Cfg.Headers.User = "X-Vouch User" }, true},
+		{"header name with a colon", func() { Cfg.Headers.Success = "X-Vouch-Success:" }, true},
+		{"prefix with a slash", func() { Cfg.Headers.Prefix = "X/Auth-" }, true},
+		{"cookie name with a semicolon", func() { Cfg.Cookie.Name = "Vouch;Cookie" }, true},
+		{"no cookie name", func() { Cfg.Cookie.Name = "" }, true},
+		{"other cookie name", func() { Cfg.Cookie.Name = "AuthCookie" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitForTestPurposes()
+			tt.set()
+			assert.Equal(t, tt.wantErr, ValidateConfiguration() != nil)
+		})
+	}
+}
+
+func TestConfigBackChannelIssuers(t *testing.T) {
+	t.Cleanup(cleanupEnv)
+	InitForTestPurposes()
+	Cfg.Session.SIDClaim = "sid"
+	GenOAuth.JWKSURL = "https://idp.example.com/keys"
+	assert.NoError(t, checkBackChannelIssuers(), "a single provider needn't name its issuer")
+
+	other := *GenOAuth
+	other.Name = "other"
+	other.JWKSURL = "https://other.example.com/keys"
+	OAuthConfigs = append(OAuthConfigs, &other)
+	assert.Error(t, checkBackChannelIssuers())
+	GenOAuth.Issuer = "https://idp.example.com"
+	other.Issuer = "https://other.example.com"
+	assert.NoError(t, checkBackChannelIssuers())
+
+	Cfg.Session.SIDClaim = ""
+	other.Issuer = ""
+	assert.NoError(t, checkBackChannelIssuers(), "without back-channel logout the issuer isn't needed")
+}
@@ -0,0 +1,43 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DefaultEmailRegex an email address, unless `vouch.email_regex` says otherwise
+const DefaultEmailRegex = "^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$"
+
+var defaultEmailRegexp = regexp.MustCompile(DefaultEmailRegex)
+
+// configureEmailRegex compiles `vouch.email_regex` into Cfg.EmailRegexp
+func configureEmailRegex() error {
+	Cfg.EmailRegexp = defaultEmailRegexp
+	if Cfg.EmailRegex == "" {
+		return nil
+	}
+	re, err := regexp.Compile(Cfg.EmailRegex)
+	if err != nil {
+		return fmt.Errorf("configuration error: %s.email_regex %s: %w", Branding.LCName, Cfg.EmailRegex, err)
+	}
+	Cfg.EmailRegexp = re
+	return nil
+}
+
+// IsEmail s is an email address per `vouch.email_regex`
+func (c *Config) IsEmail(s string) bool {
+	if c.EmailRegexp == nil {
+		return defaultEmailRegexp.MatchString(s)
+	}
+	return c.EmailRegexp.MatchString(s)
+}
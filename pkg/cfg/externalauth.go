@@ -0,0 +1,95 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ExternalAuth overrides for `/_external-auth-{id}`, keyed by the id
+// who may pass is set just as for a Policy (without Hosts) and replaces the policy for the requested host,
+// an entry without allowAllUsers, whitelist or teamWhitelist leaves that to the policies
+// Claims narrows `headers.claims` (and `token_claims`) to the claims passed as headers, all of them if empty
+type ExternalAuth struct {
+	Policy `mapstructure:",squash"`
+	Claims []string `mapstructure:"claims"`
+}
+
+// configureExternalAuth checks each of `vouch.external_auth` and compiles the `regex:` entries of its whiteList
+func configureExternalAuth() error {
+	for id, ea := range Cfg.ExternalAuth {
+		name := fmt.Sprintf("%s.external_auth.%s", Branding.LCName, id)
+		switch {
+		case len(ea.Hosts) > 0:
+			return fmt.Errorf("configuration error: %s.hosts is not supported, the id selects the entry", name)
+		case ea.AllowAllUsers && len(ea.WhiteList)+len(ea.TeamWhiteList) > 0:
+			return fmt.Errorf("configuration error: %s allowAllUsers cannot be combined with a whiteList or teamWhitelist", name)
+		}
+		for _, c := range ea.Claims {
+			if !contains(Cfg.Headers.Claims, c) && !isTokenClaim(c) {
+				return fmt.Errorf("configuration error: %s.claims lists %s which is not one of headers.claims or token_claims", name, c)
+			}
+		}
+		var err error
+		if ea.WhiteListRegexps, err = compileWhiteList(name+".whiteList", ea.WhiteList); err != nil {
+			return err
+		}
+		Cfg.ExternalAuth[id] = ea
+	}
+	return nil
+}
+
+// HasPolicy is true if the entry sets who may pass
+func (ea *ExternalAuth) HasPolicy() bool {
+	return ea.AllowAllUsers || len(ea.WhiteList)+len(ea.TeamWhiteList) > 0
+}
+
+// PassesClaim is true if the claim of `headers.claims` is passed as a header for this entry
+func (ea *ExternalAuth) PassesClaim(claim string) bool {
+	return len(ea.Claims) == 0 || contains(ea.Claims, claim)
+}
+
+// ExternalAuthFor the id of the `/_external-auth-{id}` route of r and its entry of `vouch.external_auth`,
+// "" and nil for /validate or an id without an entry
+// the ids are lowercased, as are all keys of the config file
+func (c *Config) ExternalAuthFor(r *http.Request) (string, *ExternalAuth) {
+	id := strings.ToLower(mux.Vars(r)["id"])
+	if id == "" {
+		return "", nil
+	}
+	ea, ok := c.ExternalAuth[id]
+	if !ok {
+		return "", nil
+	}
+	return id, &ea
+}
+
+func isTokenClaim(claim string) bool {
+	for _, t := range Cfg.TokenClaims {
+		if t.Claim == claim {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
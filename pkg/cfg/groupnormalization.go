@@ -0,0 +1,85 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// GroupRule rewrites a group name from the provider, such as GitHub's `org/team`, Azure's object ids
+// or Keycloak's `/parent/child`, into the canonical form used in the teamWhitelist
+// rules apply in order, each to the name left by the one before
+type GroupRule struct {
+	// Provider the `oauth.provider` the rule applies to, every provider if it's not set
+	Provider string `mapstructure:"provider"`
+	// Map renames a group, such as an Azure object id to its name, matched without regard to case
+	Map map[string]string `mapstructure:"map"`
+	// Match a regular expression, a group which matches is rewritten as Replace which may refer to `$1`
+	Match     string `mapstructure:"match"`
+	Replace   string `mapstructure:"replace"`
+	Lowercase bool   `mapstructure:"lowercase"`
+
+	re *regexp.Regexp
+}
+
+// configureGroupNormalization compiles the expression of each of `group_normalization.rules`
+func configureGroupNormalization() error {
+	for i := range Cfg.GroupNormalization.Rules {
+		g := &Cfg.GroupNormalization.Rules[i]
+		if len(g.Map) == 0 && g.Match == "" && !g.Lowercase {
+			return fmt.Errorf("configuration error: %s.group_normalization.rules[%d] requires a map, a match or lowercase", Branding.LCName, i)
+		}
+		if g.Match == "" {
+			if g.Replace != "" {
+				return fmt.Errorf("configuration error: %s.group_normalization.rules[%d].replace requires match", Branding.LCName, i)
+			}
+			continue
+		}
+		re, err := regexp.Compile(g.Match)
+		if err != nil {
+			return fmt.Errorf("configuration error: %s.group_normalization.rules[%d].match: %w", Branding.LCName, i, err)
+		}
+		g.re = re
+	}
+	return nil
+}
+
+// NormalizeGroup the canonical form of a group name from the configured provider of the Instance of ctx
+func NormalizeGroup(ctx context.Context, group string) string {
+	inst := InstanceOf(ctx)
+	for i := range inst.Cfg.GroupNormalization.Rules {
+		g := &inst.Cfg.GroupNormalization.Rules[i]
+		if g.Provider != "" && g.Provider != inst.GenOAuth.Provider {
+			continue
+		}
+		group = g.normalize(group)
+	}
+	return group
+}
+
+func (g *GroupRule) normalize(group string) string {
+	for from, to := range g.Map {
+		if strings.EqualFold(from, group) {
+			group = to
+			break
+		}
+	}
+	if g.re != nil && g.re.MatchString(group) {
+		group = g.re.ReplaceAllString(group, g.Replace)
+	}
+	if g.Lowercase {
+		group = strings.ToLower(group)
+	}
+	return group
+}
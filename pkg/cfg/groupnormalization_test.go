@@ -0,0 +1,78 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeGroup(t *testing.T) {
+	rules := []GroupRule{
+		// GitHub `org/team`, the org is dropped
+		{Provider: Providers.GitHub, Match: `^myorg/(.+)$`, Replace: "$1"},
+		// Azure object ids, which viper lowercases as map keys
+		{Provider: Providers.Azure, Map: map[string]string{
+			"2a1f3b9c-0e6d-4c1a-9f7e-8b5d3c2a1e0f": "engineering",
+			"7c9e6679-7425-40de-944b-e07fc1f90ae7": "platform/sre",
+		}},
+		// Keycloak `/parent/child` with OIDC, the leading slash is dropped
+		{Provider: Providers.OIDC, Match: `^/`, Replace: ""},
+		{Lowercase: true},
+	}
+
+	tests := []struct {
+		provider string
+		group    string
+		want     string
+	}{
+		{Providers.GitHub, "myorg/engineering", "engineering"},
+		{Providers.GitHub, "myorg/Platform/SRE", "platform/sre"},
+		{Providers.GitHub, "otherorg/engineering", "otherorg/engineering"},
+		{Providers.Azure, "2A1F3B9C-0E6D-4C1A-9F7E-8B5D3C2A1E0F", "engineering"},
+		{Providers.Azure, "7c9e6679-7425-40de-944b-e07fc1f90ae7", "platform/sre"},
+		{Providers.Azure, "Display Name", "display name"},
+		{Providers.OIDC, "/engineering", "engineering"},
+		{Providers.OIDC, "/Platform/SRE", "platform/sre"},
+		// the rules for other providers don't apply
+		{Providers.OIDC, "myorg/engineering", "myorg/engineering"},
+		{Providers.Google, "/engineering", "/engineering"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider+" "+tt.group, func(t *testing.T) {
+			Cfg = &Config{}
+			Cfg.GroupNormalization.Rules = append([]GroupRule(nil), rules...)
+			GenOAuth = &oauthConfig{Provider: tt.provider}
+			assert.NoError(t, configureGroupNormalization())
+			assert.Equal(t, tt.want, NormalizeGroup(context.Background(), tt.group))
+		})
+	}
+}
+
+func TestConfigureGroupNormalizationErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule GroupRule
+	}{
+		{"nothing to do", GroupRule{Provider: Providers.OIDC}},
+		{"replace without match", GroupRule{Replace: "$1", Lowercase: true}},
+		{"bad match", GroupRule{Match: `^(unclosed`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Cfg = &Config{}
+			Cfg.GroupNormalization.Rules = []GroupRule{tt.rule}
+			assert.Error(t, configureGroupNormalization())
+		})
+	}
+}
@@ -0,0 +1,126 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"context"
+	"sync"
+)
+
+// Instance a configuration of its own, for each of several Vouch Proxies embedded in the one process (see pkg/vouch)
+// a request carries its Instance in its context, see WithInstance()
+// a context without one is served from the package state (Cfg, GenOAuth and OAuthConfigs), as the binary is
+type Instance struct {
+	Cfg          *Config
+	GenOAuth     *oauthConfig
+	OAuthConfigs []*oauthConfig
+
+	mu    sync.RWMutex
+	state map[interface{}]interface{}
+}
+
+// instanceMu held by NewInstance() while the package state is that of the Instance being configured
+var instanceMu sync.Mutex
+
+// NewInstance configure an Instance from c and the oauth providers as ConfigureWith() would, leaving the package state as it was
+// configure is called while the package state is that of the Instance, for each package to keep what it derives from it (see SetState())
+func NewInstance(c Config, oauth []*OAuthConfig, configure func(*Instance)) (*Instance, error) {
+	instanceMu.Lock()
+	defer instanceMu.Unlock()
+
+	prevCfg, prevGenOAuth, prevOAuthConfigs, prevOAuthClient, prevOAuthopts := Cfg, GenOAuth, OAuthConfigs, OAuthClient, OAuthopts
+	defer func() {
+		Cfg, GenOAuth, OAuthConfigs, OAuthClient, OAuthopts = prevCfg, prevGenOAuth, prevOAuthConfigs, prevOAuthClient, prevOAuthopts
+	}()
+
+	if err := ConfigureWith(c, oauth...); err != nil {
+		return nil, err
+	}
+	inst := &Instance{
+		Cfg:          Cfg,
+		GenOAuth:     GenOAuth,
+		OAuthConfigs: OAuthConfigs,
+		state:        map[interface{}]interface{}{},
+	}
+	if configure != nil {
+		configure(inst)
+	}
+	return inst, nil
+}
+
+// SetState keep v as the state of a package for the Instance, key is a type of the package's own as for context.WithValue()
+func (i *Instance) SetState(key, v interface{}) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.state[key] = v
+}
+
+// State the state kept by SetState() for the Instance of ctx, nil for a context without one
+func State(ctx context.Context, key interface{}) interface{} {
+	i, ok := ctx.Value(InstanceCtxKey).(*Instance)
+	if !ok || i == nil {
+		return nil
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.state[key]
+}
+
+// WithInstance a copy of ctx for a request served by the Instance
+func WithInstance(ctx context.Context, i *Instance) context.Context {
+	return context.WithValue(ctx, InstanceCtxKey, i)
+}
+
+// WithInstanceOf a copy of ctx for a request served by the Instance of from, if it has one,
+// such as a context detached from that of the request
+func WithInstanceOf(ctx, from context.Context) context.Context {
+	if i, ok := from.Value(InstanceCtxKey).(*Instance); ok && i != nil {
+		return WithInstance(ctx, i)
+	}
+	return ctx
+}
+
+// InstanceOf the Instance of ctx, otherwise one of the package state
+func InstanceOf(ctx context.Context) *Instance {
+	if i, ok := ctx.Value(InstanceCtxKey).(*Instance); ok && i != nil {
+		return i
+	}
+	return &Instance{Cfg: Cfg, GenOAuth: GenOAuth, OAuthConfigs: OAuthConfigs}
+}
+
+// FromContext the Config of the Instance of ctx, otherwise Cfg
+func FromContext(ctx context.Context) *Config {
+	if i, ok := ctx.Value(InstanceCtxKey).(*Instance); ok && i != nil {
+		return i.Cfg
+	}
+	return Cfg
+}
+
+// OAuthByName the provider of the Instance with the `name`, its GenOAuth for "", nil if there isn't one
+func (i *Instance) OAuthByName(name string) *oauthConfig {
+	if name == "" {
+		return i.GenOAuth
+	}
+	for _, c := range i.OAuthConfigs {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// OAuthFor the provider of the Instance with the `name`, its GenOAuth if there isn't one such as for a jwt which doesn't record it
+func (i *Instance) OAuthFor(name string) *oauthConfig {
+	if c := i.OAuthByName(name); c != nil {
+		return c
+	}
+	return i.GenOAuth
+}
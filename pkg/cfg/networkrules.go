@@ -0,0 +1,207 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// NetworkRule restricts access to Hosts (or their subdomains) by where the client is
+// its CIDRs, its countries (ISO 3166 codes such as `DE`) and its autonomous system numbers
+type NetworkRule struct {
+	Hosts          []string `mapstructure:"hosts"`
+	AllowCIDRs     []string `mapstructure:"allow_cidrs"`
+	DenyCIDRs      []string `mapstructure:"deny_cidrs"`
+	AllowCountries []string `mapstructure:"allow_countries"`
+	DenyCountries  []string `mapstructure:"deny_countries"`
+	AllowASNs      []uint   `mapstructure:"allow_asns"`
+	DenyASNs       []uint   `mapstructure:"deny_asns"`
+	// Message returned to a client which is denied
+	Message string `mapstructure:"message"`
+
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+}
+
+// ClientNetwork where a request comes from
+// HasCountry and HasASN are false when that GeoIP database isn't available, and a rule with those lists then denies the client
+type ClientNetwork struct {
+	IP         net.IP
+	Country    string
+	HasCountry bool
+	ASN        uint
+	HasASN     bool
+}
+
+// configureNetworkRules parses the CIDRs of each `vouch.network_rules` rule and checks the GeoIP databases they need
+func configureNetworkRules() error {
+	for i := range Cfg.NetworkRules {
+		n := &Cfg.NetworkRules[i]
+		if len(n.Hosts) == 0 {
+			return fmt.Errorf("configuration error: %s.network_rules[%d].hosts is not set", Branding.LCName, i)
+		}
+		if len(n.AllowCIDRs)+len(n.DenyCIDRs)+len(n.AllowCountries)+len(n.DenyCountries)+len(n.AllowASNs)+len(n.DenyASNs) == 0 {
+			return fmt.Errorf("configuration error: %s.network_rules[%d] has nothing to allow or deny", Branding.LCName, i)
+		}
+		var err error
+		if n.allowNets, err = parseCIDRs(n.AllowCIDRs); err != nil {
+			return fmt.Errorf("configuration error: %s.network_rules[%d].allow_cidrs: %w", Branding.LCName, i, err)
+		}
+		if n.denyNets, err = parseCIDRs(n.DenyCIDRs); err != nil {
+			return fmt.Errorf("configuration error: %s.network_rules[%d].deny_cidrs: %w", Branding.LCName, i, err)
+		}
+	}
+	return checkNetworkRulesGeoIP()
+}
+
+// checkNetworkRulesGeoIP refuses rules by country or ASN without a database to look them up in
+// since the client couldn't be allowed or denied by them
+func checkNetworkRulesGeoIP() error {
+	for i, n := range Cfg.NetworkRules {
+		if len(n.AllowCountries)+len(n.DenyCountries) > 0 {
+			if err := checkGeoIPDB(Cfg.GeoIP.CountryDB); err != nil {
+				return fmt.Errorf("configuration error: %s.network_rules[%d] lists countries but %s.geoip.country_db %w", Branding.LCName, i, Branding.LCName, err)
+			}
+		}
+		if len(n.AllowASNs)+len(n.DenyASNs) > 0 {
+			if err := checkGeoIPDB(Cfg.GeoIP.ASNDB); err != nil {
+				return fmt.Errorf("configuration error: %s.network_rules[%d] lists ASNs but %s.geoip.asn_db %w", Branding.LCName, i, Branding.LCName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkGeoIPDB that the MaxMind DB at path opens
+func checkGeoIPDB(path string) error {
+	if path == "" {
+		return errors.New("is not set")
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return fmt.Errorf("can't be used: %w", err)
+	}
+	return db.Close()
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(c))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// Matches is true if host is one of the Hosts or a subdomain of one
+func (n *NetworkRule) Matches(host string) bool {
+	return matchesHost(n.Hosts, host)
+}
+
+// Allows is false if the client is in any of the deny lists
+// or if there are allow lists and the client is in none of them
+// or if the rule lists countries or ASNs which can't be looked up for the client
+func (n *NetworkRule) Allows(c ClientNetwork) bool {
+	if (!c.HasCountry && len(n.AllowCountries)+len(n.DenyCountries) > 0) ||
+		(!c.HasASN && len(n.AllowASNs)+len(n.DenyASNs) > 0) {
+		return false
+	}
+	if containsIP(n.denyNets, c.IP) ||
+		containsFold(n.DenyCountries, c.Country) ||
+		containsUint(n.DenyASNs, c.ASN) {
+		return false
+	}
+
+	restricted := false
+	if len(n.allowNets) > 0 {
+		restricted = true
+		if containsIP(n.allowNets, c.IP) {
+			return true
+		}
+	}
+	if len(n.AllowCountries) > 0 {
+		restricted = true
+		if containsFold(n.AllowCountries, c.Country) {
+			return true
+		}
+	}
+	if len(n.AllowASNs) > 0 {
+		restricted = true
+		if containsUint(n.AllowASNs, c.ASN) {
+			return true
+		}
+	}
+	return !restricted
+}
+
+// NetworkRulesDeny the first `network_rules` rule covering host which denies the client, nil if none do
+// every rule matching the host must allow the client, client is only called if a rule matches
+func (c *Config) NetworkRulesDeny(host string, client func() ClientNetwork) *NetworkRule {
+	var cn *ClientNetwork
+	for i := range c.NetworkRules {
+		n := &c.NetworkRules[i]
+		if !n.Matches(host) {
+			continue
+		}
+		if cn == nil {
+			got := client()
+			cn = &got
+		}
+		if !n.Allows(*cn) {
+			return n
+		}
+	}
+	return nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUint(list []uint, u uint) bool {
+	if u == 0 {
+		return false
+	}
+	for _, v := range list {
+		if v == u {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetworkRuleAllows(t *testing.T) {
+	de := ClientNetwork{IP: net.ParseIP("192.0.2.1"), Country: "DE", HasCountry: true, ASN: 64500, HasASN: true}
+	office := ClientNetwork{IP: net.ParseIP("10.1.2.3"), HasCountry: true, HasASN: true}
+	noGeoIP := ClientNetwork{IP: net.ParseIP("192.0.2.1")}
+
+	tests := []struct {
+		name   string
+		rule   NetworkRule
+		client ClientNetwork
+		want   bool
+	}{
+		{"deny country", NetworkRule{DenyCountries: []string{"de"}}, de, false},
+		{"deny other country", NetworkRule{DenyCountries: []string{"FR"}}, de, true},
+		{"deny asn", NetworkRule{DenyASNs: []uint{64500}}, de, false},
+		{"deny cidr", NetworkRule{DenyCIDRs: []string{"192.0.2.0/24"}}, de, false},
+		{"deny cidr wins over allow country", NetworkRule{DenyCIDRs: []string{"192.0.2.0/24"}, AllowCountries: []string{"DE"}}, de, false},
+		{"allow country", NetworkRule{AllowCountries: []string{"DE", "FR"}}, de, true},
+		{"allow other country", NetworkRule{AllowCountries: []string{"FR"}}, de, false},
+		{"allow cidr or country", NetworkRule{AllowCIDRs: []string{"10.0.0.0/8"}, AllowCountries: []string{"FR"}}, office, true},
+		{"allow cidr or country from neither", NetworkRule{AllowCIDRs: []string{"10.0.0.0/8"}, AllowCountries: []string{"FR"}}, de, false},
+		{"allow asn", NetworkRule{AllowASNs: []uint{64500}}, de, true},
+		{"unknown country is not allowed", NetworkRule{AllowCountries: []string{"DE"}}, office, false},
+		{"without geoip deny country denies", NetworkRule{DenyCountries: []string{"DE"}}, noGeoIP, false},
+		{"without geoip allow country denies", NetworkRule{AllowCountries: []string{"FR"}}, noGeoIP, false},
+		{"without geoip deny asn denies", NetworkRule{DenyASNs: []uint{64500}}, noGeoIP, false},
+		{"without geoip allow cidr", NetworkRule{AllowCIDRs: []string{"192.0.2.0/24"}}, noGeoIP, true},
+		{"no client address", NetworkRule{AllowCIDRs: []string{"10.0.0.0/8"}}, ClientNetwork{}, false},
+	}
+	db := emptyMMDB(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Cfg = &Config{NetworkRules: []NetworkRule{tt.rule}}
+			Cfg.GeoIP.CountryDB, Cfg.GeoIP.ASNDB = db, db
+			Cfg.NetworkRules[0].Hosts = []string{"example.com"}
+			assert.NoError(t, configureNetworkRules())
+			assert.Equal(t, tt.want, Cfg.NetworkRules[0].Allows(tt.client))
+		})
+	}
+}
+
+func TestNetworkRulesDeny(t *testing.T) {
+	Cfg = &Config{NetworkRules: []NetworkRule{
+		{Hosts: []string{"example.com"}, DenyCountries: []string{"DE"}},
+		{Hosts: []string{"admin.example.com"}, AllowCIDRs: []string{"10.0.0.0/8"}},
+	}}
+	Cfg.GeoIP.CountryDB = emptyMMDB(t)
+	assert.NoError(t, configureNetworkRules())
+
+	de := func() ClientNetwork {
+		return ClientNetwork{IP: net.ParseIP("192.0.2.1"), Country: "DE", HasCountry: true}
+	}
+	office := func() ClientNetwork {
+		return ClientNetwork{IP: net.ParseIP("10.1.2.3"), HasCountry: true}
+	}
+	assert.Equal(t, &Cfg.NetworkRules[0], Cfg.NetworkRulesDeny("app.example.com:8443", de))
+	assert.Nil(t, Cfg.NetworkRulesDeny("app.example.com", office))
+	// every rule covering the host must allow the client
+	assert.Equal(t, &Cfg.NetworkRules[1], Cfg.NetworkRulesDeny("admin.example.com", func() ClientNetwork {
+		return ClientNetwork{IP: net.ParseIP("192.0.2.1"), Country: "FR", HasCountry: true}
+	}))
+	assert.Nil(t, Cfg.NetworkRulesDeny("notexample.com", func() ClientNetwork {
+		t.Error("the client is only looked up for a host covered by a rule")
+		return de()
+	}))
+}
+
+func TestConfigureNetworkRulesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule NetworkRule
+	}{
+		{"no hosts", NetworkRule{DenyCountries: []string{"DE"}}},
+		{"nothing to allow or deny", NetworkRule{Hosts: []string{"example.com"}}},
+		{"bad allow cidr", NetworkRule{Hosts: []string{"example.com"}, AllowCIDRs: []string{"10.0.0.0"}}},
+		{"bad deny cidr", NetworkRule{Hosts: []string{"example.com"}, DenyCIDRs: []string{"10.0.0.0/33"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Cfg = &Config{NetworkRules: []NetworkRule{tt.rule}}
+			assert.Error(t, configureNetworkRules())
+		})
+	}
+}
+
+func TestConfigureNetworkRulesGeoIP(t *testing.T) {
+	db := emptyMMDB(t)
+	notADB := filepath.Join(t.TempDir(), "not-a-db.mmdb")
+	if err := ioutil.WriteFile(notADB, []byte("not a database"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		rule      NetworkRule
+		countryDB string
+		asnDB     string
+		wantErr   bool
+	}{
+		{"countries", NetworkRule{AllowCountries: []string{"DE"}}, db, "", false},
+		{"asns", NetworkRule{DenyASNs: []uint{64500}}, "", db, false},
+		{"cidrs without databases", NetworkRule{AllowCIDRs: []string{"10.0.0.0/8"}}, "", "", false},
+		{"countries without country_db", NetworkRule{DenyCountries: []string{"DE"}}, "", db, true},
+		{"asns without asn_db", NetworkRule{AllowASNs: []uint{64500}}, db, "", true},
+		{"missing country_db", NetworkRule{AllowCountries: []string{"DE"}}, filepath.Join(t.TempDir(), "missing.mmdb"), "", true},
+		{"country_db is not a database", NetworkRule{AllowCountries: []string{"DE"}}, notADB, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Cfg = &Config{NetworkRules: []NetworkRule{tt.rule}}
+			Cfg.NetworkRules[0].Hosts = []string{"example.com"}
+			Cfg.GeoIP.CountryDB, Cfg.GeoIP.ASNDB = tt.countryDB, tt.asnDB
+			err := configureNetworkRules()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// emptyMMDB the path of a MaxMind DB without any networks
+func emptyMMDB(t *testing.T) string {
+	b := []byte{
+		// a search tree of one node whose records both point past it, at no data
+		0, 0, 1, 0, 0, 1,
+		// the data section separator
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	}
+	b = append(b, "\xAB\xCD\xEFMaxMind.com"...)
+	// a map of 3 entries
+	b = append(b, 7<<5|3)
+	b = append(b, 2<<5|10)
+	b = append(b, "node_count"...)
+	b = append(b, 6<<5|1, 1)
+	b = append(b, 2<<5|11)
+	b = append(b, "record_size"...)
+	b = append(b, 5<<5|1, 24)
+	b = append(b, 2<<5|10)
+	b = append(b, "ip_version"...)
+	b = append(b, 5<<5|1, 6)
+
+	path := filepath.Join(t.TempDir(), "empty.mmdb")
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
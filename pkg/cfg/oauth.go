@@ -11,10 +11,15 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package cfg
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"path"
 	"strings"
 
+	"github.com/dgrijalva/jwt-go"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
 	"golang.org/x/oauth2/google"
@@ -25,6 +30,10 @@ var (
 	// TODO: GenOAuth and OAuthClient should be combined
 	GenOAuth = &oauthConfig{}
 
+	// OAuthConfigs each of the providers of `oauth`, which may be a list from which the user chooses at /login
+	// the first of them is GenOAuth, see OAuth() for the provider of a request
+	OAuthConfigs = []*oauthConfig{GenOAuth}
+
 	// OAuthClient is the configured client which will call the provider
 	// this actually carries the oauth2 client ala oauthclient.Client(oauth2.NoContext, providerToken)
 	OAuthClient *oauth2.Config
@@ -43,6 +52,9 @@ var (
 		OpenStax:      "openstax",
 		Nextcloud:     "nextcloud",
 		Alibaba:       "alibaba",
+		GitLab:        "gitlab",
+		Apple:         "apple",
+		SAML:          "saml",
 	}
 )
 
@@ -58,36 +70,222 @@ type OAuthProviders struct {
 	OpenStax      string
 	Nextcloud     string
 	Alibaba       string
+	GitLab        string
+	Apple         string
+	SAML          string
 }
 
+// OAuthConfig an `oauth` provider, for configuring Vouch Proxy in code with ConfigureWith()
+type OAuthConfig = oauthConfig
+
 // oauth config items endoint for access
 // `envconfig` tag is for env var support
 // https://github.com/kelseyhightower/envconfig
 type oauthConfig struct {
-	Provider            string   `mapstructure:"provider"`
-	ClientID            string   `mapstructure:"client_id" envconfig:"client_id"`
-	ClientSecret        string   `mapstructure:"client_secret" envconfig:"client_secret"`
-	AuthURL             string   `mapstructure:"auth_url" envconfig:"auth_url"`
-	TokenURL            string   `mapstructure:"token_url" envconfig:"token_url"`
-	LogoutURL           string   `mapstructure:"end_session_endpoint"  envconfig:"end_session_endpoint"`
-	RedirectURL         string   `mapstructure:"callback_url"  envconfig:"callback_url"`
-	RedirectURLs        []string `mapstructure:"callback_urls"  envconfig:"callback_urls"`
-	Scopes              []string `mapstructure:"scopes"`
-	UserInfoURL         string   `mapstructure:"user_info_url" envconfig:"user_info_url"`
-	UserTeamURL         string   `mapstructure:"user_team_url" envconfig:"user_team_url"`
-	UserOrgURL          string   `mapstructure:"user_org_url" envconfig:"user_org_url"`
-	PreferredDomain     string   `mapstructure:"preferredDomain"`
-	AzureToken          string   `mapstructure:"azure_token" envconfig:"azure_token"`
-	CodeChallengeMethod string   `mapstructure:"code_challenge_method" envconfig:"code_challenge_method"`
+	// Name the provider is chosen by at `/login?provider=NAME` when `oauth` lists more than one, defaults to Provider
+	Name string `mapstructure:"name"`
+	// Label shown for the provider on the page at /login where the user chooses one
+	Label        string   `mapstructure:"label"`
+	Provider     string   `mapstructure:"provider"`
+	ClientID     string   `mapstructure:"client_id" envconfig:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret" envconfig:"client_secret"`
+	AuthURL      string   `mapstructure:"auth_url" envconfig:"auth_url"`
+	TokenURL     string   `mapstructure:"token_url" envconfig:"token_url"`
+	LogoutURL    string   `mapstructure:"end_session_endpoint"  envconfig:"end_session_endpoint"`
+	RedirectURL  string   `mapstructure:"callback_url"  envconfig:"callback_url"`
+	RedirectURLs []string `mapstructure:"callback_urls"  envconfig:"callback_urls"`
+	Scopes       []string `mapstructure:"scopes"`
+	// ExtraScopes added to Scopes (or the provider's default scopes) and to those of each HostOverride, such as `offline_access`
+	ExtraScopes         []string       `mapstructure:"extra_scopes" envconfig:"extra_scopes"`
+	UserInfoURL         string         `mapstructure:"user_info_url" envconfig:"user_info_url"`
+	UserTeamURL         string         `mapstructure:"user_team_url" envconfig:"user_team_url"`
+	UserOrgURL          string         `mapstructure:"user_org_url" envconfig:"user_org_url"`
+	PreferredDomain     string         `mapstructure:"preferredDomain"`
+	AzureToken          string         `mapstructure:"azure_token" envconfig:"azure_token"`
+	CodeChallengeMethod string         `mapstructure:"code_challenge_method" envconfig:"code_challenge_method"`
+	HostOverrides       []HostOverride `mapstructure:"host_overrides" envconfig:"-"`
+	IDTokenSigningAlgs  []string       `mapstructure:"id_token_signing_algs" envconfig:"id_token_signing_algs"`
+	JWKSURL             string         `mapstructure:"jwks_url" envconfig:"jwks_url"`
+	DeviceAuthURL       string         `mapstructure:"device_auth_url" envconfig:"device_auth_url"`
+	// Issuer the `iss` of the provider's tokens, by which a back-channel logout_token is matched to its provider
+	Issuer string `mapstructure:"issuer" envconfig:"issuer"`
+	// EmailSelect which address to use when the IdP's `email` (or `emails`) claim is a list
+	EmailSelect string `mapstructure:"email_select" envconfig:"email_select"`
+	// ResolveGroupOverage fetch the groups of an Azure AD user in too many groups for the id_token from the Graph API
+	ResolveGroupOverage bool `mapstructure:"resolve_group_overage" envconfig:"resolve_group_overage"`
+	// AllowedTenants only tokens whose TenantClaim is one of these are accepted, such as the ids of Azure AD tenants
+	AllowedTenants []string `mapstructure:"allowed_tenants" envconfig:"allowed_tenants"`
+	// TenantClaim the claim naming the tenant which issued the token, `tid` for Azure AD
+	TenantClaim string `mapstructure:"tenant_claim" envconfig:"tenant_claim"`
+	// RateLimit how a 429 Too Many Requests from the token or userinfo endpoint is handled
+	RateLimit struct {
+		Retries int `mapstructure:"retries"`
+		MaxWait int `mapstructure:"max_wait" envconfig:"max_wait"` // in seconds
+	} `mapstructure:"rate_limit" envconfig:"rate_limit"`
+	// Claims the OIDC `claims` request parameter, asking the IdP for particular claims in the id_token or from userinfo
+	// https://openid.net/specs/openid-connect-core-1_0.html#ClaimsParameter
+	Claims map[string]interface{} `mapstructure:"claims" envconfig:"-"`
+	// ClaimsParam Claims as JSON, sent with each authorization request
+	ClaimsParam string `mapstructure:"-" envconfig:"-"`
+	// GitLabURL the GitLab instance, for self-hosted GitLab, from which the endpoints of the gitlab provider are derived
+	GitLabURL string `mapstructure:"gitlab_url" envconfig:"gitlab_url"`
+	// Resource the identifier of the ADFS relying party, sent as the `resource` parameter, see ADFSResource
+	Resource string `mapstructure:"resource"`
+	// UseRefreshTokens keep the provider's refresh token in the jwt and use it to reissue the jwt before it expires
+	UseRefreshTokens bool `mapstructure:"use_refresh_tokens" envconfig:"use_refresh_tokens"`
+	// RefreshWindow minutes before the jwt expires within which it's refreshed
+	RefreshWindow int `mapstructure:"refresh_window" envconfig:"refresh_window"`
+	// AccessToken when the provider's access token is a JWT it must be from Issuer for one of Audiences
+	AccessToken struct {
+		Issuer    string   `mapstructure:"issuer"`
+		Audiences []string `mapstructure:"audiences"`
+	} `mapstructure:"access_token" envconfig:"access_token"`
+	// Apple the key with which the client secret of Sign in with Apple is signed, see AppleSigningKey
+	Apple struct {
+		TeamID         string `mapstructure:"team_id" envconfig:"team_id"`
+		KeyID          string `mapstructure:"key_id" envconfig:"key_id"`
+		PrivateKeyFile string `mapstructure:"private_key_file" envconfig:"private_key_file"`
+	} `mapstructure:"apple" envconfig:"apple"`
+	// UserInfo the claims of the userinfo (oidc) or id_token (adfs) holding the user's username and email
+	// in place of `username` and `email`, such as `preferred_username`, `upn` or `sub`
+	UserInfo struct {
+		UsernameClaim string `mapstructure:"username_claim" envconfig:"username_claim"`
+		EmailClaim    string `mapstructure:"email_claim" envconfig:"email_claim"`
+	} `mapstructure:"user_info" envconfig:"user_info"`
+	// SkipNonceCheck don't send a `nonce` with the authorization request of an oidc or adfs provider nor check the id_token's,
+	// for IdPs which don't echo it back
+	SkipNonceCheck bool `mapstructure:"skip_nonce_check" envconfig:"skip_nonce_check"`
+	// SkipAudienceCheck don't require the `aud` of an oidc or adfs provider's id_token to include the ClientID
+	SkipAudienceCheck bool `mapstructure:"skip_audience_check" envconfig:"skip_audience_check"`
+
+	// the OAuthClient and OAuthopts of the provider, see Client() and AuthCodeOption()
+	client *oauth2.Config
+	opts   oauth2.AuthCodeOption
+}
+
+// HostOverride callback_url and scopes used when Vouch Proxy is reached at Host (or a subdomain of Host)
+type HostOverride struct {
+	Host        string   `mapstructure:"host"`
+	RedirectURL string   `mapstructure:"callback_url"`
+	Scopes      []string `mapstructure:"scopes"`
 }
 
 func configureOauth() error {
-	// OAuth defaults and client configuration
-	return UnmarshalKey("oauth", &GenOAuth)
+	// `oauth` is either a single provider or a list of them, GenOAuth (which holds any settings from the environment) is the first
+	configs := []*oauthConfig{GenOAuth}
+	if err := UnmarshalKey("oauth", &configs); err != nil {
+		return err
+	}
+	if len(configs) == 0 {
+		configs = []*oauthConfig{GenOAuth}
+	}
+	return configureOAuthConfigs(configs)
+}
 
+// configureOAuthConfigs make configs the OAuthConfigs, the first of them GenOAuth
+func configureOAuthConfigs(configs []*oauthConfig) error {
+	GenOAuth = configs[0]
+	OAuthConfigs = configs
+	if err := eachOAuthConfig(configureOauthProvider); err != nil {
+		return err
+	}
+
+	// with more than one provider the user chooses one at /login, unless the login_options already say which
+	if len(OAuthConfigs) > 1 && len(Cfg.LoginOptions) == 0 {
+		for _, c := range OAuthConfigs {
+			Cfg.LoginOptions = append(Cfg.LoginOptions, LoginOption{Name: c.Name, Label: c.Label, Provider: c.Name})
+		}
+	}
+	return nil
+}
+
+// defaultIDTokenSigningAlgs every asymmetric algorithm, each is only accepted with a key of its type from the
+// jwks_url (and of its `alg`, if the key names one), and the HMAC algorithms when there is a client_secret to key them
+func defaultIDTokenSigningAlgs() []string {
+	algs := []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+	if GenOAuth.ClientSecret != "" {
+		algs = append(algs, "HS256", "HS384", "HS512")
+	}
+	return algs
+}
+
+// configureOauthProvider OAuth defaults for GenOAuth, see eachOAuthConfig()
+func configureOauthProvider() error {
+	// the `saml` block is used in place of an OAuth provider
+	if GenOAuth.Provider == "" && Cfg.SAML.IdPMetadataURL != "" {
+		GenOAuth.Provider = Providers.SAML
+	}
+	if GenOAuth.Name == "" {
+		GenOAuth.Name = GenOAuth.Provider
+	}
+	if len(GenOAuth.IDTokenSigningAlgs) == 0 {
+		GenOAuth.IDTokenSigningAlgs = defaultIDTokenSigningAlgs()
+	}
+	if GenOAuth.EmailSelect == "" {
+		GenOAuth.EmailSelect = EmailFirst
+	}
+	if GenOAuth.RateLimit.MaxWait == 0 {
+		GenOAuth.RateLimit.MaxWait = defaultRateLimitMaxWait
+	}
+	if GenOAuth.TenantClaim == "" {
+		GenOAuth.TenantClaim = defaultTenantClaim
+	}
+	if GenOAuth.RefreshWindow == 0 {
+		GenOAuth.RefreshWindow = defaultRefreshWindow
+	}
+	claimsParam, err := oauthClaimsParam()
+	if err != nil {
+		return err
+	}
+	GenOAuth.ClaimsParam = claimsParam
+	// the first of the callback_urls is used when no other matches the host
+	if GenOAuth.RedirectURL == "" && len(GenOAuth.RedirectURLs) > 0 {
+		GenOAuth.RedirectURL = GenOAuth.RedirectURLs[0]
+	}
+	return nil
+
+}
+
+// oauthClaimsParam the `claims` request parameter as JSON, "" if oauth.claims isn't set
+func oauthClaimsParam() (string, error) {
+	if len(GenOAuth.Claims) == 0 {
+		return "", nil
+	}
+	for k := range GenOAuth.Claims {
+		if k != "id_token" && k != "userinfo" {
+			return "", fmt.Errorf("configuration error: oauth.claims may only request claims for 'id_token' or 'userinfo', not '%s'", k)
+		}
+	}
+	b, err := json.Marshal(GenOAuth.Claims)
+	if err != nil {
+		return "", fmt.Errorf("configuration error: oauth.claims %w", err)
+	}
+	return string(b), nil
 }
 
 func oauthBasicTest() error {
+	names := make(map[string]bool, len(OAuthConfigs))
+	for _, c := range OAuthConfigs {
+		if names[c.Name] {
+			return fmt.Errorf("configuration error: oauth provider name %s is used more than once, each of the oauth providers requires a name of its own", c.Name)
+		}
+		names[c.Name] = true
+		// the saml package keeps the state of a single IdP
+		if c.Provider == Providers.SAML && len(OAuthConfigs) > 1 {
+			return errors.New("configuration error: saml cannot be one of several oauth providers")
+		}
+	}
+	return eachOAuthConfig(func() error {
+		err := oauthProviderBasicTest()
+		if err != nil && len(OAuthConfigs) > 1 {
+			return fmt.Errorf("%w (oauth provider %s)", err, GenOAuth.Name)
+		}
+		return err
+	})
+}
+
+// oauthProviderBasicTest check GenOAuth, see eachOAuthConfig()
+func oauthProviderBasicTest() error {
 	if GenOAuth.Provider != Providers.Google &&
 		GenOAuth.Provider != Providers.GitHub &&
 		GenOAuth.Provider != Providers.IndieAuth &&
@@ -97,36 +295,116 @@ func oauthBasicTest() error {
 		GenOAuth.Provider != Providers.OIDC &&
 		GenOAuth.Provider != Providers.OpenStax &&
 		GenOAuth.Provider != Providers.Nextcloud &&
-		GenOAuth.Provider != Providers.Alibaba {
+		GenOAuth.Provider != Providers.Alibaba &&
+		GenOAuth.Provider != Providers.GitLab &&
+		GenOAuth.Provider != Providers.Apple &&
+		GenOAuth.Provider != Providers.SAML {
 		return errors.New("configuration error: Unknown oauth provider: " + GenOAuth.Provider)
 	}
+	switch {
+	case GenOAuth.Provider == Providers.SAML:
+		return samlBasicTest()
+	case Cfg.SAML.IdPMetadataURL != "":
+		return fmt.Errorf("configuration error: %s.saml is used in place of oauth.provider %s, only one may be configured", Branding.LCName, GenOAuth.Provider)
+	}
 	// OAuthconfig Checks
 	switch {
 	case GenOAuth.ClientID == "":
 		// everyone has a clientID
 		return errors.New("configuration error: oauth.client_id not found")
-	case GenOAuth.Provider != Providers.IndieAuth && GenOAuth.Provider != Providers.HomeAssistant && GenOAuth.Provider != Providers.ADFS && GenOAuth.Provider != Providers.OIDC && GenOAuth.ClientSecret == "":
+	case GenOAuth.Provider != Providers.IndieAuth && GenOAuth.Provider != Providers.HomeAssistant && GenOAuth.Provider != Providers.ADFS && GenOAuth.Provider != Providers.OIDC && GenOAuth.Provider != Providers.Apple && GenOAuth.ClientSecret == "":
 		// everyone except IndieAuth has a clientSecret
 		// ADFS and OIDC providers also do not require this, but can have it optionally set.
+		// Apple's is signed with oauth.apple.private_key_file
 		return errors.New("configuration error: oauth.client_secret not found")
+	case (GenOAuth.Provider == Providers.ADFS || GenOAuth.Provider == Providers.OIDC) && GenOAuth.ClientSecret == "" && GenOAuth.CodeChallengeMethod == "":
+		// a public client is only bound to the login by PKCE, without either anyone holding a code could exchange it
+		return errors.New("configuration error: oauth.client_secret or oauth.code_challenge_method is required")
 	case GenOAuth.Provider != Providers.Google && GenOAuth.AuthURL == "":
 		// everyone except IndieAuth and Google has an authURL
 		return errors.New("configuration error: oauth.auth_url not found")
-	case GenOAuth.Provider != Providers.Google && GenOAuth.Provider != Providers.IndieAuth && GenOAuth.Provider != Providers.HomeAssistant && GenOAuth.Provider != Providers.ADFS && GenOAuth.UserInfoURL == "":
-		// everyone except IndieAuth, Google and ADFS has an userInfoURL
+	case GenOAuth.Provider != Providers.Google && GenOAuth.Provider != Providers.IndieAuth && GenOAuth.Provider != Providers.HomeAssistant && GenOAuth.Provider != Providers.ADFS && GenOAuth.Provider != Providers.Apple && GenOAuth.UserInfoURL == "":
+		// everyone except IndieAuth, Google, ADFS and Apple has an userInfoURL
 		return errors.New("configuration error: oauth.user_info_url not found")
+	case GenOAuth.DeviceAuthURL != "" && GenOAuth.Provider != Providers.OIDC:
+		// the device flow relies on an OpenID Connect userinfo endpoint
+		return errors.New("configuration error: oauth.device_auth_url is only supported with the oidc provider")
+	case GenOAuth.DeviceAuthURL != "" && !Cfg.Headers.AcceptBearer:
+		// the device sends its jwt back as a bearer token
+		return fmt.Errorf("configuration error: oauth.device_auth_url requires %s.headers.accept_bearer", Branding.LCName)
+	case GenOAuth.Provider == Providers.Apple && (GenOAuth.Apple.TeamID == "" || GenOAuth.Apple.KeyID == "" || GenOAuth.Apple.PrivateKeyFile == ""):
+		return errors.New("configuration error: the apple provider requires oauth.apple.team_id, oauth.apple.key_id and oauth.apple.private_key_file")
+	case GenOAuth.Provider == Providers.Apple && GenOAuth.UseRefreshTokens:
+		// the refresh would have to be signed like the token exchange
+		return errors.New("configuration error: oauth.use_refresh_tokens is not supported with the apple provider")
+	case GenOAuth.Provider == Providers.ADFS && GenOAuth.JWKSURL == "":
+		// the id_token is the only source of the user's identity
+		return errors.New("configuration error: oauth.jwks_url is required to verify ADFS id_tokens")
+	case GenOAuth.EmailSelect != EmailFirst && GenOAuth.EmailSelect != EmailFirstVerified:
+		return fmt.Errorf("configuration error: oauth.email_select must be either '%s' or '%s'", EmailFirst, EmailFirstVerified)
 	case GenOAuth.CodeChallengeMethod != "" && (GenOAuth.CodeChallengeMethod != "plain" && GenOAuth.CodeChallengeMethod != "S256"):
 		return errors.New("configuration error: oauth.code_challenge_method must be either 'S256' or 'plain'")
+	case GenOAuth.ResolveGroupOverage && GenOAuth.Provider != Providers.OIDC:
+		return errors.New("configuration error: oauth.resolve_group_overage is only supported with the oidc provider")
+	case GenOAuth.RateLimit.Retries < 0 || GenOAuth.RateLimit.MaxWait < 0:
+		return errors.New("configuration error: oauth.rate_limit.retries and oauth.rate_limit.max_wait cannot be negative")
+	case GenOAuth.UseRefreshTokens && (GenOAuth.RefreshWindow < 1 || GenOAuth.RefreshWindow >= Cfg.JWT.MaxAge):
+		return fmt.Errorf("configuration error: oauth.refresh_window must be at least 1 and less than jwt.maxAge %d (currently: %d)", Cfg.JWT.MaxAge, GenOAuth.RefreshWindow)
+	case GenOAuth.UseRefreshTokens && Cfg.JWT.Rolling.Enabled:
+		// a rolling jwt would outlive the provider's session without asking it
+		return errors.New("configuration error: oauth.use_refresh_tokens and jwt.rolling cannot both be enabled")
+	case GenOAuth.UseRefreshTokens && !Cfg.JWT.Encrypt:
+		// the refresh token outlives the jwt, anyone who reads the cookie could use it at the provider
+		return errors.New("configuration error: oauth.use_refresh_tokens requires jwt.encrypt, the refresh token is kept in the jwt cookie")
 	}
 
+	if _, err := oauthClaimsParam(); err != nil {
+		return err
+	}
+	if GenOAuth.Provider == Providers.Apple {
+		if _, err := GenOAuth.AppleSigningKey(); err != nil {
+			return fmt.Errorf("configuration error: oauth.apple.private_key_file %w", err)
+		}
+	}
 	if GenOAuth.RedirectURL != "" {
 		if err := checkCallbackConfig(GenOAuth.RedirectURL); err != nil {
 			return err
 		}
 	}
-	if len(GenOAuth.RedirectURLs) > 0 {
-		for _, cb := range GenOAuth.RedirectURLs {
-			if err := checkCallbackConfig(cb); err != nil {
+	// /login chooses among the callback_urls by host
+	callbackHosts := make(map[string]string, len(GenOAuth.RedirectURLs))
+	for _, cb := range GenOAuth.RedirectURLs {
+		u, err := url.Parse(cb)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("configuration error: oauth.callback_urls entry %s must be an absolute URL such as https://vouch.yourdomain.com/auth", cb)
+		}
+		host := strings.ToLower(u.Hostname())
+		if other, ok := callbackHosts[host]; ok {
+			return fmt.Errorf("configuration error: oauth.callback_urls %s and %s are on the same host, each host may have only one", other, cb)
+		}
+		callbackHosts[host] = cb
+		if err := checkCallbackConfig(cb); err != nil {
+			return err
+		}
+	}
+	for _, alg := range GenOAuth.IDTokenSigningAlgs {
+		if strings.EqualFold(alg, "none") {
+			return errors.New("configuration error: oauth.id_token_signing_algs must not include 'none'")
+		}
+		if jwt.GetSigningMethod(alg) == nil {
+			return fmt.Errorf("configuration error: oauth.id_token_signing_algs unknown algorithm %s", alg)
+		}
+		// the client_secret is the key of an HMAC, without one anybody could sign the id_token
+		if strings.HasPrefix(strings.ToUpper(alg), "HS") && GenOAuth.ClientSecret == "" {
+			return fmt.Errorf("configuration error: oauth.id_token_signing_algs %s requires oauth.client_secret", alg)
+		}
+	}
+	for _, o := range GenOAuth.HostOverrides {
+		if o.Host == "" {
+			return errors.New("configuration error: every oauth.host_overrides entry requires a host")
+		}
+		if o.RedirectURL != "" {
+			if err := checkCallbackConfig(o.RedirectURL); err != nil {
 				return err
 			}
 		}
@@ -134,19 +412,102 @@ func oauthBasicTest() error {
 	return nil
 }
 
+// eachOAuthConfig call f with GenOAuth, OAuthClient and OAuthopts set to those of each of OAuthConfigs in turn
+// afterwards they're once again those of the first provider
+func eachOAuthConfig(f func() error) error {
+	defer func() {
+		GenOAuth = OAuthConfigs[0]
+		OAuthClient, OAuthopts = GenOAuth.client, GenOAuth.opts
+	}()
+	for _, c := range OAuthConfigs {
+		GenOAuth, OAuthClient, OAuthopts = c, c.client, c.opts
+		err := f()
+		c.client, c.opts = OAuthClient, OAuthopts
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OAuth the provider chosen at /login for the request, see WithOAuth(), otherwise the GenOAuth of its Instance
+func OAuth(ctx context.Context) *oauthConfig {
+	if c, ok := ctx.Value(OAuthCtxKey).(*oauthConfig); ok && c != nil {
+		return c
+	}
+	return InstanceOf(ctx).GenOAuth
+}
+
+// WithOAuth a copy of ctx for a request to the provider c
+func WithOAuth(ctx context.Context, c *oauthConfig) context.Context {
+	return context.WithValue(ctx, OAuthCtxKey, c)
+}
+
+// OAuthByName the provider of the Instance of ctx with the `name`, see Instance.OAuthByName()
+func OAuthByName(ctx context.Context, name string) *oauthConfig {
+	return InstanceOf(ctx).OAuthByName(name)
+}
+
+// OAuthFor the provider of the Instance of ctx with the `name`, see Instance.OAuthFor()
+func OAuthFor(ctx context.Context, name string) *oauthConfig {
+	return InstanceOf(ctx).OAuthFor(name)
+}
+
+// Client the OAuthClient of the provider
+func (c *oauthConfig) Client() *oauth2.Config {
+	if c == GenOAuth {
+		return OAuthClient
+	}
+	return c.client
+}
+
+// AuthCodeOption the OAuthopts of the provider
+func (c *oauthConfig) AuthCodeOption() oauth2.AuthCodeOption {
+	if c == GenOAuth {
+		return OAuthopts
+	}
+	return c.opts
+}
+
+// OAuthClientWithRedirectURL a copy of the OAuthClient of the provider of the request which uses the callback_url chosen at /login
+// see `RedirectURLCtxKey`
+func OAuthClientWithRedirectURL(ctx context.Context) *oauth2.Config {
+	c := *OAuth(ctx).Client()
+	if redirectURL, ok := ctx.Value(RedirectURLCtxKey).(string); ok && redirectURL != "" {
+		c.RedirectURL = redirectURL
+	}
+	return &c
+}
+
 func setProviderDefaults() {
+	_ = eachOAuthConfig(func() error {
+		setOAuthProviderDefaults()
+		return nil
+	})
+}
+
+func setOAuthProviderDefaults() {
 	if GenOAuth.Provider == Providers.Google {
 		setDefaultsGoogle()
 		// setDefaultsGoogle also configures the OAuthClient
 	} else if GenOAuth.Provider == Providers.GitHub {
 		setDefaultsGitHub()
 		configureOAuthClient()
+	} else if GenOAuth.Provider == Providers.GitLab {
+		setDefaultsGitLab()
+		configureOAuthClient()
 	} else if GenOAuth.Provider == Providers.ADFS {
 		setDefaultsADFS()
 		configureOAuthClient()
 	} else if GenOAuth.Provider == Providers.Azure {
 		setDefaultsAzure()
 		configureOAuthClient()
+	} else if GenOAuth.Provider == Providers.Apple {
+		setDefaultsApple()
+		configureOAuthClient()
+	} else if GenOAuth.Provider == Providers.SAML {
+		setDefaultsSAML()
+		configureOAuthClient()
 	} else if GenOAuth.Provider == Providers.IndieAuth {
 		GenOAuth.CodeChallengeMethod = "S256"
 		configureOAuthClient()
@@ -154,6 +515,40 @@ func setProviderDefaults() {
 		// OIDC, OpenStax, Nextcloud
 		configureOAuthClient()
 	}
+	addExtraScopes()
+}
+
+// addExtraScopes `oauth.extra_scopes` on top of the scopes configured, or else defaulted, for the provider
+func addExtraScopes() {
+	if len(GenOAuth.ExtraScopes) == 0 {
+		return
+	}
+	GenOAuth.Scopes = mergeScopes(GenOAuth.Scopes, GenOAuth.ExtraScopes)
+	if OAuthClient != nil {
+		OAuthClient.Scopes = GenOAuth.Scopes
+	}
+	for i := range GenOAuth.HostOverrides {
+		if len(GenOAuth.HostOverrides[i].Scopes) > 0 {
+			GenOAuth.HostOverrides[i].Scopes = mergeScopes(GenOAuth.HostOverrides[i].Scopes, GenOAuth.ExtraScopes)
+		}
+	}
+}
+
+func mergeScopes(scopes []string, extra []string) []string {
+	merged := append([]string{}, scopes...)
+	for _, e := range extra {
+		found := false
+		for _, s := range merged {
+			if s == e {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, e)
+		}
+	}
+	return merged
 }
 
 func setDefaultsGoogle() {
@@ -180,7 +575,62 @@ func setDefaultsGoogle() {
 
 func setDefaultsADFS() {
 	log.Info("configuring ADFS OAuth")
-	OAuthopts = oauth2.SetAuthURLParam("resource", GenOAuth.RedirectURL) // Needed or all claims won't be included
+	OAuthopts = oauth2.SetAuthURLParam("resource", GenOAuth.ADFSResource(GenOAuth.RedirectURL)) // Needed or all claims won't be included
+	// ADFS publishes its signing keys alongside the token endpoint
+	// https://adfs.example.com/adfs/oauth2/token -> https://adfs.example.com/adfs/discovery/keys
+	tokenURL := strings.TrimSuffix(GenOAuth.TokenURL, "/")
+	if GenOAuth.JWKSURL == "" && strings.HasSuffix(tokenURL, "/adfs/oauth2/token") {
+		GenOAuth.JWKSURL = strings.TrimSuffix(tokenURL, "/oauth2/token") + "/discovery/keys"
+		log.Infof("ADFS signing keys will be fetched from %s", GenOAuth.JWKSURL)
+	}
+}
+
+// ADFSResource the `resource` parameter sent to ADFS, `oauth.resource` if it's set
+// otherwise the redirectURL, which is what Vouch Proxy always sent before `oauth.resource` could be set
+func (c *oauthConfig) ADFSResource(redirectURL string) string {
+	if c.Resource != "" {
+		return c.Resource
+	}
+	return redirectURL
+}
+
+// NonceCheck whether a `nonce` is sent with the authorization request and must come back in the id_token
+// https://openid.net/specs/openid-connect-core-1_0.html#NonceNotes
+func (c *oauthConfig) NonceCheck() bool {
+	return (c.Provider == Providers.OIDC || c.Provider == Providers.ADFS) && !c.SkipNonceCheck
+}
+
+// AudienceCheck whether the id_token's `aud` must include the client_id, so that a token issued to another client is refused
+// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+func (c *oauthConfig) AudienceCheck() bool {
+	return (c.Provider == Providers.OIDC || c.Provider == Providers.ADFS) && !c.SkipAudienceCheck
+}
+
+func setDefaultsApple() {
+	log.Info("configuring Sign in with Apple")
+	if GenOAuth.AuthURL == "" {
+		GenOAuth.AuthURL = "https://appleid.apple.com/auth/authorize"
+	}
+	if GenOAuth.TokenURL == "" {
+		GenOAuth.TokenURL = "https://appleid.apple.com/auth/token"
+	}
+	if GenOAuth.JWKSURL == "" {
+		GenOAuth.JWKSURL = "https://appleid.apple.com/auth/keys"
+	}
+	if len(GenOAuth.Scopes) == 0 {
+		GenOAuth.Scopes = []string{"name", "email"}
+	}
+	if GenOAuth.Apple.PrivateKeyFile != "" && !path.IsAbs(GenOAuth.Apple.PrivateKeyFile) {
+		GenOAuth.Apple.PrivateKeyFile = path.Join(RootDir, GenOAuth.Apple.PrivateKeyFile)
+	}
+	// Apple posts the callback, and only does so when the name or email is asked for
+	// https://developer.apple.com/documentation/sign_in_with_apple/request_an_authorization_to_the_sign_in_with_apple_server
+	OAuthopts = oauth2.SetAuthURLParam("response_mode", "form_post")
+}
+
+// AppleSigningKey the ES256 key (the .p8 file downloaded from Apple) with which the client secret is signed
+func (c *oauthConfig) AppleSigningKey() (interface{}, error) {
+	return privateKey(jwt.SigningMethodES256.Alg(), c.Apple.PrivateKeyFile)
 }
 
 func setDefaultsAzure() {
@@ -227,6 +677,31 @@ func setDefaultsGitHub() {
 	GenOAuth.CodeChallengeMethod = "S256"
 }
 
+func setDefaultsGitLab() {
+	if GenOAuth.GitLabURL == "" {
+		GenOAuth.GitLabURL = "https://gitlab.com"
+	}
+	gitlabURL := strings.TrimSuffix(GenOAuth.GitLabURL, "/")
+	if GenOAuth.AuthURL == "" {
+		GenOAuth.AuthURL = gitlabURL + "/oauth/authorize"
+	}
+	if GenOAuth.TokenURL == "" {
+		GenOAuth.TokenURL = gitlabURL + "/oauth/token"
+	}
+	if GenOAuth.UserInfoURL == "" {
+		GenOAuth.UserInfoURL = gitlabURL + "/api/v4/user"
+	}
+	if len(GenOAuth.Scopes) == 0 {
+		// https://docs.gitlab.com/ee/integration/oauth_provider.html#authorized-applications
+		GenOAuth.Scopes = []string{"read_user"}
+		// the groups of the user are only listed by the api
+		if len(Cfg.TeamWhiteList) > 0 {
+			GenOAuth.Scopes = []string{"read_api"}
+		}
+	}
+	GenOAuth.CodeChallengeMethod = "S256"
+}
+
 func configureOAuthClient() {
 	log.Infof("configuring %s OAuth with Endpoint %s", GenOAuth.Provider, GenOAuth.AuthURL)
 	OAuthClient = &oauth2.Config{
@@ -239,6 +714,10 @@ func configureOAuthClient() {
 		RedirectURL: GenOAuth.RedirectURL,
 		Scopes:      GenOAuth.Scopes,
 	}
+	if GenOAuth.ClientSecret == "" {
+		// a public client sends its client_id with the token request, and no empty client_secret
+		OAuthClient.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
 }
 
 func checkCallbackConfig(url string) error {
@@ -11,7 +11,10 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package cfg
 
 import (
+	"reflect"
 	"testing"
+
+	"golang.org/x/oauth2"
 )
 
 func Test_checkCallbackConfig(t *testing.T) {
@@ -33,3 +36,157 @@ func Test_checkCallbackConfig(t *testing.T) {
 		})
 	}
 }
+
+func Test_setDefaultsADFSJWKSURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		tokenURL string
+		jwksURL  string
+		want     string
+	}{
+		{"derived", "https://adfs.example.com/adfs/oauth2/token", "", "https://adfs.example.com/adfs/discovery/keys"},
+		{"derived trailing slash", "https://adfs.example.com/adfs/oauth2/token/", "", "https://adfs.example.com/adfs/discovery/keys"},
+		{"configured", "https://adfs.example.com/adfs/oauth2/token", "https://keys.example.com/", "https://keys.example.com/"},
+		{"not adfs shaped", "https://idp.example.com/token", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitForTestPurposes()
+			GenOAuth.TokenURL = tt.tokenURL
+			GenOAuth.JWKSURL = tt.jwksURL
+			setDefaultsADFS()
+			if GenOAuth.JWKSURL != tt.want {
+				t.Errorf("setDefaultsADFS() jwks_url = %v, want %v", GenOAuth.JWKSURL, tt.want)
+			}
+		})
+	}
+}
+
+func Test_oauthBasicTestCallbackURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		urls    []string
+		wantErr bool
+	}{
+		{"one per host", []string{"http://vouch.example.com:9090/auth", "http://vouch.other.com:9090/auth"}, false},
+		{"relative", []string{"http://vouch.example.com:9090/auth", "/auth"}, true},
+		{"no scheme", []string{"vouch.example.com/auth"}, true},
+		{"same host", []string{"http://vouch.example.com:9090/auth", "https://VOUCH.example.com/auth"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUp("/config/testing/handler_login_redirecturls.yml")
+			GenOAuth.RedirectURLs = tt.urls
+			if err := oauthBasicTest(); (err != nil) != tt.wantErr {
+				t.Errorf("oauthBasicTest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_setDefaultsGitLab(t *testing.T) {
+	tests := []struct {
+		name          string
+		gitlabURL     string
+		teamWhiteList []string
+		wantAuthURL   string
+		wantUserInfo  string
+		wantScopes    []string
+	}{
+		{"gitlab.com", "", nil, "https://gitlab.com/oauth/authorize", "https://gitlab.com/api/v4/user", []string{"read_user"}},
+		{"self-hosted", "https://gitlab.example.com/", nil, "https://gitlab.example.com/oauth/authorize", "https://gitlab.example.com/api/v4/user", []string{"read_user"}},
+		{"groups need the api", "", []string{"myGroup"}, "https://gitlab.com/oauth/authorize", "https://gitlab.com/api/v4/user", []string{"read_api"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitForTestPurposes()
+			GenOAuth = &oauthConfig{Provider: Providers.GitLab, GitLabURL: tt.gitlabURL}
+			Cfg.TeamWhiteList = tt.teamWhiteList
+			setDefaultsGitLab()
+			if GenOAuth.AuthURL != tt.wantAuthURL || GenOAuth.UserInfoURL != tt.wantUserInfo {
+				t.Errorf("setDefaultsGitLab() auth_url = %v, user_info_url = %v", GenOAuth.AuthURL, GenOAuth.UserInfoURL)
+			}
+			if len(GenOAuth.Scopes) != 1 || GenOAuth.Scopes[0] != tt.wantScopes[0] {
+				t.Errorf("setDefaultsGitLab() scopes = %v, want %v", GenOAuth.Scopes, tt.wantScopes)
+			}
+		})
+	}
+}
+
+func Test_oauthBasicTestPublicClient(t *testing.T) {
+	tests := []struct {
+		name                string
+		clientSecret        string
+		codeChallengeMethod string
+		wantErr             bool
+	}{
+		{"confidential client", "secret", "", false},
+		{"confidential client with PKCE", "secret", "S256", false},
+		{"public client with PKCE", "", "S256", false},
+		{"neither", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUp("/config/testing/handler_oidc_username_claim.yml")
+			GenOAuth.ClientSecret = tt.clientSecret
+			GenOAuth.CodeChallengeMethod = tt.codeChallengeMethod
+			// the default algs depend on the client_secret
+			GenOAuth.IDTokenSigningAlgs = defaultIDTokenSigningAlgs()
+			if err := oauthBasicTest(); (err != nil) != tt.wantErr {
+				t.Errorf("oauthBasicTest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			configureOAuthClient()
+			if public := OAuthClient.Endpoint.AuthStyle == oauth2.AuthStyleInParams; public != (tt.clientSecret == "") {
+				t.Errorf("configureOAuthClient() AuthStyle = %v", OAuthClient.Endpoint.AuthStyle)
+			}
+		})
+	}
+}
+
+func Test_oauthBasicTestDeviceAcceptBearer(t *testing.T) {
+	setUp("/config/testing/handler_oidc_username_claim.yml")
+	GenOAuth.DeviceAuthURL = "https://idp.example.com/device"
+	if err := oauthBasicTest(); err != nil {
+		t.Errorf("oauthBasicTest() error = %v", err)
+	}
+	Cfg.Headers.AcceptBearer = false
+	if err := oauthBasicTest(); err == nil {
+		t.Error("oauthBasicTest() the device flow without headers.accept_bearer, want an error")
+	}
+}
+
+func Test_addExtraScopes(t *testing.T) {
+	tests := []struct {
+		name       string
+		provider   string
+		scopes     []string
+		extra      []string
+		wantScopes []string
+	}{
+		{"added to the defaults", Providers.Google, nil, []string{"offline_access"}, []string{"email", "offline_access"}},
+		{"added to those configured", Providers.OIDC, []string{"openid", "email"}, []string{"offline_access", "api://reports/read"}, []string{"openid", "email", "offline_access", "api://reports/read"}},
+		{"not repeated", Providers.OIDC, []string{"openid", "offline_access"}, []string{"offline_access"}, []string{"openid", "offline_access"}},
+		{"none", Providers.OIDC, []string{"openid"}, nil, []string{"openid"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitForTestPurposes()
+			GenOAuth = &oauthConfig{Provider: tt.provider, Scopes: tt.scopes, ExtraScopes: tt.extra,
+				HostOverrides: []HostOverride{{Host: "a.example.com", Scopes: []string{"openid"}}, {Host: "b.example.com"}}}
+			OAuthConfigs = []*oauthConfig{GenOAuth}
+			setOAuthProviderDefaults()
+			if !reflect.DeepEqual(GenOAuth.Scopes, tt.wantScopes) {
+				t.Errorf("Scopes = %v, want %v", GenOAuth.Scopes, tt.wantScopes)
+			}
+			if !reflect.DeepEqual(OAuthClient.Scopes, tt.wantScopes) {
+				t.Errorf("OAuthClient.Scopes = %v, want %v", OAuthClient.Scopes, tt.wantScopes)
+			}
+			if want := mergeScopes([]string{"openid"}, tt.extra); !reflect.DeepEqual(GenOAuth.HostOverrides[0].Scopes, want) {
+				t.Errorf("HostOverrides[0].Scopes = %v, want %v", GenOAuth.HostOverrides[0].Scopes, want)
+			}
+			if len(GenOAuth.HostOverrides[1].Scopes) != 0 {
+				t.Errorf("HostOverrides[1].Scopes = %v, want the provider's", GenOAuth.HostOverrides[1].Scopes)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Policy who may reach Hosts (or their subdomains), checked at /validate on top of the global whiteList,
+// teamWhitelist, domains or allowAllUsers which the user passed at login
+// a user is allowed by AllowAllUsers, or by being in the WhiteList or a member of one of the TeamWhiteList
+type Policy struct {
+	Hosts         []string `mapstructure:"hosts"`
+	WhiteList     []string `mapstructure:"whitelist"`
+	TeamWhiteList []string `mapstructure:"teamWhitelist"`
+	AllowAllUsers bool     `mapstructure:"allowAllUsers"`
+
+	// WhiteListRegexps the compiled `regex:` entries of the WhiteList
+	WhiteListRegexps []*regexp.Regexp `mapstructure:"-"`
+}
+
+// configurePolicies checks each of `vouch.policies` and compiles the `regex:` entries of its whiteList
+func configurePolicies() error {
+	for i := range Cfg.Policies {
+		p := &Cfg.Policies[i]
+		name := fmt.Sprintf("%s.policies[%d]", Branding.LCName, i)
+		switch {
+		case len(p.Hosts) == 0:
+			return fmt.Errorf("configuration error: %s.hosts is not set", name)
+		case p.AllowAllUsers && len(p.WhiteList)+len(p.TeamWhiteList) > 0:
+			return fmt.Errorf("configuration error: %s allowAllUsers cannot be combined with a whiteList or teamWhitelist", name)
+		case !p.AllowAllUsers && len(p.WhiteList)+len(p.TeamWhiteList) == 0:
+			return fmt.Errorf("configuration error: %s needs allowAllUsers, a whiteList or a teamWhitelist", name)
+		}
+		var err error
+		if p.WhiteListRegexps, err = compileWhiteList(name+".whiteList", p.WhiteList); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches is true if host, without any port, is one of the Hosts or a subdomain of one
+func (p *Policy) Matches(host string) bool {
+	return matchesHost(p.Hosts, host)
+}
+
+// PolicyFor the first of `vouch.policies` covering host and its index, -1 and nil if none do
+func (c *Config) PolicyFor(host string) (int, *Policy) {
+	for i := range c.Policies {
+		if c.Policies[i].Matches(host) {
+			return i, &c.Policies[i]
+		}
+	}
+	return -1, nil
+}
+
+// PoliciesUseTeams is true if any of `vouch.policies` or `vouch.external_auth` has a teamWhitelist
+// or `revocation_store.admin_teams` or `step_up_admin_teams` is set, so the user's teams are kept in the jwt
+func (c *Config) PoliciesUseTeams() bool {
+	if len(c.RevocationStore.AdminTeams) > 0 || len(c.StepUpAdminTeams) > 0 {
+		return true
+	}
+	for _, p := range c.Policies {
+		if len(p.TeamWhiteList) > 0 {
+			return true
+		}
+	}
+	for _, ea := range c.ExternalAuth {
+		if len(ea.TeamWhiteList) > 0 {
+			return true
+		}
+	}
+	return false
+}
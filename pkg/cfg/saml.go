@@ -0,0 +1,116 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SAML Vouch Proxy as the service provider of a SAML 2.0 IdP, used in place of an OAuth provider when IdPMetadataURL is set
+// the IdP posts its response to ACSURL, EntityID (by default /saml/metadata at the host of the ACSURL) names Vouch Proxy to the IdP
+// Cert and Key sign the authentication requests and are published in the metadata
+// Attributes the names of the attributes holding the user's email and groups, the NameID is the username
+type SAML struct {
+	IdPMetadataURL string `mapstructure:"idp_metadata_url" envconfig:"idp_metadata_url"`
+	EntityID       string `mapstructure:"entity_id" envconfig:"entity_id"`
+	ACSURL         string `mapstructure:"acs_url" envconfig:"acs_url"`
+	Cert           string `mapstructure:"cert"`
+	Key            string `mapstructure:"key"`
+	Attributes     struct {
+		Email  string `mapstructure:"email"`
+		Groups string `mapstructure:"groups"`
+	} `mapstructure:"attributes"`
+}
+
+func setDefaultsSAML() {
+	log.Info("configuring SAML")
+	if Cfg.SAML.EntityID == "" {
+		if u, err := url.Parse(Cfg.SAML.ACSURL); err == nil && u.Host != "" {
+			Cfg.SAML.EntityID = (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/saml/metadata"}).String()
+		}
+	}
+	if Cfg.SAML.Cert != "" && !path.IsAbs(Cfg.SAML.Cert) {
+		Cfg.SAML.Cert = path.Join(RootDir, Cfg.SAML.Cert)
+	}
+	if Cfg.SAML.Key != "" && !path.IsAbs(Cfg.SAML.Key) {
+		Cfg.SAML.Key = path.Join(RootDir, Cfg.SAML.Key)
+	}
+}
+
+// samlBasicTest the `vouch.saml` block, none of the oauth options apply
+func samlBasicTest() error {
+	name := Branding.LCName + ".saml"
+	u, err := url.Parse(Cfg.SAML.IdPMetadataURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("configuration error: %s.idp_metadata_url %s must be an absolute http or https url", name, Cfg.SAML.IdPMetadataURL)
+	}
+	u, err = url.Parse(Cfg.SAML.ACSURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("configuration error: %s.acs_url %s must be an absolute url such as https://vouch.yourdomain.com/saml/acs", name, Cfg.SAML.ACSURL)
+	}
+	if !allowedCookieDomain(u.Hostname()) {
+		return fmt.Errorf("configuration error: %s.acs_url (%s) must be within a configured domains where the cookie will be set: either `vouch.domains` %s or `vouch.cookie.domain` %s", name, Cfg.SAML.ACSURL, Cfg.Domains, Cfg.Cookie.Domain)
+	}
+	if (Cfg.SAML.Cert == "") != (Cfg.SAML.Key == "") {
+		return fmt.Errorf("configuration error: %s.cert and %s.key must be set together", name, name)
+	}
+	if Cfg.SAML.Cert != "" {
+		if _, _, err := Cfg.SAMLKeyPair(); err != nil {
+			return fmt.Errorf("configuration error: %s %w", name, err)
+		}
+	}
+	if GenOAuth.UseRefreshTokens {
+		return errors.New("configuration error: oauth.use_refresh_tokens is not supported with saml")
+	}
+	if Cfg.Session.Backend != SessionBackendRedis {
+		return fmt.Errorf("configuration error: %s requires session.backend %s, in which the assertions are kept from the acs_url until /auth/{state}/", name, SessionBackendRedis)
+	}
+	return nil
+}
+
+// SAMLKeyPair the RSA key and certificate with which the authentication requests are signed, see `vouch.saml.cert` and `vouch.saml.key`
+func (c *Config) SAMLKeyPair() (*rsa.PrivateKey, *x509.Certificate, error) {
+	keyBytes, err := ioutil.ReadFile(c.SAML.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(keyBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("key %s: %w", c.SAML.Key, err)
+	}
+	certBytes, err := ioutil.ReadFile(c.SAML.Cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(certBytes)
+	if block == nil || !strings.HasSuffix(block.Type, "CERTIFICATE") {
+		return nil, nil, fmt.Errorf("cert %s is not a PEM encoded certificate", c.SAML.Cert)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cert %s: %w", c.SAML.Cert, err)
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || pub.N.Cmp(key.N) != 0 {
+		return nil, nil, fmt.Errorf("cert %s is not for the key %s", c.SAML.Cert, c.SAML.Key)
+	}
+	return key, cert, nil
+}
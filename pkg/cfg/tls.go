@@ -12,6 +12,9 @@ package cfg
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
 )
 
 // TLSConfig config returns a *tls.Config with the specified profile (modern, intermediate, old, default) configuration.
@@ -67,3 +70,27 @@ func TLSConfig(profile string) *tls.Config {
 
 	return c
 }
+
+// OAuthClientTLSConfig the *tls.Config of requests to the IdP per `vouch.oauth_client`, nil to use the default
+func (c *Config) OAuthClientTLSConfig() (*tls.Config, error) {
+	if c.OAuthClient.CABundle == "" && !c.OAuthClient.InsecureSkipVerify {
+		return nil, nil
+	}
+	// #nosec - insecure_skip_verify is for a lab IdP with a self-signed certificate, ca_bundle is preferred
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.OAuthClient.InsecureSkipVerify}
+	if c.OAuthClient.CABundle != "" {
+		pem, err := ioutil.ReadFile(c.OAuthClient.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("contains no PEM certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,64 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// TokenClaim a claim carried in every JWT issued by Vouch Proxy, such as an environment tag or a policy version
+// the Value may be a template such as `{{.Email}}` referencing the user, see TokenClaimData
+type TokenClaim struct {
+	Claim string `mapstructure:"claim"`
+	Value string `mapstructure:"value"`
+
+	tmpl *template.Template
+}
+
+// TokenClaimData the user's attributes available to the template of a TokenClaim
+type TokenClaimData struct {
+	Username string
+	Name     string
+	Email    string
+	// Claims the claims from the IdP which are kept, such as `{{.Claims.department}}`
+	Claims map[string]interface{}
+}
+
+// configureTokenClaims parses the template of each `vouch.token_claims`
+// a reference to a claim the user doesn't have is an error when the token is issued rather than `<no value>`
+func configureTokenClaims() error {
+	for i := range Cfg.TokenClaims {
+		t := &Cfg.TokenClaims[i]
+		if t.Claim == "" {
+			return fmt.Errorf("configuration error: %s.token_claims[%d].claim is not set", Branding.LCName, i)
+		}
+		tmpl, err := template.New(t.Claim).Option("missingkey=error").Parse(t.Value)
+		if err != nil {
+			return fmt.Errorf("configuration error: %s.token_claims[%d].value: %w", Branding.LCName, i, err)
+		}
+		t.tmpl = tmpl
+	}
+	return nil
+}
+
+// Execute the value of the claim for the user
+func (t TokenClaim) Execute(data TokenClaimData) (string, error) {
+	if t.tmpl == nil {
+		return t.Value, nil
+	}
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,44 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package cfg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// WhiteListRegexPrefix marks an entry of the whiteList as a regular expression, such as `regex:^ext-.+@partner\.com$`
+const WhiteListRegexPrefix = "regex:"
+
+// configureWhiteList compiles each `regex:` entry of `vouch.whiteList` into Cfg.WhiteListRegexps
+// a pattern must match the whole username
+func configureWhiteList() error {
+	var err error
+	Cfg.WhiteListRegexps, err = compileWhiteList(Branding.LCName+".whiteList", Cfg.WhiteList)
+	return err
+}
+
+// compileWhiteList the `regex:` entries of the whiteList, each pattern must match the whole username
+func compileWhiteList(name string, whiteList []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for i, wl := range whiteList {
+		if !strings.HasPrefix(wl, WhiteListRegexPrefix) {
+			continue
+		}
+		re, err := regexp.Compile(`^(?:` + strings.TrimPrefix(wl, WhiteListRegexPrefix) + `)$`)
+		if err != nil {
+			return nil, fmt.Errorf("configuration error: %s[%d] %s: %w", name, i, wl, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
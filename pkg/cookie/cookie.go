@@ -11,20 +11,36 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package cookie
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"unicode/utf8"
 
 	// "github.com/vouch/vouch-proxy/pkg/structs"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
-	"github.com/vouch/vouch-proxy/pkg/domains"
 	"go.uber.org/zap"
 )
 
-const maxCookieSize = 4000
+// compressedPrefix marks a cookie holding the gzipped jwt, see `cookie.compress`
+// a jwt, a JWE and a jwt compressed by `jwt.compress` each begin otherwise
+const compressedPrefix = "gz."
+
+// maxDecompressedSize the largest jwt uncompressed from a cookie
+const maxDecompressedSize = 1 << 20
+
+// maxCookieChunks the most cookies a jwt is split into, as room is left in each for the name's _99of99 suffix
+const maxCookieChunks = 99
 
 var log *zap.SugaredLogger
 
@@ -34,52 +50,129 @@ func Configure() {
 }
 
 // SetCookie http
-func SetCookie(w http.ResponseWriter, r *http.Request, val string) {
-	setCookie(w, r, val, cfg.Cfg.Cookie.MaxAge*60) // convert minutes to seconds
+// claims are the user's claims, with `cookie.tenant_claim` the cookie is scoped to the domain of the user's tenant
+func SetCookie(w http.ResponseWriter, r *http.Request, val string, claims map[string]interface{}) {
+	c := cfg.FromContext(r.Context())
+	domain := userCookieDomain(r, claims)
+	if c.Cookie.Compress {
+		compressed, err := compress(val)
+		if err != nil {
+			log.Errorf("cookie.compress: %s, setting the jwt as it is", err)
+		} else {
+			val = compressed
+		}
+	}
+	setCookie(w, r, val, domain, c.Cookie.MaxAge*60) // convert minutes to seconds
+	if c.Cookie.Profile.Enabled {
+		setProfileCookie(w, r, domain, claims)
+	}
 }
 
-func setCookie(w http.ResponseWriter, r *http.Request, val string, maxAge int) {
-	cookieName := cfg.Cfg.Cookie.Name
-	// foreach domain
-	domain := domains.Matches(r.Host)
-	// Allow overriding the cookie domain in the config file
-	if cfg.Cfg.Cookie.Domain != "" {
-		domain = cfg.Cfg.Cookie.Domain
-		log.Debugf("setting the cookie domain to %v", domain)
+// setProfileCookie the `cookie.profile.name` cookie holding the `cookie.profile.claims` of the user as URL encoded JSON
+// it is scoped and expires like the jwt cookie but is never httpOnly, see `cookie.profile`
+func setProfileCookie(w http.ResponseWriter, r *http.Request, domain string, claims map[string]interface{}) {
+	c := cfg.FromContext(r.Context())
+	profile := make(map[string]interface{})
+	for _, claim := range c.Cookie.Profile.Claims {
+		if v, ok := claims[claim]; ok {
+			profile[claim] = v
+		}
+	}
+	b, err := json.Marshal(profile)
+	if err != nil {
+		log.Errorf("cookie.profile: %s", err)
+		return
 	}
-	sameSite := SameSite()
+	pc := &http.Cookie{
+		Name: c.Cookie.Profile.Name,
+		// JSON's quotes, commas and spaces aren't allowed in a cookie
+		Value:    url.PathEscape(string(b)),
+		Path:     "/",
+		Domain:   domain,
+		MaxAge:   c.Cookie.MaxAge * 60,
+		Secure:   c.Cookie.Secure,
+		HttpOnly: false,
+		SameSite: SameSite(r.Context()),
+	}
+	if size := len(pc.String()); size > c.Cookie.MaxChunkSize {
+		log.Warnf("cookie.profile: the cookie of %d bytes is too large to set, list fewer claims", size)
+		return
+	}
+	http.SetCookie(w, pc)
+}
+
+// SetCSRFCookie the `csrf.cookie_name` cookie holding the token which scripts send back in the `csrf.header`
+// it is scoped and expires like the jwt cookie but is never httpOnly
+func SetCSRFCookie(w http.ResponseWriter, r *http.Request, token string, claims map[string]interface{}) {
+	c := cfg.FromContext(r.Context())
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.CSRF.CookieName,
+		Value:    token,
+		Path:     "/",
+		Domain:   userCookieDomain(r, claims),
+		MaxAge:   c.Cookie.MaxAge * 60,
+		Secure:   c.Cookie.Secure,
+		HttpOnly: false,
+		SameSite: SameSite(r.Context()),
+	})
+}
+
+// CSRFCookie the token in the `csrf.cookie_name` cookie, "" if there is none
+func CSRFCookie(r *http.Request) string {
+	csrf, err := r.Cookie(cfg.FromContext(r.Context()).CSRF.CookieName)
+	if err != nil {
+		return ""
+	}
+	return csrf.Value
+}
+
+// userCookieDomain the domain of the cookies issued to the user
+func userCookieDomain(r *http.Request, claims map[string]interface{}) string {
+	if cfg.FromContext(r.Context()).Cookie.TenantClaim != "" {
+		return tenantDomain(r, claims)
+	}
+	return cookieDomain(r)
+}
+
+func setCookie(w http.ResponseWriter, r *http.Request, val string, domain string, maxAge int) {
+	c := cfg.FromContext(r.Context())
+	cookieName := c.Cookie.Name
+	sameSite := SameSite(r.Context())
 
 	cookie := http.Cookie{
-		Name:     cfg.Cfg.Cookie.Name,
+		Name:     c.Cookie.Name,
 		Value:    val,
 		Path:     "/",
 		Domain:   domain,
 		MaxAge:   maxAge,
-		Secure:   cfg.Cfg.Cookie.Secure,
-		HttpOnly: cfg.Cfg.Cookie.HTTPOnly,
+		Secure:   c.Cookie.Secure,
+		HttpOnly: c.Cookie.HTTPOnly,
 		SameSite: sameSite,
 	}
 	cookieSize := len(cookie.String())
 	cookie.Value = ""
+	// leave room for the _1of3 suffix of the split cookie's name
+	cookie.Name = c.Cookie.Name + "_99of99"
 	emptyCookieSize := len(cookie.String())
 	// Cookies have a max size of 4096 bytes, but to support most browsers, we should stay below 4000 bytes
+	// which is the default `cookie.max_chunk_size`, a proxy may limit the size of a header further
 	// https://tools.ietf.org/html/rfc6265#section-6.1
 	// http://browsercookielimits.squawky.net/
-	if cookieSize > maxCookieSize {
+	if cookieSize > c.Cookie.MaxChunkSize {
 		// https://www.lifewire.com/cookie-limit-per-domain-3466809
-		log.Warnf("cookie size: %d.  cookie sizes over ~4093 bytes(depending on the browser and platform) have shown to cause issues or simply aren't supported.", cookieSize)
-		cookieParts := splitCookie(val, maxCookieSize-emptyCookieSize)
+		log.Warnf("cookie size: %d.  cookie sizes over %d bytes (cookie.max_chunk_size) are split into several cookies.", cookieSize, c.Cookie.MaxChunkSize)
+		cookieParts := splitCookie(val, c.Cookie.MaxChunkSize-emptyCookieSize)
 		for i, cookiePart := range cookieParts {
 			// Cookies are named 1of3, 2of3, 3of3
-			cookieName = fmt.Sprintf("%s_%dof%d", cfg.Cfg.Cookie.Name, i+1, len(cookieParts))
+			cookieName = fmt.Sprintf("%s_%dof%d", c.Cookie.Name, i+1, len(cookieParts))
 			http.SetCookie(w, &http.Cookie{
 				Name:     cookieName,
 				Value:    cookiePart,
 				Path:     "/",
 				Domain:   domain,
 				MaxAge:   maxAge,
-				Secure:   cfg.Cfg.Cookie.Secure,
-				HttpOnly: cfg.Cfg.Cookie.HTTPOnly,
+				Secure:   c.Cookie.Secure,
+				HttpOnly: c.Cookie.HTTPOnly,
 				SameSite: sameSite,
 			})
 		}
@@ -90,50 +183,54 @@ func setCookie(w http.ResponseWriter, r *http.Request, val string, maxAge int) {
 			Path:     "/",
 			Domain:   domain,
 			MaxAge:   maxAge,
-			Secure:   cfg.Cfg.Cookie.Secure,
-			HttpOnly: cfg.Cfg.Cookie.HTTPOnly,
+			Secure:   c.Cookie.Secure,
+			HttpOnly: c.Cookie.HTTPOnly,
 			SameSite: sameSite,
 		})
 	}
 }
 
-// Cookie get the vouch jwt cookie
+// Cookie get the vouch jwt cookie, joining a split cookie and uncompressing a compressed one
 func Cookie(r *http.Request) (string, error) {
+	val, err := cookieValue(r)
+	if err != nil || !strings.HasPrefix(val, compressedPrefix) {
+		return val, err
+	}
+	return decompress(val)
+}
+
+func cookieValue(r *http.Request) (string, error) {
+	c := cfg.FromContext(r.Context())
 
 	cookieParts := make([]string, 0)
 	var numParts = -1
 
-	var err error
 	cookies := r.Cookies()
 	// Get the remaining parts
 	// search for cookie parts in order
 	// this is the hotpath so we're trying to only walk once
 	for _, cookie := range cookies {
-		if cookie.Name == cfg.Cfg.Cookie.Name {
+		if cookie.Name == c.Cookie.Name {
 			return cookie.Value, nil
 		}
-		cookieUnder := fmt.Sprintf("%s_", cfg.Cfg.Cookie.Name)
-		if strings.HasPrefix(cookie.Name, cookieUnder) {
-			log.Debugw("cookie",
-				"cookieName", cookie.Name,
-				"cookieValue", cookie.Value,
-			)
-			xOFy := strings.Replace(cookie.Name, cookieUnder, "", 1)
-			xyArray := strings.Split(xOFy, "of")
-			if numParts == -1 { // then its uninitialized
-				if numParts, err = strconv.Atoi(xyArray[1]); err != nil {
-					return "", fmt.Errorf("multipart cookie fail: %s", err)
-				}
-				log.Debugf("make cookieParts of size %d", numParts)
-				cookieParts = make([]string, numParts)
-			}
-			var i int
-			if i, err = strconv.Atoi(xyArray[0]); err != nil {
-				return "", fmt.Errorf("multipart cookie fail: %s", err)
-			}
-			cookieParts[i-1] = cookie.Value
+		// another cookie whose name merely begins with `cookie.name`, such as that of another Vouch Proxy, is left alone
+		i, n, ok := cookieChunk(c, cookie.Name)
+		if !ok {
+			continue
 		}
-
+		log.Debugw("cookie",
+			"cookieName", cookie.Name,
+			"cookieValue", cookie.Value,
+		)
+		if numParts == -1 { // then its uninitialized
+			numParts = n
+			log.Debugf("make cookieParts of size %d", numParts)
+			cookieParts = make([]string, numParts)
+		}
+		if n != numParts {
+			return "", fmt.Errorf("multipart cookie fail: %s is not one of %d parts", cookie.Name, numParts)
+		}
+		cookieParts[i-1] = cookie.Value
 	}
 	// combinedCookieStr := combinedCookie.String()
 	combinedCookieStr := strings.Join(cookieParts, "")
@@ -144,21 +241,49 @@ func Cookie(r *http.Request) (string, error) {
 	log.Debugw("combined cookie",
 		"cookieValue", combinedCookieStr,
 	)
-	return combinedCookieStr, err
+	return combinedCookieStr, nil
+}
+
+// cookieChunk the part i of n of the jwt split into cookies named `cookie.name`_1ofN, _2ofN...
+func cookieChunk(c *cfg.Config, name string) (i int, n int, ok bool) {
+	if !strings.HasPrefix(name, c.Cookie.Name+"_") {
+		return 0, 0, false
+	}
+	xy := strings.SplitN(strings.TrimPrefix(name, c.Cookie.Name+"_"), "of", 2)
+	if len(xy) != 2 {
+		return 0, 0, false
+	}
+	i, err := strconv.Atoi(xy[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	n, err = strconv.Atoi(xy[1])
+	if err != nil || i < 1 || i > n || n > maxCookieChunks {
+		return 0, 0, false
+	}
+	return i, n, true
+}
+
+// isJWTCookie the cookie holds the jwt, or a part of it
+func isJWTCookie(c *cfg.Config, name string) bool {
+	_, _, ok := cookieChunk(c, name)
+	return ok || name == c.Cookie.Name
 }
 
 // ClearCookie get rid of the existing cookie
 func ClearCookie(w http.ResponseWriter, r *http.Request) {
+	c := cfg.FromContext(r.Context())
 	cookies := r.Cookies()
-	domain := domains.Matches(r.Host)
-	// Allow overriding the cookie domain in the config file
-	if cfg.Cfg.Cookie.Domain != "" {
-		domain = cfg.Cfg.Cookie.Domain
-		log.Debugf("setting the cookie domain to %v", domain)
+	var domain string
+	if c.Cookie.TenantClaim != "" {
+		domain = tenantDomainForHost(c, r.Host)
+	} else {
+		domain = cookieDomain(r)
 	}
-	// search for cookie parts
+	// search for cookie parts, and the csrf token and profile which go with them
 	for _, cookie := range cookies {
-		if strings.HasPrefix(cookie.Name, cfg.Cfg.Cookie.Name) {
+		if isJWTCookie(c, cookie.Name) || (c.CSRF.Enabled && cookie.Name == c.CSRF.CookieName) ||
+			(c.Cookie.Profile.Enabled && cookie.Name == c.Cookie.Profile.Name) {
 			log.Debugf("deleting cookie: %s", cookie.Name)
 			http.SetCookie(w, &http.Cookie{
 				Name:     cookie.Name,
@@ -166,26 +291,98 @@ func ClearCookie(w http.ResponseWriter, r *http.Request) {
 				Path:     "/",
 				Domain:   domain,
 				MaxAge:   -1,
-				Secure:   cfg.Cfg.Cookie.Secure,
-				HttpOnly: cfg.Cfg.Cookie.HTTPOnly,
+				Secure:   c.Cookie.Secure,
+				HttpOnly: c.Cookie.HTTPOnly,
 			})
 		}
 	}
 }
 
-// SameSite return cfg.Cfg.Cookie.SameSite as http.Samesite
-// if cfg.Cfg.Cookie.SameSite is unconfigured return http.SameSite(0)
+// cookieDomain the longest domain in `vouch.domains` which the request is for, unless `cookie.domain` is set
+// no domain with `cookie.domain: off`, nor if the request isn't for `cookie.domain`, since a browser would refuse the cookie
+func cookieDomain(r *http.Request) string {
+	c := cfg.FromContext(r.Context())
+	if c.Cookie.HostOnly {
+		return ""
+	}
+	// Allow overriding the cookie domain in the config file
+	if c.Cookie.Domain != "" {
+		if !withinDomain(r.Host, strings.TrimPrefix(c.Cookie.Domain, ".")) {
+			log.Warnf("%s is not within cookie.domain %s, the cookie is scoped to %s", r.Host, c.Cookie.Domain, r.Host)
+			return ""
+		}
+		log.Debugf("setting the cookie domain to %v", c.Cookie.Domain)
+		return c.Cookie.Domain
+	}
+	var domain string
+	for _, d := range c.Domains {
+		if withinDomain(r.Host, d) && len(d) > len(domain) {
+			domain = d
+		}
+	}
+	if domain == "" && len(c.Domains) > 0 {
+		log.Warnf("%s is not within any of domains %v, the cookie is scoped to %s", r.Host, c.Domains, r.Host)
+	}
+	return domain
+}
+
+// tenantDomain the domain in `cookie.tenant_domains` for the tenant named in the user's `cookie.tenant_claim`
+// if the tenant has no domain or the request isn't for the tenant's domain the cookie is left without a domain,
+// a browser then sends it only to the host which set it rather than to every tenant
+func tenantDomain(r *http.Request, claims map[string]interface{}) string {
+	c := cfg.FromContext(r.Context())
+	tenant, _ := claims[c.Cookie.TenantClaim].(string)
+	var domain string
+	for t, d := range c.Cookie.TenantDomains {
+		// viper lowercases the keys of a map
+		if strings.EqualFold(t, tenant) {
+			domain = d
+		}
+	}
+	if domain == "" {
+		log.Warnf("no cookie.tenant_domains entry for %s %q, the cookie is scoped to %s", c.Cookie.TenantClaim, tenant, r.Host)
+		return ""
+	}
+	if !withinDomain(r.Host, domain) {
+		log.Warnf("%s is not within %s, the domain for %s %q, the cookie is scoped to %s", r.Host, domain, c.Cookie.TenantClaim, tenant, r.Host)
+		return ""
+	}
+	log.Debugf("setting the cookie domain to %s for %s %q", domain, c.Cookie.TenantClaim, tenant)
+	return domain
+}
+
+// tenantDomainForHost the longest domain in `cookie.tenant_domains` which the host is within
+func tenantDomainForHost(c *cfg.Config, host string) string {
+	var domain string
+	for _, d := range c.Cookie.TenantDomains {
+		if withinDomain(host, d) && len(d) > len(domain) {
+			domain = d
+		}
+	}
+	return domain
+}
+
+func withinDomain(host, domain string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// SameSite return `cookie.sameSite` of the cfg.Instance of ctx as http.Samesite
+// if it is unconfigured return http.SameSite(0)
 // see https://github.com/vouch/vouch-proxy/issues/210
-func SameSite() http.SameSite {
+func SameSite(ctx context.Context) http.SameSite {
+	c := cfg.FromContext(ctx)
 	sameSite := http.SameSite(0)
-	if cfg.Cfg.Cookie.SameSite != "" {
-		switch strings.ToLower(cfg.Cfg.Cookie.SameSite) {
+	if c.Cookie.SameSite != "" {
+		switch strings.ToLower(c.Cookie.SameSite) {
 		case "lax":
 			sameSite = http.SameSiteLaxMode
 		case "strict":
 			sameSite = http.SameSiteStrictMode
 		case "none":
-			if cfg.Cfg.Cookie.Secure == false {
+			if c.Cookie.Secure == false {
 				log.Error("SameSite cookie attribute with sameSite=none should also be specified with secure=true.")
 			}
 			sameSite = http.SameSiteNoneMode
@@ -194,6 +391,41 @@ func SameSite() http.SameSite {
 	return sameSite
 }
 
+// compress gzip and base64 encode the jwt, marked by the compressedPrefix
+func compress(val string) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(val)); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return compressedPrefix + base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// decompress the jwt compressed by compress
+func decompress(val string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(val, compressedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("compressed cookie: %w", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return "", fmt.Errorf("compressed cookie: %w", err)
+	}
+	defer zr.Close()
+	// a jwt is never near this large, a larger one would only be a zip bomb
+	ss, err := ioutil.ReadAll(io.LimitReader(zr, maxDecompressedSize+1))
+	if err != nil {
+		return "", fmt.Errorf("compressed cookie: %w", err)
+	}
+	if len(ss) > maxDecompressedSize {
+		return "", errors.New("compressed cookie: too large")
+	}
+	return string(ss), nil
+}
+
 // splitCookie separate string into several strings of specified length
 func splitCookie(longString string, maxLen int) []string {
 	splits := make([]string, 0)
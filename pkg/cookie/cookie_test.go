@@ -11,16 +11,25 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package cookie
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/domains"
 )
 
 func init() {
 	cfg.InitForTestPurposes()
+	domains.Configure()
 	Configure()
 }
 
@@ -67,3 +76,287 @@ func TestCookie(t *testing.T) {
 		t.Errorf("expected \"%s\" received \"%s\"", expectedValue, s)
 	}
 }
+
+func TestCookieNameOfAnotherProxy(t *testing.T) {
+	cfg.Cfg.Cookie.Name = "VouchCookie"
+	tests := []struct {
+		name    string
+		cookies []string
+		want    string
+		wantErr bool
+	}{
+		{"another proxy's cookie", []string{"VouchCookie_b=other", "VouchCookie=jwt"}, "jwt", false},
+		{"another proxy's split cookie", []string{"VouchCookie_b_1of2=other1", "VouchCookie_1of2=jwt1", "VouchCookie_b_2of2=other2", "VouchCookie_2of2=jwt2"}, "jwt1jwt2", false},
+		{"not a part", []string{"VouchCookie_xofy=other", "VouchCookie_1of1=jwt"}, "jwt", false},
+		{"no such part", []string{"VouchCookie_3of2=other", "VouchCookie_1of1=jwt"}, "jwt", false},
+		{"too many parts", []string{"VouchCookie_1of999999999=other"}, "", true},
+		{"parts of different counts", []string{"VouchCookie_1of2=jwt1", "VouchCookie_2of3=jwt2"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/validate", nil)
+			r.Header.Set("Cookie", strings.Join(tt.cookies, "; "))
+			got, err := Cookie(r)
+			assert.Equal(t, tt.wantErr, err != nil, "err = %v", err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestClearCookieLeavesAnotherProxysCookie(t *testing.T) {
+	cfg.Cfg.Cookie.Name = "VouchCookie"
+	r := httptest.NewRequest("GET", "/logout", nil)
+	r.Header.Set("Cookie", "VouchCookie_1of2=a; VouchCookie_2of2=b; VouchCookie_b=other; VouchCookieJar=other")
+	w := httptest.NewRecorder()
+	ClearCookie(w, r)
+
+	var cleared []string
+	for _, c := range w.Result().Cookies() {
+		cleared = append(cleared, c.Name)
+	}
+	assert.Equal(t, []string{"VouchCookie_1of2", "VouchCookie_2of2"}, cleared)
+}
+
+func TestSetCookieTenantDomain(t *testing.T) {
+	cfg.Cfg.Cookie.TenantClaim = "tenant"
+	cfg.Cfg.Cookie.TenantDomains = map[string]string{"a": "a.example.com", "b": "b.example.com"}
+	defer func() {
+		cfg.Cfg.Cookie.TenantClaim = ""
+		cfg.Cfg.Cookie.TenantDomains = nil
+	}()
+
+	tests := []struct {
+		name       string
+		host       string
+		claims     map[string]interface{}
+		wantDomain string
+	}{
+		{"tenant a", "vouch.a.example.com", map[string]interface{}{"tenant": "a"}, "a.example.com"},
+		{"tenant a with port", "vouch.a.example.com:9090", map[string]interface{}{"tenant": "a"}, "a.example.com"},
+		{"tenant b", "vouch.b.example.com", map[string]interface{}{"tenant": "b"}, "b.example.com"},
+		{"tenant is case insensitive", "vouch.b.example.com", map[string]interface{}{"tenant": "B"}, "b.example.com"},
+		{"tenant b at tenant a's host", "vouch.a.example.com", map[string]interface{}{"tenant": "b"}, ""},
+		{"unknown tenant", "vouch.a.example.com", map[string]interface{}{"tenant": "c"}, ""},
+		{"no tenant claim", "vouch.a.example.com", map[string]interface{}{}, ""},
+		{"tenant claim not a string", "vouch.a.example.com", map[string]interface{}{"tenant": []interface{}{"a"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/auth/", nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			SetCookie(w, r, "jwt", tt.claims)
+
+			cookies := w.Result().Cookies()
+			assert.Len(t, cookies, 1)
+			assert.Equal(t, tt.wantDomain, cookies[0].Domain)
+		})
+	}
+}
+
+func TestClearCookieTenantDomain(t *testing.T) {
+	cfg.Cfg.Cookie.Name = "VouchCookie"
+	cfg.Cfg.Cookie.TenantClaim = "tenant"
+	cfg.Cfg.Cookie.TenantDomains = map[string]string{"a": "a.example.com", "sub": "sub.a.example.com"}
+	defer func() {
+		cfg.Cfg.Cookie.TenantClaim = ""
+		cfg.Cfg.Cookie.TenantDomains = nil
+	}()
+
+	tests := []struct {
+		host       string
+		wantDomain string
+	}{
+		{"vouch.a.example.com", "a.example.com"},
+		{"vouch.sub.a.example.com", "sub.a.example.com"},
+		{"vouch.example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/logout", nil)
+			r.Host = tt.host
+			r.AddCookie(&http.Cookie{Name: "VouchCookie", Value: "jwt"})
+			w := httptest.NewRecorder()
+			ClearCookie(w, r)
+
+			cookies := w.Result().Cookies()
+			assert.Len(t, cookies, 1)
+			assert.Equal(t, tt.wantDomain, cookies[0].Domain)
+		})
+	}
+}
+
+func TestSetCookieDomain(t *testing.T) {
+	defer func(d []string) {
+		cfg.Cfg.Domains = d
+		cfg.Cfg.Cookie.Domain = ""
+		cfg.Cfg.Cookie.HostOnly = false
+	}(cfg.Cfg.Domains)
+	// the longest match is taken whatever the order
+	cfg.Cfg.Domains = []string{"example.com", "internal.example.com"}
+
+	tests := []struct {
+		name         string
+		cookieDomain string
+		hostOnly     bool
+		host         string
+		wantDomain   string
+	}{
+		{"subdomain", "", false, "a.example.com", "example.com"},
+		{"the domain itself", "", false, "example.com", "example.com"},
+		{"nested subdomain", "", false, "a.b.example.com", "example.com"},
+		{"subdomain of the longer domain", "", false, "a.internal.example.com", "internal.example.com"},
+		{"nested subdomain of the longer domain", "", false, "a.b.internal.example.com", "internal.example.com"},
+		{"with port", "", false, "a.internal.example.com:9090", "internal.example.com"},
+		{"not within domains", "", false, "a.example.net", ""},
+		{"only a suffix of the name", "", false, "badexample.com", ""},
+		{"cookie.domain", "example.com", false, "a.internal.example.com", "example.com"},
+		{"cookie.domain with a leading dot", ".example.com", false, "a.example.com", ".example.com"},
+		{"not within cookie.domain", "example.com", false, "a.example.net", ""},
+		{"off", "", true, "a.internal.example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Cfg.Cookie.Domain = tt.cookieDomain
+			cfg.Cfg.Cookie.HostOnly = tt.hostOnly
+			r := httptest.NewRequest("GET", "/auth/", nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			SetCookie(w, r, "jwt", nil)
+
+			cookies := w.Result().Cookies()
+			assert.Len(t, cookies, 1)
+			// net/http drops the leading dot
+			assert.Equal(t, strings.TrimPrefix(tt.wantDomain, "."), cookies[0].Domain)
+		})
+	}
+}
+
+func TestSetCookieProfile(t *testing.T) {
+	cfg.Cfg.Cookie.Name = "VouchCookie"
+	cfg.Cfg.Cookie.Profile.Enabled = true
+	cfg.Cfg.Cookie.Profile.Name = "VouchProfile"
+	cfg.Cfg.Cookie.Profile.Claims = []string{"name", "picture", "nickname"}
+	defer func() {
+		cfg.Cfg.Cookie.Profile.Enabled = false
+		cfg.Cfg.Cookie.Profile.Claims = nil
+	}()
+
+	r := httptest.NewRequest("GET", "/auth/", nil)
+	w := httptest.NewRecorder()
+	SetCookie(w, r, "jwt", map[string]interface{}{
+		"name":    "Jane Doe, PhD",
+		"picture": "https://example.com/jane.png?s=64",
+		"email":   "jane@example.com",
+		"groups":  []interface{}{"admins"},
+	})
+
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 2)
+	profile := cookies[1]
+	assert.Equal(t, "VouchProfile", profile.Name)
+	assert.False(t, profile.HttpOnly)
+	assert.Equal(t, cookies[0].MaxAge, profile.MaxAge)
+
+	v, err := url.PathUnescape(profile.Value)
+	assert.NoError(t, err)
+	// only the allowlisted claims the user has
+	assert.JSONEq(t, `{"name":"Jane Doe, PhD","picture":"https://example.com/jane.png?s=64"}`, v)
+
+	// and it goes with the jwt cookie
+	r.AddCookie(cookies[0])
+	r.AddCookie(profile)
+	w = httptest.NewRecorder()
+	ClearCookie(w, r)
+	cleared := w.Result().Cookies()
+	assert.Len(t, cleared, 2)
+	assert.Equal(t, "VouchProfile", cleared[1].Name)
+	assert.Equal(t, -1, cleared[1].MaxAge)
+}
+
+// an encrypted jwt (`jwt.encrypt`) is a third larger and is split like any other
+func TestSetCookieSplitsJWE(t *testing.T) {
+	cfg.Cfg.Cookie.Name = "VouchCookie"
+	jwe := `eyJhbGciOiJkaXIiLCJlbmMiOiJBMjU2R0NNIn0..` + strings.Repeat("AbC-_9", 1000) + "." + strings.Repeat("x", 22)
+
+	r := httptest.NewRequest("GET", "/auth/", nil)
+	w := httptest.NewRecorder()
+	SetCookie(w, r, jwe, nil)
+
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 2)
+	for i, c := range cookies {
+		assert.Equal(t, fmt.Sprintf("VouchCookie_%dof2", i+1), c.Name)
+		assert.LessOrEqual(t, len(c.String()), cfg.Cfg.Cookie.MaxChunkSize)
+		r.AddCookie(c)
+	}
+	s, err := Cookie(r)
+	assert.NoError(t, err)
+	assert.Equal(t, jwe, s)
+}
+
+// a jwt with many groups is split into cookies of at most `cookie.max_chunk_size` bytes, compressed with `cookie.compress`
+func TestSetCookieMaxChunkSizeAndCompress(t *testing.T) {
+	cfg.Cfg.Cookie.Name = "VouchCookie"
+	defer func() {
+		cfg.Cfg.Cookie.MaxChunkSize = 4000
+		cfg.Cfg.Cookie.Compress = false
+	}()
+	jwtWithGroups := func(n int) string {
+		groups := make([]string, n)
+		for i := range groups {
+			groups[i] = fmt.Sprintf("engineering-team-%04d", i)
+		}
+		payload, err := json.Marshal(map[string]interface{}{"username": "alice@example.com", "groups": groups})
+		assert.NoError(t, err)
+		return "eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".c2lnbmF0dXJl"
+	}
+
+	tests := []struct {
+		name         string
+		jwt          string
+		maxChunkSize int
+		compress     bool
+	}{
+		{"split", jwtWithGroups(60), 1024, false},
+		{"compressed and split", jwtWithGroups(300), 512, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Cfg.Cookie.MaxChunkSize = tt.maxChunkSize
+			cfg.Cfg.Cookie.Compress = tt.compress
+
+			r := httptest.NewRequest("GET", "/auth/", nil)
+			w := httptest.NewRecorder()
+			SetCookie(w, r, tt.jwt, nil)
+
+			cookies := w.Result().Cookies()
+			assert.Len(t, cookies, 3)
+			for i, c := range cookies {
+				assert.Equal(t, fmt.Sprintf("VouchCookie_%dof3", i+1), c.Name)
+				assert.LessOrEqual(t, len(c.String()), tt.maxChunkSize)
+				if i == 0 {
+					assert.Equal(t, tt.compress, strings.HasPrefix(c.Value, compressedPrefix))
+				}
+				r.AddCookie(c)
+			}
+			s, err := Cookie(r)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.jwt, s)
+		})
+	}
+
+	// compressed cookies are read whether or not `cookie.compress` is still set
+	compressed, err := compress(jwtWithGroups(10))
+	assert.NoError(t, err)
+	r := httptest.NewRequest("GET", "/validate", nil)
+	r.AddCookie(&http.Cookie{Name: "VouchCookie", Value: compressed})
+	s, err := Cookie(r)
+	assert.NoError(t, err)
+	assert.Equal(t, jwtWithGroups(10), s)
+
+	r = httptest.NewRequest("GET", "/validate", nil)
+	r.AddCookie(&http.Cookie{Name: "VouchCookie", Value: compressedPrefix + "bm90IGd6aXA"})
+	_, err = Cookie(r)
+	assert.Error(t, err)
+}
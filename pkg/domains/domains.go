@@ -11,6 +11,7 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package domains
 
 import (
+	"context"
 	"sort"
 	"strings"
 
@@ -26,8 +27,8 @@ func Configure() {
 	sort.Sort(ByLengthDesc(cfg.Cfg.Domains))
 }
 
-// Matches returns one of the domains we're configured for
-func Matches(s string) string {
+// Matches returns one of the domains the cfg.Instance of ctx is configured for
+func Matches(ctx context.Context, s string) string {
 	if strings.Contains(s, ":") {
 		// then we have a port and we just want to check the host
 		split := strings.Split(s, ":")
@@ -35,27 +36,27 @@ func Matches(s string) string {
 		s = split[0]
 	}
 
-	if len(cfg.Cfg.Domains) > 0 {
-		for i, v := range cfg.Cfg.Domains {
+	if domains := cfg.FromContext(ctx).Domains; len(domains) > 0 {
+		for i, v := range domains {
 			if s == v || strings.HasSuffix(s, "."+v) {
 				log.Debugf("domain %s matched array value at [%d]=%v", s, i, v)
 				return v
 			}
 		}
-		log.Warnf("domain %s not found in any domains %v", s, cfg.Cfg.Domains)
+		log.Warnf("domain %s not found in any domains %v", s, domains)
 	}
 	return ""
 }
 
 // IsUnderManagement check if an email is under vouch-managed domain
-func IsUnderManagement(email string) bool {
+func IsUnderManagement(ctx context.Context, email string) bool {
 	split := strings.Split(email, "@")
 	if len(split) != 2 {
 		log.Warnf("not a valid email: %s", email)
 		return false
 	}
 
-	match := Matches(split[1])
+	match := Matches(ctx, split[1])
 	if match != "" {
 		return true
 	}
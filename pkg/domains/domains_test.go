@@ -11,6 +11,7 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package domains
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
 	"testing"
 
@@ -24,29 +25,29 @@ func init() {
 }
 
 func TestIsUnderManagement(t *testing.T) {
-	assert.True(t, IsUnderManagement("test@vouch.github.io"))
-	assert.True(t, IsUnderManagement("test@sub.vouch.github.io"))
-	assert.True(t, IsUnderManagement("test@test.mydomain.com"))
-	assert.True(t, IsUnderManagement("test@sub.test.mydomain.com"))
-
-	assert.False(t, IsUnderManagement("test@example.com"))
-	assert.False(t, IsUnderManagement("vouch.github.io@example.com"))
-	assert.False(t, IsUnderManagement("test-vouch.github.io@example.com"))
-	assert.False(t, IsUnderManagement("test@vouch.github.io.com"))
+	assert.True(t, IsUnderManagement(context.Background(), "test@vouch.github.io"))
+	assert.True(t, IsUnderManagement(context.Background(), "test@sub.vouch.github.io"))
+	assert.True(t, IsUnderManagement(context.Background(), "test@test.mydomain.com"))
+	assert.True(t, IsUnderManagement(context.Background(), "test@sub.test.mydomain.com"))
+
+	assert.False(t, IsUnderManagement(context.Background(), "test@example.com"))
+	assert.False(t, IsUnderManagement(context.Background(), "vouch.github.io@example.com"))
+	assert.False(t, IsUnderManagement(context.Background(), "test-vouch.github.io@example.com"))
+	assert.False(t, IsUnderManagement(context.Background(), "test@vouch.github.io.com"))
 }
 
 func TestMatches(t *testing.T) {
 	// Full email should not be accepted
-	assert.Equal(t, "", Matches("test@vouch.github.io"))
+	assert.Equal(t, "", Matches(context.Background(), "test@vouch.github.io"))
 
-	assert.Equal(t, "vouch.github.io", Matches("vouch.github.io"))
-	assert.Equal(t, "vouch.github.io", Matches("sub.vouch.github.io"))
-	assert.Equal(t, "", Matches("a-different-vouch.github.io"))
+	assert.Equal(t, "vouch.github.io", Matches(context.Background(), "vouch.github.io"))
+	assert.Equal(t, "vouch.github.io", Matches(context.Background(), "sub.vouch.github.io"))
+	assert.Equal(t, "", Matches(context.Background(), "a-different-vouch.github.io"))
 
-	assert.Equal(t, "", Matches("mydomain.com"))
+	assert.Equal(t, "", Matches(context.Background(), "mydomain.com"))
 
-	assert.Equal(t, "test.mydomain.com", Matches("test.mydomain.com"))
-	assert.Equal(t, "sub.test.mydomain.com", Matches("sub.test.mydomain.com"))
-	assert.Equal(t, "sub.test.mydomain.com", Matches("subsub.sub.test.mydomain.com"))
-	assert.Equal(t, "test.mydomain.com", Matches("other.test.mydomain.com"))
+	assert.Equal(t, "test.mydomain.com", Matches(context.Background(), "test.mydomain.com"))
+	assert.Equal(t, "sub.test.mydomain.com", Matches(context.Background(), "sub.test.mydomain.com"))
+	assert.Equal(t, "sub.test.mydomain.com", Matches(context.Background(), "subsub.sub.test.mydomain.com"))
+	assert.Equal(t, "test.mydomain.com", Matches(context.Background(), "other.test.mydomain.com"))
 }
@@ -0,0 +1,211 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package forwarded reads the X-Forwarded-* headers set by the reverse proxies in front of Vouch Proxy
+// or the RFC 7239 `Forwarded` header in their place, see `vouch.forwarded.header`
+// when the request has passed through a chain of proxies each one may have appended a value
+// and `vouch.forwarded.select` and `vouch.forwarded.trusted_hops` decide which of them to believe
+package forwarded
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// Value the chosen value of a forwarded header which may be repeated or hold a comma separated list
+// `first` is the value set by the proxy furthest from Vouch Proxy,
+// `last` counts `trusted_hops` back from the nearest proxy, values beyond them could have been sent by the client
+func Value(r *http.Request, header string) string {
+	var values []string
+	for _, h := range r.Header.Values(header) {
+		values = append(values, strings.Split(h, ",")...)
+	}
+	return choose(r, values)
+}
+
+// Param the chosen value of a parameter, such as `proto`, of the RFC 7239 `Forwarded` header
+// each proxy appends an element: `Forwarded: for=192.0.2.60;proto=https;host=app.example.com, for=10.0.0.1`
+// the values are chosen from the elements which hold the parameter, as with the X-Forwarded-* headers
+// https://tools.ietf.org/html/rfc7239
+func Param(r *http.Request, param string) string {
+	var values []string
+	for _, h := range r.Header.Values("Forwarded") {
+		for _, element := range splitQuoted(h, ',') {
+			for _, pair := range splitQuoted(element, ';') {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), param) {
+					values = append(values, unquote(kv[1]))
+				}
+			}
+		}
+	}
+	return choose(r, values)
+}
+
+// splitQuoted split s at each sep which isn't within a quoted string
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote the value of a parameter, which is a token or a quoted string
+func unquote(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	var b strings.Builder
+	for i := 1; i < len(v)-1; i++ {
+		if v[i] == '\\' && i+1 < len(v)-1 {
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// header the X-Forwarded-* header or the parameter of `Forwarded`, whichever `forwarded.header` reads first
+func header(r *http.Request, xHeader string, param string) string {
+	if cfg.FromContext(r.Context()).Forwarded.Header == cfg.ForwardedHeaderRFC7239 {
+		if v := Param(r, param); v != "" {
+			return v
+		}
+		return Value(r, xHeader)
+	}
+	if v := Value(r, xHeader); v != "" {
+		return v
+	}
+	return Param(r, param)
+}
+
+// choose from the values appended by each proxy per `vouch.forwarded` of the request's cfg.Instance
+func choose(r *http.Request, values []string) string {
+	var vs []string
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			vs = append(vs, v)
+		}
+	}
+	if len(vs) == 0 {
+		return ""
+	}
+
+	forwarded := cfg.FromContext(r.Context()).Forwarded
+	if forwarded.Select == cfg.ForwardedFirst {
+		return vs[0]
+	}
+	i := len(vs) - forwarded.TrustedHops
+	if i < 0 {
+		i = 0
+	}
+	return vs[i]
+}
+
+// Host the host requested of the proxy, from `X-Forwarded-Host` (or `Forwarded: host=`) or the request's Host
+func Host(r *http.Request) string {
+	if host := header(r, "X-Forwarded-Host", "host"); host != "" {
+		return host
+	}
+	return r.Host
+}
+
+// URI the path requested of the proxy, from nginx's `X-Original-URI` or `X-Forwarded-Uri`
+// a path may hold commas so only repeated headers are treated as several values
+func URI(r *http.Request) string {
+	if uri := choose(r, r.Header.Values("X-Original-URI")); uri != "" {
+		return uri
+	}
+	return choose(r, r.Header.Values("X-Forwarded-Uri"))
+}
+
+// URL the url requested of the proxy, from Scheme, Host and URI
+func URL(r *http.Request) string {
+	return Scheme(r) + "://" + Host(r) + URI(r)
+}
+
+// Scheme the scheme requested of the proxy, from `X-Forwarded-Proto` (or `Forwarded: proto=`)
+// without a scheme from the proxy it's https if `cookie.secure`, since the cookie is then only sent over https
+func Scheme(r *http.Request) string {
+	scheme := strings.ToLower(header(r, "X-Forwarded-Proto", "proto"))
+	if scheme != "http" && scheme != "https" {
+		scheme = "http"
+		if cfg.FromContext(r.Context()).Cookie.Secure {
+			scheme = "https"
+		}
+	}
+	return scheme
+}
+
+// Method the method of the request to the proxy, from Traefik's `X-Forwarded-Method` or `X-Original-Method`
+// or else the method of the request itself, which is GET from nginx's auth_request
+func Method(r *http.Request) string {
+	if method := Value(r, "X-Forwarded-Method"); method != "" {
+		return strings.ToUpper(method)
+	}
+	if method := Value(r, "X-Original-Method"); method != "" {
+		return strings.ToUpper(method)
+	}
+	return r.Method
+}
+
+// ClientIP the client's address from `X-Forwarded-For` (or `Forwarded: for=`), or the address the request came from
+func ClientIP(r *http.Request) string {
+	if cfg.FromContext(r.Context()).Forwarded.Header == cfg.ForwardedHeaderRFC7239 {
+		if ip := forNode(Param(r, "for")); ip != "" {
+			return ip
+		}
+	}
+	if ip := Value(r, "X-Forwarded-For"); ip != "" {
+		return ip
+	}
+	if ip := forNode(Param(r, "for")); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forNode the address of the node of `Forwarded: for=`, less its port
+// "" for an obfuscated identifier such as `_hidden` or `unknown`, which isn't an address
+func forNode(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	if node == "unknown" || strings.HasPrefix(node, "_") {
+		return ""
+	}
+	return node
+}
@@ -0,0 +1,195 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package forwarded
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestHost(t *testing.T) {
+	cfg.InitForTestPurposes()
+
+	tests := []struct {
+		name        string
+		xfh         []string
+		selection   string
+		trustedHops int
+		want        string
+	}{
+		{"none", nil, cfg.ForwardedLast, 1, "vouch.example.com"},
+		{"single", []string{"app.example.com"}, cfg.ForwardedLast, 1, "app.example.com"},
+		{"list last", []string{"evil.example.net, app.example.com"}, cfg.ForwardedLast, 1, "app.example.com"},
+		{"list first", []string{"app.example.com, lb.internal"}, cfg.ForwardedFirst, 1, "app.example.com"},
+		{"repeated headers last", []string{"evil.example.net", "app.example.com"}, cfg.ForwardedLast, 1, "app.example.com"},
+		{"repeated headers first", []string{"app.example.com", "lb.internal"}, cfg.ForwardedFirst, 1, "app.example.com"},
+		{"two trusted hops", []string{"evil.example.net, app.example.com", "lb.internal"}, cfg.ForwardedLast, 2, "app.example.com"},
+		{"more hops than values", []string{"app.example.com, lb.internal"}, cfg.ForwardedLast, 5, "app.example.com"},
+		{"blank values", []string{" , app.example.com ,"}, cfg.ForwardedLast, 1, "app.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Cfg.Forwarded.Select = tt.selection
+			cfg.Cfg.Forwarded.TrustedHops = tt.trustedHops
+			r := httptest.NewRequest("GET", "http://vouch.example.com/validate", nil)
+			for _, v := range tt.xfh {
+				r.Header.Add("X-Forwarded-Host", v)
+			}
+			assert.Equal(t, tt.want, Host(r))
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	cfg.InitForTestPurposes()
+	cfg.Cfg.Forwarded.TrustedHops = 2
+
+	r := httptest.NewRequest("GET", "/validate", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	assert.Equal(t, "10.0.0.2", ClientIP(r))
+
+	r.Header.Set("X-Forwarded-For", "198.51.100.66, 203.0.113.7, 10.0.0.1")
+	assert.Equal(t, "203.0.113.7", ClientIP(r))
+}
+
+func TestParam(t *testing.T) {
+	cfg.InitForTestPurposes()
+
+	tests := []struct {
+		name      string
+		forwarded []string
+		param     string
+		selection string
+		want      string
+	}{
+		{"none", nil, "proto", cfg.ForwardedLast, ""},
+		{"single", []string{"for=192.0.2.60;proto=https;host=app.example.com"}, "proto", cfg.ForwardedLast, "https"},
+		{"case insensitive name", []string{"For=192.0.2.60;Proto=https"}, "proto", cfg.ForwardedLast, "https"},
+		{"quoted", []string{`for="[2001:db8:cafe::17]:4711";host="app.example.com"`}, "host", cfg.ForwardedLast, "app.example.com"},
+		{"quoted comma", []string{`host="a,b";proto=https, host=app.example.com`}, "host", cfg.ForwardedFirst, "a,b"},
+		{"escaped quote", []string{`host="app\"x"`}, "host", cfg.ForwardedLast, `app"x`},
+		{"list first", []string{"proto=https;host=app.example.com, proto=http;host=lb.internal"}, "host", cfg.ForwardedFirst, "app.example.com"},
+		{"list last", []string{"host=evil.example.net, host=app.example.com"}, "host", cfg.ForwardedLast, "app.example.com"},
+		{"repeated headers first", []string{"proto=https", "proto=http"}, "proto", cfg.ForwardedFirst, "https"},
+		{"elements without the param", []string{"for=192.0.2.60;proto=https, for=10.0.0.1"}, "proto", cfg.ForwardedLast, "https"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Cfg.Forwarded.Select = tt.selection
+			r := httptest.NewRequest("GET", "/validate", nil)
+			for _, v := range tt.forwarded {
+				r.Header.Add("Forwarded", v)
+			}
+			assert.Equal(t, tt.want, Param(r, tt.param))
+		})
+	}
+}
+
+func TestForwardedHeader(t *testing.T) {
+	cfg.InitForTestPurposes()
+	cfg.Cfg.Cookie.Secure = false
+	defer func() { cfg.Cfg.Forwarded.Header = cfg.ForwardedHeaderX }()
+
+	tests := []struct {
+		name       string
+		header     string
+		xForwarded bool
+		wantURL    string
+		wantIP     string
+	}{
+		{"fallback", cfg.ForwardedHeaderX, false, "https://app.example.com/hello", "2001:db8:cafe::17"},
+		{"x-forwarded first", cfg.ForwardedHeaderX, true, "http://x.example.com/hello", "198.51.100.7"},
+		{"forwarded first", cfg.ForwardedHeaderRFC7239, true, "https://app.example.com/hello", "2001:db8:cafe::17"},
+		{"forwarded only", cfg.ForwardedHeaderRFC7239, false, "https://app.example.com/hello", "2001:db8:cafe::17"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Cfg.Forwarded.Header = tt.header
+			r := httptest.NewRequest("GET", "/validate", nil)
+			r.Header.Set("X-Original-URI", "/hello")
+			r.Header.Set("Forwarded", `for="[2001:db8:cafe::17]:4711";proto=HTTPS;host=app.example.com`)
+			if tt.xForwarded {
+				r.Header.Set("X-Forwarded-Proto", "http")
+				r.Header.Set("X-Forwarded-Host", "x.example.com")
+				r.Header.Set("X-Forwarded-For", "198.51.100.7")
+			}
+			assert.Equal(t, tt.wantURL, URL(r))
+			assert.Equal(t, tt.wantIP, ClientIP(r))
+		})
+	}
+}
+
+func TestForNode(t *testing.T) {
+	tests := []struct {
+		node string
+		want string
+	}{
+		{"192.0.2.43", "192.0.2.43"},
+		{"192.0.2.43:47011", "192.0.2.43"},
+		{"[2001:db8:cafe::17]:4711", "2001:db8:cafe::17"},
+		{"[2001:db8:cafe::17]", "2001:db8:cafe::17"},
+		{"unknown", ""},
+		{"_hidden", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.node, func(t *testing.T) {
+			assert.Equal(t, tt.want, forNode(tt.node))
+		})
+	}
+}
+
+func TestClientIPForwardedUnknown(t *testing.T) {
+	cfg.InitForTestPurposes()
+
+	r := httptest.NewRequest("GET", "/validate", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	r.Header.Set("Forwarded", "for=unknown")
+	assert.Equal(t, "10.0.0.2", ClientIP(r))
+}
+
+func TestURI(t *testing.T) {
+	cfg.InitForTestPurposes()
+
+	r := httptest.NewRequest("GET", "/validate", nil)
+	assert.Equal(t, "", URI(r))
+	r.Header.Set("X-Forwarded-Uri", "/forwarded")
+	assert.Equal(t, "/forwarded", URI(r))
+	r.Header.Set("X-Original-URI", "/original?a=1,2")
+	assert.Equal(t, "/original?a=1,2", URI(r))
+}
+
+func TestURL(t *testing.T) {
+	cfg.InitForTestPurposes()
+	cfg.Cfg.Cookie.Secure = true
+
+	r := httptest.NewRequest("GET", "/validate", nil)
+	r.Header.Set("X-Forwarded-Host", "app.example.com")
+	r.Header.Set("X-Original-URI", "/hello?a=1")
+	assert.Equal(t, "https://app.example.com/hello?a=1", URL(r))
+	r.Header.Set("X-Forwarded-Proto", "http")
+	assert.Equal(t, "http://app.example.com/hello?a=1", URL(r))
+}
+
+func TestMethod(t *testing.T) {
+	cfg.InitForTestPurposes()
+
+	r := httptest.NewRequest("GET", "/validate", nil)
+	assert.Equal(t, "GET", Method(r))
+	r.Header.Set("X-Original-Method", "put")
+	assert.Equal(t, "PUT", Method(r))
+	r.Header.Set("X-Forwarded-Method", "POST")
+	assert.Equal(t, "POST", Method(r))
+}
@@ -0,0 +1,119 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package geoip finds the country and the autonomous system of an address
+// in MaxMind DB files such as GeoLite2-Country (or -City) and GeoLite2-ASN, for `vouch.network_rules`
+package geoip
+
+import (
+	"context"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+var log *zap.SugaredLogger
+
+// state the databases of `vouch.geoip` of a cfg.Instance
+type state struct {
+	countryDB *maxminddb.Reader
+	asnDB     *maxminddb.Reader
+}
+
+type stateKey struct{}
+
+// std the state of the package configuration, for a request without a cfg.Instance
+var std = &state{}
+
+// stateOf the state of the cfg.Instance of ctx, otherwise std
+func stateOf(ctx context.Context) *state {
+	if s, ok := cfg.State(ctx, stateKey{}).(*state); ok {
+		return s
+	}
+	return std
+}
+
+// Configure see main.go configure()
+// cfg.ValidateConfiguration() has already refused network_rules by country or ASN without a database which opens
+func Configure() {
+	log = cfg.Logging.Logger
+	std = &state{
+		countryDB: open(std.countryDB, cfg.Cfg.GeoIP.CountryDB, "country_db"),
+		asnDB:     open(std.asnDB, cfg.Cfg.GeoIP.ASNDB, "asn_db"),
+	}
+}
+
+// ConfigureInstance open the databases of inst, see cfg.NewInstance()
+func ConfigureInstance(inst *cfg.Instance) {
+	log = cfg.Logging.Logger
+	inst.SetState(stateKey{}, &state{
+		countryDB: open(nil, cfg.Cfg.GeoIP.CountryDB, "country_db"),
+		asnDB:     open(nil, cfg.Cfg.GeoIP.ASNDB, "asn_db"),
+	})
+}
+
+// open the database at path in place of prev
+func open(prev *maxminddb.Reader, path, option string) *maxminddb.Reader {
+	if prev != nil {
+		prev.Close()
+	}
+	if path == "" {
+		return nil
+	}
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		log.Errorf("%s.geoip.%s: %s", cfg.Branding.LCName, option, err)
+		return nil
+	}
+	log.Infof("%s.geoip.%s %s is a %s database", cfg.Branding.LCName, option, path, r.Metadata.DatabaseType)
+	return r
+}
+
+// Country the ISO 3166 code of the country of ip, "" if it isn't found
+// false if the database of the cfg.Instance of ctx isn't available
+func Country(ctx context.Context, ip net.IP) (string, bool) {
+	countryDB := stateOf(ctx).countryDB
+	if countryDB == nil {
+		return "", false
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	lookup(countryDB, ip, &record)
+	return record.Country.ISOCode, true
+}
+
+// ASN the number of the autonomous system announcing ip, 0 if it isn't found
+// false if the database of the cfg.Instance of ctx isn't available
+func ASN(ctx context.Context, ip net.IP) (uint, bool) {
+	asnDB := stateOf(ctx).asnDB
+	if asnDB == nil {
+		return 0, false
+	}
+	var record struct {
+		ASN uint `maxminddb:"autonomous_system_number"`
+	}
+	lookup(asnDB, ip, &record)
+	return record.ASN, true
+}
+
+func lookup(r *maxminddb.Reader, ip net.IP, record interface{}) {
+	if ip == nil {
+		return
+	}
+	if err := r.Lookup(ip, record); err != nil {
+		log.Warnf("geoip lookup of %s in the %s database: %s", ip, r.Metadata.DatabaseType, err)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package geoip
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// the MaxMind DB format, as used by GeoLite2 and GeoIP2
+// https://maxmind.github.io/MaxMind-DB/
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const dataSectionSeparator = 16
+
+const (
+	typePointer = 1
+	typeString  = 2
+	typeUint16  = 5
+	typeUint32  = 6
+	typeMap     = 7
+)
+
+// mmdbWriter builds a small MaxMind DB for the tests
+// networks must not overlap
+type mmdbWriter struct {
+	ipVersion  int
+	recordSize int
+	// nodes each record is 0 for empty, n+1 for node n, or -(offset+1) for data at offset
+	nodes [][2]int
+	data  []byte
+}
+
+func newMMDBWriter(ipVersion, recordSize int) *mmdbWriter {
+	return &mmdbWriter{ipVersion: ipVersion, recordSize: recordSize, nodes: [][2]int{{0, 0}}}
+}
+
+// insert the encoded record for cidr, returns the offset of the record in the data section
+func (m *mmdbWriter) insert(t *testing.T, cidr string, record []byte) int {
+	offset := len(m.data)
+	m.data = append(m.data, record...)
+	m.insertOffset(t, cidr, offset)
+	return offset
+}
+
+func (m *mmdbWriter) insertOffset(t *testing.T, cidr string, offset int) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := []byte(ipnet.IP)
+	prefix, _ := ipnet.Mask.Size()
+	if m.ipVersion == 6 && len(ip) == net.IPv4len {
+		ip = append(make([]byte, 12), ip...)
+		prefix += 96
+	}
+
+	node := 0
+	for i := 0; i < prefix; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		if i == prefix-1 {
+			m.nodes[node][bit] = -(offset + 1)
+			return
+		}
+		if next := m.nodes[node][bit]; next > 0 {
+			node = next - 1
+			continue
+		}
+		m.nodes = append(m.nodes, [2]int{0, 0})
+		m.nodes[node][bit] = len(m.nodes)
+		node = len(m.nodes) - 1
+	}
+}
+
+func (m *mmdbWriter) bytes() []byte {
+	nodeCount := len(m.nodes)
+	value := func(r int) uint32 {
+		switch {
+		case r == 0:
+			return uint32(nodeCount)
+		case r > 0:
+			return uint32(r - 1)
+		default:
+			return uint32(nodeCount + dataSectionSeparator - r - 1)
+		}
+	}
+
+	var b []byte
+	for _, n := range m.nodes {
+		l, r := value(n[0]), value(n[1])
+		switch m.recordSize {
+		case 24:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			b = append(b, byte(l>>16), byte(l>>8), byte(l), byte(l>>24<<4|r>>24&0x0F), byte(r>>16), byte(r>>8), byte(r))
+		default:
+			b = append(b, byte(l>>24), byte(l>>16), byte(l>>8), byte(l), byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	b = append(b, make([]byte, dataSectionSeparator)...)
+	b = append(b, m.data...)
+	b = append(b, metadataMarker...)
+	b = append(b, encodeMap(
+		"node_count", encodeUint32(uint32(nodeCount)),
+		"record_size", encodeUint16(uint16(m.recordSize)),
+		"ip_version", encodeUint16(uint16(m.ipVersion)),
+		"database_type", encodeString("Vouch-Test"),
+	)...)
+	return b
+}
+
+func encodeString(s string) []byte {
+	if len(s) >= 29 {
+		panic("encodeString only encodes short strings")
+	}
+	return append([]byte{typeString<<5 | byte(len(s))}, s...)
+}
+
+func encodeUint16(u uint16) []byte {
+	b := []byte{typeUint16<<5 | 2, 0, 0}
+	binary.BigEndian.PutUint16(b[1:], u)
+	return b
+}
+
+func encodeUint32(u uint32) []byte {
+	b := []byte{typeUint32<<5 | 4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], u)
+	return b
+}
+
+func encodePointer(offset int) []byte {
+	return []byte{typePointer<<5 | byte(offset>>8&0x7), byte(offset)}
+}
+
+// encodeMap of keys and their encoded values
+func encodeMap(kv ...interface{}) []byte {
+	b := []byte{typeMap<<5 | byte(len(kv)/2)}
+	for i := 0; i < len(kv); i += 2 {
+		b = append(b, encodeString(kv[i].(string))...)
+		b = append(b, kv[i+1].([]byte)...)
+	}
+	return b
+}
+
+func countryRecord(code string) []byte {
+	return encodeMap("country", encodeMap("iso_code", encodeString(code)))
+}
+
+func TestCountryAndASN(t *testing.T) {
+	cfg.InitForTestPurposes()
+	defer func() {
+		cfg.InitForTestPurposes()
+		Configure()
+	}()
+
+	// the databases aren't configured
+	Configure()
+	_, ok := Country(context.Background(), net.ParseIP("192.0.2.1"))
+	assert.False(t, ok)
+	_, ok = ASN(context.Background(), net.ParseIP("192.0.2.1"))
+	assert.False(t, ok)
+
+	// a database which is missing isn't used
+	cfg.Cfg.GeoIP.CountryDB = filepath.Join(t.TempDir(), "missing.mmdb")
+	Configure()
+	_, ok = Country(context.Background(), net.ParseIP("192.0.2.1"))
+	assert.False(t, ok)
+
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			t.Run(fmt.Sprintf("ipv%d-%d", ipVersion, recordSize), func(t *testing.T) {
+				dir := t.TempDir()
+				countries := newMMDBWriter(ipVersion, recordSize)
+				de := countries.insert(t, "192.0.2.0/24", countryRecord("DE"))
+				// a second network for the same country points at the first record
+				countries.insert(t, "203.0.113.128/25", encodePointer(de))
+				if ipVersion == 6 {
+					countries.insert(t, "2001:db8::/32", countryRecord("NL"))
+				}
+				asns := newMMDBWriter(ipVersion, recordSize)
+				asns.insert(t, "192.0.2.0/24", encodeMap("autonomous_system_number", encodeUint32(64500)))
+				for name, w := range map[string]*mmdbWriter{"country.mmdb": countries, "asn.mmdb": asns} {
+					if err := ioutil.WriteFile(filepath.Join(dir, name), w.bytes(), 0600); err != nil {
+						t.Fatal(err)
+					}
+				}
+				cfg.Cfg.GeoIP.CountryDB = filepath.Join(dir, "country.mmdb")
+				cfg.Cfg.GeoIP.ASNDB = filepath.Join(dir, "asn.mmdb")
+				Configure()
+
+				countryTests := map[string]string{
+					"192.0.2.1":        "DE",
+					"::ffff:192.0.2.1": "DE",
+					"203.0.113.200":    "DE",
+					"203.0.113.1":      "",
+					"198.51.100.1":     "",
+				}
+				if ipVersion == 6 {
+					countryTests["2001:db8::1"] = "NL"
+				}
+				for ip, want := range countryTests {
+					country, ok := Country(context.Background(), net.ParseIP(ip))
+					assert.True(t, ok, ip)
+					assert.Equal(t, want, country, ip)
+				}
+
+				asn, ok := ASN(context.Background(), net.ParseIP("192.0.2.1"))
+				assert.True(t, ok)
+				assert.Equal(t, uint(64500), asn)
+				asn, ok = ASN(context.Background(), net.ParseIP("198.51.100.1"))
+				assert.True(t, ok)
+				assert.Equal(t, uint(0), asn)
+			})
+		}
+	}
+}
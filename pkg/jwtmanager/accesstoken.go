@@ -0,0 +1,58 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"net/http"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// SetAccessTokenHeader pass the provider's access token in `headers.accesstoken` so that the upstream may call the IdP's APIs
+// with `headers.accesstoken_encrypt` it's a compact JWE (dir, A256GCM) which only the holder of the key can read
+// the token is left out rather than sent in the clear if it can't be encrypted
+func SetAccessTokenHeader(w http.ResponseWriter, r *http.Request, claims *VouchClaims) {
+	c := cfg.FromContext(r.Context())
+	if c.Headers.AccessToken == "" || claims.PAccessToken == "" {
+		return
+	}
+	token := claims.PAccessToken
+	if c.Headers.AccessTokenEncrypt != "" {
+		var err error
+		if token, err = encryptAccessToken(c, token); err != nil {
+			log.Errorf("headers.accesstoken_encrypt: %s", err)
+			return
+		}
+	}
+	w.Header().Set(c.Headers.AccessToken, token)
+}
+
+func accessTokenAEAD(c *cfg.Config) (cipher.AEAD, error) {
+	key, err := c.AccessTokenKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptAccessToken(c *cfg.Config, token string) (string, error) {
+	aead, err := accessTokenAEAD(c)
+	if err != nil {
+		return "", err
+	}
+	return sealJWE(aead, jweHeader{Alg: jweAlg, Enc: jweEnc}, []byte(token))
+}
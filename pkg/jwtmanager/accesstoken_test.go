@@ -0,0 +1,58 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestSetAccessTokenHeader(t *testing.T) {
+	defer func(h, k string) { cfg.Cfg.Headers.AccessToken, cfg.Cfg.Headers.AccessTokenEncrypt = h, k }(cfg.Cfg.Headers.AccessToken, cfg.Cfg.Headers.AccessTokenEncrypt)
+	cfg.Cfg.Headers.AccessToken = "X-Vouch-IdP-AccessToken"
+	claims := &VouchClaims{PAccessToken: "an-access-token"}
+
+	tests := []struct {
+		name    string
+		key     string
+		claims  *VouchClaims
+		want    string
+		wantJWE bool
+	}{
+		{"in the clear", "", claims, "an-access-token", false},
+		{"encrypted", "1etvapkjqhkOPpx39B0fPjdYvYt6MZZIFemwPpRUxMU=", claims, "", true},
+		{"unpadded url encoded key", "1etvapkjqhkOPpx39B0fPjdYvYt6MZZIFemwPpRUxMU", claims, "", true},
+		{"a key too short is never sent in the clear", "c2hvcnQ=", claims, "", false},
+		{"no access token", "", &VouchClaims{}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Cfg.Headers.AccessTokenEncrypt = tt.key
+			rr := httptest.NewRecorder()
+			SetAccessTokenHeader(rr, httptest.NewRequest("GET", "/validate", nil), tt.claims)
+			got := rr.Header().Get(cfg.Cfg.Headers.AccessToken)
+			if !tt.wantJWE {
+				assert.Equal(t, tt.want, got)
+				return
+			}
+			assert.NotContains(t, got, "an-access-token")
+			aead, err := accessTokenAEAD(cfg.Cfg)
+			assert.NoError(t, err)
+			token, err := openJWE(aead, got)
+			assert.NoError(t, err)
+			assert.Equal(t, "an-access-token", string(token))
+		})
+	}
+}
@@ -0,0 +1,184 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"crypto"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/patrickmn/go-cache"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
+)
+
+// an assertion is only good for the request it was issued for
+const assertionMaxAge = time.Minute
+
+// AssertionClaims the signed assertion passed downstream in `headers.assertion`
+// verify it with Vouch Proxy's public key (or jwt.secret) and check that `aud`, `host` and `path` match the request
+type AssertionClaims struct {
+	Host   string                 `json:"host"`
+	Path   string                 `json:"path,omitempty"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+	jwt.StandardClaims
+}
+
+// audienceSigner signs the assertions for one of `jwt.audience_keys`
+type audienceSigner struct {
+	method jwt.SigningMethod
+	key    interface{}
+	// verifyKey the secret, or the public key of the private key
+	verifyKey interface{}
+	kid       string
+}
+
+func (s *state) assertionConfigure() {
+	if cfg.Cfg.Headers.Assertion == "" {
+		return
+	}
+	var err error
+	if s.assertionKey, err = cfg.Cfg.SigningKey(); err != nil {
+		log.Errorf("headers.assertion: %s", err)
+	}
+	s.audienceSigners = make(map[string]*audienceSigner, len(cfg.Cfg.JWT.AudienceKeys))
+	for _, k := range cfg.Cfg.JWT.AudienceKeys {
+		signer, err := newAudienceSigner(k)
+		if err != nil {
+			log.Errorf("jwt.audience_keys %s: %s", k.Audience, err)
+			continue
+		}
+		s.audienceSigners[strings.ToLower(k.Audience)] = signer
+	}
+	exp := time.Duration(cfg.Cfg.JWT.MaxAge) * time.Minute
+	s.assertionClaims = cache.New(exp, exp/5)
+}
+
+func newAudienceSigner(k cfg.AudienceKey) (*audienceSigner, error) {
+	key, err := k.SigningKey()
+	if err != nil {
+		return nil, err
+	}
+	s := &audienceSigner{method: jwt.GetSigningMethod(k.SigningMethod), key: key, verifyKey: key}
+	if signer, ok := key.(crypto.Signer); ok {
+		s.verifyKey = signer.Public()
+		jwk, err := newJWK(s.verifyKey, k.SigningMethod)
+		if err != nil {
+			return nil, err
+		}
+		s.kid = jwk.Kid
+	}
+	return s, nil
+}
+
+// requestedHostAndPath the host and path requested of nginx (or another reverse proxy) which sent the request to /validate
+func requestedHostAndPath(r *http.Request) (string, string) {
+	return forwarded.Host(r), forwarded.URI(r)
+}
+
+// NewAssertion sign the identity in claims for the request r
+func NewAssertion(claims *VouchClaims, r *http.Request) (string, error) {
+	c, st := cfg.FromContext(r.Context()), stateOf(r.Context())
+	host, path := requestedHostAndPath(r)
+	now := time.Now()
+	ac := AssertionClaims{
+		Host:   host,
+		Path:   path,
+		Claims: claims.CustomClaims,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    c.JWT.Issuer,
+			Subject:   claims.Username,
+			Audience:  host,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(assertionMaxAge).Unix(),
+		},
+	}
+	method, key, kid := jwt.GetSigningMethod(c.JWT.SigningMethod), st.assertionKey, st.keyID()
+	if s, ok := st.audienceSigners[strings.ToLower(host)]; ok {
+		method, key, kid = s.method, s.key, s.kid
+	}
+	token := jwt.NewWithClaims(method, ac)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	return token.SignedString(key)
+}
+
+// SetAssertionHeader add a signed assertion to `headers.assertion` and remember the claims for vouchJWT
+func SetAssertionHeader(w http.ResponseWriter, r *http.Request, vouchJWT string, claims *VouchClaims) {
+	c := cfg.FromContext(r.Context())
+	if c.Headers.Assertion == "" {
+		return
+	}
+	assertion, err := NewAssertion(claims, r)
+	if err != nil {
+		log.Errorf("headers.assertion: %s", err)
+		return
+	}
+	w.Header().Set(c.Headers.Assertion, assertion)
+	stateOf(r.Context()).assertionClaims.SetDefault(vouchJWT, claims)
+}
+
+// cachedAssertion sign a fresh assertion for a response served from the cache
+// assertionClaims outlives the response cache so the claims are always found
+func cachedAssertion(w http.ResponseWriter, r *http.Request, vouchJWT string) {
+	v, found := stateOf(r.Context()).assertionClaims.Get(vouchJWT)
+	if !found {
+		log.Errorf("headers.assertion: no claims found for cached response")
+		return
+	}
+	assertion, err := NewAssertion(v.(*VouchClaims), r)
+	if err != nil {
+		log.Errorf("headers.assertion: %s", err)
+		return
+	}
+	w.Header().Set(cfg.FromContext(r.Context()).Headers.Assertion, assertion)
+}
+
+// ParseAssertion verify an assertion as a backend would, with Vouch Proxy's public key
+// or, for the audience of one of `jwt.audience_keys`, with that key
+func ParseAssertion(assertion string, r *http.Request) (*AssertionClaims, error) {
+	c := cfg.FromContext(r.Context())
+	host, path := requestedHostAndPath(r)
+	method := jwt.GetSigningMethod(c.JWT.SigningMethod)
+	var key interface{}
+	if s, ok := stateOf(r.Context()).audienceSigners[strings.ToLower(host)]; ok {
+		method, key = s.method, s.verifyKey
+	} else {
+		var err error
+		if key, err = c.DecryptionKey(); err != nil {
+			return nil, err
+		}
+	}
+	return parseAssertion(assertion, host, path, method, key)
+}
+
+// parseAssertion verify the assertion for host and path with key
+func parseAssertion(assertion, host, path string, method jwt.SigningMethod, key interface{}) (*AssertionClaims, error) {
+	ac := &AssertionClaims{}
+	_, err := jwt.ParseWithClaims(assertion, ac, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != method {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ac.VerifyAudience(host, true) || ac.Host != host || ac.Path != path {
+		return nil, fmt.Errorf("assertion was issued for %s%s not %s%s", ac.Host, ac.Path, host, path)
+	}
+	return ac, nil
+}
@@ -0,0 +1,152 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestAssertionRoundTrip(t *testing.T) {
+	rootDir := os.Getenv(cfg.Branding.UCName + "_ROOT")
+	defer func() {
+		os.Unsetenv(cfg.Branding.UCName + "_CONFIG")
+		cfg.InitForTestPurposes()
+		Configure()
+	}()
+
+	for _, cfgFile := range []string{"test_config.yml", "test_config_rsa.yml"} {
+		t.Run(cfgFile, func(t *testing.T) {
+			os.Setenv(cfg.Branding.UCName+"_CONFIG", filepath.Join(rootDir, "config/testing", cfgFile))
+			cfg.InitForTestPurposes()
+			if cfg.Cfg.JWT.PrivateKeyFile != "" {
+				if _, err := os.Stat(cfg.Cfg.JWT.PrivateKeyFile); err != nil {
+					t.Skipf("%s not found, see `./do.sh test`", cfg.Cfg.JWT.PrivateKeyFile)
+				}
+			}
+			cfg.Cfg.Headers.Assertion = "X-Vouch-Assertion"
+			Configure()
+
+			claims := &VouchClaims{Username: "test@example.com", CustomClaims: map[string]interface{}{"groups": []interface{}{"admins"}}}
+			r, _ := http.NewRequest("GET", "http://vouch.example.com/validate", nil)
+			r.Host = "app.example.com"
+			r.Header.Set("X-Original-URI", "/admin/settings")
+
+			assertion, err := NewAssertion(claims, r)
+			assert.NoError(t, err)
+
+			ac, err := ParseAssertion(assertion, r)
+			assert.NoError(t, err)
+			if assert.NotNil(t, ac) {
+				assert.Equal(t, "test@example.com", ac.Subject)
+				assert.Equal(t, "app.example.com", ac.Host)
+				assert.Equal(t, "/admin/settings", ac.Path)
+				assert.Equal(t, []interface{}{"admins"}, ac.Claims["groups"])
+			}
+
+			// replayed against another path
+			other := r.Clone(r.Context())
+			other.Header.Set("X-Original-URI", "/somewhere/else")
+			_, err = ParseAssertion(assertion, other)
+			assert.Error(t, err)
+
+			// replayed against another host
+			other = r.Clone(r.Context())
+			other.Host = "evil.example.com"
+			_, err = ParseAssertion(assertion, other)
+			assert.Error(t, err)
+
+			// tampered
+			parts := strings.Split(assertion, ".")
+			parts[2] = strings.Repeat("A", len(parts[2]))
+			_, err = ParseAssertion(strings.Join(parts, "."), r)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAssertionAudienceKeys(t *testing.T) {
+	privA, _, pubA := writeKeyPair(t, "RS256")
+	privB, _, pubB := writeKeyPair(t, "ES256")
+	secretC := strings.Repeat("c", 44)
+	cfg.Cfg.Headers.Assertion = "X-Vouch-Assertion"
+	cfg.Cfg.JWT.AudienceKeys = []cfg.AudienceKey{
+		{Audience: "svc-a.example.com", SigningMethod: "RS256", PrivateKeyFile: privA},
+		{Audience: "SVC-B.example.com", SigningMethod: "ES256", PrivateKeyFile: privB},
+		{Audience: "svc-c.example.com", SigningMethod: "HS256", Secret: secretC},
+	}
+	Configure()
+	defer func() {
+		cfg.Cfg.Headers.Assertion = ""
+		cfg.Cfg.JWT.AudienceKeys = nil
+		Configure()
+	}()
+
+	// the key each backend holds
+	backends := map[string]struct {
+		method jwt.SigningMethod
+		key    interface{}
+	}{
+		"svc-a.example.com": {jwt.SigningMethodRS256, pubA},
+		"svc-b.example.com": {jwt.SigningMethodES256, pubB},
+		"svc-c.example.com": {jwt.SigningMethodHS256, []byte(secretC)},
+		"app.example.com":   {jwt.GetSigningMethod(cfg.Cfg.JWT.SigningMethod), []byte(cfg.Cfg.JWT.Secret)},
+	}
+	claims := &VouchClaims{Username: "test@example.com"}
+	for host, own := range backends {
+		t.Run(host, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://vouch.example.com/validate", nil)
+			r.Host = host
+			r.Header.Set("X-Original-URI", "/api")
+
+			assertion, err := NewAssertion(claims, r)
+			assert.NoError(t, err)
+			token, _, err := new(jwt.Parser).ParseUnverified(assertion, &AssertionClaims{})
+			assert.NoError(t, err)
+			assert.Equal(t, own.method.Alg(), token.Header["alg"])
+
+			ac, err := ParseAssertion(assertion, r)
+			assert.NoError(t, err)
+			if assert.NotNil(t, ac) {
+				assert.Equal(t, host, ac.Audience)
+			}
+
+			// each backend can verify only the assertions for its own audience
+			for other, theirs := range backends {
+				_, err := parseAssertion(assertion, host, "/api", theirs.method, theirs.key)
+				if other == host {
+					assert.NoError(t, err)
+				} else {
+					assert.Error(t, err, "verified by %s", other)
+				}
+			}
+		})
+	}
+
+	// the kid of an RS* or ES* key names its public key
+	r, _ := http.NewRequest("GET", "http://vouch.example.com/validate", nil)
+	r.Host = "svc-a.example.com"
+	assertion, err := NewAssertion(claims, r)
+	assert.NoError(t, err)
+	token, _, err := new(jwt.Parser).ParseUnverified(assertion, &AssertionClaims{})
+	assert.NoError(t, err)
+	jwk, err := newJWK(pubA, "RS256")
+	assert.NoError(t, err)
+	assert.Equal(t, jwk.Kid, token.Header["kid"])
+}
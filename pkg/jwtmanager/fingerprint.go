@@ -0,0 +1,75 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/responses"
+)
+
+// SessionFingerprint the sha256 of the username, expiry and groups (in any order) of the session, see `conditional_validate`
+func SessionFingerprint(ctx context.Context, claims *VouchClaims) string {
+	var groups []string
+	switch g := claims.CustomClaims[cfg.FromContext(ctx).Groups.Claim].(type) {
+	case []interface{}:
+		for _, v := range g {
+			groups = append(groups, fmt.Sprint(v))
+		}
+	case string:
+		groups = []string{g}
+	}
+	sort.Strings(groups)
+
+	h := sha256.New()
+	// each field is length prefixed so that no two sessions hash the same input
+	for _, field := range append([]string{claims.Username, strconv.FormatInt(claims.ExpiresAt, 10)}, groups...) {
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// SetSessionFingerprintHeader pass the fingerprint in `conditional_validate.header` for the backend to send back
+func SetSessionFingerprintHeader(w http.ResponseWriter, r *http.Request, fingerprint string) {
+	c := cfg.FromContext(r.Context())
+	if !c.ConditionalValidate.Enabled {
+		return
+	}
+	w.Header().Set(c.ConditionalValidate.Header, fingerprint)
+}
+
+// SessionUnchanged the backend sent back the fingerprint of the session in `conditional_validate.request_header`
+func SessionUnchanged(r *http.Request, fingerprint string) bool {
+	c := cfg.FromContext(r.Context())
+	if !c.ConditionalValidate.Enabled || fingerprint == "" {
+		return false
+	}
+	sent := r.Header.Get(c.ConditionalValidate.RequestHeader)
+	return sent != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(fingerprint)) == 1
+}
+
+// SendSessionUnchanged the minimal 200 from /validate, only the user, success and fingerprint headers
+func SendSessionUnchanged(w http.ResponseWriter, r *http.Request, username, fingerprint string) {
+	log.Debugf("/validate session of %s unchanged", username)
+	c := cfg.FromContext(r.Context())
+	w.Header().Set(c.Headers.User, username)
+	w.Header().Set(c.Headers.Success, "true")
+	SetSessionFingerprintHeader(w, r, fingerprint)
+	responses.SessionUnchanged(w, r)
+}
@@ -0,0 +1,73 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestSessionFingerprint(t *testing.T) {
+	cfg.InitForTestPurposes()
+	session := func(username string, exp int64, groups ...interface{}) *VouchClaims {
+		return &VouchClaims{
+			Username:       username,
+			CustomClaims:   map[string]interface{}{"groups": groups, "family_name": "Tester"},
+			StandardClaims: jwt.StandardClaims{ExpiresAt: exp},
+		}
+	}
+	base := SessionFingerprint(context.Background(), session("alice", 1600000000, "admins", "dev"))
+
+	tests := []struct {
+		name    string
+		claims  *VouchClaims
+		changed bool
+	}{
+		{"same", session("alice", 1600000000, "admins", "dev"), false},
+		{"groups in another order", session("alice", 1600000000, "dev", "admins"), false},
+		{"other claims aren't included", &VouchClaims{Username: "alice",
+			CustomClaims: map[string]interface{}{"groups": []interface{}{"admins", "dev"}}, StandardClaims: jwt.StandardClaims{ExpiresAt: 1600000000}}, false},
+		{"another user", session("bob", 1600000000, "admins", "dev"), true},
+		{"a new login", session("alice", 1600003600, "admins", "dev"), true},
+		{"a group removed", session("alice", 1600000000, "admins"), true},
+		{"a group added", session("alice", 1600000000, "admins", "dev", "ops"), true},
+		{"fields run together", session("alice1", 600000000, "admins", "dev"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.changed, SessionFingerprint(context.Background(), tt.claims) != base)
+		})
+	}
+}
+
+func TestSessionUnchanged(t *testing.T) {
+	cfg.InitForTestPurposes()
+	fingerprint := SessionFingerprint(context.Background(), &VouchClaims{Username: "alice"})
+	r, _ := http.NewRequest("GET", "/validate", nil)
+
+	cfg.Cfg.ConditionalValidate.Enabled = false
+	r.Header.Set(cfg.Cfg.ConditionalValidate.RequestHeader, fingerprint)
+	assert.False(t, SessionUnchanged(r, fingerprint), "not enabled")
+
+	cfg.Cfg.ConditionalValidate.Enabled = true
+	assert.True(t, SessionUnchanged(r, fingerprint))
+	assert.False(t, SessionUnchanged(r, ""))
+	r.Header.Set(cfg.Cfg.ConditionalValidate.RequestHeader, fingerprint[1:])
+	assert.False(t, SessionUnchanged(r, fingerprint))
+	r.Header.Del(cfg.Cfg.ConditionalValidate.RequestHeader)
+	assert.False(t, SessionUnchanged(r, fingerprint))
+}
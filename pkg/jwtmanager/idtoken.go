@@ -0,0 +1,45 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"net/http"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
+)
+
+// SetIDTokenHeader pass the provider's id_token in `headers.idtoken` to the hosts in `headers.idtoken_hosts`
+// so that they may verify it themselves
+func SetIDTokenHeader(w http.ResponseWriter, r *http.Request, claims *VouchClaims) {
+	c := cfg.FromContext(r.Context())
+	if c.Headers.IDToken == "" || claims.PIdToken == "" {
+		return
+	}
+	if host := forwarded.Host(r); !c.IDTokenHostAllowed(host) {
+		log.Debugf("headers.idtoken: %s is not in headers.idtoken_hosts", host)
+		return
+	}
+	w.Header().Set(c.Headers.IDToken, claims.PIdToken)
+}
+
+// cachedIDToken the id_token for a response served from the cache, which is shared by every host
+func cachedIDToken(w http.ResponseWriter, r *http.Request, vouchJWT string) {
+	if !cfg.FromContext(r.Context()).IDTokenHostAllowed(forwarded.Host(r)) {
+		return
+	}
+	claims, err := ClaimsFromJWT(r.Context(), vouchJWT)
+	if err != nil {
+		log.Errorf("headers.idtoken: %s", err)
+		return
+	}
+	SetIDTokenHeader(w, r, claims)
+}
@@ -0,0 +1,160 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// the JWE of `jwt.encrypt` in the compact serialization, with the key used directly for A256GCM
+// https://tools.ietf.org/html/rfc7516#section-7.1
+const (
+	jweAlg = "dir"
+	jweEnc = "A256GCM"
+	// jweKeyInfo binds the derived key to its use, it is never the same as the HMAC key signing the jwt
+	jweKeyInfo = "vouch-proxy jwe A256GCM"
+)
+
+var errJWE = errors.New("jwt.encrypt: invalid JWE")
+
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	// Cty JWT when the payload is the signed jwt itself, rather than its compressed form
+	Cty string `json:"cty,omitempty"`
+}
+
+// jweKey the 256 bit content encryption key, derived from `jwt.secret`
+func jweKey(c *cfg.Config) []byte {
+	return deriveKey(c, jweKeyInfo)
+}
+
+// DeriveKey a 256 bit key for the use named by info, HKDF-SHA256 of `jwt.secret` of the cfg.Instance of ctx
+// https://tools.ietf.org/html/rfc5869
+func DeriveKey(ctx context.Context, info string) []byte {
+	return deriveKey(cfg.FromContext(ctx), info)
+}
+
+func deriveKey(c *cfg.Config, info string) []byte {
+	// extract, with no salt
+	mac := hmac.New(sha256.New, make([]byte, sha256.Size))
+	mac.Write([]byte(c.JWT.Secret))
+	prk := mac.Sum(nil)
+	// expand, a single block is the length of the key
+	mac = hmac.New(sha256.New, prk)
+	mac.Write([]byte(info))
+	mac.Write([]byte{1})
+	return mac.Sum(nil)
+}
+
+func jweAEAD(c *cfg.Config) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(jweKey(c))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptJWE the signed (and perhaps compressed) token ss as a compact JWE
+func encryptJWE(c *cfg.Config, ss string) (string, error) {
+	h := jweHeader{Alg: jweAlg, Enc: jweEnc}
+	if !c.JWT.Compress {
+		h.Cty = "JWT"
+	}
+	aead, err := jweAEAD(c)
+	if err != nil {
+		return "", err
+	}
+	return sealJWE(aead, h, []byte(ss))
+}
+
+// sealJWE the payload as a compact JWE with the header h, encrypted by aead
+func sealJWE(aead cipher.AEAD, h jweHeader, payload []byte) (string, error) {
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	protected := base64.RawURLEncoding.EncodeToString(hb)
+	sealed := aead.Seal(nil, iv, payload, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+
+	// with `dir` the encrypted key is empty
+	return strings.Join([]string{
+		protected,
+		"",
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// decryptJWE the token within the compact JWE s, an error if it was not encrypted with `jwt.secret` or was altered
+func decryptJWE(c *cfg.Config, s string) (string, error) {
+	aead, err := jweAEAD(c)
+	if err != nil {
+		return "", err
+	}
+	ss, err := openJWE(aead, s)
+	if err != nil {
+		return "", err
+	}
+	return string(ss), nil
+}
+
+// openJWE the payload of the compact JWE s, which must have been sealed by aead
+func openJWE(aead cipher.AEAD, s string) ([]byte, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 5 || parts[1] != "" {
+		return nil, errJWE
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errJWE
+	}
+	var h jweHeader
+	if err := json.Unmarshal(hb, &h); err != nil || h.Alg != jweAlg || h.Enc != jweEnc {
+		return nil, errJWE
+	}
+	iv, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(iv) != aead.NonceSize() {
+		return nil, errJWE
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, errJWE
+	}
+	tag, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil || len(tag) != aead.Overhead() {
+		return nil, errJWE
+	}
+
+	payload, err := aead.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return nil, errJWE
+	}
+	return payload, nil
+}
@@ -0,0 +1,105 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// useJWE encrypt the jwt for the rest of the test
+func useJWE(t *testing.T, compress bool) {
+	secret, prevCompress := cfg.Cfg.JWT.Secret, cfg.Cfg.JWT.Compress
+	cfg.Cfg.JWT.Secret = "a-jwt-secret-of-at-least-32-characters"
+	cfg.Cfg.JWT.Compress = compress
+	cfg.Cfg.JWT.Encrypt = true
+	t.Cleanup(func() {
+		cfg.Cfg.JWT.Secret, cfg.Cfg.JWT.Compress = secret, prevCompress
+		cfg.Cfg.JWT.Encrypt = false
+	})
+}
+
+func TestNewVPJWTEncrypted(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		useJWE(t, compress)
+
+		uts, err := NewVPJWT(context.Background(), u1, customClaims, t1)
+		assert.NoError(t, err)
+		parts := strings.Split(uts, ".")
+		assert.Len(t, parts, 5)
+		assert.Empty(t, parts[1], "dir has no encrypted key")
+		assert.NotContains(t, uts, base64.RawURLEncoding.EncodeToString([]byte(u1.Username)))
+
+		hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+		assert.NoError(t, err)
+		if compress {
+			assert.Equal(t, `{"alg":"dir","enc":"A256GCM"}`, string(hb))
+		} else {
+			assert.Equal(t, `{"alg":"dir","enc":"A256GCM","cty":"JWT"}`, string(hb))
+		}
+
+		token, err := ParseTokenString(context.Background(), uts)
+		assert.NoError(t, err)
+		claims, err := PTokenClaims(token)
+		assert.NoError(t, err)
+		assert.Equal(t, u1.Username, claims.Username)
+	}
+}
+
+func TestParseTokenStringEncryptedTampered(t *testing.T) {
+	useJWE(t, false)
+	uts, err := NewVPJWT(context.Background(), u1, customClaims, t1)
+	assert.NoError(t, err)
+	parts := strings.Split(uts, ".")
+
+	ciphertext, _ := base64.RawURLEncoding.DecodeString(parts[3])
+	ciphertext[0] ^= 1
+	tampered := append([]string{}, parts...)
+	tampered[3] = base64.RawURLEncoding.EncodeToString(ciphertext)
+	header := append([]string{}, parts...)
+	header[0] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"dir","enc":"A256GCM"}`))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"ciphertext", strings.Join(tampered, ".")},
+		{"header", strings.Join(header, ".")},
+		{"signed only", mustSign(t)},
+		{"truncated", strings.Join(parts[:4], ".")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseTokenString(context.Background(), tt.token)
+			assert.Equal(t, errJWE, err)
+		})
+	}
+
+	// another secret derives another key
+	cfg.Cfg.JWT.Secret = "another-jwt-secret-of-at-least-32-characters"
+	_, err = ParseTokenString(context.Background(), uts)
+	assert.Equal(t, errJWE, err)
+}
+
+// mustSign a jwt which is signed but not encrypted
+func mustSign(t *testing.T) string {
+	cfg.Cfg.JWT.Encrypt = false
+	defer func() { cfg.Cfg.JWT.Encrypt = true }()
+	uts, err := NewVPJWT(context.Background(), u1, customClaims, t1)
+	assert.NoError(t, err)
+	return uts
+}
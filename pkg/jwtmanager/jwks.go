@@ -0,0 +1,100 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// JWK the public key which verifies the jwt and the assertions signed with an RS* or ES* `jwt.signing_method`
+// https://tools.ietf.org/html/rfc7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet the body of /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (s *state) jwksConfigure() {
+	if strings.HasPrefix(cfg.Cfg.JWT.SigningMethod, "HS") {
+		return
+	}
+	key, err := cfg.Cfg.DecryptionKey()
+	if err != nil {
+		log.Errorf("jwks: %s", err)
+		return
+	}
+	if s.publicJWK, err = newJWK(key, cfg.Cfg.JWT.SigningMethod); err != nil {
+		log.Errorf("jwks: %s", err)
+	}
+}
+
+// JWKS the public key of the cfg.Instance of ctx, false if the jwt is signed with a shared secret
+func JWKS(ctx context.Context) (JWKSet, bool) {
+	s := stateOf(ctx)
+	if s.publicJWK == nil {
+		return JWKSet{}, false
+	}
+	return JWKSet{Keys: []JWK{*s.publicJWK}}, true
+}
+
+// keyID the `kid` of the public key, sent in the header of each signed token so that verifiers can find it after a key rotation
+func (s *state) keyID() string {
+	if s.publicJWK == nil {
+		return ""
+	}
+	return s.publicJWK.Kid
+}
+
+func newJWK(key interface{}, alg string) (*JWK, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	var jwk *JWK
+	// the members of the thumbprint, in lexicographic order
+	// https://tools.ietf.org/html/rfc7638#section-3.2
+	var thumbprint string
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		jwk = &JWK{Kty: "RSA", N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())}
+		thumbprint = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, jwk.E, jwk.Kty, jwk.N)
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk = &JWK{Kty: "EC", Crv: k.Curve.Params().Name, X: b64(k.X.FillBytes(make([]byte, size))), Y: b64(k.Y.FillBytes(make([]byte, size)))}
+		thumbprint = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	default:
+		return nil, fmt.Errorf("unexpected public key %T", key)
+	}
+	sum := sha256.Sum256([]byte(thumbprint))
+	jwk.Kid = b64(sum[:])
+	jwk.Use = "sig"
+	jwk.Alg = alg
+	return jwk, nil
+}
@@ -0,0 +1,128 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// useKeyPair sign with a new key pair of signingMethod for the rest of the test
+func useKeyPair(t *testing.T, signingMethod string) {
+	privFile, pubFile, _ := writeKeyPair(t, signingMethod)
+
+	signing, secret := cfg.Cfg.JWT.SigningMethod, cfg.Cfg.JWT.Secret
+	cfg.Cfg.JWT.SigningMethod, cfg.Cfg.JWT.Secret = signingMethod, ""
+	cfg.Cfg.JWT.PrivateKeyFile, cfg.Cfg.JWT.PublicKeyFile = privFile, pubFile
+	Configure()
+	t.Cleanup(func() {
+		cfg.Cfg.JWT.SigningMethod, cfg.Cfg.JWT.Secret = signing, secret
+		cfg.Cfg.JWT.PrivateKeyFile, cfg.Cfg.JWT.PublicKeyFile = "", ""
+		Configure()
+	})
+}
+
+// writeKeyPair a new key pair of signingMethod as PEM files
+func writeKeyPair(t *testing.T, signingMethod string) (string, string, interface{}) {
+	var privDER []byte
+	var pub interface{}
+	switch signingMethod[:2] {
+	case "RS":
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+		privDER, pub = x509.MarshalPKCS1PrivateKey(priv), priv.Public()
+	case "ES":
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		privDER, err = x509.MarshalECPrivateKey(priv)
+		assert.NoError(t, err)
+		pub = priv.Public()
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	privFile, pubFile := filepath.Join(dir, "jwt.key"), filepath.Join(dir, "jwt.pub")
+	assert.NoError(t, ioutil.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600))
+	assert.NoError(t, ioutil.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0600))
+	return privFile, pubFile, pub
+}
+
+// publicKey the key as a verifier would build it from the JWK
+func publicKey(t *testing.T, jwk JWK) interface{} {
+	num := func(s string) *big.Int {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		assert.NoError(t, err)
+		return new(big.Int).SetBytes(b)
+	}
+	if jwk.Kty == "RSA" {
+		return &rsa.PublicKey{N: num(jwk.N), E: int(num(jwk.E).Int64())}
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: num(jwk.X), Y: num(jwk.Y)}
+}
+
+func TestJWKS(t *testing.T) {
+	_, ok := JWKS(context.Background())
+	assert.False(t, ok, "the secret of HS256 is never published")
+
+	for _, signingMethod := range []string{"RS256", "ES256"} {
+		t.Run(signingMethod, func(t *testing.T) {
+			useKeyPair(t, signingMethod)
+			jwks, ok := JWKS(context.Background())
+			assert.True(t, ok)
+			if !assert.Len(t, jwks.Keys, 1) {
+				return
+			}
+			jwk := jwks.Keys[0]
+			assert.Equal(t, "sig", jwk.Use)
+			assert.Equal(t, signingMethod, jwk.Alg)
+			assert.NotEmpty(t, jwk.Kid)
+
+			// a backend verifies the jwt with the key of its kid
+			uts, err := NewVPJWT(context.Background(), u1, customClaims, t1)
+			assert.NoError(t, err)
+			if cfg.Cfg.JWT.Compress {
+				uts = decodeAndDecompressTokenString(uts)
+			}
+			token, err := jwt.ParseWithClaims(uts, &VouchClaims{}, func(token *jwt.Token) (interface{}, error) {
+				assert.Equal(t, jwk.Kid, token.Header["kid"])
+				return publicKey(t, jwk), nil
+			})
+			if assert.NoError(t, err) {
+				assert.True(t, token.Valid)
+			}
+		})
+	}
+}
+
+func TestNewJWKThumbprint(t *testing.T) {
+	// the example of https://tools.ietf.org/html/rfc7638#section-3.1
+	n, _ := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	jwk, err := newJWK(&rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}, "RS256")
+	assert.NoError(t, err)
+	assert.Equal(t, "AQAB", jwk.E)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", jwk.Kid)
+}
@@ -11,31 +11,65 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package jwtmanager
 
 import (
+	"context"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	cache "github.com/patrickmn/go-cache"
 
+	"github.com/vouch/vouch-proxy/pkg/audit"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/forwarded"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
 	"github.com/vouch/vouch-proxy/pkg/responses"
 )
 
-// Cache in memory temporary store for responses from /validate for jwt
-var Cache *cache.Cache
+// Cache the in memory temporary store for responses from /validate for jwt of the cfg.Instance of ctx
+func Cache(ctx context.Context) *cache.Cache {
+	return stateOf(ctx).cache
+}
+
+// now is swapped out by tests
+var now = time.Now
 
-func cacheConfigure() {
+func (s *state) cacheConfigure() {
 
 	var expire int = 20 // default 20 minutes
 
 	if cfg.Cfg.JWT.MaxAge < expire {
 		expire = cfg.Cfg.JWT.MaxAge
 	}
+	// a cached response would hide refreshed group memberships
+	if cfg.Cfg.Groups.RefreshInterval > 0 && cfg.Cfg.Groups.RefreshInterval < expire {
+		expire = cfg.Cfg.Groups.RefreshInterval
+	}
 	dExp := time.Duration(expire) * time.Minute
+	// a response cached before the JWT came within the rolling window would hide it until expiry
+	if cfg.Cfg.JWT.Rolling.Enabled && cfg.Cfg.JWT.Rolling.Window > 0 {
+		if half := time.Duration(cfg.Cfg.JWT.Rolling.Window) * time.Minute / 2; half < dExp {
+			dExp = half
+		}
+	}
+	// as it would the JWT coming within the refresh window
+	for _, provider := range cfg.OAuthConfigs {
+		if provider.UseRefreshTokens && provider.RefreshWindow > 0 {
+			if half := time.Duration(provider.RefreshWindow) * time.Minute / 2; half < dExp {
+				dExp = half
+			}
+		}
+	}
+	// a response served from the cache neither checks nor updates the session's last_seen, see handlers.touchSession
+	// so it's cached no longer than last_seen is left stale, and the session idles out within that of `jwt.idle_timeout`
+	if cfg.Cfg.JWT.IdleTimeout > 0 {
+		if touch := time.Duration(cfg.Cfg.JWT.IdleTimeout) * time.Minute / 10; touch < dExp {
+			dExp = touch
+		}
+	}
 	purgeCheck := dExp / 5
 	// log.Debugf("cacheConfigure expire %d dExp %d purgecheck %d", expire, dExp, purgeCheck)
-	Cache = cache.New(dExp, purgeCheck)
-	log.Infof("jwtcache: the returned headers for a valid jwt will be cached for %d minutes", expire)
+	s.cache = cache.New(dExp, purgeCheck)
+	log.Infof("jwtcache: the returned headers for a valid jwt will be cached for %s", dExp)
 }
 
 // CachedResponse caches the JWT response
@@ -55,19 +89,49 @@ func JWTCacheHandler(next http.Handler) http.Handler {
 		// wrap ResponseWriter
 		// v := CachedResponse{CaptureWriter: &CaptureWriter{ResponseWriter: w}}
 
+		c, s := cfg.FromContext(r.Context()), stateOf(r.Context())
 		jwt := FindJWT(r)
 		// check to see if we have headers cached for this jwt
 		if jwt != "" {
-			if resp, found := Cache.Get(jwt); found {
+			if resp, found := s.cache.Get(cacheKey(r, jwt)); found {
 				// found it in cache!
 				logger.Debug("/validate found response headers for jwt in cache")
+				cached := resp.(http.Header)
+				// the user's sessions may have been revoked since, /validate decides whether this one was
+				if s.userRevokedAt(c, cached.Get(c.Headers.User)) != 0 {
+					next.ServeHTTP(w, r)
+					return
+				}
+				// as may the host's `access_hours` have closed, the key is the same for every host
+				if !c.AccessHoursAllow(forwarded.Host(r), now()) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				auditCached(r, cached)
+				if c.ConditionalValidate.Enabled {
+					if fingerprint := cached.Get(c.ConditionalValidate.Header); SessionUnchanged(r, fingerprint) {
+						metrics.ValidateRequest(metrics.ValidateOK)
+						SendSessionUnchanged(w, r, cached.Get(c.Headers.User), fingerprint)
+						return
+					}
+				}
 				// TODO: instead of the copy for each, can we just append the whole blob?
 				// or better still can we just cache the entire response including 200OK?
-				for k, v := range resp.(http.Header) {
-					w.Header().Add(k, strings.Join(v, ","))
-
+				// a header may be repeated, such as for each group with `groups.header_style: repeated`
+				for k, v := range cached {
+					for _, vv := range v {
+						w.Header().Add(k, vv)
+					}
+				}
+				// the assertion is bound to each request
+				if c.Headers.Assertion != "" {
+					cachedAssertion(w, r, jwt)
+				}
+				if c.Headers.IDToken != "" {
+					cachedIDToken(w, r, jwt)
 				}
 
+				metrics.ValidateRequest(metrics.ValidateOK)
 				responses.OK200(w, r)
 
 				return
@@ -82,7 +146,72 @@ func JWTCacheHandler(next http.Handler) http.Handler {
 			// r.Context().Done() is still open
 			// cache the response headers for this jwt
 			// log.Debug("setting cache for %+v", w.Header().Clone())
-			Cache.SetDefault(jwt, w.Header().Clone())
+			h := w.Header().Clone()
+			if c.Headers.Assertion != "" {
+				h.Del(c.Headers.Assertion)
+			}
+			if c.Headers.IDToken != "" {
+				h.Del(c.Headers.IDToken)
+			}
+			// set for the Origin of each request by handlers.CORSHandler
+			for _, k := range []string{"Vary", "Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Access-Control-Expose-Headers"} {
+				h.Del(k)
+			}
+			s.cache.SetDefault(cacheKey(r, jwt), h)
 		}
 	})
 }
+
+// stepUpKeyPrefix of the responses cached for a host of `vouch.step_up_hosts`
+const stepUpKeyPrefix = "stepup:"
+
+// cacheKey the jwt or, with `vouch.policies`, the jwt and the policy covering the requested host
+// since the user may be allowed by one policy and not by another
+// an `/_external-auth-{id}` request with an entry of `vouch.external_auth` is cached apart by its id as well
+// as is a request for a host of `vouch.step_up_hosts`
+func cacheKey(r *http.Request, jwt string) string {
+	c := cfg.FromContext(r.Context())
+	key := jwt
+	if len(c.Policies) > 0 {
+		i, _ := c.PolicyFor(forwarded.Host(r))
+		key = strconv.Itoa(i) + ":" + jwt
+	}
+	// a jwt which isn't stepped up is refused by `vouch.step_up_hosts` but not by other hosts
+	if c.StepUpRequired(forwarded.Host(r)) {
+		key = stepUpKeyPrefix + key
+	}
+	if id, ea := c.ExternalAuthFor(r); ea != nil {
+		key = id + "/" + key
+	}
+	return key
+}
+
+// forgetJWT delete the responses cached for jwt, for any policy, external_auth id and step-up host
+func (s *state) forgetJWT(c *cfg.Config, jwt string) {
+	prefixes := []string{""}
+	for id := range c.ExternalAuth {
+		prefixes = append(prefixes, id+"/")
+	}
+	for _, prefix := range prefixes {
+		for _, stepUp := range []string{"", stepUpKeyPrefix} {
+			s.cache.Delete(prefix + stepUp + jwt)
+			for i := -1; i < len(c.Policies); i++ {
+				s.cache.Delete(prefix + stepUp + strconv.Itoa(i) + ":" + jwt)
+			}
+		}
+	}
+}
+
+// auditCached record the decision of /validate answered from the cache with `audit.validate`, see handlers.auditValidate
+func auditCached(r *http.Request, cached http.Header) {
+	c := cfg.FromContext(r.Context())
+	if !c.Audit.Validate {
+		return
+	}
+	audit.Authorization(r, audit.Decision{
+		User:    cached.Get(c.Headers.User),
+		Rule:    audit.RuleJWT,
+		URL:     forwarded.URL(r),
+		Allowed: true,
+	})
+}
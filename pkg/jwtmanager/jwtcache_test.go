@@ -0,0 +1,76 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// a response cached while a host's access_hours were open, or for another host, isn't served once they've closed
+func TestJWTCacheHandlerAccessHours(t *testing.T) {
+	rootDir := os.Getenv(cfg.Branding.UCName + "_ROOT")
+	os.Setenv(cfg.Branding.UCName+"_CONFIG", filepath.Join(rootDir, "config/testing/handler_access_hours.yml"))
+	defer func() {
+		os.Unsetenv(cfg.Branding.UCName + "_CONFIG")
+		cfg.InitForTestPurposes()
+		Configure()
+		now = time.Now
+	}()
+	cfg.InitForTestPurposes()
+	Configure()
+
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	vpjwt, err := NewVPJWT(context.Background(), structs.User{Username: "testuser"}, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+
+	// stands in for handlers.ValidateRequestHandler, which refuses a closed host
+	validated := 0
+	h := JWTCacheHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		validated++
+		if !cfg.Cfg.AccessHoursAllow(r.Host, now()) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	validate := func(host string, at time.Time) int {
+		now = func() time.Time { return at }
+		req := httptest.NewRequest("GET", "/validate", nil)
+		req.Host = host
+		req.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: vpjwt})
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	noon := time.Date(2021, 3, 1, 12, 0, 0, 0, ny)
+	night := time.Date(2021, 3, 1, 3, 0, 0, 0, ny)
+	assert.Equal(t, http.StatusOK, validate("restricted.example.com", noon))
+	assert.Equal(t, http.StatusOK, validate("restricted.example.com", noon))
+	assert.Equal(t, 1, validated, "answered from the cache while open")
+
+	assert.Equal(t, http.StatusForbidden, validate("restricted.example.com", night))
+	assert.Equal(t, http.StatusOK, validate("open.example.com", night))
+	assert.Equal(t, http.StatusForbidden, validate("restricted.example.com", night), "not the response cached for the open host")
+	assert.Equal(t, 3, validated)
+}
@@ -13,15 +13,18 @@ package jwtmanager
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	cache "github.com/patrickmn/go-cache"
 	"go.uber.org/zap"
 
 	"github.com/vouch/vouch-proxy/pkg/cfg"
@@ -29,7 +32,10 @@ import (
 	"github.com/vouch/vouch-proxy/pkg/structs"
 )
 
-const comma = ","
+const (
+	comma    = ","
+	redacted = "[redacted]"
+)
 
 // VouchClaims jwt Claims specific to vouch
 type VouchClaims struct {
@@ -37,26 +43,104 @@ type VouchClaims struct {
 	CustomClaims map[string]interface{}
 	PAccessToken string
 	PIdToken     string
+	// PRefreshToken the provider's refresh token, kept with `oauth.use_refresh_tokens`
+	PRefreshToken string `json:",omitempty"`
+	// Teams the user's team memberships, kept for the teamWhitelist of `vouch.policies`
+	Teams []string `json:",omitempty"`
+	// Provider the name of the oauth provider the user logged in with, see cfg.OAuthFor()
+	Provider string `json:"provider,omitempty"`
+	// LastSeen when the session was last used at /validate, kept with `jwt.idle_timeout`
+	LastSeen int64 `json:"last_seen,omitempty"`
+	// StepUp when the user confirmed with a passkey at /stepup, required by `vouch.step_up_hosts`
+	StepUp int64 `json:"step_up,omitempty"`
 	jwt.StandardClaims
 }
 
-// StandardClaims jwt.StandardClaims implementation
-var StandardClaims jwt.StandardClaims
+// String the claims for the debug log, without the provider's tokens
+func (c VouchClaims) String() string {
+	type claims VouchClaims
+	if c.PAccessToken != "" {
+		c.PAccessToken = redacted
+	}
+	if c.PIdToken != "" {
+		c.PIdToken = redacted
+	}
+	if c.PRefreshToken != "" {
+		c.PRefreshToken = redacted
+	}
+	return fmt.Sprintf("%+v", claims(c))
+}
 
 var logger *zap.Logger
 var log *zap.SugaredLogger
-var aud string
+
+// state what the package derives from the configuration of a cfg.Instance
+type state struct {
+	aud            string
+	standardClaims jwt.StandardClaims
+
+	// cache in memory temporary store for responses from /validate for jwt, see cacheConfigure()
+	cache *cache.Cache
+
+	// revokedSIDs the IdP session ids (see `session.sid_claim`) ended by back-channel logout
+	// kept for as long as a JWT carrying them could still be valid
+	revokedSIDs *cache.Cache
+	// sidJWTs the JWTs seen at /validate for each sid, so that their cached responses can be purged
+	sidJWTs *cache.Cache
+	sidMu   sync.Mutex
+	// revocations the `revocation_store`, nil unless it's configured
+	revocations RevocationStore
+	// userRevocations the time each user's sessions were revoked, 0 for none, as last looked up in revocations
+	userRevocations *cache.Cache
+
+	assertionKey interface{}
+	// audienceSigners by lowercased audience
+	audienceSigners map[string]*audienceSigner
+	// assertionClaims for the jwts seen at /validate, so that JWTCacheHandler can sign a fresh assertion for each request
+	assertionClaims *cache.Cache
+
+	// publicJWK nil with an HS* `jwt.signing_method`, whose secret is never published
+	publicJWK *JWK
+}
+
+type stateKey struct{}
+
+// std the state of the package configuration, for a request without a cfg.Instance
+var std = &state{}
+
+// stateOf the state of the cfg.Instance of ctx, otherwise std
+func stateOf(ctx context.Context) *state {
+	if s, ok := cfg.State(ctx, stateKey{}).(*state); ok {
+		return s
+	}
+	return std
+}
 
 // Configure see main.go configure()
 func Configure() {
 	log = cfg.Logging.Logger
 	logger = cfg.Logging.FastLogger
-	cacheConfigure()
-	aud = audience()
-	StandardClaims = jwt.StandardClaims{
+	std = newState()
+}
+
+// ConfigureInstance the keys and caches of inst, see cfg.NewInstance()
+func ConfigureInstance(inst *cfg.Instance) {
+	log = cfg.Logging.Logger
+	logger = cfg.Logging.FastLogger
+	inst.SetState(stateKey{}, newState())
+}
+
+func newState() *state {
+	s := &state{aud: audience()}
+	s.standardClaims = jwt.StandardClaims{
 		Issuer:   cfg.Cfg.JWT.Issuer,
-		Audience: aud,
+		Audience: s.aud,
 	}
+	s.cacheConfigure()
+	s.revokeConfigure()
+	s.assertionConfigure()
+	s.jwksConfigure()
+	return s
 }
 
 // `aud` of the issued JWT https://tools.ietf.org/html/rfc7519#section-4.1.3
@@ -75,36 +159,95 @@ func audience() string {
 }
 
 
-// NewVPJWT issue a signed Vouch Proxy JWT for a user
-func NewVPJWT(u structs.User, customClaims structs.CustomClaims, ptokens structs.PTokens) (string, error) {
+// NewVPJWT issue a signed Vouch Proxy JWT for a user, per the configuration of the cfg.Instance of ctx
+func NewVPJWT(ctx context.Context, u structs.User, customClaims structs.CustomClaims, ptokens structs.PTokens) (string, error) {
+	c, s := cfg.FromContext(ctx), stateOf(ctx)
 	// User`token`
 	// u.PrepareUserData()
 	claims := VouchClaims{
-		u.Username,
-		customClaims.Claims,
-		ptokens.PAccessToken,
-		ptokens.PIdToken,
-		StandardClaims,
+		Username:       u.Username,
+		CustomClaims:   withTokenClaims(c, u, customClaims.Claims),
+		PAccessToken:   ptokens.PAccessToken,
+		PIdToken:       ptokens.PIdToken,
+		PRefreshToken:  ptokens.PRefreshToken,
+		Provider:       u.Provider,
+		StandardClaims: s.standardClaims,
 	}
 
-	claims.Audience = aud
-	claims.ExpiresAt = time.Now().Add(time.Minute * time.Duration(cfg.Cfg.JWT.MaxAge)).Unix()
+	if c.PoliciesUseTeams() {
+		claims.Teams = u.TeamMemberships
+	}
+
+	claims.Audience = s.aud
+	claims.IssuedAt = time.Now().Unix()
+	claims.ExpiresAt = ExpiresAt(ctx, ptokens)
+	if c.JWT.IdleTimeout > 0 {
+		claims.LastSeen = claims.IssuedAt
+	}
 
 	// https://github.com/vouch/vouch-proxy/issues/287
-	if cfg.Cfg.Headers.AccessToken == "" {
+	// the access token is also kept to refresh group memberships
+	if c.Headers.AccessToken == "" && c.Groups.RefreshInterval == 0 {
 		claims.PAccessToken = ""
 	}
 
-	if cfg.Cfg.Headers.IDToken == "" {
+	// and the id token is the id_token_hint at the provider's end_session_endpoint on /logout
+	if c.Headers.IDToken == "" && cfg.OAuthFor(ctx, u.Provider).LogoutURL == "" {
 		claims.PIdToken = ""
 	}
 
+	return signVPJWT(ctx, claims)
+}
+
+// ExpiresAt the expiry of a jwt issued now, `jwt.maxAge` from now
+// or with a refresh token (see `oauth.use_refresh_tokens`) the expiry of the provider's access token if that's sooner
+func ExpiresAt(ctx context.Context, ptokens structs.PTokens) int64 {
+	exp := time.Now().Add(time.Minute * time.Duration(cfg.FromContext(ctx).JWT.MaxAge))
+	if ptokens.PRefreshToken != "" && !ptokens.PExpiry.IsZero() && ptokens.PExpiry.Before(exp) {
+		exp = ptokens.PExpiry
+	}
+	return exp.Unix()
+}
+
+// withTokenClaims a copy of the claims with each of `vouch.token_claims`, which take precedence over the IdP's claims
+// a claim whose template can't be executed for the user (such as one referencing a claim they don't have) is left out
+func withTokenClaims(c *cfg.Config, u structs.User, customClaims map[string]interface{}) map[string]interface{} {
+	if len(c.TokenClaims) == 0 {
+		return customClaims
+	}
+	claims := make(map[string]interface{}, len(customClaims)+len(c.TokenClaims))
+	for k, v := range customClaims {
+		claims[k] = v
+	}
+	data := cfg.TokenClaimData{Username: u.Username, Name: u.Name, Email: u.Email, Claims: customClaims}
+	for _, t := range c.TokenClaims {
+		v, err := t.Execute(data)
+		if err != nil {
+			log.Warnf("token_claims %s for user %s: %s", t.Claim, u.Username, err)
+			continue
+		}
+		claims[t.Claim] = v
+	}
+	return claims
+}
+
+// ReissueVPJWT sign updated claims, such as refreshed group memberships, as a new Vouch Proxy JWT
+// the expiry is left as it is, so the JWT still expires when the original did unless the caller extends it, see `jwt.rolling`
+func ReissueVPJWT(ctx context.Context, claims VouchClaims) (string, error) {
+	return signVPJWT(ctx, claims)
+}
+
+func signVPJWT(ctx context.Context, claims VouchClaims) (string, error) {
+	c := cfg.FromContext(ctx)
 	// https://godoc.org/github.com/dgrijalva/jwt-go#NewWithClaims
-	token := jwt.NewWithClaims(jwt.GetSigningMethod(cfg.Cfg.JWT.SigningMethod), claims)
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(c.JWT.SigningMethod), claims)
+	if kid := stateOf(ctx).keyID(); kid != "" {
+		token.Header["kid"] = kid
+	}
 	// log.Debugf("token: %v", token)
 	log.Debugf("token created, expires: %d diff from now: %d", claims.StandardClaims.ExpiresAt, claims.StandardClaims.ExpiresAt-time.Now().Unix())
 
-	key, err := cfg.SigningKey()
+	key, err := c.SigningKey()
 	if err != nil {
 		log.Errorf("%s", err)
 	}
@@ -113,20 +256,26 @@ func NewVPJWT(u structs.User, customClaims structs.CustomClaims, ptokens structs
 	if ss == "" || err != nil {
 		return "", fmt.Errorf("New JWT: signed token error: %s", err)
 	}
-	if cfg.Cfg.JWT.Compress {
+	if c.JWT.Compress {
 		ss, err = compressAndEncodeTokenString(ss)
 		if ss == "" || err != nil {
 			return "", fmt.Errorf("New JWT: compressed token error: %w", err)
 		}
 	}
+	if c.JWT.Encrypt {
+		ss, err = encryptJWE(c, ss)
+		if err != nil {
+			return "", fmt.Errorf("New JWT: encrypted token error: %w", err)
+		}
+	}
 	return ss, nil
 }
 
 // SiteInToken searches does the token contain the site?
-func SiteInToken(site string, token *jwt.Token) bool {
+func SiteInToken(ctx context.Context, site string, token *jwt.Token) bool {
 	if claims, ok := token.Claims.(*VouchClaims); ok {
 		log.Debugf("site %s claim %v", site, claims)
-		if claims.SiteInAudience(site) {
+		if claims.SiteInAudience(ctx, site) {
 			return true
 		}
 	}
@@ -134,22 +283,30 @@ func SiteInToken(site string, token *jwt.Token) bool {
 	return false
 }
 
-// ParseTokenString converts signed token to jwt struct
-func ParseTokenString(tokenString string) (*jwt.Token, error) {
+// ParseTokenString converts signed token to jwt struct, verified with the key of the cfg.Instance of ctx
+func ParseTokenString(ctx context.Context, tokenString string) (*jwt.Token, error) {
+	c := cfg.FromContext(ctx)
 	log.Debugf("tokenString length: %d", len(tokenString))
-	if cfg.Cfg.JWT.Compress {
+	if c.JWT.Encrypt {
+		ss, err := decryptJWE(c, tokenString)
+		if err != nil {
+			return nil, err
+		}
+		tokenString = ss
+	}
+	if c.JWT.Compress {
 		tokenString = decodeAndDecompressTokenString(tokenString)
 		log.Debugf("decompressed tokenString length %d", len(tokenString))
 	}
 
-	key, err := cfg.DecryptionKey()
+	key, err := c.DecryptionKey()
 	if err != nil {
 		log.Errorf("%s", err)
 	}
 
 	return jwt.ParseWithClaims(tokenString, &VouchClaims{}, func(token *jwt.Token) (interface{}, error) {
 		// return jwt.ParseWithClaims(tokenString, &VouchClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if token.Method != jwt.GetSigningMethod(cfg.Cfg.JWT.SigningMethod) {
+		if token.Method != jwt.GetSigningMethod(c.JWT.SigningMethod) {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
 
@@ -158,9 +315,9 @@ func ParseTokenString(tokenString string) (*jwt.Token, error) {
 
 }
 
-// SiteInAudience does the claim contain the value?
-func (claims *VouchClaims) SiteInAudience(site string) bool {
-	for _, s := range strings.Split(aud, comma) {
+// SiteInAudience does the claim contain the value? per the audience of the cfg.Instance of ctx
+func (claims *VouchClaims) SiteInAudience(ctx context.Context, site string) bool {
+	for _, s := range strings.Split(stateOf(ctx).aud, comma) {
 		if strings.Contains(site, s) {
 			log.Debugf("site %s is found for claims.Audience %s", site, s)
 			return true
@@ -217,7 +374,7 @@ func compressAndEncodeTokenString(ss string) (string, error) {
 	return ret, nil
 }
 
-// FindJWT look for JWT in Cookie, JWT Header, Authorization Header (OAuth2 Bearer Token)
+// FindJWT look for JWT in Cookie, JWT Header, Authorization Header (OAuth2 Bearer Token, with `headers.accept_bearer`)
 // and Query String in that order
 func FindJWT(r *http.Request) string {
 	jwt, err := cookie.Cookie(r)
@@ -225,33 +382,34 @@ func FindJWT(r *http.Request) string {
 		logger.Debug("jwt found in cookie")
 		return jwt
 	}
-	jwt = r.Header.Get(cfg.Cfg.Headers.JWT)
+	c := cfg.FromContext(r.Context())
+	jwt = r.Header.Get(c.Headers.JWT)
 	if jwt != "" {
-		log.Debugf("jwt from header %s: %s", cfg.Cfg.Headers.JWT, jwt)
+		log.Debugf("jwt from header %s: %s", c.Headers.JWT, jwt)
 		return jwt
 	}
-	auth := r.Header.Get("Authorization")
-	if auth != "" {
-		s := strings.SplitN(auth, " ", 2)
-		if len(s) == 2 {
-			jwt = s[1]
+	if c.Headers.AcceptBearer {
+		// https://tools.ietf.org/html/rfc6750#section-2.1 the scheme is case insensitive
+		s := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+		if len(s) == 2 && strings.EqualFold(s[0], "Bearer") && s[1] != "" {
+			jwt = strings.TrimSpace(s[1])
 			log.Debugf("jwt from authorization header: %s", jwt)
 			return jwt
 		}
 	}
-	jwt = r.URL.Query().Get(cfg.Cfg.Headers.QueryString)
+	jwt = r.URL.Query().Get(c.Headers.QueryString)
 	if jwt != "" {
-		log.Debugf("jwt from querystring %s: %s", cfg.Cfg.Headers.QueryString, jwt)
+		log.Debugf("jwt from querystring %s: %s", c.Headers.QueryString, jwt)
 		return jwt
 	}
 	return ""
 }
 
-// ClaimsFromJWT parse the jwt and return the claims
-func ClaimsFromJWT(jwt string) (*VouchClaims, error) {
+// ClaimsFromJWT parse the jwt and return the claims, see ParseTokenString()
+func ClaimsFromJWT(ctx context.Context, jwt string) (*VouchClaims, error) {
 	var claims *VouchClaims
 
-	jwtParsed, err := ParseTokenString(jwt)
+	jwtParsed, err := ParseTokenString(ctx, jwt)
 	if err != nil {
 		return nil, err
 	}
@@ -11,12 +11,21 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package jwtmanager
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
 
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/redis"
 	"github.com/vouch/vouch-proxy/pkg/structs"
 
 	"github.com/stretchr/testify/assert"
@@ -53,7 +62,12 @@ func init() {
 		customClaims.Claims,
 		t1.PAccessToken,
 		t1.PIdToken,
-		StandardClaims,
+		"",
+		nil,
+		"",
+		0,
+		0,
+		std.standardClaims,
 	}
 
 }
@@ -71,21 +85,21 @@ func TestClaimsHMAC(t *testing.T) {
 		assert.NotEmpty(t, cfg.Cfg.JWT.SigningMethod)
 		assert.NotEmpty(t, cfg.Cfg.JWT.MaxAge)
 
-		uts, err := NewVPJWT(u1, customClaims, t1)
+		uts, err := NewVPJWT(context.Background(), u1, customClaims, t1)
 		assert.NoError(t, err)
 
-		utsParsed, err := ParseTokenString(uts)
+		utsParsed, err := ParseTokenString(context.Background(), uts)
 		assert.NoError(t, err)
 
 		log.Infof("utsParsed: %+v", utsParsed)
 		// log.Infof("Sites: %+v", Sites)
-		assert.True(t, SiteInToken(cfg.Cfg.Domains[0], utsParsed))
+		assert.True(t, SiteInToken(context.Background(), cfg.Cfg.Domains[0], utsParsed))
 	}
 	json.Unmarshal([]byte(claimjson), &customClaims.Claims)
 }
 
 func TestClaims(t *testing.T) {
-	aud = audience()
+	std.aud = audience()
 	log.Debugf("jwt config %s %d", string(cfg.Cfg.JWT.Secret), cfg.Cfg.JWT.MaxAge)
 	assert.NotEmpty(t, cfg.Cfg.JWT.Secret)
 	assert.NotEmpty(t, cfg.Cfg.JWT.MaxAge)
@@ -95,10 +109,195 @@ func TestClaims(t *testing.T) {
 	// log.Infof("lc d %s", d.String())
 	// lc.StandardClaims.ExpiresAt = now.Add(time.Duration(ExpiresAtMinutes) * time.Minute).Unix()
 	// log.Infof("lc expiresAt %d", now.Unix()-lc.StandardClaims.ExpiresAt)
-	uts, err := NewVPJWT(u1, customClaims, t1)
+	uts, err := NewVPJWT(context.Background(), u1, customClaims, t1)
 	assert.NoError(t, err)
-	utsParsed, _ := ParseTokenString(uts)
+	utsParsed, _ := ParseTokenString(context.Background(), uts)
 	log.Infof("utsParsed: %+v", utsParsed)
-	log.Infof("Audience: %+v", aud)
-	assert.True(t, SiteInToken(cfg.Cfg.Domains[0], utsParsed))
+	log.Infof("Audience: %+v", std.aud)
+	assert.True(t, SiteInToken(context.Background(), cfg.Cfg.Domains[0], utsParsed))
+}
+
+func TestNewVPJWTTokenClaims(t *testing.T) {
+	os.Unsetenv(cfg.Branding.UCName + "_CONFIG")
+	cfg.InitForTestPurposes()
+	Configure()
+	defer func() { cfg.Cfg.TokenClaims = nil }()
+	cfg.Cfg.TokenClaims = []cfg.TokenClaim{
+		{Claim: "environment", Value: "staging"},
+		{Claim: "policy_version", Value: "2021-03"},
+		{Claim: "principal", Value: "{{.Username}} <{{.Email}}>"},
+		{Claim: "department", Value: "dept-{{.Claims.department}}"},
+		{Claim: "groups", Value: "overridden"},
+	}
+	assert.NoError(t, cfg.ValidateConfiguration())
+
+	tests := []struct {
+		name       string
+		idpClaims  map[string]interface{}
+		department interface{}
+	}{
+		{"with department", map[string]interface{}{"department": "eng", "groups": []interface{}{"a"}}, "dept-eng"},
+		// a template referencing a claim the user doesn't have leaves the claim out
+		{"without department", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := structs.User{Username: "testuser", Email: "test@example.com"}
+			uts, err := NewVPJWT(context.Background(), u, structs.CustomClaims{Claims: tt.idpClaims}, structs.PTokens{})
+			assert.NoError(t, err)
+			claims, err := ClaimsFromJWT(context.Background(), uts)
+			assert.NoError(t, err)
+
+			assert.Equal(t, "staging", claims.CustomClaims["environment"])
+			assert.Equal(t, "2021-03", claims.CustomClaims["policy_version"])
+			assert.Equal(t, "testuser <test@example.com>", claims.CustomClaims["principal"])
+			assert.Equal(t, tt.department, claims.CustomClaims["department"])
+			assert.Equal(t, "overridden", claims.CustomClaims["groups"])
+		})
+	}
+}
+
+func TestNewVPJWTProvider(t *testing.T) {
+	os.Unsetenv(cfg.Branding.UCName + "_CONFIG")
+	cfg.InitForTestPurposes()
+	Configure()
+
+	u := structs.User{Username: "testuser", Email: "test@example.com", Provider: "github"}
+	uts, err := NewVPJWT(context.Background(), u, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+	claims, err := ClaimsFromJWT(context.Background(), uts)
+	assert.NoError(t, err)
+	assert.Equal(t, "github", claims.Provider)
+}
+
+func TestVouchClaimsStringRedactsTokens(t *testing.T) {
+	s := lc.String()
+	assert.Contains(t, s, u1.Username)
+	assert.NotContains(t, s, t1.PIdToken)
+	assert.NotContains(t, s, t1.PAccessToken)
+	// the claims themselves are untouched
+	assert.Equal(t, t1.PIdToken, lc.PIdToken)
+
+	withRefresh := lc
+	withRefresh.PRefreshToken = "refreshtoken"
+	assert.NotContains(t, withRefresh.String(), "refreshtoken")
+}
+
+func TestExpiresAt(t *testing.T) {
+	maxAge := time.Now().Add(time.Duration(cfg.Cfg.JWT.MaxAge) * time.Minute).Unix()
+	soon := time.Now().Add(10 * time.Minute)
+	later := time.Now().Add(time.Duration(cfg.Cfg.JWT.MaxAge+10) * time.Minute)
+
+	tests := []struct {
+		name    string
+		ptokens structs.PTokens
+		want    int64
+	}{
+		{"no refresh token", structs.PTokens{PExpiry: soon}, maxAge},
+		{"no expiry", structs.PTokens{PRefreshToken: "r"}, maxAge},
+		{"access token expires sooner", structs.PTokens{PRefreshToken: "r", PExpiry: soon}, soon.Unix()},
+		{"access token expires later", structs.PTokens{PRefreshToken: "r", PExpiry: later}, maxAge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.want, ExpiresAt(context.Background(), tt.ptokens), 1)
+		})
+	}
+}
+
+// memRevocations stands in for Redis
+type memRevocations struct {
+	data map[string][]byte
+	err  error
+	gets int
+}
+
+func (m *memRevocations) Get(key string) ([]byte, error) {
+	m.gets++
+	if m.err != nil {
+		return nil, m.err
+	}
+	v, ok := m.data[key]
+	if !ok {
+		return nil, redis.ErrNil
+	}
+	return v, nil
+}
+
+func (m *memRevocations) Set(key string, value []byte, ttl time.Duration) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.data[key] = value
+	return nil
+}
+
+func TestIsUserRevoked(t *testing.T) {
+	Configure()
+	defer func() { std.revocations = nil }()
+
+	_, err := RevokeUser(context.Background(), u1.Username)
+	assert.True(t, errors.Is(err, ErrRevocationUnsupported))
+
+	store := &memRevocations{data: map[string][]byte{}}
+	std.revocations = store
+	now := time.Now().Unix()
+	claims := func(iat int64) *VouchClaims {
+		return &VouchClaims{Username: u1.Username, StandardClaims: jwt.StandardClaims{IssuedAt: iat}}
+	}
+	assert.False(t, IsUserRevoked(context.Background(), claims(now-60)))
+
+	// revoked at another instance, which is seen here once the lookup expires
+	store.data[revocationKey(cfg.Cfg, u1.Username)] = []byte(strconv.FormatInt(now-30, 10))
+	assert.False(t, IsUserRevoked(context.Background(), claims(now-60)))
+	assert.Equal(t, 1, store.gets)
+	std.userRevocations.Flush()
+	assert.True(t, IsUserRevoked(context.Background(), claims(now-60)))
+	assert.True(t, IsUserRevoked(context.Background(), claims(now-30)), "issued in the same second")
+	assert.False(t, IsUserRevoked(context.Background(), claims(now-29)), "logged in again since")
+	assert.Equal(t, 2, store.gets)
+
+	// the store can't be reached
+	std.userRevocations.Flush()
+	store.err = errors.New("connection refused")
+	assert.False(t, IsUserRevoked(context.Background(), claims(now-60)))
+	_, err = RevokeUser(context.Background(), u1.Username)
+	assert.Error(t, err)
+
+	store.err = nil
+	at, err := RevokeUser(context.Background(), u1.Username)
+	assert.NoError(t, err)
+	assert.True(t, IsUserRevoked(context.Background(), claims(at.Unix())))
+	assert.False(t, IsUserRevoked(context.Background(), &VouchClaims{Username: "someone@testing.com"}))
+}
+
+func TestFindJWTBearer(t *testing.T) {
+	defer func(accept bool) { cfg.Cfg.Headers.AcceptBearer = accept }(cfg.Cfg.Headers.AcceptBearer)
+
+	tests := []struct {
+		name         string
+		acceptBearer bool
+		cookie       string
+		auth         string
+		want         string
+	}{
+		{"bearer", true, "", "Bearer abc.def.ghi", "abc.def.ghi"},
+		{"scheme is case insensitive", true, "", "bearer abc.def.ghi", "abc.def.ghi"},
+		{"cookie first", true, "cookie.jwt.value", "Bearer abc.def.ghi", "cookie.jwt.value"},
+		{"another scheme", true, "", "Basic dXNlcjpwYXNz", ""},
+		{"no token", true, "", "Bearer ", ""},
+		{"not accepted", false, "", "Bearer abc.def.ghi", ""},
+		{"cookie when not accepted", false, "cookie.jwt.value", "Bearer abc.def.ghi", "cookie.jwt.value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Cfg.Headers.AcceptBearer = tt.acceptBearer
+			r := httptest.NewRequest("GET", "/validate", nil)
+			r.Header.Set("Authorization", tt.auth)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: tt.cookie})
+			}
+			assert.Equal(t, tt.want, FindJWT(r))
+		})
+	}
 }
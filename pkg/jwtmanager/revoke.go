@@ -0,0 +1,172 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package jwtmanager
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/redis"
+)
+
+// revocationLookupTTL a user's revocation is looked up in the RevocationStore at most this often by each instance
+// so a revocation made at another instance takes effect here within it
+const revocationLookupTTL = 10 * time.Second
+
+// ErrRevocationUnsupported a user's sessions can only be revoked with a `revocation_store` shared by every instance
+var ErrRevocationUnsupported = errors.New("revoking a user's sessions is not supported without a shared revocation_store")
+
+// RevocationStore the commands of Redis used to keep the revocations
+type RevocationStore interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+}
+
+// SetRevocationStore use store as the `revocation_store` of requests without a cfg.Instance, such as by tests
+func SetRevocationStore(store RevocationStore) {
+	std.revocations = store
+}
+
+// UserRevocationSupported is there a `revocation_store` for the cfg.Instance of ctx, see RevokeUser()
+func UserRevocationSupported(ctx context.Context) bool {
+	return stateOf(ctx).revocations != nil
+}
+
+func (s *state) revokeConfigure() {
+	exp := time.Duration(cfg.Cfg.JWT.MaxAge) * time.Minute
+	s.revokedSIDs = cache.New(exp, exp/5)
+	s.sidJWTs = cache.New(exp, exp/5)
+	s.userRevocations = cache.New(revocationLookupTTL, time.Minute)
+
+	if cfg.Cfg.RevocationStore.Backend != cfg.RevocationStoreRedis {
+		return
+	}
+	opts := redis.Options{
+		Addr:     cfg.Cfg.RevocationStore.Redis.Addr,
+		Password: cfg.Cfg.RevocationStore.Redis.Password,
+		DB:       cfg.Cfg.RevocationStore.Redis.DB,
+	}
+	if cfg.Cfg.RevocationStore.Redis.TLS {
+		opts.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	s.revocations = redis.NewClient(opts)
+}
+
+// SID the IdP's session id for these claims, if `session.sid_claim` of the cfg.Instance of ctx is configured
+func (claims *VouchClaims) SID(ctx context.Context) string {
+	c := cfg.FromContext(ctx)
+	if c.Session.SIDClaim == "" {
+		return ""
+	}
+	sid, _ := claims.CustomClaims[c.Session.SIDClaim].(string)
+	return sid
+}
+
+// TrackSID remember that jwt belongs to the IdP session of claims
+func TrackSID(ctx context.Context, claims *VouchClaims, jwt string) {
+	sid := claims.SID(ctx)
+	if sid == "" {
+		return
+	}
+	s := stateOf(ctx)
+	s.sidMu.Lock()
+	defer s.sidMu.Unlock()
+	jwts := map[string]bool{}
+	if v, found := s.sidJWTs.Get(sid); found {
+		jwts = v.(map[string]bool)
+	}
+	jwts[jwt] = true
+	s.sidJWTs.SetDefault(sid, jwts)
+}
+
+// RevokeSID invalidate every JWT belonging to the IdP session sid
+func RevokeSID(ctx context.Context, sid string) {
+	s := stateOf(ctx)
+	s.revokedSIDs.SetDefault(sid, true)
+	s.sidMu.Lock()
+	defer s.sidMu.Unlock()
+	if v, found := s.sidJWTs.Get(sid); found {
+		for jwt := range v.(map[string]bool) {
+			s.forgetJWT(cfg.FromContext(ctx), jwt)
+		}
+		s.sidJWTs.Delete(sid)
+	}
+	log.Infof("revoked session for sid %s", sid)
+}
+
+// IsRevoked has the IdP session of these claims ended
+func IsRevoked(ctx context.Context, claims *VouchClaims) bool {
+	sid := claims.SID(ctx)
+	if sid == "" {
+		return false
+	}
+	_, found := stateOf(ctx).revokedSIDs.Get(sid)
+	return found
+}
+
+// RevokeUser invalidate every JWT issued to username until now, at every instance sharing the `revocation_store`
+// the revocation is kept for as long as such a JWT could still be valid
+func RevokeUser(ctx context.Context, username string) (time.Time, error) {
+	c, s := cfg.FromContext(ctx), stateOf(ctx)
+	if s.revocations == nil {
+		return time.Time{}, ErrRevocationUnsupported
+	}
+	at := time.Now()
+	if err := s.revocations.Set(revocationKey(c, username), []byte(strconv.FormatInt(at.Unix(), 10)), time.Duration(c.JWT.MaxAge)*time.Minute); err != nil {
+		return time.Time{}, err
+	}
+	s.userRevocations.SetDefault(username, at.Unix())
+	log.Infof("revoked the sessions of %s", username)
+	return at, nil
+}
+
+// IsUserRevoked were the user's sessions revoked since these claims were issued
+// a JWT issued in the same second as the revocation is revoked with it
+func IsUserRevoked(ctx context.Context, claims *VouchClaims) bool {
+	at := stateOf(ctx).userRevokedAt(cfg.FromContext(ctx), claims.Username)
+	return at != 0 && claims.IssuedAt <= at
+}
+
+// userRevokedAt when the sessions of username were last revoked, 0 if they weren't
+// should the store be unreachable the user is taken not to be revoked, rather than failing every request
+func (s *state) userRevokedAt(c *cfg.Config, username string) int64 {
+	if s.revocations == nil || username == "" {
+		return 0
+	}
+	if v, found := s.userRevocations.Get(username); found {
+		return v.(int64)
+	}
+	var at int64
+	b, err := s.revocations.Get(revocationKey(c, username))
+	switch {
+	case errors.Is(err, redis.ErrNil):
+	case err != nil:
+		log.Errorf("revocation_store: looking up %s: %s", username, err)
+		return 0
+	default:
+		if at, err = strconv.ParseInt(string(b), 10, 64); err != nil {
+			log.Errorf("revocation_store: the revocation of %s is not a timestamp: %s", username, err)
+			return 0
+		}
+	}
+	s.userRevocations.SetDefault(username, at)
+	return at
+}
+
+func revocationKey(c *cfg.Config, username string) string {
+	return c.RevocationStore.Redis.KeyPrefix + username
+}
@@ -0,0 +1,238 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package metrics counts requests to /validate, logins and their callbacks, and times the provider's userinfo
+// reported at /metrics for Prometheus alongside the health of each provider
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// the result label of vouch_validate_requests_total
+const (
+	ValidateOK       = "ok"
+	ValidateDenied   = "denied"
+	ValidateNoCookie = "nocookie"
+)
+
+// the result label of vouch_callback_total
+const (
+	CallbackOK     = "ok"
+	CallbackDenied = "denied"
+	CallbackError  = "error"
+)
+
+// userInfoBuckets the upper bounds in seconds of the userinfo histogram, those of the Prometheus client libraries
+var userInfoBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	mu sync.Mutex
+
+	validateRequests = newCounter("validate_requests_total", "requests to /validate by result", "result")
+	logins           = newCounter("login_total", "users sent from /login to the provider to log in")
+	callbacks        = newCounter("callback_total", "logins returning from the provider, by provider and result", "provider", "result")
+	userInfo         = newHistogram("userinfo_duration_seconds", "the token exchange and userinfo request to the provider, by provider", userInfoBuckets, "provider")
+
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// ValidateRequest a request to /validate, or a response to one from the jwtcache
+func ValidateRequest(result string) {
+	mu.Lock()
+	defer mu.Unlock()
+	validateRequests.inc(result)
+}
+
+// Login a user sent to the provider to log in
+func Login() {
+	mu.Lock()
+	defer mu.Unlock()
+	logins.inc()
+}
+
+// Callback a login returned from the provider
+func Callback(provider, result string) {
+	mu.Lock()
+	defer mu.Unlock()
+	callbacks.inc(provider, result)
+}
+
+// ObserveUserInfo the time taken by the provider's token exchange and userinfo
+func ObserveUserInfo(provider string, d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	userInfo.observe(d.Seconds(), provider)
+}
+
+// WriteMetrics each metric in the Prometheus text exposition format
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+func WriteMetrics(w io.Writer) error {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, c := range []*counter{validateRequests, logins, callbacks} {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return userInfo.write(w)
+}
+
+// reset for tests
+func reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, c := range []*counter{validateRequests, logins, callbacks} {
+		c.clear()
+	}
+	userInfo.series = make(map[string]*series)
+}
+
+type counter struct {
+	name   string
+	help   string
+	labels []string
+	// values by the label values, see key()
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{name: name, help: help, labels: labels}
+	c.clear()
+	return c
+}
+
+// clear a counter without labels starts at 0, one with labels has no series until it's first incremented
+func (c *counter) clear() {
+	c.values = make(map[string]float64)
+	if len(c.labels) == 0 {
+		c.values[""] = 0
+	}
+}
+
+func (c *counter) inc(labelValues ...string) {
+	c.values[key(labelValues)]++
+}
+
+func (c *counter) write(w io.Writer) error {
+	name := cfg.Branding.LCName + "_" + c.name
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, c.help, name); err != nil {
+		return err
+	}
+	for _, k := range sortedKeys(c.values) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", name, labelPairs(c.labels, k), formatFloat(c.values[k])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+	series  map[string]*series
+}
+
+type series struct {
+	// counts of the observations in each bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, labels: labels, series: make(map[string]*series)}
+}
+
+func (h *histogram) observe(v float64, labelValues ...string) {
+	k := key(labelValues)
+	s, ok := h.series[k]
+	if !ok {
+		s = &series{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+	s.count++
+	s.sum += v
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+}
+
+func (h *histogram) write(w io.Writer) error {
+	name := cfg.Branding.LCName + "_" + h.name
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, h.help, name); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		labels := append(h.labels[:len(h.labels):len(h.labels)], "le")
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelPairs(labels, key([]string{k, formatFloat(le)})), cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelPairs(labels, key([]string{k, "+Inf"})), s.count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n",
+			name, labelPairs(h.labels, k), formatFloat(s.sum), name, labelPairs(h.labels, k), s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// key the label values joined by a byte which can't be in a label value given as valid UTF-8
+func key(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// labelPairs `{provider="oidc",result="ok"}` for the label values held in the key, "" without labels
+func labelPairs(labels []string, k string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	values := strings.Split(k, "\xff")
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", l, labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
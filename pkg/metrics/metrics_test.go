@@ -0,0 +1,71 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	cfg.InitForTestPurposes()
+	reset()
+
+	ValidateRequest(ValidateOK)
+	ValidateRequest(ValidateOK)
+	ValidateRequest(ValidateNoCookie)
+	Login()
+	Callback("oidc", CallbackOK)
+	Callback("oidc", CallbackDenied)
+	Callback(`we"ird`, CallbackError)
+	ObserveUserInfo("oidc", 30*time.Millisecond)
+	ObserveUserInfo("oidc", 2*time.Second)
+	ObserveUserInfo("oidc", time.Minute)
+
+	var b bytes.Buffer
+	assert.NoError(t, WriteMetrics(&b))
+	got := b.String()
+
+	for _, want := range []string{
+		"# TYPE vouch_validate_requests_total counter\n",
+		`vouch_validate_requests_total{result="nocookie"} 1` + "\n",
+		`vouch_validate_requests_total{result="ok"} 2` + "\n",
+		"# TYPE vouch_login_total counter\nvouch_login_total 1\n",
+		`vouch_callback_total{provider="oidc",result="denied"} 1` + "\n",
+		`vouch_callback_total{provider="oidc",result="ok"} 1` + "\n",
+		`vouch_callback_total{provider="we\"ird",result="error"} 1` + "\n",
+		"# TYPE vouch_userinfo_duration_seconds histogram\n",
+		`vouch_userinfo_duration_seconds_bucket{provider="oidc",le="0.025"} 0` + "\n",
+		`vouch_userinfo_duration_seconds_bucket{provider="oidc",le="0.05"} 1` + "\n",
+		`vouch_userinfo_duration_seconds_bucket{provider="oidc",le="2.5"} 2` + "\n",
+		`vouch_userinfo_duration_seconds_bucket{provider="oidc",le="10"} 2` + "\n",
+		`vouch_userinfo_duration_seconds_bucket{provider="oidc",le="+Inf"} 3` + "\n",
+		`vouch_userinfo_duration_seconds_sum{provider="oidc"} 62.03` + "\n",
+		`vouch_userinfo_duration_seconds_count{provider="oidc"} 3` + "\n",
+	} {
+		assert.Contains(t, got, want)
+	}
+}
+
+func TestWriteMetricsBeforeAnyRequests(t *testing.T) {
+	cfg.InitForTestPurposes()
+	reset()
+
+	var b bytes.Buffer
+	assert.NoError(t, WriteMetrics(&b))
+	assert.Contains(t, b.String(), "vouch_login_total 0\n")
+	assert.NotContains(t, b.String(), "vouch_validate_requests_total{")
+}
@@ -0,0 +1,241 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package providerhealth tracks the outcome of the token exchange with each provider
+// the same state is reported as Prometheus gauges at /metrics and as readiness at /readyz
+package providerhealth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"go.uber.org/zap"
+)
+
+var (
+	log *zap.SugaredLogger
+
+	// std the providers of the package configuration, for a request without a cfg.Instance
+	std = newRegistry()
+
+	// now is replaced in tests
+	now = time.Now
+
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// registry the health of each provider of a cfg.Instance
+type registry struct {
+	mu        sync.RWMutex
+	providers map[string]*state
+}
+
+type registryKey struct{}
+
+func newRegistry() *registry {
+	return &registry{providers: make(map[string]*state)}
+}
+
+// registryOf the registry of the cfg.Instance of ctx, otherwise std
+func registryOf(ctx context.Context) *registry {
+	if reg, ok := cfg.State(ctx, registryKey{}).(*registry); ok {
+		return reg
+	}
+	return std
+}
+
+type state struct {
+	consecutiveFailures int
+	selfTestFailed      bool
+	lastSuccess         time.Time
+	lastFailure         time.Time
+}
+
+// Status the health of a provider
+type Status struct {
+	Healthy             bool       `json:"healthy"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+}
+
+// Configure see main.go configure()
+// each configured provider is reported from the start, before its first token exchange, by the name it's chosen by at /login
+func Configure() {
+	log = cfg.Logging.Logger
+	for _, c := range cfg.OAuthConfigs {
+		std.register(c.Name)
+	}
+}
+
+// ConfigureInstance the providers of inst, see cfg.NewInstance()
+func ConfigureInstance(inst *cfg.Instance) {
+	log = cfg.Logging.Logger
+	reg := newRegistry()
+	for _, c := range inst.OAuthConfigs {
+		reg.register(c.Name)
+	}
+	inst.SetState(registryKey{}, reg)
+}
+
+// Register a provider of the cfg.Instance of ctx so that it is reported
+func Register(ctx context.Context, provider string) {
+	registryOf(ctx).register(provider)
+}
+
+func (reg *registry) register(provider string) {
+	if provider == "" {
+		return
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.providers[provider]; !ok {
+		reg.providers[provider] = &state{}
+	}
+}
+
+// Success a token exchange with the provider succeeded
+func Success(ctx context.Context, provider string) {
+	reg := registryOf(ctx)
+	reg.register(provider)
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.providers[provider].consecutiveFailures = 0
+	reg.providers[provider].selfTestFailed = false
+	reg.providers[provider].lastSuccess = now()
+}
+
+// Failure a token exchange with the provider failed
+func Failure(ctx context.Context, provider string) {
+	reg := registryOf(ctx)
+	reg.register(provider)
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	s := reg.providers[provider]
+	s.consecutiveFailures++
+	s.lastFailure = now()
+	if s.consecutiveFailures == cfg.FromContext(ctx).Readiness.FailureThreshold {
+		log.Warnf("provider %s is unhealthy after %d consecutive failed token exchanges", provider, s.consecutiveFailures)
+	}
+}
+
+// SelfTestFailed the startup self-test could not reach the provider
+// it is unhealthy until a token exchange succeeds
+func SelfTestFailed(ctx context.Context, provider string) {
+	reg := registryOf(ctx)
+	reg.register(provider)
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.providers[provider].selfTestFailed = true
+}
+
+// healthy a provider is unhealthy once `readiness.failure_threshold` token exchanges in a row have failed
+// and until a token exchange succeeds or `readiness.failure_window` passes without another failure,
+// so that an instance taken out of service while its provider was down comes back once it may have recovered
+func (s *state) healthy(c *cfg.Config) bool {
+	if s.selfTestFailed {
+		return false
+	}
+	if s.consecutiveFailures < c.Readiness.FailureThreshold {
+		return true
+	}
+	return now().Sub(s.lastFailure) > time.Duration(c.Readiness.FailureWindow)*time.Second
+}
+
+// Statuses the health of each provider of the cfg.Instance of ctx
+func Statuses(ctx context.Context) map[string]Status {
+	reg := registryOf(ctx)
+	c := cfg.FromContext(ctx)
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	statuses := make(map[string]Status, len(reg.providers))
+	for name, s := range reg.providers {
+		statuses[name] = Status{
+			Healthy:             s.healthy(c),
+			ConsecutiveFailures: s.consecutiveFailures,
+			LastSuccess:         timeOrNil(s.lastSuccess),
+			LastFailure:         timeOrNil(s.lastFailure),
+		}
+	}
+	return statuses
+}
+
+// Ready every provider of the cfg.Instance of ctx is healthy
+func Ready(ctx context.Context) bool {
+	for _, s := range Statuses(ctx) {
+		if !s.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteMetrics the health of each provider of the cfg.Instance of ctx as Prometheus gauges in the text exposition format
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+func WriteMetrics(ctx context.Context, w io.Writer) error {
+	statuses := Statuses(ctx)
+	names := make([]string, 0, len(statuses))
+	for name := range statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(Status) float64
+	}{
+		{"provider_up", "1 if the provider is healthy, 0 if too many token exchanges in a row have failed",
+			func(s Status) float64 {
+				if s.Healthy {
+					return 1
+				}
+				return 0
+			}},
+		{"provider_consecutive_failures", "token exchanges in a row which have failed",
+			func(s Status) float64 { return float64(s.ConsecutiveFailures) }},
+		{"provider_last_success_timestamp_seconds", "unix time of the last successful token exchange, 0 if there hasn't been one",
+			func(s Status) float64 { return unixSeconds(s.LastSuccess) }},
+	}
+	for _, g := range gauges {
+		name := cfg.Branding.LCName + "_" + g.name
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, g.help, name); err != nil {
+			return err
+		}
+		for _, provider := range names {
+			value := strconv.FormatFloat(g.value(statuses[provider]), 'f', -1, 64)
+			if _, err := fmt.Fprintf(w, "%s{provider=\"%s\"} %s\n", name, labelEscaper.Replace(provider), value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func unixSeconds(t *time.Time) float64 {
+	if t == nil {
+		return 0
+	}
+	return float64(t.Unix())
+}
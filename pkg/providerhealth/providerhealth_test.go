@@ -0,0 +1,92 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package providerhealth
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func setUp(t *testing.T) *time.Time {
+	cfg.InitForTestPurposes()
+	Configure()
+	cfg.Cfg.Readiness.FailureThreshold = 3
+	cfg.Cfg.Readiness.FailureWindow = 60
+	std = newRegistry()
+
+	clock := time.Unix(1600000000, 0)
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = time.Now })
+	return &clock
+}
+
+func TestHealth(t *testing.T) {
+	clock := setUp(t)
+	Register(context.Background(), "oidc")
+	assert.True(t, Ready(context.Background()))
+
+	Failure(context.Background(), "oidc")
+	Failure(context.Background(), "oidc")
+	assert.True(t, Ready(context.Background()), "below the threshold")
+
+	Failure(context.Background(), "oidc")
+	assert.False(t, Ready(context.Background()), "at the threshold")
+	assert.Equal(t, 3, Statuses(context.Background())["oidc"].ConsecutiveFailures)
+
+	*clock = clock.Add(61 * time.Second)
+	assert.True(t, Ready(context.Background()), "after the window without another failure")
+
+	Failure(context.Background(), "oidc")
+	assert.False(t, Ready(context.Background()), "failing again")
+
+	Success(context.Background(), "oidc")
+	assert.True(t, Ready(context.Background()), "after a success")
+	s := Statuses(context.Background())["oidc"]
+	assert.Equal(t, 0, s.ConsecutiveFailures)
+	assert.Equal(t, *clock, *s.LastSuccess)
+}
+
+func TestHealthSelfTestFailed(t *testing.T) {
+	setUp(t)
+	SelfTestFailed(context.Background(), "oidc")
+	assert.False(t, Ready(context.Background()), "unhealthy from the start")
+
+	Failure(context.Background(), "oidc")
+	assert.False(t, Ready(context.Background()))
+
+	Success(context.Background(), "oidc")
+	assert.True(t, Ready(context.Background()), "after a success")
+}
+
+func TestWriteMetrics(t *testing.T) {
+	setUp(t)
+	Register(context.Background(), "oidc")
+	Success(context.Background(), "github")
+	for i := 0; i < 3; i++ {
+		Failure(context.Background(), "oidc")
+	}
+
+	var b bytes.Buffer
+	assert.NoError(t, WriteMetrics(context.Background(), &b))
+	metrics := b.String()
+	assert.Contains(t, metrics, "# TYPE vouch_provider_up gauge\n")
+	assert.Contains(t, metrics, "vouch_provider_up{provider=\"github\"} 1\n")
+	assert.Contains(t, metrics, "vouch_provider_up{provider=\"oidc\"} 0\n")
+	assert.Contains(t, metrics, "vouch_provider_consecutive_failures{provider=\"oidc\"} 3\n")
+	assert.Contains(t, metrics, "vouch_provider_last_success_timestamp_seconds{provider=\"github\"} 1600000000\n")
+	assert.Contains(t, metrics, "vouch_provider_last_success_timestamp_seconds{provider=\"oidc\"} 0\n")
+}
@@ -11,14 +11,12 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package adfs
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"golang.org/x/oauth2"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
 
@@ -51,16 +49,22 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 	code := r.URL.Query().Get("code")
 	log.Debugf("code: %s", code)
 
+	provider := cfg.OAuth(r.Context())
+	redirectURL := cfg.OAuthClientWithRedirectURL(r.Context()).RedirectURL
 	formData := url.Values{}
 	formData.Set("code", code)
 	formData.Set("grant_type", "authorization_code")
-	formData.Set("resource", cfg.GenOAuth.RedirectURL)
-	formData.Set("client_id", cfg.GenOAuth.ClientID)
-	formData.Set("redirect_uri", cfg.GenOAuth.RedirectURL)
-	if cfg.GenOAuth.ClientSecret != "" {
-		formData.Set("client_secret", cfg.GenOAuth.ClientSecret)
+	formData.Set("resource", provider.ADFSResource(redirectURL))
+	formData.Set("client_id", provider.ClientID)
+	formData.Set("redirect_uri", redirectURL)
+	// a public client authenticates the exchange with the PKCE code_verifier alone
+	if provider.ClientSecret != "" {
+		formData.Set("client_secret", provider.ClientSecret)
 	}
-	req, err := http.NewRequest("POST", cfg.GenOAuth.TokenURL, strings.NewReader(formData.Encode()))
+	for k, v := range common.AuthCodeOptionValues(opts...) {
+		formData[k] = v
+	}
+	req, err := http.NewRequest("POST", provider.TokenURL, strings.NewReader(formData.Encode()))
 	if err != nil {
 		return err
 	}
@@ -68,8 +72,7 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 	req.Header.Add("Content-Length", strconv.Itoa(len(formData.Encode())))
 	req.Header.Set("Accept", "application/json")
 
-	client := &http.Client{}
-	userinfo, err := client.Do(req)
+	userinfo, err := common.HTTPClient(r.Context()).Do(req)
 
 	if err != nil {
 		return err
@@ -87,17 +90,15 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 		return fmt.Errorf("getUserInfoFromADFS oauth2: cannot fetch token: %+v", err)
 	}
 
+	if err := common.CheckAccessToken(r.Context(), tokenRes.AccessToken); err != nil {
+		return err
+	}
 	ptokens.PAccessToken = string(tokenRes.AccessToken)
 	ptokens.PIdToken = string(tokenRes.IDToken)
 
-	s := strings.Split(tokenRes.IDToken, ".")
-	if len(s) < 2 {
-		return fmt.Errorf("getUserInfoFromADFS jws: invalid token received")
-	}
-
-	idToken, err := base64.RawURLEncoding.DecodeString(s[1])
+	idToken, err := common.VerifyIDToken(r.Context(), tokenRes.IDToken)
 	if err != nil {
-		return fmt.Errorf("getUserInfoFromADFS decode token: %+v", err)
+		return fmt.Errorf("getUserInfoFromADFS %w", err)
 	}
 	log.Debugf("getUserInfoFromADFS idToken: %+v", string(idToken))
 
@@ -107,21 +108,23 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 	// data contains an access token, refresh token, and id token
 	// Please note that in order for custom claims to work you MUST set allatclaims in ADFS to be passed
 	// https://oktotechnologies.ca/2018/08/26/adfs-openidconnect-configuration/
-	if err = common.MapClaims([]byte(idToken), customClaims); err != nil {
+	if err = common.MapClaims(r.Context(), []byte(idToken), customClaims); err != nil {
 		return err
 	}
 	adfsUser.PrepareUserData()
-	var rxEmail = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
 	if len(adfsUser.Email) == 0 {
 		// If the email is blank, we will try to determine if the UPN is an email.
-		if rxEmail.MatchString(adfsUser.UPN) {
+		if cfg.FromContext(r.Context()).IsEmail(adfsUser.UPN) {
 			// Set the email from UPN if there is a valid email present.
 			adfsUser.Email = adfsUser.UPN
 		}
 	}
 	user.Username = adfsUser.Username
 	user.Email = adfsUser.Email
+	if err = common.MapUser(r.Context(), []byte(idToken), user); err != nil {
+		return err
+	}
 	log.Debugf("User Obj: %+v", user)
 	return nil
 }
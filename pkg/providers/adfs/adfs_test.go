@@ -0,0 +1,272 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package adfs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestGetUserInfoVerifiesSignature(t *testing.T) {
+	cfg.InitForTestPurposesWithProvider("adfs")
+	common.Configure()
+	Provider{}.Configure()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"upn":   "test@example.com",
+		"email": "test@example.com",
+		"aud":   cfg.GenOAuth.ClientID,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = "adfs1"
+	idToken, err := token.SignedString(key)
+	assert.NoError(t, err)
+
+	// swap in a payload claiming to be someone else, keeping the original signature
+	parts := strings.Split(idToken, ".")
+	forged, _ := json.Marshal(map[string]interface{}{"upn": "admin@example.com", "email": "admin@example.com", "aud": cfg.GenOAuth.ClientID, "exp": time.Now().Add(time.Hour).Unix()})
+	tampered := strings.Join([]string{parts[0], base64.RawURLEncoding.EncodeToString(forged), parts[2]}, ".")
+
+	keyFetches := 0
+	var serveIDToken string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/adfs/oauth2/token":
+			_ = json.NewEncoder(w).Encode(adfsTokenRes{AccessToken: "access", TokenType: "bearer", IDToken: serveIDToken})
+		case "/adfs/discovery/keys":
+			keyFetches++
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kid": "adfs1",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	cfg.GenOAuth.TokenURL = ts.URL + "/adfs/oauth2/token"
+	cfg.GenOAuth.JWKSURL = ts.URL + "/adfs/discovery/keys"
+
+	tests := []struct {
+		name      string
+		idToken   string
+		wantEmail string
+		wantErr   bool
+	}{
+		{"valid", idToken, "test@example.com", false},
+		{"tampered", tampered, "", true},
+		{"valid again", idToken, "test@example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serveIDToken = tt.idToken
+			r, _ := http.NewRequest("GET", "/auth?code=abc", nil)
+			user := &structs.User{}
+			err := Provider{}.GetUserInfo(r, user, &structs.CustomClaims{}, &structs.PTokens{})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantEmail, user.Email)
+		})
+	}
+	// the keys are cached
+	assert.Equal(t, 1, keyFetches)
+}
+
+func TestGetUserInfoUsernameClaim(t *testing.T) {
+	cfg.InitForTestPurposesWithProvider("adfs")
+	common.Configure()
+	Provider{}.Configure()
+	cfg.GenOAuth.UserInfo.UsernameClaim = "sub"
+	defer func() { cfg.GenOAuth.UserInfo.UsernameClaim = "" }()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	// an id_token which only supplies sub
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "S-1-5-21-3623811015-3361044348-30300820-1013",
+		"aud": cfg.GenOAuth.ClientID,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = "adfs1"
+	idToken, err := token.SignedString(key)
+	assert.NoError(t, err)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/adfs/oauth2/token":
+			_ = json.NewEncoder(w).Encode(adfsTokenRes{AccessToken: "access", TokenType: "bearer", IDToken: idToken})
+		case "/adfs/discovery/keys":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kid": "adfs1",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	cfg.GenOAuth.TokenURL = ts.URL + "/adfs/oauth2/token"
+	cfg.GenOAuth.JWKSURL = ts.URL + "/adfs/discovery/keys"
+
+	r, _ := http.NewRequest("GET", "/auth?code=abc", nil)
+	user := &structs.User{}
+	assert.NoError(t, Provider{}.GetUserInfo(r, user, &structs.CustomClaims{}, &structs.PTokens{}))
+	assert.Equal(t, "S-1-5-21-3623811015-3361044348-30300820-1013", user.Username)
+	assert.Empty(t, user.Email)
+}
+
+// the id_token must carry the nonce sent at /login
+func TestGetUserInfoNonce(t *testing.T) {
+	cfg.InitForTestPurposesWithProvider("adfs")
+	common.Configure()
+	Provider{}.Configure()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"upn":   "test@example.com",
+		"nonce": "n0nce",
+		"aud":   cfg.GenOAuth.ClientID,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = "adfs1"
+	idToken, err := token.SignedString(key)
+	assert.NoError(t, err)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/adfs/oauth2/token":
+			_ = json.NewEncoder(w).Encode(adfsTokenRes{AccessToken: "access", TokenType: "bearer", IDToken: idToken})
+		case "/adfs/discovery/keys":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kid": "adfs1",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	cfg.GenOAuth.TokenURL = ts.URL + "/adfs/oauth2/token"
+	cfg.GenOAuth.JWKSURL = ts.URL + "/adfs/discovery/keys"
+
+	tests := []struct {
+		name    string
+		nonce   string
+		wantErr bool
+	}{
+		{"nonce sent", "n0nce", false},
+		{"nonce of another login", "other", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/auth?code=abc", nil)
+			r = r.WithContext(context.WithValue(r.Context(), cfg.IDTokenNonceCtxKey, tt.nonce))
+			err := Provider{}.GetUserInfo(r, &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestGetUserInfoResource(t *testing.T) {
+	cfg.InitForTestPurposesWithProvider("adfs")
+	common.Configure()
+	Provider{}.Configure()
+
+	var resource, redirectURI string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resource = r.FormValue("resource")
+		redirectURI = r.FormValue("redirect_uri")
+		http.Error(w, "stop after the token request", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+	cfg.GenOAuth.TokenURL = ts.URL + "/adfs/oauth2/token"
+
+	tests := []struct {
+		name         string
+		resource     string
+		wantResource string
+	}{
+		// as before oauth.resource could be set
+		{"defaults to the redirect_uri", "", cfg.GenOAuth.RedirectURL},
+		{"the relying party's identifier", "urn:vouch:relying-party", "urn:vouch:relying-party"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.GenOAuth.Resource = tt.resource
+			r, _ := http.NewRequest("GET", "/auth?code=abc", nil)
+			_ = Provider{}.GetUserInfo(r, &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{})
+			assert.Equal(t, tt.wantResource, resource)
+			assert.Equal(t, cfg.GenOAuth.RedirectURL, redirectURI)
+		})
+	}
+}
+
+// a public client sends the PKCE code_verifier in place of a client_secret
+func TestGetUserInfoPublicClient(t *testing.T) {
+	cfg.InitForTestPurposesWithProvider("adfs")
+	common.Configure()
+	Provider{}.Configure()
+	cfg.GenOAuth.ClientSecret = ""
+
+	var form url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		form = r.PostForm
+		http.Error(w, "stop after the token request", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+	cfg.GenOAuth.TokenURL = ts.URL + "/adfs/oauth2/token"
+
+	r, _ := http.NewRequest("GET", "/auth?code=abc", nil)
+	_ = Provider{}.GetUserInfo(r, &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{}, oauth2.SetAuthURLParam("code_verifier", "verifier"))
+	assert.Equal(t, "verifier", form.Get("code_verifier"))
+	assert.Equal(t, cfg.GenOAuth.ClientID, form.Get("client_id"))
+	_, ok := form["client_secret"]
+	assert.False(t, ok, "no client_secret is sent")
+}
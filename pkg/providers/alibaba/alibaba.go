@@ -39,7 +39,7 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 	if err != nil {
 		return err
 	}
-	userinfo, err := client.Get(cfg.GenOAuth.UserInfoURL)
+	userinfo, err := client.Get(cfg.OAuth(r.Context()).UserInfoURL)
 	if err != nil {
 		return err
 	}
@@ -50,7 +50,7 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 	}()
 	data, _ := ioutil.ReadAll(userinfo.Body)
 	log.Infof("Alibaba userinfo body: %s", string(data))
-	if err = common.MapClaims(data, customClaims); err != nil {
+	if err = common.MapClaims(r.Context(), data, customClaims); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -0,0 +1,195 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package apple
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// Provider Sign in with Apple, which is OpenID Connect but for two things
+// the client secret is a jwt signed with the team's ES256 key rather than a fixed string
+// and the user's name isn't in the id_token, it's posted along with the code at the first authorization only
+// https://developer.apple.com/documentation/sign_in_with_apple/sign_in_with_apple_rest_api
+type Provider struct{}
+
+// issuer of the id_token, and the audience of the client secret
+const issuer = "https://appleid.apple.com"
+
+const (
+	// clientSecretLifetime Apple accepts a client secret valid for up to six months
+	clientSecretLifetime = 24 * time.Hour
+	// clientSecretRenewal the client secret is signed again once it expires within this
+	clientSecretRenewal = time.Hour
+)
+
+var (
+	log *zap.SugaredLogger
+
+	errNotFromApple = errors.New("id_token is not from Apple for this client")
+
+	secretMu     sync.Mutex
+	secret       string
+	secretExpiry time.Time
+	// secretFor the name of the provider the secret was signed for
+	secretFor string
+	// now is swapped out by tests
+	now = time.Now
+)
+
+// Configure see main.go configure()
+func (Provider) Configure() {
+	log = cfg.Logging.Logger
+	secretMu.Lock()
+	defer secretMu.Unlock()
+	secret = ""
+}
+
+// GetUserInfo provider specific call to get userinfomation, from the id_token and the `user` of the first authorization
+func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens, opts ...oauth2.AuthCodeOption) error {
+	cs, err := clientSecret(r.Context())
+	if err != nil {
+		return fmt.Errorf("getUserInfoFromApple %w", err)
+	}
+	_, providerToken, err := common.PrepareTokensAndClientWithSecret(r, ptokens, cs, false, opts...)
+	if err != nil {
+		return err
+	}
+	idToken, _ := providerToken.Extra("id_token").(string)
+	if idToken == "" {
+		return errors.New("getUserInfoFromApple: no id_token in the token response")
+	}
+	ptokens.PIdToken = idToken
+	payload, err := common.VerifyIDToken(r.Context(), idToken)
+	if err != nil {
+		return fmt.Errorf("getUserInfoFromApple %w", err)
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("getUserInfoFromApple %w", err)
+	}
+	if err := checkIssuerAndAudience(r.Context(), claims); err != nil {
+		return fmt.Errorf("getUserInfoFromApple %w", err)
+	}
+	addFirstAuthorization(r, claims)
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	log.Debugf("getUserInfoFromApple claims: %s", string(data))
+
+	if err = common.MapClaims(r.Context(), data, customClaims); err != nil {
+		log.Error(err)
+		return err
+	}
+	appleUser := structs.AppleUser{}
+	if err = json.Unmarshal(data, &appleUser); err != nil {
+		log.Error(err)
+		return err
+	}
+	appleUser.PrepareUserData()
+	user.Username = appleUser.Username
+	user.Email = appleUser.Email
+	user.Name = appleUser.Name
+	log.Debugf("User Obj: %+v", user)
+	return nil
+}
+
+// clientSecret the jwt sent as the client_secret, signed again shortly before it expires rather than for each login
+func clientSecret(ctx context.Context) (string, error) {
+	provider := cfg.OAuth(ctx)
+	secretMu.Lock()
+	defer secretMu.Unlock()
+	if secret != "" && secretFor == provider.Name && now().Add(clientSecretRenewal).Before(secretExpiry) {
+		return secret, nil
+	}
+	key, err := provider.AppleSigningKey()
+	if err != nil {
+		return "", err
+	}
+	issued := now()
+	expiry := issued.Add(clientSecretLifetime)
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.StandardClaims{
+		Issuer:    provider.Apple.TeamID,
+		Subject:   provider.ClientID,
+		Audience:  issuer,
+		IssuedAt:  issued.Unix(),
+		ExpiresAt: expiry.Unix(),
+	})
+	token.Header["kid"] = provider.Apple.KeyID
+	signed, err := token.SignedString(key)
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("signed the client secret for Sign in with Apple, valid until %s", expiry)
+	secret, secretExpiry, secretFor = signed, expiry, provider.Name
+	return secret, nil
+}
+
+// checkIssuerAndAudience the id_token must be issued by Apple to `oauth.client_id` (the Services ID)
+func checkIssuerAndAudience(ctx context.Context, claims map[string]interface{}) error {
+	iss, _ := claims["iss"].(string)
+	if iss != issuer {
+		return fmt.Errorf("%w: iss %q", errNotFromApple, iss)
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == cfg.OAuth(ctx).ClientID {
+			return nil
+		}
+	case []interface{}:
+		for _, a := range aud {
+			if a == cfg.OAuth(ctx).ClientID {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: aud %v", errNotFromApple, claims["aud"])
+}
+
+// addFirstAuthorization the user's name, which Apple posts only at the first authorization of the app by the user
+// as the `name`, `given_name` and `family_name` claims, so that they may be passed in `headers.claims`
+// unlike the id_token it isn't signed, the email is always taken from the id_token
+func addFirstAuthorization(r *http.Request, claims map[string]interface{}) {
+	posted := r.URL.Query().Get("user")
+	if posted == "" {
+		return
+	}
+	var first structs.AppleName
+	if err := json.Unmarshal([]byte(posted), &first); err != nil {
+		log.Warnf("getUserInfoFromApple could not parse the user posted at the first authorization: %s", err)
+		return
+	}
+	if first.Name.FirstName != "" {
+		claims["given_name"] = first.Name.FirstName
+	}
+	if first.Name.LastName != "" {
+		claims["family_name"] = first.Name.LastName
+	}
+	if name := strings.TrimSpace(first.Name.FirstName + " " + first.Name.LastName); name != "" {
+		claims["name"] = name
+	}
+}
@@ -0,0 +1,183 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package apple
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// setUpApple configures the apple provider with a .p8 key of its own, returning its public half
+func setUpApple(t *testing.T) *ecdsa.PublicKey {
+	cfg.InitForTestPurposesWithProvider("apple")
+	common.Configure()
+	Provider{}.Configure()
+	now = time.Now
+	t.Cleanup(func() { now = time.Now })
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	p8 := filepath.Join(t.TempDir(), "AuthKey_KEY123.p8")
+	assert.NoError(t, ioutil.WriteFile(p8, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	cfg.GenOAuth.ClientID = "com.example.vouch"
+	cfg.GenOAuth.Apple.TeamID = "TEAM123"
+	cfg.GenOAuth.Apple.KeyID = "KEY123"
+	cfg.GenOAuth.Apple.PrivateKeyFile = p8
+	cfg.OAuthClient.ClientID = cfg.GenOAuth.ClientID
+	return &key.PublicKey
+}
+
+// stubApple Apple's token and keys endpoints, the token endpoint checks the client secret and answers with the id_token
+func stubApple(t *testing.T, secretKey *ecdsa.PublicKey, idToken *string) (*httptest.Server, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/auth/token":
+			claims := jwt.StandardClaims{}
+			token, err := jwt.ParseWithClaims(r.FormValue("client_secret"), &claims, func(token *jwt.Token) (interface{}, error) {
+				assert.Equal(t, jwt.SigningMethodES256, token.Method)
+				assert.Equal(t, "KEY123", token.Header["kid"])
+				return secretKey, nil
+			})
+			if err != nil || !token.Valid || claims.Issuer != "TEAM123" || claims.Subject != "com.example.vouch" || claims.Audience != issuer {
+				http.Error(w, `{"error":"invalid_client"}`, http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access", "token_type": "bearer", "expires_in": 3600, "id_token": *idToken})
+		case "/auth/keys":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kid": "apple1",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	cfg.GenOAuth.TokenURL = ts.URL + "/auth/token"
+	cfg.OAuthClient.Endpoint.TokenURL = cfg.GenOAuth.TokenURL
+	cfg.GenOAuth.JWKSURL = ts.URL + "/auth/keys"
+	return ts, key
+}
+
+func TestGetUserInfo(t *testing.T) {
+	secretKey := setUpApple(t)
+	var idToken string
+	_, key := stubApple(t, secretKey, &idToken)
+
+	sign := func(claims jwt.MapClaims) string {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "apple1"
+		s, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return s
+	}
+	firstUser := `{"name":{"firstName":"Jane","lastName":"Appleseed"},"email":"someone.else@example.com"}`
+
+	tests := []struct {
+		name         string
+		claims       jwt.MapClaims
+		user         string
+		wantUsername string
+		wantEmail    string
+		wantName     string
+		wantErr      bool
+	}{
+		{"first authorization", jwt.MapClaims{"iss": issuer, "aud": "com.example.vouch", "sub": "001.abc", "email": "jane@example.com"}, firstUser, "jane@example.com", "jane@example.com", "Jane Appleseed", false},
+		{"later authorizations", jwt.MapClaims{"iss": issuer, "aud": "com.example.vouch", "sub": "001.abc", "email": "jane@example.com"}, "", "jane@example.com", "jane@example.com", "", false},
+		{"no email", jwt.MapClaims{"iss": issuer, "aud": "com.example.vouch", "sub": "001.abc"}, "", "001.abc", "", "", false},
+		{"another client", jwt.MapClaims{"iss": issuer, "aud": "com.example.other", "sub": "001.abc", "email": "jane@example.com"}, "", "", "", "", true},
+		{"another issuer", jwt.MapClaims{"iss": "https://idp.example.com", "aud": "com.example.vouch", "sub": "001.abc", "email": "jane@example.com"}, "", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idToken = sign(tt.claims)
+			q := url.Values{"code": {"abc"}}
+			if tt.user != "" {
+				q.Set("user", tt.user)
+			}
+			r := httptest.NewRequest("GET", "/auth/state/?"+q.Encode(), nil)
+			user := &structs.User{}
+			ptokens := &structs.PTokens{}
+			err := Provider{}.GetUserInfo(r, user, &structs.CustomClaims{}, ptokens)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.True(t, errors.Is(err, errNotFromApple), "%v", err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantUsername, user.Username)
+			assert.Equal(t, tt.wantEmail, user.Email)
+			assert.Equal(t, tt.wantName, user.Name)
+			assert.Equal(t, idToken, ptokens.PIdToken)
+		})
+	}
+}
+
+func TestClientSecretRenewed(t *testing.T) {
+	setUpApple(t)
+	start := time.Now()
+	now = func() time.Time { return start }
+
+	first, err := clientSecret(context.Background())
+	assert.NoError(t, err)
+	second, err := clientSecret(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, first, second, "the client secret is signed once rather than per login")
+
+	now = func() time.Time { return start.Add(clientSecretLifetime - clientSecretRenewal - time.Minute) }
+	second, err = clientSecret(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	// signed again before it expires
+	now = func() time.Time { return start.Add(clientSecretLifetime - clientSecretRenewal + time.Minute) }
+	third, err := clientSecret(context.Background())
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, third)
+
+	claims := jwt.StandardClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(third, &claims)
+	assert.NoError(t, err)
+	assert.Equal(t, now().Add(clientSecretLifetime).Unix(), claims.ExpiresAt)
+}
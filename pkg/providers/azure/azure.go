@@ -46,11 +46,12 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 	// just going to extract user info and custom claims from there.
 	azureUser := structs.AzureUser{}
 
+	provider := cfg.OAuth(r.Context())
 	var tokenParts []string
 
-	if cfg.GenOAuth.AzureToken == "access_token" {
+	if provider.AzureToken == "access_token" {
 		tokenParts = strings.Split(ptokens.PAccessToken, ".")
-	} else if cfg.GenOAuth.AzureToken == "id_token" {
+	} else if provider.AzureToken == "id_token" {
 		tokenParts = strings.Split(ptokens.PIdToken, ".")
 	} else {
 		err = fmt.Errorf("Azure Token not access_token or id_token")
@@ -71,7 +72,7 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 		return err
 	}
 
-	if err = common.MapClaims(tokenBytes, customClaims); err != nil {
+	if err = common.MapClaims(r.Context(), tokenBytes, customClaims); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -0,0 +1,87 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// ErrAccessTokenNotForUs the access token is a JWT issued by another issuer or for another audience than `oauth.access_token`
+var ErrAccessTokenNotForUs = errors.New("access token issued for another issuer or audience")
+
+// CheckAccessToken with `oauth.access_token.issuer` or `oauth.access_token.audiences` an access token which is a JWT
+// must have been issued by the issuer for one of the audiences, so that a token meant for another resource isn't kept
+// or passed on, an opaque access token can't be checked and is accepted
+// the token is straight from the provider's token endpoint, so its signature isn't checked
+func CheckAccessToken(ctx context.Context, accessToken string) error {
+	want := cfg.OAuth(ctx).AccessToken
+	if want.Issuer == "" && len(want.Audiences) == 0 {
+		return nil
+	}
+	claims, ok := accessTokenClaims(accessToken)
+	if !ok {
+		log.Debugf("access token is opaque, its issuer and audience are not checked")
+		return nil
+	}
+
+	if iss := want.Issuer; iss != "" {
+		if got, _ := claims["iss"].(string); got != iss {
+			return fmt.Errorf("%w: iss %q", ErrAccessTokenNotForUs, got)
+		}
+	}
+	if len(want.Audiences) == 0 {
+		return nil
+	}
+	// `aud` is either a string or a list of them
+	var auds []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		auds = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+	}
+	for _, aud := range auds {
+		for _, a := range want.Audiences {
+			if aud == a {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: aud %q", ErrAccessTokenNotForUs, auds)
+}
+
+// accessTokenClaims the payload of an access token which is a JWT, false if it isn't one
+func accessTokenClaims(accessToken string) (map[string]interface{}, bool) {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, false
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, false
+	}
+	return claims, true
+}
@@ -0,0 +1,67 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// unsignedJWT a JWT with the payload, the signature isn't checked
+func unsignedJWT(payload string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc([]byte(payload)) + ".c2lnbmF0dXJl"
+}
+
+func TestCheckAccessToken(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Configure()
+	cfg.GenOAuth.AccessToken.Issuer = "https://idp.example.com/"
+	cfg.GenOAuth.AccessToken.Audiences = []string{"api://vouch", "https://app.example.com"}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"matching", unsignedJWT(`{"iss":"https://idp.example.com/","aud":"api://vouch"}`), false},
+		{"one of the audiences", unsignedJWT(`{"iss":"https://idp.example.com/","aud":["https://graph.example.com","https://app.example.com"]}`), false},
+		{"another audience", unsignedJWT(`{"iss":"https://idp.example.com/","aud":"https://graph.example.com"}`), true},
+		{"none of the audiences", unsignedJWT(`{"iss":"https://idp.example.com/","aud":["https://graph.example.com"]}`), true},
+		{"no audience", unsignedJWT(`{"iss":"https://idp.example.com/"}`), true},
+		{"another issuer", unsignedJWT(`{"iss":"https://evil.example.com/","aud":"api://vouch"}`), true},
+		{"opaque", "2YotnFZFEjr1zCsicMWpAA", false},
+		{"not json", "a.b.c", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckAccessToken(context.Background(), tt.token)
+			if !tt.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, ErrAccessTokenNotForUs), "%v", err)
+			assert.True(t, Refused(err))
+		})
+	}
+
+	// either may be left out
+	cfg.GenOAuth.AccessToken.Audiences = nil
+	assert.NoError(t, CheckAccessToken(context.Background(), unsignedJWT(`{"iss":"https://idp.example.com/","aud":"https://graph.example.com"}`)))
+	cfg.GenOAuth.AccessToken.Issuer = ""
+	assert.NoError(t, CheckAccessToken(context.Background(), unsignedJWT(`{"iss":"https://evil.example.com/"}`)), "not checked unless configured")
+}
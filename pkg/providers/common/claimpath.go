@@ -0,0 +1,69 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ClaimValue the value of the claim, which may be a dotted path into claims whose values are objects such as `address.country`
+// and may index into claims whose values are arrays such as `realm_access.roles[0]`
+// a claim whose name holds a dot itself, such as Auth0's namespaced `https://example.com/roles`, is found first
+func ClaimValue(claims map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := claims[path]; ok {
+		return v, true
+	}
+	if v, ok := indexedClaimValue(claims, path); ok {
+		return v, true
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] != '.' {
+			continue
+		}
+		head, ok := claims[path[:i]]
+		if !ok {
+			head, ok = indexedClaimValue(claims, path[:i])
+		}
+		if obj, ok := head.(map[string]interface{}); ok {
+			if v, ok := ClaimValue(obj, path[i+1:]); ok {
+				return v, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// indexedClaimValue the element of an array claim named by a path ending in an index, such as `roles[0]`
+func indexedClaimValue(claims map[string]interface{}, path string) (interface{}, bool) {
+	open := strings.LastIndexByte(path, '[')
+	if open <= 0 || !strings.HasSuffix(path, "]") {
+		return nil, false
+	}
+	n, err := strconv.Atoi(path[open+1 : len(path)-1])
+	if err != nil || n < 0 {
+		return nil, false
+	}
+	v, ok := ClaimValue(claims, path[:open])
+	if !ok {
+		return nil, false
+	}
+	arr, ok := v.([]interface{})
+	if !ok || n >= len(arr) {
+		return nil, false
+	}
+	return arr[n], true
+}
+
+// claimIn the top level claim k holds the claim, as either the claim itself or the object or array at the start of its path
+func claimIn(k, claim string) bool {
+	return k != "" && (k == claim || strings.HasPrefix(claim, k+".") || strings.HasPrefix(claim, k+"["))
+}
@@ -0,0 +1,106 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestClaimValue(t *testing.T) {
+	claims := make(map[string]interface{})
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"address": {"country": "DE", "geo": {"lat": 52.5}},
+		"groups": ["a", "b"],
+		"http://www.example.com/favorite_color": "blue",
+		"https://example.com/org": {"name": "Example"},
+		"a.b": "literal",
+		"a": {"b": "nested"},
+		"realm_access": {"roles": ["admin", "user"]},
+		"orgs": [{"name": "Example", "teams": ["x"]}]
+	}`), &claims))
+
+	tests := []struct {
+		path   string
+		want   interface{}
+		wantOK bool
+	}{
+		{"address.country", "DE", true},
+		{"address.geo.lat", 52.5, true},
+		{"groups", []interface{}{"a", "b"}, true},
+		{"http://www.example.com/favorite_color", "blue", true},
+		{"https://example.com/org.name", "Example", true},
+		{"a.b", "literal", true},
+		{"address.city", nil, false},
+		{"groups.a", nil, false},
+		{"missing.country", nil, false},
+		{"address.", nil, false},
+		{"groups[1]", "b", true},
+		{"realm_access.roles[0]", "admin", true},
+		{"orgs[0].name", "Example", true},
+		{"orgs[0].teams[0]", "x", true},
+		{"groups[2]", nil, false},
+		{"groups[-1]", nil, false},
+		{"groups[]", nil, false},
+		{"address[0]", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, ok := ClaimValue(claims, tt.path)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMapClaimsObjectPath(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Configure()
+	claimsCleaned := cfg.Cfg.Headers.ClaimsCleaned
+	requiredClaims := cfg.Cfg.RequiredClaims
+	defer func() {
+		cfg.Cfg.Headers.ClaimsCleaned = claimsCleaned
+		cfg.Cfg.RequiredClaims = requiredClaims
+	}()
+	cfg.Cfg.Headers.ClaimsCleaned = map[string]string{"address.country": "Address-Country"}
+
+	userinfo := []byte(`{"sub":"abc","address":{"country":"DE"},"phone":{"number":"1"}}`)
+
+	customClaims := structs.CustomClaims{}
+	assert.NoError(t, MapClaims(context.Background(), userinfo, &customClaims))
+	assert.Contains(t, customClaims.Claims, "address")
+	assert.NotContains(t, customClaims.Claims, "phone")
+
+	cfg.Cfg.RequiredClaims = []string{"address.country"}
+	assert.NoError(t, MapClaims(context.Background(), userinfo, &structs.CustomClaims{}))
+
+	cfg.Cfg.RequiredClaims = []string{"address.locality"}
+	assert.Error(t, MapClaims(context.Background(), userinfo, &structs.CustomClaims{}))
+}
+
+func TestMapClaimsClaimHeaders(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Configure()
+	defer func() { cfg.Cfg.Headers.ClaimHeaders = nil }()
+	cfg.Cfg.Headers.ClaimHeaders = map[string]string{"x-app-role": "realm_access.roles[0]", "x-app-team": "teams[0]"}
+
+	customClaims := structs.CustomClaims{}
+	assert.NoError(t, MapClaims(context.Background(), []byte(`{"sub":"abc","realm_access":{"roles":["admin"]},"teams":["x"],"phone":"1"}`), &customClaims))
+	assert.Contains(t, customClaims.Claims, "realm_access")
+	assert.Contains(t, customClaims.Claims, "teams")
+	assert.NotContains(t, customClaims.Claims, "phone")
+}
@@ -13,47 +13,136 @@ package common
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 
 	"github.com/vouch/vouch-proxy/pkg/cfg"
 	"github.com/vouch/vouch-proxy/pkg/structs"
+	"github.com/vouch/vouch-proxy/pkg/timelog"
 )
 
 var log *zap.SugaredLogger
 
+// ErrMissingClaim the IdP did not provide one of the `vouch.required_claims`
+var ErrMissingClaim = errors.New("token missing required claim")
+
+// ErrTenantNotAllowed the token was issued for a tenant which isn't one of `oauth.allowed_tenants`
+var ErrTenantNotAllowed = errors.New("token from a tenant which is not allowed")
+
+// Refused the user's claims were refused, which is the user's problem rather than the provider's
+func Refused(err error) bool {
+	return errors.Is(err, ErrMissingClaim) || errors.Is(err, ErrTenantNotAllowed) || errors.Is(err, ErrAccessTokenNotForUs)
+}
+
 // Configure see main.go configure()
 func Configure() {
 	log = cfg.Logging.Logger
+	std = configureHTTPClient()
+}
+
+// ConfigureInstance the clients of inst, see cfg.NewInstance()
+func ConfigureInstance(inst *cfg.Instance) {
+	log = cfg.Logging.Logger
+	inst.SetState(stateKey{}, configureHTTPClient())
 }
 
 // PrepareTokensAndClient setup the client, usually for a UserInfo request
 func PrepareTokensAndClient(r *http.Request, ptokens *structs.PTokens, setProviderToken bool, opts ...oauth2.AuthCodeOption) (*http.Client, *oauth2.Token, error) {
-	providerToken, err := cfg.OAuthClient.Exchange(context.TODO(), r.URL.Query().Get("code"), opts...)
+	return prepareTokensAndClient(r, cfg.OAuthClientWithRedirectURL(r.Context()), ptokens, setProviderToken, opts...)
+}
+
+// PrepareTokensAndClientWithSecret PrepareTokensAndClient, sending clientSecret rather than `oauth.client_secret`
+// for providers whose client secret is generated, such as Sign in with Apple
+func PrepareTokensAndClientWithSecret(r *http.Request, ptokens *structs.PTokens, clientSecret string, setProviderToken bool, opts ...oauth2.AuthCodeOption) (*http.Client, *oauth2.Token, error) {
+	oauthClient := cfg.OAuthClientWithRedirectURL(r.Context())
+	oauthClient.ClientSecret = clientSecret
+	return prepareTokensAndClient(r, oauthClient, ptokens, setProviderToken, opts...)
+}
+
+func prepareTokensAndClient(r *http.Request, oauthClient *oauth2.Config, ptokens *structs.PTokens, setProviderToken bool, opts ...oauth2.AuthCodeOption) (*http.Client, *oauth2.Token, error) {
+	ctx := providerContext(r.Context())
+	start := time.Now()
+	providerToken, err := oauthClient.Exchange(ctx, r.URL.Query().Get("code"), opts...)
+	timelog.Since(r, timelog.TimingToken, start)
 	if err != nil {
 		return nil, nil, err
 	}
+	if err := CheckAccessToken(ctx, providerToken.AccessToken); err != nil {
+		return nil, nil, err
+	}
 	ptokens.PAccessToken = providerToken.AccessToken
+	if cfg.OAuth(ctx).UseRefreshTokens {
+		ptokens.PRefreshToken = providerToken.RefreshToken
+		ptokens.PExpiry = providerToken.Expiry
+	}
 
 	if setProviderToken {
 		if providerToken.Extra("id_token") != nil {
 			// Certain providers (eg. gitea) don't provide an id_token
 			// and it's not necessary for the authentication phase
 			ptokens.PIdToken = providerToken.Extra("id_token").(string)
+			if _, err := VerifyIDToken(ctx, ptokens.PIdToken); err != nil {
+				return nil, nil, err
+			}
 		} else {
 			log.Debugf("id_token missing - may not be supported by this provider")
 		}
 	}
 
 	log.Debugf("ptokens: accessToken length: %d, IdToken length: %d", len(ptokens.PAccessToken), len(ptokens.PIdToken))
-	client := cfg.OAuthClient.Client(context.TODO(), providerToken)
+	client := oauthClient.Client(ctx, providerToken)
 	return client, providerToken, err
 }
 
+// AuthCodeOptionValues the parameters set by opts, such as the PKCE `code_verifier`,
+// for providers which build their own token request rather than using oauth2.Config.Exchange()
+func AuthCodeOptionValues(opts ...oauth2.AuthCodeOption) url.Values {
+	// oauth2 only applies the options itself, to the query of an authorization url
+	u, err := url.Parse((&oauth2.Config{}).AuthCodeURL("", opts...))
+	if err != nil {
+		return url.Values{}
+	}
+	v := u.Query()
+	v.Del("response_type")
+	v.Del("client_id")
+	return v
+}
+
+// RefreshTokens new tokens from the provider (of ctx, see cfg.OAuth()) for the refresh token, see `oauth.use_refresh_tokens`
+// the provider may or may not rotate the refresh token, if it doesn't the one given is kept
+func RefreshTokens(ctx context.Context, refreshToken string) (*structs.PTokens, error) {
+	ctx = providerContext(ctx)
+	providerToken, err := cfg.OAuth(ctx).Client().TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckAccessToken(ctx, providerToken.AccessToken); err != nil {
+		return nil, err
+	}
+	ptokens := &structs.PTokens{
+		PAccessToken:  providerToken.AccessToken,
+		PRefreshToken: providerToken.RefreshToken,
+		PExpiry:       providerToken.Expiry,
+	}
+	if idToken, ok := providerToken.Extra("id_token").(string); ok && idToken != "" {
+		if _, err := VerifyIDToken(ctx, idToken); err != nil {
+			return nil, err
+		}
+		ptokens.PIdToken = idToken
+	}
+	return ptokens, nil
+}
+
 // MapClaims populate CustomClaims from userInfo for each configure claims header
-func MapClaims(claims []byte, customClaims *structs.CustomClaims) error {
+// the userinfo is from the provider of ctx, see cfg.OAuth()
+func MapClaims(ctx context.Context, claims []byte, customClaims *structs.CustomClaims) error {
 	var f interface{}
 	err := json.Unmarshal(claims, &f)
 	if err != nil {
@@ -61,13 +150,66 @@ func MapClaims(claims []byte, customClaims *structs.CustomClaims) error {
 		return err
 	}
 	m := f.(map[string]interface{})
+	normalizeEmail(ctx, m)
+	if err := checkRequiredClaims(ctx, m); err != nil {
+		return err
+	}
+	if err := checkTenant(ctx, m); err != nil {
+		return err
+	}
+	c := cfg.FromContext(ctx)
 	for k := range m {
-		var found = false
-		for claim := range cfg.Cfg.Headers.ClaimsCleaned {
+		var found = k != "" && (k == c.Headers.UIDClaim || k == c.Session.SIDClaim)
+		for claim := range c.Headers.ClaimsCleaned {
+			if claimIn(k, claim) {
+				found = true
+			}
+		}
+		// the claims passed in headers.claim_headers
+		for _, claim := range c.Headers.ClaimHeaders {
+			if claimIn(k, claim) {
+				found = true
+			}
+		}
+		// the claim naming the tenant whose domain the cookie is scoped to
+		if k != "" && k == c.Cookie.TenantClaim {
+			found = true
+		}
+		// the claims split by claim_transforms
+		for _, t := range c.ClaimTransforms {
+			if k == t.Claim {
+				found = true
+			}
+		}
+		// the claims in the profile cookie
+		for _, claim := range c.Cookie.Profile.Claims {
 			if k == claim {
 				found = true
 			}
 		}
+		// the claims used to derive the role
+		for _, rule := range c.Roles.Rules {
+			if claimIn(k, rule.Claim) {
+				found = true
+			}
+		}
+		// the claims choosing the post_logout_redirect_rules
+		for _, rule := range c.PostLogoutRedirectRules {
+			if claimIn(k, rule.Claim) {
+				found = true
+			}
+		}
+		// the groups claim, fetched again every `groups.refresh_interval` and reissued in the jwt
+		// or checked against `lockdown.allow_groups` at login
+		if (c.Groups.RefreshInterval > 0 || len(c.Lockdown.AllowGroups) > 0) && claimIn(k, c.Groups.Claim) {
+			found = true
+		}
+		// the claims checked by the deny_rules
+		for _, rule := range c.DenyRules {
+			if claimIn(k, rule.Claim) {
+				found = true
+			}
+		}
 		if found == false {
 			delete(m, k)
 		}
@@ -75,3 +217,32 @@ func MapClaims(claims []byte, customClaims *structs.CustomClaims) error {
 	customClaims.Claims = m
 	return nil
 }
+
+// checkTenant with `oauth.allowed_tenants` the token's `oauth.tenant_claim` must name one of them
+// tenant ids such as Azure AD's GUIDs are compared without regard to case
+func checkTenant(ctx context.Context, m map[string]interface{}) error {
+	provider := cfg.OAuth(ctx)
+	if len(provider.AllowedTenants) == 0 {
+		return nil
+	}
+	v, _ := ClaimValue(m, provider.TenantClaim)
+	tenant, _ := v.(string)
+	if tenant != "" {
+		for _, allowed := range provider.AllowedTenants {
+			if strings.EqualFold(tenant, allowed) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: %s %q", ErrTenantNotAllowed, provider.TenantClaim, tenant)
+}
+
+// checkRequiredClaims each of `vouch.required_claims` must be present and not be null or an empty string
+func checkRequiredClaims(ctx context.Context, m map[string]interface{}) error {
+	for _, claim := range cfg.FromContext(ctx).RequiredClaims {
+		if v, ok := ClaimValue(m, claim); !ok || v == nil || v == "" {
+			return fmt.Errorf("%w %s", ErrMissingClaim, claim)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestMapClaimsRequiredClaims(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Configure()
+	cfg.Cfg.RequiredClaims = []string{"email", "groups"}
+	defer func() { cfg.Cfg.RequiredClaims = nil }()
+
+	tests := []struct {
+		name        string
+		userinfo    string
+		wantMissing string
+	}{
+		{"all present", `{"sub":"abc","email":"test@example.com","groups":["staff"]}`, ""},
+		{"email missing", `{"sub":"abc","groups":["staff"]}`, "email"},
+		{"email null", `{"sub":"abc","email":null,"groups":["staff"]}`, "email"},
+		{"email empty", `{"sub":"abc","email":"","groups":["staff"]}`, "email"},
+		{"groups missing", `{"sub":"abc","email":"test@example.com"}`, "groups"},
+		{"groups null", `{"sub":"abc","email":"test@example.com","groups":null}`, "groups"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := MapClaims(context.Background(), []byte(tt.userinfo), &structs.CustomClaims{})
+			if tt.wantMissing == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, ErrMissingClaim))
+			assert.EqualError(t, err, "token missing required claim "+tt.wantMissing)
+		})
+	}
+}
+
+func TestMapClaimsKeepsRoleClaims(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Configure()
+	cfg.Cfg.Roles.Rules = []cfg.RoleRule{{Role: "admin", Claim: "groups", Values: []string{"platform-admins"}}}
+	defer func() { cfg.Cfg.Roles.Rules = nil }()
+
+	customClaims := structs.CustomClaims{}
+	assert.NoError(t, MapClaims(context.Background(), []byte(`{"sub":"abc","groups":["platform-admins"],"locale":"en"}`), &customClaims))
+	assert.Contains(t, customClaims.Claims, "groups")
+	assert.NotContains(t, customClaims.Claims, "locale")
+}
+
+func TestMapClaimsAllowedTenants(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Configure()
+	assert.Equal(t, "tid", cfg.GenOAuth.TenantClaim)
+	cfg.GenOAuth.AllowedTenants = []string{"72f988bf-86f1-41af-91ab-2d7cd011db47"}
+	defer func() { cfg.GenOAuth.AllowedTenants = nil }()
+
+	tests := []struct {
+		name    string
+		token   string
+		allowed bool
+	}{
+		{"allowed tenant", `{"sub":"abc","tid":"72f988bf-86f1-41af-91ab-2d7cd011db47"}`, true},
+		{"allowed tenant in upper case", `{"sub":"abc","tid":"72F988BF-86F1-41AF-91AB-2D7CD011DB47"}`, true},
+		{"other tenant", `{"sub":"abc","tid":"9188040d-6c67-4c5b-b112-36a304b66dad"}`, false},
+		{"no tenant", `{"sub":"abc"}`, false},
+		{"tenant not a string", `{"sub":"abc","tid":["72f988bf-86f1-41af-91ab-2d7cd011db47"]}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := MapClaims(context.Background(), []byte(tt.token), &structs.CustomClaims{})
+			if tt.allowed {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, ErrTenantNotAllowed))
+			assert.True(t, Refused(err))
+		})
+	}
+}
+
+func TestAuthCodeOptionValues(t *testing.T) {
+	v := AuthCodeOptionValues(oauth2.SetAuthURLParam("code_verifier", "verifier"), oauth2.SetAuthURLParam("code_challenge", "challenge"))
+	assert.Equal(t, url.Values{"code_verifier": {"verifier"}, "code_challenge": {"challenge"}}, v)
+	assert.Empty(t, AuthCodeOptionValues())
+}
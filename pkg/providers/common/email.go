@@ -0,0 +1,86 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// NormalizeEmail userinfo whose `email` is a list (or which only has `emails`) is rewritten with a single `email`
+// chosen per `oauth.email_select` so that it can be unmarshaled into a structs.User
+// any other userinfo is returned as it is
+func NormalizeEmail(ctx context.Context, userinfo []byte) []byte {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(userinfo, &m); err != nil {
+		return userinfo
+	}
+	if !normalizeEmail(ctx, m) {
+		return userinfo
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return userinfo
+	}
+	return b
+}
+
+// normalizeEmail replace a list of addresses in the claims with one, returns true if the claims were changed
+// the list may hold strings, or objects such as GitHub's {"email", "verified", "primary"} or SCIM's {"value", "primary"}
+func normalizeEmail(ctx context.Context, m map[string]interface{}) bool {
+	v, ok := m["email"]
+	if !ok || v == nil {
+		if v, ok = m["emails"]; !ok {
+			return false
+		}
+	}
+	switch e := v.(type) {
+	case string:
+		if _, ok := m["email"].(string); ok {
+			return false
+		}
+		m["email"] = e
+	case []interface{}:
+		m["email"] = chooseEmail(e, m["email_verified"] == true, cfg.OAuth(ctx).EmailSelect)
+	default:
+		return false
+	}
+	return true
+}
+
+// chooseEmail the first address, or with `first_verified` the first which is verified
+// a plain string in the list counts as verified if the claims carry `email_verified: true`
+func chooseEmail(emails []interface{}, allVerified bool, emailSelect string) string {
+	for _, e := range emails {
+		var addr string
+		verified := allVerified
+		switch v := e.(type) {
+		case string:
+			addr = v
+		case map[string]interface{}:
+			addr, _ = v["email"].(string)
+			if addr == "" {
+				addr, _ = v["value"].(string)
+			}
+			verified = v["verified"] == true
+		}
+		if addr == "" {
+			continue
+		}
+		if emailSelect == cfg.EmailFirstVerified && !verified {
+			continue
+		}
+		return addr
+	}
+	return ""
+}
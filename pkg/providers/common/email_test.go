@@ -0,0 +1,73 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Configure()
+	defer func() { cfg.GenOAuth.EmailSelect = cfg.EmailFirst }()
+
+	tests := []struct {
+		name     string
+		selectBy string
+		userinfo string
+		want     string
+	}{
+		{"scalar", cfg.EmailFirst, `{"email":"test@example.com"}`, "test@example.com"},
+		{"list", cfg.EmailFirst, `{"email":["test@example.com","x@other.com"]}`, "test@example.com"},
+		{"empty list", cfg.EmailFirst, `{"email":[]}`, ""},
+		{"emails fallback", cfg.EmailFirst, `{"emails":["test@example.com","x@other.com"]}`, "test@example.com"},
+		{"scim objects", cfg.EmailFirst, `{"emails":[{"value":"test@example.com","primary":true}]}`, "test@example.com"},
+		{"first ignores verified", cfg.EmailFirst,
+			`{"email":[{"email":"x@other.com","verified":false},{"email":"test@example.com","verified":true}]}`, "x@other.com"},
+		{"first verified", cfg.EmailFirstVerified,
+			`{"email":[{"email":"x@other.com","verified":false},{"email":"test@example.com","verified":true}]}`, "test@example.com"},
+		{"first verified none verified", cfg.EmailFirstVerified,
+			`{"email":[{"email":"x@other.com"},{"email":"test@example.com","verified":false}]}`, ""},
+		{"first verified strings with email_verified", cfg.EmailFirstVerified,
+			`{"email":["test@example.com","x@other.com"],"email_verified":true}`, "test@example.com"},
+		{"first verified strings unverified", cfg.EmailFirstVerified, `{"email":["test@example.com"]}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.GenOAuth.EmailSelect = tt.selectBy
+			user := structs.User{}
+			assert.NoError(t, json.Unmarshal(NormalizeEmail(context.Background(), []byte(tt.userinfo)), &user))
+			assert.Equal(t, tt.want, user.Email)
+		})
+	}
+}
+
+func TestMapClaimsEmailList(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Configure()
+	cfg.Cfg.Headers.ClaimsCleaned = map[string]string{"email": "X-Vouch-Idp-Claims-Email"}
+	cfg.Cfg.RequiredClaims = []string{"email"}
+	defer func() {
+		cfg.Cfg.Headers.ClaimsCleaned = nil
+		cfg.Cfg.RequiredClaims = nil
+	}()
+
+	customClaims := structs.CustomClaims{}
+	assert.NoError(t, MapClaims(context.Background(), []byte(`{"sub":"abc","email":["test@example.com","x@other.com"]}`), &customClaims))
+	assert.Equal(t, "test@example.com", customClaims.Claims["email"])
+}
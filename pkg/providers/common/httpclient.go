@@ -0,0 +1,67 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// state the transport and timeout of requests to the IdP per `vouch.oauth_client` of an Instance, see configureHTTPClient()
+type state struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+type stateKey struct{}
+
+// std the state of the package configuration, for a request without a cfg.Instance
+var std = &state{transport: http.DefaultTransport, timeout: 10 * time.Second}
+
+// stateOf the state of the cfg.Instance of ctx, otherwise std
+func stateOf(ctx context.Context) *state {
+	if s, ok := cfg.State(ctx, stateKey{}).(*state); ok {
+		return s
+	}
+	return std
+}
+
+// HTTPClient a client for requests to the IdP, bounded by `vouch.oauth_client.timeout`
+// and trusting the CAs of `vouch.oauth_client.ca_bundle`, those of the cfg.Instance of ctx
+func HTTPClient(ctx context.Context) *http.Client {
+	s := stateOf(ctx)
+	return &http.Client{Timeout: s.timeout, Transport: s.transport}
+}
+
+// RateLimitedHTTPClient HTTPClient, which also handles a 429 per `oauth.rate_limit`, see RateLimitTransport()
+func RateLimitedHTTPClient(ctx context.Context) *http.Client {
+	s := stateOf(ctx)
+	return &http.Client{Timeout: s.timeout, Transport: RateLimitTransport(s.transport)}
+}
+
+func configureHTTPClient() *state {
+	s := &state{transport: http.DefaultTransport, timeout: time.Duration(cfg.Cfg.OAuthClient.Timeout) * time.Second}
+	tlsConfig, err := cfg.Cfg.OAuthClientTLSConfig()
+	if err != nil {
+		// already refused by the config's validation
+		log.Errorf("oauth_client: %s", err)
+		return s
+	}
+	if tlsConfig != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = tlsConfig
+		s.transport = t
+	}
+	return s
+}
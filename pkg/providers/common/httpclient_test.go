@@ -0,0 +1,79 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestHTTPClient(t *testing.T) {
+	// an IdP with a self-signed certificate
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600))
+
+	tests := []struct {
+		name               string
+		caBundle           string
+		insecureSkipVerify bool
+		wantErr            bool
+	}{
+		{"unknown CA", "", false, true},
+		{"ca_bundle", bundle, false, false},
+		{"insecure_skip_verify", "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.InitForTestPurposes()
+			cfg.Cfg.OAuthClient.CABundle = tt.caBundle
+			cfg.Cfg.OAuthClient.InsecureSkipVerify = tt.insecureSkipVerify
+			Configure()
+			defer Configure()
+
+			for _, client := range []*http.Client{HTTPClient(context.Background()), RateLimitedHTTPClient(context.Background())} {
+				resp, err := client.Get(ts.URL)
+				if tt.wantErr {
+					assert.Error(t, err)
+					continue
+				}
+				assert.NoError(t, err)
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+func TestHTTPClientTimeout(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Configure()
+	assert.Equal(t, 10*time.Second, HTTPClient(context.Background()).Timeout)
+
+	cfg.Cfg.OAuthClient.Timeout = 3
+	Configure()
+	defer func() {
+		cfg.Cfg.OAuthClient.Timeout = 10
+		Configure()
+	}()
+	assert.Equal(t, 3*time.Second, HTTPClient(context.Background()).Timeout)
+	assert.Equal(t, 3*time.Second, RateLimitedHTTPClient(context.Background()).Timeout)
+}
@@ -0,0 +1,364 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+var (
+	errAlgNotAllowed = errors.New("id_token signing algorithm not allowed")
+	errNoKey         = errors.New("no key found to verify id_token")
+	errNonceMismatch = errors.New("id_token nonce does not match the one sent with the authorization request")
+	errAudience      = errors.New("id_token was not issued for this client_id")
+
+	// the keys fetched from the oauth.jwks_url of each provider, by url, shared by each cfg.Instance
+	jwks = map[string]*jwkSet{}
+	// jwksMu guards jwks, not the sets in it
+	jwksMu sync.Mutex
+)
+
+// jwkSet keys fetched from an oauth.jwks_url, by kid
+type jwkSet struct {
+	// mu guards the fields, it is never held while fetching
+	mu      sync.Mutex
+	keys    map[string]jwk
+	fetched time.Time
+	// fetching is closed once the fetch in flight is done, nil when there is none, err is that of the last fetch
+	fetching chan struct{}
+	err      error
+}
+
+// jwk a public key and the `alg` the IdP signs with it, "" if the key doesn't say
+type jwk struct {
+	key interface{}
+	alg string
+}
+
+// an unknown kid causes a refetch of oauth.jwks_url, but no more often than this
+const jwksRefetchInterval = time.Minute
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// VerifyIDToken check the id_token's `alg` against `oauth.id_token_signing_algs`
+// and, when `oauth.jwks_url` is configured, verify its signature
+// the id_token is from the provider of ctx, see cfg.OAuth()
+// when ctx carries the nonce sent at /login (see cfg.IDTokenNonceCtxKey) the id_token's `nonce` must match it
+// returns the decoded payload of the id_token
+func VerifyIDToken(ctx context.Context, idToken string) ([]byte, error) {
+	provider := cfg.OAuth(ctx)
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id_token: invalid token received; not enough parts")
+	}
+
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		alg, _ := token.Header["alg"].(string)
+		if !algAllowed(alg, provider.IDTokenSigningAlgs) {
+			return nil, fmt.Errorf("%w: %s", errAlgNotAllowed, alg)
+		}
+		if provider.JWKSURL == "" {
+			return nil, nil
+		}
+		switch token.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			// per OIDC the client_secret is the key, never a public key, and an empty key is no key at all
+			if provider.ClientSecret == "" {
+				return nil, fmt.Errorf("%w: %s without a client_secret", errAlgNotAllowed, alg)
+			}
+			return []byte(provider.ClientSecret), nil
+		default:
+			kid, _ := token.Header["kid"].(string)
+			k, err := jwksKey(ctx, provider.JWKSURL, kid)
+			if err != nil {
+				return nil, err
+			}
+			// a key which names its algorithm is never used with another
+			if k.alg != "" && k.alg != alg {
+				return nil, fmt.Errorf("%w: %s with the %s key %s", errAlgNotAllowed, alg, k.alg, kid)
+			}
+			return k.key, nil
+		}
+	}
+
+	if provider.JWKSURL == "" {
+		// without keys the best we can do is to refuse unexpected algorithms
+		token, _, err := new(jwt.Parser).ParseUnverified(idToken, jwt.MapClaims{})
+		if err != nil {
+			return nil, fmt.Errorf("id_token: %w", err)
+		}
+		if _, err := keyFunc(token); err != nil {
+			return nil, err
+		}
+		log.Debugf("id_token signature not verified, oauth.jwks_url is not configured")
+	} else {
+		if _, err := jwt.Parse(idToken, keyFunc); err != nil {
+			var verr *jwt.ValidationError
+			if errors.As(err, &verr) && verr.Inner != nil {
+				err = verr.Inner
+			}
+			return nil, fmt.Errorf("id_token: %w", err)
+		}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNonce(ctx, payload); err != nil {
+		return nil, err
+	}
+	if provider.AudienceCheck() {
+		if err := checkAudience(payload, provider.ClientID); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+// checkAudience the `aud` of the id_token payload, a string or an array of strings, must include clientID
+func checkAudience(payload []byte, clientID string) error {
+	var claims struct {
+		Aud interface{} `json:"aud"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("id_token: %w", err)
+	}
+	switch aud := claims.Aud.(type) {
+	case string:
+		if aud == clientID {
+			return nil
+		}
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: aud %v", errAudience, claims.Aud)
+}
+
+// checkNonce the `nonce` of the id_token payload against the one sent at /login, if ctx carries one
+func checkNonce(ctx context.Context, payload []byte) error {
+	expected, ok := ctx.Value(cfg.IDTokenNonceCtxKey).(string)
+	if !ok {
+		return nil
+	}
+	var claims struct {
+		Nonce string `json:"nonce"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("id_token: %w", err)
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(expected)) != 1 {
+		return errNonceMismatch
+	}
+	return nil
+}
+
+func algAllowed(alg string, allowed []string) bool {
+	if alg == "" || strings.EqualFold(alg, "none") {
+		return false
+	}
+	for _, a := range allowed {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// jwksKey find the key for kid, fetching jwksURL if it's not known yet (the IdP may have rotated keys)
+func jwksKey(ctx context.Context, jwksURL string, kid string) (jwk, error) {
+	set := jwkSetFor(jwksURL)
+	if k, ok := set.lookup(kid); ok {
+		return k, nil
+	}
+	if err := set.refresh(ctx, jwksURL, false); err != nil {
+		return jwk{}, err
+	}
+	if k, ok := set.lookup(kid); ok {
+		return k, nil
+	}
+	return jwk{}, fmt.Errorf("%w: kid %s", errNoKey, kid)
+}
+
+// LoadJWKS fetch the keys at a provider's `oauth.jwks_url`, for the startup self-test
+// an error if none of them can be used to verify an id_token
+func LoadJWKS(ctx context.Context, jwksURL string) error {
+	set := jwkSetFor(jwksURL)
+	if err := set.refresh(ctx, jwksURL, true); err != nil {
+		return err
+	}
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if len(set.keys) == 0 {
+		return fmt.Errorf("%w: %s has no signing keys", errNoKey, jwksURL)
+	}
+	return nil
+}
+
+// jwkSetFor the keys of jwksURL
+func jwkSetFor(jwksURL string) *jwkSet {
+	jwksMu.Lock()
+	defer jwksMu.Unlock()
+	set, ok := jwks[jwksURL]
+	if !ok {
+		set = &jwkSet{keys: map[string]jwk{}}
+		jwks[jwksURL] = set
+	}
+	return set
+}
+
+// lookup the key for kid, or the single key of a set whose key has no kid
+func (set *jwkSet) lookup(kid string) (jwk, bool) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if k, ok := set.keys[kid]; ok {
+		return k, true
+	}
+	if kid == "" && len(set.keys) == 1 {
+		for _, k := range set.keys {
+			return k, true
+		}
+	}
+	return jwk{}, false
+}
+
+// refresh fetch the keys again unless they were fetched within jwksRefetchInterval, or force
+// a caller finding a fetch in flight waits for it rather than fetching again
+func (set *jwkSet) refresh(ctx context.Context, jwksURL string, force bool) error {
+	set.mu.Lock()
+	if done := set.fetching; done != nil {
+		set.mu.Unlock()
+		<-done
+		set.mu.Lock()
+		defer set.mu.Unlock()
+		return set.err
+	}
+	if !force && time.Since(set.fetched) <= jwksRefetchInterval {
+		set.mu.Unlock()
+		return nil
+	}
+	done := make(chan struct{})
+	set.fetching = done
+	set.mu.Unlock()
+
+	keys, err := fetchJWKS(ctx, jwksURL)
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if err == nil {
+		set.keys, set.fetched = keys, time.Now()
+	}
+	set.err, set.fetching = err, nil
+	close(done)
+	return err
+}
+
+// fetchJWKS the signing keys at jwksURL, by kid, with the HTTPClient of ctx
+func fetchJWKS(ctx context.Context, jwksURL string) (map[string]jwk, error) {
+	log.Debugf("fetching keys from %s", jwksURL)
+	// #nosec - the url is from the config
+	resp, err := HTTPClient(ctx).Get(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", jwksURL, resp.Status)
+	}
+	var body struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", jwksURL, err)
+	}
+	keys := make(map[string]jwk, len(body.Keys))
+	for _, k := range body.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warnf("skipping key %s from %s: %s", k.Kid, jwksURL, err)
+			continue
+		}
+		keys[k.Kid] = jwk{key: key, alg: k.Alg}
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
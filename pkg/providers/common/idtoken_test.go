@@ -0,0 +1,329 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+var idTokenClaims = jwt.MapClaims{"sub": "testuser", "email": "test@example.com", "exp": time.Now().Add(time.Hour).Unix()}
+
+func setUpIDToken(t *testing.T) (*rsa.PrivateKey, *httptest.Server) {
+	cfg.InitForTestPurposes()
+	Configure()
+	cfg.GenOAuth.IDTokenSigningAlgs = []string{"RS256"}
+	jwks = map[string]*jwkSet{}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{{
+			Kid: "key1",
+			Kty: "RSA",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	}))
+	cfg.GenOAuth.JWKSURL = ts.URL
+	return key, ts
+}
+
+func signIDToken(t *testing.T, method jwt.SigningMethod, key interface{}) string {
+	token := jwt.NewWithClaims(method, idTokenClaims)
+	token.Header["kid"] = "key1"
+	ss, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return ss
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	key, ts := setUpIDToken(t)
+	defer ts.Close()
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+
+	tests := []struct {
+		name    string
+		idToken string
+		wantErr bool
+	}{
+		{"RS256", signIDToken(t, jwt.SigningMethodRS256, key), false},
+		{"alg none", signIDToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType), true},
+		{"HS256 signed with the public key", signIDToken(t, jwt.SigningMethodHS256, pubPEM), true},
+		{"RS384 not in the allowlist", signIDToken(t, jwt.SigningMethodRS384, key), true},
+		{"RS256 signed with another key", signIDToken(t, jwt.SigningMethodRS256, otherKey), true},
+		{"not a jwt", "not.a.jwt", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := VerifyIDToken(context.Background(), tt.idToken)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Contains(t, string(payload), "test@example.com")
+		})
+	}
+
+	// an HMAC is keyed with the client_secret, a client without one refuses it rather than use an empty key
+	cfg.GenOAuth.IDTokenSigningAlgs = []string{"RS256", "HS256"}
+	cfg.GenOAuth.ClientSecret = ""
+	_, err := VerifyIDToken(context.Background(), signIDToken(t, jwt.SigningMethodHS256, []byte("")))
+	assert.True(t, errors.Is(err, errAlgNotAllowed), "err = %v", err)
+	cfg.GenOAuth.ClientSecret = "secret"
+	_, err = VerifyIDToken(context.Background(), signIDToken(t, jwt.SigningMethodHS256, []byte("secret")))
+	assert.NoError(t, err)
+}
+
+func TestLoadJWKS(t *testing.T) {
+	_, ts := setUpIDToken(t)
+	assert.NoError(t, LoadJWKS(context.Background(), ts.URL))
+	assert.Contains(t, jwks[ts.URL].keys, "key1")
+
+	jwks = map[string]*jwkSet{}
+	ts.Close()
+	assert.Error(t, LoadJWKS(context.Background(), ts.URL))
+
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"keys":[]}`))
+	}))
+	defer empty.Close()
+	err := LoadJWKS(context.Background(), empty.URL)
+	assert.True(t, errors.Is(err, errNoKey), "err = %v", err)
+}
+
+// each provider's id_tokens are verified with the keys at its own jwks_url
+func TestVerifyIDTokenOfProvider(t *testing.T) {
+	key, ts := setUpIDToken(t)
+	defer ts.Close()
+	other := *cfg.GenOAuth
+	other.Name = "other"
+	other.JWKSURL = ""
+	cfg.OAuthConfigs = append(cfg.OAuthConfigs, &other)
+	ctx := cfg.WithOAuth(context.Background(), &other)
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, err := VerifyIDToken(ctx, signIDToken(t, jwt.SigningMethodRS256, otherKey))
+	assert.NoError(t, err, "without a jwks_url the signature isn't verified")
+	_, err = VerifyIDToken(context.Background(), signIDToken(t, jwt.SigningMethodRS256, otherKey))
+	assert.Error(t, err)
+
+	other.IDTokenSigningAlgs = []string{"ES256"}
+	_, err = VerifyIDToken(ctx, signIDToken(t, jwt.SigningMethodRS256, key))
+	assert.True(t, errors.Is(err, errAlgNotAllowed), "err = %v", err)
+}
+
+// without oauth.id_token_signing_algs an IdP signing with ES256 is accepted, with the key's `alg` if it names one
+func TestVerifyIDTokenDefaultAlgs(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Configure()
+	assert.Contains(t, cfg.GenOAuth.IDTokenSigningAlgs, "ES256")
+	jwks = map[string]*jwkSet{}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{
+			{Kid: "key1", Kty: "EC", Crv: "P-256", X: base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes()), Y: base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes())},
+			{Kid: "key2", Kty: "RSA", Alg: "RS256", N: base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()), E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+		}})
+	}))
+	defer ts.Close()
+	cfg.GenOAuth.JWKSURL = ts.URL
+
+	_, err = VerifyIDToken(context.Background(), signIDToken(t, jwt.SigningMethodES256, ecKey))
+	assert.NoError(t, err)
+
+	withKid := func(method jwt.SigningMethod, kid string) string {
+		token := jwt.NewWithClaims(method, idTokenClaims)
+		token.Header["kid"] = kid
+		ss, err := token.SignedString(rsaKey)
+		assert.NoError(t, err)
+		return ss
+	}
+	_, err = VerifyIDToken(context.Background(), withKid(jwt.SigningMethodRS256, "key2"))
+	assert.NoError(t, err)
+	_, err = VerifyIDToken(context.Background(), withKid(jwt.SigningMethodPS256, "key2"))
+	assert.True(t, errors.Is(err, errAlgNotAllowed), "the key is for RS256, err = %v", err)
+}
+
+// a fetch of one jwks_url holds up neither the keys of another nor a second fetch of its own
+func TestJWKSFetchUnlocked(t *testing.T) {
+	_, ts := setUpIDToken(t)
+	defer ts.Close()
+	_, err := jwksKey(context.Background(), ts.URL, "key1")
+	assert.NoError(t, err)
+
+	var fetches int32
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		_, _ = w.Write([]byte(`{"keys":[]}`))
+	}))
+	defer slow.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := jwksKey(context.Background(), slow.URL, "rotated")
+			assert.True(t, errors.Is(err, errNoKey), "err = %v", err)
+		}()
+	}
+
+	found := make(chan error)
+	go func() {
+		_, err := jwksKey(context.Background(), ts.URL, "key1")
+		found <- err
+	}()
+	select {
+	case err := <-found:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Error("the keys of another jwks_url waited for the fetch")
+	}
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+}
+
+func TestVerifyIDTokenWithoutJWKS(t *testing.T) {
+	key, ts := setUpIDToken(t)
+	ts.Close()
+	cfg.GenOAuth.JWKSURL = ""
+
+	_, err := VerifyIDToken(context.Background(), signIDToken(t, jwt.SigningMethodRS256, key))
+	assert.NoError(t, err)
+
+	// the algorithm is still checked
+	_, err = VerifyIDToken(context.Background(), signIDToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType))
+	assert.True(t, errors.Is(err, errAlgNotAllowed), "err = %v", err)
+	_, err = VerifyIDToken(context.Background(), signIDToken(t, jwt.SigningMethodHS256, []byte("secret")))
+	assert.True(t, errors.Is(err, errAlgNotAllowed), "err = %v", err)
+}
+
+func TestVerifyIDTokenNonce(t *testing.T) {
+	key, ts := setUpIDToken(t)
+	defer ts.Close()
+
+	withNonce := func(nonce string) string {
+		claims := jwt.MapClaims{"sub": "testuser", "exp": time.Now().Add(time.Hour).Unix()}
+		if nonce != "" {
+			claims["nonce"] = nonce
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "key1"
+		ss, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return ss
+	}
+	ctx := context.WithValue(context.Background(), cfg.IDTokenNonceCtxKey, "n0nce")
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		idToken string
+		wantErr bool
+	}{
+		{"matching nonce", ctx, withNonce("n0nce"), false},
+		{"other nonce", ctx, withNonce("other"), true},
+		{"no nonce", ctx, withNonce(""), true},
+		{"nonce expected but not known", context.WithValue(context.Background(), cfg.IDTokenNonceCtxKey, ""), withNonce(""), true},
+		{"no nonce expected", context.Background(), withNonce("other"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := VerifyIDToken(tt.ctx, tt.idToken)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, errNonceMismatch), "err = %v", err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestVerifyIDTokenAudience(t *testing.T) {
+	key, ts := setUpIDToken(t)
+	defer ts.Close()
+	cfg.GenOAuth.Provider = cfg.Providers.OIDC
+	cfg.GenOAuth.ClientID = "vouch"
+
+	withAud := func(aud interface{}) string {
+		claims := jwt.MapClaims{"sub": "testuser", "exp": time.Now().Add(time.Hour).Unix()}
+		if aud != nil {
+			claims["aud"] = aud
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "key1"
+		ss, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return ss
+	}
+
+	tests := []struct {
+		name     string
+		provider string
+		skip     bool
+		idToken  string
+		wantErr  bool
+	}{
+		{"client_id", cfg.Providers.OIDC, false, withAud("vouch"), false},
+		{"one of the audiences", cfg.Providers.OIDC, false, withAud([]string{"api", "vouch"}), false},
+		{"another client", cfg.Providers.OIDC, false, withAud("other-client"), true},
+		{"none of the audiences", cfg.Providers.OIDC, false, withAud([]string{"api", "other-client"}), true},
+		{"no aud", cfg.Providers.OIDC, false, withAud(nil), true},
+		{"adfs", cfg.Providers.ADFS, false, withAud("other-client"), true},
+		{"skip_audience_check", cfg.Providers.OIDC, true, withAud("other-client"), false},
+		{"not checked for other providers", cfg.Providers.Google, false, withAud("other-client"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.GenOAuth.Provider = tt.provider
+			cfg.GenOAuth.SkipAudienceCheck = tt.skip
+			_, err := VerifyIDToken(context.Background(), tt.idToken)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, errAudience), "err = %v", err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,154 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/tracing"
+)
+
+// RateLimitError the provider answered 429 Too Many Requests and the request wasn't retried
+type RateLimitError struct {
+	URL string
+	// RetryAfter the wait asked for in the provider's `Retry-After` header, 0 if it didn't say
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited by the provider at %s, retry after %s", e.URL, e.RetryAfter)
+	}
+	return fmt.Sprintf("rate limited by the provider at %s", e.URL)
+}
+
+// RetryAfterSeconds the RetryAfter rounded up to whole seconds
+func (e *RateLimitError) RetryAfterSeconds() int {
+	return int((e.RetryAfter + time.Second - 1) / time.Second)
+}
+
+// the wait between retries is swapped out by tests
+var sleep = defaultSleep
+
+func defaultSleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RateLimitTransport handles a 429 from the provider per `oauth.rate_limit`
+// the request is retried up to `retries` times if the provider's `Retry-After` is no longer than `max_wait`,
+// otherwise the 429 is returned as a *RateLimitError
+func RateLimitTransport(next http.RoundTripper) http.RoundTripper {
+	return &rateLimitTransport{next: next}
+}
+
+type rateLimitTransport struct {
+	next http.RoundTripper
+	// provider the context whose provider's `oauth.rate_limit` applies, otherwise that of the request, see cfg.OAuth()
+	provider context.Context
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if t.provider != nil {
+		ctx = t.provider
+	}
+	limit := cfg.OAuth(ctx).RateLimit
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+		retryAfter, hinted := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		drain(resp.Body)
+
+		rl := &RateLimitError{URL: req.URL.Redacted(), RetryAfter: retryAfter}
+		// without a hint from the provider a retry could only add to its load
+		if !hinted || attempt >= limit.Retries ||
+			retryAfter > time.Duration(limit.MaxWait)*time.Second {
+			return nil, rl
+		}
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, rl
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, rl
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		log.Infof("%s, retrying (%d of %d)", rl, attempt+1, limit.Retries)
+		if err := sleep(req.Context(), retryAfter); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseRetryAfter the `Retry-After` header as either seconds or an HTTP date
+// false if there's no usable header
+func parseRetryAfter(h string, now time.Time) (time.Duration, bool) {
+	h = strings.TrimSpace(h)
+	if h == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	when, err := http.ParseTime(h)
+	if err != nil {
+		return 0, false
+	}
+	if d := when.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+func drain(body io.ReadCloser) {
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(body, 4096))
+	_ = body.Close()
+}
+
+// providerContext carries a client which handles a 429 per `oauth.rate_limit` of the provider of the request (ctx)
+// into the oauth2 token exchange, and into the client it returns for userinfo
+// each request the client makes is traced within the span of ctx, see tracing.Transport()
+// the nonce expected in the id_token is carried along, see VerifyIDToken()
+func providerContext(ctx context.Context) context.Context {
+	pctx := cfg.WithOAuth(trace.ContextWithSpan(cfg.WithInstanceOf(context.TODO(), ctx), trace.SpanFromContext(ctx)), cfg.OAuth(ctx))
+	if nonce, ok := ctx.Value(cfg.IDTokenNonceCtxKey).(string); ok {
+		pctx = context.WithValue(pctx, cfg.IDTokenNonceCtxKey, nonce)
+	}
+	s := stateOf(ctx)
+	httpClient := &http.Client{Timeout: s.timeout, Transport: &rateLimitTransport{next: tracing.Transport(pctx, s.transport), provider: pctx}}
+	return context.WithValue(pctx, oauth2.HTTPClient, httpClient)
+}
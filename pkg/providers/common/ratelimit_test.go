@@ -0,0 +1,127 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestRateLimitTransport(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Configure()
+	var slept []time.Duration
+	sleep = func(_ context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	defer func() {
+		sleep = defaultSleep
+		cfg.InitForTestPurposes()
+	}()
+
+	tests := []struct {
+		name       string
+		limited    int
+		retryAfter string
+		retries    int
+		maxWait    int
+		wantErr    bool
+		wantAfter  time.Duration
+		wantSlept  []time.Duration
+	}{
+		{"not limited", 0, "", 0, 5, false, 0, nil},
+		{"no retries", 1, "7", 0, 5, true, 7 * time.Second, nil},
+		{"retried", 1, "2", 1, 5, false, 0, []time.Duration{2 * time.Second}},
+		{"retries exhausted", 3, "1", 2, 5, true, time.Second, []time.Duration{time.Second, time.Second}},
+		{"wait too long", 1, "10", 1, 5, true, 10 * time.Second, nil},
+		{"no hint", 1, "", 1, 5, true, 0, nil},
+		{"http date", 1, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), 0, 5, true, time.Hour, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.GenOAuth.RateLimit.Retries = tt.retries
+			cfg.GenOAuth.RateLimit.MaxWait = tt.maxWait
+			slept = nil
+
+			var bodies []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				bodies = append(bodies, string(b))
+				if len(bodies) <= tt.limited {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				_, _ = w.Write([]byte(`{"access_token":"accesstoken"}`))
+			}))
+			defer ts.Close()
+
+			// the body of the token request is sent again with each retry
+			httpClient := providerContext(context.Background()).Value(oauth2.HTTPClient).(*http.Client)
+			resp, err := httpClient.Post(ts.URL+"/token", "application/x-www-form-urlencoded", strings.NewReader("code=authcode"))
+			if tt.wantErr {
+				var rl *RateLimitError
+				if assert.True(t, errors.As(err, &rl), "%v", err) {
+					assert.InDelta(t, tt.wantAfter.Seconds(), rl.RetryAfter.Seconds(), 1)
+				}
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				resp.Body.Close()
+			}
+			assert.Equal(t, tt.wantSlept, slept)
+			for _, b := range bodies {
+				assert.Equal(t, "code=authcode", b)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header   string
+		want     time.Duration
+		wantHint bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"-5", 0, false},
+		{"Fri, 01 May 2020 12:00:30 GMT", 30 * time.Second, true},
+		{"Fri, 01 May 2020 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, hint := parseRetryAfter(tt.header, now)
+		assert.Equal(t, tt.want, got, tt.header)
+		assert.Equal(t, tt.wantHint, hint, tt.header)
+	}
+}
+
+func TestRateLimitErrorRetryAfterSeconds(t *testing.T) {
+	assert.Equal(t, 0, (&RateLimitError{}).RetryAfterSeconds())
+	assert.Equal(t, 2, (&RateLimitError{RetryAfter: 1500 * time.Millisecond}).RetryAfterSeconds())
+	assert.Equal(t, 30, (&RateLimitError{RetryAfter: 30 * time.Second}).RetryAfterSeconds())
+}
@@ -0,0 +1,62 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// MapUser set the user's Username and Email from the claims named by `oauth.user_info` of the provider of ctx
+// a claim which isn't configured, or which the provider didn't send, leaves the user as it is
+func MapUser(ctx context.Context, claims []byte, user *structs.User) error {
+	provider := cfg.OAuth(ctx)
+	if provider.UserInfo.UsernameClaim == "" && provider.UserInfo.EmailClaim == "" {
+		return nil
+	}
+	m := make(map[string]interface{})
+	d := json.NewDecoder(bytes.NewReader(claims))
+	// a numeric `sub` such as GitHub's is kept as it was sent
+	d.UseNumber()
+	if err := d.Decode(&m); err != nil {
+		return err
+	}
+	normalizeEmail(ctx, m)
+	if v, ok := claimString(m, provider.UserInfo.UsernameClaim); ok {
+		user.Username = v
+	}
+	if v, ok := claimString(m, provider.UserInfo.EmailClaim); ok {
+		user.Email = v
+	}
+	return nil
+}
+
+// claimString the string or number value of the claim at path
+func claimString(m map[string]interface{}, path string) (string, bool) {
+	if path == "" {
+		return "", false
+	}
+	v, _ := ClaimValue(m, path)
+	switch s := v.(type) {
+	case string:
+		return s, s != ""
+	case json.Number:
+		return s.String(), true
+	}
+	if v != nil {
+		log.Warnf("the claim %s is neither a string nor a number, it can't be the user's username or email: %v", path, v)
+	}
+	return "", false
+}
@@ -0,0 +1,62 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestMapUser(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Configure()
+	defer func() {
+		cfg.GenOAuth.UserInfo.UsernameClaim = ""
+		cfg.GenOAuth.UserInfo.EmailClaim = ""
+	}()
+
+	tests := []struct {
+		name          string
+		usernameClaim string
+		emailClaim    string
+		claims        string
+		wantUsername  string
+		wantEmail     string
+	}{
+		{"unset", "", "", `{"sub":"abc","preferred_username":"jdoe"}`, "username", "email@example.com"},
+		{"sub only", "sub", "", `{"sub":"248289761001"}`, "248289761001", "email@example.com"},
+		{"numeric sub", "sub", "", `{"sub":12345678901234567890}`, "12345678901234567890", "email@example.com"},
+		{"preferred_username", "preferred_username", "", `{"sub":"abc","preferred_username":"jdoe"}`, "jdoe", "email@example.com"},
+		{"upn as email", "", "upn", `{"upn":"jdoe@example.com"}`, "username", "jdoe@example.com"},
+		{"nested", "attributes.login", "", `{"attributes":{"login":"jdoe"}}`, "jdoe", "email@example.com"},
+		{"email list", "", "email", `{"email":["jdoe@example.com","x@other.com"]}`, "username", "jdoe@example.com"},
+		{"missing falls back", "preferred_username", "upn", `{"sub":"abc"}`, "username", "email@example.com"},
+		{"not a string", "groups", "", `{"groups":["a","b"]}`, "username", "email@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.GenOAuth.UserInfo.UsernameClaim = tt.usernameClaim
+			cfg.GenOAuth.UserInfo.EmailClaim = tt.emailClaim
+			user := structs.User{Username: "username", Email: "email@example.com"}
+			assert.NoError(t, MapUser(context.Background(), []byte(tt.claims), &user))
+			assert.Equal(t, tt.wantUsername, user.Username)
+			assert.Equal(t, tt.wantEmail, user.Email)
+		})
+	}
+
+	cfg.GenOAuth.UserInfo.UsernameClaim = "sub"
+	assert.Error(t, MapUser(context.Background(), []byte(`not json`), &structs.User{}))
+}
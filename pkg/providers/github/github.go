@@ -11,6 +11,7 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package github
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -45,7 +46,7 @@ func (me Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims
 		return err
 	}
 	log.Errorf("ptoken.AccessToken: %s", ptoken.AccessToken)
-	userinfo, err := client.Get(cfg.GenOAuth.UserInfoURL + ptoken.AccessToken)
+	userinfo, err := client.Get(cfg.OAuth(r.Context()).UserInfoURL + ptoken.AccessToken)
 	if err != nil {
 		// http.Error(w, err.Error(), http.StatusBadRequest)
 		return err
@@ -57,7 +58,7 @@ func (me Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims
 	}()
 	data, _ := ioutil.ReadAll(userinfo.Body)
 	log.Infof("github userinfo body: %s", string(data))
-	if err = common.MapClaims(data, customClaims); err != nil {
+	if err = common.MapClaims(r.Context(), data, customClaims); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -91,17 +92,17 @@ func (me Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims
 		}
 	}
 
-	if len(cfg.Cfg.TeamWhiteList) != 0 {
-		for _, orgAndTeam := range cfg.Cfg.TeamWhiteList {
+	if teamWhiteList := cfg.FromContext(r.Context()).TeamWhiteList; len(teamWhiteList) != 0 {
+		for _, orgAndTeam := range teamWhiteList {
 			org, team := toOrgAndTeam(orgAndTeam)
 			if org != "" {
 				log.Info(org)
 				var err error
 				isMember := false
 				if team != "" {
-					isMember, err = getTeamMembershipStateFromGitHub(client, user, org, team, ptoken)
+					isMember, err = getTeamMembershipStateFromGitHub(r.Context(), client, user, org, team, ptoken)
 				} else {
-					isMember, err = getOrgMembershipStateFromGitHub(client, user, org, ptoken)
+					isMember, err = getOrgMembershipStateFromGitHub(r.Context(), client, user, org, ptoken)
 				}
 				if err != nil {
 					return err
@@ -121,9 +122,9 @@ func (me Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims
 	return nil
 }
 
-func getOrgMembershipStateFromGitHub(client *http.Client, user *structs.User, orgID string, ptoken *oauth2.Token) (isMember bool, rerr error) {
+func getOrgMembershipStateFromGitHub(ctx context.Context, client *http.Client, user *structs.User, orgID string, ptoken *oauth2.Token) (isMember bool, rerr error) {
 	replacements := strings.NewReplacer(":org_id", orgID, ":username", user.Username)
-	orgMembershipResp, err := client.Get(replacements.Replace(cfg.GenOAuth.UserOrgURL) + ptoken.AccessToken)
+	orgMembershipResp, err := client.Get(replacements.Replace(cfg.OAuth(ctx).UserOrgURL) + ptoken.AccessToken)
 	if err != nil {
 		log.Error(err)
 		return false, err
@@ -149,9 +150,9 @@ func getOrgMembershipStateFromGitHub(client *http.Client, user *structs.User, or
 	}
 }
 
-func getTeamMembershipStateFromGitHub(client *http.Client, user *structs.User, orgID string, team string, ptoken *oauth2.Token) (isMember bool, rerr error) {
+func getTeamMembershipStateFromGitHub(ctx context.Context, client *http.Client, user *structs.User, orgID string, team string, ptoken *oauth2.Token) (isMember bool, rerr error) {
 	replacements := strings.NewReplacer(":org_id", orgID, ":team_slug", team, ":username", user.Username)
-	membershipStateResp, err := client.Get(replacements.Replace(cfg.GenOAuth.UserTeamURL) + ptoken.AccessToken)
+	membershipStateResp, err := client.Get(replacements.Replace(cfg.OAuth(ctx).UserTeamURL) + ptoken.AccessToken)
 	if err != nil {
 		log.Error(err)
 		return false, err
@@ -0,0 +1,140 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// maxGroupPages bounds the requests for the groups of a user, at 100 groups a page
+const maxGroupPages = 50
+
+// Provider provider specific functions
+type Provider struct {
+	PrepareTokensAndClient func(r *http.Request, ptokens *structs.PTokens, setProviderToken bool, opts ...oauth2.AuthCodeOption) (*http.Client, *oauth2.Token, error)
+}
+
+var log *zap.SugaredLogger
+
+// Configure see main.go configure()
+func (Provider) Configure() {
+	log = cfg.Logging.Logger
+}
+
+// GetUserInfo gitlab user info from /api/v4/user, and with a teamWhitelist the full paths of the user's groups
+// from /api/v4/groups as the user's team memberships
+// https://docs.gitlab.com/ee/api/users.html#for-normal-users-1
+func (me Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens, opts ...oauth2.AuthCodeOption) (rerr error) {
+	client, _, err := me.PrepareTokensAndClient(r, ptokens, true, opts...)
+	if err != nil {
+		return err
+	}
+	userinfo, err := client.Get(cfg.OAuth(r.Context()).UserInfoURL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := userinfo.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	if userinfo.StatusCode != http.StatusOK {
+		return fmt.Errorf("gitlab user: unexpected response status %s", userinfo.Status)
+	}
+	data, _ := ioutil.ReadAll(userinfo.Body)
+	log.Infof("gitlab userinfo body: %s", string(data))
+	if err = common.MapClaims(r.Context(), data, customClaims); err != nil {
+		log.Error(err)
+		return err
+	}
+	glUser := structs.GitLabUser{}
+	if err = json.Unmarshal(data, &glUser); err != nil {
+		log.Error(err)
+		return err
+	}
+	glUser.PrepareUserData()
+	user.Email = glUser.Email
+	user.Name = glUser.Name
+	user.Username = glUser.Username
+	user.ID = glUser.ID
+
+	if len(cfg.FromContext(r.Context()).TeamWhiteList) == 0 {
+		return nil
+	}
+	groups, err := getGroupsFromGitLab(r.Context(), client)
+	if err != nil {
+		return err
+	}
+	user.TeamMemberships = append(user.TeamMemberships, groups...)
+	log.Debugf("getUserInfoFromGitLab %s is a member of %s", user.Username, user.TeamMemberships)
+	return nil
+}
+
+// getGroupsFromGitLab the full paths (such as myorg/myteam) of the groups the user is a member of, a page at a time
+// https://docs.gitlab.com/ee/api/groups.html#list-groups
+func getGroupsFromGitLab(ctx context.Context, client *http.Client) ([]string, error) {
+	var paths []string
+	page := "1"
+	for i := 0; page != ""; i++ {
+		if i == maxGroupPages {
+			log.Warnf("gitlab groups: only the first %d pages of groups were fetched", maxGroupPages)
+			break
+		}
+		groups, next, err := getGroupsPage(ctx, client, page)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			paths = append(paths, g.FullPath)
+		}
+		page = next
+	}
+	return paths, nil
+}
+
+// getGroupsPage one page of the user's groups and the number of the next page, "" on the last page
+func getGroupsPage(ctx context.Context, client *http.Client, page string) (groups []structs.GitLabGroup, next string, rerr error) {
+	groupsURL := strings.TrimSuffix(cfg.OAuth(ctx).GitLabURL, "/") + "/api/v4/groups?min_access_level=10&per_page=100&page=" + page
+	resp, err := client.Get(groupsURL)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		// the token needs the read_api scope
+		return nil, "", fmt.Errorf("gitlab groups: unexpected response status %s", resp.Status)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, "", fmt.Errorf("gitlab groups: %w", err)
+	}
+	next = resp.Header.Get("X-Next-Page")
+	if _, err := strconv.Atoi(next); err != nil {
+		next = ""
+	}
+	return groups, next, nil
+}
@@ -0,0 +1,104 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package gitlab
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// stubGitLab answers /api/v4/user, and /api/v4/groups with two pages of groups, to the bearer of the access token
+func stubGitLab(t *testing.T) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer accesstoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v4/user":
+			fmt.Fprint(w, `{"id":42,"username":"jdoe","name":"Jane Doe","email":"jdoe@example.com","avatar_url":"https://gitlab.example.com/jdoe.png"}`)
+		case "/api/v4/groups":
+			switch r.URL.Query().Get("page") {
+			case "1":
+				w.Header().Set("X-Next-Page", "2")
+				fmt.Fprint(w, `[{"id":1,"full_path":"myorg"},{"id":2,"full_path":"myorg/engineering"}]`)
+			case "2":
+				w.Header().Set("X-Next-Page", "")
+				fmt.Fprint(w, `[{"id":3,"full_path":"otherorg"}]`)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func setUp(t *testing.T, teamWhiteList []string) Provider {
+	cfg.InitForTestPurposesWithProvider("gitlab")
+	Provider{}.Configure()
+	ts := stubGitLab(t)
+	cfg.GenOAuth.GitLabURL = ts.URL
+	cfg.GenOAuth.UserInfoURL = ts.URL + "/api/v4/user"
+	cfg.Cfg.TeamWhiteList = teamWhiteList
+
+	token := &oauth2.Token{AccessToken: "accesstoken", TokenType: "Bearer"}
+	return Provider{PrepareTokensAndClient: func(r *http.Request, ptokens *structs.PTokens, setProviderToken bool, opts ...oauth2.AuthCodeOption) (*http.Client, *oauth2.Token, error) {
+		ptokens.PAccessToken = token.AccessToken
+		return oauth2.NewClient(r.Context(), oauth2.StaticTokenSource(token)), token, nil
+	}}
+}
+
+func TestGetUserInfo(t *testing.T) {
+	tests := []struct {
+		name          string
+		teamWhiteList []string
+		wantTeams     []string
+	}{
+		{"without a teamWhitelist the groups aren't fetched", nil, nil},
+		{"the full paths of every page of groups", []string{"myorg/engineering"}, []string{"myorg", "myorg/engineering", "otherorg"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := setUp(t, tt.teamWhiteList)
+			user := &structs.User{}
+			err := p.GetUserInfo(httptest.NewRequest("GET", "/auth/state/?code=authcode", nil), user, &structs.CustomClaims{}, &structs.PTokens{})
+			assert.NoError(t, err)
+			assert.Equal(t, "jdoe", user.Username)
+			assert.Equal(t, "jdoe@example.com", user.Email)
+			assert.Equal(t, "Jane Doe", user.Name)
+			assert.Equal(t, 42, user.ID)
+			assert.Equal(t, tt.wantTeams, user.TeamMemberships)
+		})
+	}
+}
+
+func TestGetUserInfoGroupsError(t *testing.T) {
+	p := setUp(t, []string{"myorg"})
+	// the instance is unreachable
+	cfg.GenOAuth.GitLabURL = "http://127.0.0.1:1"
+	err := p.GetUserInfo(httptest.NewRequest("GET", "/auth/state/?code=authcode", nil), &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{})
+	assert.Error(t, err)
+
+	p = setUp(t, []string{"myorg"})
+	cfg.GenOAuth.GitLabURL += "/nowhere"
+	err = p.GetUserInfo(httptest.NewRequest("GET", "/auth/state/?code=authcode", nil), &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{})
+	assert.EqualError(t, err, "gitlab groups: unexpected response status 404 Not Found")
+}
@@ -39,6 +39,7 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 	// indieauth sends the "me" setting in json back to the callback, so just pluck it from the callback
 	code := r.URL.Query().Get("code")
 	log.Errorf("ptoken.AccessToken: %s", code)
+	provider := cfg.OAuth(r.Context())
 	var b bytes.Buffer
 	w := multipart.NewWriter(&b)
 	// v.Set("code", code)
@@ -53,21 +54,21 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 	if fw, err = w.CreateFormField("redirect_uri"); err != nil {
 		return err
 	}
-	if _, err = fw.Write([]byte(cfg.GenOAuth.RedirectURL)); err != nil {
+	if _, err = fw.Write([]byte(provider.RedirectURL)); err != nil {
 		return err
 	}
 	// v.Set("client_id", cfg.GenOAuth.ClientID)
 	if fw, err = w.CreateFormField("client_id"); err != nil {
 		return err
 	}
-	if _, err = fw.Write([]byte(cfg.GenOAuth.ClientID)); err != nil {
+	if _, err = fw.Write([]byte(provider.ClientID)); err != nil {
 		return err
 	}
 	if err = w.Close(); err != nil {
 		log.Error("error closing writer.")
 	}
 
-	req, err := http.NewRequest("POST", cfg.GenOAuth.AuthURL, &b)
+	req, err := http.NewRequest("POST", provider.AuthURL, &b)
 	if err != nil {
 		return err
 	}
@@ -77,8 +78,7 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 	// v := url.Values{}
 	// userinfo, err := client.PostForm(cfg.GenOAuth.UserInfoURL, v)
 
-	client := &http.Client{}
-	userinfo, err := client.Do(req)
+	userinfo, err := common.HTTPClient(r.Context()).Do(req)
 
 	if err != nil {
 		// http.Error(w, err.Error(), http.StatusBadRequest)
@@ -92,7 +92,7 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 
 	data, _ := ioutil.ReadAll(userinfo.Body)
 	log.Infof("indieauth userinfo body: %s", string(data))
-	if err = common.MapClaims(data, customClaims); err != nil {
+	if err = common.MapClaims(r.Context(), data, customClaims); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -0,0 +1,166 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package openid
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// Azure AD leaves the `groups` claim out of the id_token of a user in too many groups (the "overage")
+// and instead points at the Graph API, where the groups can be fetched with the access token
+// https://docs.microsoft.com/en-us/azure/active-directory/develop/id-tokens#groups-overage-claim
+
+// groupOverages the groups fetched for an access token, kept for the lifetime of the token, by the hash of the token
+var groupOverages = cache.New(time.Hour, 10*time.Minute)
+
+// graphClient bounds the wait for the Graph API, and handles a 429 per `oauth.rate_limit`, that of the cfg.Instance of ctx
+var graphClient = common.RateLimitedHTTPClient
+
+// graphHosts the Graph API of each national cloud, the access token is sent to no other host
+var graphHosts = map[string]bool{
+	"graph.microsoft.com":             true,
+	"graph.microsoft.us":              true,
+	"dod-graph.microsoft.us":          true,
+	"microsoftgraph.chinacloudapi.cn": true,
+	"graph.windows.net":               true,
+	"graph.chinacloudapi.cn":          true,
+}
+
+// legacyGraphHosts serve the retired Azure AD Graph API, the same request is made of Microsoft Graph instead
+var legacyGraphHosts = map[string]string{
+	"graph.windows.net":      "graph.microsoft.com",
+	"graph.chinacloudapi.cn": "microsoftgraph.chinacloudapi.cn",
+}
+
+type overageClaims struct {
+	ClaimNames   map[string]string `json:"_claim_names"`
+	ClaimSources map[string]struct {
+		Endpoint string `json:"endpoint"`
+	} `json:"_claim_sources"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+// resolveGroupOverage with `oauth.resolve_group_overage`, when the id_token points at the Graph API for the user's groups
+// fetch them with the access token into the user's TeamMemberships, as object ids
+func resolveGroupOverage(ctx context.Context, ptokens *structs.PTokens, user *structs.User) error {
+	parts := strings.Split(ptokens.PIdToken, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("group overage: decoding id_token: %w", err)
+	}
+	var oc overageClaims
+	if err := json.Unmarshal(payload, &oc); err != nil {
+		return fmt.Errorf("group overage: %w", err)
+	}
+	source, ok := oc.ClaimNames["groups"]
+	if !ok {
+		return nil
+	}
+	endpoint, err := graphEndpoint(oc.ClaimSources[source].Endpoint)
+	if err != nil {
+		return fmt.Errorf("group overage: %w", err)
+	}
+
+	sum := sha256.Sum256([]byte(ptokens.PAccessToken))
+	key := hex.EncodeToString(sum[:])
+	if groups, found := groupOverages.Get(key); found {
+		log.Debugf("group overage: %d groups for %s found in cache", len(groups.([]string)), user.Username)
+		user.TeamMemberships = append(user.TeamMemberships, groups.([]string)...)
+		return nil
+	}
+
+	groups, err := fetchMemberObjects(ctx, endpoint, ptokens.PAccessToken)
+	if err != nil {
+		return fmt.Errorf("group overage: %w", err)
+	}
+	if oc.ExpiresAt == 0 {
+		groupOverages.SetDefault(key, groups)
+	} else if expires := time.Until(time.Unix(oc.ExpiresAt, 0)); expires > 0 {
+		groupOverages.Set(key, groups, expires)
+	}
+	log.Infof("group overage: fetched %d groups for %s from %s", len(groups), user.Username, endpoint)
+	user.TeamMemberships = append(user.TeamMemberships, groups...)
+	return nil
+}
+
+// graphEndpoint the getMemberObjects url of the Graph API named by the `_claim_sources` endpoint
+func graphEndpoint(source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", err
+	}
+	host := strings.ToLower(u.Hostname())
+	if u.Scheme != "https" || !graphHosts[host] {
+		return "", fmt.Errorf("%s is not a Microsoft Graph endpoint", source)
+	}
+	newHost, legacy := legacyGraphHosts[host]
+	if !legacy {
+		return u.String(), nil
+	}
+	// https://graph.windows.net/{tenant}/users/{oid}/getMemberObjects
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i+2 < len(segments); i++ {
+		if segments[i] == "users" && segments[i+2] == "getMemberObjects" {
+			return fmt.Sprintf("https://%s/v1.0/users/%s/getMemberObjects", newHost, url.PathEscape(segments[i+1])), nil
+		}
+	}
+	return "", fmt.Errorf("%s is not a getMemberObjects endpoint", source)
+}
+
+// fetchMemberObjects the ids of the groups the user is a member of
+// https://docs.microsoft.com/en-us/graph/api/directoryobject-getmemberobjects
+func fetchMemberObjects(ctx context.Context, endpoint, accessToken string) ([]string, error) {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBufferString(`{"securityEnabledOnly":false}`))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := graphClient(ctx).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	var body struct {
+		Value []string `json:"value"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, err
+	}
+	if body.Value == nil {
+		return nil, errors.New("getMemberObjects returned no value")
+	}
+	return body.Value, nil
+}
@@ -0,0 +1,131 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package openid
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// idToken an unsigned id_token carrying claims
+func idToken(t *testing.T, claims map[string]interface{}) string {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(b) + ".c2lnbmF0dXJl"
+}
+
+func overageClaimsFor(endpoint string) map[string]interface{} {
+	return map[string]interface{}{
+		"sub":            "abc",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"_claim_names":   map[string]string{"groups": "src1"},
+		"_claim_sources": map[string]interface{}{"src1": map[string]string{"endpoint": endpoint}},
+	}
+}
+
+func TestResolveGroupOverage(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Provider{}.Configure()
+
+	calls := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/v1.0/users/oid1/getMemberObjects", r.URL.Path)
+		assert.JSONEq(t, `{"securityEnabledOnly":false}`, string(body))
+		if r.Header.Get("Authorization") != "Bearer accesstoken" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"value":["11111111-aaaa","22222222-bbbb"]}`))
+	}))
+	defer ts.Close()
+	host := ts.Listener.Addr().String()
+	u, _ := url.Parse(ts.URL)
+	graphHosts[u.Hostname()] = true
+	client := graphClient
+	graphClient = func(context.Context) *http.Client { return ts.Client() }
+	defer func() {
+		delete(graphHosts, u.Hostname())
+		graphClient = client
+	}()
+	endpoint := "https://" + host + "/v1.0/users/oid1/getMemberObjects"
+
+	// no overage, the groups are in the token
+	user := structs.User{Username: "testuser"}
+	ptokens := structs.PTokens{PAccessToken: "accesstoken", PIdToken: idToken(t, map[string]interface{}{"sub": "abc", "groups": []string{"staff"}})}
+	assert.NoError(t, resolveGroupOverage(context.Background(), &ptokens, &user))
+	assert.Empty(t, user.TeamMemberships)
+	assert.Equal(t, 0, calls)
+
+	ptokens.PIdToken = idToken(t, overageClaimsFor(endpoint))
+	assert.NoError(t, resolveGroupOverage(context.Background(), &ptokens, &user))
+	assert.Equal(t, []string{"11111111-aaaa", "22222222-bbbb"}, user.TeamMemberships)
+	assert.Equal(t, 1, calls)
+
+	// the groups are cached for the access token
+	user = structs.User{Username: "testuser"}
+	assert.NoError(t, resolveGroupOverage(context.Background(), &ptokens, &user))
+	assert.Equal(t, []string{"11111111-aaaa", "22222222-bbbb"}, user.TeamMemberships)
+	assert.Equal(t, 1, calls)
+
+	// but not for another token, which Graph refuses
+	ptokens.PAccessToken = "othertoken"
+	assert.Error(t, resolveGroupOverage(context.Background(), &ptokens, &structs.User{Username: "testuser"}))
+	assert.Equal(t, 2, calls)
+}
+
+func TestResolveGroupOverageRefusesOtherHosts(t *testing.T) {
+	cfg.InitForTestPurposes()
+	Provider{}.Configure()
+
+	// the access token must never be sent to a host named in an id_token which isn't the Graph API
+	ptokens := structs.PTokens{PAccessToken: "accesstoken", PIdToken: idToken(t, overageClaimsFor("https://evil.example.com/users/oid1/getMemberObjects"))}
+	user := structs.User{Username: "testuser"}
+	assert.Error(t, resolveGroupOverage(context.Background(), &ptokens, &user))
+	assert.Empty(t, user.TeamMemberships)
+}
+
+func TestGraphEndpoint(t *testing.T) {
+	tests := []struct {
+		source  string
+		want    string
+		wantErr bool
+	}{
+		{"https://graph.microsoft.com/v1.0/users/oid1/getMemberObjects", "https://graph.microsoft.com/v1.0/users/oid1/getMemberObjects", false},
+		{"https://graph.windows.net/tenant1/users/oid1/getMemberObjects", "https://graph.microsoft.com/v1.0/users/oid1/getMemberObjects", false},
+		{"https://graph.chinacloudapi.cn/tenant1/users/oid1/getMemberObjects", "https://microsoftgraph.chinacloudapi.cn/v1.0/users/oid1/getMemberObjects", false},
+		{"https://graph.windows.net/tenant1/users/oid1", "", true},
+		{"http://graph.microsoft.com/v1.0/users/oid1/getMemberObjects", "", true},
+		{"https://graph.microsoft.com.evil.example.com/v1.0/users/oid1/getMemberObjects", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := graphEndpoint(tt.source)
+		assert.Equal(t, tt.want, got, tt.source)
+		assert.Equal(t, tt.wantErr, err != nil, tt.source)
+	}
+}
@@ -38,7 +38,7 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 	if err != nil {
 		return err
 	}
-	userinfo, err := client.Get(cfg.GenOAuth.UserInfoURL)
+	userinfo, err := client.Get(cfg.OAuth(r.Context()).UserInfoURL)
 	if err != nil {
 		return err
 	}
@@ -49,7 +49,8 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 	}()
 	data, _ := ioutil.ReadAll(userinfo.Body)
 	log.Infof("OpenID userinfo body: %s", string(data))
-	if err = common.MapClaims(data, customClaims); err != nil {
+	data = common.NormalizeEmail(r.Context(), data)
+	if err = common.MapClaims(r.Context(), data, customClaims); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -57,6 +58,16 @@ func (Provider) GetUserInfo(r *http.Request, user *structs.User, customClaims *s
 		log.Error(err)
 		return err
 	}
+	if err = common.MapUser(r.Context(), data, user); err != nil {
+		log.Error(err)
+		return err
+	}
 	user.PrepareUserData()
+	if cfg.OAuth(r.Context()).ResolveGroupOverage {
+		if err := resolveGroupOverage(r.Context(), ptokens, user); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,230 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package proxyproto reads the PROXY protocol header (v1 and v2) sent by an L4 load balancer
+// so that the client address of each connection is the address of the real client
+// https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"go.uber.org/zap"
+)
+
+var log *zap.SugaredLogger
+
+// v2Signature begins every v2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+	v2Local     = 0x0
+	v2Proxy     = 0x1
+	v2TCP4      = 0x11
+	v2TCP6      = 0x21
+)
+
+var errNoHeader = errors.New("proxy protocol: connection did not begin with a PROXY header")
+
+// Configure see main.go configure()
+func Configure() {
+	log = cfg.Logging.Logger
+}
+
+// Listener accepts connections which must begin with a PROXY protocol header
+// connections without one are refused, which is why PROXY protocol must be enabled explicitly
+type Listener struct {
+	net.Listener
+	// HeaderTimeout bounds the wait for the header
+	HeaderTimeout time.Duration
+}
+
+// Accept the next connection, the header is read on the first call to Read, RemoteAddr or LocalAddr
+// so a slow client doesn't hold up Accept
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, br: bufio.NewReader(c), timeout: l.HeaderTimeout}, nil
+}
+
+// Conn a connection whose RemoteAddr and LocalAddr are those given in the PROXY header
+type Conn struct {
+	net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	src     net.Addr
+	dst     net.Addr
+	err     error
+}
+
+// Read from the connection after the PROXY header
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr the client's address from the PROXY header
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr the address the client connected to from the PROXY header
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) readHeader() {
+	if c.timeout > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+			c.err = err
+			return
+		}
+		// http.Server sets its own deadlines once the header is read
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+	c.src, c.dst, c.err = ReadHeader(c.br)
+	if c.err != nil {
+		log.Warnf("%s from %s", c.err, c.Conn.RemoteAddr())
+		// hang up rather than let http.Server answer a client that isn't behind the load balancer
+		c.Conn.Close()
+	}
+}
+
+// ReadHeader reads a v1 or v2 PROXY header from br and returns the source and destination addresses
+// both are nil for a health check from the load balancer itself (v1 `UNKNOWN` or v2 `LOCAL`)
+func ReadHeader(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	peek, err := br.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, nil, errNoHeader
+	}
+	if string(peek) == v1Prefix {
+		return readV1(br)
+	}
+	if peek, err = br.Peek(len(v2Signature)); err == nil && bytes.Equal(peek, v2Signature) {
+		return readV2(br)
+	}
+	return nil, nil, errNoHeader
+}
+
+// readV1 `PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n`
+func readV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("proxy protocol: reading v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("proxy protocol: v1 header is not terminated by CRLF")
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("proxy protocol: malformed v1 header %q", line)
+	}
+	src, err := tcpAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := tcpAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func tcpAddr(ip, port string) (*net.TCPAddr, error) {
+	a := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if a.IP == nil {
+		return nil, fmt.Errorf("proxy protocol: invalid address %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol: invalid port %q", port)
+	}
+	a.Port = int(p)
+	return a, nil
+}
+
+// readV2 the binary header
+func readV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, nil, fmt.Errorf("proxy protocol: reading v2 header: %w", err)
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, fmt.Errorf("proxy protocol: reading v2 addresses: %w", err)
+	}
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("proxy protocol: unsupported version %d", verCmd>>4)
+	}
+
+	switch verCmd & 0xf {
+	case v2Local:
+		return nil, nil, nil
+	case v2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("proxy protocol: unsupported v2 command %d", verCmd&0xf)
+	}
+
+	var n int
+	switch fam {
+	case v2TCP4:
+		n = net.IPv4len
+	case v2TCP6:
+		n = net.IPv6len
+	default:
+		// UDP and unix sockets carry no usable client address, keep the connection's own
+		return nil, nil, nil
+	}
+	if len(body) < 2*n+4 {
+		return nil, nil, errors.New("proxy protocol: v2 address block is too short")
+	}
+	src := &net.TCPAddr{IP: net.IP(body[:n]), Port: int(binary.BigEndian.Uint16(body[2*n:]))}
+	dst := &net.TCPAddr{IP: net.IP(body[n : 2*n]), Port: int(binary.BigEndian.Uint16(body[2*n+2:]))}
+	return src, dst, nil
+}
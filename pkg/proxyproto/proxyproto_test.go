@@ -0,0 +1,118 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package proxyproto
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	Configure()
+}
+
+func v2Header(cmd, fam byte, addrs []byte) string {
+	h := append([]byte{}, v2Signature...)
+	h = append(h, 0x20|cmd, fam, byte(len(addrs)>>8), byte(len(addrs)))
+	return string(append(h, addrs...))
+}
+
+func TestReadHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+
+	tests := []struct {
+		name    string
+		input   string
+		wantSrc string
+		wantDst string
+		wantErr bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET /", "192.0.2.1:56324", "198.51.100.1:443", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET /", "[2001:db8::1]:56324", "[2001:db8::2]:443", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\nGET /", "", "", false},
+		{"v1 no crlf", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\nGET /", "", "", true},
+		{"v1 bad address", "PROXY TCP4 192.0.2.x 198.51.100.1 56324 443\r\nGET /", "", "", true},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\nGET /", "", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "", "", true},
+		{"v2 tcp4", v2Header(v2Proxy, v2TCP4, v4) + "GET /", "192.0.2.1:56324", "198.51.100.1:443", false},
+		{"v2 tcp6", v2Header(v2Proxy, v2TCP6, v6) + "GET /", "[2001:db8::1]:56324", "[2001:db8::2]:443", false},
+		{"v2 local", v2Header(v2Local, 0, nil) + "GET /", "", "", false},
+		{"v2 short addresses", v2Header(v2Proxy, v2TCP4, v4[:8]) + "GET /", "", "", true},
+		{"no header", "GET / HTTP/1.1\r\n", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tt.input))
+			src, dst, err := ReadHeader(br)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			if tt.wantSrc == "" {
+				assert.Nil(t, src)
+				assert.Nil(t, dst)
+			} else {
+				assert.Equal(t, tt.wantSrc, src.String())
+				assert.Equal(t, tt.wantDst, dst.String())
+			}
+			// the request which follows the header is untouched
+			rest, _ := ioutil.ReadAll(br)
+			assert.Equal(t, "GET /", string(rest))
+		})
+	}
+}
+
+func TestListenerRemoteAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.RemoteAddr))
+	})}
+	go srv.Serve(&Listener{Listener: l, HeaderTimeout: time.Second})
+	defer srv.Close()
+
+	get := func(header string) (string, error) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		if _, err := c.Write([]byte(header + "GET / HTTP/1.0\r\nHost: vouch.example.com\r\n\r\n")); err != nil {
+			return "", err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	got, err := get("PROXY TCP4 203.0.113.7 10.0.0.1 40000 9090\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.7:40000", got)
+
+	// without the header the connection is refused
+	_, err = get("")
+	assert.Error(t, err)
+}
@@ -0,0 +1,255 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package redis a minimal client for the few commands Vouch Proxy needs of Redis, speaking RESP
+// https://redis.io/topics/protocol
+package redis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ErrNil the key does not exist
+var ErrNil = errors.New("redis: nil")
+
+// Error an error reply from Redis
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+// Options where and how to connect
+type Options struct {
+	Addr     string
+	Password string
+	DB       int
+	// TLS connect with TLS, verifying the server's certificate, nil for plaintext
+	TLS *tls.Config
+	// Timeout for dialing and for each command
+	Timeout time.Duration
+	// MaxIdle connections kept open between commands
+	MaxIdle int
+}
+
+// Client is safe for concurrent use, each command takes a connection of its own
+type Client struct {
+	opts Options
+	idle chan *conn
+}
+
+type conn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+// NewClient connects lazily, at the first command
+func NewClient(opts Options) *Client {
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.MaxIdle == 0 {
+		opts.MaxIdle = 8
+	}
+	return &Client{opts: opts, idle: make(chan *conn, opts.MaxIdle)}
+}
+
+// Ping the server
+func (c *Client) Ping() error {
+	_, err := c.do("PING")
+	return err
+}
+
+// Get the value of key, ErrNil if it doesn't exist
+func (c *Client) Get(key string) ([]byte, error) {
+	v, err := c.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, ErrNil
+	}
+	return b, nil
+}
+
+// Set key to value, expiring after ttl, or never if ttl is 0
+func (c *Client) Set(key string, value []byte, ttl time.Duration) error {
+	if ttl == 0 {
+		_, err := c.do("SET", key, string(value))
+		return err
+	}
+	_, err := c.do("SET", key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// Del key
+func (c *Client) Del(key string) error {
+	_, err := c.do("DEL", key)
+	return err
+}
+
+// Incr the integer held by key, from 0 if it doesn't exist, returning the new value
+func (c *Client) Incr(key string) (int64, error) {
+	v, err := c.do("INCR", key)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply to INCR %v", v)
+	}
+	return n, nil
+}
+
+// PExpire key after ttl, ErrNil if it doesn't exist
+func (c *Client) PExpire(key string, ttl time.Duration) error {
+	v, err := c.do("PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return err
+	}
+	if n, _ := v.(int64); n == 0 {
+		return ErrNil
+	}
+	return nil
+}
+
+// PTTL how long until key expires, ErrNil if it doesn't exist, 0 if it never expires
+func (c *Client) PTTL(key string) (time.Duration, error) {
+	v, err := c.do("PTTL", key)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int64)
+	switch {
+	case !ok:
+		return 0, fmt.Errorf("redis: unexpected reply to PTTL %v", v)
+	case n == -2:
+		return 0, ErrNil
+	case n < 0:
+		return 0, nil
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
+
+func (c *Client) do(args ...string) (interface{}, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	v, err := cn.cmd(c.opts.Timeout, args...)
+	var rerr Error
+	if err != nil && !errors.As(err, &rerr) {
+		// the connection may be left mid reply
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return v, err
+}
+
+func (c *Client) get() (*conn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+	return c.dial()
+}
+
+func (c *Client) put(cn *conn) {
+	select {
+	case c.idle <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+func (c *Client) dial() (*conn, error) {
+	dialer := &net.Dialer{Timeout: c.opts.Timeout}
+	var nc net.Conn
+	var err error
+	if c.opts.TLS != nil {
+		nc, err = tls.DialWithDialer(dialer, "tcp", c.opts.Addr, c.opts.TLS)
+	} else {
+		nc, err = dialer.Dial("tcp", c.opts.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, rd: bufio.NewReader(nc)}
+	if c.opts.Password != "" {
+		if _, err := cn.cmd(c.opts.Timeout, "AUTH", c.opts.Password); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	if c.opts.DB != 0 {
+		if _, err := cn.cmd(c.opts.Timeout, "SELECT", strconv.Itoa(c.opts.DB)); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// cmd send a command as an array of bulk strings and read the reply
+func (cn *conn) cmd(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := cn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(a))+"\r\n"+a+"\r\n"...)
+	}
+	if _, err := cn.Write(buf); err != nil {
+		return nil, err
+	}
+	return cn.reply()
+}
+
+// reply a simple string, an integer, a bulk string ([]byte, nil if it doesn't exist) or an Error
+func (cn *conn) reply() (interface{}, error) {
+	line, err := cn.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.rd, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
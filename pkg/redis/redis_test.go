@@ -0,0 +1,224 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer answers AUTH, SELECT, PING, GET, SET, DEL, INCR, PEXPIRE and PTTL over RESP from a map,
+// keeping but never counting down each key's expiry
+type fakeServer struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	data     map[string]string
+	ttls     map[string]string
+	commands []string
+}
+
+func newFakeServer(t *testing.T, password string) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, password: password, data: make(map[string]string), ttls: make(map[string]string)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	authed := s.password == ""
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, strings.Join(args, " "))
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[1] == s.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "SELECT" || cmd == "PING":
+			reply = "+OK\r\n"
+		case cmd == "SET":
+			s.data[args[1]] = args[2]
+			delete(s.ttls, args[1])
+			if len(args) == 5 {
+				s.ttls[args[1]] = args[4]
+			}
+			reply = "+OK\r\n"
+		case cmd == "GET":
+			v, ok := s.data[args[1]]
+			reply = "$-1\r\n"
+			if ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			}
+		case cmd == "DEL":
+			_, ok := s.data[args[1]]
+			delete(s.data, args[1])
+			delete(s.ttls, args[1])
+			reply = ":0\r\n"
+			if ok {
+				reply = ":1\r\n"
+			}
+		case cmd == "INCR":
+			n, err := strconv.Atoi(s.data[args[1]])
+			if _, ok := s.data[args[1]]; ok && err != nil {
+				reply = "-ERR value is not an integer or out of range\r\n"
+				break
+			}
+			s.data[args[1]] = strconv.Itoa(n + 1)
+			reply = fmt.Sprintf(":%d\r\n", n+1)
+		case cmd == "PEXPIRE":
+			reply = ":0\r\n"
+			if _, ok := s.data[args[1]]; ok {
+				s.ttls[args[1]] = args[2]
+				reply = ":1\r\n"
+			}
+		case cmd == "PTTL":
+			reply = ":-2\r\n"
+			if _, ok := s.data[args[1]]; ok {
+				reply = ":-1\r\n"
+				if ttl, ok := s.ttls[args[1]]; ok {
+					reply = ":" + ttl + "\r\n"
+				}
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		s.mu.Unlock()
+		if _, err := io.WriteString(c, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if line, err = rd.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func TestClient(t *testing.T) {
+	s := newFakeServer(t, "sekret")
+	c := NewClient(Options{Addr: s.ln.Addr().String(), Password: "sekret", DB: 2})
+
+	assert.NoError(t, c.Ping())
+	_, err := c.Get("missing")
+	assert.Equal(t, ErrNil, err)
+
+	// binary values, including the line endings of the protocol itself
+	value := []byte("a\r\nb\x00c")
+	assert.NoError(t, c.Set("key", value, 300*time.Second))
+	got, err := c.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, value, got)
+
+	assert.NoError(t, c.Del("key"))
+	_, err = c.Get("key")
+	assert.Equal(t, ErrNil, err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// one connection authenticated and selected the db once, then was reused
+	assert.Equal(t, []string{"AUTH sekret", "SELECT 2", "PING", "GET missing", "SET key a\r\nb\x00c PX 300000", "GET key", "DEL key", "GET key"}, s.commands)
+}
+
+func TestClientCounter(t *testing.T) {
+	s := newFakeServer(t, "")
+	c := NewClient(Options{Addr: s.ln.Addr().String()})
+
+	_, err := c.PTTL("failures")
+	assert.Equal(t, ErrNil, err)
+	assert.Equal(t, ErrNil, c.PExpire("failures", time.Minute))
+
+	n, err := c.Incr("failures")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	ttl, err := c.PTTL("failures")
+	assert.NoError(t, err)
+	assert.Zero(t, ttl, "the key never expires")
+	assert.NoError(t, c.PExpire("failures", time.Minute))
+	n, err = c.Incr("failures")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	ttl, err = c.PTTL("failures")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, ttl)
+
+	assert.NoError(t, c.Set("name", []byte("vouch"), 0))
+	ttl, err = c.PTTL("name")
+	assert.NoError(t, err)
+	assert.Zero(t, ttl, "the key never expires")
+	_, err = c.Incr("name")
+	var rerr Error
+	assert.True(t, errors.As(err, &rerr), "%v", err)
+}
+
+func TestClientErrors(t *testing.T) {
+	s := newFakeServer(t, "sekret")
+
+	err := NewClient(Options{Addr: s.ln.Addr().String(), Password: "wrong"}).Ping()
+	assert.EqualError(t, err, "redis: WRONGPASS invalid password")
+
+	err = NewClient(Options{Addr: s.ln.Addr().String()}).Ping()
+	var rerr Error
+	assert.True(t, errors.As(err, &rerr), "%v", err)
+
+	s.ln.Close()
+	assert.Error(t, NewClient(Options{Addr: s.ln.Addr().String(), Timeout: time.Second}).Ping())
+}
@@ -11,58 +11,203 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 package responses
 
 import (
+	"encoding/json"
 	"errors"
 	"html/template"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/vouch/vouch-proxy/pkg/cfg"
 	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
 )
 
+// requestIDHeader the id of the request given by the proxy in front of Vouch Proxy, such as nginx's $request_id
+const requestIDHeader = "X-Request-Id"
+
 // Index variables passed to index.tmpl
+// Msg is escaped by html/template, it may carry what the IdP or the user sent
 type Index struct {
 	Msg      string
 	TestURLs []string
 	Testing  bool
+	RetryURL string
+	CSPNonce string
+	// RequestID the request's `X-Request-Id`, or else its trace id with `tracing`, for the user to quote to support
+	RequestID string
+	Branding  cfg.Brand
+}
+
+// LoginOptions variables passed to login_options.tmpl
+type LoginOptions struct {
+	RequestedURL string
+	DomainHint   string
+	Options      []cfg.LoginOption
+	CSPNonce     string
+	Branding     cfg.Brand
+}
+
+// StepUp variables passed to stepup.tmpl, whose script asks the browser for a passkey
+// with Register a new passkey is created for the user, otherwise one of CredentialIDs signs the Challenge
+type StepUp struct {
+	Options  StepUpOptions
+	CSPNonce string
+	Branding cfg.Brand
+}
+
+// StepUpOptions of the WebAuthn ceremony, given to the script of stepup.tmpl as json
+type StepUpOptions struct {
+	Challenge     string   `json:"challenge"`
+	RPID          string   `json:"rpId"`
+	UserID        string   `json:"userId"`
+	Username      string   `json:"username"`
+	CredentialIDs []string `json:"credentialIds"`
+	Register      bool     `json:"register"`
 }
 
 var (
-	indexTemplate *template.Template
-	errorTemplate *template.Template
-	log           *zap.SugaredLogger
-	fastlog       *zap.Logger
+	log     *zap.SugaredLogger
+	fastlog *zap.Logger
 
 	errNotAuthorized = errors.New("not authorized")
 )
 
+// templates parsed from the `templates.dir` of a cfg.Instance
+type templates struct {
+	stepUp       *template.Template
+	loginOptions *template.Template
+	index        *template.Template
+}
+
+type templatesKey struct{}
+
+// std the templates of the package configuration, for a request without a cfg.Instance
+var std = &templates{}
+
+// templatesOf the templates of the cfg.Instance of r, otherwise std
+func templatesOf(r *http.Request) *templates {
+	if t, ok := cfg.State(r.Context(), templatesKey{}).(*templates); ok {
+		return t
+	}
+	return std
+}
+
 // Configure see main.go configure()
 func Configure() {
 	log = cfg.Logging.Logger
 	fastlog = cfg.Logging.FastLogger
 
 	log.Debugf("responses.Configure() attempting to parse templates with cfg.RootDir: %s", cfg.RootDir)
-	indexTemplate = template.Must(template.ParseFiles(filepath.Join(cfg.RootDir, "templates/index.tmpl")))
+	std = parseTemplates()
+}
 
+// ConfigureInstance the templates of inst, see cfg.NewInstance()
+func ConfigureInstance(inst *cfg.Instance) {
+	log = cfg.Logging.Logger
+	fastlog = cfg.Logging.FastLogger
+	inst.SetState(templatesKey{}, parseTemplates())
+}
+
+func parseTemplates() *templates {
+	return &templates{
+		index:        parseTemplate("index.tmpl"),
+		loginOptions: parseTemplate("login_options.tmpl"),
+		stepUp:       parseTemplate("stepup.tmpl"),
+	}
+}
+
+// parseTemplate the template `name` from `templates.dir`, or the built-in one if the dir isn't set or doesn't have it
+// like the built-in templates, one which doesn't parse stops Vouch Proxy at startup
+func parseTemplate(name string) *template.Template {
+	if dir := cfg.Cfg.Templates.Dir; dir != "" {
+		f := filepath.Join(dir, name)
+		if _, err := os.Stat(f); err == nil {
+			log.Infof("using the template %s", f)
+			return template.Must(template.ParseFiles(f))
+		}
+		log.Debugf("templates.dir %s has no %s, using the built-in template", dir, name)
+	}
+	return template.Must(template.ParseFiles(filepath.Join(cfg.RootDir, "templates", name)))
+}
+
+// newIndex the variables of index.tmpl for the response to r
+func newIndex(r *http.Request, msg string) *Index {
+	return &Index{Msg: msg, CSPNonce: CSPNonce(r), RequestID: requestID(r), Branding: cfg.Branding}
+}
+
+// requestID the id of the request, see Index
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	return tracing.TraceID(r.Context())
+}
+
+// CSPNonce the nonce of the `csp.policy` of the response to r, "" if there is none
+func CSPNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cfg.CSPNonceCtxKey).(string)
+	return nonce
 }
 
 // RenderIndex render the response as an HTML page, mostly used in testing
-func RenderIndex(w http.ResponseWriter, msg string) {
-	if err := indexTemplate.Execute(w, &Index{Msg: msg, TestURLs: cfg.Cfg.TestURLs, Testing: cfg.Cfg.Testing}); err != nil {
+func RenderIndex(w http.ResponseWriter, r *http.Request, msg string) {
+	c := cfg.FromContext(r.Context())
+	index := newIndex(r, msg)
+	index.TestURLs, index.Testing = c.TestURLs, c.Testing
+	if err := templatesOf(r).index.Execute(w, index); err != nil {
+		log.Error(err)
+	}
+}
+
+// RenderLoginOptions render the page where the user chooses from `vouch.login_options`
+func RenderLoginOptions(w http.ResponseWriter, r *http.Request, requestedURL string, domainHint string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := templatesOf(r).loginOptions.Execute(w, &LoginOptions{RequestedURL: requestedURL, DomainHint: domainHint, Options: cfg.FromContext(r.Context()).LoginOptions, CSPNonce: CSPNonce(r), Branding: cfg.Branding}); err != nil {
+		log.Error(err)
+	}
+}
+
+// RenderStepUp render the page where the user confirms with a passkey, see `vouch.step_up_hosts`
+func RenderStepUp(w http.ResponseWriter, r *http.Request, options StepUpOptions) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := templatesOf(r).stepUp.Execute(w, &StepUp{Options: options, CSPNonce: CSPNonce(r), Branding: cfg.Branding}); err != nil {
 		log.Error(err)
 	}
 }
 
 // renderError html error page
 // something terse for the end user
-func renderError(w http.ResponseWriter, msg string, status int) {
+func renderError(w http.ResponseWriter, r *http.Request, msg string, status int) {
 	log.Debugf("rendering error for user: %s", msg)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(status)
-	if err := indexTemplate.Execute(w, &Index{Msg: msg}); err != nil {
+	if err := templatesOf(r).index.Execute(w, newIndex(r, msg)); err != nil {
+		log.Error(err)
+	}
+}
+
+// AccessDenied the user declined consent at the IdP (`error=access_denied`)
+// render a friendly explanation along with a link to try again instead of an IdP error
+func AccessDenied(w http.ResponseWriter, r *http.Request, retryURL string) {
+	log.Infof("user declined consent at the IdP: %s", r.URL.Query().Get("error_description"))
+	c := cfg.FromContext(r.Context())
+	cookie.ClearCookie(w, r)
+	w.Header().Set(c.Headers.Error, "access_denied")
+	addErrandCancelRequest(r)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusUnauthorized)
+	index := newIndex(r, c.AccessDeniedMessage)
+	index.RetryURL = retryURL
+	if err := templatesOf(r).index.Execute(w, index); err != nil {
 		log.Error(err)
 	}
 }
@@ -77,9 +222,9 @@ func OK200(w http.ResponseWriter, r *http.Request) {
 
 // Redirect302 redirect to the specificed rURL
 func Redirect302(w http.ResponseWriter, r *http.Request, rURL string) {
-	if cfg.Cfg.Testing {
-		cfg.Cfg.TestURLs = append(cfg.Cfg.TestURLs, rURL)
-		RenderIndex(w, "302 redirect to: "+rURL)
+	if c := cfg.FromContext(r.Context()); c.Testing {
+		c.TestURLs = append(c.TestURLs, rURL)
+		RenderIndex(w, r, "302 redirect to: "+rURL)
 		return
 	}
 	http.Redirect(w, r, rURL, http.StatusFound)
@@ -88,7 +233,7 @@ func Redirect302(w http.ResponseWriter, r *http.Request, rURL string) {
 // Error400 Bad Request
 func Error400(w http.ResponseWriter, r *http.Request, e error) {
 	cancelClearSetError(w, r, e)
-	renderError(w, "400 Bad Request", http.StatusBadRequest)
+	renderError(w, r, "400 Bad Request", http.StatusBadRequest)
 }
 
 // Error401 Unauthorized, the standard error returned when failing /validate
@@ -102,14 +247,70 @@ func Error401(w http.ResponseWriter, r *http.Request, e error) {
 // Error401HTTP
 func Error401HTTP(w http.ResponseWriter, r *http.Request, e error) {
 	cancelClearSetError(w, r, e)
-	renderError(w, e.Error(), http.StatusUnauthorized)
+	renderError(w, r, e.Error(), http.StatusUnauthorized)
 }
 
 // Error403 Forbidden
 // if there's an error during /auth or if they don't pass validation in /auth
 func Error403(w http.ResponseWriter, r *http.Request, e error) {
 	cancelClearSetError(w, r, e)
-	renderError(w, "403 Forbidden", http.StatusForbidden)
+	renderError(w, r, "403 Forbidden", http.StatusForbidden)
+}
+
+// Error403Msg Forbidden with a message for the user
+func Error403Msg(w http.ResponseWriter, r *http.Request, msg string, e error) {
+	cancelClearSetError(w, r, e)
+	renderError(w, r, "403 Forbidden - "+msg, http.StatusForbidden)
+}
+
+// Error403KeepCookie Forbidden with a message for the user, whose cookie is left alone since they may be allowed elsewhere
+func Error403KeepCookie(w http.ResponseWriter, r *http.Request, msg string, e error) {
+	log.Info(e)
+	w.Header().Set(cfg.FromContext(r.Context()).Headers.Error, msg)
+	addErrandCancelRequest(r)
+	renderError(w, r, "403 Forbidden - "+msg, http.StatusForbidden)
+}
+
+// Unavailable the body of a 503, so that clients and proxies can tell why Vouch Proxy is shedding load
+type Unavailable struct {
+	Error      string `json:"error"`
+	Reason     string `json:"reason"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+// Error503 Service Unavailable with a `Retry-After` of retryAfter seconds (or `vouch.retry_after` if 0)
+// and a machine readable reason, which is also set in the `X-Vouch-Error` header
+// the user's cookie is left alone, they'll be fine once the condition clears
+func Error503(w http.ResponseWriter, r *http.Request, reason string, retryAfter int, e error) {
+	log.Warnf("503 %s: %s", reason, e)
+	c := cfg.FromContext(r.Context())
+	if retryAfter <= 0 {
+		retryAfter = c.RetryAfter
+	}
+	w.Header().Set(c.Headers.Error, reason)
+	addErrandCancelRequest(r)
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if err := json.NewEncoder(w).Encode(Unavailable{
+		Error:      "service_unavailable",
+		Reason:     reason,
+		RetryAfter: retryAfter,
+	}); err != nil {
+		log.Error(err)
+	}
+}
+
+// Error429 Too Many Requests with a `Retry-After` of retryAfter seconds
+// the user's cookie is left alone
+func Error429(w http.ResponseWriter, r *http.Request, retryAfter int, e error) {
+	log.Warn(e)
+	w.Header().Set(cfg.FromContext(r.Context()).Headers.Error, e.Error())
+	addErrandCancelRequest(r)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	renderError(w, r, "429 Too Many Requests", http.StatusTooManyRequests)
 }
 
 // Error500 Internal Error
@@ -117,17 +318,32 @@ func Error403(w http.ResponseWriter, r *http.Request, e error) {
 func Error500(w http.ResponseWriter, r *http.Request, e error) {
 	cancelClearSetError(w, r, e)
 	log.Infof("If this error persists it may be worthy of a bug report but please check your setup first.  See the README at %s", cfg.Branding.URL)
-	renderError(w, "500 - Internal Server Error", http.StatusInternalServerError)
+	renderError(w, r, "500 - Internal Server Error", http.StatusInternalServerError)
 }
 
 // cancelClearSetError convenience method to keep it DRY
 func cancelClearSetError(w http.ResponseWriter, r *http.Request, e error) {
 	log.Error(e)
+	tracing.SetError(trace.SpanFromContext(r.Context()), e)
 	cookie.ClearCookie(w, r)
-	w.Header().Set(cfg.Cfg.Headers.Error, e.Error())
+	w.Header().Set(cfg.FromContext(r.Context()).Headers.Error, e.Error())
 	addErrandCancelRequest(r)
 }
 
+// SessionUnchanged the 200 from /validate carrying only the headers already set, see `conditional_validate`
+// like an error it isn't cached, since the next request with the same jwt may not be conditional
+func SessionUnchanged(w http.ResponseWriter, r *http.Request) {
+	cancelRequest(r)
+	OK200(w, r)
+}
+
+// cancelRequest the request's context is done, so that `jwtmanager.JWTCacheHandler` doesn't cache the response
+func cancelRequest(r *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	*r = *r.Clone(ctx)
+	cancel()
+}
+
 // cfg.ErrCtx is tested by `jwtmanager.JWTCacheHandler`
 func addErrandCancelRequest(r *http.Request) {
 	ctx, cancel := context.WithCancel(r.Context())
@@ -0,0 +1,131 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package responses
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/domains"
+)
+
+func TestError503(t *testing.T) {
+	cfg.InitForTestPurposes()
+	cookie.Configure()
+	Configure()
+
+	tests := []struct {
+		name           string
+		retryAfter     int
+		wantRetryAfter string
+	}{
+		{"feature knows better", 120, "120"},
+		{"configured default", 0, "30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/validate", nil)
+			rr := httptest.NewRecorder()
+			Error503(rr, req, "maintenance", tt.retryAfter, errors.New("down for maintenance"))
+
+			assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+			assert.Equal(t, tt.wantRetryAfter, rr.Header().Get("Retry-After"))
+			assert.Equal(t, "maintenance", rr.Header().Get(cfg.Cfg.Headers.Error))
+			assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+			// the user's cookie is left alone
+			assert.Empty(t, rr.Header().Get("Set-Cookie"))
+			// the response isn't cached by the jwt cache
+			assert.Equal(t, true, req.Context().Value(cfg.ErrCtxKey))
+
+			var body Unavailable
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+			assert.Equal(t, "service_unavailable", body.Error)
+			assert.Equal(t, "maintenance", body.Reason)
+			assert.Equal(t, tt.wantRetryAfter, strconv.Itoa(body.RetryAfter))
+		})
+	}
+}
+
+func TestError429(t *testing.T) {
+	cfg.InitForTestPurposes()
+	cookie.Configure()
+	Configure()
+
+	req := httptest.NewRequest("GET", "/login", nil)
+	rr := httptest.NewRecorder()
+	Error429(rr, req, 10, errors.New("/login too many requests from 192.0.2.1"))
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "10", rr.Header().Get("Retry-After"))
+	assert.Equal(t, "/login too many requests from 192.0.2.1", rr.Header().Get(cfg.Cfg.Headers.Error))
+	assert.Empty(t, rr.Header().Get("Set-Cookie"))
+	assert.Equal(t, true, req.Context().Value(cfg.ErrCtxKey))
+}
+
+func TestTemplatesDir(t *testing.T) {
+	cfg.InitForTestPurposes()
+	cookie.Configure()
+	domains.Configure()
+	dir := t.TempDir()
+	index := `<p>{{ .Branding.FullName }} support</p><p id="msg">{{ .Msg }}</p><p id="rid">{{ .RequestID }}</p>`
+	if err := os.WriteFile(filepath.Join(dir, "index.tmpl"), []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Cfg.Templates.Dir = dir
+	defer func() {
+		cfg.Cfg.Templates.Dir = ""
+		Configure()
+	}()
+	Configure()
+
+	// the error_description of the IdP is reflected in the message
+	req := httptest.NewRequest("GET", "/auth?error=server_error", nil)
+	req.Header.Set("X-Request-Id", "7f3a")
+	rr := httptest.NewRecorder()
+	Error401HTTP(rr, req, errors.New(`/auth Error from IdP: server_error - <script>alert(1)</script>`))
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	body := rr.Body.String()
+	assert.Contains(t, body, "<p>Vouch Proxy support</p>")
+	assert.Contains(t, body, `<p id="rid">7f3a</p>`)
+	assert.Contains(t, body, "&lt;script&gt;alert(1)&lt;/script&gt;")
+	assert.NotContains(t, body, "<script>")
+
+	// login_options.tmpl isn't in the dir, the built-in one is used
+	rr = httptest.NewRecorder()
+	RenderLoginOptions(rr, httptest.NewRequest("GET", "/login", nil), "http://app.example.com/", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEmpty(t, rr.Body.String())
+}
+
+func TestRenderIndexEscapes(t *testing.T) {
+	cfg.InitForTestPurposes()
+	cookie.Configure()
+	domains.Configure()
+	Configure()
+
+	req := httptest.NewRequest("GET", "/auth", nil)
+	rr := httptest.NewRecorder()
+	Error401HTTP(rr, req, errors.New(`<img src=x onerror=alert(1)>`))
+	assert.NotContains(t, rr.Body.String(), "<img src=x")
+	assert.Contains(t, rr.Body.String(), "&lt;img src=x onerror=alert(1)&gt;")
+	assert.NotContains(t, rr.Body.String(), "quote the request id", "there's no request id without X-Request-Id or tracing")
+}
@@ -0,0 +1,206 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package selftest runs live checks at startup, before serving traffic, see `self_test` in the config
+// and the checks of `-test`, which validates the configuration without serving traffic
+package selftest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/providerhealth"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+var log *zap.SugaredLogger
+
+const selfTestUser = "self-test"
+
+type check struct {
+	name string
+	// provider the check is run for each of the providers of `oauth`, a failure is reported as the provider's health at /readyz
+	provider bool
+	run      func(ctx context.Context, p provider) error
+}
+
+var checks = []check{
+	{"jwt", false, func(ctx context.Context, _ provider) error { return jwtRoundTrip(ctx) }},
+	{"jwks", true, loadJWKS},
+	{"token_url", true, tokenURLReachable},
+}
+
+// provider the endpoints of one of the OAuthConfigs of the cfg.Instance
+type provider struct {
+	name     string
+	authURL  string
+	tokenURL string
+	jwksURL  string
+}
+
+// providers each of the providers of `oauth`, not just the first of them
+func providers(ctx context.Context) []provider {
+	oauthConfigs := cfg.InstanceOf(ctx).OAuthConfigs
+	ps := make([]provider, 0, len(oauthConfigs))
+	for _, c := range oauthConfigs {
+		ps = append(ps, provider{name: c.Name, authURL: c.AuthURL, tokenURL: c.TokenURL, jwksURL: c.JWKSURL})
+	}
+	return ps
+}
+
+// checkName the name of a provider's check names the provider when `oauth` lists more than one
+func checkName(ctx context.Context, name string, p provider) string {
+	if len(cfg.InstanceOf(ctx).OAuthConfigs) > 1 {
+		return p.name + " " + name
+	}
+	return name
+}
+
+// Configure see main.go configure()
+func Configure() {
+	log = cfg.Logging.Logger
+}
+
+// Run each check, with `self_test.on_failure: fatal` an error naming every failure is returned
+// with `warn` each failure is logged and a provider which failed is unhealthy at /readyz until a token exchange succeeds
+// the checks are of the cfg.Instance of ctx
+func Run(ctx context.Context) error {
+	var failed []string
+	providersFailed := map[string]bool{}
+	ps := providers(ctx)
+	for _, c := range checks {
+		if !c.provider {
+			if err := c.run(ctx, provider{}); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", c.name, err))
+				continue
+			}
+			log.Debugf("self test: %s ok", c.name)
+			continue
+		}
+		for _, p := range ps {
+			name := checkName(ctx, c.name, p)
+			if err := c.run(ctx, p); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", name, err))
+				providersFailed[p.name] = true
+				continue
+			}
+			log.Debugf("self test: %s ok", name)
+		}
+	}
+	if len(failed) == 0 {
+		log.Info("self test passed")
+		return nil
+	}
+	if cfg.FromContext(ctx).SelfTest.OnFailure == cfg.SelfTestFatal {
+		return fmt.Errorf("self test failed: %s", strings.Join(failed, "; "))
+	}
+	for _, f := range failed {
+		log.Errorf("SELF TEST FAILED, continuing per self_test.on_failure: %s", f)
+	}
+	for name := range providersFailed {
+		providerhealth.SelfTestFailed(ctx, name)
+	}
+	return nil
+}
+
+// CheckConfig the checks of `-test` for a configuration which has passed cfg.ValidateConfiguration(), returning each problem found
+// with offline the provider isn't reached, for validating a configuration where the provider can't be reached (such as in CI)
+func CheckConfig(ctx context.Context, offline bool) []error {
+	var problems []error
+	add := func(name string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	add("jwt.secret", cfg.CheckJWTSecretLength())
+	add("domains", checkDomains(ctx))
+	add("jwt", jwtRoundTrip(ctx))
+	if offline {
+		log.Info("config test: skipping the checks which reach the provider")
+		return problems
+	}
+	for _, p := range providers(ctx) {
+		add(checkName(ctx, "auth_url", p), reachable(ctx, p.authURL))
+		add(checkName(ctx, "token_url", p), reachable(ctx, p.tokenURL))
+		add(checkName(ctx, "jwks", p), loadJWKS(ctx, p))
+	}
+	return problems
+}
+
+// checkDomains each of `vouch.domains` is a domain such as example.com, not a url or an email address
+func checkDomains(ctx context.Context) error {
+	c := cfg.FromContext(ctx)
+	for _, d := range c.Domains {
+		if d == "" || strings.ContainsAny(d, "/@: \t") {
+			return fmt.Errorf("%q is not a domain such as example.com", d)
+		}
+	}
+	for _, w := range c.WhiteList {
+		if strings.TrimSpace(w) == "" {
+			return errors.New("whiteList holds an empty entry")
+		}
+	}
+	return nil
+}
+
+// reachable the provider answers a HEAD of url, with any status since it isn't an authorization or token request
+func reachable(ctx context.Context, url string) error {
+	if url == "" {
+		return nil
+	}
+	resp, err := common.HTTPClient(ctx).Head(url)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// jwtRoundTrip sign a JWT with the `jwt` keys and verify it, as for a user at login and at /validate
+func jwtRoundTrip(ctx context.Context) error {
+	token, err := jwtmanager.NewVPJWT(ctx, structs.User{Username: selfTestUser}, structs.CustomClaims{}, structs.PTokens{})
+	if err != nil {
+		return err
+	}
+	claims, err := jwtmanager.ClaimsFromJWT(ctx, token)
+	if err != nil {
+		return fmt.Errorf("verifying the signed JWT: %w", err)
+	}
+	if claims.Username != selfTestUser {
+		return errors.New("the verified JWT does not hold the signed claims")
+	}
+	return nil
+}
+
+// loadJWKS the keys which verify the provider's id_tokens can be fetched
+func loadJWKS(ctx context.Context, p provider) error {
+	if p.jwksURL == "" {
+		return nil
+	}
+	return common.LoadJWKS(ctx, p.jwksURL)
+}
+
+// tokenURLReachable the provider answers at `oauth.token_url`, with any status since a GET isn't a token request
+func tokenURLReachable(ctx context.Context, p provider) error {
+	if p.tokenURL == "" {
+		return nil
+	}
+	resp, err := common.HTTPClient(ctx).Get(p.tokenURL)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
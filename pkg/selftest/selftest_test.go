@@ -0,0 +1,145 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package selftest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/providerhealth"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+)
+
+func setUp(t *testing.T, onFailure string) *httptest.Server {
+	cfg.InitForTestPurposes()
+	cfg.Cfg.SelfTest.OnFailure = onFailure
+	jwtmanager.Configure()
+	common.Configure()
+	providerhealth.Configure()
+	Configure()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a GET of the token endpoint is refused, the provider is up all the same
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}))
+	t.Cleanup(ts.Close)
+	cfg.GenOAuth.TokenURL = ts.URL
+	return ts
+}
+
+func TestRun(t *testing.T) {
+	setUp(t, cfg.SelfTestFatal)
+	assert.NoError(t, Run(context.Background()))
+}
+
+func TestRunBrokenSigningKey(t *testing.T) {
+	setUp(t, cfg.SelfTestFatal)
+	cfg.Cfg.JWT.SigningMethod = "RS256"
+	cfg.Cfg.JWT.PrivateKeyFile = "/nonexistent/rsa.key"
+	cfg.Cfg.JWT.PublicKeyFile = "/nonexistent/rsa.pub"
+
+	err := Run(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "jwt: ")
+	assert.NotContains(t, err.Error(), "token_url")
+}
+
+func TestRunUnreachableProvider(t *testing.T) {
+	ts := setUp(t, cfg.SelfTestFatal)
+	ts.Close()
+	cfg.GenOAuth.JWKSURL = ts.URL + "/keys"
+
+	err := Run(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "jwks: ")
+	assert.Contains(t, err.Error(), "token_url: ")
+	assert.True(t, providerhealth.Ready(context.Background()), "fatal doesn't get as far as serving /readyz")
+}
+
+func TestRunUnreachableProviderWarn(t *testing.T) {
+	ts := setUp(t, cfg.SelfTestWarn)
+	ts.Close()
+
+	assert.NoError(t, Run(context.Background()))
+	assert.False(t, providerhealth.Ready(context.Background()))
+	assert.False(t, providerhealth.Statuses(context.Background())[cfg.GenOAuth.Provider].Healthy)
+
+	providerhealth.Success(context.Background(), cfg.GenOAuth.Provider)
+	assert.True(t, providerhealth.Ready(context.Background()), "healthy after a token exchange succeeds")
+}
+
+// every provider of `oauth` is checked, not only the first
+func TestRunEachProvider(t *testing.T) {
+	setUp(t, cfg.SelfTestWarn)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	other := *cfg.GenOAuth
+	other.Name = "other"
+	other.TokenURL = down.URL
+	cfg.OAuthConfigs = append(cfg.OAuthConfigs, &other)
+	providerhealth.Configure()
+
+	assert.NoError(t, Run(context.Background()))
+	assert.True(t, providerhealth.Statuses(context.Background())[cfg.GenOAuth.Name].Healthy)
+	assert.False(t, providerhealth.Statuses(context.Background())["other"].Healthy)
+
+	cfg.Cfg.SelfTest.OnFailure = cfg.SelfTestFatal
+	err := Run(context.Background())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "other token_url: ")
+	}
+	assert.Contains(t, fmt.Sprint(CheckConfig(context.Background(), false)), "other token_url: ")
+}
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		modify       func(ts *httptest.Server)
+		offline      bool
+		wantProblems []string
+	}{
+		{"ok", func(ts *httptest.Server) {}, false, nil},
+		{"short secret", func(ts *httptest.Server) { cfg.Cfg.JWT.Secret = "tooshort" }, false, []string{"jwt.secret: "}},
+		{"url for a domain", func(ts *httptest.Server) { cfg.Cfg.Domains = []string{"https://example.com"} }, false, []string{"domains: "}},
+		{"empty whitelist entry", func(ts *httptest.Server) { cfg.Cfg.WhiteList = []string{""} }, false, []string{"domains: "}},
+		{"unreachable provider", func(ts *httptest.Server) { ts.Close() }, false, []string{"auth_url: ", "token_url: "}},
+		{"unreachable provider, offline", func(ts *httptest.Server) { ts.Close() }, true, nil},
+		{"short secret and unreachable provider", func(ts *httptest.Server) {
+			cfg.Cfg.JWT.Secret = "tooshort"
+			ts.Close()
+		}, false, []string{"jwt.secret: ", "auth_url: ", "token_url: "}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := setUp(t, cfg.SelfTestFatal)
+			cfg.Cfg.JWT.Secret = strings.Repeat("s", 44)
+			jwtmanager.Configure()
+			cfg.GenOAuth.AuthURL = ts.URL + "/authorize"
+			tt.modify(ts)
+
+			problems := CheckConfig(context.Background(), tt.offline)
+			assert.Len(t, problems, len(tt.wantProblems), "%v", problems)
+			for i, p := range problems {
+				if i < len(tt.wantProblems) {
+					assert.Contains(t, p.Error(), tt.wantProblems[i])
+				}
+			}
+		})
+	}
+}
@@ -10,7 +10,10 @@ OR CONDITIONS OF ANY KIND, either express or implied.
 
 package structs
 
-import "strconv"
+import (
+	"strconv"
+	"time"
+)
 
 // CustomClaims Temporary struct storing custom claims until JWT creation.
 type CustomClaims struct {
@@ -24,9 +27,9 @@ type UserI interface {
 
 // User is inherited.
 type User struct {
-	// TODO: set Provider here so that we can pass it to db
+	// Provider the name of the oauth provider the user logged in with
+	Provider string `json:"-" mapstructure:"-"`
 	// populated by db (via mapstructure) or from provider (via json)
-	// Provider   string `json:"provider",mapstructure:"provider"`
 	Username   string `json:"username" mapstructure:"username"`
 	Name       string `json:"name" mapstructure:"name"`
 	Email      string `json:"email" mapstructure:"email"`
@@ -130,6 +133,23 @@ func (u *GitHubUser) PrepareUserData() {
 	u.Username = u.Login
 }
 
+// GitLabUser is a retrieved and authenticated user from GitLab
+type GitLabUser struct {
+	User
+	GitLabID int    `json:"id"`
+	Picture  string `json:"avatar_url"`
+}
+
+// GitLabGroup for the GitLab groups api call
+type GitLabGroup struct {
+	FullPath string `json:"full_path"`
+}
+
+// PrepareUserData implement PersonalData interface
+func (u *GitLabUser) PrepareUserData() {
+	u.ID = u.GitLabID
+}
+
 // IndieAuthUser see indieauth.net
 type IndieAuthUser struct {
 	User
@@ -217,6 +237,33 @@ type AliData struct {
 	OuName   string `json:"ou_name"`
 }
 
+// AppleUser is a retrieved and authenticated user from Sign in with Apple, from the claims of the id_token
+// the user's name is not among them, Apple sends it only at the first authorization, see AppleName
+type AppleUser struct {
+	User
+	Sub string `json:"sub"`
+}
+
+// PrepareUserData implement PersonalData interface
+// a user who hid their email from the app (and hasn't shared a relay address) is known by their sub
+func (u *AppleUser) PrepareUserData() {
+	if u.Username == "" {
+		u.Username = u.Email
+	}
+	if u.Username == "" {
+		u.Username = u.Sub
+	}
+}
+
+// AppleName the `user` form value posted by Apple with the first authorization of the app by the user
+type AppleName struct {
+	Name struct {
+		FirstName string `json:"firstName"`
+		LastName  string `json:"lastName"`
+	} `json:"name"`
+	Email string `json:"email"`
+}
+
 // Team has members and provides acess to sites
 type Team struct {
 	Name       string   `json:"name" mapstructure:"name"`
@@ -239,4 +286,7 @@ type Site struct {
 type PTokens struct {
 	PAccessToken string
 	PIdToken     string
+	// PRefreshToken and PExpiry, the expiry of PAccessToken, are kept with `oauth.use_refresh_tokens`
+	PRefreshToken string
+	PExpiry       time.Time
 }
@@ -0,0 +1,130 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package timelog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// the metrics of the Server-Timing header, see `server_timing` in the config
+const (
+	TimingToken    = "token"
+	TimingUserInfo = "userinfo"
+	TimingClaims   = "claims"
+	TimingJWT      = "jwt"
+	TimingTotal    = "total"
+)
+
+var timingDescriptions = map[string]string{
+	TimingToken:    "token exchange",
+	TimingUserInfo: "userinfo request",
+	TimingClaims:   "claim mapping",
+	TimingJWT:      "jwt signing",
+	TimingTotal:    "total",
+}
+
+type timingsKey struct{}
+
+// timings the durations recorded for one request, in the order they were recorded
+type timings struct {
+	mu      sync.Mutex
+	names   []string
+	elapsed map[string]time.Duration
+}
+
+// withTimings a context in which Record keeps the durations of the request, if `server_timing.enabled`
+func withTimings(ctx context.Context) context.Context {
+	if !cfg.FromContext(ctx).ServerTiming.Enabled {
+		return ctx
+	}
+	return context.WithValue(ctx, timingsKey{}, &timings{elapsed: make(map[string]time.Duration)})
+}
+
+func timingsFrom(r *http.Request) *timings {
+	t, _ := r.Context().Value(timingsKey{}).(*timings)
+	return t
+}
+
+// Record the time taken by one step of the request for its Server-Timing header, repeated steps add up
+func Record(r *http.Request, name string, d time.Duration) {
+	t := timingsFrom(r)
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.elapsed[name]; !ok {
+		t.names = append(t.names, name)
+	}
+	t.elapsed[name] += d
+}
+
+// Since Record the time since start
+func Since(r *http.Request, name string, start time.Time) {
+	Record(r, name, time.Since(start))
+}
+
+// Recorded the time so far recorded for name
+func Recorded(r *http.Request, name string) time.Duration {
+	t := timingsFrom(r)
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.elapsed[name]
+}
+
+// header `token;desc="token exchange";dur=12.3, ...` in milliseconds
+// https://www.w3.org/TR/server-timing/
+func (t *timings) header(total time.Duration) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	metrics := make([]string, 0, len(t.names)+1)
+	for _, name := range append(t.names, TimingTotal) {
+		d := total
+		if name != TimingTotal {
+			d = t.elapsed[name]
+		}
+		metrics = append(metrics, fmt.Sprintf("%s;desc=%q;dur=%.1f", name, timingDescriptions[name], float64(d)/float64(time.Millisecond)))
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// serverTimingWriter adds the Server-Timing header just before the response is written
+type serverTimingWriter struct {
+	http.ResponseWriter
+	timings     *timings
+	start       time.Time
+	wroteHeader bool
+}
+
+func (w *serverTimingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set("Server-Timing", w.timings.header(time.Since(w.start)))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *serverTimingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -42,9 +42,14 @@ func TimeLog(nextHandler http.Handler) func(http.ResponseWriter, *http.Request)
 		start := time.Now()
 
 		// make the call
+		// detached from the request, but served by its cfg.Instance
+		ctx := withTimings(cfg.WithInstanceOf(context.Background(), r.Context()))
+		rt := r.WithContext(ctx)
+		if t := timingsFrom(rt); t != nil {
+			w = &serverTimingWriter{ResponseWriter: w, timings: t, start: start}
+		}
 		v := capturewriter.CaptureWriter{ResponseWriter: w, StatusCode: 0}
-		ctx := context.Background()
-		nextHandler.ServeHTTP(&v, r.WithContext(ctx))
+		nextHandler.ServeHTTP(&v, rt)
 
 		// Stop timer
 		end := time.Now()
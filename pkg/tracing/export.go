@@ -0,0 +1,131 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package tracing
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// maxQueued the spans waiting to be sent, past which more are dropped rather than holding up a login
+const maxQueued = 2048
+
+// urlQuery the query and fragment of a url within an error message
+var urlQuery = regexp.MustCompile(`(\w+://[^\s?#"]*)[?#][^\s"]*`)
+
+// newExporter send the spans to `tracing.endpoint`, less the query of any url recorded on them
+// the path /v1/traces of otlptracehttp is kept for an endpoint without a path of its own
+func newExporter() (sdktrace.SpanExporter, error) {
+	// checked by cfg.ValidateConfiguration()
+	u, err := url.Parse(cfg.Cfg.Tracing.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return redactingExporter{exporter}, nil
+}
+
+func serviceResource() *resource.Resource {
+	return resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(cfg.Cfg.Tracing.ServiceName))
+}
+
+// redactingExporter otelhttp records the whole url of a request, whose query may carry a token or code,
+// each span is sent without them
+type redactingExporter struct {
+	sdktrace.SpanExporter
+}
+
+func (e redactingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	redacted := make([]sdktrace.ReadOnlySpan, len(spans))
+	for i, s := range spans {
+		redacted[i] = redactedSpan{s}
+	}
+	return e.SpanExporter.ExportSpans(ctx, redacted)
+}
+
+type redactedSpan struct {
+	sdktrace.ReadOnlySpan
+}
+
+func (s redactedSpan) Attributes() []attribute.KeyValue {
+	return redactAttributes(s.ReadOnlySpan.Attributes())
+}
+
+func (s redactedSpan) Events() []sdktrace.Event {
+	events := s.ReadOnlySpan.Events()
+	redacted := make([]sdktrace.Event, len(events))
+	for i, e := range events {
+		e.Attributes = redactAttributes(e.Attributes)
+		redacted[i] = e
+	}
+	return redacted
+}
+
+func (s redactedSpan) Status() sdktrace.Status {
+	status := s.ReadOnlySpan.Status()
+	status.Description = withoutQueries(status.Description)
+	return status
+}
+
+func redactAttributes(attrs []attribute.KeyValue) []attribute.KeyValue {
+	redacted := make([]attribute.KeyValue, len(attrs))
+	for i, kv := range attrs {
+		if kv.Value.Type() == attribute.STRING {
+			switch kv.Key {
+			case semconv.HTTPURLKey:
+				if u, err := url.Parse(kv.Value.AsString()); err == nil {
+					kv = kv.Key.String(withoutQuery(u))
+				}
+			case semconv.HTTPTargetKey:
+				target := kv.Value.AsString()
+				if end := strings.IndexAny(target, "?#"); end >= 0 {
+					kv = kv.Key.String(target[:end])
+				}
+			default:
+				kv = kv.Key.String(withoutQueries(kv.Value.AsString()))
+			}
+		}
+		redacted[i] = kv
+	}
+	return redacted
+}
+
+// withoutQueries the message less the query of each url in it, such as that of a *url.Error
+func withoutQueries(msg string) string {
+	return urlQuery.ReplaceAllString(msg, "$1")
+}
+
+// withoutQuery the url less its query, fragment and any password
+func withoutQuery(u *url.URL) string {
+	c := *u
+	c.RawQuery, c.Fragment, c.User = "", "", nil
+	return c.String()
+}
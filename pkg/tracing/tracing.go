@@ -0,0 +1,131 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package tracing OpenTelemetry spans of the login flow, sent per `vouch.tracing` to a collector over OTLP/HTTP
+// the W3C `traceparent` of a request continues its trace, and is passed on to the requests made to the provider
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// the attributes Vouch Proxy records on a span, besides those of otelhttp
+const (
+	AttrProvider = attribute.Key("vouch.provider")
+	AttrDecision = attribute.Key("vouch.decision")
+)
+
+var (
+	log *zap.SugaredLogger
+	// provider the spans' TracerProvider, nil when tracing is off
+	provider *sdktrace.TracerProvider
+)
+
+// Configure see main.go configure()
+// with tracing off otel's global TracerProvider is left as the no-op one, whose spans are neither recorded nor propagated
+func Configure() {
+	log = cfg.Logging.Logger
+	if provider != nil {
+		_ = provider.Shutdown(context.Background())
+		provider = nil
+	}
+	if !cfg.Cfg.Tracing.Enabled {
+		return
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warnf("tracing: %s", err)
+	}))
+	exporter, err := newExporter()
+	if err != nil {
+		log.Errorf("tracing: could not start the exporter to %s: %s", cfg.Cfg.Tracing.Endpoint, err)
+		return
+	}
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter, sdktrace.WithMaxQueueSize(maxQueued)),
+		// a trace continued from a `traceparent` follows its sampled flag
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Cfg.Tracing.SampleRate))),
+		sdktrace.WithResource(serviceResource()),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// Flush send the spans ended so far, and wait until they're sent
+func Flush() {
+	if provider == nil {
+		return
+	}
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		log.Warnf("tracing: could not send the spans to %s: %s", cfg.Cfg.Tracing.Endpoint, err)
+	}
+}
+
+// Start a span within the span of ctx, or else a new trace
+func Start(ctx context.Context, name string) (context.Context, trace.Span) {
+	return otel.Tracer(cfg.Branding.FullName).Start(ctx, name)
+}
+
+// SetError the operation of span failed with err, nothing if err is nil
+func SetError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// TraceID the id of the trace of ctx, "" when tracing is off
+func TraceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// Handler the handling of each request by next is a span named for its route, recording the status of the response
+func Handler(route string, next http.Handler) http.Handler {
+	if !cfg.Cfg.Tracing.Enabled {
+		return next
+	}
+	return otelhttp.NewHandler(otelhttp.WithRouteTag(route, next), route)
+}
+
+// Transport each request sent by next is a span within that of the request's context, or else of ctx,
+// and carries its `traceparent` to the provider
+func Transport(ctx context.Context, next http.RoundTripper) http.RoundTripper {
+	if !cfg.FromContext(ctx).Tracing.Enabled {
+		return next
+	}
+	return &transport{next: otelhttp.NewTransport(next), ctx: ctx}
+}
+
+type transport struct {
+	next http.RoundTripper
+	ctx  context.Context
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !trace.SpanContextFromContext(req.Context()).IsValid() && t.ctx != nil {
+		req = req.WithContext(trace.ContextWithSpan(req.Context(), trace.SpanFromContext(t.ctx)))
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,212 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+const inbound = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// collector an OTLP collector at path, the spans it was sent are returned by the func along with the bodies they came in
+func collector(t *testing.T, path string) (*httptest.Server, func() ([]*tracepb.Span, []byte)) {
+	var mu sync.Mutex
+	var spans []*tracepb.Span
+	var bodies []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, path, r.URL.Path)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var req coltracepb.ExportTraceServiceRequest
+		assert.NoError(t, proto.Unmarshal(body, &req))
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, body...)
+		for _, rs := range req.ResourceSpans {
+			assert.Equal(t, "vouch-test", rs.Resource.Attributes[0].Value.GetStringValue())
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() ([]*tracepb.Span, []byte) {
+		Flush()
+		mu.Lock()
+		defer mu.Unlock()
+		return spans, bodies
+	}
+}
+
+func setUp(t *testing.T, endpoint string, sampleRate float64) {
+	cfg.InitForTestPurposes()
+	cfg.Cfg.Tracing.Enabled = true
+	cfg.Cfg.Tracing.Endpoint = endpoint
+	cfg.Cfg.Tracing.ServiceName = "vouch-test"
+	cfg.Cfg.Tracing.SampleRate = sampleRate
+	Configure()
+	t.Cleanup(func() {
+		cfg.Cfg.Tracing.Enabled = false
+		Configure()
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+}
+
+// attributes the string and int attributes of s
+func attributes(s *tracepb.Span) map[string]interface{} {
+	attrs := map[string]interface{}{}
+	for _, kv := range s.Attributes {
+		switch v := kv.Value.Value.(type) {
+		case *commonpb.AnyValue_StringValue:
+			attrs[kv.Key] = v.StringValue
+		case *commonpb.AnyValue_IntValue:
+			attrs[kv.Key] = v.IntValue
+		}
+	}
+	return attrs
+}
+
+func TestDisabled(t *testing.T) {
+	cfg.InitForTestPurposes()
+	cfg.Cfg.Tracing.Enabled = false
+	Configure()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, TraceID(r.Context()))
+	})
+	req := httptest.NewRequest("GET", "/login", nil)
+	req.Header.Set("traceparent", inbound)
+	Handler("/login", next).ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, http.DefaultTransport, Transport(context.Background(), http.DefaultTransport))
+
+	// the span of a context without one may be used as any other
+	ctx, span := Start(context.Background(), "userinfo")
+	assert.False(t, span.IsRecording())
+	SetError(span, errors.New("failed"))
+	span.End()
+	assert.Empty(t, TraceID(ctx))
+}
+
+func TestHandler(t *testing.T) {
+	srv, sent := collector(t, "/v1/traces")
+	setUp(t, srv.URL, 1)
+
+	// the provider is sent the traceparent of the span of its request, without the request's query being recorded
+	var providerTraceParent string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		providerTraceParent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer provider.Close()
+
+	h := Handler("/auth/{state}/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", TraceID(r.Context()))
+		trace.SpanFromContext(r.Context()).SetAttributes(AttrProvider.String("oidc"))
+		ctx, span := Start(r.Context(), "userinfo")
+		defer span.End()
+		// the client of the provider makes its requests without the context of the userinfo span
+		client := &http.Client{Transport: Transport(ctx, http.DefaultTransport)}
+		resp, err := client.Get(provider.URL + "/userinfo?access_token=secrettoken")
+		assert.NoError(t, err)
+		_, _ = ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		_, err = client.Get("http://127.0.0.1:1/userinfo?access_token=secrettoken")
+		SetError(span, err)
+		SetError(trace.SpanFromContext(r.Context()), errors.New("user not permitted"))
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	req := httptest.NewRequest("GET", "/auth/abc/?state=abc&code=secretcode", nil)
+	req.Header.Set("traceparent", inbound)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	got, body := sent()
+	spans := map[string][]*tracepb.Span{}
+	for _, s := range got {
+		spans[s.Name] = append(spans[s.Name], s)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(s.TraceId), "the trace of the inbound traceparent is continued")
+	}
+	assert.Len(t, got, 4)
+
+	server := spans["/auth/{state}/"][0]
+	assert.Equal(t, tracepb.Span_SPAN_KIND_SERVER, server.Kind)
+	assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(server.ParentSpanId))
+	assert.Equal(t, "user not permitted", server.Events[0].Attributes[1].Value.GetStringValue())
+	assert.Equal(t, "oidc", attributes(server)["vouch.provider"])
+	assert.Equal(t, int64(403), attributes(server)["http.status_code"])
+	assert.Equal(t, "/auth/{state}/", attributes(server)["http.route"])
+	assert.Equal(t, "/auth/abc/", attributes(server)["http.target"])
+
+	userinfo := spans["userinfo"][0]
+	assert.Equal(t, server.SpanId, userinfo.ParentSpanId)
+	assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, userinfo.Status.Code)
+	assert.Contains(t, userinfo.Status.Message, "http://127.0.0.1:1/userinfo")
+
+	assert.Len(t, spans["HTTP GET"], 2)
+	client := spans["HTTP GET"][0]
+	if attributes(client)["http.url"] != provider.URL+"/userinfo" {
+		client = spans["HTTP GET"][1]
+	}
+	assert.Equal(t, tracepb.Span_SPAN_KIND_CLIENT, client.Kind)
+	assert.Equal(t, userinfo.SpanId, client.ParentSpanId)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+hex.EncodeToString(client.SpanId)+"-01", providerTraceParent)
+	assert.Equal(t, provider.URL+"/userinfo", attributes(client)["http.url"])
+
+	assert.False(t, bytes.Contains(body, []byte("secret")), "no token or code is sent to the collector")
+}
+
+func TestSampleRate(t *testing.T) {
+	srv, sent := collector(t, "/otlp/traces")
+	setUp(t, srv.URL+"/otlp/traces", 0)
+
+	Handler("/login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// an unsampled trace is still carried on to the provider
+		sc := trace.SpanContextFromContext(r.Context())
+		assert.True(t, sc.IsValid())
+		assert.False(t, sc.IsSampled())
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/login", nil))
+	spans, _ := sent()
+	assert.Empty(t, spans)
+
+	// the sampled flag of the inbound traceparent is followed
+	req := httptest.NewRequest("GET", "/login", nil)
+	req.Header.Set("traceparent", inbound)
+	Handler("/login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), req)
+	spans, _ = sent()
+	assert.Len(t, spans, 1)
+}
+
+func Test_withoutQueries(t *testing.T) {
+	_, err := http.Get("http://127.0.0.1:1/userinfo?access_token=secrettoken")
+	assert.Error(t, err)
+	assert.NotContains(t, withoutQueries(err.Error()), "secrettoken")
+	assert.Contains(t, withoutQueries(err.Error()), `"http://127.0.0.1:1/userinfo"`)
+	assert.Equal(t, "plain", withoutQueries("plain"))
+}
@@ -0,0 +1,204 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+// Package vouch Vouch Proxy as a library, for an application embedding its login and JWT validation
+// rather than running the binary
+//
+//	c := cfg.Defaults()
+//	c.Domains = []string{"yourdomain.com"}
+//	v, err := vouch.New(c, &cfg.OAuthConfig{Provider: "github", ClientID: "...", ClientSecret: "..."})
+//	...
+//	http.Handle("/", v.Handlers())
+//	user, err := v.ValidateToken(jwt)
+//
+// Each Vouch keeps its configuration as a cfg.Instance, which its Handlers() put in the context of each request,
+// so that several of them may serve side by side in the one process.
+// Logging, metrics and tracing are those of the process, as are the caches keyed by a jwt or by the state of a login.
+package vouch
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+
+	"github.com/gorilla/mux"
+
+	"github.com/vouch/vouch-proxy/handlers"
+	"github.com/vouch/vouch-proxy/handlers/saml"
+	"github.com/vouch/vouch-proxy/pkg/audit"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/geoip"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/providerhealth"
+	"github.com/vouch/vouch-proxy/pkg/providers/common"
+	"github.com/vouch/vouch-proxy/pkg/proxyproto"
+	"github.com/vouch/vouch-proxy/pkg/responses"
+	"github.com/vouch/vouch-proxy/pkg/selftest"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+	"github.com/vouch/vouch-proxy/pkg/timelog"
+	"github.com/vouch/vouch-proxy/pkg/tracing"
+)
+
+const staticDir = "/static/"
+
+// Vouch a configured Vouch Proxy
+type Vouch struct {
+	inst   *cfg.Instance
+	router *mux.Router
+}
+
+// New configure Vouch Proxy from c and the oauth providers, the first of them the default, see cfg.NewInstance()
+// the package configuration (cfg.Cfg), which the binary serves, is left as it was
+func New(c cfg.Config, oauth ...*cfg.OAuthConfig) (*Vouch, error) {
+	v := &Vouch{}
+	inst, err := cfg.NewInstance(c, oauth, func(inst *cfg.Instance) {
+		configureInstance(inst)
+		v.router = Router()
+	})
+	if err != nil {
+		return nil, err
+	}
+	v.inst = inst
+	return v, nil
+}
+
+// ValidateToken the user of a JWT issued by this Vouch, as its /validate would accept it
+func (v *Vouch) ValidateToken(tokenString string) (*structs.User, error) {
+	return handlers.UserFromJWT(v.context(), tokenString)
+}
+
+// VerifyUser the user is one this Vouch permits to log in, see handlers.VerifyUser()
+func (v *Vouch) VerifyUser(user structs.User) error {
+	return handlers.VerifyUser(v.context(), user)
+}
+
+// Handlers /login, /auth, /validate, /logout and the rest of Vouch Proxy's endpoints, served with the configuration of this Vouch
+func (v *Vouch) Handlers() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.router.ServeHTTP(w, r.WithContext(cfg.WithInstance(r.Context(), v.inst)))
+	})
+}
+
+// context a context with the configuration of this Vouch
+func (v *Vouch) context() context.Context {
+	return cfg.WithInstance(context.Background(), v.inst)
+}
+
+// Configure each of Vouch Proxy's packages from the configuration, once cfg is configured and validated
+func Configure() {
+	domains.Configure()
+	jwtmanager.Configure()
+	cookie.Configure()
+	responses.Configure()
+	handlers.Configure()
+	timelog.Configure()
+	tracing.Configure()
+	audit.Configure()
+	proxyproto.Configure()
+	selftest.Configure()
+}
+
+// configureInstance each of Vouch Proxy's packages for inst, called by cfg.NewInstance() while cfg.Cfg is that of inst
+// logging, metrics and tracing are configured for the process, as Configure() would
+func configureInstance(inst *cfg.Instance) {
+	domains.Configure()
+	// before the providers, which build their clients with common.HTTPClient()
+	common.ConfigureInstance(inst)
+	jwtmanager.ConfigureInstance(inst)
+	cookie.Configure()
+	responses.ConfigureInstance(inst)
+	providerhealth.ConfigureInstance(inst)
+	geoip.ConfigureInstance(inst)
+	handlers.ConfigureInstance(inst)
+	timelog.Configure()
+	tracing.Configure()
+	audit.ConfigureInstance(inst)
+	proxyproto.Configure()
+	selftest.Configure()
+}
+
+// Router the routes of Vouch Proxy's endpoints
+// /metrics is left to the caller when `metrics.listen` puts it on a listener of its own
+func Router() *mux.Router {
+	muxR := mux.NewRouter()
+
+	authH := http.HandlerFunc(handlers.ValidateRequestHandler)
+	muxR.HandleFunc("/validate", timelog.TimeLog(handlers.CORSHandler(handlers.HeadHandler(handlers.NetworkRulesHandler(handlers.CSRFHandler(jwtmanager.JWTCacheHandler(authH)))))))
+	muxR.HandleFunc("/_external-auth-{id}", timelog.TimeLog(handlers.CORSHandler(handlers.HeadHandler(handlers.NetworkRulesHandler(handlers.CSRFHandler(jwtmanager.JWTCacheHandler(authH)))))))
+
+	loginH := http.HandlerFunc(handlers.LoginHandler)
+	muxR.HandleFunc("/login", timelog.TimeLog(tracing.Handler("/login", handlers.CSPHandler(handlers.RateLimitHandler(loginH)))))
+
+	logoutH := http.HandlerFunc(handlers.LogoutHandler)
+	muxR.HandleFunc("/logout", timelog.TimeLog(handlers.CSPHandler(logoutH)))
+
+	backChannelLogoutH := http.HandlerFunc(handlers.BackChannelLogoutHandler)
+	muxR.HandleFunc("/logout/backchannel", timelog.TimeLog(backChannelLogoutH)).Methods("POST")
+
+	authStateH := http.HandlerFunc(handlers.AuthStateHandler)
+	muxR.HandleFunc("/auth/{state}/", timelog.TimeLog(tracing.Handler("/auth/{state}/", handlers.CORSHandler(handlers.CSPHandler(handlers.RateLimitHandler(handlers.LockoutHandler(authStateH)))))))
+	// some proxies normalize away the trailing slash
+	muxR.HandleFunc("/auth/{state}", timelog.TimeLog(tracing.Handler("/auth/{state}/", handlers.CORSHandler(handlers.CSPHandler(handlers.RateLimitHandler(handlers.LockoutHandler(authStateH)))))))
+
+	callH := http.HandlerFunc(handlers.CallbackHandler)
+	muxR.HandleFunc("/auth", timelog.TimeLog(tracing.Handler("/auth", handlers.CORSHandler(handlers.CSPHandler(handlers.RateLimitHandler(handlers.LockoutHandler(callH)))))))
+
+	// the passkey asked for by `vouch.step_up_hosts`
+	stepUpH := http.HandlerFunc(handlers.StepUpHandler)
+	muxR.HandleFunc("/stepup", timelog.TimeLog(handlers.CSPHandler(handlers.RateLimitHandler(handlers.LockoutHandler(stepUpH))))).Methods("GET", "POST")
+
+	// the link with which a user enrols a passkey, for an admin of `vouch.step_up_admin_teams`
+	stepUpEnrolH := http.HandlerFunc(handlers.StepUpEnrolHandler)
+	muxR.HandleFunc("/stepup/enrol", timelog.TimeLog(stepUpEnrolH))
+
+	// the SAML service provider, only answers if saml is configured
+	samlMetadataH := http.HandlerFunc(saml.MetadataHandler)
+	muxR.HandleFunc("/saml/metadata", timelog.TimeLog(handlers.HeadHandler(samlMetadataH)))
+
+	samlACSH := http.HandlerFunc(saml.ACSHandler)
+	muxR.HandleFunc("/saml/acs", timelog.TimeLog(handlers.CSPHandler(handlers.RateLimitHandler(samlACSH)))).Methods("POST")
+
+	// device authorization grant, only answers if oauth.device_auth_url is configured
+	deviceCodeH := http.HandlerFunc(handlers.DeviceCodeHandler)
+	muxR.HandleFunc("/device/code", timelog.TimeLog(deviceCodeH)).Methods("POST")
+
+	deviceTokenH := http.HandlerFunc(handlers.DeviceTokenHandler)
+	muxR.HandleFunc("/device/token", timelog.TimeLog(deviceTokenH)).Methods("POST")
+
+	// the public key of an RS* or ES* jwt.signing_method, for backends verifying the jwt or headers.assertion
+	jwksH := http.HandlerFunc(handlers.JWKSHandler)
+	muxR.HandleFunc("/.well-known/jwks.json", timelog.TimeLog(handlers.HeadHandler(jwksH)))
+
+	healthH := http.HandlerFunc(handlers.HealthcheckHandler)
+	muxR.HandleFunc("/healthcheck", timelog.TimeLog(handlers.HeadHandler(healthH)))
+
+	// the health of each provider, see readiness in the config
+	readyzH := http.HandlerFunc(handlers.ReadyzHandler)
+	muxR.HandleFunc("/readyz", timelog.TimeLog(handlers.HeadHandler(readyzH)))
+
+	// see metrics in the config
+	if cfg.Cfg.Metrics.Enabled && cfg.Cfg.Metrics.Listen == "" {
+		metricsH := http.HandlerFunc(handlers.MetricsHandler)
+		muxR.HandleFunc("/metrics", timelog.TimeLog(handlers.HeadHandler(metricsH)))
+	}
+
+	// setup static
+	sPath, err := filepath.Abs(cfg.RootDir + staticDir)
+	if err != nil {
+		cfg.Logging.Logger.Errorf("couldn't find static assets at %s", sPath)
+	}
+	cfg.Logging.Logger.Debugf("serving static files from %s", sPath)
+	// https://golangcode.com/serve-static-assets-using-the-mux-router/
+	muxR.PathPrefix(staticDir).Handler(http.StripPrefix(staticDir, http.FileServer(http.Dir(sPath))))
+
+	return muxR
+}
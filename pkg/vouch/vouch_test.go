@@ -0,0 +1,187 @@
+/*
+
+Copyright 2020 The Vouch Proxy Authors.
+Use of this source code is governed by The MIT License (MIT) that
+can be found in the LICENSE file. Software distributed under The
+MIT License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES
+OR CONDITIONS OF ANY KIND, either express or implied.
+
+*/
+
+package vouch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// testConfig the configuration of a Vouch
+func testConfig(t *testing.T) (cfg.Config, *cfg.OAuthConfig) {
+	c := cfg.Defaults()
+	c.Domains = []string{"example.com"}
+	c.JWT.Secret = "testingsecretthatisatleastthirtytwocharacters"
+	c.Cookie.Secure = false
+	return c, &cfg.OAuthConfig{
+		Provider:     cfg.Providers.OIDC,
+		ClientID:     "vouch",
+		ClientSecret: "secret",
+		AuthURL:      "https://idp.example.com/auth",
+		TokenURL:     "https://idp.example.com/token",
+		UserInfoURL:  "https://idp.example.com/userinfo",
+		RedirectURL:  "http://vouch.example.com/auth",
+		Scopes:       []string{"openid", "email"},
+	}
+}
+
+func TestNew(t *testing.T) {
+	c, oauth := testConfig(t)
+	_, err := New(c)
+	assert.Error(t, err, "an oauth provider is required")
+	c.Domains = nil
+	c.Cookie.Domain = ""
+	_, err = New(c, oauth)
+	assert.Error(t, err, "the configuration is validated")
+
+	c, oauth = testConfig(t)
+	v, err := New(c, oauth)
+	assert.NoError(t, err)
+	assert.NotNil(t, v.Handlers())
+	assert.Equal(t, "oidc", v.inst.GenOAuth.Name)
+	assert.Equal(t, "VouchCookie", v.inst.Cfg.Cookie.Name, "the defaults of .defaults.yml are kept")
+
+	// a second Vouch has a configuration of its own, and the package configuration is left as it was
+	prev := cfg.Cfg
+	other, otherOAuth := testConfig(t)
+	other.Cookie.Name = "OtherCookie"
+	o, err := New(other, otherOAuth)
+	assert.NoError(t, err)
+	assert.Equal(t, "OtherCookie", o.inst.Cfg.Cookie.Name)
+	assert.Equal(t, "VouchCookie", v.inst.Cfg.Cookie.Name)
+	assert.Equal(t, prev, cfg.Cfg)
+}
+
+func TestValidateToken(t *testing.T) {
+	c, oauth := testConfig(t)
+	v, err := New(c, oauth)
+	assert.NoError(t, err)
+
+	user := structs.User{Username: "test@example.com", Email: "test@example.com", Name: "Test Name"}
+	vpjwt, err := jwtmanager.NewVPJWT(v.context(), user, structs.CustomClaims{Claims: map[string]interface{}{"email": user.Email, "name": user.Name}}, structs.PTokens{})
+	assert.NoError(t, err)
+
+	got, err := v.ValidateToken(vpjwt)
+	assert.NoError(t, err)
+	assert.Equal(t, user.Username, got.Username)
+	assert.Equal(t, user.Email, got.Email)
+	assert.Equal(t, user.Name, got.Name)
+	assert.NoError(t, v.VerifyUser(*got))
+	assert.Error(t, v.VerifyUser(structs.User{Username: "someone", Email: "someone@example.org"}))
+
+	_, err = v.ValidateToken("not.a.jwt")
+	assert.Error(t, err)
+	_, err = v.ValidateToken("")
+	assert.Error(t, err)
+}
+
+func TestHandlers(t *testing.T) {
+	c, oauth := testConfig(t)
+	v, err := New(c, oauth)
+	assert.NoError(t, err)
+
+	vpjwt, err := jwtmanager.NewVPJWT(v.context(), structs.User{Username: "test@example.com", Email: "test@example.com"}, structs.CustomClaims{}, structs.PTokens{})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		path     string
+		jwt      string
+		wantCode int
+	}{
+		{"validate without a jwt", "/validate", "", http.StatusUnauthorized},
+		{"validate", "/validate", vpjwt, http.StatusOK},
+		{"login", "/login?url=http://myapp.example.com/", "", http.StatusFound},
+		{"healthcheck", "/healthcheck", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://myapp.example.com"+tt.path, nil)
+			if tt.jwt != "" {
+				req.AddCookie(&http.Cookie{Name: v.inst.Cfg.Cookie.Name, Value: tt.jwt})
+			}
+			rr := httptest.NewRecorder()
+			v.Handlers().ServeHTTP(rr, req)
+			assert.Equal(t, tt.wantCode, rr.Code)
+		})
+	}
+}
+
+func TestVouchesOfTheirOwn(t *testing.T) {
+	c, oauth := testConfig(t)
+	a, err := New(c, oauth)
+	assert.NoError(t, err)
+
+	c, oauth = testConfig(t)
+	c.Domains = []string{"example.org"}
+	c.JWT.Secret = "anothersecretthatisalsoatleastthirtytwocharacters"
+	c.Cookie.Name = "OtherCookie"
+	oauth.RedirectURL = "http://vouch.example.org/auth"
+	b, err := New(c, oauth)
+	assert.NoError(t, err)
+
+	vouchJWT := func(v *Vouch, user structs.User) string {
+		vpjwt, err := jwtmanager.NewVPJWT(v.context(), user, structs.CustomClaims{}, structs.PTokens{})
+		assert.NoError(t, err)
+		return vpjwt
+	}
+	userA := structs.User{Username: "test@example.com", Email: "test@example.com"}
+	userB := structs.User{Username: "test@example.org", Email: "test@example.org"}
+	jwtA, jwtB := vouchJWT(a, userA), vouchJWT(b, userB)
+
+	tests := []struct {
+		name     string
+		v        *Vouch
+		jwt      string
+		wantUser string
+	}{
+		{"a validates its own jwt", a, jwtA, userA.Username},
+		{"b validates its own jwt", b, jwtB, userB.Username},
+		{"a refuses the jwt of b", a, jwtB, ""},
+		{"b refuses the jwt of a", b, jwtA, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.v.ValidateToken(tt.jwt)
+			if tt.wantUser == "" {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantUser, got.Username)
+		})
+	}
+
+	assert.NoError(t, a.VerifyUser(userA))
+	assert.Error(t, a.VerifyUser(userB))
+	assert.NoError(t, b.VerifyUser(userB))
+	assert.Error(t, b.VerifyUser(userA))
+
+	validate := func(v *Vouch, host, cookieName, jwt string) int {
+		req := httptest.NewRequest("GET", "http://"+host+"/validate", nil)
+		req.AddCookie(&http.Cookie{Name: cookieName, Value: jwt})
+		rr := httptest.NewRecorder()
+		v.Handlers().ServeHTTP(rr, req)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusOK, validate(a, "myapp.example.com", "VouchCookie", jwtA))
+	assert.Equal(t, http.StatusOK, validate(b, "myapp.example.org", "OtherCookie", jwtB))
+	assert.Equal(t, http.StatusUnauthorized, validate(a, "myapp.example.com", "VouchCookie", jwtB))
+	assert.Equal(t, http.StatusUnauthorized, validate(b, "myapp.example.org", "OtherCookie", jwtA))
+	assert.Equal(t, http.StatusUnauthorized, validate(b, "myapp.example.org", "VouchCookie", jwtB), "b reads its own cookie")
+}